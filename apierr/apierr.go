@@ -0,0 +1,137 @@
+// Package apierr defines the error codes returned by the oscar API, the
+// HTTP status each one is sent with, and the body of error responses.
+package apierr
+
+import (
+	"net/http"
+	"sort"
+)
+
+// Code identifies an error returned by the API. Codes are stable; clients
+// depend on them, so they must never be renumbered or reused.
+type Code int
+
+// Codes returned by the API
+const (
+	None                            Code = 0
+	Internal                        Code = 1
+	BadRequest                      Code = 2
+	InvalidUsername                 Code = 3
+	InvalidPublicKey                Code = 4
+	InvalidWrappedSecretKey         Code = 5
+	InvalidWrappedSecretKeyNonce    Code = 6
+	InvalidWrappedSymmetricKey      Code = 7
+	InvalidWrappedSymmetricKeyNonce Code = 8
+	InvalidPasswordSalt             Code = 9
+	UsernameNotAvailable            Code = 10
+	NotFound                        Code = 11
+	InsufficientPermission          Code = 12
+	Argon2iOpsLimitTooLow           Code = 13
+	Argon2iMemLimitTooLow           Code = 14
+	InvalidAccessToken              Code = 15
+	UserNotFound                    Code = 16
+	ChallengeNotFound               Code = 17
+	ChallengeExpired                Code = 18
+	LoginFailed                     Code = 19
+	BackupNotFound                  Code = 20
+	InvalidEmail                    Code = 21
+	MissingVerificationToken        Code = 22
+	InvalidPasswordHashAlgorithm    Code = 23
+	NotAnEndpoint                   Code = 24
+	RateLimited                     Code = 25
+	InvalidPayloadSize              Code = 26
+	RequestTimeout                  Code = 27
+	ClientUpgradeRequired           Code = 28
+	ContentRejected                 Code = 29
+	QuotaExceeded                   Code = 30
+	Draining                        Code = 31
+	RecipientQueueFull              Code = 32
+	InvalidRefreshToken             Code = 33
+	AccountSuspended                Code = 34
+	AccountBanned                   Code = 35
+)
+
+// Info describes a Code for client developers
+type Info struct {
+	Code        Code   `json:"code"`
+	Name        string `json:"name"`
+	Status      int    `json:"http_status"`
+	Description string `json:"description"`
+}
+
+var catalog = map[Code]Info{
+	None:                            {None, "none", http.StatusOK, "No error."},
+	Internal:                        {Internal, "internal", http.StatusInternalServerError, "The server failed to handle the request. Retrying later may succeed."},
+	BadRequest:                      {BadRequest, "bad_request", http.StatusBadRequest, "The request was malformed, e.g. the body couldn't be parsed."},
+	InvalidUsername:                 {InvalidUsername, "invalid_username", http.StatusBadRequest, "Usernames must be 5 to 32 characters, and only contain a-z and 0-9."},
+	InvalidPublicKey:                {InvalidPublicKey, "invalid_public_key", http.StatusBadRequest, "The public key is missing or the wrong size."},
+	InvalidWrappedSecretKey:         {InvalidWrappedSecretKey, "invalid_wrapped_secret_key", http.StatusBadRequest, "The wrapped secret key is missing."},
+	InvalidWrappedSecretKeyNonce:    {InvalidWrappedSecretKeyNonce, "invalid_wrapped_secret_key_nonce", http.StatusBadRequest, "The wrapped secret key nonce is missing."},
+	InvalidWrappedSymmetricKey:      {InvalidWrappedSymmetricKey, "invalid_wrapped_symmetric_key", http.StatusBadRequest, "The wrapped symmetric key is missing."},
+	InvalidWrappedSymmetricKeyNonce: {InvalidWrappedSymmetricKeyNonce, "invalid_wrapped_symmetric_key_nonce", http.StatusBadRequest, "The wrapped symmetric key nonce is missing."},
+	InvalidPasswordSalt:             {InvalidPasswordSalt, "invalid_password_salt", http.StatusBadRequest, "The password salt is missing."},
+	UsernameNotAvailable:            {UsernameNotAvailable, "username_not_available", http.StatusBadRequest, "Another user already has the username."},
+	NotFound:                        {NotFound, "not_found", http.StatusNotFound, "The requested item doesn't exist."},
+	InsufficientPermission:          {InsufficientPermission, "insufficient_permission", http.StatusForbidden, "The user isn't allowed to perform the request."},
+	Argon2iOpsLimitTooLow:           {Argon2iOpsLimitTooLow, "password_hash_ops_limit_too_low", http.StatusBadRequest, "The password hash ops limit is below the interactive limit of the algorithm."},
+	Argon2iMemLimitTooLow:           {Argon2iMemLimitTooLow, "password_hash_mem_limit_too_low", http.StatusBadRequest, "The password hash memory limit is below the interactive limit of the algorithm."},
+	InvalidAccessToken:              {InvalidAccessToken, "invalid_access_token", http.StatusUnauthorized, "The access token, delivery token or admin token is missing, expired or invalid."},
+	UserNotFound:                    {UserNotFound, "user_not_found", http.StatusNotFound, "No user matches the id or username."},
+	ChallengeNotFound:               {ChallengeNotFound, "challenge_not_found", http.StatusNotFound, "The login challenge doesn't exist. Request a new one."},
+	ChallengeExpired:                {ChallengeExpired, "challenge_expired", http.StatusBadRequest, "The login challenge is more than 2 minutes old. Request a new one."},
+	LoginFailed:                     {LoginFailed, "login_failed", http.StatusUnauthorized, "The challenge response didn't verify."},
+	BackupNotFound:                  {BackupNotFound, "backup_not_found", http.StatusNotFound, "The user hasn't saved a backup."},
+	InvalidEmail:                    {InvalidEmail, "invalid_email", http.StatusBadRequest, "The email address is malformed."},
+	MissingVerificationToken:        {MissingVerificationToken, "missing_verification_token", http.StatusBadRequest, "The email verification token is missing."},
+	InvalidPasswordHashAlgorithm:    {InvalidPasswordHashAlgorithm, "invalid_password_hash_algorithm", http.StatusBadRequest, "The password hash algorithm isn't supported."},
+	NotAnEndpoint:                   {NotAnEndpoint, "not_an_endpoint", http.StatusNotFound, "No endpoint matches the method and path."},
+	RateLimited:                     {RateLimited, "rate_limited", http.StatusTooManyRequests, "Too many requests. Retry after a while."},
+	InvalidPayloadSize:              {InvalidPayloadSize, "invalid_payload_size", http.StatusBadRequest, "The payload isn't padded to one of the sizes published in /server-info."},
+	RequestTimeout:                  {RequestTimeout, "request_timeout", http.StatusServiceUnavailable, "The request took too long to handle."},
+	ClientUpgradeRequired:           {ClientUpgradeRequired, "client_upgrade_required", http.StatusUpgradeRequired, "The client is older than the minimum version the server supports for its platform. Prompt the user to update the app."},
+	ContentRejected:                 {ContentRejected, "content_rejected", http.StatusForbidden, "The server's abuse policy refused the message or package."},
+	QuotaExceeded:                   {QuotaExceeded, "quota_exceeded", http.StatusRequestEntityTooLarge, "Storing the upload would put the user over their storage quota."},
+	Draining:                        {Draining, "draining", http.StatusServiceUnavailable, "The server is shutting down, and accepts no new websockets. Retry after the delay in Retry-After, to reach another server."},
+	RecipientQueueFull:              {RecipientQueueFull, "recipient_queue_full", http.StatusTooManyRequests, "The recipient has as many messages queued as the server keeps. Only urgent messages are accepted until they fetch some."},
+	InvalidRefreshToken:             {InvalidRefreshToken, "invalid_refresh_token", http.StatusUnauthorized, "The refresh token is missing, expired or revoked. Log in again."},
+	AccountSuspended:                {AccountSuspended, "account_suspended", http.StatusForbidden, "An admin suspended the account. It can't log in or send anything until the suspension ends or it's reinstated."},
+	AccountBanned:                   {AccountBanned, "account_banned", http.StatusForbidden, "An admin banned the account. It can't log in or send anything."},
+}
+
+// Status returns the HTTP status the code is normally sent with
+func (c Code) Status() int {
+	if info, ok := catalog[c]; ok {
+		return info.Status
+	}
+	return http.StatusInternalServerError
+}
+
+// String returns the name of the code, e.g. "user_not_found"
+func (c Code) String() string {
+	if info, ok := catalog[c]; ok {
+		return info.Name
+	}
+	return "unknown"
+}
+
+// Catalog returns the description of every code, ordered by code
+func Catalog() []Info {
+	infos := make([]Info, 0, len(catalog))
+	for _, info := range catalog {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Code < infos[j].Code })
+	return infos
+}
+
+// Body is the JSON body of every error response
+type Body struct {
+	Message string `json:"error_message"`
+	Code    Code   `json:"error_code"`
+	Name    string `json:"error_name"`
+}
+
+// NewBody returns the response body for an error with code
+func NewBody(code Code, msg string) Body {
+	return Body{Message: msg, Code: code, Name: code.String()}
+}
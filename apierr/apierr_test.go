@@ -0,0 +1,34 @@
+package apierr
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCatalog(t *testing.T) {
+	infos := Catalog()
+	require.Len(t, infos, int(AccountBanned)+1)
+
+	names := map[string]bool{}
+	for i, info := range infos {
+		// codes are contiguous, and every one is documented
+		require.Equal(t, Code(i), info.Code)
+		require.NotEmpty(t, info.Name)
+		require.NotEmpty(t, info.Description)
+		require.False(t, names[info.Name], "duplicate name %s", info.Name)
+		names[info.Name] = true
+	}
+
+	require.Equal(t, http.StatusNotFound, UserNotFound.Status())
+	require.Equal(t, http.StatusInternalServerError, Code(9999).Status())
+	require.Equal(t, "unknown", Code(9999).String())
+}
+
+func TestBody(t *testing.T) {
+	buf, err := json.Marshal(NewBody(RateLimited, "slow down"))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"error_message":"slow down","error_code":25,"error_name":"rate_limited"}`, string(buf))
+}
@@ -0,0 +1,263 @@
+// Package azureblob implements filestor.Provider against Azure Blob Storage.
+package azureblob
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"zood.dev/oscar/filestor"
+)
+
+// apiVersion is the version of the Blob service REST API the provider speaks.
+// Bearer tokens need 2017-11-09 or newer.
+const apiVersion = "2019-12-12"
+
+const defaultEndpointSuffix = "core.windows.net"
+
+// Config describes the container the provider stores files in. Exactly one
+// of ConnectionString and AccountName must be set.
+type Config struct {
+	Container string
+	// ConnectionString authenticates with the account key in it
+	ConnectionString string
+	// AccountName, without a ConnectionString, authenticates as the managed
+	// identity of the VM or container the server runs in
+	AccountName string
+	// ManagedIdentityClientID picks a user-assigned managed identity. When
+	// empty, the system-assigned identity is used.
+	ManagedIdentityClientID string
+	// HTTPClient sends the requests. When nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+}
+
+// authorizer adds credentials to a request
+type authorizer interface {
+	authorize(r *http.Request) error
+}
+
+type azureBlobProvider struct {
+	ctx    context.Context
+	client *http.Client
+	auth   authorizer
+	// container is the url of the container, without a trailing slash
+	container *url.URL
+}
+
+// New returns a filestor.Provider backed by the Azure Blob Storage container
+// in cfg. It checks the container is reachable with the credentials.
+func New(cfg Config) (filestor.Provider, error) {
+	abp, err := newProvider(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err = abp.checkContainer(); err != nil {
+		return nil, errors.Wrapf(err, "unable to access container '%s'", cfg.Container)
+	}
+	return abp, nil
+}
+
+func newProvider(cfg Config) (azureBlobProvider, error) {
+	if cfg.Container == "" {
+		return azureBlobProvider{}, errors.New("must provide a container name")
+	}
+	if (cfg.ConnectionString == "") == (cfg.AccountName == "") {
+		return azureBlobProvider{}, errors.New("must provide either a connection string or an account name")
+	}
+	client := cfg.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	abp := azureBlobProvider{ctx: context.Background(), client: client}
+	endpoint := fmt.Sprintf("https://%s.blob.%s", cfg.AccountName, defaultEndpointSuffix)
+	if cfg.ConnectionString != "" {
+		cs, err := parseConnectionString(cfg.ConnectionString)
+		if err != nil {
+			return azureBlobProvider{}, err
+		}
+		endpoint = cs.blobEndpoint
+		abp.auth = sharedKey{accountName: cs.accountName, accountKey: cs.accountKey}
+	} else {
+		abp.auth = newManagedIdentity(cfg.ManagedIdentityClientID, client)
+	}
+
+	container, err := url.Parse(strings.TrimSuffix(endpoint, "/") + "/" + cfg.Container)
+	if err != nil {
+		return azureBlobProvider{}, errors.Wrap(err, "invalid blob endpoint")
+	}
+	if container.Scheme != "https" && container.Scheme != "http" {
+		return azureBlobProvider{}, errors.Errorf("blob endpoint '%s' must be http or https", endpoint)
+	}
+	abp.container = container
+	return abp, nil
+}
+
+// WithContext fulfills filestor.Provider
+func (abp azureBlobProvider) WithContext(ctx context.Context) filestor.Provider {
+	abp.ctx = ctx
+	return abp
+}
+
+func (abp azureBlobProvider) FileSize(relPath string) (int64, error) {
+	resp, err := abp.do(http.MethodHead, relPath, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+func (abp azureBlobProvider) ReadFile(relPath string) (io.ReadCloser, error) {
+	resp, err := abp.do(http.MethodGet, relPath, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// WriteFile uploads src as a block blob in a single request. It's buffered
+// in memory, since the length has to be known up front.
+func (abp azureBlobProvider) WriteFile(relPath string, src io.Reader) error {
+	body, err := ioutil.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	hdrs := http.Header{}
+	hdrs.Set("x-ms-blob-type", "BlockBlob")
+	resp, err := abp.do(http.MethodPut, relPath, hdrs, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// enumerationResults is a page of a List Blobs response
+type enumerationResults struct {
+	Blobs []struct {
+		Name string `xml:"Name"`
+	} `xml:"Blobs>Blob"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+// ListFiles lists the container a page at a time
+func (abp azureBlobProvider) ListFiles(dir string, fn func(relPath string) error) error {
+	q := url.Values{"restype": {"container"}, "comp": {"list"}}
+	if dir != "" {
+		q.Set("prefix", strings.TrimSuffix(dir, "/")+"/")
+	}
+	for {
+		resp, err := abp.do(http.MethodGet, "?"+q.Encode(), nil, nil)
+		if err != nil {
+			return err
+		}
+		page := enumerationResults{}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return errors.Wrap(err, "invalid list response")
+		}
+		for _, blob := range page.Blobs {
+			if err = fn(blob.Name); err != nil {
+				return err
+			}
+		}
+		if page.NextMarker == "" {
+			return nil
+		}
+		q.Set("marker", page.NextMarker)
+	}
+}
+
+func (abp azureBlobProvider) DeleteFile(relPath string) error {
+	resp, err := abp.do(http.MethodDelete, relPath, nil, nil)
+	if err != nil {
+		if err == filestor.ErrFileNotExist {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// checkContainer fetches the properties of the container
+func (abp azureBlobProvider) checkContainer() error {
+	resp, err := abp.do(http.MethodHead, "?restype=container", nil, nil)
+	if err != nil {
+		if err == filestor.ErrFileNotExist {
+			return errors.New("the container does not exist")
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends an authorized request for the blob at relPath. relPath may carry
+// a query, for requests about the container itself. A 404 is returned as
+// filestor.ErrFileNotExist, and other failures as *Error.
+func (abp azureBlobProvider) do(method, relPath string, hdrs http.Header, body []byte) (*http.Response, error) {
+	u := *abp.container
+	if q := strings.IndexByte(relPath, '?'); q != -1 {
+		u.RawQuery = relPath[q+1:]
+		relPath = relPath[:q]
+	}
+	if relPath != "" {
+		u.Path += "/" + strings.TrimPrefix(relPath, "/")
+	}
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(abp.ctx)
+	for name, vals := range hdrs {
+		req.Header[name] = vals
+	}
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", apiVersion)
+	if err = abp.auth.authorize(req); err != nil {
+		return nil, err
+	}
+
+	resp, err := abp.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, filestor.ErrFileNotExist
+	}
+	apiErr := &Error{StatusCode: resp.StatusCode, Code: resp.Header.Get("x-ms-error-code")}
+	// HEAD responses have no body, so the code comes from the header
+	buf, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	xml.Unmarshal(buf, apiErr)
+	return nil, apiErr
+}
+
+// Error is a failed request to Azure Blob Storage
+type Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("azureblob: %s (%d)", e.Code, e.StatusCode)
+	}
+	return fmt.Sprintf("azureblob: %s (%d): %s", e.Code, e.StatusCode, e.Message)
+}
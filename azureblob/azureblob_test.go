@@ -0,0 +1,226 @@
+package azureblob
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/filestor"
+)
+
+// the well known key of the Azurite emulator
+const testAccountKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+
+func TestParseConnectionString(t *testing.T) {
+	cs, err := parseConnectionString("DefaultEndpointsProtocol=https;AccountName=zood;AccountKey=" + testAccountKey + ";EndpointSuffix=core.windows.net")
+	require.NoError(t, err)
+	require.Equal(t, "zood", cs.accountName)
+	require.Equal(t, "https://zood.blob.core.windows.net", cs.blobEndpoint)
+
+	cs, err = parseConnectionString("AccountName=devstoreaccount1;AccountKey=" + testAccountKey + ";BlobEndpoint=http://127.0.0.1:10000/devstoreaccount1;")
+	require.NoError(t, err)
+	require.Equal(t, "http://127.0.0.1:10000/devstoreaccount1", cs.blobEndpoint)
+
+	for _, bad := range []string{"", "AccountName=zood", "AccountKey=" + testAccountKey, "AccountName=zood;AccountKey=???", "garbage"} {
+		_, err = parseConnectionString(bad)
+		require.Error(t, err, bad)
+	}
+}
+
+func TestStringToSign(t *testing.T) {
+	r, err := http.NewRequest(http.MethodPut, "https://zood.blob.core.windows.net/backups/users/1?timeout=30&comp=block", strings.NewReader("hello"))
+	require.NoError(t, err)
+	r.Header.Set("x-ms-date", "Fri, 26 Jun 2020 21:17:42 GMT")
+	r.Header.Set("x-ms-version", apiVersion)
+	r.Header.Set("x-ms-blob-type", "BlockBlob")
+	r.Header.Set("Content-Type", "application/octet-stream")
+
+	sk := sharedKey{accountName: "zood"}
+	require.Equal(t, "PUT\n\n\n5\n\napplication/octet-stream\n\n\n\n\n\n\n"+
+		"x-ms-blob-type:BlockBlob\n"+
+		"x-ms-date:Fri, 26 Jun 2020 21:17:42 GMT\n"+
+		"x-ms-version:2019-12-12\n"+
+		"/zood/backups/users/1\n"+
+		"comp:block\n"+
+		"timeout:30", sk.stringToSign(r))
+}
+
+// fakeBlobService stores blobs in memory, and checks the shared key
+// signature of every request
+type fakeBlobService struct {
+	t     *testing.T
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func (fbs *fakeBlobService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key, _ := base64.StdEncoding.DecodeString(testAccountKey)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(sharedKey{accountName: "devstoreaccount1"}.stringToSign(r)))
+	expected := "SharedKey devstoreaccount1:" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	if r.Header.Get("Authorization") != expected {
+		w.Header().Set("x-ms-error-code", "AuthenticationFailed")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	fbs.mu.Lock()
+	defer fbs.mu.Unlock()
+
+	if r.URL.Query().Get("restype") == "container" {
+		if r.URL.Query().Get("comp") == "list" {
+			fbs.list(w, r)
+		}
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/devstoreaccount1/oscar/")
+	switch r.Method {
+	case http.MethodPut:
+		require.Equal(fbs.t, "BlockBlob", r.Header.Get("x-ms-blob-type"))
+		fbs.blobs[name], _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet, http.MethodHead:
+		buf, ok := fbs.blobs[name]
+		if !ok {
+			w.Header().Set("x-ms-error-code", "BlobNotFound")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(buf)
+	case http.MethodDelete:
+		if _, ok := fbs.blobs[name]; !ok {
+			w.Header().Set("x-ms-error-code", "BlobNotFound")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(fbs.blobs, name)
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// list answers List Blobs a blob at a time, so every page but the last has
+// a marker
+func (fbs *fakeBlobService) list(w http.ResponseWriter, r *http.Request) {
+	var names []string
+	for name := range fbs.blobs {
+		if strings.HasPrefix(name, r.URL.Query().Get("prefix")) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	start := 0
+	if marker := r.URL.Query().Get("marker"); marker != "" {
+		start, _ = strconv.Atoi(marker)
+	}
+	w.Write([]byte("<EnumerationResults><Blobs>"))
+	if start < len(names) {
+		fmt.Fprintf(w, "<Blob><Name>%s</Name></Blob>", names[start])
+	}
+	w.Write([]byte("</Blobs><NextMarker>"))
+	if start+1 < len(names) {
+		fmt.Fprintf(w, "%d", start+1)
+	}
+	w.Write([]byte("</NextMarker></EnumerationResults>"))
+}
+
+func TestProvider(t *testing.T) {
+	fake := &fakeBlobService{t: t, blobs: map[string][]byte{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	p, err := New(Config{
+		Container:        "oscar",
+		ConnectionString: fmt.Sprintf("AccountName=devstoreaccount1;AccountKey=%s;BlobEndpoint=%s/devstoreaccount1", testAccountKey, server.URL),
+	})
+	require.NoError(t, err)
+
+	_, err = p.ReadFile("should-not-exist")
+	require.Equal(t, filestor.ErrFileNotExist, err)
+	_, err = p.FileSize("should-not-exist")
+	require.Equal(t, filestor.ErrFileNotExist, err)
+
+	data := []byte("Hello, darkness, my old friend")
+	require.NoError(t, p.WriteFile("backups/lyrics.txt", bytes.NewReader(data)))
+	dst, err := filestor.ReadAll(p, "backups/lyrics.txt")
+	require.NoError(t, err)
+	require.Equal(t, data, dst)
+	size, err := p.FileSize("backups/lyrics.txt")
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), size)
+
+	require.NoError(t, p.WriteFile("backups/other.txt", bytes.NewReader(data)))
+	require.NoError(t, p.WriteFile("elsewhere.txt", bytes.NewReader(data)))
+	var listed []string
+	require.NoError(t, p.ListFiles("backups", func(relPath string) error {
+		listed = append(listed, relPath)
+		return nil
+	}))
+	require.Equal(t, []string{"backups/lyrics.txt", "backups/other.txt"}, listed)
+	require.NoError(t, p.DeleteFile("backups/other.txt"))
+	require.NoError(t, p.DeleteFile("backups/other.txt"))
+	_, err = p.FileSize("backups/other.txt")
+	require.Equal(t, filestor.ErrFileNotExist, err)
+
+	// a wrong key is reported when the provider is created
+	wrongKey := base64.StdEncoding.EncodeToString([]byte("wrong"))
+	_, err = New(Config{
+		Container:        "oscar",
+		ConnectionString: fmt.Sprintf("AccountName=devstoreaccount1;AccountKey=%s;BlobEndpoint=%s/devstoreaccount1", wrongKey, server.URL),
+	})
+	require.Error(t, err)
+}
+
+func TestNewValidation(t *testing.T) {
+	_, err := New(Config{AccountName: "zood"})
+	require.Error(t, err)
+	_, err = New(Config{Container: "oscar"})
+	require.Error(t, err)
+	_, err = New(Config{Container: "oscar", AccountName: "zood", ConnectionString: "AccountName=zood;AccountKey=" + testAccountKey})
+	require.Error(t, err)
+
+	abp, err := newProvider(Config{Container: "oscar", AccountName: "zood"})
+	require.NoError(t, err)
+	require.Equal(t, "https://zood.blob.core.windows.net/oscar", abp.container.String())
+}
+
+func TestManagedIdentity(t *testing.T) {
+	var mu sync.Mutex
+	fetches := 0
+	tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "identity-header", r.Header.Get("X-IDENTITY-HEADER"))
+		require.Equal(t, storageResource, r.URL.Query().Get("resource"))
+		require.Equal(t, "client-id", r.URL.Query().Get("client_id"))
+		mu.Lock()
+		fetches++
+		mu.Unlock()
+		fmt.Fprintf(w, `{"access_token": "token", "expires_on": "%d"}`, time.Now().Add(time.Hour).Unix())
+	}))
+	defer tokens.Close()
+
+	mi := newManagedIdentity("client-id", http.DefaultClient)
+	mi.endpoint = tokens.URL
+	mi.header = "identity-header"
+
+	for i := 0; i < 2; i++ {
+		r, err := http.NewRequest(http.MethodGet, "https://zood.blob.core.windows.net/oscar/blob", nil)
+		require.NoError(t, err)
+		require.NoError(t, mi.authorize(r))
+		require.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+	}
+
+	// the token is cached until it's about to expire
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, 1, fetches)
+}
@@ -0,0 +1,120 @@
+package azureblob
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// storageResource is the audience of tokens for Azure Storage
+const storageResource = "https://storage.azure.com/"
+
+// imdsTokenURL is the token endpoint of the instance metadata service
+// available to VMs
+const imdsTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+// tokenRefreshMargin is how long before a token expires that it's replaced
+const tokenRefreshMargin = 5 * time.Minute
+
+// managedIdentity authorizes requests with tokens of the managed identity
+// the server runs as. App Service and Container Apps provide the token
+// endpoint in IDENTITY_ENDPOINT, and VMs via the instance metadata service.
+type managedIdentity struct {
+	// clientID picks a user-assigned identity. When empty, the
+	// system-assigned identity is used.
+	clientID string
+	client   *http.Client
+	// endpoint and header override the token endpoint. They're set from the
+	// environment when the provider is created.
+	endpoint string
+	header   string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func newManagedIdentity(clientID string, client *http.Client) *managedIdentity {
+	return &managedIdentity{
+		clientID: clientID,
+		client:   client,
+		endpoint: os.Getenv("IDENTITY_ENDPOINT"),
+		header:   os.Getenv("IDENTITY_HEADER"),
+	}
+}
+
+func (mi *managedIdentity) authorize(r *http.Request) error {
+	token, err := mi.currentToken()
+	if err != nil {
+		return errors.Wrap(err, "unable to get a managed identity token")
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// currentToken returns a cached token, or fetches a new one when it's about
+// to expire
+func (mi *managedIdentity) currentToken() (string, error) {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+
+	if mi.token != "" && time.Now().Add(tokenRefreshMargin).Before(mi.expires) {
+		return mi.token, nil
+	}
+
+	q := url.Values{}
+	q.Set("resource", storageResource)
+	if mi.clientID != "" {
+		q.Set("client_id", mi.clientID)
+	}
+	endpoint := imdsTokenURL
+	q.Set("api-version", "2018-02-01")
+	if mi.endpoint != "" {
+		endpoint = mi.endpoint
+		q.Set("api-version", "2019-08-01")
+	}
+	req, err := http.NewRequest(http.MethodGet, endpoint+"?"+q.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	if mi.endpoint != "" {
+		req.Header.Set("X-IDENTITY-HEADER", mi.header)
+	} else {
+		req.Header.Set("Metadata", "true")
+	}
+
+	resp, err := mi.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("token endpoint responded with %d", resp.StatusCode)
+	}
+	body := struct {
+		AccessToken string `json:"access_token"`
+		// ExpiresOn is in seconds since the epoch. Both endpoints send it
+		// as a string.
+		ExpiresOn json.Number `json:"expires_on"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", errors.Wrap(err, "unable to decode the token response")
+	}
+	if body.AccessToken == "" {
+		return "", errors.New("the token response has no access token")
+	}
+	expiresOn, err := strconv.ParseInt(body.ExpiresOn.String(), 10, 64)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid token expiry")
+	}
+
+	mi.token = body.AccessToken
+	mi.expires = time.Unix(expiresOn, 0)
+	return mi.token, nil
+}
@@ -0,0 +1,131 @@
+package azureblob
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// connectionString holds the parts of an Azure storage connection string
+// that the provider needs
+type connectionString struct {
+	accountName  string
+	accountKey   []byte
+	blobEndpoint string
+}
+
+// parseConnectionString parses a connection string such as the ones shown in
+// the Azure portal, e.g.
+// "DefaultEndpointsProtocol=https;AccountName=zood;AccountKey=...;EndpointSuffix=core.windows.net".
+// A BlobEndpoint overrides the endpoint built from the other parts, which is
+// how the Azurite emulator is reached.
+func parseConnectionString(s string) (connectionString, error) {
+	parts := map[string]string{}
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		eq := strings.IndexByte(part, '=')
+		if eq == -1 {
+			return connectionString{}, errors.Errorf("malformed connection string part '%s'", part)
+		}
+		parts[part[:eq]] = part[eq+1:]
+	}
+
+	cs := connectionString{accountName: parts["AccountName"]}
+	if cs.accountName == "" {
+		return connectionString{}, errors.New("the connection string has no AccountName")
+	}
+	var err error
+	cs.accountKey, err = base64.StdEncoding.DecodeString(parts["AccountKey"])
+	if err != nil || len(cs.accountKey) == 0 {
+		return connectionString{}, errors.New("the connection string has no valid AccountKey")
+	}
+
+	cs.blobEndpoint = parts["BlobEndpoint"]
+	if cs.blobEndpoint == "" {
+		protocol := parts["DefaultEndpointsProtocol"]
+		if protocol == "" {
+			protocol = "https"
+		}
+		suffix := parts["EndpointSuffix"]
+		if suffix == "" {
+			suffix = defaultEndpointSuffix
+		}
+		cs.blobEndpoint = fmt.Sprintf("%s://%s.blob.%s", protocol, cs.accountName, suffix)
+	}
+	return cs, nil
+}
+
+// sharedKey authorizes requests with the account key, as described at
+// https://docs.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+type sharedKey struct {
+	accountName string
+	accountKey  []byte
+}
+
+func (sk sharedKey) authorize(r *http.Request) error {
+	sum := hmac.New(sha256.New, sk.accountKey)
+	sum.Write([]byte(sk.stringToSign(r)))
+	signature := base64.StdEncoding.EncodeToString(sum.Sum(nil))
+	r.Header.Set("Authorization", fmt.Sprintf("SharedKey %s:%s", sk.accountName, signature))
+	return nil
+}
+
+// stringToSign returns the canonical form of r that gets signed. The
+// x-ms-date header stands in for Date.
+func (sk sharedKey) stringToSign(r *http.Request) string {
+	contentLength := ""
+	if r.ContentLength > 0 {
+		contentLength = strconv.FormatInt(r.ContentLength, 10)
+	}
+	lines := []string{
+		r.Method,
+		r.Header.Get("Content-Encoding"),
+		r.Header.Get("Content-Language"),
+		contentLength,
+		r.Header.Get("Content-MD5"),
+		r.Header.Get("Content-Type"),
+		"", // Date
+		r.Header.Get("If-Modified-Since"),
+		r.Header.Get("If-Match"),
+		r.Header.Get("If-None-Match"),
+		r.Header.Get("If-Unmodified-Since"),
+		r.Header.Get("Range"),
+	}
+
+	var msHeaders []string
+	for name := range r.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-") {
+			msHeaders = append(msHeaders, lower)
+		}
+	}
+	sort.Strings(msHeaders)
+	canonical := &strings.Builder{}
+	for _, name := range msHeaders {
+		fmt.Fprintf(canonical, "%s:%s\n", name, strings.TrimSpace(r.Header.Get(name)))
+	}
+
+	canonical.WriteString("/" + sk.accountName + r.URL.EscapedPath())
+	query := r.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		vals := query[k]
+		sort.Strings(vals)
+		fmt.Fprintf(canonical, "\n%s:%s", strings.ToLower(k), strings.Join(vals, ","))
+	}
+
+	return strings.Join(lines, "\n") + "\n" + canonical.String()
+}
@@ -0,0 +1,118 @@
+package b2
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// account authorizes the application key, and keeps the session it gets
+// until it expires. Sessions last a day.
+type account struct {
+	apiURL         string
+	keyID          string
+	applicationKey string
+	bucketName     string
+	client         *http.Client
+
+	mu      sync.Mutex
+	current *session
+}
+
+// session is the response of b2_authorize_account, along with the id of the
+// bucket
+type session struct {
+	AccountID          string `json:"accountId"`
+	AuthorizationToken string `json:"authorizationToken"`
+	APIURL             string `json:"apiUrl"`
+	DownloadURL        string `json:"downloadUrl"`
+	Allowed            struct {
+		BucketID   string `json:"bucketId"`
+		BucketName string `json:"bucketName"`
+	} `json:"allowed"`
+
+	bucketID string
+}
+
+// session returns the current session, or authorizes a new one if there
+// isn't one or the current one is expired. Requests that find the same
+// session expired at once only renew it once.
+func (a *account) session(ctx context.Context, expired *session) (*session, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.current != nil && a.current != expired {
+		return a.current, nil
+	}
+	s, err := a.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	a.current = s
+	return s, nil
+}
+
+func (a *account) authorize(ctx context.Context) (*session, error) {
+	req, err := http.NewRequest(http.MethodGet, a.apiURL+"/b2api/v2/b2_authorize_account", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(a.keyID, a.applicationKey)
+	resp, err := a.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp, err = checkResponse(resp); err != nil {
+		return nil, errors.Wrap(err, "authorizing the application key")
+	}
+	defer resp.Body.Close()
+	s := &session{}
+	if err = json.NewDecoder(resp.Body).Decode(s); err != nil {
+		return nil, errors.Wrap(err, "invalid authorization response")
+	}
+
+	// a key restricted to a bucket says which one, otherwise it's looked up
+	if s.Allowed.BucketID != "" {
+		if s.Allowed.BucketName != a.bucketName {
+			return nil, errors.Errorf("the application key is restricted to bucket '%s'", s.Allowed.BucketName)
+		}
+		s.bucketID = s.Allowed.BucketID
+		return s, nil
+	}
+	if s.bucketID, err = a.bucketID(ctx, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (a *account) bucketID(ctx context.Context, s *session) (string, error) {
+	body, _ := json.Marshal(map[string]string{"accountId": s.AccountID, "bucketName": a.bucketName})
+	req, err := http.NewRequest(http.MethodPost, s.APIURL+"/b2api/v2/b2_list_buckets", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", s.AuthorizationToken)
+	resp, err := a.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	if resp, err = checkResponse(resp); err != nil {
+		return "", errors.Wrap(err, "looking up the bucket")
+	}
+	defer resp.Body.Close()
+	list := struct {
+		Buckets []struct {
+			BucketID string `json:"bucketId"`
+		} `json:"buckets"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", errors.Wrap(err, "invalid list buckets response")
+	}
+	if len(list.Buckets) == 0 {
+		return "", errors.New("the bucket does not exist")
+	}
+	return list.Buckets[0].BucketID, nil
+}
@@ -0,0 +1,369 @@
+// Package b2 implements filestor.Provider against Backblaze B2, with its
+// native API.
+package b2
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"zood.dev/oscar/filestor"
+)
+
+// defaultAPIURL is where accounts are authorized. The urls of the other
+// calls come from the authorization.
+const defaultAPIURL = "https://api.backblazeb2.com"
+
+// listPageSize is how many file names are asked for per list call. 1000 is
+// the most a call is billed as one transaction for.
+const listPageSize = 1000
+
+// Config describes the bucket the provider stores files in
+type Config struct {
+	// KeyID and ApplicationKey are an application key of the account. A
+	// key restricted to Bucket is enough.
+	KeyID          string
+	ApplicationKey string
+	Bucket         string
+	// APIURL is where accounts are authorized. When empty, the Backblaze
+	// endpoint is used.
+	APIURL string
+	// HTTPClient sends the requests. When nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+}
+
+type b2Provider struct {
+	ctx     context.Context
+	client  *http.Client
+	account *account
+}
+
+// New returns a filestor.Provider backed by the B2 bucket in cfg. It
+// authorizes the key, and checks the bucket is reachable with it.
+//
+// B2 keeps every version of a file, so replacing a file doesn't free the
+// space of the previous version. The bucket's lifecycle should be set to
+// keep only the last version.
+func New(cfg Config) (filestor.Provider, error) {
+	bp, err := newProvider(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = bp.account.session(bp.ctx, nil); err != nil {
+		return nil, errors.Wrapf(err, "unable to access bucket '%s'", cfg.Bucket)
+	}
+	return bp, nil
+}
+
+func newProvider(cfg Config) (b2Provider, error) {
+	if cfg.Bucket == "" {
+		return b2Provider{}, errors.New("must provide a bucket name")
+	}
+	if cfg.KeyID == "" || cfg.ApplicationKey == "" {
+		return b2Provider{}, errors.New("must provide a key id and application key")
+	}
+	apiURL := cfg.APIURL
+	if apiURL == "" {
+		apiURL = defaultAPIURL
+	}
+	if !strings.HasPrefix(apiURL, "https://") && !strings.HasPrefix(apiURL, "http://") {
+		return b2Provider{}, errors.Errorf("api url '%s' must be http or https", apiURL)
+	}
+	client := cfg.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return b2Provider{
+		ctx:    context.Background(),
+		client: client,
+		account: &account{
+			apiURL:         strings.TrimSuffix(apiURL, "/"),
+			keyID:          cfg.KeyID,
+			applicationKey: cfg.ApplicationKey,
+			bucketName:     cfg.Bucket,
+			client:         client,
+		},
+	}, nil
+}
+
+// WithContext fulfills filestor.Provider
+func (bp b2Provider) WithContext(ctx context.Context) filestor.Provider {
+	bp.ctx = ctx
+	return bp
+}
+
+func (bp b2Provider) FileSize(relPath string) (int64, error) {
+	resp, err := bp.download(http.MethodHead, relPath)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+func (bp b2Provider) ReadFile(relPath string) (io.ReadCloser, error) {
+	resp, err := bp.download(http.MethodGet, relPath)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// download requests the file by name from the download url
+func (bp b2Provider) download(method, relPath string) (*http.Response, error) {
+	return bp.withSession(func(s *session) (*http.Response, error) {
+		u := s.DownloadURL + "/file/" + escapeName(bp.account.bucketName) + "/" + escapeName(relPath)
+		req, err := http.NewRequest(method, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", s.AuthorizationToken)
+		return bp.send(req)
+	})
+}
+
+// WriteFile buffers src in memory, since B2 needs the length and the SHA1
+// of the file up front
+func (bp b2Provider) WriteFile(relPath string, src io.Reader) error {
+	body, err := ioutil.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	sum := sha1.Sum(body)
+
+	// upload urls have their own tokens, so an expired one takes getting a
+	// new url rather than a new session
+	for attempt := 0; ; attempt++ {
+		target := struct {
+			UploadURL          string `json:"uploadUrl"`
+			AuthorizationToken string `json:"authorizationToken"`
+		}{}
+		err = bp.call("b2_get_upload_url", func(s *session) interface{} {
+			return map[string]string{"bucketId": s.bucketID}
+		}, &target)
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequest(http.MethodPost, target.UploadURL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", target.AuthorizationToken)
+		req.Header.Set("X-Bz-File-Name", escapeName(relPath))
+		req.Header.Set("Content-Type", "b2/x-auto")
+		req.Header.Set("X-Bz-Content-Sha1", hex.EncodeToString(sum[:]))
+		resp, err := bp.send(req)
+		if err == nil {
+			resp.Body.Close()
+			return nil
+		}
+		if attempt > 0 || !retryableUpload(err) {
+			return err
+		}
+	}
+}
+
+// retryableUpload returns whether an upload failed because of its upload
+// url, in which case it can be retried with another one
+func retryableUpload(err error) bool {
+	apiErr, ok := err.(*Error)
+	if !ok {
+		return false
+	}
+	return apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusServiceUnavailable
+}
+
+type fileInfo struct {
+	FileID   string `json:"fileId"`
+	FileName string `json:"fileName"`
+}
+
+// ListFiles lists the latest version of every file a page at a time
+func (bp b2Provider) ListFiles(dir string, fn func(relPath string) error) error {
+	prefix := ""
+	if dir != "" {
+		prefix = strings.TrimSuffix(dir, "/") + "/"
+	}
+	start := ""
+	for {
+		page := struct {
+			Files        []fileInfo `json:"files"`
+			NextFileName *string    `json:"nextFileName"`
+		}{}
+		err := bp.call("b2_list_file_names", func(s *session) interface{} {
+			return listRequest{BucketID: s.bucketID, Prefix: prefix, StartFileName: start, MaxFileCount: listPageSize}
+		}, &page)
+		if err != nil {
+			return err
+		}
+		for _, f := range page.Files {
+			if err = fn(f.FileName); err != nil {
+				return err
+			}
+		}
+		if page.NextFileName == nil {
+			return nil
+		}
+		start = *page.NextFileName
+	}
+}
+
+type listRequest struct {
+	BucketID      string `json:"bucketId"`
+	Prefix        string `json:"prefix,omitempty"`
+	StartFileName string `json:"startFileName,omitempty"`
+	StartFileID   string `json:"startFileId,omitempty"`
+	MaxFileCount  int    `json:"maxFileCount"`
+}
+
+// DeleteFile deletes every version of the file, so none of its contents are
+// left in the bucket
+func (bp b2Provider) DeleteFile(relPath string) error {
+	for {
+		page := struct {
+			Files []fileInfo `json:"files"`
+		}{}
+		err := bp.call("b2_list_file_versions", func(s *session) interface{} {
+			return listRequest{BucketID: s.bucketID, Prefix: relPath, StartFileName: relPath, MaxFileCount: listPageSize}
+		}, &page)
+		if err != nil {
+			return err
+		}
+		deleted := 0
+		for _, f := range page.Files {
+			// the prefix also matches longer names
+			if f.FileName != relPath {
+				continue
+			}
+			err = bp.call("b2_delete_file_version", func(*session) interface{} {
+				return f
+			}, nil)
+			if err != nil && err != filestor.ErrFileNotExist {
+				return err
+			}
+			deleted++
+		}
+		if deleted < listPageSize {
+			return nil
+		}
+	}
+}
+
+// call makes a call of the B2 API with the body made by mkBody, and decodes
+// the response into dst, unless it's nil. A session that expired is renewed,
+// and the call retried once.
+func (bp b2Provider) call(name string, mkBody func(*session) interface{}, dst interface{}) error {
+	resp, err := bp.withSession(func(s *session) (*http.Response, error) {
+		body, err := json.Marshal(mkBody(s))
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest(http.MethodPost, s.APIURL+"/b2api/v2/"+name, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", s.AuthorizationToken)
+		return bp.send(req)
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if dst == nil {
+		return nil
+	}
+	if err = json.NewDecoder(resp.Body).Decode(dst); err != nil {
+		return errors.Wrapf(err, "invalid %s response", name)
+	}
+	return nil
+}
+
+// withSession sends a request made with the current session, and retries it
+// once with a new session if the token expired
+func (bp b2Provider) withSession(send func(*session) (*http.Response, error)) (*http.Response, error) {
+	s, err := bp.account.session(bp.ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := send(s)
+	if apiErr, ok := err.(*Error); !ok || !apiErr.expiredToken() {
+		return resp, err
+	}
+	if s, err = bp.account.session(bp.ctx, s); err != nil {
+		return nil, err
+	}
+	return send(s)
+}
+
+// send sends req. A 404 is returned as filestor.ErrFileNotExist, and other
+// failures as *Error.
+func (bp b2Provider) send(req *http.Request) (*http.Response, error) {
+	resp, err := bp.client.Do(req.WithContext(bp.ctx))
+	if err != nil {
+		return nil, err
+	}
+	return checkResponse(resp)
+}
+
+func checkResponse(resp *http.Response) (*http.Response, error) {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, filestor.ErrFileNotExist
+	}
+	apiErr := &Error{StatusCode: resp.StatusCode}
+	// HEAD responses have no body, so only the status is known
+	buf, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	json.Unmarshal(buf, apiErr)
+	return nil, apiErr
+}
+
+// escapeName percent encodes a file name for urls and the X-Bz-File-Name
+// header. Slashes are kept, since they're what B2 treats as folders.
+func escapeName(name string) string {
+	b := &strings.Builder{}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// Error is a failed call to B2
+type Error struct {
+	StatusCode int    `json:"status"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return "b2: status " + strconv.Itoa(e.StatusCode)
+	}
+	return fmt.Sprintf("b2: %s (%d): %s", e.Code, e.StatusCode, e.Message)
+}
+
+// expiredToken returns whether the call failed because the session expired.
+// HEAD responses have no body, so any 401 of a download counts.
+func (e *Error) expiredToken() bool {
+	return e.StatusCode == http.StatusUnauthorized && (e.Code == "" || e.Code == "expired_auth_token" || e.Code == "bad_auth_token")
+}
@@ -0,0 +1,247 @@
+package b2
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/filestor"
+)
+
+type fakeVersion struct {
+	id   string
+	data []byte
+}
+
+// fakeB2 keeps every version of the files of a single bucket in memory
+type fakeB2 struct {
+	t      *testing.T
+	url    string
+	mu     sync.Mutex
+	token  string
+	nextID int
+	files  map[string][]fakeVersion
+	// authorizations counts the calls to b2_authorize_account
+	authorizations int
+}
+
+func (fb *fakeB2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	if r.URL.Path == "/b2api/v2/b2_authorize_account" {
+		if id, key, _ := r.BasicAuth(); id != "key-id" || key != "app-key" {
+			fb.fail(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		fb.authorizations++
+		fb.token = fmt.Sprintf("token-%d", fb.authorizations)
+		json.NewEncoder(w).Encode(map[string]string{
+			"accountId":          "account",
+			"authorizationToken": fb.token,
+			"apiUrl":             fb.url,
+			"downloadUrl":        fb.url,
+		})
+		return
+	}
+	if r.Header.Get("Authorization") != fb.token {
+		fb.fail(w, http.StatusUnauthorized, "expired_auth_token")
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/file/bucket/") {
+		versions := fb.files[strings.TrimPrefix(r.URL.Path, "/file/bucket/")]
+		if len(versions) == 0 {
+			fb.fail(w, http.StatusNotFound, "not_found")
+			return
+		}
+		w.Write(versions[len(versions)-1].data)
+		return
+	}
+
+	body := map[string]interface{}{}
+	if r.URL.Path != "/upload" {
+		require.NoError(fb.t, json.NewDecoder(r.Body).Decode(&body))
+	}
+	switch r.URL.Path {
+	case "/b2api/v2/b2_list_buckets":
+		if body["bucketName"] != "bucket" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"buckets": []interface{}{}})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"buckets": []interface{}{map[string]string{"bucketId": "bucket-id"}}})
+	case "/b2api/v2/b2_get_upload_url":
+		require.Equal(fb.t, "bucket-id", body["bucketId"])
+		json.NewEncoder(w).Encode(map[string]string{"uploadUrl": fb.url + "/upload", "authorizationToken": fb.token})
+	case "/upload":
+		data, _ := ioutil.ReadAll(r.Body)
+		sum := sha1.Sum(data)
+		if r.Header.Get("X-Bz-Content-Sha1") != hex.EncodeToString(sum[:]) {
+			fb.fail(w, http.StatusBadRequest, "bad_request")
+			return
+		}
+		name := strings.Replace(r.Header.Get("X-Bz-File-Name"), "%20", " ", -1)
+		fb.nextID++
+		fb.files[name] = append(fb.files[name], fakeVersion{id: fmt.Sprint(fb.nextID), data: data})
+		json.NewEncoder(w).Encode(map[string]string{"fileName": name})
+	case "/b2api/v2/b2_list_file_names":
+		fb.list(w, body, false)
+	case "/b2api/v2/b2_list_file_versions":
+		fb.list(w, body, true)
+	case "/b2api/v2/b2_delete_file_version":
+		name := body["fileName"].(string)
+		versions := fb.files[name]
+		for i, v := range versions {
+			if v.id == body["fileId"] {
+				fb.files[name] = append(versions[:i:i], versions[i+1:]...)
+				json.NewEncoder(w).Encode(body)
+				return
+			}
+		}
+		fb.fail(w, http.StatusBadRequest, "file_not_present")
+	default:
+		fb.fail(w, http.StatusBadRequest, "bad_request")
+	}
+}
+
+// list answers a file at a time, so every page but the last has a next
+// file name
+func (fb *fakeB2) list(w http.ResponseWriter, body map[string]interface{}, versions bool) {
+	prefix, _ := body["prefix"].(string)
+	start, _ := body["startFileName"].(string)
+	var names []string
+	for name, vs := range fb.files {
+		if len(vs) > 0 && strings.HasPrefix(name, prefix) && name >= start {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	resp := map[string]interface{}{}
+	var files []map[string]string
+	if len(names) > 0 {
+		vs := fb.files[names[0]]
+		if !versions {
+			vs = vs[len(vs)-1:]
+		}
+		for _, v := range vs {
+			files = append(files, map[string]string{"fileName": names[0], "fileId": v.id})
+		}
+	}
+	resp["files"] = files
+	if len(names) > 1 {
+		resp["nextFileName"] = names[1]
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (fb *fakeB2) fail(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Error{StatusCode: status, Code: code, Message: code})
+}
+
+func newFake(t *testing.T) (*fakeB2, Config, func()) {
+	fake := &fakeB2{t: t, files: map[string][]fakeVersion{}}
+	server := httptest.NewServer(fake)
+	fake.url = server.URL
+	cfg := Config{KeyID: "key-id", ApplicationKey: "app-key", Bucket: "bucket", APIURL: server.URL}
+	return fake, cfg, server.Close
+}
+
+func TestProvider(t *testing.T) {
+	fake, cfg, done := newFake(t)
+	defer done()
+	p, err := New(cfg)
+	require.NoError(t, err)
+
+	_, err = p.ReadFile("should-not-exist")
+	require.Equal(t, filestor.ErrFileNotExist, err)
+	_, err = p.FileSize("should-not-exist")
+	require.Equal(t, filestor.ErrFileNotExist, err)
+
+	data := []byte("Hello, darkness, my old friend")
+	require.NoError(t, p.WriteFile("backups/lyrics.txt", bytes.NewReader(data)))
+	dst, err := filestor.ReadAll(p, "backups/lyrics.txt")
+	require.NoError(t, err)
+	require.Equal(t, data, dst)
+	size, err := p.FileSize("backups/lyrics.txt")
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), size)
+
+	// replacing a file adds a version
+	data = []byte("*Eggs\n*Milk\n")
+	require.NoError(t, p.WriteFile("backups/lyrics.txt", bytes.NewReader(data)))
+	dst, err = filestor.ReadAll(p, "backups/lyrics.txt")
+	require.NoError(t, err)
+	require.Equal(t, data, dst)
+
+	require.NoError(t, p.WriteFile("backups/a b.txt", bytes.NewReader(data)))
+	require.NoError(t, p.WriteFile("other.txt", bytes.NewReader(data)))
+	var listed []string
+	require.NoError(t, p.ListFiles("backups", func(relPath string) error {
+		listed = append(listed, relPath)
+		return nil
+	}))
+	require.Equal(t, []string{"backups/a b.txt", "backups/lyrics.txt"}, listed)
+
+	// deleting removes every version
+	require.NoError(t, p.DeleteFile("backups/lyrics.txt"))
+	require.NoError(t, p.DeleteFile("backups/lyrics.txt"))
+	_, err = p.FileSize("backups/lyrics.txt")
+	require.Equal(t, filestor.ErrFileNotExist, err)
+	fake.mu.Lock()
+	require.Len(t, fake.files["backups/lyrics.txt"], 0)
+	require.Len(t, fake.files["backups/a b.txt"], 1)
+	fake.mu.Unlock()
+}
+
+func TestExpiredSession(t *testing.T) {
+	fake, cfg, done := newFake(t)
+	defer done()
+	p, err := New(cfg)
+	require.NoError(t, err)
+
+	// the session expires
+	fake.mu.Lock()
+	fake.token = "expired"
+	fake.mu.Unlock()
+	require.NoError(t, p.WriteFile("backups/1.db", bytes.NewReader([]byte("backup"))))
+
+	fake.mu.Lock()
+	fake.token = "expired"
+	fake.mu.Unlock()
+	size, err := p.FileSize("backups/1.db")
+	require.NoError(t, err)
+	require.Equal(t, int64(6), size)
+	require.Equal(t, 3, fake.authorizations)
+}
+
+func TestNewValidation(t *testing.T) {
+	_, err := New(Config{KeyID: "a", ApplicationKey: "b"})
+	require.Error(t, err)
+	_, err = New(Config{Bucket: "bucket"})
+	require.Error(t, err)
+	_, err = New(Config{Bucket: "bucket", KeyID: "a", ApplicationKey: "b", APIURL: "ftp://example.com"})
+	require.Error(t, err)
+
+	_, cfg, done := newFake(t)
+	defer done()
+	// missing buckets and rejected keys are reported when the provider is
+	// created
+	cfg.Bucket = "missing"
+	_, err = New(cfg)
+	require.Error(t, err)
+	cfg.Bucket = "bucket"
+	cfg.ApplicationKey = "wrong"
+	_, err = New(cfg)
+	require.Error(t, err)
+}
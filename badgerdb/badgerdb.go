@@ -0,0 +1,234 @@
+// Package badgerdb implements a kvstor.Provider backed by BadgerDB. Unlike
+// bolt, badger lets transactions write concurrently, so drop box traffic
+// doesn't queue behind a single writer. Values are appended to a value log,
+// which has to be garbage collected with CollectValueLog.
+package badgerdb
+
+import (
+	"encoding/binary"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/pkg/errors"
+	"zood.dev/oscar/kvstor"
+)
+
+// Every kind of data lives in the one keyspace, under its own prefix
+var (
+	userIDsPrefix             = []byte("user_ids:")
+	publicIDsPrefix           = []byte("public_ids:")
+	dropboxesPrefix           = []byte("drop_boxes:")
+	contentNamesPrefix        = []byte("content_names:")
+	contentRefsPrefix         = []byte("content_refs:")
+	debugCapturesPrefix       = []byte("debug_captures:")
+	debugCaptureRecordsPrefix = []byte("debug_capture_records:")
+	boxAliasesPrefix          = []byte("box_aliases:")
+	aliasedBoxesPrefix        = []byte("aliased_boxes:")
+	emailQueuePrefix          = []byte("email_queue:")
+	deadLettersPrefix         = []byte("dead_letters:")
+	spentTokensPrefix         = []byte("spent_tokens:")
+	incidentKey               = []byte("server_status:incident")
+)
+
+// maxConflictRetries is how often a read-write transaction is retried when
+// another transaction changed what it read
+const maxConflictRetries = 10
+
+// valueLogDiscardRatio is the share of a value log file that has to be
+// garbage before the file is rewritten
+const valueLogDiscardRatio = 0.5
+
+type badgerProvider struct {
+	db *badger.DB
+}
+
+// Provider is a kvstor.Provider whose value log can be garbage collected
+type Provider interface {
+	kvstor.Provider
+	kvstor.Lister
+	// CollectValueLog rewrites the value log files that are mostly
+	// garbage, and returns how many it rewrote
+	CollectValueLog() (int, error)
+	Close() error
+}
+
+// New returns a Provider backed by a badger database in the directory dir,
+// which is created if needed
+func New(dir string) (Provider, error) {
+	opts := badger.DefaultOptions(dir).WithLogger(nil)
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+	return badgerProvider{db: db}, nil
+}
+
+// Close fulfills Provider
+func (bp badgerProvider) Close() error {
+	return bp.db.Close()
+}
+
+// CollectValueLog fulfills Provider
+func (bp badgerProvider) CollectValueLog() (int, error) {
+	rewritten := 0
+	for {
+		err := bp.db.RunValueLogGC(valueLogDiscardRatio)
+		if err == badger.ErrNoRewrite {
+			return rewritten, nil
+		}
+		if err != nil {
+			return rewritten, err
+		}
+		rewritten++
+	}
+}
+
+func key(prefix []byte, id []byte) []byte {
+	return append(append([]byte{}, prefix...), id...)
+}
+
+func int64Key(prefix []byte, id int64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(id))
+	return key(prefix, buf)
+}
+
+// update runs fn in a read-write transaction, retrying it while it
+// conflicts with other transactions
+func (bp badgerProvider) update(fn func(txn *badger.Txn) error) error {
+	var err error
+	for i := 0; i < maxConflictRetries; i++ {
+		err = bp.db.Update(fn)
+		if err != badger.ErrConflict {
+			return err
+		}
+	}
+	return errors.Wrap(err, "giving up after retrying")
+}
+
+// get returns a copy of the value of k, or nil
+func get(txn *badger.Txn, k []byte) ([]byte, error) {
+	item, err := txn.Get(k)
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
+
+// getInt64 returns the int64 value of k, or 0
+func getInt64(txn *badger.Txn, k []byte) (int64, error) {
+	buf, err := get(txn, k)
+	if err != nil || buf == nil {
+		return 0, err
+	}
+	if len(buf) != 8 {
+		return 0, errors.Errorf("expected 8 bytes. Given %d.", len(buf))
+	}
+	return int64(binary.BigEndian.Uint64(buf)), nil
+}
+
+func int64Value(i int64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(i))
+	return buf
+}
+
+// DropPackage fulfills kvstor.Provider. Drops never read, so concurrent
+// drops can't conflict. The expiry is badger's own, so expired packages
+// aren't read, and their space is reclaimed by CollectValueLog.
+func (bp badgerProvider) DropPackage(pkg []byte, boxID []byte, expires int64) error {
+	return bp.db.Update(func(txn *badger.Txn) error {
+		e := badger.NewEntry(key(dropboxesPrefix, boxID), pkg)
+		e.ExpiresAt = uint64(expires)
+		return txn.SetEntry(e)
+	})
+}
+
+// PickUpPackage fulfills kvstor.Provider
+func (bp badgerProvider) PickUpPackage(boxID []byte) ([]byte, error) {
+	var pkg []byte
+	err := bp.db.View(func(txn *badger.Txn) error {
+		var err error
+		pkg, err = get(txn, key(dropboxesPrefix, boxID))
+		return err
+	})
+	return pkg, err
+}
+
+// PurgeExpiredPackages fulfills kvstor.Provider. Badger drops expired
+// packages itself, so there's nothing to purge.
+func (bp badgerProvider) PurgeExpiredPackages(now int64) (int, error) {
+	return 0, nil
+}
+
+// Incident fulfills kvstor.IncidentNotice
+func (bp badgerProvider) Incident() ([]byte, error) {
+	var notice []byte
+	err := bp.db.View(func(txn *badger.Txn) error {
+		var err error
+		notice, err = get(txn, incidentKey)
+		return err
+	})
+	return notice, err
+}
+
+// SetIncident fulfills kvstor.IncidentNotice
+func (bp badgerProvider) SetIncident(notice []byte) error {
+	return bp.db.Update(func(txn *badger.Txn) error {
+		if notice == nil {
+			return txn.Delete(incidentKey)
+		}
+		return txn.Set(incidentKey, notice)
+	})
+}
+
+// InsertIds fulfills kvstor.Provider
+func (bp badgerProvider) InsertIds(userID int64, pubID []byte) error {
+	return bp.db.Update(func(txn *badger.Txn) error {
+		if err := txn.Set(key(userIDsPrefix, pubID), int64Value(userID)); err != nil {
+			return err
+		}
+		return txn.Set(int64Key(publicIDsPrefix, userID), pubID)
+	})
+}
+
+// PublicIDFromUserID fulfills kvstor.Provider
+func (bp badgerProvider) PublicIDFromUserID(userID int64) ([]byte, error) {
+	var pubID []byte
+	err := bp.db.View(func(txn *badger.Txn) error {
+		var err error
+		pubID, err = get(txn, int64Key(publicIDsPrefix, userID))
+		return err
+	})
+	return pubID, err
+}
+
+// UserIDFromPublicID fulfills kvstor.Provider. It returns 0 when there's no
+// user with pubID.
+func (bp badgerProvider) UserIDFromPublicID(pubID []byte) (int64, error) {
+	var userID int64
+	err := bp.db.View(func(txn *badger.Txn) error {
+		var err error
+		userID, err = getInt64(txn, key(userIDsPrefix, pubID))
+		return err
+	})
+	return userID, err
+}
+
+// keysWithPrefix returns the keys starting with prefix, in order, with the
+// prefix removed
+func keysWithPrefix(txn *badger.Txn, prefix []byte) [][]byte {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = prefix
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	var keys [][]byte
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		keys = append(keys, it.Item().KeyCopy(nil)[len(prefix):])
+	}
+	return keys
+}
@@ -0,0 +1,336 @@
+package badgerdb
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"zood.dev/oscar/kvstor"
+)
+
+// temp opens a database in a new temporary directory, and returns the func
+// removing it
+func temp(t testing.TB) (Provider, func()) {
+	dir, err := ioutil.TempDir("", "badgerdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := New(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestPackages(t *testing.T) {
+	db, done := temp(t)
+	defer done()
+	box := []byte("box")
+
+	pkg, err := db.PickUpPackage(box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkg) != 0 {
+		t.Fatalf("the box should be empty. Got '%s'", pkg)
+	}
+	if err = db.DropPackage([]byte("package"), box, 0); err != nil {
+		t.Fatal(err)
+	}
+	if pkg, _ = db.PickUpPackage(box); string(pkg) != "package" {
+		t.Fatalf("expected the package. Got '%s'", pkg)
+	}
+
+	// wipe the package
+	if err = db.DropPackage(nil, box, 0); err != nil {
+		t.Fatal(err)
+	}
+	if pkg, _ = db.PickUpPackage(box); len(pkg) != 0 {
+		t.Fatalf("the box should have been wiped. Got '%s'", pkg)
+	}
+}
+
+func TestIDs(t *testing.T) {
+	db, done := temp(t)
+	defer done()
+	pubID := []byte("public id made of random data")
+
+	if userID, err := db.UserIDFromPublicID(pubID); err != nil || userID != 0 {
+		t.Fatalf("expected no user id. Got %d, %v", userID, err)
+	}
+	if err := db.InsertIds(300, pubID); err != nil {
+		t.Fatal(err)
+	}
+	if userID, err := db.UserIDFromPublicID(pubID); err != nil || userID != 300 {
+		t.Fatalf("expected user id 300. Got %d, %v", userID, err)
+	}
+	if id, err := db.PublicIDFromUserID(300); err != nil || !bytes.Equal(id, pubID) {
+		t.Fatalf("expected the public id. Got '%s', %v", id, err)
+	}
+}
+
+func TestConcurrentDrops(t *testing.T) {
+	db, done := temp(t)
+	defer done()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			box := []byte(fmt.Sprintf("box %d", i))
+			if err := db.DropPackage([]byte(fmt.Sprintf("package %d", i)), box, 0); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 50; i++ {
+		pkg, err := db.PickUpPackage([]byte(fmt.Sprintf("box %d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(pkg) != fmt.Sprintf("package %d", i) {
+			t.Fatalf("box %d holds '%s'", i, pkg)
+		}
+	}
+}
+
+func TestContentIndex(t *testing.T) {
+	db, done := temp(t)
+	defer done()
+	hashA := []byte("hash a")
+	hashB := []byte("hash b")
+
+	for _, name := range []string{"backups/1", "backups/2", "other/1"} {
+		if _, _, err := db.LinkContent(name, hashA); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if refs, _ := db.ContentReferences(hashA); refs != 3 {
+		t.Fatalf("expected 3 references to hash a. Got %d", refs)
+	}
+
+	old, oldRefs, err := db.LinkContent("backups/1", hashB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(old, hashA) || oldRefs != 2 {
+		t.Fatalf("expected hash a with 2 references left. Got '%s' with %d", old, oldRefs)
+	}
+	if hash, _ := db.ContentHash("backups/1"); !bytes.Equal(hash, hashB) {
+		t.Fatalf("expected hash b. Got '%s'", hash)
+	}
+
+	var names []string
+	err = db.ContentNames("backups/", func(name string) error {
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"backups/1", "backups/2"}) {
+		t.Fatalf("unexpected names: %v", names)
+	}
+
+	old, oldRefs, err = db.UnlinkContent("backups/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(old, hashB) || oldRefs != 0 {
+		t.Fatalf("expected hash b with no references left. Got '%s' with %d", old, oldRefs)
+	}
+	if refs, _ := db.ContentReferences(hashB); refs != 0 {
+		t.Fatalf("expected hash b to be gone. Got %d references", refs)
+	}
+	if old, _, _ = db.UnlinkContent("backups/1"); old != nil {
+		t.Fatalf("unlinking a missing name shouldn't release a hash. Got '%s'", old)
+	}
+}
+
+func TestDebugCaptures(t *testing.T) {
+	db, done := temp(t)
+	defer done()
+
+	if err := db.StartDebugCapture(7, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if until, _ := db.DebugCaptureUntil(7); until != 1000 {
+		t.Fatalf("expected the capture to last until 1000. Got %d", until)
+	}
+	for i := 0; i < 5; i++ {
+		if err := db.AppendDebugCapture(7, []byte(fmt.Sprintf("record %d", i)), 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records, err := db.DebugCapture(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || string(records[0]) != "record 2" || string(records[2]) != "record 4" {
+		t.Fatalf("expected the latest 3 records. Got %q", records)
+	}
+
+	if err = db.DeleteDebugCapture(7); err != nil {
+		t.Fatal(err)
+	}
+	if until, _ := db.DebugCaptureUntil(7); until != 0 {
+		t.Fatalf("expected the capture to be deleted. Got one until %d", until)
+	}
+	if records, _ = db.DebugCapture(7); len(records) != 0 {
+		t.Fatalf("expected the records to be deleted. Got %q", records)
+	}
+}
+
+func TestEmailQueue(t *testing.T) {
+	db, cleanup := temp(t)
+	defer cleanup()
+
+	if err := db.QueueEmail("a", []byte("email a"), 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueueEmail("b", []byte("email b"), 200); err != nil {
+		t.Fatal(err)
+	}
+	due, err := db.DueEmails(150, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(due, map[string][]byte{"a": []byte("email a")}) {
+		t.Fatalf("expected only email a to be due. Got %v", due)
+	}
+	if due, _ = db.DueEmails(250, 1); len(due) != 1 {
+		t.Fatalf("expected a single email. Got %d", len(due))
+	}
+
+	// queueing again reschedules
+	if err = db.QueueEmail("a", []byte("retried a"), 300); err != nil {
+		t.Fatal(err)
+	}
+	if due, _ = db.DueEmails(250, 10); !reflect.DeepEqual(due, map[string][]byte{"b": []byte("email b")}) {
+		t.Fatalf("expected only email b to be due. Got %v", due)
+	}
+
+	// replacing keeps when the email is due
+	if replaced, err := db.ReplaceQueuedEmail("b", []byte("resealed b")); err != nil || !replaced {
+		t.Fatalf("expected email b to be replaced. Got %v, %v", replaced, err)
+	}
+	if due, _ = db.DueEmails(250, 10); !reflect.DeepEqual(due, map[string][]byte{"b": []byte("resealed b")}) {
+		t.Fatalf("expected the replaced email b to be due. Got %v", due)
+	}
+	if replaced, err := db.ReplaceQueuedEmail("c", []byte("email c")); err != nil || replaced {
+		t.Fatalf("expected unknown email c to be left alone. Got %v, %v", replaced, err)
+	}
+
+	if err = db.DequeueEmail("b", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.DequeueEmail("a", []byte("dead a")); err != nil {
+		t.Fatal(err)
+	}
+	if due, _ = db.DueEmails(1000, 10); len(due) != 0 {
+		t.Fatalf("expected an empty queue. Got %v", due)
+	}
+	letters, err := db.DeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(letters, map[string][]byte{"a": []byte("dead a")}) {
+		t.Fatalf("expected the dead letter of a. Got %v", letters)
+	}
+	if replaced, err := db.ReplaceDeadLetter("a", []byte("resealed a")); err != nil || !replaced {
+		t.Fatalf("expected the dead letter of a to be replaced. Got %v, %v", replaced, err)
+	}
+	if letters, _ = db.DeadLetters(); !reflect.DeepEqual(letters, map[string][]byte{"a": []byte("resealed a")}) {
+		t.Fatalf("expected the replaced dead letter of a. Got %v", letters)
+	}
+
+	if err = db.DeleteDeadLetter("a"); err != nil {
+		t.Fatal(err)
+	}
+	if letters, _ = db.DeadLetters(); len(letters) != 0 {
+		t.Fatalf("expected no dead letters. Got %v", letters)
+	}
+	if replaced, err := db.ReplaceDeadLetter("a", []byte("resealed a")); err != nil || replaced {
+		t.Fatalf("expected the deleted dead letter to stay deleted. Got %v, %v", replaced, err)
+	}
+}
+
+func TestSpentTokens(t *testing.T) {
+	db, cleanup := temp(t)
+	defer cleanup()
+
+	expires := time.Now().Add(time.Hour).Unix()
+	if spent, err := db.SpendToken([]byte("a"), expires); err != nil || !spent {
+		t.Fatalf("expected a to be spent. Got %v, %v", spent, err)
+	}
+	if spent, err := db.SpendToken([]byte("a"), expires); err != nil || spent {
+		t.Fatalf("expected a to be spent already. Got %v, %v", spent, err)
+	}
+	if spent, err := db.SpendToken([]byte("b"), expires); err != nil || !spent {
+		t.Fatalf("expected b to be spent. Got %v, %v", spent, err)
+	}
+}
+
+func TestBoxAliases(t *testing.T) {
+	db, done := temp(t)
+	defer done()
+
+	now := time.Now().Unix()
+	for _, alias := range []string{"alias 1", "alias 2"} {
+		if err := db.AddBoxAlias([]byte("box"), []byte(alias), 7, now+60); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.AddBoxAlias([]byte("box"), []byte("alias 3"), 7, now-1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddBoxAlias([]byte("box"), []byte("alias 4"), 8, now+60); err != kvstor.ErrBoxOwner {
+		t.Fatalf("expected ErrBoxOwner. Got %v", err)
+	}
+
+	// alias 1 keeps the grace period it was given when alias 2 was added
+	for alias, expected := range map[string][]byte{"alias 1": []byte("box"), "alias 2": nil, "alias 3": []byte("box"), "alias 4": nil} {
+		box, err := db.BoxOfAlias([]byte(alias))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(box, expected) {
+			t.Fatalf("expected %s to lead to %q. Got %q", alias, expected, box)
+		}
+	}
+
+	var listed []string
+	err := db.ListBoxAliases(func(alias, boxID []byte, ownerID int64, expires int64) error {
+		listed = append(listed, fmt.Sprintf("%s=%s/%d@%d", alias, boxID, ownerID, expires))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{fmt.Sprintf("alias 1=box/7@%d", now+60), "alias 3=box/7@0"}
+	if !reflect.DeepEqual(listed, expected) {
+		t.Fatalf("expected %q. Got %q", expected, listed)
+	}
+}
+
+func TestCollectValueLog(t *testing.T) {
+	db, done := temp(t)
+	defer done()
+
+	// nothing is garbage yet
+	if _, err := db.CollectValueLog(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,106 @@
+package badgerdb
+
+import (
+	"encoding/binary"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/pkg/errors"
+	"zood.dev/oscar/kvstor"
+)
+
+// Each alias is keyed to its box, with badger's own expiry once it stops
+// being current. Each aliased box is keyed to its owner, followed by its
+// current alias.
+
+// AddBoxAlias fulfills kvstor.BoxAliases. Adding aliases to the same box
+// conflicts, and is retried.
+func (bp badgerProvider) AddBoxAlias(boxID, alias []byte, ownerID int64, graceUntil int64) error {
+	return bp.update(func(txn *badger.Txn) error {
+		buf, err := get(txn, key(aliasedBoxesPrefix, boxID))
+		if err != nil {
+			return err
+		}
+		if buf != nil {
+			owner, current, err := splitAliasedBox(buf)
+			if err != nil {
+				return errors.Wrapf(err, "aliases of box %x", boxID)
+			}
+			if owner != ownerID {
+				return kvstor.ErrBoxOwner
+			}
+			// the previous alias may already have expired
+			prev, err := get(txn, key(boxAliasesPrefix, current))
+			if err != nil {
+				return err
+			}
+			if prev != nil {
+				e := badger.NewEntry(key(boxAliasesPrefix, current), prev)
+				e.ExpiresAt = uint64(graceUntil)
+				if err = txn.SetEntry(e); err != nil {
+					return err
+				}
+			}
+		}
+		if err = txn.Set(key(boxAliasesPrefix, alias), boxID); err != nil {
+			return err
+		}
+		return txn.Set(key(aliasedBoxesPrefix, boxID), append(int64Value(ownerID), alias...))
+	})
+}
+
+// BoxOfAlias fulfills kvstor.BoxAliases
+func (bp badgerProvider) BoxOfAlias(alias []byte) ([]byte, error) {
+	var boxID []byte
+	err := bp.db.View(func(txn *badger.Txn) error {
+		var err error
+		boxID, err = get(txn, key(boxAliasesPrefix, alias))
+		return err
+	})
+	return boxID, err
+}
+
+// PurgeExpiredBoxAliases fulfills kvstor.BoxAliases. Badger drops expired
+// aliases itself, so there's nothing to purge.
+func (bp badgerProvider) PurgeExpiredBoxAliases(now int64) (int, error) {
+	return 0, nil
+}
+
+// ListBoxAliases fulfills kvstor.Lister
+func (bp badgerProvider) ListBoxAliases(fn func(alias, boxID []byte, ownerID int64, expires int64) error) error {
+	return bp.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = boxAliasesPrefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(boxAliasesPrefix); it.ValidForPrefix(boxAliasesPrefix); it.Next() {
+			item := it.Item()
+			boxID, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			buf, err := get(txn, key(aliasedBoxesPrefix, boxID))
+			if err != nil {
+				return err
+			}
+			ownerID, _, err := splitAliasedBox(buf)
+			if err != nil {
+				return errors.Wrapf(err, "aliases of box %x", boxID)
+			}
+			alias := item.KeyCopy(nil)[len(boxAliasesPrefix):]
+			if err = fn(alias, boxID, ownerID, int64(item.ExpiresAt())); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// splitAliasedBox splits the value of an aliased box into the owner and the
+// current alias
+func splitAliasedBox(buf []byte) (int64, []byte, error) {
+	if len(buf) < 8 {
+		return 0, nil, errors.Errorf("expected at least 8 bytes. Given %d.", len(buf))
+	}
+	return int64(binary.BigEndian.Uint64(buf[:8])), buf[8:], nil
+}
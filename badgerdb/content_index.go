@@ -0,0 +1,121 @@
+package badgerdb
+
+import (
+	"bytes"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// ContentHash fulfills kvstor.ContentIndex
+func (bp badgerProvider) ContentHash(name string) ([]byte, error) {
+	var hash []byte
+	err := bp.db.View(func(txn *badger.Txn) error {
+		var err error
+		hash, err = get(txn, key(contentNamesPrefix, []byte(name)))
+		return err
+	})
+	return hash, err
+}
+
+// ContentReferences fulfills kvstor.ContentIndex
+func (bp badgerProvider) ContentReferences(hash []byte) (int64, error) {
+	var refs int64
+	err := bp.db.View(func(txn *badger.Txn) error {
+		var err error
+		refs, err = getInt64(txn, key(contentRefsPrefix, hash))
+		return err
+	})
+	return refs, err
+}
+
+// LinkContent fulfills kvstor.ContentIndex
+func (bp badgerProvider) LinkContent(name string, hash []byte) ([]byte, int64, error) {
+	var old []byte
+	var oldRefs int64
+	err := bp.update(func(txn *badger.Txn) error {
+		// reset, since a conflict runs this again
+		old, oldRefs = nil, 0
+		nameKey := key(contentNamesPrefix, []byte(name))
+		cur, err := get(txn, nameKey)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(cur, hash) {
+			return nil
+		}
+		old = cur
+		if err = txn.Set(nameKey, hash); err != nil {
+			return err
+		}
+		if _, err = addContentRefs(txn, hash, 1); err != nil {
+			return err
+		}
+		if old == nil {
+			return nil
+		}
+		oldRefs, err = addContentRefs(txn, old, -1)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return old, oldRefs, nil
+}
+
+// UnlinkContent fulfills kvstor.ContentIndex
+func (bp badgerProvider) UnlinkContent(name string) ([]byte, int64, error) {
+	var old []byte
+	var oldRefs int64
+	err := bp.update(func(txn *badger.Txn) error {
+		old, oldRefs = nil, 0
+		nameKey := key(contentNamesPrefix, []byte(name))
+		cur, err := get(txn, nameKey)
+		if err != nil || cur == nil {
+			return err
+		}
+		old = cur
+		if err = txn.Delete(nameKey); err != nil {
+			return err
+		}
+		oldRefs, err = addContentRefs(txn, old, -1)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return old, oldRefs, nil
+}
+
+// ContentNames fulfills kvstor.ContentIndex. The names are collected before
+// fn is called, so fn can change the index.
+func (bp badgerProvider) ContentNames(prefix string, fn func(name string) error) error {
+	var names [][]byte
+	err := bp.db.View(func(txn *badger.Txn) error {
+		names = keysWithPrefix(txn, key(contentNamesPrefix, []byte(prefix)))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err = fn(prefix + string(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addContentRefs adds delta to the references of hash, and returns the new
+// count. Hashes without references are removed.
+func addContentRefs(txn *badger.Txn, hash []byte, delta int64) (int64, error) {
+	refsKey := key(contentRefsPrefix, hash)
+	refs, err := getInt64(txn, refsKey)
+	if err != nil {
+		return 0, err
+	}
+	refs += delta
+	if refs <= 0 {
+		return 0, txn.Delete(refsKey)
+	}
+	return refs, txn.Set(refsKey, int64Value(refs))
+}
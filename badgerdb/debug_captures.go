@@ -0,0 +1,103 @@
+package badgerdb
+
+import (
+	"encoding/binary"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// The records of each user are keyed by the user's id and a big endian
+// sequence number, so they're iterated in the order they were added.
+
+func debugCaptureRecordsKey(userID int64) []byte {
+	return append(int64Key(debugCaptureRecordsPrefix, userID), ':')
+}
+
+// StartDebugCapture fulfills kvstor.DebugCaptures
+func (bp badgerProvider) StartDebugCapture(userID int64, until int64) error {
+	return bp.update(func(txn *badger.Txn) error {
+		if err := deleteDebugCaptureRecords(txn, userID); err != nil {
+			return err
+		}
+		return txn.Set(int64Key(debugCapturesPrefix, userID), int64Value(until))
+	})
+}
+
+// DebugCaptureUntil fulfills kvstor.DebugCaptures
+func (bp badgerProvider) DebugCaptureUntil(userID int64) (int64, error) {
+	var until int64
+	err := bp.db.View(func(txn *badger.Txn) error {
+		var err error
+		until, err = getInt64(txn, int64Key(debugCapturesPrefix, userID))
+		return err
+	})
+	return until, err
+}
+
+// AppendDebugCapture fulfills kvstor.DebugCaptures. Appends for the same
+// user conflict, and are retried.
+func (bp badgerProvider) AppendDebugCapture(userID int64, record []byte, max int) error {
+	prefix := debugCaptureRecordsKey(userID)
+	return bp.update(func(txn *badger.Txn) error {
+		seqs := keysWithPrefix(txn, prefix)
+		var next uint64
+		if len(seqs) > 0 {
+			next = binary.BigEndian.Uint64(seqs[len(seqs)-1]) + 1
+		}
+		seq := make([]byte, 8)
+		binary.BigEndian.PutUint64(seq, next)
+		if err := txn.Set(key(prefix, seq), record); err != nil {
+			return err
+		}
+
+		for excess := len(seqs) + 1 - max; excess > 0; excess-- {
+			if err := txn.Delete(key(prefix, seqs[0])); err != nil {
+				return err
+			}
+			seqs = seqs[1:]
+		}
+		return nil
+	})
+}
+
+// DebugCapture fulfills kvstor.DebugCaptures
+func (bp badgerProvider) DebugCapture(userID int64) ([][]byte, error) {
+	prefix := debugCaptureRecordsKey(userID)
+	var records [][]byte
+	err := bp.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			record, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			records = append(records, record)
+		}
+		return nil
+	})
+	return records, err
+}
+
+// DeleteDebugCapture fulfills kvstor.DebugCaptures
+func (bp badgerProvider) DeleteDebugCapture(userID int64) error {
+	return bp.update(func(txn *badger.Txn) error {
+		if err := deleteDebugCaptureRecords(txn, userID); err != nil {
+			return err
+		}
+		return txn.Delete(int64Key(debugCapturesPrefix, userID))
+	})
+}
+
+func deleteDebugCaptureRecords(txn *badger.Txn, userID int64) error {
+	prefix := debugCaptureRecordsKey(userID)
+	for _, seq := range keysWithPrefix(txn, prefix) {
+		if err := txn.Delete(key(prefix, seq)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
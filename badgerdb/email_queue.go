@@ -0,0 +1,128 @@
+package badgerdb
+
+import (
+	"encoding/binary"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/pkg/errors"
+)
+
+// Each queued email is kept under its id, after the 8 bytes of when it's
+// due. The queue is short, so it's scanned for the due emails rather than
+// indexed by time.
+
+// QueueEmail fulfills kvstor.EmailQueue
+func (bp badgerProvider) QueueEmail(id string, email []byte, due int64) error {
+	return bp.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(key(emailQueuePrefix, []byte(id)), append(int64Value(due), email...))
+	})
+}
+
+// DueEmails fulfills kvstor.EmailQueue
+func (bp badgerProvider) DueEmails(now int64, max int) (map[string][]byte, error) {
+	emails := map[string][]byte{}
+	err := bp.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = emailQueuePrefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(emailQueuePrefix); it.ValidForPrefix(emailQueuePrefix) && len(emails) < max; it.Next() {
+			buf, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			id := it.Item().KeyCopy(nil)[len(emailQueuePrefix):]
+			if len(buf) < 8 {
+				return errors.Errorf("queued email %s is cut short", id)
+			}
+			if int64(binary.BigEndian.Uint64(buf)) <= now {
+				emails[string(id)] = buf[8:]
+			}
+		}
+		return nil
+	})
+	return emails, err
+}
+
+// DequeueEmail fulfills kvstor.EmailQueue
+func (bp badgerProvider) DequeueEmail(id string, deadLetter []byte) error {
+	return bp.db.Update(func(txn *badger.Txn) error {
+		if err := txn.Delete(key(emailQueuePrefix, []byte(id))); err != nil {
+			return err
+		}
+		if deadLetter == nil {
+			return nil
+		}
+		return txn.Set(key(deadLettersPrefix, []byte(id)), deadLetter)
+	})
+}
+
+// ReplaceQueuedEmail fulfills kvstor.EmailQueue
+func (bp badgerProvider) ReplaceQueuedEmail(id string, email []byte) (bool, error) {
+	replaced := false
+	err := bp.db.Update(func(txn *badger.Txn) error {
+		k := key(emailQueuePrefix, []byte(id))
+		item, err := txn.Get(k)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		buf, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if len(buf) < 8 {
+			return errors.Errorf("queued email %s is cut short", id)
+		}
+		replaced = true
+		return txn.Set(k, append(buf[:8], email...))
+	})
+	return replaced, err
+}
+
+// DeadLetters fulfills kvstor.EmailQueue
+func (bp badgerProvider) DeadLetters() (map[string][]byte, error) {
+	letters := map[string][]byte{}
+	err := bp.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = deadLettersPrefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(deadLettersPrefix); it.ValidForPrefix(deadLettersPrefix); it.Next() {
+			letter, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			letters[string(it.Item().KeyCopy(nil)[len(deadLettersPrefix):])] = letter
+		}
+		return nil
+	})
+	return letters, err
+}
+
+// DeleteDeadLetter fulfills kvstor.EmailQueue
+func (bp badgerProvider) DeleteDeadLetter(id string) error {
+	return bp.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(key(deadLettersPrefix, []byte(id)))
+	})
+}
+
+// ReplaceDeadLetter fulfills kvstor.EmailQueue
+func (bp badgerProvider) ReplaceDeadLetter(id string, deadLetter []byte) (bool, error) {
+	replaced := false
+	err := bp.db.Update(func(txn *badger.Txn) error {
+		k := key(deadLettersPrefix, []byte(id))
+		if _, err := txn.Get(k); err == badger.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		replaced = true
+		return txn.Set(k, deadLetter)
+	})
+	return replaced, err
+}
@@ -0,0 +1,80 @@
+package badgerdb
+
+import (
+	"encoding/binary"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/pkg/errors"
+)
+
+// eachWithPrefix calls fn with every item whose key starts with prefix, and
+// the key with the prefix removed. Expired items are skipped by badger.
+func (bp badgerProvider) eachWithPrefix(prefix []byte, fn func(id []byte, item *badger.Item) error) error {
+	return bp.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			if err := fn(it.Item().KeyCopy(nil)[len(prefix):], it.Item()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// decodeInt64 decodes the big endian ids and values written by int64Key and
+// int64Value
+func decodeInt64(id []byte) (int64, error) {
+	if len(id) != 8 {
+		return 0, errors.Errorf("expected 8 bytes. Given %d.", len(id))
+	}
+	return int64(binary.BigEndian.Uint64(id)), nil
+}
+
+// ListPackages fulfills kvstor.Lister
+func (bp badgerProvider) ListPackages(fn func(boxID, pkg []byte, expires int64) error) error {
+	return bp.eachWithPrefix(dropboxesPrefix, func(boxID []byte, item *badger.Item) error {
+		pkg, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		return fn(boxID, pkg, int64(item.ExpiresAt()))
+	})
+}
+
+// ListIDs fulfills kvstor.Lister
+func (bp badgerProvider) ListIDs(fn func(userID int64, pubID []byte) error) error {
+	return bp.eachWithPrefix(publicIDsPrefix, func(id []byte, item *badger.Item) error {
+		userID, err := decodeInt64(id)
+		if err != nil {
+			return err
+		}
+		pubID, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		return fn(userID, pubID)
+	})
+}
+
+// ListDebugCaptures fulfills kvstor.Lister
+func (bp badgerProvider) ListDebugCaptures(fn func(userID int64, until int64) error) error {
+	return bp.eachWithPrefix(debugCapturesPrefix, func(id []byte, item *badger.Item) error {
+		userID, err := decodeInt64(id)
+		if err != nil {
+			return err
+		}
+		buf, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		until, err := decodeInt64(buf)
+		if err != nil {
+			return err
+		}
+		return fn(userID, until)
+	})
+}
@@ -0,0 +1,32 @@
+package badgerdb
+
+import (
+	"github.com/dgraph-io/badger/v2"
+)
+
+// Each spent token id is a key with badger's own expiry, so it's gone once
+// the token would have expired anyway.
+
+// SpendToken fulfills kvstor.SpentTokens. Spending the same token twice
+// conflicts, and is retried.
+func (bp badgerProvider) SpendToken(id []byte, expires int64) (bool, error) {
+	spent := false
+	err := bp.update(func(txn *badger.Txn) error {
+		spent = false
+		buf, err := get(txn, key(spentTokensPrefix, id))
+		if err != nil || buf != nil {
+			return err
+		}
+		e := badger.NewEntry(key(spentTokensPrefix, id), []byte{1})
+		e.ExpiresAt = uint64(expires)
+		spent = true
+		return txn.SetEntry(e)
+	})
+	return spent, err
+}
+
+// PurgeSpentTokens fulfills kvstor.SpentTokens. Badger drops expired ids
+// itself, so there's nothing to purge.
+func (bp badgerProvider) PurgeSpentTokens(now int64) (int, error) {
+	return 0, nil
+}
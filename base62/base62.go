@@ -2,6 +2,7 @@ package base62
 
 import (
 	crand "crypto/rand"
+	"io"
 	"strings"
 )
 
@@ -9,20 +10,26 @@ var base62Chars = strings.Split("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTU
 
 // Rand returns a base62 string of size length
 func Rand(length uint) string {
-	s := ""
-	for i := uint(0); i < length; i++ {
-		idx := randUint8() % 62
-		s += base62Chars[idx]
+	s, err := RandFrom(crand.Reader, length)
+	if err != nil {
+		panic(err)
 	}
 
 	return s
 }
 
-func randUint8() uint8 {
-	b := make([]byte, 1)
-	if _, err := crand.Read(b); err != nil {
-		panic(err)
+// RandFrom returns a base62 string of size length, using src as the source
+// of randomness
+func RandFrom(src io.Reader, length uint) (string, error) {
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(src, buf); err != nil {
+		return "", err
+	}
+
+	s := ""
+	for _, b := range buf {
+		s += base62Chars[b%62]
 	}
 
-	return uint8(b[0])
+	return s, nil
 }
@@ -1,6 +1,7 @@
 package base62
 
 import (
+	"bytes"
 	"testing"
 )
 
@@ -12,3 +13,19 @@ func TestRand(t *testing.T) {
 		}
 	}
 }
+
+func TestRandFrom(t *testing.T) {
+	src := bytes.NewReader([]byte{0, 1, 26, 61, 62})
+	s, err := RandFrom(src, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "abA9a" {
+		t.Fatalf("Unexpected string: %s", s)
+	}
+
+	// the source is now exhausted
+	if _, err = RandFrom(src, 1); err == nil {
+		t.Fatal("Expected an error from an empty source")
+	}
+}
@@ -2,8 +2,10 @@ package boltdb
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
@@ -15,16 +17,51 @@ import (
 var userIDsBucketName = []byte("user_ids")
 var publicIDsBucketName = []byte("public_ids")
 var dropboxesBucketName = []byte("drop_boxes")
+var dropboxExpiriesBucketName = []byte("drop_box_expiries")
+var contentNamesBucketName = []byte("content_names")
+var contentRefsBucketName = []byte("content_refs")
+var debugCapturesBucketName = []byte("debug_captures")
+var debugCaptureRecordsBucketName = []byte("debug_capture_records")
+var serverStatusBucketName = []byte("server_status")
+var boxAliasesBucketName = []byte("box_aliases")
+var boxAliasExpiriesBucketName = []byte("box_alias_expiries")
+var aliasedBoxesBucketName = []byte("aliased_boxes")
+var emailQueueBucketName = []byte("email_queue")
+var deadLettersBucketName = []byte("dead_letters")
+var spentTokensBucketName = []byte("spent_tokens")
+
+// incidentKey holds the incident notice in serverStatusBucketName
+var incidentKey = []byte("incident")
 
 type boltdbProvider struct {
+	file *boltFile
+}
+
+// boltFile is the open database. Compact replaces db with a compacted copy,
+// so every transaction holds mu for reading.
+type boltFile struct {
+	mu sync.RWMutex
 	db *bolt.DB
 }
 
-// New returns a kvstor.Provider backed by a bolt database written to the
-// file specified at dbPath
-func New(dbPath string) (kvstor.Provider, error) {
-	var err error
-	db, err := bolt.Open(dbPath, 0600, nil)
+// Provider is a kvstor.Provider whose file can be compacted
+type Provider interface {
+	kvstor.Provider
+	kvstor.Lister
+	// Compact copies the live data to a new file, which replaces the
+	// current one. Other operations wait until it's done.
+	Compact() (CompactResult, error)
+	Stats() (Stats, error)
+	// Snapshot writes a consistent copy of the database to w, while the
+	// other operations carry on, and returns its size
+	Snapshot(w io.Writer) (int64, error)
+	Close() error
+}
+
+// New returns a Provider backed by a bolt database written to the file
+// specified at dbPath
+func New(dbPath string) (Provider, error) {
+	db, err := open(dbPath)
 	if err != nil {
 		return nil, err
 	}
@@ -45,16 +82,72 @@ func New(dbPath string) (kvstor.Provider, error) {
 	if err != nil {
 		return nil, fmt.Errorf("while creating '%s' bucket: %w", dropboxesBucketName, err)
 	}
+	_, err = tx.CreateBucketIfNotExists(dropboxExpiriesBucketName)
+	if err != nil {
+		return nil, fmt.Errorf("while creating '%s' bucket: %w", dropboxExpiriesBucketName, err)
+	}
+	_, err = tx.CreateBucketIfNotExists(contentNamesBucketName)
+	if err != nil {
+		return nil, fmt.Errorf("while creating '%s' bucket: %w", contentNamesBucketName, err)
+	}
+	_, err = tx.CreateBucketIfNotExists(contentRefsBucketName)
+	if err != nil {
+		return nil, fmt.Errorf("while creating '%s' bucket: %w", contentRefsBucketName, err)
+	}
+	_, err = tx.CreateBucketIfNotExists(debugCapturesBucketName)
+	if err != nil {
+		return nil, fmt.Errorf("while creating '%s' bucket: %w", debugCapturesBucketName, err)
+	}
+	_, err = tx.CreateBucketIfNotExists(debugCaptureRecordsBucketName)
+	if err != nil {
+		return nil, fmt.Errorf("while creating '%s' bucket: %w", debugCaptureRecordsBucketName, err)
+	}
+	_, err = tx.CreateBucketIfNotExists(serverStatusBucketName)
+	if err != nil {
+		return nil, fmt.Errorf("while creating '%s' bucket: %w", serverStatusBucketName, err)
+	}
+	_, err = tx.CreateBucketIfNotExists(boxAliasesBucketName)
+	if err != nil {
+		return nil, fmt.Errorf("while creating '%s' bucket: %w", boxAliasesBucketName, err)
+	}
+	_, err = tx.CreateBucketIfNotExists(boxAliasExpiriesBucketName)
+	if err != nil {
+		return nil, fmt.Errorf("while creating '%s' bucket: %w", boxAliasExpiriesBucketName, err)
+	}
+	_, err = tx.CreateBucketIfNotExists(aliasedBoxesBucketName)
+	if err != nil {
+		return nil, fmt.Errorf("while creating '%s' bucket: %w", aliasedBoxesBucketName, err)
+	}
+	_, err = tx.CreateBucketIfNotExists(emailQueueBucketName)
+	if err != nil {
+		return nil, fmt.Errorf("while creating '%s' bucket: %w", emailQueueBucketName, err)
+	}
+	_, err = tx.CreateBucketIfNotExists(deadLettersBucketName)
+	if err != nil {
+		return nil, fmt.Errorf("while creating '%s' bucket: %w", deadLettersBucketName, err)
+	}
+	_, err = tx.CreateBucketIfNotExists(spentTokensBucketName)
+	if err != nil {
+		return nil, fmt.Errorf("while creating '%s' bucket: %w", spentTokensBucketName, err)
+	}
 	err = tx.Commit()
 	if err != nil {
 		return nil, fmt.Errorf("while commiting initialiation of kvdb: %w", err)
 	}
 
-	return boltdbProvider{db: db}, nil
+	return boltdbProvider{file: &boltFile{db: db}}, nil
+}
+
+func open(dbPath string) (*bolt.DB, error) {
+	db, err := bolt.Open(dbPath, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
 }
 
 // Temp returns a new database backed by a file in the system temp directory
-func Temp(t *testing.T) kvstor.Provider {
+func Temp(t *testing.T) Provider {
 	t.Helper()
 
 	file := filepath.Join(os.TempDir(), fmt.Sprintf("bolt%d.db", time.Now().UnixNano()))
@@ -64,41 +157,65 @@ func Temp(t *testing.T) kvstor.Provider {
 	return db
 }
 
-func (bdp boltdbProvider) DropPackage(pkg []byte, boxID []byte) error {
-	err := bdp.db.Update(func(tx *bolt.Tx) error {
+// Close fulfills Provider
+func (bdp boltdbProvider) Close() error {
+	bdp.file.mu.Lock()
+	defer bdp.file.mu.Unlock()
+	return bdp.file.db.Close()
+}
+
+func (bdp boltdbProvider) view(fn func(tx *bolt.Tx) error) error {
+	bdp.file.mu.RLock()
+	defer bdp.file.mu.RUnlock()
+	return bdp.file.db.View(fn)
+}
+
+func (bdp boltdbProvider) update(fn func(tx *bolt.Tx) error) error {
+	bdp.file.mu.RLock()
+	defer bdp.file.mu.RUnlock()
+	return bdp.file.db.Update(fn)
+}
+
+// DropPackage stores pkg in the box, replacing any package already there.
+// The expiry is kept in its own bucket, keyed by box, so packages dropped
+// before expiries existed still read the same.
+func (bdp boltdbProvider) DropPackage(pkg []byte, boxID []byte, expires int64) error {
+	return bdp.update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(dropboxesBucketName)
-		err := bucket.Put(boxID, pkg)
-		return err
+		if err := bucket.Put(boxID, pkg); err != nil {
+			return err
+		}
+		expiries := tx.Bucket(dropboxExpiriesBucketName)
+		if expires == 0 {
+			return expiries.Delete(boxID)
+		}
+		return expiries.Put(boxID, int64ToBytes(expires))
 	})
-	return err
 }
 
 func (bdp boltdbProvider) InsertIds(userID int64, pubID []byte) error {
-	tx, err := bdp.db.Begin(true)
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
-
-	userIDBytes := int64ToBytes(userID)
-	uidsBucket := tx.Bucket(userIDsBucketName)
-	err = uidsBucket.Put(pubID, userIDBytes)
-	if err != nil {
-		return err
-	}
-
-	pubIDsBucket := tx.Bucket(publicIDsBucketName)
-	err = pubIDsBucket.Put(userIDBytes, pubID)
-	if err != nil {
-		return err
-	}
+	return bdp.update(func(tx *bolt.Tx) error {
+		userIDBytes := int64ToBytes(userID)
+		uidsBucket := tx.Bucket(userIDsBucketName)
+		err := uidsBucket.Put(pubID, userIDBytes)
+		if err != nil {
+			return err
+		}
 
-	return tx.Commit()
+		pubIDsBucket := tx.Bucket(publicIDsBucketName)
+		return pubIDsBucket.Put(userIDBytes, pubID)
+	})
 }
 
 func (bdp boltdbProvider) PickUpPackage(boxID []byte) ([]byte, error) {
 	var pkgCopy []byte
-	bdp.db.View(func(tx *bolt.Tx) error {
+	now := time.Now().Unix()
+	bdp.view(func(tx *bolt.Tx) error {
+		if expires := tx.Bucket(dropboxExpiriesBucketName).Get(boxID); expires != nil {
+			if t, err := bytesToInt64(expires); err == nil && t <= now {
+				return nil
+			}
+		}
 		pkg := tx.Bucket(dropboxesBucketName).Get(boxID)
 		// we have to copy the package, because the slice is only
 		// valid for the duration of the transaction
@@ -111,25 +228,88 @@ func (bdp boltdbProvider) PickUpPackage(boxID []byte) ([]byte, error) {
 	return pkgCopy, nil
 }
 
+// PurgeExpiredPackages deletes the packages that expired by now, along with
+// their expiries
+func (bdp boltdbProvider) PurgeExpiredPackages(now int64) (int, error) {
+	purged := 0
+	err := bdp.update(func(tx *bolt.Tx) error {
+		purged = 0
+		var expired [][]byte
+		expiries := tx.Bucket(dropboxExpiriesBucketName)
+		err := expiries.ForEach(func(boxID, buf []byte) error {
+			expires, err := bytesToInt64(buf)
+			if err != nil {
+				return fmt.Errorf("expiry of box %x: %w", boxID, err)
+			}
+			if expires <= now {
+				expired = append(expired, append([]byte{}, boxID...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		boxes := tx.Bucket(dropboxesBucketName)
+		for _, boxID := range expired {
+			if err := boxes.Delete(boxID); err != nil {
+				return err
+			}
+			if err := expiries.Delete(boxID); err != nil {
+				return err
+			}
+			purged++
+		}
+		return nil
+	})
+	return purged, err
+}
+
+// Incident fulfills kvstor.IncidentNotice
+func (bdp boltdbProvider) Incident() ([]byte, error) {
+	var notice []byte
+	err := bdp.view(func(tx *bolt.Tx) error {
+		if buf := tx.Bucket(serverStatusBucketName).Get(incidentKey); buf != nil {
+			notice = append([]byte{}, buf...)
+		}
+		return nil
+	})
+	return notice, err
+}
+
+// SetIncident fulfills kvstor.IncidentNotice
+func (bdp boltdbProvider) SetIncident(notice []byte) error {
+	return bdp.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(serverStatusBucketName)
+		if notice == nil {
+			return bucket.Delete(incidentKey)
+		}
+		return bucket.Put(incidentKey, notice)
+	})
+}
+
 func (bdp boltdbProvider) PublicIDFromUserID(userID int64) ([]byte, error) {
-	tx, err := bdp.db.Begin(false)
-	if err != nil {
-		panic(err)
-	}
-	defer tx.Rollback()
-	return tx.Bucket(publicIDsBucketName).Get(int64ToBytes(userID)), nil
+	var pubID []byte
+	err := bdp.view(func(tx *bolt.Tx) error {
+		// copied, since the file may be swapped by Compact once the
+		// transaction is over
+		if id := tx.Bucket(publicIDsBucketName).Get(int64ToBytes(userID)); id != nil {
+			pubID = append([]byte{}, id...)
+		}
+		return nil
+	})
+	return pubID, err
 }
 
 func (bdp boltdbProvider) UserIDFromPublicID(pubID []byte) (int64, error) {
-	tx, err := bdp.db.Begin(false)
-	if err != nil {
-		panic(err)
-	}
-	defer tx.Rollback()
-
-	userIDBytes := tx.Bucket(userIDsBucketName).Get(pubID)
-	if len(userIDBytes) == 0 {
-		return 0, nil
-	}
-	return bytesToInt64(userIDBytes)
+	var userID int64
+	err := bdp.view(func(tx *bolt.Tx) error {
+		userIDBytes := tx.Bucket(userIDsBucketName).Get(pubID)
+		if len(userIDBytes) == 0 {
+			return nil
+		}
+		var err error
+		userID, err = bytesToInt64(userIDBytes)
+		return err
+	})
+	return userID, err
 }
@@ -49,7 +49,7 @@ func TestPackages(t *testing.T) {
 		t.Fatalf("the package should have been nil")
 	}
 
-	err = db(t).DropPackage(pkg1, box1)
+	err = db(t).DropPackage(pkg1, box1, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -63,7 +63,7 @@ func TestPackages(t *testing.T) {
 	}
 
 	// wipe the package in box 1
-	err = db(t).DropPackage(nil, box1)
+	err = db(t).DropPackage(nil, box1, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -122,3 +122,221 @@ func TestIDs(t *testing.T) {
 		t.Fatalf("Alice's user id (%d) did not match returned value. %d", aliceID, userID)
 	}
 }
+
+func TestPackageExpiry(t *testing.T) {
+	db := Temp(t)
+	defer db.Close()
+	now := time.Now().Unix()
+	if err := db.DropPackage([]byte("expired"), []byte("box 1"), now-1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DropPackage([]byte("fresh"), []byte("box 2"), now+60); err != nil {
+		t.Fatal(err)
+	}
+	// replacing a package clears its expiry
+	if err := db.DropPackage([]byte("forever"), []byte("box 3"), now-1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DropPackage([]byte("forever"), []byte("box 3"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// expired packages can't be picked up, even before they're purged
+	pkg, err := db.PickUpPackage([]byte("box 1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg != nil {
+		t.Fatalf("picked up an expired package: %s", pkg)
+	}
+
+	purged, err := db.PurgeExpiredPackages(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 1 {
+		t.Fatalf("purged %d packages, expected 1", purged)
+	}
+	pkg, err = db.PickUpPackage([]byte("box 2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pkg) != "fresh" {
+		t.Fatalf("expected the fresh package. Got %q", pkg)
+	}
+	purged, err = db.PurgeExpiredPackages(now + 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 1 {
+		t.Fatalf("purged %d packages, expected 1", purged)
+	}
+	pkg, err = db.PickUpPackage([]byte("box 3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pkg) != "forever" {
+		t.Fatalf("expected the package without expiry. Got %q", pkg)
+	}
+}
+
+func TestList(t *testing.T) {
+	db := Temp(t)
+	defer db.Close()
+	now := time.Now().Unix()
+	if err := db.DropPackage([]byte("expired"), []byte("box 1"), now-1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DropPackage([]byte("fresh"), []byte("box 2"), now+60); err != nil {
+		t.Fatal(err)
+	}
+	var listed []string
+	err := db.ListPackages(func(boxID, pkg []byte, expires int64) error {
+		listed = append(listed, fmt.Sprintf("%s=%s@%d", boxID, pkg, expires))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0] != fmt.Sprintf("box 2=fresh@%d", now+60) {
+		t.Fatalf("expected only the fresh package. Got %q", listed)
+	}
+
+	if err = db.InsertIds(300, []byte("public id")); err != nil {
+		t.Fatal(err)
+	}
+	listed = nil
+	err = db.ListIDs(func(userID int64, pubID []byte) error {
+		listed = append(listed, fmt.Sprintf("%d=%s", userID, pubID))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0] != "300=public id" {
+		t.Fatalf("expected the inserted ids. Got %q", listed)
+	}
+
+	if err = db.StartDebugCapture(7, 1000); err != nil {
+		t.Fatal(err)
+	}
+	listed = nil
+	err = db.ListDebugCaptures(func(userID int64, until int64) error {
+		listed = append(listed, fmt.Sprintf("%d@%d", userID, until))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0] != "7@1000" {
+		t.Fatalf("expected the debug capture. Got %q", listed)
+	}
+}
+
+func TestIncident(t *testing.T) {
+	db := Temp(t)
+	defer db.Close()
+	if err := db.SetIncident([]byte("delays")); err != nil {
+		t.Fatal(err)
+	}
+	notice, err := db.Incident()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(notice) != "delays" {
+		t.Fatalf("expected the incident. Got %q", notice)
+	}
+
+	if err = db.SetIncident(nil); err != nil {
+		t.Fatal(err)
+	}
+	notice, err = db.Incident()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notice != nil {
+		t.Fatalf("the incident should have been cleared. Got %q", notice)
+	}
+}
+
+func TestConcurrentDrops(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			box := []byte(fmt.Sprintf("concurrent box %d", i))
+			if err := db(t).DropPackage([]byte(fmt.Sprintf("package %d", i)), box, 0); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 50; i++ {
+		pkg, err := db(t).PickUpPackage([]byte(fmt.Sprintf("concurrent box %d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(pkg) != fmt.Sprintf("package %d", i) {
+			t.Fatalf("box %d holds '%s'", i, pkg)
+		}
+	}
+}
+
+// benchmarkDrops measures the throughput of drops to distinct boxes using
+// drop, from parallelism goroutines per CPU, or from one goroutine when it's 0
+func benchmarkDrops(b *testing.B, parallelism int, drop func(bdp boltdbProvider, pkg, boxID []byte) error) {
+	dbPath := filepath.Join(os.TempDir(), fmt.Sprintf("bench%d.kvdb", time.Now().UnixNano()))
+	defer os.Remove(dbPath)
+	kvs, err := New(dbPath)
+	if err != nil {
+		b.Fatal(err)
+	}
+	bdp := kvs.(boltdbProvider)
+	defer bdp.Close()
+
+	pkg := make([]byte, 256)
+	if parallelism == 0 {
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := drop(bdp, pkg, []byte(fmt.Sprintf("box %d", i))); err != nil {
+				b.Fatal(err)
+			}
+		}
+		return
+	}
+
+	var n int64
+	var mu sync.Mutex
+	b.SetParallelism(parallelism)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			mu.Lock()
+			n++
+			boxID := []byte(fmt.Sprintf("box %d", n))
+			mu.Unlock()
+			if err := drop(bdp, pkg, boxID); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkDropPackage measures drops from many goroutines, which contend
+// for bolt's single writer
+func BenchmarkDropPackage(b *testing.B) {
+	benchmarkDrops(b, 32, func(bdp boltdbProvider, pkg, boxID []byte) error {
+		return bdp.DropPackage(pkg, boxID, 0)
+	})
+}
+
+// BenchmarkDropPackageSerial measures the latency of a drop without
+// contention
+func BenchmarkDropPackageSerial(b *testing.B) {
+	benchmarkDrops(b, 0, func(bdp boltdbProvider, pkg, boxID []byte) error {
+		return bdp.DropPackage(pkg, boxID, 0)
+	})
+}
@@ -0,0 +1,133 @@
+package boltdb
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"zood.dev/oscar/kvstor"
+)
+
+// Each alias is keyed in boxAliasesBucketName to its box, and the aliases
+// that stopped being current have their expiry in
+// boxAliasExpiriesBucketName, like packages. aliasedBoxesBucketName keys
+// each aliased box to its owner, followed by its current alias.
+
+// AddBoxAlias fulfills kvstor.BoxAliases
+func (bdp boltdbProvider) AddBoxAlias(boxID, alias []byte, ownerID int64, graceUntil int64) error {
+	return bdp.update(func(tx *bolt.Tx) error {
+		boxes := tx.Bucket(aliasedBoxesBucketName)
+		if buf := boxes.Get(boxID); buf != nil {
+			owner, current, err := splitAliasedBox(buf)
+			if err != nil {
+				return fmt.Errorf("aliases of box %x: %w", boxID, err)
+			}
+			if owner != ownerID {
+				return kvstor.ErrBoxOwner
+			}
+			// the previous alias may already have been purged
+			if tx.Bucket(boxAliasesBucketName).Get(current) != nil {
+				if err = tx.Bucket(boxAliasExpiriesBucketName).Put(current, int64ToBytes(graceUntil)); err != nil {
+					return err
+				}
+			}
+		}
+		if err := tx.Bucket(boxAliasesBucketName).Put(alias, boxID); err != nil {
+			return err
+		}
+		return boxes.Put(boxID, append(int64ToBytes(ownerID), alias...))
+	})
+}
+
+// BoxOfAlias fulfills kvstor.BoxAliases
+func (bdp boltdbProvider) BoxOfAlias(alias []byte) ([]byte, error) {
+	var boxID []byte
+	now := time.Now().Unix()
+	err := bdp.view(func(tx *bolt.Tx) error {
+		if buf := tx.Bucket(boxAliasExpiriesBucketName).Get(alias); buf != nil {
+			expires, err := bytesToInt64(buf)
+			if err != nil {
+				return err
+			}
+			if expires <= now {
+				return nil
+			}
+		}
+		if id := tx.Bucket(boxAliasesBucketName).Get(alias); id != nil {
+			boxID = append([]byte{}, id...)
+		}
+		return nil
+	})
+	return boxID, err
+}
+
+// PurgeExpiredBoxAliases fulfills kvstor.BoxAliases
+func (bdp boltdbProvider) PurgeExpiredBoxAliases(now int64) (int, error) {
+	purged := 0
+	err := bdp.update(func(tx *bolt.Tx) error {
+		purged = 0
+		var expired [][]byte
+		expiries := tx.Bucket(boxAliasExpiriesBucketName)
+		err := expiries.ForEach(func(alias, buf []byte) error {
+			expires, err := bytesToInt64(buf)
+			if err != nil {
+				return fmt.Errorf("expiry of alias %x: %w", alias, err)
+			}
+			if expires <= now {
+				expired = append(expired, append([]byte{}, alias...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		aliases := tx.Bucket(boxAliasesBucketName)
+		for _, alias := range expired {
+			if err := aliases.Delete(alias); err != nil {
+				return err
+			}
+			if err := expiries.Delete(alias); err != nil {
+				return err
+			}
+			purged++
+		}
+		return nil
+	})
+	return purged, err
+}
+
+// ListBoxAliases fulfills kvstor.Lister
+func (bdp boltdbProvider) ListBoxAliases(fn func(alias, boxID []byte, ownerID int64, expires int64) error) error {
+	now := time.Now().Unix()
+	return bdp.view(func(tx *bolt.Tx) error {
+		expiries := tx.Bucket(boxAliasExpiriesBucketName)
+		boxes := tx.Bucket(aliasedBoxesBucketName)
+		return tx.Bucket(boxAliasesBucketName).ForEach(func(alias, boxID []byte) error {
+			var expires int64
+			if buf := expiries.Get(alias); buf != nil {
+				var err error
+				if expires, err = bytesToInt64(buf); err != nil {
+					return err
+				}
+				if expires <= now {
+					return nil
+				}
+			}
+			ownerID, _, err := splitAliasedBox(boxes.Get(boxID))
+			if err != nil {
+				return fmt.Errorf("aliases of box %x: %w", boxID, err)
+			}
+			return fn(append([]byte{}, alias...), append([]byte{}, boxID...), ownerID, expires)
+		})
+	})
+}
+
+// splitAliasedBox splits a value of aliasedBoxesBucketName into the owner
+// and the current alias
+func splitAliasedBox(buf []byte) (int64, []byte, error) {
+	if len(buf) < 8 {
+		return 0, nil, fmt.Errorf("expected at least 8 bytes. Given %d.", len(buf))
+	}
+	ownerID, err := bytesToInt64(buf[:8])
+	return ownerID, buf[8:], err
+}
@@ -0,0 +1,69 @@
+package boltdb
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"zood.dev/oscar/kvstor"
+)
+
+func TestBoxAliases(t *testing.T) {
+	db := Temp(t)
+	defer db.Close()
+
+	now := time.Now().Unix()
+	for _, alias := range []string{"alias 1", "alias 2"} {
+		if err := db.AddBoxAlias([]byte("box"), []byte(alias), 7, now+60); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.AddBoxAlias([]byte("box"), []byte("alias 3"), 7, now-1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddBoxAlias([]byte("box"), []byte("alias 4"), 8, now+60); err != kvstor.ErrBoxOwner {
+		t.Fatalf("expected ErrBoxOwner. Got %v", err)
+	}
+
+	// alias 1 keeps the grace period it was given when alias 2 was added
+	for alias, expected := range map[string][]byte{"alias 1": []byte("box"), "alias 2": nil, "alias 3": []byte("box"), "alias 4": nil} {
+		box, err := db.BoxOfAlias([]byte(alias))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(box, expected) {
+			t.Fatalf("expected %s to lead to %q. Got %q", alias, expected, box)
+		}
+	}
+
+	var listed []string
+	err := db.ListBoxAliases(func(alias, boxID []byte, ownerID int64, expires int64) error {
+		listed = append(listed, fmt.Sprintf("%s=%s/%d@%d", alias, boxID, ownerID, expires))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(listed)
+	expected := []string{fmt.Sprintf("alias 1=box/7@%d", now+60), "alias 3=box/7@0"}
+	if fmt.Sprint(listed) != fmt.Sprint(expected) {
+		t.Fatalf("expected %q. Got %q", expected, listed)
+	}
+
+	purged, err := db.PurgeExpiredBoxAliases(now + 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 2 {
+		t.Fatalf("expected 2 aliases to be purged. Got %d", purged)
+	}
+	box, err := db.BoxOfAlias([]byte("alias 3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(box) != "box" {
+		t.Fatalf("the current alias should still lead to the box. Got %q", box)
+	}
+}
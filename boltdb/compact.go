@@ -0,0 +1,202 @@
+package boltdb
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/boltdb/bolt"
+)
+
+// compactTxSize is roughly how many bytes are copied in each write
+// transaction of a compaction, so a large bucket doesn't have to fit in
+// memory in one go
+const compactTxSize = 16 << 20
+
+// Stats describe how much of the database file is in use
+type Stats struct {
+	// FileSize is the size of the file in bytes
+	FileSize int64
+	// FreePages are the pages that can be reused for new data, and
+	// PendingPages the ones that will be once the open read transactions
+	// are over
+	FreePages    int
+	PendingPages int
+	// FreeBytes is the size of the free and pending pages. Bolt never
+	// shrinks the file, so only Compact returns it to the filesystem.
+	FreeBytes int64
+	// FreelistBytes is the size of the list of the free pages, which is
+	// rewritten by every commit
+	FreelistBytes int
+}
+
+// CompactResult are the file sizes before and after a compaction
+type CompactResult struct {
+	Before int64
+	After  int64
+}
+
+// Stats fulfills Provider
+func (bdp boltdbProvider) Stats() (Stats, error) {
+	bdp.file.mu.RLock()
+	defer bdp.file.mu.RUnlock()
+
+	fi, err := os.Stat(bdp.file.db.Path())
+	if err != nil {
+		return Stats{}, err
+	}
+	dbStats := bdp.file.db.Stats()
+	return Stats{
+		FileSize:      fi.Size(),
+		FreePages:     dbStats.FreePageN,
+		PendingPages:  dbStats.PendingPageN,
+		FreeBytes:     int64(dbStats.FreePageN+dbStats.PendingPageN) * int64(bdp.file.db.Info().PageSize),
+		FreelistBytes: dbStats.FreelistInuse,
+	}, nil
+}
+
+// Snapshot fulfills Provider. The copy is written in a read transaction, so
+// writes carry on, but a compaction waits until it's done.
+func (bdp boltdbProvider) Snapshot(w io.Writer) (int64, error) {
+	var n int64
+	err := bdp.view(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+// Compact fulfills Provider. The data is copied to a temporary file next to
+// the database, which is then renamed over it. If the copy fails, the
+// database is left as it was.
+func (bdp boltdbProvider) Compact() (CompactResult, error) {
+	bdp.file.mu.Lock()
+	defer bdp.file.mu.Unlock()
+
+	src := bdp.file.db
+	path := src.Path()
+	tmpPath := path + ".compact"
+	before, err := os.Stat(path)
+	if err != nil {
+		return CompactResult{}, err
+	}
+
+	// a leftover from a compaction that crashed
+	if err = os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+		return CompactResult{}, err
+	}
+	dst, err := bolt.Open(tmpPath, 0600, nil)
+	if err != nil {
+		return CompactResult{}, fmt.Errorf("while creating the compacted file: %w", err)
+	}
+	err = copyDB(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return CompactResult{}, fmt.Errorf("while copying to the compacted file: %w", err)
+	}
+	after, err := os.Stat(tmpPath)
+	if err != nil {
+		return CompactResult{}, err
+	}
+
+	if err = src.Close(); err != nil {
+		os.Remove(tmpPath)
+		return CompactResult{}, fmt.Errorf("while closing the database: %w", err)
+	}
+	renameErr := os.Rename(tmpPath, path)
+	// reopened even when the rename failed, so the provider keeps working
+	// with the uncompacted file
+	db, err := open(path)
+	if err != nil {
+		return CompactResult{}, fmt.Errorf("while reopening the database: %w", err)
+	}
+	bdp.file.db = db
+	if renameErr != nil {
+		os.Remove(tmpPath)
+		return CompactResult{}, fmt.Errorf("while replacing the database: %w", renameErr)
+	}
+
+	return CompactResult{Before: before.Size(), After: after.Size()}, nil
+}
+
+// copyDB copies every bucket of src, with the nested buckets and the
+// sequences, to dst
+func copyDB(dst, src *bolt.DB) error {
+	dstTx, err := dst.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if dstTx != nil {
+			dstTx.Rollback()
+		}
+	}()
+	size := 0
+
+	// path is the names of the buckets leading to the one being copied
+	var copyBucket func(path [][]byte, b *bolt.Bucket) error
+	copyBucket = func(path [][]byte, b *bolt.Bucket) error {
+		if err := createBucket(dstTx, path, b.Sequence()); err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if v == nil {
+				return copyBucket(append(path[:len(path):len(path)], k), b.Bucket(k))
+			}
+			// commit before the transaction grows too large, and carry on in
+			// a new one
+			if size += len(k) + len(v); size > compactTxSize {
+				if err := dstTx.Commit(); err != nil {
+					dstTx = nil
+					return err
+				}
+				if dstTx, err = dst.Begin(true); err != nil {
+					return err
+				}
+				size = 0
+			}
+			return bucketAt(dstTx, path).Put(k, v)
+		})
+	}
+
+	err = src.View(func(srcTx *bolt.Tx) error {
+		return srcTx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			return copyBucket([][]byte{name}, b)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	err = dstTx.Commit()
+	dstTx = nil
+	return err
+}
+
+// createBucket creates the bucket at path in tx, where its parents already
+// exist
+func createBucket(tx *bolt.Tx, path [][]byte, seq uint64) error {
+	var b *bolt.Bucket
+	var err error
+	if len(path) == 1 {
+		b, err = tx.CreateBucket(path[0])
+	} else {
+		b, err = bucketAt(tx, path[:len(path)-1]).CreateBucket(path[len(path)-1])
+	}
+	if err != nil {
+		return err
+	}
+	return b.SetSequence(seq)
+}
+
+// bucketAt returns the bucket at path in tx
+func bucketAt(tx *bolt.Tx, path [][]byte) *bolt.Bucket {
+	b := tx.Bucket(path[0])
+	for _, name := range path[1:] {
+		b = b.Bucket(name)
+	}
+	return b
+}
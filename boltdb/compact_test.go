@@ -0,0 +1,120 @@
+package boltdb
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCompact(t *testing.T) {
+	db := Temp(t)
+	defer os.Remove(db.(boltdbProvider).file.db.Path())
+	defer db.Close()
+
+	// large packages replaced by small ones leave most of the file free
+	big := bytes.Repeat([]byte("x"), 64<<10)
+	for i := 0; i < 100; i++ {
+		if err := db.DropPackage(big, []byte(fmt.Sprintf("box %d", i)), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if err := db.DropPackage([]byte("small"), []byte(fmt.Sprintf("box %d", i)), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.InsertIds(7, []byte("public 7")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AppendDebugCapture(7, []byte("record 0"), 10); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.FreeBytes < 4<<20 {
+		t.Fatalf("expected the replaced packages to be free. Got %+v", stats)
+	}
+
+	res, err := db.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Before != stats.FileSize || res.After >= res.Before/2 {
+		t.Fatalf("expected the file to shrink from %d. Got %+v", stats.FileSize, res)
+	}
+	if stats, _ = db.Stats(); stats.FileSize != res.After {
+		t.Fatalf("expected the compacted file to be in use. Got %+v", stats)
+	}
+
+	// the data survived, and the provider works on the new file
+	pkg, err := db.PickUpPackage([]byte("box 99"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pkg) != "small" {
+		t.Fatalf("expected the package to survive. Got %q", pkg)
+	}
+	if userID, _ := db.UserIDFromPublicID([]byte("public 7")); userID != 7 {
+		t.Fatalf("expected the public id to survive. Got %d", userID)
+	}
+	// the record sequence carries on, so the new record comes last
+	if err = db.AppendDebugCapture(7, []byte("record 1"), 10); err != nil {
+		t.Fatal(err)
+	}
+	records, err := db.DebugCapture(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || string(records[0]) != "record 0" || string(records[1]) != "record 1" {
+		t.Fatalf("expected both records in order. Got %q", records)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	db := Temp(t)
+	defer os.Remove(db.(boltdbProvider).file.db.Path())
+	defer db.Close()
+	if err := db.DropPackage([]byte("package"), []byte("box"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile("", "bolt-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	n, err := db.Snapshot(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(f.Name()); err != nil || fi.Size() != n {
+		t.Fatalf("expected %d bytes in the snapshot. Got %v, %v", n, fi, err)
+	}
+
+	// the snapshot is a database of its own
+	snapshot, err := New(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Close()
+	pkg, err := snapshot.PickUpPackage([]byte("box"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pkg) != "package" {
+		t.Fatalf("expected the package in the snapshot. Got %q", pkg)
+	}
+	// and it's independent of the original
+	if err = db.DropPackage([]byte("replaced"), []byte("box"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if pkg, _ = snapshot.PickUpPackage([]byte("box")); string(pkg) != "package" {
+		t.Fatalf("expected the snapshot to keep its package. Got %q", pkg)
+	}
+}
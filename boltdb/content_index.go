@@ -0,0 +1,131 @@
+package boltdb
+
+import (
+	"bytes"
+
+	"github.com/boltdb/bolt"
+)
+
+// ContentHash fulfills kvstor.ContentIndex
+func (bdp boltdbProvider) ContentHash(name string) ([]byte, error) {
+	var hash []byte
+	err := bdp.view(func(tx *bolt.Tx) error {
+		// copied, because the slice is only valid during the transaction
+		if h := tx.Bucket(contentNamesBucketName).Get([]byte(name)); h != nil {
+			hash = append([]byte{}, h...)
+		}
+		return nil
+	})
+	return hash, err
+}
+
+// ContentReferences fulfills kvstor.ContentIndex
+func (bdp boltdbProvider) ContentReferences(hash []byte) (int64, error) {
+	var refs int64
+	err := bdp.view(func(tx *bolt.Tx) error {
+		var err error
+		refs, err = contentRefs(tx, hash)
+		return err
+	})
+	return refs, err
+}
+
+// LinkContent fulfills kvstor.ContentIndex
+func (bdp boltdbProvider) LinkContent(name string, hash []byte) ([]byte, int64, error) {
+	var old []byte
+	var oldRefs int64
+	err := bdp.update(func(tx *bolt.Tx) error {
+		names := tx.Bucket(contentNamesBucketName)
+		if cur := names.Get([]byte(name)); cur != nil {
+			if bytes.Equal(cur, hash) {
+				return nil
+			}
+			old = append([]byte{}, cur...)
+		}
+		if err := names.Put([]byte(name), hash); err != nil {
+			return err
+		}
+		if _, err := addContentRefs(tx, hash, 1); err != nil {
+			return err
+		}
+		if old == nil {
+			return nil
+		}
+		var err error
+		oldRefs, err = addContentRefs(tx, old, -1)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return old, oldRefs, nil
+}
+
+// UnlinkContent fulfills kvstor.ContentIndex
+func (bdp boltdbProvider) UnlinkContent(name string) ([]byte, int64, error) {
+	var old []byte
+	var oldRefs int64
+	err := bdp.update(func(tx *bolt.Tx) error {
+		names := tx.Bucket(contentNamesBucketName)
+		cur := names.Get([]byte(name))
+		if cur == nil {
+			return nil
+		}
+		old = append([]byte{}, cur...)
+		if err := names.Delete([]byte(name)); err != nil {
+			return err
+		}
+		var err error
+		oldRefs, err = addContentRefs(tx, old, -1)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return old, oldRefs, nil
+}
+
+// ContentNames fulfills kvstor.ContentIndex. The names are collected before
+// fn is called, so fn can change the index.
+func (bdp boltdbProvider) ContentNames(prefix string, fn func(name string) error) error {
+	var names []string
+	err := bdp.view(func(tx *bolt.Tx) error {
+		c := tx.Bucket(contentNamesBucketName).Cursor()
+		for k, _ := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = c.Next() {
+			names = append(names, string(k))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err = fn(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func contentRefs(tx *bolt.Tx, hash []byte) (int64, error) {
+	buf := tx.Bucket(contentRefsBucketName).Get(hash)
+	if buf == nil {
+		return 0, nil
+	}
+	return bytesToInt64(buf)
+}
+
+// addContentRefs adds delta to the references of hash, and returns the new
+// count. Hashes without references are removed.
+func addContentRefs(tx *bolt.Tx, hash []byte, delta int64) (int64, error) {
+	refs, err := contentRefs(tx, hash)
+	if err != nil {
+		return 0, err
+	}
+	refs += delta
+	bucket := tx.Bucket(contentRefsBucketName)
+	if refs <= 0 {
+		return 0, bucket.Delete(hash)
+	}
+	return refs, bucket.Put(hash, int64ToBytes(refs))
+}
@@ -0,0 +1,80 @@
+package boltdb
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestContentIndex(t *testing.T) {
+	idx := Temp(t)
+	hashA := []byte("hash a")
+	hashB := []byte("hash b")
+
+	old, _, err := idx.LinkContent("backups/1", hashA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old != nil {
+		t.Fatalf("a new name shouldn't release a hash. Got '%s'", old)
+	}
+	if _, _, err = idx.LinkContent("backups/2", hashA); err != nil {
+		t.Fatal(err)
+	}
+	if refs, _ := idx.ContentReferences(hashA); refs != 2 {
+		t.Fatalf("expected 2 references to hash a. Got %d", refs)
+	}
+
+	// linking the same content again changes nothing
+	old, _, err = idx.LinkContent("backups/1", hashA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old != nil {
+		t.Fatalf("relinking shouldn't release a hash. Got '%s'", old)
+	}
+	if refs, _ := idx.ContentReferences(hashA); refs != 2 {
+		t.Fatalf("expected 2 references to hash a. Got %d", refs)
+	}
+
+	old, oldRefs, err := idx.LinkContent("backups/1", hashB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(old, hashA) || oldRefs != 1 {
+		t.Fatalf("expected hash a with 1 reference left. Got '%s' with %d", old, oldRefs)
+	}
+	hash, err := idx.ContentHash("backups/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(hash, hashB) {
+		t.Fatalf("expected hash b. Got '%s'", hash)
+	}
+
+	var names []string
+	err = idx.ContentNames("backups/", func(name string) error {
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"backups/1", "backups/2"}) {
+		t.Fatalf("unexpected names: %v", names)
+	}
+
+	old, oldRefs, err = idx.UnlinkContent("backups/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(old, hashA) || oldRefs != 0 {
+		t.Fatalf("expected hash a with no references left. Got '%s' with %d", old, oldRefs)
+	}
+	if hash, _ = idx.ContentHash("backups/2"); hash != nil {
+		t.Fatalf("backups/2 should be gone. Got '%s'", hash)
+	}
+	if old, _, _ = idx.UnlinkContent("backups/2"); old != nil {
+		t.Fatalf("unlinking a missing name shouldn't release a hash. Got '%s'", old)
+	}
+}
@@ -0,0 +1,105 @@
+package boltdb
+
+import (
+	"encoding/binary"
+
+	"github.com/boltdb/bolt"
+)
+
+// The records of each user are kept in a bucket of their own, nested in
+// debugCaptureRecordsBucketName, keyed by a big endian sequence number so
+// they're iterated in the order they were added.
+
+// StartDebugCapture fulfills kvstor.DebugCaptures
+func (bdp boltdbProvider) StartDebugCapture(userID int64, until int64) error {
+	return bdp.update(func(tx *bolt.Tx) error {
+		if err := deleteDebugCaptureRecords(tx, userID); err != nil {
+			return err
+		}
+		return tx.Bucket(debugCapturesBucketName).Put(int64ToBytes(userID), int64ToBytes(until))
+	})
+}
+
+// DebugCaptureUntil fulfills kvstor.DebugCaptures
+func (bdp boltdbProvider) DebugCaptureUntil(userID int64) (int64, error) {
+	var until int64
+	err := bdp.view(func(tx *bolt.Tx) error {
+		buf := tx.Bucket(debugCapturesBucketName).Get(int64ToBytes(userID))
+		if buf == nil {
+			return nil
+		}
+		var err error
+		until, err = bytesToInt64(buf)
+		return err
+	})
+	return until, err
+}
+
+// AppendDebugCapture fulfills kvstor.DebugCaptures
+func (bdp boltdbProvider) AppendDebugCapture(userID int64, record []byte, max int) error {
+	return bdp.update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(debugCaptureRecordsBucketName).CreateBucketIfNotExists(int64ToBytes(userID))
+		if err != nil {
+			return err
+		}
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		if err = bucket.Put(key, record); err != nil {
+			return err
+		}
+
+		// counted with a cursor, since Stats misses the writes of the open
+		// transaction
+		c := bucket.Cursor()
+		excess := -max
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			excess++
+		}
+		for k, _ := c.First(); k != nil && excess > 0; k, _ = c.First() {
+			if err = c.Delete(); err != nil {
+				return err
+			}
+			excess--
+		}
+		return nil
+	})
+}
+
+// DebugCapture fulfills kvstor.DebugCaptures
+func (bdp boltdbProvider) DebugCapture(userID int64) ([][]byte, error) {
+	var records [][]byte
+	err := bdp.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(debugCaptureRecordsBucketName).Bucket(int64ToBytes(userID))
+		if bucket == nil {
+			return nil
+		}
+		// copied, because the slices are only valid during the transaction
+		return bucket.ForEach(func(k, v []byte) error {
+			records = append(records, append([]byte{}, v...))
+			return nil
+		})
+	})
+	return records, err
+}
+
+// DeleteDebugCapture fulfills kvstor.DebugCaptures
+func (bdp boltdbProvider) DeleteDebugCapture(userID int64) error {
+	return bdp.update(func(tx *bolt.Tx) error {
+		if err := deleteDebugCaptureRecords(tx, userID); err != nil {
+			return err
+		}
+		return tx.Bucket(debugCapturesBucketName).Delete(int64ToBytes(userID))
+	})
+}
+
+func deleteDebugCaptureRecords(tx *bolt.Tx, userID int64) error {
+	err := tx.Bucket(debugCaptureRecordsBucketName).DeleteBucket(int64ToBytes(userID))
+	if err == bolt.ErrBucketNotFound {
+		return nil
+	}
+	return err
+}
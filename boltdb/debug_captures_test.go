@@ -0,0 +1,65 @@
+package boltdb
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDebugCaptures(t *testing.T) {
+	db := Temp(t)
+
+	until, err := db.DebugCaptureUntil(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if until != 0 {
+		t.Fatalf("expected no capture. Got one until %d", until)
+	}
+	if err = db.StartDebugCapture(7, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if until, _ = db.DebugCaptureUntil(7); until != 1000 {
+		t.Fatalf("expected the capture to last until 1000. Got %d", until)
+	}
+
+	for i := 0; i < 5; i++ {
+		if err = db.AppendDebugCapture(7, []byte(fmt.Sprintf("record %d", i)), 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records, err := db.DebugCapture(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || string(records[0]) != "record 2" || string(records[2]) != "record 4" {
+		t.Fatalf("expected the latest 3 records. Got %q", records)
+	}
+	if records, _ = db.DebugCapture(8); len(records) != 0 {
+		t.Fatalf("expected no records for another user. Got %q", records)
+	}
+
+	// a new capture starts empty
+	if err = db.StartDebugCapture(7, 2000); err != nil {
+		t.Fatal(err)
+	}
+	if records, _ = db.DebugCapture(7); len(records) != 0 {
+		t.Fatalf("expected the records to be dropped. Got %q", records)
+	}
+
+	if err = db.AppendDebugCapture(7, []byte("record"), 3); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.DeleteDebugCapture(7); err != nil {
+		t.Fatal(err)
+	}
+	if until, _ = db.DebugCaptureUntil(7); until != 0 {
+		t.Fatalf("expected the capture to be deleted. Got one until %d", until)
+	}
+	if records, _ = db.DebugCapture(7); len(records) != 0 {
+		t.Fatalf("expected the records to be deleted. Got %q", records)
+	}
+	// deleting nothing is fine
+	if err = db.DeleteDebugCapture(7); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,106 @@
+package boltdb
+
+import (
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// Each queued email is kept under its id, after the 8 bytes of when it's
+// due. The queue is short, so it's scanned for the due emails rather than
+// indexed by time.
+
+// QueueEmail fulfills kvstor.EmailQueue
+func (bdp boltdbProvider) QueueEmail(id string, email []byte, due int64) error {
+	return bdp.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(emailQueueBucketName).Put([]byte(id), append(int64ToBytes(due), email...))
+	})
+}
+
+// DueEmails fulfills kvstor.EmailQueue
+func (bdp boltdbProvider) DueEmails(now int64, max int) (map[string][]byte, error) {
+	emails := map[string][]byte{}
+	err := bdp.view(func(tx *bolt.Tx) error {
+		c := tx.Bucket(emailQueueBucketName).Cursor()
+		for k, v := c.First(); k != nil && len(emails) < max; k, v = c.Next() {
+			if len(v) < 8 {
+				return fmt.Errorf("queued email %s is cut short", k)
+			}
+			due, err := bytesToInt64(v[:8])
+			if err != nil {
+				return err
+			}
+			// copied, because the slices are only valid during the
+			// transaction
+			if due <= now {
+				emails[string(k)] = append([]byte{}, v[8:]...)
+			}
+		}
+		return nil
+	})
+	return emails, err
+}
+
+// DequeueEmail fulfills kvstor.EmailQueue
+func (bdp boltdbProvider) DequeueEmail(id string, deadLetter []byte) error {
+	return bdp.update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(emailQueueBucketName).Delete([]byte(id)); err != nil {
+			return err
+		}
+		if deadLetter == nil {
+			return nil
+		}
+		return tx.Bucket(deadLettersBucketName).Put([]byte(id), deadLetter)
+	})
+}
+
+// ReplaceQueuedEmail fulfills kvstor.EmailQueue
+func (bdp boltdbProvider) ReplaceQueuedEmail(id string, email []byte) (bool, error) {
+	replaced := false
+	err := bdp.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(emailQueueBucketName)
+		v := b.Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		if len(v) < 8 {
+			return fmt.Errorf("queued email %s is cut short", id)
+		}
+		replaced = true
+		return b.Put([]byte(id), append(append([]byte{}, v[:8]...), email...))
+	})
+	return replaced, err
+}
+
+// DeadLetters fulfills kvstor.EmailQueue
+func (bdp boltdbProvider) DeadLetters() (map[string][]byte, error) {
+	letters := map[string][]byte{}
+	err := bdp.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(deadLettersBucketName).ForEach(func(k, v []byte) error {
+			letters[string(k)] = append([]byte{}, v...)
+			return nil
+		})
+	})
+	return letters, err
+}
+
+// DeleteDeadLetter fulfills kvstor.EmailQueue
+func (bdp boltdbProvider) DeleteDeadLetter(id string) error {
+	return bdp.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(deadLettersBucketName).Delete([]byte(id))
+	})
+}
+
+// ReplaceDeadLetter fulfills kvstor.EmailQueue
+func (bdp boltdbProvider) ReplaceDeadLetter(id string, deadLetter []byte) (bool, error) {
+	replaced := false
+	err := bdp.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(deadLettersBucketName)
+		if b.Get([]byte(id)) == nil {
+			return nil
+		}
+		replaced = true
+		return b.Put([]byte(id), deadLetter)
+	})
+	return replaced, err
+}
@@ -0,0 +1,80 @@
+package boltdb
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEmailQueue(t *testing.T) {
+	db := Temp(t)
+	defer db.Close()
+
+	if err := db.QueueEmail("a", []byte("email a"), 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueueEmail("b", []byte("email b"), 200); err != nil {
+		t.Fatal(err)
+	}
+	due, err := db.DueEmails(150, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(due, map[string][]byte{"a": []byte("email a")}) {
+		t.Fatalf("expected only email a to be due. Got %v", due)
+	}
+	if due, _ = db.DueEmails(250, 1); len(due) != 1 {
+		t.Fatalf("expected a single email. Got %d", len(due))
+	}
+
+	// queueing again reschedules
+	if err = db.QueueEmail("a", []byte("retried a"), 300); err != nil {
+		t.Fatal(err)
+	}
+	if due, _ = db.DueEmails(250, 10); !reflect.DeepEqual(due, map[string][]byte{"b": []byte("email b")}) {
+		t.Fatalf("expected only email b to be due. Got %v", due)
+	}
+
+	// replacing keeps when the email is due
+	if replaced, err := db.ReplaceQueuedEmail("b", []byte("resealed b")); err != nil || !replaced {
+		t.Fatalf("expected email b to be replaced. Got %v, %v", replaced, err)
+	}
+	if due, _ = db.DueEmails(250, 10); !reflect.DeepEqual(due, map[string][]byte{"b": []byte("resealed b")}) {
+		t.Fatalf("expected the replaced email b to be due. Got %v", due)
+	}
+	if replaced, err := db.ReplaceQueuedEmail("c", []byte("email c")); err != nil || replaced {
+		t.Fatalf("expected unknown email c to be left alone. Got %v, %v", replaced, err)
+	}
+
+	if err = db.DequeueEmail("b", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.DequeueEmail("a", []byte("dead a")); err != nil {
+		t.Fatal(err)
+	}
+	if due, _ = db.DueEmails(1000, 10); len(due) != 0 {
+		t.Fatalf("expected an empty queue. Got %v", due)
+	}
+	letters, err := db.DeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(letters, map[string][]byte{"a": []byte("dead a")}) {
+		t.Fatalf("expected the dead letter of a. Got %v", letters)
+	}
+	if replaced, err := db.ReplaceDeadLetter("a", []byte("resealed a")); err != nil || !replaced {
+		t.Fatalf("expected the dead letter of a to be replaced. Got %v, %v", replaced, err)
+	}
+	if letters, _ = db.DeadLetters(); !reflect.DeepEqual(letters, map[string][]byte{"a": []byte("resealed a")}) {
+		t.Fatalf("expected the replaced dead letter of a. Got %v", letters)
+	}
+
+	if err = db.DeleteDeadLetter("a"); err != nil {
+		t.Fatal(err)
+	}
+	if letters, _ = db.DeadLetters(); len(letters) != 0 {
+		t.Fatalf("expected no dead letters. Got %v", letters)
+	}
+	if replaced, err := db.ReplaceDeadLetter("a", []byte("resealed a")); err != nil || replaced {
+		t.Fatalf("expected the deleted dead letter to stay deleted. Got %v, %v", replaced, err)
+	}
+}
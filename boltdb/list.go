@@ -0,0 +1,61 @@
+package boltdb
+
+import (
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// The slices handed to the listing functions are copies, since the ones
+// bolt returns are only valid during the transaction.
+
+// ListPackages fulfills kvstor.Lister
+func (bdp boltdbProvider) ListPackages(fn func(boxID, pkg []byte, expires int64) error) error {
+	now := time.Now().Unix()
+	return bdp.view(func(tx *bolt.Tx) error {
+		expiries := tx.Bucket(dropboxExpiriesBucketName)
+		return tx.Bucket(dropboxesBucketName).ForEach(func(boxID, pkg []byte) error {
+			var expires int64
+			if buf := expiries.Get(boxID); buf != nil {
+				var err error
+				if expires, err = bytesToInt64(buf); err != nil {
+					return err
+				}
+				if expires <= now {
+					return nil
+				}
+			}
+			return fn(append([]byte{}, boxID...), append([]byte{}, pkg...), expires)
+		})
+	})
+}
+
+// ListIDs fulfills kvstor.Lister
+func (bdp boltdbProvider) ListIDs(fn func(userID int64, pubID []byte) error) error {
+	return bdp.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(publicIDsBucketName).ForEach(func(k, pubID []byte) error {
+			userID, err := bytesToInt64(k)
+			if err != nil {
+				return err
+			}
+			return fn(userID, append([]byte{}, pubID...))
+		})
+	})
+}
+
+// ListDebugCaptures fulfills kvstor.Lister
+func (bdp boltdbProvider) ListDebugCaptures(fn func(userID int64, until int64) error) error {
+	return bdp.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(debugCapturesBucketName).ForEach(func(k, v []byte) error {
+			userID, err := bytesToInt64(k)
+			if err != nil {
+				return err
+			}
+			until, err := bytesToInt64(v)
+			if err != nil {
+				return err
+			}
+			return fn(userID, until)
+		})
+	})
+}
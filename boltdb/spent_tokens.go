@@ -0,0 +1,64 @@
+package boltdb
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Each spent token id is kept with the 8 bytes of when it expires, and is
+// purged like packages.
+
+// SpendToken fulfills kvstor.SpentTokens
+func (bdp boltdbProvider) SpendToken(id []byte, expires int64) (bool, error) {
+	spent := false
+	now := time.Now().Unix()
+	err := bdp.update(func(tx *bolt.Tx) error {
+		spent = false
+		b := tx.Bucket(spentTokensBucketName)
+		if buf := b.Get(id); buf != nil {
+			exp, err := bytesToInt64(buf)
+			if err != nil {
+				return fmt.Errorf("expiry of token %x: %w", id, err)
+			}
+			if exp > now {
+				return nil
+			}
+		}
+		spent = true
+		return b.Put(id, int64ToBytes(expires))
+	})
+	return spent, err
+}
+
+// PurgeSpentTokens fulfills kvstor.SpentTokens
+func (bdp boltdbProvider) PurgeSpentTokens(now int64) (int, error) {
+	purged := 0
+	err := bdp.update(func(tx *bolt.Tx) error {
+		purged = 0
+		var expired [][]byte
+		b := tx.Bucket(spentTokensBucketName)
+		err := b.ForEach(func(id, buf []byte) error {
+			expires, err := bytesToInt64(buf)
+			if err != nil {
+				return fmt.Errorf("expiry of token %x: %w", id, err)
+			}
+			if expires <= now {
+				expired = append(expired, append([]byte{}, id...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, id := range expired {
+			if err := b.Delete(id); err != nil {
+				return err
+			}
+			purged++
+		}
+		return nil
+	})
+	return purged, err
+}
@@ -0,0 +1,38 @@
+package boltdb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSpentTokens(t *testing.T) {
+	db := Temp(t)
+	defer db.Close()
+
+	now := time.Now()
+	expires := now.Add(time.Hour).Unix()
+	if spent, err := db.SpendToken([]byte("a"), expires); err != nil || !spent {
+		t.Fatalf("expected a to be spent. Got %v, %v", spent, err)
+	}
+	if spent, err := db.SpendToken([]byte("a"), expires); err != nil || spent {
+		t.Fatalf("expected a to be spent already. Got %v, %v", spent, err)
+	}
+	if spent, err := db.SpendToken([]byte("b"), expires); err != nil || !spent {
+		t.Fatalf("expected b to be spent. Got %v, %v", spent, err)
+	}
+
+	// an expired id doesn't count as spent, and is purged
+	expired := now.Add(-time.Minute).Unix()
+	if spent, err := db.SpendToken([]byte("c"), expired); err != nil || !spent {
+		t.Fatalf("expected c to be spent. Got %v, %v", spent, err)
+	}
+	if spent, err := db.SpendToken([]byte("c"), expired); err != nil || !spent {
+		t.Fatalf("expected expired c to be spent again. Got %v, %v", spent, err)
+	}
+	if purged, err := db.PurgeSpentTokens(now.Unix()); err != nil || purged != 1 {
+		t.Fatalf("expected c to be purged. Got %d, %v", purged, err)
+	}
+	if spent, _ := db.SpendToken([]byte("a"), expires); spent {
+		t.Fatal("expected a to outlast the purge")
+	}
+}
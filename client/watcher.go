@@ -0,0 +1,250 @@
+// Package client holds helpers for apps that talk to the oscar API.
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+// DropBoxIDSize is the size of a drop box id in bytes
+const DropBoxIDSize = 16
+
+// socket commands, as defined by the server in server/sockets.go
+const (
+	socketClientCmdWatch  byte = 1
+	socketClientCmdIgnore byte = 2
+
+	socketServerCmdPackage byte = 1
+)
+
+// Backoff between reconnection attempts. It doubles after every failed
+// attempt, and resets once a connection succeeds.
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = time.Minute
+)
+
+// Package is the contents of a drop box
+type Package struct {
+	BoxID []byte
+	Data  []byte
+}
+
+// Watcher delivers the packages dropped in a set of drop boxes. It keeps a
+// socket open to the server, reconnecting whenever it drops, and watches the
+// boxes again after each reconnection. Packages are delivered once, even
+// though the server sends the current package of a box every time it is
+// watched.
+type Watcher struct {
+	endpoint string
+	token    func() (string, error)
+	pkgs     chan Package
+	done     chan struct{}
+	stopped  chan struct{}
+
+	mu    sync.Mutex
+	conn  *websocket.Conn
+	boxes map[string]bool
+	// seen holds the digest of the last package delivered from each box
+	seen map[string][sha256.Size]byte
+	// closeErr is the error returned by closing the connection in Close
+	closeErr error
+}
+
+// NewWatcher starts watching drop boxes over the socket at endpoint, e.g.
+// "wss://api.zood.xyz/1/sockets". token is called before every connection
+// attempt, so it can return a fresh access token after the last one expired.
+func NewWatcher(endpoint string, token func() (string, error)) *Watcher {
+	w := &Watcher{
+		endpoint: endpoint,
+		token:    token,
+		pkgs:     make(chan Package, 16),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		boxes:    map[string]bool{},
+		seen:     map[string][sha256.Size]byte{},
+	}
+	go w.run()
+	return w
+}
+
+// Packages returns the channel packages are delivered on. It's closed
+// after Close.
+func (w *Watcher) Packages() <-chan Package {
+	return w.pkgs
+}
+
+// Watch subscribes to the packages dropped in boxID
+func (w *Watcher) Watch(boxID []byte) error {
+	if len(boxID) != DropBoxIDSize {
+		return errors.Errorf("drop box ids are %d bytes; got %d", DropBoxIDSize, len(boxID))
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	key := hex.EncodeToString(boxID)
+	if w.boxes[key] {
+		return nil
+	}
+	w.boxes[key] = true
+	// when disconnected, the box is watched after reconnecting
+	w.send(socketClientCmdWatch, boxID)
+	return nil
+}
+
+// Ignore unsubscribes from boxID
+func (w *Watcher) Ignore(boxID []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	key := hex.EncodeToString(boxID)
+	if !w.boxes[key] {
+		return
+	}
+	delete(w.boxes, key)
+	delete(w.seen, key)
+	w.send(socketClientCmdIgnore, boxID)
+}
+
+// Close disconnects from the server and stops reconnecting
+func (w *Watcher) Close() error {
+	w.mu.Lock()
+	select {
+	case <-w.done:
+		w.mu.Unlock()
+		return nil
+	default:
+	}
+	close(w.done)
+	if w.conn != nil {
+		w.closeErr = w.conn.Close()
+	}
+	w.mu.Unlock()
+
+	<-w.stopped
+	return w.closeErr
+}
+
+// send writes a command to the socket, if there is one. Callers must hold
+// w.mu. Write errors are left for the read loop to notice.
+func (w *Watcher) send(cmd byte, boxID []byte) {
+	if w.conn == nil {
+		return
+	}
+	w.conn.WriteMessage(websocket.BinaryMessage, append([]byte{cmd}, boxID...))
+}
+
+func (w *Watcher) run() {
+	defer close(w.stopped)
+	defer close(w.pkgs)
+
+	delay := minReconnectDelay
+	for {
+		conn, err := w.connect()
+		if err == nil {
+			delay = minReconnectDelay
+			w.read(conn)
+		}
+
+		select {
+		case <-w.done:
+			return
+		case <-time.After(delay):
+		}
+		if err != nil {
+			delay *= 2
+			if delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+		}
+	}
+}
+
+// connect dials the server and watches every box again
+func (w *Watcher) connect() (*websocket.Conn, error) {
+	token, err := w.token()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get an access token")
+	}
+	hdrs := make(http.Header)
+	hdrs.Set("Sec-Websocket-Protocol", token)
+	conn, _, err := websocket.DefaultDialer.Dial(w.endpoint, hdrs)
+	if err != nil {
+		return nil, err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	select {
+	case <-w.done:
+		conn.Close()
+		return nil, errors.New("watcher is closed")
+	default:
+	}
+	w.conn = conn
+	for key := range w.boxes {
+		boxID, _ := hex.DecodeString(key)
+		w.send(socketClientCmdWatch, boxID)
+	}
+	return conn, nil
+}
+
+// read delivers packages from conn until it fails
+func (w *Watcher) read(conn *websocket.Conn) {
+	defer func() {
+		w.mu.Lock()
+		if w.conn == conn {
+			w.conn = nil
+		}
+		w.mu.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		_, buf, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if len(buf) < 1+DropBoxIDSize || buf[0] != socketServerCmdPackage {
+			continue
+		}
+		pkg, ok := w.dedupe(buf[1:1+DropBoxIDSize], buf[1+DropBoxIDSize:])
+		if !ok {
+			continue
+		}
+		select {
+		case w.pkgs <- pkg:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// dedupe returns the package to deliver, or false if it was already
+// delivered, or the box is no longer watched
+func (w *Watcher) dedupe(boxID, data []byte) (Package, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	key := hex.EncodeToString(boxID)
+	if !w.boxes[key] {
+		return Package{}, false
+	}
+	digest := sha256.Sum256(data)
+	if last, ok := w.seen[key]; ok && bytes.Equal(last[:], digest[:]) {
+		return Package{}, false
+	}
+	w.seen[key] = digest
+
+	return Package{
+		BoxID: append([]byte(nil), boxID...),
+		Data:  append([]byte(nil), data...),
+	}, true
+}
@@ -0,0 +1,118 @@
+package client
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSocketServer replies to every watch with the current package of the
+// box, like the real server does
+type fakeSocketServer struct {
+	t     *testing.T
+	mu    sync.Mutex
+	pkgs  map[string][]byte
+	conns []*websocket.Conn
+	// watches counts the watch commands received
+	watches int
+}
+
+func (fs *fakeSocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	require.Equal(fs.t, "access-token", r.Header.Get("Sec-Websocket-Protocol"))
+	upgrader := websocket.Upgrader{}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	require.NoError(fs.t, err)
+	fs.mu.Lock()
+	fs.conns = append(fs.conns, conn)
+	fs.mu.Unlock()
+
+	for {
+		_, buf, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if buf[0] != socketClientCmdWatch {
+			continue
+		}
+		fs.mu.Lock()
+		pkg := fs.pkgs[string(buf[1:])]
+		fs.mu.Unlock()
+		if pkg != nil {
+			fs.drop(conn, buf[1:], pkg)
+		}
+		// counted after replying, so the test's writes don't race this one
+		fs.mu.Lock()
+		fs.watches++
+		fs.mu.Unlock()
+	}
+}
+
+func (fs *fakeSocketServer) drop(conn *websocket.Conn, boxID, pkg []byte) {
+	msg := append([]byte{socketServerCmdPackage}, boxID...)
+	conn.WriteMessage(websocket.BinaryMessage, append(msg, pkg...))
+}
+
+func (fs *fakeSocketServer) lastConn() *websocket.Conn {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.conns[len(fs.conns)-1]
+}
+
+func (fs *fakeSocketServer) watchCount() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.watches
+}
+
+func receive(t *testing.T, w *Watcher) Package {
+	t.Helper()
+	select {
+	case pkg := <-w.Packages():
+		return pkg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a package")
+		return Package{}
+	}
+}
+
+func TestWatcherResubscribes(t *testing.T) {
+	boxID := bytes.Repeat([]byte{7}, DropBoxIDSize)
+	fake := &fakeSocketServer{t: t, pkgs: map[string][]byte{string(boxID): []byte("first")}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	w := NewWatcher("ws"+strings.TrimPrefix(server.URL, "http"), func() (string, error) {
+		return "access-token", nil
+	})
+	defer w.Close()
+
+	require.Error(t, w.Watch([]byte("short")))
+	require.NoError(t, w.Watch(boxID))
+	pkg := receive(t, w)
+	require.Equal(t, boxID, pkg.BoxID)
+	require.Equal(t, []byte("first"), pkg.Data)
+
+	// drop the connection. The watcher reconnects, and watches the box again.
+	fake.lastConn().Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for fake.watchCount() < 2 {
+		require.True(t, time.Now().Before(deadline), "the box wasn't watched again")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the replayed package was already delivered, so only the new one arrives
+	fake.drop(fake.lastConn(), boxID, []byte("second"))
+	pkg = receive(t, w)
+	require.Equal(t, []byte("second"), pkg.Data)
+
+	require.NoError(t, w.Close())
+	_, ok := <-w.Packages()
+	require.False(t, ok)
+}
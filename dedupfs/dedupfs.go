@@ -0,0 +1,247 @@
+// Package dedupfs wraps a filestor.Provider, so files with the same content
+// are stored once. Files are stored as objects named after the SHA-256 hash
+// of their content, and a kvstor.ContentIndex maps the path of each file to
+// its object and counts the references to every object.
+package dedupfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"zood.dev/oscar/filestor"
+	"zood.dev/oscar/kvstor"
+)
+
+// objectsDir holds the objects in the underlying provider. The leading dot
+// keeps it apart from the paths of files.
+const objectsDir = ".dedup/objects"
+
+type dedupProvider struct {
+	p     filestor.Provider
+	index kvstor.ContentIndex
+	// locks is shared by the copies made by WithContext
+	locks *hashLocks
+}
+
+// New returns a filestor.Provider that stores the files written to it in p,
+// deduplicated by their content. Uploads are spooled to a temporary file on
+// local disk while they're hashed, so the content of a file that's already
+// stored never reaches p again.
+//
+// Files p already held under their own path are still read, listed and
+// deleted. They're replaced by an object the next time they're written.
+func New(p filestor.Provider, index kvstor.ContentIndex) filestor.Provider {
+	return dedupProvider{p: p, index: index, locks: newHashLocks()}
+}
+
+func objectPath(hash []byte) string {
+	h := hex.EncodeToString(hash)
+	return objectsDir + "/" + h[:2] + "/" + h
+}
+
+// WithContext fulfills filestor.Provider
+func (dp dedupProvider) WithContext(ctx context.Context) filestor.Provider {
+	dp.p = dp.p.WithContext(ctx)
+	return dp
+}
+
+// resolve returns the path in p holding the content of relPath
+func (dp dedupProvider) resolve(relPath string) (string, error) {
+	hash, err := dp.index.ContentHash(relPath)
+	if err != nil {
+		return "", errors.Wrap(err, "looking up the content of the file")
+	}
+	if hash == nil {
+		// stored before deduplication was turned on, if at all
+		return relPath, nil
+	}
+	return objectPath(hash), nil
+}
+
+// FileSize fulfills filestor.Provider
+func (dp dedupProvider) FileSize(relPath string) (int64, error) {
+	path, err := dp.resolve(relPath)
+	if err != nil {
+		return 0, err
+	}
+	return dp.p.FileSize(path)
+}
+
+// ReadFile fulfills filestor.Provider
+func (dp dedupProvider) ReadFile(relPath string) (io.ReadCloser, error) {
+	path, err := dp.resolve(relPath)
+	if err != nil {
+		return nil, err
+	}
+	return dp.p.ReadFile(path)
+}
+
+// WriteFile fulfills filestor.Provider. When the content is already stored,
+// nothing is written to the underlying provider.
+func (dp dedupProvider) WriteFile(relPath string, src io.Reader) error {
+	if strings.HasPrefix(relPath, objectsDir) {
+		return errors.Errorf("'%s' is reserved for deduplicated objects", objectsDir)
+	}
+
+	prev, err := dp.index.ContentHash(relPath)
+	if err != nil {
+		return errors.Wrap(err, "looking up the content of the file")
+	}
+	spool, err := ioutil.TempFile("", "dedupfs-")
+	if err != nil {
+		return errors.Wrap(err, "creating the spool file")
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(spool, h), src); err != nil {
+		return err
+	}
+	hash := h.Sum(nil)
+
+	old, oldRefs, err := dp.link(relPath, hash, spool)
+	if err != nil {
+		return err
+	}
+	if prev == nil {
+		// an older copy may be stored under the path itself
+		if err = dp.p.DeleteFile(relPath); err != nil {
+			return errors.Wrap(err, "deleting the file stored before deduplication")
+		}
+	}
+	if old != nil && oldRefs == 0 {
+		return dp.release(old)
+	}
+	return nil
+}
+
+// link stores the object of hash from spool, unless it's already stored, and
+// points relPath at it
+func (dp dedupProvider) link(relPath string, hash []byte, spool *os.File) ([]byte, int64, error) {
+	// the object mustn't be released between checking for it and linking it
+	unlock := dp.locks.lock(hash)
+	defer unlock()
+
+	refs, err := dp.index.ContentReferences(hash)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "counting the references to the content")
+	}
+	if refs == 0 {
+		if _, err = spool.Seek(0, io.SeekStart); err != nil {
+			return nil, 0, err
+		}
+		if err = dp.p.WriteFile(objectPath(hash), spool); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	old, oldRefs, err := dp.index.LinkContent(relPath, hash)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "linking the file to its content")
+	}
+	return old, oldRefs, nil
+}
+
+// release deletes the object of hash, if nothing references it anymore
+func (dp dedupProvider) release(hash []byte) error {
+	unlock := dp.locks.lock(hash)
+	defer unlock()
+
+	refs, err := dp.index.ContentReferences(hash)
+	if err != nil {
+		return errors.Wrap(err, "counting the references to the content")
+	}
+	if refs > 0 {
+		// linked again in the meantime
+		return nil
+	}
+	return dp.p.DeleteFile(objectPath(hash))
+}
+
+// ListFiles fulfills filestor.Provider
+func (dp dedupProvider) ListFiles(dir string, fn func(relPath string) error) error {
+	prefix := strings.TrimSuffix(dir, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	listed := make(map[string]bool)
+	err := dp.index.ContentNames(prefix, func(name string) error {
+		listed[name] = true
+		return fn(name)
+	})
+	if err != nil {
+		return err
+	}
+
+	// and the files stored before deduplication was turned on
+	return dp.p.ListFiles(dir, func(relPath string) error {
+		if listed[relPath] || strings.HasPrefix(relPath, objectsDir+"/") {
+			return nil
+		}
+		return fn(relPath)
+	})
+}
+
+// DeleteFile fulfills filestor.Provider
+func (dp dedupProvider) DeleteFile(relPath string) error {
+	old, oldRefs, err := dp.index.UnlinkContent(relPath)
+	if err != nil {
+		return errors.Wrap(err, "unlinking the file from its content")
+	}
+	if old == nil {
+		return dp.p.DeleteFile(relPath)
+	}
+	if oldRefs == 0 {
+		return dp.release(old)
+	}
+	return nil
+}
+
+// hashLocks serializes the work on each object
+type hashLocks struct {
+	mu    sync.Mutex
+	locks map[string]*hashLock
+}
+
+type hashLock struct {
+	sync.Mutex
+	// users counts the holders and waiters, so the lock can be dropped from
+	// the map once there are none
+	users int
+}
+
+func newHashLocks() *hashLocks {
+	return &hashLocks{locks: make(map[string]*hashLock)}
+}
+
+// lock locks hash, and returns the func unlocking it
+func (hl *hashLocks) lock(hash []byte) func() {
+	key := string(hash)
+	hl.mu.Lock()
+	l, ok := hl.locks[key]
+	if !ok {
+		l = &hashLock{}
+		hl.locks[key] = l
+	}
+	l.users++
+	hl.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		hl.mu.Lock()
+		l.users--
+		if l.users == 0 {
+			delete(hl.locks, key)
+		}
+		hl.mu.Unlock()
+	}
+}
@@ -0,0 +1,236 @@
+package dedupfs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/filestor"
+	"zood.dev/oscar/memfs"
+)
+
+// memIndex is a kvstor.ContentIndex kept in memory
+type memIndex struct {
+	mu    sync.Mutex
+	names map[string]string
+	refs  map[string]int64
+}
+
+func newMemIndex() *memIndex {
+	return &memIndex{names: make(map[string]string), refs: make(map[string]int64)}
+}
+
+func (mi *memIndex) ContentHash(name string) ([]byte, error) {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	if h, ok := mi.names[name]; ok {
+		return []byte(h), nil
+	}
+	return nil, nil
+}
+
+func (mi *memIndex) ContentReferences(hash []byte) (int64, error) {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	return mi.refs[string(hash)], nil
+}
+
+func (mi *memIndex) LinkContent(name string, hash []byte) ([]byte, int64, error) {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	cur, ok := mi.names[name]
+	if ok && cur == string(hash) {
+		return nil, 0, nil
+	}
+	mi.names[name] = string(hash)
+	mi.refs[string(hash)]++
+	if !ok {
+		return nil, 0, nil
+	}
+	return []byte(cur), mi.release(cur), nil
+}
+
+func (mi *memIndex) UnlinkContent(name string) ([]byte, int64, error) {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	cur, ok := mi.names[name]
+	if !ok {
+		return nil, 0, nil
+	}
+	delete(mi.names, name)
+	return []byte(cur), mi.release(cur), nil
+}
+
+func (mi *memIndex) release(hash string) int64 {
+	mi.refs[hash]--
+	refs := mi.refs[hash]
+	if refs == 0 {
+		delete(mi.refs, hash)
+	}
+	return refs
+}
+
+func (mi *memIndex) ContentNames(prefix string, fn func(name string) error) error {
+	mi.mu.Lock()
+	var names []string
+	for name := range mi.names {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	mi.mu.Unlock()
+	sort.Strings(names)
+	for _, name := range names {
+		if err := fn(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countingProvider counts the writes that reach its provider
+type countingProvider struct {
+	filestor.Provider
+	mu     sync.Mutex
+	writes int
+}
+
+func (cp *countingProvider) WriteFile(relPath string, src io.Reader) error {
+	cp.mu.Lock()
+	cp.writes++
+	cp.mu.Unlock()
+	return cp.Provider.WriteFile(relPath, src)
+}
+
+func (cp *countingProvider) WithContext(ctx context.Context) filestor.Provider {
+	return cp
+}
+
+func (cp *countingProvider) written() int {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.writes
+}
+
+func listAll(t *testing.T, p filestor.Provider, dir string) []string {
+	var paths []string
+	require.NoError(t, p.ListFiles(dir, func(relPath string) error {
+		paths = append(paths, relPath)
+		return nil
+	}))
+	sort.Strings(paths)
+	return paths
+}
+
+func TestDeduplicates(t *testing.T) {
+	backend := &countingProvider{Provider: memfs.New()}
+	p := New(backend, newMemIndex())
+	data := bytes.Repeat([]byte("backup"), 100000)
+
+	require.NoError(t, p.WriteFile("backups/1", bytes.NewReader(data)))
+	require.Equal(t, 1, backend.written())
+	// the same content under another path, or again under the same path,
+	// isn't written again
+	require.NoError(t, p.WriteFile("backups/2", bytes.NewReader(data)))
+	require.NoError(t, p.WriteFile("backups/1", bytes.NewReader(data)))
+	require.Equal(t, 1, backend.written())
+
+	for _, path := range []string{"backups/1", "backups/2"} {
+		stored, err := filestor.ReadAll(p, path)
+		require.NoError(t, err)
+		require.Equal(t, data, stored)
+		size, err := p.FileSize(path)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(data)), size)
+	}
+	require.Equal(t, []string{"backups/1", "backups/2"}, listAll(t, p, "backups"))
+	require.Len(t, listAll(t, backend, objectsDir), 1)
+
+	// the object is kept until the last file using it is gone
+	require.NoError(t, p.WriteFile("backups/1", strings.NewReader("changed")))
+	require.Equal(t, 2, backend.written())
+	require.Len(t, listAll(t, backend, objectsDir), 2)
+	require.NoError(t, p.DeleteFile("backups/2"))
+	require.Len(t, listAll(t, backend, objectsDir), 1)
+	_, err := p.ReadFile("backups/2")
+	require.Equal(t, filestor.ErrFileNotExist, err)
+
+	require.NoError(t, p.DeleteFile("backups/1"))
+	require.Empty(t, listAll(t, backend, ""))
+	require.NoError(t, p.DeleteFile("backups/1"))
+}
+
+func TestFailedUploadKeepsPrevious(t *testing.T) {
+	backend := &countingProvider{Provider: memfs.New()}
+	p := New(backend, newMemIndex())
+	require.NoError(t, p.WriteFile("backups/1", strings.NewReader("first")))
+
+	err := p.WriteFile("backups/1", io.MultiReader(strings.NewReader("partial"), errReader{}))
+	require.Error(t, err)
+	stored, err := filestor.ReadAll(p, "backups/1")
+	require.NoError(t, err)
+	require.Equal(t, "first", string(stored))
+	require.Equal(t, 1, backend.written())
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) { return 0, errors.New("connection reset") }
+
+func TestFilesStoredBeforeDeduplication(t *testing.T) {
+	backend := memfs.New()
+	require.NoError(t, backend.WriteFile("backups/1", strings.NewReader("legacy")))
+	require.NoError(t, backend.WriteFile("backups/2", strings.NewReader("legacy too")))
+	p := New(backend, newMemIndex())
+
+	stored, err := filestor.ReadAll(p, "backups/1")
+	require.NoError(t, err)
+	require.Equal(t, "legacy", string(stored))
+	require.Equal(t, []string{"backups/1", "backups/2"}, listAll(t, p, "backups"))
+
+	// writing one moves it to an object
+	require.NoError(t, p.WriteFile("backups/1", strings.NewReader("new")))
+	_, err = backend.FileSize("backups/1")
+	require.Equal(t, filestor.ErrFileNotExist, err)
+	require.Equal(t, []string{"backups/1", "backups/2"}, listAll(t, p, ""))
+
+	require.NoError(t, p.DeleteFile("backups/2"))
+	require.Equal(t, []string{"backups/1"}, listAll(t, p, "backups"))
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	backend := memfs.New()
+	p := New(backend, newMemIndex())
+	contents := []string{"a", "b", "c"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			path := "backups/" + contents[i%2]
+			require.NoError(t, p.WriteFile(path, strings.NewReader(contents[i%3])))
+		}(i)
+	}
+	wg.Wait()
+
+	// every file can be read, and only the objects in use are kept
+	used := make(map[string]bool)
+	for _, path := range listAll(t, p, "backups") {
+		stored, err := filestor.ReadAll(p, path)
+		require.NoError(t, err)
+		used[string(stored)] = true
+	}
+	require.Len(t, listAll(t, backend, objectsDir), len(used))
+}
+
+func TestReservesObjectsDir(t *testing.T) {
+	p := New(memfs.New(), newMemIndex())
+	require.Error(t, p.WriteFile(objectsDir+"/ab/cd", strings.NewReader("x")))
+}
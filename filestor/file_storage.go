@@ -1,15 +1,42 @@
 package filestor
 
 import (
+	"context"
 	"errors"
 	"io"
+	"io/ioutil"
 )
 
 // Provider is the set of functionality required by oscar of a file storage system.
 type Provider interface {
-	ReadFile(relPath string, dst io.Writer) error
+	// FileSize returns the size of the file in bytes, or ErrFileNotExist
+	FileSize(relPath string) (int64, error)
+	// ReadFile opens the file for reading, or returns ErrFileNotExist. The
+	// caller must close it.
+	ReadFile(relPath string) (io.ReadCloser, error)
+	// WriteFile streams src into the file, replacing it. When src fails, the
+	// previous contents of the file are kept.
 	WriteFile(relPath string, src io.Reader) error
+	// ListFiles calls fn with the path of every file in dir and its
+	// subdirectories, in no particular order. Listing stops at the first
+	// error returned by fn.
+	ListFiles(dir string, fn func(relPath string) error) error
+	// DeleteFile removes the file. Removing a file that doesn't exist isn't
+	// an error.
+	DeleteFile(relPath string) error
+	// WithContext returns a Provider whose operations are cancelled when ctx is
+	WithContext(ctx context.Context) Provider
 }
 
 // ErrFileNotExist indicates the files does not exist
 var ErrFileNotExist = errors.New("file does not exist")
+
+// ReadAll reads the whole file at relPath into memory
+func ReadAll(p Provider, relPath string) ([]byte, error) {
+	rc, err := p.ReadFile(relPath)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
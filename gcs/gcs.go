@@ -4,13 +4,17 @@ import (
 	"context"
 	"errors"
 	"io"
+	"net/http"
+	"strings"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 	"zood.dev/oscar/filestor"
 )
 
 type gcsProvider struct {
+	ctx    context.Context
 	bucket *storage.BucketHandle
 	client *storage.Client
 }
@@ -20,10 +24,25 @@ func New(credsPath, bucketName string) (filestor.Provider, error) {
 	if credsPath == "" {
 		return nil, errors.New("must provide the credentials file path")
 	}
+	return newProvider(bucketName, option.WithCredentialsFile(credsPath))
+}
+
+// NewWithHTTPClient returns a filestor.Provider that sends all of its
+// requests through hc. The client is used as is, so it's responsible for any
+// authentication. This is mostly useful for pointing the provider at an
+// emulated storage server.
+func NewWithHTTPClient(hc *http.Client, bucketName string) (filestor.Provider, error) {
+	if hc == nil {
+		return nil, errors.New("must provide an http client")
+	}
+	return newProvider(bucketName, option.WithHTTPClient(hc))
+}
+
+func newProvider(bucketName string, opts ...option.ClientOption) (filestor.Provider, error) {
 	if bucketName == "" {
 		return nil, errors.New("must provide a bucket name")
 	}
-	client, err := storage.NewClient(context.Background(), option.WithCredentialsFile(credsPath))
+	client, err := storage.NewClient(context.Background(), opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -34,29 +53,82 @@ func New(credsPath, bucketName string) (filestor.Provider, error) {
 	}
 
 	return gcsProvider{
+		ctx:    context.Background(),
 		bucket: bkt,
 		client: client,
 	}, nil
 }
 
-func (gp gcsProvider) ReadFile(relPath string, dst io.Writer) error {
-	obj := gp.bucket.Object(relPath)
-	rdr, err := obj.NewReader(context.Background())
+// WithContext fulfills filestor.Provider
+func (gp gcsProvider) WithContext(ctx context.Context) filestor.Provider {
+	gp.ctx = ctx
+	return gp
+}
+
+func (gp gcsProvider) FileSize(relPath string) (int64, error) {
+	attrs, err := gp.bucket.Object(relPath).Attrs(gp.ctx)
 	if err != nil {
 		if err == storage.ErrObjectNotExist {
-			return filestor.ErrFileNotExist
+			return 0, filestor.ErrFileNotExist
 		}
-		return err
+		return 0, err
 	}
+	return attrs.Size, nil
+}
 
-	_, err = io.Copy(dst, rdr)
-	return err
+func (gp gcsProvider) ReadFile(relPath string) (io.ReadCloser, error) {
+	obj := gp.bucket.Object(relPath)
+	rdr, err := obj.NewReader(gp.ctx)
+	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			return nil, filestor.ErrFileNotExist
+		}
+		return nil, err
+	}
+	return rdr, nil
 }
 
 func (gp gcsProvider) WriteFile(relPath string, src io.Reader) error {
+	// cancelling the context is the only way to abandon an upload. Closing
+	// the writer would commit whatever was written so far.
+	ctx, cancel := context.WithCancel(gp.ctx)
+	defer cancel()
 	obj := gp.bucket.Object(relPath)
-	dst := obj.NewWriter(context.Background())
-	defer dst.Close()
-	_, err := io.Copy(dst, src)
-	return err
+	dst := obj.NewWriter(ctx)
+	if _, err := io.Copy(dst, src); err != nil {
+		cancel()
+		dst.Close()
+		return err
+	}
+	// the object isn't committed until the writer is closed, so a cancelled
+	// context or failed upload only shows up here
+	return dst.Close()
+}
+
+func (gp gcsProvider) ListFiles(dir string, fn func(relPath string) error) error {
+	q := &storage.Query{}
+	if dir != "" {
+		q.Prefix = strings.TrimSuffix(dir, "/") + "/"
+	}
+	it := gp.bucket.Objects(gp.ctx, q)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = fn(attrs.Name); err != nil {
+			return err
+		}
+	}
+}
+
+func (gp gcsProvider) DeleteFile(relPath string) error {
+	err := gp.bucket.Object(relPath).Delete(gp.ctx)
+	if err != nil && err != storage.ErrObjectNotExist {
+		return err
+	}
+	return nil
 }
@@ -49,8 +49,7 @@ func TestReadNonExistentObject(t *testing.T) {
 	p := provider(t)
 	fp := filepath.Join(testDir, "should-not-exist")
 
-	dst := &bytes.Buffer{}
-	err := p.ReadFile(fp, dst)
+	_, err := p.ReadFile(fp)
 	if err != filestor.ErrFileNotExist {
 		t.Fatalf("Should have received 'file not exist'. Got %v", err)
 	}
@@ -70,13 +69,12 @@ func TestWriteNewFile(t *testing.T) {
 	}
 
 	// read it back
-	dst := &bytes.Buffer{}
-	err = p.ReadFile(fp, dst)
+	dst, err := filestor.ReadAll(p, fp)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !bytes.Equal(dst.Bytes(), data) {
-		t.Fatalf("data read back is not correct. Got '%s'", dst.String())
+	if !bytes.Equal(dst, data) {
+		t.Fatalf("data read back is not correct. Got '%s'", dst)
 	}
 }
 
@@ -98,12 +96,11 @@ func TestUpdateFile(t *testing.T) {
 	}
 
 	// read it back to make sure the update worked
-	dst := &bytes.Buffer{}
-	err = p.ReadFile(fp, dst)
+	dst, err := filestor.ReadAll(p, fp)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !bytes.Equal(dst.Bytes(), data2) {
-		t.Fatalf("data read back is not correct. Got '%s'", dst.String())
+	if !bytes.Equal(dst, data2) {
+		t.Fatalf("data read back is not correct. Got '%s'", dst)
 	}
 }
@@ -6,9 +6,12 @@ require (
 	cloud.google.com/go/storage v1.10.0
 	github.com/Masterminds/squirrel v1.4.0
 	github.com/boltdb/bolt v0.0.0-20161221234606-f0cf3bfd5b5f
+	github.com/dgraph-io/badger/v2 v2.2007.2
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible // indirect
 	github.com/gorilla/mux v1.7.4
 	github.com/gorilla/websocket v1.4.2
+	github.com/jackc/pgconn v1.6.4
+	github.com/jackc/pgx/v4 v4.8.1
 	github.com/jmoiron/sqlx v1.2.0
 	github.com/mattn/go-sqlite3 v1.14.0
 	github.com/pkg/errors v0.9.1
@@ -1,11 +1,156 @@
 package kvstor
 
+import "errors"
+
+// ErrBoxOwner is returned when a user adds an alias to a drop box whose
+// aliases are owned by another user
+var ErrBoxOwner = errors.New("the drop box's aliases belong to another user")
+
 // Provider is the set of functionality required by oscar of a persistent
 // key-value storage system.
 type Provider interface {
-	DropPackage(pkg []byte, boxID []byte) error
+	BoxAliases
+	ContentIndex
+	DebugCaptures
+	EmailQueue
+	IncidentNotice
+	SpentTokens
+	// DropPackage stores pkg in the box, replacing any package already
+	// there. The package expires at the unix time expires, or never when
+	// it's 0.
+	DropPackage(pkg []byte, boxID []byte, expires int64) error
 	InsertIds(userID int64, pubID []byte) error
+	// PickUpPackage returns the package in the box, or nil when the box is
+	// empty or its package expired
 	PickUpPackage(boxID []byte) ([]byte, error)
+	// PurgeExpiredPackages deletes the packages that expired by the unix
+	// time now, and returns how many it deleted. Providers whose storage
+	// expires keys on its own may always return 0.
+	PurgeExpiredPackages(now int64) (int, error)
 	PublicIDFromUserID(userID int64) ([]byte, error)
 	UserIDFromPublicID(pubID []byte) (int64, error)
 }
+
+// BoxAliases lets a drop box be reached through alias ids, so its id as
+// seen by observers can be rotated. The box keeps its own id, and one
+// current alias that doesn't expire. Adding an alias has the previous one
+// expire after a grace period, for the clients that haven't switched yet.
+type BoxAliases interface {
+	// AddBoxAlias makes alias lead to boxID, and the box's previous
+	// alias, if any, expire at the unix time graceUntil. The first user to
+	// add an alias to a box owns it, and ErrBoxOwner is returned for the
+	// others.
+	AddBoxAlias(boxID, alias []byte, ownerID int64, graceUntil int64) error
+	// BoxOfAlias returns the box alias leads to, or nil when it isn't an
+	// alias or it expired
+	BoxOfAlias(alias []byte) ([]byte, error)
+	// PurgeExpiredBoxAliases deletes the aliases that expired by the unix
+	// time now, and returns how many it deleted. Providers whose storage
+	// expires keys on its own may always return 0.
+	PurgeExpiredBoxAliases(now int64) (int, error)
+}
+
+// ContentIndex maps names to the hash of their content, and counts the names
+// that reference each hash, for content-addressed file storage. Each call is
+// atomic.
+type ContentIndex interface {
+	// ContentHash returns the hash name references, or nil
+	ContentHash(name string) ([]byte, error)
+	// ContentReferences counts the names referencing hash
+	ContentReferences(hash []byte) (int64, error)
+	// LinkContent points name at hash. When name referenced another hash
+	// before, that one is returned with the count of the names still
+	// referencing it. Otherwise old is nil.
+	LinkContent(name string, hash []byte) (old []byte, oldRefs int64, err error)
+	// UnlinkContent removes name, returning the hash it referenced, if any,
+	// like LinkContent
+	UnlinkContent(name string) (old []byte, oldRefs int64, err error)
+	// ContentNames calls fn with every name starting with prefix, in order.
+	// Listing stops at the first error returned by fn.
+	ContentNames(prefix string, fn func(name string) error) error
+}
+
+// DebugCaptures keeps the windows during which the requests of a user are
+// recorded, and the records. Records are opaque to the provider.
+type DebugCaptures interface {
+	// StartDebugCapture records the requests of userID until the unix time
+	// until, dropping the records of any earlier capture
+	StartDebugCapture(userID int64, until int64) error
+	// DebugCaptureUntil returns when the capture of userID ends, or 0 when
+	// there has been none
+	DebugCaptureUntil(userID int64) (int64, error)
+	// AppendDebugCapture adds a record to the capture of userID, keeping
+	// only the latest max records
+	AppendDebugCapture(userID int64, record []byte, max int) error
+	// DebugCapture returns the records of userID, oldest first
+	DebugCapture(userID int64) ([][]byte, error)
+	// DeleteDebugCapture ends the capture of userID, and drops its records
+	DeleteDebugCapture(userID int64) error
+}
+
+// EmailQueue holds the emails waiting to be sent, and the dead letters,
+// which are the emails given up on. Emails are opaque to the provider.
+type EmailQueue interface {
+	// QueueEmail stores email under id, to be sent from the unix time due
+	// on, replacing the queued email with that id, if any
+	QueueEmail(id string, email []byte, due int64) error
+	// DueEmails returns up to max of the emails due by the unix time now,
+	// keyed by id
+	DueEmails(now int64, max int) (map[string][]byte, error)
+	// DequeueEmail removes the email with id from the queue. When
+	// deadLetter isn't nil, it's kept as the dead letter of the email.
+	DequeueEmail(id string, deadLetter []byte) error
+	// ReplaceQueuedEmail replaces the queued email with id, keeping when
+	// it's due. It returns false, and changes nothing, when no email with
+	// id is queued.
+	ReplaceQueuedEmail(id string, email []byte) (bool, error)
+	// DeadLetters returns every dead letter, keyed by id
+	DeadLetters() (map[string][]byte, error)
+	// DeleteDeadLetter removes the dead letter with id
+	DeleteDeadLetter(id string) error
+	// ReplaceDeadLetter replaces the dead letter with id. It returns false,
+	// and changes nothing, when there's no dead letter with id.
+	ReplaceDeadLetter(id string, deadLetter []byte) (bool, error)
+}
+
+// IncidentNotice keeps the notice of an ongoing incident, which the client
+// apps show to users. The notice is opaque to the provider.
+type IncidentNotice interface {
+	// Incident returns the current notice, or nil when there's none
+	Incident() ([]byte, error)
+	// SetIncident replaces the current notice. A nil notice clears it.
+	SetIncident(notice []byte) error
+}
+
+// SpentTokens remembers the single use tokens that were spent, until they
+// would have expired anyway, so they can't be spent twice. The ids are
+// opaque to the provider.
+type SpentTokens interface {
+	// SpendToken marks id as spent until the unix time expires, and returns
+	// false if it already was. Checking and marking is atomic.
+	SpendToken(id []byte, expires int64) (bool, error)
+	// PurgeSpentTokens deletes the ids that expired by the unix time now,
+	// and returns how many it deleted. Providers whose storage expires keys
+	// on its own may always return 0.
+	PurgeSpentTokens(now int64) (int, error)
+}
+
+// Lister is implemented by the providers whose data can be listed, so it can
+// be copied to another provider. The content index is listed with
+// ContentNames. Listing stops at the first error returned by fn, which must
+// not use the provider being listed. The listing is only consistent when
+// nothing writes to the provider meanwhile.
+type Lister interface {
+	// ListPackages calls fn with every package that hasn't expired, and the
+	// unix time it expires, or 0
+	ListPackages(fn func(boxID, pkg []byte, expires int64) error) error
+	// ListIDs calls fn with every user id and its public id
+	ListIDs(fn func(userID int64, pubID []byte) error) error
+	// ListDebugCaptures calls fn with every user that has a debug capture,
+	// and when it ends
+	ListDebugCaptures(fn func(userID int64, until int64) error) error
+	// ListBoxAliases calls fn with every box alias that hasn't expired,
+	// the box it leads to and its owner, and the unix time it expires, or 0
+	// for the current alias of the box
+	ListBoxAliases(fn func(alias, boxID []byte, ownerID int64, expires int64) error) error
+}
@@ -1,17 +1,24 @@
 package localdisk
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/pkg/errors"
 	"zood.dev/oscar/filestor"
 )
 
+// tempPrefix starts the names of the temporary files of writes in progress
+const tempPrefix = ".tmp-"
+
 // localDiskProvider satisifies the filestor.Provider interface
 type localDiskProvider struct {
+	ctx     context.Context
 	rootDir string
 }
 
@@ -32,25 +39,49 @@ func New(rootDir string) (filestor.Provider, error) {
 		return nil, fmt.Errorf("'%s' is not a directory", rootDir)
 	}
 
-	return localDiskProvider{rootDir: rootDir}, nil
+	return localDiskProvider{ctx: context.Background(), rootDir: rootDir}, nil
+}
+
+// WithContext fulfills filestor.Provider. Disk operations can't be
+// interrupted, so ctx is only checked before a read or write starts.
+func (ldp localDiskProvider) WithContext(ctx context.Context) filestor.Provider {
+	ldp.ctx = ctx
+	return ldp
+}
+
+func (ldp localDiskProvider) FileSize(relPath string) (int64, error) {
+	if err := ldp.ctx.Err(); err != nil {
+		return 0, err
+	}
+	fi, err := os.Stat(filepath.Join(ldp.rootDir, relPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, filestor.ErrFileNotExist
+		}
+		return 0, err
+	}
+	return fi.Size(), nil
 }
 
-func (ldp localDiskProvider) ReadFile(relPath string, dst io.Writer) error {
+func (ldp localDiskProvider) ReadFile(relPath string) (io.ReadCloser, error) {
+	if err := ldp.ctx.Err(); err != nil {
+		return nil, err
+	}
 	fp := filepath.Join(ldp.rootDir, relPath)
 	f, err := os.Open(fp)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return filestor.ErrFileNotExist
+			return nil, filestor.ErrFileNotExist
 		}
-		return err
+		return nil, err
 	}
-	defer f.Close()
-
-	_, err = io.Copy(dst, f)
-	return err
+	return f, nil
 }
 
 func (ldp localDiskProvider) WriteFile(relPath string, src io.Reader) error {
+	if err := ldp.ctx.Err(); err != nil {
+		return err
+	}
 	fp := filepath.Join(ldp.rootDir, relPath)
 	// make sure all the directories in the path exist
 	dir := filepath.Dir(fp)
@@ -59,12 +90,61 @@ func (ldp localDiskProvider) WriteFile(relPath string, src io.Reader) error {
 		return err
 	}
 
-	f, err := os.Create(fp)
+	// write to a temporary file, and move it into place once it's complete,
+	// so a failed write doesn't clobber the existing file
+	f, err := ioutil.TempFile(dir, tempPrefix+filepath.Base(fp))
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	defer os.Remove(f.Name())
+	if _, err = io.Copy(f, src); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fp)
+}
+
+// ListFiles fulfills filestor.Provider. The temporary files of writes in
+// progress aren't listed.
+func (ldp localDiskProvider) ListFiles(dir string, fn func(relPath string) error) error {
+	if err := ldp.ctx.Err(); err != nil {
+		return err
+	}
+	root := filepath.Join(ldp.rootDir, dir)
+	if _, err := os.Stat(root); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return filepath.Walk(root, func(fp string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ldp.ctx.Err(); err != nil {
+			return err
+		}
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), tempPrefix) {
+			return nil
+		}
+		relPath, err := filepath.Rel(ldp.rootDir, fp)
+		if err != nil {
+			return err
+		}
+		return fn(relPath)
+	})
+}
 
-	_, err = io.Copy(f, src)
-	return err
+func (ldp localDiskProvider) DeleteFile(relPath string) error {
+	if err := ldp.ctx.Err(); err != nil {
+		return err
+	}
+	err := os.Remove(filepath.Join(ldp.rootDir, relPath))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
 }
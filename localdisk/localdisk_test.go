@@ -2,6 +2,8 @@ package localdisk
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -55,8 +57,9 @@ func TestReadNonExistentObject(t *testing.T) {
 	p := provider()
 	fp := filepath.Join("somedir", "should-not-exist")
 
-	dst := &bytes.Buffer{}
-	err := p.ReadFile(fp, dst)
+	_, err := p.ReadFile(fp)
+	require.Equal(t, filestor.ErrFileNotExist, err)
+	_, err = p.FileSize(fp)
 	require.Equal(t, filestor.ErrFileNotExist, err)
 }
 
@@ -72,14 +75,17 @@ func TestWriteNewFile(t *testing.T) {
 	}
 
 	// read it back
-	dst := &bytes.Buffer{}
-	err = p.ReadFile(fp, dst)
+	dst, err := filestor.ReadAll(p, fp)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !bytes.Equal(dst.Bytes(), data) {
-		t.Fatalf("data read back is not correct. Got '%s'", dst.String())
+	if !bytes.Equal(dst, data) {
+		t.Fatalf("data read back is not correct. Got '%s'", dst)
 	}
+
+	size, err := p.FileSize(fp)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), size)
 }
 
 func TestUpdateFile(t *testing.T) {
@@ -98,12 +104,79 @@ func TestUpdateFile(t *testing.T) {
 	}
 
 	// read it back to make sure the update worked
-	dst := &bytes.Buffer{}
-	err = p.ReadFile(fp, dst)
+	dst, err := filestor.ReadAll(p, fp)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !bytes.Equal(dst.Bytes(), data2) {
-		t.Fatalf("data read back is not correct. Got '%s'", dst.String())
+	if !bytes.Equal(dst, data2) {
+		t.Fatalf("data read back is not correct. Got '%s'", dst)
 	}
 }
+
+// failingReader returns some data, and then an error
+type failingReader struct {
+	data []byte
+}
+
+func (fr *failingReader) Read(p []byte) (int, error) {
+	if len(fr.data) == 0 {
+		return 0, errors.New("connection reset")
+	}
+	n := copy(p, fr.data)
+	fr.data = fr.data[n:]
+	return n, nil
+}
+
+func TestFailedWriteKeepsFile(t *testing.T) {
+	p := provider()
+	fp := filepath.Join("backups", "1.db")
+	require.NoError(t, p.WriteFile(fp, bytes.NewBufferString("complete")))
+
+	err := p.WriteFile(fp, &failingReader{data: []byte("partial")})
+	require.Error(t, err)
+	dst, err := filestor.ReadAll(p, fp)
+	require.NoError(t, err)
+	require.Equal(t, "complete", string(dst))
+}
+
+func TestWithContext(t *testing.T) {
+	p := provider()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	bound := p.WithContext(ctx)
+	err := bound.WriteFile("cancelled.txt", bytes.NewBufferString("data"))
+	require.Equal(t, context.Canceled, err)
+	_, err = bound.ReadFile("cancelled.txt")
+	require.Equal(t, context.Canceled, err)
+	_, err = bound.FileSize("cancelled.txt")
+	require.Equal(t, context.Canceled, err)
+
+	// the original provider isn't affected
+	require.NoError(t, p.WriteFile("cancelled.txt", bytes.NewBufferString("data")))
+}
+
+func TestListAndDelete(t *testing.T) {
+	p := provider()
+	require.NoError(t, p.WriteFile(filepath.Join("backups", "1.db"), bytes.NewBufferString("one")))
+	require.NoError(t, p.WriteFile(filepath.Join("backups", "old", "2.db"), bytes.NewBufferString("two")))
+	require.NoError(t, p.WriteFile(filepath.Join("other", "3.db"), bytes.NewBufferString("three")))
+	// a write in progress
+	require.NoError(t, p.WriteFile(filepath.Join("backups", tempPrefix+"4.db"), bytes.NewBufferString("four")))
+
+	var listed []string
+	require.NoError(t, p.ListFiles("backups", func(relPath string) error {
+		listed = append(listed, relPath)
+		return nil
+	}))
+	require.ElementsMatch(t, []string{filepath.Join("backups", "1.db"), filepath.Join("backups", "old", "2.db")}, listed)
+	require.NoError(t, p.ListFiles("nothing-here", func(relPath string) error {
+		t.Fatal("listed a file of a missing directory")
+		return nil
+	}))
+
+	require.NoError(t, p.DeleteFile(filepath.Join("backups", "1.db")))
+	require.NoError(t, p.DeleteFile(filepath.Join("backups", "1.db")))
+	_, err := p.FileSize(filepath.Join("backups", "1.db"))
+	require.Equal(t, filestor.ErrFileNotExist, err)
+}
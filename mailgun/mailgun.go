@@ -1,6 +1,7 @@
 package mailgun
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -10,17 +11,50 @@ import (
 	"zood.dev/oscar/smtp"
 )
 
+// DefaultBaseURL is the root of mailgun's HTTP API
+const DefaultBaseURL = "https://api.mailgun.net/v3"
+
+// EUBaseURL is the root of mailgun's HTTP API for domains in the EU region
+const EUBaseURL = "https://api.eu.mailgun.net/v3"
+
+// Regions a mailgun domain can be hosted in
+const (
+	RegionUS = "us"
+	RegionEU = "eu"
+)
+
+// BaseURLForRegion returns the root of the API serving region. An empty
+// region is the US.
+func BaseURLForRegion(region string) (string, error) {
+	switch strings.ToLower(region) {
+	case "", RegionUS:
+		return DefaultBaseURL, nil
+	case RegionEU:
+		return EUBaseURL, nil
+	default:
+		return "", fmt.Errorf("unknown mailgun region '%s'", region)
+	}
+}
+
 type mailgun struct {
 	apiKey   string
+	baseURL  string
 	domain   string
 	testMode bool
 }
 
 // New returns a smtp.SendEmailer backed by mailgun
 func New(apiKey, domain string) smtp.SendEmailer {
+	return NewWithBaseURL(apiKey, domain, DefaultBaseURL)
+}
+
+// NewWithBaseURL returns a smtp.SendEmailer backed by a mailgun compatible
+// API rooted at baseURL
+func NewWithBaseURL(apiKey, domain, baseURL string) smtp.SendEmailer {
 	return &mailgun{
-		apiKey: apiKey,
-		domain: domain,
+		apiKey:  apiKey,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		domain:  domain,
 	}
 }
 
@@ -39,7 +73,7 @@ func (mg *mailgun) SendEmail(from string, to string, subj string, textMsg string
 
 	req, _ := http.NewRequest(
 		http.MethodPost,
-		fmt.Sprintf("https://api.mailgun.net/v3/%s/messages", mg.domain),
+		fmt.Sprintf("%s/%s/messages", mg.baseURL, mg.domain),
 		strings.NewReader(vals.Encode()))
 	req.Header.Set("content-type", "application/x-www-form-urlencoded")
 	req.SetBasicAuth("api", mg.apiKey)
@@ -59,3 +93,28 @@ func (mg *mailgun) SendEmail(from string, to string, subj string, textMsg string
 	}
 	return err
 }
+
+// CheckHealth fulfills smtp.HealthChecker. It fetches the domain, which
+// fails when the api key is revoked or the domain was removed.
+func (mg *mailgun) CheckHealth(ctx context.Context) error {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/domains/%s", mg.baseURL, mg.domain), nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth("api", mg.apiKey)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized:
+		return fmt.Errorf("mailgun rejected the api key")
+	case http.StatusNotFound:
+		return fmt.Errorf("mailgun has no domain '%s'", mg.domain)
+	default:
+		return fmt.Errorf("mailgun domain check failed with status %d", resp.StatusCode)
+	}
+}
@@ -1,8 +1,11 @@
 package mailgun
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 )
@@ -31,3 +34,26 @@ func TestSendEmail(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestCheckHealth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, key, _ := r.BasicAuth(); key != "good-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/v3/domains/example.com" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	if err := NewWithBaseURL("good-key", "example.com", server.URL+"/v3").(*mailgun).CheckHealth(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewWithBaseURL("revoked-key", "example.com", server.URL+"/v3").(*mailgun).CheckHealth(context.Background()); err == nil {
+		t.Fatal("a revoked key should fail the check")
+	}
+	if err := NewWithBaseURL("good-key", "missing.com", server.URL+"/v3").(*mailgun).CheckHealth(context.Background()); err == nil {
+		t.Fatal("a missing domain should fail the check")
+	}
+}
@@ -0,0 +1,111 @@
+package mailgun
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Event types reported by webhooks. A bounce is reported as a failed event
+// with permanent severity.
+const (
+	EventDelivered  = "delivered"
+	EventFailed     = "failed"
+	EventComplained = "complained"
+)
+
+// maxWebhookAge is how old a webhook's signature may be, to limit replays
+const maxWebhookAge = 15 * time.Minute
+
+// ErrInvalidSignature is returned for webhooks that weren't signed by
+// mailgun, or were signed too long ago
+var ErrInvalidSignature = errors.New("invalid mailgun webhook signature")
+
+// Event is a delivery, bounce or complaint reported by a mailgun webhook
+type Event struct {
+	ID        string
+	Event     string
+	Severity  string
+	Recipient string
+	MessageID string
+	Reason    string
+	Timestamp time.Time
+}
+
+type webhook struct {
+	Signature struct {
+		Timestamp string `json:"timestamp"`
+		Token     string `json:"token"`
+		Signature string `json:"signature"`
+	} `json:"signature"`
+	EventData struct {
+		ID        string  `json:"id"`
+		Event     string  `json:"event"`
+		Severity  string  `json:"severity"`
+		Recipient string  `json:"recipient"`
+		Reason    string  `json:"reason"`
+		Timestamp float64 `json:"timestamp"`
+		Message   struct {
+			Headers struct {
+				MessageID string `json:"message-id"`
+			} `json:"headers"`
+		} `json:"message"`
+		DeliveryStatus struct {
+			Description string `json:"description"`
+		} `json:"delivery-status"`
+	} `json:"event-data"`
+}
+
+// ParseWebhook verifies the signature of a webhook request body with the
+// domain's webhook signing key, and returns the event it reports.
+func ParseWebhook(body []byte, signingKey string, now time.Time) (*Event, error) {
+	wh := webhook{}
+	if err := json.Unmarshal(body, &wh); err != nil {
+		return nil, fmt.Errorf("unable to parse mailgun webhook: %w", err)
+	}
+	if !VerifySignature(signingKey, wh.Signature.Timestamp, wh.Signature.Token, wh.Signature.Signature) {
+		return nil, ErrInvalidSignature
+	}
+	signedAt, err := strconv.ParseInt(wh.Signature.Timestamp, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	if age := now.Sub(time.Unix(signedAt, 0)); age > maxWebhookAge || age < -maxWebhookAge {
+		return nil, ErrInvalidSignature
+	}
+
+	ed := wh.EventData
+	evt := &Event{
+		ID:        ed.ID,
+		Event:     ed.Event,
+		Severity:  ed.Severity,
+		Recipient: ed.Recipient,
+		MessageID: ed.Message.Headers.MessageID,
+		Reason:    ed.Reason,
+		Timestamp: time.Unix(0, int64(ed.Timestamp*float64(time.Second))),
+	}
+	if ed.DeliveryStatus.Description != "" {
+		evt.Reason = ed.DeliveryStatus.Description
+	}
+	return evt, nil
+}
+
+// VerifySignature returns true if signature is mailgun's signature of
+// timestamp and token, made with signingKey
+func VerifySignature(signingKey, timestamp, token, signature string) bool {
+	if signingKey == "" {
+		return false
+	}
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(signingKey))
+	mac.Write([]byte(timestamp + token))
+	return hmac.Equal(mac.Sum(nil), expected)
+}
@@ -0,0 +1,65 @@
+package mailgun
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func signedWebhook(key string, signedAt time.Time, event string) []byte {
+	timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+	token := "a8ce0edb2dd8301dee6c2405235584e45aa91d1e9f979f3de0"
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(timestamp + token))
+	return []byte(fmt.Sprintf(`{
+		"signature": {"timestamp": "%s", "token": "%s", "signature": "%s"},
+		"event-data": {
+			"id": "CPgfbmQMTCKtHW6uIWtuVe",
+			"event": "%s",
+			"severity": "permanent",
+			"recipient": "alice@example.com",
+			"timestamp": 1521472262.908181,
+			"message": {"headers": {"message-id": "20130503182626.18666.16540@example.com"}},
+			"delivery-status": {"description": "No such mailbox"}
+		}
+	}`, timestamp, token, hex.EncodeToString(mac.Sum(nil)), event))
+}
+
+func TestParseWebhook(t *testing.T) {
+	now := time.Now()
+	evt, err := ParseWebhook(signedWebhook("signing-key", now, EventFailed), "signing-key", now)
+	require.NoError(t, err)
+	require.Equal(t, EventFailed, evt.Event)
+	require.Equal(t, "permanent", evt.Severity)
+	require.Equal(t, "alice@example.com", evt.Recipient)
+	require.Equal(t, "20130503182626.18666.16540@example.com", evt.MessageID)
+	require.Equal(t, "No such mailbox", evt.Reason)
+	require.Equal(t, int64(1521472262), evt.Timestamp.Unix())
+
+	_, err = ParseWebhook(signedWebhook("other-key", now, EventFailed), "signing-key", now)
+	require.Equal(t, ErrInvalidSignature, err)
+
+	// stale signatures could be replays
+	_, err = ParseWebhook(signedWebhook("signing-key", now.Add(-time.Hour), EventFailed), "signing-key", now)
+	require.Equal(t, ErrInvalidSignature, err)
+
+	_, err = ParseWebhook([]byte("not json"), "signing-key", now)
+	require.Error(t, err)
+}
+
+func TestBaseURLForRegion(t *testing.T) {
+	url, err := BaseURLForRegion("")
+	require.NoError(t, err)
+	require.Equal(t, DefaultBaseURL, url)
+	url, err = BaseURLForRegion("EU")
+	require.NoError(t, err)
+	require.Equal(t, EUBaseURL, url)
+	_, err = BaseURLForRegion("mars")
+	require.Error(t, err)
+}
@@ -0,0 +1,118 @@
+// Package memfs implements filestor.Provider in memory, for tests and local
+// development. Files are lost when the process exits.
+package memfs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"zood.dev/oscar/filestor"
+)
+
+// memProvider satisfies the filestor.Provider interface. Copies returned by
+// WithContext share the same files.
+type memProvider struct {
+	ctx   context.Context
+	files *files
+}
+
+type files struct {
+	mu   sync.RWMutex
+	data map[string][]byte
+}
+
+// New returns an empty filestor.Provider that keeps files in memory
+func New() filestor.Provider {
+	return memProvider{ctx: context.Background(), files: &files{data: map[string][]byte{}}}
+}
+
+// WithContext fulfills filestor.Provider. ctx is only checked before a read
+// or write starts.
+func (mp memProvider) WithContext(ctx context.Context) filestor.Provider {
+	mp.ctx = ctx
+	return mp
+}
+
+func (mp memProvider) FileSize(relPath string) (int64, error) {
+	if err := mp.ctx.Err(); err != nil {
+		return 0, err
+	}
+	mp.files.mu.RLock()
+	defer mp.files.mu.RUnlock()
+
+	buf, ok := mp.files.data[relPath]
+	if !ok {
+		return 0, filestor.ErrFileNotExist
+	}
+	return int64(len(buf)), nil
+}
+
+func (mp memProvider) ReadFile(relPath string) (io.ReadCloser, error) {
+	if err := mp.ctx.Err(); err != nil {
+		return nil, err
+	}
+	mp.files.mu.RLock()
+	defer mp.files.mu.RUnlock()
+	buf, ok := mp.files.data[relPath]
+	if !ok {
+		return nil, filestor.ErrFileNotExist
+	}
+
+	// stored files are never modified in place, so buf can be read unlocked
+	return ioutil.NopCloser(bytes.NewReader(buf)), nil
+}
+
+func (mp memProvider) WriteFile(relPath string, src io.Reader) error {
+	if err := mp.ctx.Err(); err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadAll(src)
+	if err != nil {
+		return err
+	}
+
+	mp.files.mu.Lock()
+	defer mp.files.mu.Unlock()
+	mp.files.data[relPath] = buf
+	return nil
+}
+
+func (mp memProvider) ListFiles(dir string, fn func(relPath string) error) error {
+	if err := mp.ctx.Err(); err != nil {
+		return err
+	}
+	prefix := ""
+	if dir != "" {
+		prefix = strings.TrimSuffix(dir, "/") + "/"
+	}
+	// fn may touch the files, so it's called after the lock is released
+	var paths []string
+	mp.files.mu.RLock()
+	for relPath := range mp.files.data {
+		if strings.HasPrefix(relPath, prefix) {
+			paths = append(paths, relPath)
+		}
+	}
+	mp.files.mu.RUnlock()
+
+	for _, relPath := range paths {
+		if err := fn(relPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mp memProvider) DeleteFile(relPath string) error {
+	if err := mp.ctx.Err(); err != nil {
+		return err
+	}
+	mp.files.mu.Lock()
+	defer mp.files.mu.Unlock()
+	delete(mp.files.data, relPath)
+	return nil
+}
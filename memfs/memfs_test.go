@@ -0,0 +1,77 @@
+package memfs
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/filestor"
+)
+
+func TestReadNonExistentObject(t *testing.T) {
+	p := New()
+	_, err := p.ReadFile("somedir/should-not-exist")
+	require.Equal(t, filestor.ErrFileNotExist, err)
+	_, err = p.FileSize("somedir/should-not-exist")
+	require.Equal(t, filestor.ErrFileNotExist, err)
+}
+
+func TestWriteAndUpdateFile(t *testing.T) {
+	p := New()
+	data := []byte("Hello, darkness, my old friend")
+	require.NoError(t, p.WriteFile("backups/lyrics.txt", bytes.NewReader(data)))
+
+	dst, err := filestor.ReadAll(p, "backups/lyrics.txt")
+	require.NoError(t, err)
+	require.Equal(t, data, dst)
+	size, err := p.FileSize("backups/lyrics.txt")
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), size)
+
+	// now overwrite it
+	data = []byte("*Eggs\n*Milk\n*Orange juice\n")
+	require.NoError(t, p.WriteFile("backups/lyrics.txt", bytes.NewReader(data)))
+	dst, err = filestor.ReadAll(p, "backups/lyrics.txt")
+	require.NoError(t, err)
+	require.Equal(t, data, dst)
+}
+
+func TestWithContext(t *testing.T) {
+	p := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	bound := p.WithContext(ctx)
+	err := bound.WriteFile("cancelled.txt", bytes.NewBufferString("data"))
+	require.Equal(t, context.Canceled, err)
+	_, err = bound.ReadFile("cancelled.txt")
+	require.Equal(t, context.Canceled, err)
+	_, err = bound.FileSize("cancelled.txt")
+	require.Equal(t, context.Canceled, err)
+
+	// the bound provider shares the files of the original
+	require.NoError(t, p.WriteFile("shared.txt", bytes.NewBufferString("data")))
+	size, err := p.WithContext(context.Background()).FileSize("shared.txt")
+	require.NoError(t, err)
+	require.Equal(t, int64(4), size)
+}
+
+func TestListAndDelete(t *testing.T) {
+	p := New()
+	require.NoError(t, p.WriteFile("backups/1.db", bytes.NewBufferString("one")))
+	require.NoError(t, p.WriteFile("backups/old/2.db", bytes.NewBufferString("two")))
+	require.NoError(t, p.WriteFile("backups-elsewhere/3.db", bytes.NewBufferString("three")))
+
+	var listed []string
+	require.NoError(t, p.ListFiles("backups", func(relPath string) error {
+		listed = append(listed, relPath)
+		return nil
+	}))
+	require.ElementsMatch(t, []string{"backups/1.db", "backups/old/2.db"}, listed)
+
+	require.NoError(t, p.DeleteFile("backups/1.db"))
+	require.NoError(t, p.DeleteFile("backups/1.db"))
+	_, err := p.FileSize("backups/1.db")
+	require.Equal(t, filestor.ErrFileNotExist, err)
+}
@@ -0,0 +1,512 @@
+// Package memkv implements kvstor.Provider in memory, for tests and local
+// development. Everything is lost when the process exits.
+package memkv
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"zood.dev/oscar/kvstor"
+)
+
+// memProvider satisfies the kvstor.Provider interface. Values are copied in
+// and out, so callers can't change what's stored, like with the providers
+// that persist their data.
+type memProvider struct {
+	mu             sync.RWMutex
+	packages       map[string][]byte
+	expiries       map[string]int64
+	userIDs        map[string]int64
+	publicIDs      map[int64][]byte
+	contentNames   map[string][]byte
+	contentRefs    map[string]int64
+	captures       map[int64]int64
+	captureRecords map[int64][][]byte
+	incident       []byte
+	aliases        map[string]boxAlias
+	aliasedBoxes   map[string]aliasedBox
+	emails         map[string]queuedEmail
+	deadLetters    map[string][]byte
+	spentTokens    map[string]int64
+}
+
+// queuedEmail is an email waiting to be sent, and when it's due
+type queuedEmail struct {
+	email []byte
+	due   int64
+}
+
+// boxAlias is where an alias leads, and when it expires, or 0
+type boxAlias struct {
+	boxID   []byte
+	expires int64
+}
+
+// aliasedBox is the owner of a box's aliases, and its current one
+type aliasedBox struct {
+	ownerID int64
+	current []byte
+}
+
+// New returns an empty kvstor.Provider that keeps its data in memory
+func New() kvstor.Provider {
+	return &memProvider{
+		packages:       map[string][]byte{},
+		expiries:       map[string]int64{},
+		userIDs:        map[string]int64{},
+		publicIDs:      map[int64][]byte{},
+		contentNames:   map[string][]byte{},
+		contentRefs:    map[string]int64{},
+		captures:       map[int64]int64{},
+		captureRecords: map[int64][][]byte{},
+		aliases:        map[string]boxAlias{},
+		aliasedBoxes:   map[string]aliasedBox{},
+		emails:         map[string]queuedEmail{},
+		deadLetters:    map[string][]byte{},
+		spentTokens:    map[string]int64{},
+	}
+}
+
+func clone(buf []byte) []byte {
+	if buf == nil {
+		return nil
+	}
+	return append([]byte{}, buf...)
+}
+
+// DropPackage fulfills kvstor.Provider
+func (mp *memProvider) DropPackage(pkg []byte, boxID []byte, expires int64) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.packages[string(boxID)] = clone(pkg)
+	if expires == 0 {
+		delete(mp.expiries, string(boxID))
+	} else {
+		mp.expiries[string(boxID)] = expires
+	}
+	return nil
+}
+
+// PickUpPackage fulfills kvstor.Provider
+func (mp *memProvider) PickUpPackage(boxID []byte) ([]byte, error) {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	if expires, ok := mp.expiries[string(boxID)]; ok && expires <= time.Now().Unix() {
+		return nil, nil
+	}
+	return clone(mp.packages[string(boxID)]), nil
+}
+
+// PurgeExpiredPackages fulfills kvstor.Provider
+func (mp *memProvider) PurgeExpiredPackages(now int64) (int, error) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	purged := 0
+	for boxID, expires := range mp.expiries {
+		if expires <= now {
+			delete(mp.packages, boxID)
+			delete(mp.expiries, boxID)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// Incident fulfills kvstor.IncidentNotice
+func (mp *memProvider) Incident() ([]byte, error) {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	return clone(mp.incident), nil
+}
+
+// SetIncident fulfills kvstor.IncidentNotice
+func (mp *memProvider) SetIncident(notice []byte) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.incident = clone(notice)
+	return nil
+}
+
+// QueueEmail fulfills kvstor.EmailQueue
+func (mp *memProvider) QueueEmail(id string, email []byte, due int64) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.emails[id] = queuedEmail{email: clone(email), due: due}
+	return nil
+}
+
+// DueEmails fulfills kvstor.EmailQueue
+func (mp *memProvider) DueEmails(now int64, max int) (map[string][]byte, error) {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	due := map[string][]byte{}
+	for id, e := range mp.emails {
+		if len(due) == max {
+			break
+		}
+		if e.due <= now {
+			due[id] = clone(e.email)
+		}
+	}
+	return due, nil
+}
+
+// DequeueEmail fulfills kvstor.EmailQueue
+func (mp *memProvider) DequeueEmail(id string, deadLetter []byte) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	delete(mp.emails, id)
+	if deadLetter != nil {
+		mp.deadLetters[id] = clone(deadLetter)
+	}
+	return nil
+}
+
+// ReplaceQueuedEmail fulfills kvstor.EmailQueue
+func (mp *memProvider) ReplaceQueuedEmail(id string, email []byte) (bool, error) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	e, ok := mp.emails[id]
+	if !ok {
+		return false, nil
+	}
+	e.email = clone(email)
+	mp.emails[id] = e
+	return true, nil
+}
+
+// DeadLetters fulfills kvstor.EmailQueue
+func (mp *memProvider) DeadLetters() (map[string][]byte, error) {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	letters := make(map[string][]byte, len(mp.deadLetters))
+	for id, letter := range mp.deadLetters {
+		letters[id] = clone(letter)
+	}
+	return letters, nil
+}
+
+// DeleteDeadLetter fulfills kvstor.EmailQueue
+func (mp *memProvider) DeleteDeadLetter(id string) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	delete(mp.deadLetters, id)
+	return nil
+}
+
+// ReplaceDeadLetter fulfills kvstor.EmailQueue
+func (mp *memProvider) ReplaceDeadLetter(id string, deadLetter []byte) (bool, error) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	if _, ok := mp.deadLetters[id]; !ok {
+		return false, nil
+	}
+	mp.deadLetters[id] = clone(deadLetter)
+	return true, nil
+}
+
+// SpendToken fulfills kvstor.SpentTokens
+func (mp *memProvider) SpendToken(id []byte, expires int64) (bool, error) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	if exp, ok := mp.spentTokens[string(id)]; ok && exp > time.Now().Unix() {
+		return false, nil
+	}
+	mp.spentTokens[string(id)] = expires
+	return true, nil
+}
+
+// PurgeSpentTokens fulfills kvstor.SpentTokens
+func (mp *memProvider) PurgeSpentTokens(now int64) (int, error) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	purged := 0
+	for id, expires := range mp.spentTokens {
+		if expires <= now {
+			delete(mp.spentTokens, id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// AddBoxAlias fulfills kvstor.BoxAliases
+func (mp *memProvider) AddBoxAlias(boxID, alias []byte, ownerID int64, graceUntil int64) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	box, ok := mp.aliasedBoxes[string(boxID)]
+	if ok && box.ownerID != ownerID {
+		return kvstor.ErrBoxOwner
+	}
+	// the previous alias may already have been purged
+	if prev, ok := mp.aliases[string(box.current)]; ok && box.current != nil {
+		prev.expires = graceUntil
+		mp.aliases[string(box.current)] = prev
+	}
+	mp.aliases[string(alias)] = boxAlias{boxID: clone(boxID)}
+	mp.aliasedBoxes[string(boxID)] = aliasedBox{ownerID: ownerID, current: clone(alias)}
+	return nil
+}
+
+// BoxOfAlias fulfills kvstor.BoxAliases
+func (mp *memProvider) BoxOfAlias(alias []byte) ([]byte, error) {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	a, ok := mp.aliases[string(alias)]
+	if !ok || (a.expires != 0 && a.expires <= time.Now().Unix()) {
+		return nil, nil
+	}
+	return clone(a.boxID), nil
+}
+
+// PurgeExpiredBoxAliases fulfills kvstor.BoxAliases
+func (mp *memProvider) PurgeExpiredBoxAliases(now int64) (int, error) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	purged := 0
+	for alias, a := range mp.aliases {
+		if a.expires != 0 && a.expires <= now {
+			delete(mp.aliases, alias)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// ListBoxAliases fulfills kvstor.Lister
+func (mp *memProvider) ListBoxAliases(fn func(alias, boxID []byte, ownerID int64, expires int64) error) error {
+	type entry struct {
+		alias, boxID []byte
+		ownerID      int64
+		expires      int64
+	}
+	now := time.Now().Unix()
+	mp.mu.RLock()
+	entries := make([]entry, 0, len(mp.aliases))
+	for alias, a := range mp.aliases {
+		if a.expires != 0 && a.expires <= now {
+			continue
+		}
+		ownerID := mp.aliasedBoxes[string(a.boxID)].ownerID
+		entries = append(entries, entry{alias: []byte(alias), boxID: clone(a.boxID), ownerID: ownerID, expires: a.expires})
+	}
+	mp.mu.RUnlock()
+
+	for _, e := range entries {
+		if err := fn(e.alias, e.boxID, e.ownerID, e.expires); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListPackages fulfills kvstor.Lister. The packages are copied before fn is
+// called, so fn can use the provider.
+func (mp *memProvider) ListPackages(fn func(boxID, pkg []byte, expires int64) error) error {
+	type entry struct {
+		boxID, pkg []byte
+		expires    int64
+	}
+	now := time.Now().Unix()
+	mp.mu.RLock()
+	entries := make([]entry, 0, len(mp.packages))
+	for boxID, pkg := range mp.packages {
+		expires, ok := mp.expiries[boxID]
+		if ok && expires <= now {
+			continue
+		}
+		entries = append(entries, entry{boxID: []byte(boxID), pkg: clone(pkg), expires: expires})
+	}
+	mp.mu.RUnlock()
+
+	for _, e := range entries {
+		if err := fn(e.boxID, e.pkg, e.expires); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListIDs fulfills kvstor.Lister
+func (mp *memProvider) ListIDs(fn func(userID int64, pubID []byte) error) error {
+	mp.mu.RLock()
+	ids := make(map[int64][]byte, len(mp.publicIDs))
+	for userID, pubID := range mp.publicIDs {
+		ids[userID] = clone(pubID)
+	}
+	mp.mu.RUnlock()
+
+	for userID, pubID := range ids {
+		if err := fn(userID, pubID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListDebugCaptures fulfills kvstor.Lister
+func (mp *memProvider) ListDebugCaptures(fn func(userID int64, until int64) error) error {
+	mp.mu.RLock()
+	captures := make(map[int64]int64, len(mp.captures))
+	for userID, until := range mp.captures {
+		captures[userID] = until
+	}
+	mp.mu.RUnlock()
+
+	for userID, until := range captures {
+		if err := fn(userID, until); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InsertIds fulfills kvstor.Provider
+func (mp *memProvider) InsertIds(userID int64, pubID []byte) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.userIDs[string(pubID)] = userID
+	mp.publicIDs[userID] = clone(pubID)
+	return nil
+}
+
+// PublicIDFromUserID fulfills kvstor.Provider
+func (mp *memProvider) PublicIDFromUserID(userID int64) ([]byte, error) {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	return clone(mp.publicIDs[userID]), nil
+}
+
+// UserIDFromPublicID fulfills kvstor.Provider. It returns 0 when there's no
+// user with pubID.
+func (mp *memProvider) UserIDFromPublicID(pubID []byte) (int64, error) {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	return mp.userIDs[string(pubID)], nil
+}
+
+// ContentHash fulfills kvstor.ContentIndex
+func (mp *memProvider) ContentHash(name string) ([]byte, error) {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	return clone(mp.contentNames[name]), nil
+}
+
+// ContentReferences fulfills kvstor.ContentIndex
+func (mp *memProvider) ContentReferences(hash []byte) (int64, error) {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	return mp.contentRefs[string(hash)], nil
+}
+
+// addContentRefs adds delta to the references of hash, and returns the new
+// count. Hashes without references are removed. mu must be held.
+func (mp *memProvider) addContentRefs(hash []byte, delta int64) int64 {
+	refs := mp.contentRefs[string(hash)] + delta
+	if refs <= 0 {
+		delete(mp.contentRefs, string(hash))
+		return 0
+	}
+	mp.contentRefs[string(hash)] = refs
+	return refs
+}
+
+// LinkContent fulfills kvstor.ContentIndex
+func (mp *memProvider) LinkContent(name string, hash []byte) ([]byte, int64, error) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	old := mp.contentNames[name]
+	if bytes.Equal(old, hash) {
+		return nil, 0, nil
+	}
+	mp.contentNames[name] = clone(hash)
+	mp.addContentRefs(hash, 1)
+	if old == nil {
+		return nil, 0, nil
+	}
+	return old, mp.addContentRefs(old, -1), nil
+}
+
+// UnlinkContent fulfills kvstor.ContentIndex
+func (mp *memProvider) UnlinkContent(name string) ([]byte, int64, error) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	old, ok := mp.contentNames[name]
+	if !ok {
+		return nil, 0, nil
+	}
+	delete(mp.contentNames, name)
+	return old, mp.addContentRefs(old, -1), nil
+}
+
+// ContentNames fulfills kvstor.ContentIndex. The names are collected before
+// fn is called, so fn can change the index.
+func (mp *memProvider) ContentNames(prefix string, fn func(name string) error) error {
+	mp.mu.RLock()
+	var names []string
+	for name := range mp.contentNames {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	mp.mu.RUnlock()
+
+	sort.Strings(names)
+	for _, name := range names {
+		if err := fn(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartDebugCapture fulfills kvstor.DebugCaptures
+func (mp *memProvider) StartDebugCapture(userID int64, until int64) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.captures[userID] = until
+	delete(mp.captureRecords, userID)
+	return nil
+}
+
+// DebugCaptureUntil fulfills kvstor.DebugCaptures
+func (mp *memProvider) DebugCaptureUntil(userID int64) (int64, error) {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	return mp.captures[userID], nil
+}
+
+// AppendDebugCapture fulfills kvstor.DebugCaptures
+func (mp *memProvider) AppendDebugCapture(userID int64, record []byte, max int) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	records := append(mp.captureRecords[userID], clone(record))
+	if len(records) > max {
+		records = records[len(records)-max:]
+	}
+	mp.captureRecords[userID] = records
+	return nil
+}
+
+// DebugCapture fulfills kvstor.DebugCaptures
+func (mp *memProvider) DebugCapture(userID int64) ([][]byte, error) {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	records := make([][]byte, 0, len(mp.captureRecords[userID]))
+	for _, record := range mp.captureRecords[userID] {
+		records = append(records, clone(record))
+	}
+	return records, nil
+}
+
+// DeleteDebugCapture fulfills kvstor.DebugCaptures
+func (mp *memProvider) DeleteDebugCapture(userID int64) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	delete(mp.captures, userID)
+	delete(mp.captureRecords, userID)
+	return nil
+}
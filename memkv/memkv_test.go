@@ -0,0 +1,308 @@
+package memkv
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/kvstor"
+)
+
+func TestPackages(t *testing.T) {
+	p := New()
+	pkg, err := p.PickUpPackage([]byte("box"))
+	require.NoError(t, err)
+	require.Nil(t, pkg)
+
+	dropped := []byte("package")
+	require.NoError(t, p.DropPackage(dropped, []byte("box"), 0))
+	// the stored package is a copy
+	dropped[0] = 'X'
+	pkg, err = p.PickUpPackage([]byte("box"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("package"), pkg)
+}
+
+func TestPackageExpiry(t *testing.T) {
+	p := New()
+	now := time.Now().Unix()
+	require.NoError(t, p.DropPackage([]byte("expired"), []byte("box 1"), now-1))
+	require.NoError(t, p.DropPackage([]byte("fresh"), []byte("box 2"), now+60))
+	require.NoError(t, p.DropPackage([]byte("forever"), []byte("box 3"), 0))
+
+	// expired packages can't be picked up, even before they're purged
+	pkg, err := p.PickUpPackage([]byte("box 1"))
+	require.NoError(t, err)
+	require.Nil(t, pkg)
+	pkg, err = p.PickUpPackage([]byte("box 2"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("fresh"), pkg)
+
+	purged, err := p.PurgeExpiredPackages(now)
+	require.NoError(t, err)
+	require.Equal(t, 1, purged)
+	purged, err = p.PurgeExpiredPackages(now + 60)
+	require.NoError(t, err)
+	require.Equal(t, 1, purged)
+	pkg, err = p.PickUpPackage([]byte("box 3"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("forever"), pkg)
+}
+
+func TestConcurrentDrops(t *testing.T) {
+	p := New()
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			require.NoError(t, p.DropPackage([]byte(fmt.Sprintf("package %d", i)), []byte(fmt.Sprintf("box %d", i)), 0))
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < 50; i++ {
+		pkg, err := p.PickUpPackage([]byte(fmt.Sprintf("box %d", i)))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("package %d", i), string(pkg))
+	}
+}
+
+func TestIDs(t *testing.T) {
+	p := New()
+	userID, err := p.UserIDFromPublicID([]byte("public id"))
+	require.NoError(t, err)
+	require.Zero(t, userID)
+
+	require.NoError(t, p.InsertIds(300, []byte("public id")))
+	userID, err = p.UserIDFromPublicID([]byte("public id"))
+	require.NoError(t, err)
+	require.Equal(t, int64(300), userID)
+	pubID, err := p.PublicIDFromUserID(300)
+	require.NoError(t, err)
+	require.Equal(t, []byte("public id"), pubID)
+}
+
+func TestContentIndex(t *testing.T) {
+	p := New()
+	hashA := []byte("hash a")
+	hashB := []byte("hash b")
+	for _, name := range []string{"backups/2", "backups/1", "other/1"} {
+		_, _, err := p.LinkContent(name, hashA)
+		require.NoError(t, err)
+	}
+	refs, err := p.ContentReferences(hashA)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), refs)
+
+	old, oldRefs, err := p.LinkContent("backups/1", hashB)
+	require.NoError(t, err)
+	require.Equal(t, hashA, old)
+	require.Equal(t, int64(2), oldRefs)
+
+	var names []string
+	require.NoError(t, p.ContentNames("backups/", func(name string) error {
+		names = append(names, name)
+		return nil
+	}))
+	require.Equal(t, []string{"backups/1", "backups/2"}, names)
+
+	old, oldRefs, err = p.UnlinkContent("backups/1")
+	require.NoError(t, err)
+	require.Equal(t, hashB, old)
+	require.Zero(t, oldRefs)
+	refs, err = p.ContentReferences(hashB)
+	require.NoError(t, err)
+	require.Zero(t, refs)
+	old, _, err = p.UnlinkContent("backups/1")
+	require.NoError(t, err)
+	require.Nil(t, old)
+}
+
+func TestDebugCaptures(t *testing.T) {
+	p := New()
+	require.NoError(t, p.StartDebugCapture(7, 1000))
+	until, err := p.DebugCaptureUntil(7)
+	require.NoError(t, err)
+	require.Equal(t, int64(1000), until)
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, p.AppendDebugCapture(7, []byte(fmt.Sprintf("record %d", i)), 3))
+	}
+	records, err := p.DebugCapture(7)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("record 2"), []byte("record 3"), []byte("record 4")}, records)
+
+	require.NoError(t, p.StartDebugCapture(7, 2000))
+	records, err = p.DebugCapture(7)
+	require.NoError(t, err)
+	require.Empty(t, records)
+
+	require.NoError(t, p.DeleteDebugCapture(7))
+	until, err = p.DebugCaptureUntil(7)
+	require.NoError(t, err)
+	require.Zero(t, until)
+}
+
+func TestIncident(t *testing.T) {
+	p := New()
+	notice, err := p.Incident()
+	require.NoError(t, err)
+	require.Nil(t, notice)
+
+	require.NoError(t, p.SetIncident([]byte("delays")))
+	notice, err = p.Incident()
+	require.NoError(t, err)
+	require.Equal(t, []byte("delays"), notice)
+
+	require.NoError(t, p.SetIncident(nil))
+	notice, err = p.Incident()
+	require.NoError(t, err)
+	require.Nil(t, notice)
+}
+
+func TestEmailQueue(t *testing.T) {
+	p := New()
+	require.NoError(t, p.QueueEmail("a", []byte("email a"), 100))
+	require.NoError(t, p.QueueEmail("b", []byte("email b"), 200))
+	due, err := p.DueEmails(150, 10)
+	require.NoError(t, err)
+	require.Equal(t, map[string][]byte{"a": []byte("email a")}, due)
+	due, err = p.DueEmails(250, 1)
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+
+	// queueing again reschedules
+	require.NoError(t, p.QueueEmail("a", []byte("retried a"), 300))
+	due, err = p.DueEmails(250, 10)
+	require.NoError(t, err)
+	require.Equal(t, map[string][]byte{"b": []byte("email b")}, due)
+
+	// replacing keeps when the email is due
+	replaced, err := p.ReplaceQueuedEmail("b", []byte("resealed b"))
+	require.NoError(t, err)
+	require.True(t, replaced)
+	due, err = p.DueEmails(250, 10)
+	require.NoError(t, err)
+	require.Equal(t, map[string][]byte{"b": []byte("resealed b")}, due)
+	replaced, err = p.ReplaceQueuedEmail("c", []byte("email c"))
+	require.NoError(t, err)
+	require.False(t, replaced)
+
+	require.NoError(t, p.DequeueEmail("b", nil))
+	require.NoError(t, p.DequeueEmail("a", []byte("dead a")))
+	due, err = p.DueEmails(1000, 10)
+	require.NoError(t, err)
+	require.Empty(t, due)
+	letters, err := p.DeadLetters()
+	require.NoError(t, err)
+	require.Equal(t, map[string][]byte{"a": []byte("dead a")}, letters)
+	replaced, err = p.ReplaceDeadLetter("a", []byte("resealed a"))
+	require.NoError(t, err)
+	require.True(t, replaced)
+	letters, err = p.DeadLetters()
+	require.NoError(t, err)
+	require.Equal(t, map[string][]byte{"a": []byte("resealed a")}, letters)
+
+	require.NoError(t, p.DeleteDeadLetter("a"))
+	letters, err = p.DeadLetters()
+	require.NoError(t, err)
+	require.Empty(t, letters)
+	replaced, err = p.ReplaceDeadLetter("a", []byte("resealed a"))
+	require.NoError(t, err)
+	require.False(t, replaced)
+}
+
+func TestSpentTokens(t *testing.T) {
+	p := New()
+	now := time.Now()
+	spent, err := p.SpendToken([]byte("a"), now.Add(time.Hour).Unix())
+	require.NoError(t, err)
+	require.True(t, spent)
+	spent, err = p.SpendToken([]byte("a"), now.Add(time.Hour).Unix())
+	require.NoError(t, err)
+	require.False(t, spent)
+	spent, err = p.SpendToken([]byte("b"), now.Add(time.Hour).Unix())
+	require.NoError(t, err)
+	require.True(t, spent)
+
+	// an expired id doesn't count as spent
+	spent, err = p.SpendToken([]byte("c"), now.Add(-time.Minute).Unix())
+	require.NoError(t, err)
+	require.True(t, spent)
+	spent, err = p.SpendToken([]byte("c"), now.Add(-time.Minute).Unix())
+	require.NoError(t, err)
+	require.True(t, spent)
+	purged, err := p.PurgeSpentTokens(now.Unix())
+	require.NoError(t, err)
+	require.Equal(t, 1, purged)
+}
+
+func TestBoxAliases(t *testing.T) {
+	p := New()
+	box, err := p.BoxOfAlias([]byte("alias 1"))
+	require.NoError(t, err)
+	require.Nil(t, box)
+
+	now := time.Now().Unix()
+	require.NoError(t, p.AddBoxAlias([]byte("box"), []byte("alias 1"), 7, now+60))
+	require.NoError(t, p.AddBoxAlias([]byte("box"), []byte("alias 2"), 7, now+60))
+	require.NoError(t, p.AddBoxAlias([]byte("box"), []byte("alias 3"), 7, now-1))
+	require.Equal(t, kvstor.ErrBoxOwner, p.AddBoxAlias([]byte("box"), []byte("alias 4"), 8, now+60))
+
+	// alias 1 keeps the grace period it was given when alias 2 was added
+	for alias, expected := range map[string][]byte{"alias 1": []byte("box"), "alias 2": nil, "alias 3": []byte("box"), "alias 4": nil} {
+		box, err = p.BoxOfAlias([]byte(alias))
+		require.NoError(t, err)
+		require.Equal(t, expected, box, alias)
+	}
+
+	listed := map[string]int64{}
+	require.NoError(t, p.(kvstor.Lister).ListBoxAliases(func(alias, boxID []byte, ownerID int64, expires int64) error {
+		require.Equal(t, []byte("box"), boxID)
+		require.Equal(t, int64(7), ownerID)
+		listed[string(alias)] = expires
+		return nil
+	}))
+	require.Equal(t, map[string]int64{"alias 1": now + 60, "alias 3": 0}, listed)
+
+	purged, err := p.PurgeExpiredBoxAliases(now + 60)
+	require.NoError(t, err)
+	require.Equal(t, 2, purged)
+	box, err = p.BoxOfAlias([]byte("alias 3"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("box"), box)
+}
+
+func TestList(t *testing.T) {
+	p := New()
+	lister := p.(kvstor.Lister)
+	require.NoError(t, p.DropPackage([]byte("a"), []byte("box a"), 0))
+	require.NoError(t, p.DropPackage([]byte("b"), []byte("box b"), time.Now().Add(-time.Minute).Unix()))
+	require.NoError(t, p.InsertIds(300, []byte("public id")))
+	require.NoError(t, p.StartDebugCapture(7, 1000))
+
+	// fn can use the provider, since memkv copies what it lists first
+	var boxes []string
+	require.NoError(t, lister.ListPackages(func(boxID, pkg []byte, expires int64) error {
+		boxes = append(boxes, string(boxID))
+		_, err := p.PickUpPackage(boxID)
+		return err
+	}))
+	require.Equal(t, []string{"box a"}, boxes)
+
+	ids := map[int64]string{}
+	require.NoError(t, lister.ListIDs(func(userID int64, pubID []byte) error {
+		ids[userID] = string(pubID)
+		return nil
+	}))
+	require.Equal(t, map[int64]string{300: "public id"}, ids)
+
+	captures := map[int64]int64{}
+	require.NoError(t, lister.ListDebugCaptures(func(userID int64, until int64) error {
+		captures[userID] = until
+		return nil
+	}))
+	require.Equal(t, map[int64]int64{7: 1000}, captures)
+}
@@ -1,13 +1,32 @@
 package model
 
-import "errors"
+import (
+	"context"
+	"errors"
+)
 
 var ErrDuplicateUsername = errors.New("a user with that username already exists")
 
+// ErrQueueFull is returned when a message can't be stored because its
+// recipient already has as many messages queued as allowed.
+var ErrQueueFull = errors.New("the recipient's message queue is full")
+
 type AccessTokenRecord struct {
 	Token     string `db:"token"`
 	UserID    int64  `db:"user_id"`
 	ExpiresAt int64  `db:"expires_at"`
+	// ClientRecord is the app the session was created from
+	ClientRecord
+	// RefreshToken is the refresh token the access token was issued from.
+	// It's empty for access tokens inserted without one.
+	RefreshToken string `db:"refresh_token"`
+	// SessionLastUsed is the LastUsed of RefreshToken
+	SessionLastUsed int64 `db:"session_last_used"`
+	// Scopes limits what the token can be used for, as a space separated
+	// list. Empty means it can be used for anything.
+	Scopes string `db:"scopes"`
+	// UserStatusRecord is the status of the token's user
+	UserStatusRecord
 }
 
 // APNSTokenRecord represents a row in the user_apns_tokens table
@@ -15,6 +34,39 @@ type APNSTokenRecord struct {
 	ID     int64  `db:"id"`
 	UserID int64  `db:"user_id"`
 	Token  string `db:"token"`
+	// ClientRecord is the app the token was registered from
+	ClientRecord
+}
+
+// ClientRecord identifies the app build, and the device it runs on, that
+// created a session or registered a push token. Its fields are empty when
+// the client didn't identify itself.
+type ClientRecord struct {
+	Platform    string `db:"platform"`
+	AppVersion  string `db:"app_version"`
+	DeviceModel string `db:"device_model"`
+}
+
+// ClientCountRecord counts the active sessions and the push tokens of each
+// app build
+type ClientCountRecord struct {
+	Platform   string `db:"platform"`
+	AppVersion string `db:"app_version"`
+	Sessions   int64  `db:"sessions"`
+	PushTokens int64  `db:"push_tokens"`
+}
+
+// EmailEventRecord represents a row in the email_events table. Events are
+// reported by the email provider, e.g. deliveries, bounces and complaints.
+type EmailEventRecord struct {
+	ID         int64  `db:"id"`
+	ProviderID string `db:"provider_id"`
+	Event      string `db:"event"`
+	Severity   string `db:"severity"`
+	Recipient  string `db:"recipient"`
+	MessageID  string `db:"message_id"`
+	Reason     string `db:"reason"`
+	Timestamp  int64  `db:"timestamp"`
 }
 
 // EmailVerificationTokenRecord represents a row in the email_verification_tokens table
@@ -30,6 +82,8 @@ type FCMTokenRecord struct {
 	ID     int64  `db:"id"`
 	UserID int64  `db:"user_id"`
 	Token  string `db:"token"`
+	// ClientRecord is the app the token was registered from
+	ClientRecord
 }
 
 // MessageRecord represents a row in the messages table
@@ -40,6 +94,84 @@ type MessageRecord struct {
 	CipherText  []byte `db:"cipher_text"`
 	Nonce       []byte `db:"nonce"`
 	SentDate    int64  `db:"sent_date"`
+	// Sealed records have their sender, sent date and content sealed to the
+	// recipient's public key in CipherText. SenderID and SentDate are zero.
+	Sealed bool `db:"sealed"`
+	// System records were sent by the server, not by a user. It's false for
+	// sealed records, which keep it inside the envelope.
+	System bool `db:"system"`
+	// Urgent records may evict older records that aren't urgent when the
+	// recipient's queue is full.
+	Urgent bool `db:"urgent"`
+}
+
+// OutboxRecord represents a row in the outbox table. An entry holds the
+// side effects of storing a message, i.e. publishing it over sockets and
+// pushing it, and is written in the same transaction as the message, so
+// they're performed even if the server stops before getting to them.
+type OutboxRecord struct {
+	ID          int64 `db:"id"`
+	RecipientID int64 `db:"recipient_id"`
+	MessageID   int64 `db:"message_id"`
+	// Payload is what's needed to deliver the message. It's opaque to the
+	// database.
+	Payload []byte `db:"payload"`
+	Urgent  bool   `db:"urgent"`
+	// Attempts counts the times the entry was claimed for delivery
+	Attempts int `db:"attempts"`
+	// NextAttempt is when the entry can be claimed again, in case the
+	// delivery that claimed it never finished
+	NextAttempt int64 `db:"next_attempt"`
+}
+
+// UserIndexRecord is the subset of a users row returned by contact discovery
+type UserIndexRecord struct {
+	ID            int64  `db:"id"`
+	PublicKey     []byte `db:"public_key"`
+	UsernameIndex []byte `db:"username_index"`
+}
+
+// RefreshTokenRecord represents a row in the refresh_tokens table. A refresh
+// token outlives the access tokens it's exchanged for, which are stored with
+// it as their refresh_token. Each refresh token is a session of the user,
+// from logging in until it expires or is revoked.
+type RefreshTokenRecord struct {
+	ID        int64  `db:"id"`
+	Token     string `db:"token"`
+	UserID    int64  `db:"user_id"`
+	ExpiresAt int64  `db:"expires_at"`
+	// ClientRecord is the app the refresh token was issued to
+	ClientRecord
+	// CreatedAt is when the user logged in, and LastUsed is when the
+	// session was last used. Both are zero for sessions from before they
+	// were recorded.
+	CreatedAt int64 `db:"created_at"`
+	LastUsed  int64 `db:"last_used"`
+	// UserAgent is the User-Agent header of the login, and IPPrefix the
+	// network it came from, e.g. 203.0.113.0/24
+	UserAgent string `db:"user_agent"`
+	IPPrefix  string `db:"ip_prefix"`
+}
+
+// ReservedUsernameRecord represents a row in the reserved_usernames table.
+// Reserved usernames can only be registered with Email. When Email is
+// empty, nobody can register it.
+type ReservedUsernameRecord struct {
+	Username  string `db:"username"`
+	Email     string `db:"email"`
+	Note      string `db:"note"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+// TicketRecord represents a row in the tickets table
+type TicketRecord struct {
+	UserID    int64 `db:"user_id"`
+	Timestamp int64 `db:"timestamp"`
+	// Scopes limits what the ticket can be used for, like the Scopes of an
+	// AccessTokenRecord
+	Scopes string `db:"scopes"`
+	// UserStatusRecord is the status of the ticket's user
+	UserStatusRecord
 }
 
 // SessionChallengeRecord represents a row in the session_challenges table
@@ -48,6 +180,18 @@ type SessionChallengeRecord struct {
 	UserID       int64  `db:"user_id"`
 	CreationDate int64  `db:"creation_date"`
 	Challenge    []byte `db:"challenge"`
+	// Used is set once the challenge has been answered, so the answer can't
+	// be replayed
+	Used bool `db:"used"`
+}
+
+// UserDataSummary counts what the relational database holds about a user
+type UserDataSummary struct {
+	PendingMessages     int64 `db:"pending_messages"`
+	PendingMessageBytes int64 `db:"pending_message_bytes"`
+	APNSTokens          int64 `db:"apns_tokens"`
+	FCMTokens           int64 `db:"fcm_tokens"`
+	ActiveSessions      int64 `db:"active_sessions"`
 }
 
 // UserRecord represents a row in the users table
@@ -64,6 +208,35 @@ type UserRecord struct {
 	PasswordHashOperationsLimit uint    `db:"password_hash_operations_limit"`
 	PasswordHashMemoryLimit     uint64  `db:"password_hash_memory_limit"`
 	Email                       *string `db:"email"`
+	// UsernameIndex is a keyed hash of the username, so users can be looked
+	// up without revealing the username being searched for
+	UsernameIndex []byte `db:"username_index"`
+	// Locale is the language tag emails to the user are written in, e.g.
+	// "pt-br". Empty means the server's default.
+	Locale string `db:"locale"`
+	// UndeliverableEmail is the address that was taken off the account
+	// because it bounced or complained, until another one is verified
+	UndeliverableEmail *string `db:"undeliverable_email"`
+	// CreatedAt is when the user registered. It's 0 for users that
+	// registered before it was recorded.
+	CreatedAt int64 `db:"created_at"`
+	UserStatusRecord
+}
+
+// Statuses of a user, set by an admin
+const (
+	UserActive    = ""
+	UserSuspended = "suspended"
+	UserBanned    = "banned"
+)
+
+// UserStatusRecord is whether a user is active, suspended or banned
+type UserStatusRecord struct {
+	Status string `db:"status"`
+	// SuspendedUntil is when a suspension ends by itself. It's 0 for
+	// suspensions that last until the user is reinstated.
+	SuspendedUntil int64  `db:"suspended_until"`
+	StatusReason   string `db:"status_reason"`
 }
 
 // Provider is the set of functionality required by oscar of a relational database.
@@ -71,42 +244,156 @@ type UserRecord struct {
 // with a stubbed out relational database.
 type Provider interface {
 	AccessToken(token string) (*AccessTokenRecord, error)
+	// AccessTokens returns up to limit of the access tokens that are still
+	// valid at now, in order, starting after afterToken
+	AccessTokens(afterToken string, now int64, limit int) ([]string, error)
+	// ClaimOutboxEntries returns up to limit outbox entries that were due
+	// at now, and holds them off until leaseUntil, so they're only claimed
+	// again if their delivery doesn't finish by then
+	ClaimOutboxEntries(now, leaseUntil int64, limit int) ([]OutboxRecord, error)
 	APNSToken(token string) (*APNSTokenRecord, error)
 	APNSTokensRaw(userID int64) ([]string, error)
 	APNSTokenUser(userID int64, token string) (*APNSTokenRecord, error)
+	// ClientCounts counts the sessions that are still active at now, and
+	// the push tokens, of each app build
+	ClientCounts(now int64) ([]ClientCountRecord, error)
+	// DeleteAccessToken ends the session of token, deleting the refresh
+	// token it was issued from, along with the other access tokens issued
+	// from that refresh token
+	DeleteAccessToken(token string) error
+	// DeleteAccessTokensOfUser ends all of the user's sessions, deleting
+	// their refresh tokens too. It returns the number of access tokens
+	// deleted.
+	DeleteAccessTokensOfUser(userID int64) (rowsAffected int64, err error)
 	DeleteAPNSToken(token string) error
 	DeleteAPNSTokenOfUser(userID int64, token string) error
+	// DeleteExpiredAccessTokens removes the sessions that expired before now
+	DeleteExpiredAccessTokens(now int64) (rowsAffected int64, err error)
+	// DeleteExpiredRefreshTokens removes the refresh tokens that expired
+	// before now
+	DeleteExpiredRefreshTokens(now int64) (rowsAffected int64, err error)
 	DeleteFCMToken(token string) error
 	DeleteFCMTokenOfUser(userID int64, token string) error
 	DeleteMessageToRecipient(recipientID, msgID int64) error
+	DeleteMessagesToRecipient(recipientID int64, msgIDs []int64) (rowsAffected int64, err error)
+	DeleteOutboxEntry(id int64) error
+	DeleteReservedUsername(username string) (deleted bool, err error)
+	// DeleteSession ends the session of the user with id, deleting the
+	// refresh token and the access tokens issued from it. It returns false
+	// if the user has no such session.
+	DeleteSession(userID, id int64) (bool, error)
 	DeleteSessionChallengeID(id int64) error
 	DeleteSessionChallengeUser(userID int64) error
+	// DeleteSessionChallenges removes the challenges created before olderThan
+	DeleteSessionChallenges(olderThan int64) (rowsAffected int64, err error)
 	DeleteTickets(olderThan int64) error
 	DisavowEmail(token string) error
+	// EachMessageRecord calls fn with each message of recipientID, in order
+	// of id, as they're read from the database, so they don't have to be
+	// held in memory at once. It stops at the first error fn returns, and
+	// returns it.
+	EachMessageRecord(recipientID int64, fn func(MessageRecord) error) error
+	EmailEvents(limit int) ([]EmailEventRecord, error)
+	EmailSuppressed(email string) (bool, error)
 	EmailVerificationTokenRecord(token string) (*EmailVerificationTokenRecord, error)
 	FCMToken(token string) (*FCMTokenRecord, error)
 	FCMTokensRaw(userID int64) ([]string, error)
 	FCMTokenUser(userID int64, token string) (*FCMTokenRecord, error)
-	InsertAccessToken(token string, userID int64, expiresAt int64) error
-	InsertAPNSToken(userID int64, token string) error
-	InsertFCMToken(userID int64, token string) error
+	InsertAccessToken(token string, userID int64, expiresAt int64, client ClientRecord) error
+	InsertEmailEvent(evt EmailEventRecord) error
+	// InsertEmailVerificationToken starts the verification of email for
+	// userID, replacing the verifications the user hasn't finished. The
+	// user's current address is kept until VerifyEmail.
+	InsertEmailVerificationToken(userID int64, email, token string) error
+	InsertAPNSToken(userID int64, token string, client ClientRecord) error
+	InsertAuditLogEntry(actor, action, details string) error
+	InsertFCMToken(userID int64, token string, client ClientRecord) error
 	InsertMessage(recipientID, senderID int64, cipherText, nonce []byte, sentDate int64) (int64, error)
+	// InsertMessageWithOutbox stores msg, sealed or not, and the outbox
+	// entry for its delivery in one transaction. The MessageID of entry is
+	// filled in with the id of the new message. If maxQueued is above zero
+	// and the recipient already has that many messages, an urgent msg
+	// evicts the oldest message that isn't urgent, along with its outbox
+	// entry, and its id is returned as evictedID. Otherwise ErrQueueFull
+	// is returned.
+	InsertMessageWithOutbox(msg MessageRecord, entry OutboxRecord, maxQueued int64) (msgID, entryID, evictedID int64, err error)
+	// InsertRefreshToken stores a refresh token. Access tokens are issued
+	// from it with InsertRefreshedAccessToken. The ID of rtr is ignored.
+	InsertRefreshToken(rtr RefreshTokenRecord) error
+	// InsertRefreshedAccessToken stores an access token issued from
+	// refreshToken, for the user and client of refreshToken
+	InsertRefreshedAccessToken(token, refreshToken string, expiresAt int64) error
+	// InsertScopedAccessToken stores an access token of userID that can only
+	// be used for scopes, a space separated list. It isn't issued from a
+	// refresh token, so it ends when it expires.
+	InsertScopedAccessToken(token string, userID, expiresAt int64, scopes string) error
+	InsertSealedMessage(recipientID int64, sealedEnvelope, nonce []byte) (int64, error)
 	InsertSessionChallenge(userID int64, creationDate int64, challenge []byte) error
-	InsertTicket(ticket string, userID int64) error
+	// InsertTicket stores a ticket of userID that can only be used for
+	// scopes, a space separated list. Empty scopes allow anything.
+	InsertTicket(ticket string, userID int64, scopes string) error
 	InsertUser(user UserRecord, verificationToken *string) (int64, error)
 	LimitedUserInfo(username string) (id int64, pubKey []byte, err error)
 	LimitedUserInfoID(userID int64) (username string, pubKey []byte, err error)
+	LimitedUserInfoIndex(index []byte) (id int64, username string, pubKey []byte, err error)
 	MessageRecords(recipientID int64) ([]MessageRecord, error)
 	MessageToRecipient(recipientID, msgID int64) (*MessageRecord, error)
+	MessagesToRecipient(recipientID int64, msgIDs []int64) ([]MessageRecord, error)
+	// OutboxEntries returns up to limit outbox entries whose id is above
+	// afterID, in order of id, whether they're due or not
+	OutboxEntries(afterID int64, limit int) ([]OutboxRecord, error)
+	OutboxSize() (int64, error)
+	RefreshToken(token string) (*RefreshTokenRecord, error)
+	// RotateRefreshToken replaces the refresh token old with new, which
+	// expires at expiresAt, keeping the access tokens issued from old. It
+	// returns false if old is unknown, e.g. because it was already rotated.
+	RotateRefreshToken(old, new string, expiresAt int64) (bool, error)
+	// RecentUsers returns up to limit users whose id is below beforeID, the
+	// newest first. A beforeID of 0 starts with the newest user.
+	RecentUsers(beforeID int64, limit int) ([]UserRecord, error)
+	ReserveUsernames(usernames []string, email, note string) error
+	ReservedUsername(username string) (*ReservedUsernameRecord, error)
+	ReservedUsernames() ([]ReservedUsernameRecord, error)
 	ReplaceAPNSToken(old, new string) (rowsAffected int64, err error)
 	ReplaceFCMToken(old, new string) (rowsAffected int64, err error)
 	SessionChallenge(userID int64) (*SessionChallengeRecord, error)
-	Ticket(ticket string) (userID, timestamp int64, err error)
-	UpdateUserIDOfAPNSToken(newUserID int64, token string) error
-	UpdateUserIDOfFCMToken(newUserID int64, token string) error
+	SessionChallengeCount() (int64, error)
+	// Sessions returns the sessions of the user that are still active at
+	// now, the ones used last first
+	Sessions(userID, now int64) ([]RefreshTokenRecord, error)
+	SuppressEmail(email, reason string) (affectedUsers int64, err error)
+	SetUserLocale(userID int64, locale string) error
+	// SetUserStatus suspends, bans or reinstates the user. It returns false
+	// if there's no such user.
+	SetUserStatus(userID int64, status UserStatusRecord) (bool, error)
+	SetUsernameIndex(userID int64, index []byte) error
+	// Ticket returns the record of ticket, or nil if it's unknown
+	Ticket(ticket string) (*TicketRecord, error)
+	// TouchSession records that the session of refreshToken was used at
+	// lastUsed
+	TouchSession(refreshToken string, lastUsed int64) error
+	// UpdateUserIDOfAPNSToken moves the token to newUserID, and records the
+	// client registering it
+	UpdateUserIDOfAPNSToken(newUserID int64, token string, client ClientRecord) error
+	// UseSessionChallenge marks the challenge as used, and returns false if
+	// it already was
+	UseSessionChallenge(id int64) (bool, error)
+	// UpdateUserIDOfFCMToken moves the token to newUserID, and records the
+	// client registering it
+	UpdateUserIDOfFCMToken(newUserID int64, token string, client ClientRecord) error
+	// UpdateOutboxPayload replaces the payload of the outbox entry with id.
+	// It's not an error if the entry is gone.
+	UpdateOutboxPayload(id int64, payload []byte) error
 	User(username string) (*UserRecord, error)
+	// UserDataSummary counts the user's records. Sessions that expired
+	// before now aren't counted.
+	UserDataSummary(userID, now int64) (*UserDataSummary, error)
 	Username(userID int64) string
 	UsernameAvailable(username string) (bool, error)
+	UsernamesWithoutIndex() (map[int64]string, error)
 	UserPublicKey(userID int64) ([]byte, error)
+	UsersWithIndexPrefix(prefix []byte, limit int) ([]UserIndexRecord, error)
 	VerifyEmail(email string, userID int64) error
+	// WithContext returns a Provider whose operations are cancelled when ctx is
+	WithContext(ctx context.Context) Provider
 }
@@ -0,0 +1,136 @@
+package postgres
+
+// migrations brings the schema from one version to the next. The schema
+// matches the one the sqlite provider reaches after all its migrations,
+// with postgres types.
+var migrations = [][]string{
+	{
+		`CREATE TABLE email_verification_tokens (
+				  user_id BIGINT PRIMARY KEY,
+				  token TEXT NOT NULL,
+				  email TEXT NOT NULL,
+				  send_date BIGINT NOT NULL)`,
+		`CREATE TABLE messages (id BIGSERIAL PRIMARY KEY,
+							recipient_id BIGINT NOT NULL,
+							sender_id BIGINT NOT NULL,
+							cipher_text BYTEA NOT NULL,
+							nonce BYTEA NOT NULL,
+							sent_date BIGINT NOT NULL,
+							sealed BOOLEAN NOT NULL DEFAULT FALSE,
+							system BOOLEAN NOT NULL DEFAULT FALSE)`,
+		`CREATE INDEX messages_recipient_id ON messages(recipient_id)`,
+		`CREATE TABLE session_challenges (id BIGSERIAL PRIMARY KEY,
+									  user_id BIGINT NOT NULL,
+									  creation_date BIGINT NOT NULL,
+									  challenge BYTEA NOT NULL,
+									  used BOOLEAN NOT NULL DEFAULT FALSE)`,
+		`CREATE TABLE user_apns_tokens (id BIGSERIAL PRIMARY KEY,
+									user_id BIGINT NOT NULL,
+									token TEXT NOT NULL)`,
+		`CREATE TABLE user_fcm_tokens (id BIGSERIAL PRIMARY KEY,
+								   user_id BIGINT NOT NULL,
+								   token TEXT NOT NULL)`,
+		`CREATE TABLE users (id BIGSERIAL PRIMARY KEY,
+						 username TEXT NOT NULL,
+						 public_key BYTEA NOT NULL,
+						 wrapped_secret_key BYTEA NOT NULL,
+						 wrapped_secret_key_nonce BYTEA NOT NULL,
+						 wrapped_symmetric_key BYTEA NOT NULL,
+						 wrapped_symmetric_key_nonce BYTEA NOT NULL,
+						 password_salt BYTEA NOT NULL,
+						 password_hash_algorithm TEXT NOT NULL,
+						 password_hash_operations_limit BIGINT NOT NULL,
+						 password_hash_memory_limit BIGINT NOT NULL,
+						 email TEXT,
+						 username_index BYTEA,
+						 locale TEXT NOT NULL DEFAULT '')`,
+		`CREATE UNIQUE INDEX users_username_unique_constraint ON users(username)`,
+		`CREATE UNIQUE INDEX users_username_index_unique_constraint ON users(username_index)`,
+		`CREATE TABLE tickets (
+				  ticket TEXT NOT NULL PRIMARY KEY,
+				  user_id BIGINT NOT NULL,
+				  timestamp BIGINT NOT NULL DEFAULT EXTRACT(EPOCH FROM now())::BIGINT)`,
+		`CREATE TABLE sessions (token TEXT PRIMARY KEY,
+							user_id BIGINT NOT NULL,
+							expires_at BIGINT NOT NULL)`,
+		`CREATE TABLE email_events (id BIGSERIAL PRIMARY KEY,
+								provider_id TEXT NOT NULL,
+								event TEXT NOT NULL,
+								severity TEXT NOT NULL,
+								recipient TEXT NOT NULL,
+								message_id TEXT NOT NULL,
+								reason TEXT NOT NULL,
+								timestamp BIGINT NOT NULL)`,
+		`CREATE UNIQUE INDEX email_events_provider_id_unique_constraint ON email_events(provider_id)`,
+		`CREATE TABLE suppressed_emails (email TEXT PRIMARY KEY,
+									 reason TEXT NOT NULL,
+									 created_at BIGINT NOT NULL DEFAULT EXTRACT(EPOCH FROM now())::BIGINT)`,
+		`CREATE TABLE audit_log (id BIGSERIAL PRIMARY KEY,
+							 created_at BIGINT NOT NULL DEFAULT EXTRACT(EPOCH FROM now())::BIGINT,
+							 actor TEXT NOT NULL,
+							 action TEXT NOT NULL,
+							 details TEXT NOT NULL)`,
+		`CREATE TABLE reserved_usernames (username TEXT PRIMARY KEY,
+									  email TEXT NOT NULL DEFAULT '',
+									  note TEXT NOT NULL DEFAULT '',
+									  created_at BIGINT NOT NULL DEFAULT EXTRACT(EPOCH FROM now())::BIGINT)`,
+		`CREATE TABLE outbox (id BIGSERIAL PRIMARY KEY,
+						  recipient_id BIGINT NOT NULL,
+						  message_id BIGINT NOT NULL,
+						  payload BYTEA NOT NULL,
+						  urgent BOOLEAN NOT NULL DEFAULT FALSE,
+						  attempts INTEGER NOT NULL DEFAULT 0,
+						  next_attempt BIGINT NOT NULL)`,
+		`CREATE INDEX outbox_next_attempt ON outbox(next_attempt)`,
+	},
+	{
+		`ALTER TABLE sessions ADD COLUMN platform TEXT NOT NULL DEFAULT '',
+							ADD COLUMN app_version TEXT NOT NULL DEFAULT '',
+							ADD COLUMN device_model TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE user_apns_tokens ADD COLUMN platform TEXT NOT NULL DEFAULT '',
+									ADD COLUMN app_version TEXT NOT NULL DEFAULT '',
+									ADD COLUMN device_model TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE user_fcm_tokens ADD COLUMN platform TEXT NOT NULL DEFAULT '',
+								   ADD COLUMN app_version TEXT NOT NULL DEFAULT '',
+								   ADD COLUMN device_model TEXT NOT NULL DEFAULT ''`,
+		`CREATE INDEX sessions_user_id ON sessions(user_id)`,
+	},
+	{
+		`ALTER TABLE messages ADD COLUMN urgent BOOLEAN NOT NULL DEFAULT FALSE`,
+	},
+	{
+		`ALTER TABLE users ADD COLUMN undeliverable_email TEXT`,
+	},
+	{
+		`CREATE TABLE refresh_tokens (id BIGSERIAL PRIMARY KEY,
+								  token TEXT NOT NULL,
+								  user_id BIGINT NOT NULL,
+								  expires_at BIGINT NOT NULL,
+								  platform TEXT NOT NULL DEFAULT '',
+								  app_version TEXT NOT NULL DEFAULT '',
+								  device_model TEXT NOT NULL DEFAULT '')`,
+		`CREATE UNIQUE INDEX refresh_tokens_token_unique_constraint ON refresh_tokens(token)`,
+		`CREATE INDEX refresh_tokens_user_id ON refresh_tokens(user_id)`,
+		`ALTER TABLE sessions ADD COLUMN refresh_token TEXT NOT NULL DEFAULT ''`,
+		`CREATE INDEX sessions_refresh_token ON sessions(refresh_token)`,
+		`INSERT INTO refresh_tokens (token, user_id, expires_at, platform, app_version, device_model)
+		SELECT token, user_id, expires_at, platform, app_version, device_model FROM sessions`,
+		`UPDATE sessions SET refresh_token=token`,
+	},
+	{
+		`ALTER TABLE refresh_tokens ADD COLUMN created_at BIGINT NOT NULL DEFAULT 0,
+									ADD COLUMN last_used BIGINT NOT NULL DEFAULT 0,
+									ADD COLUMN user_agent TEXT NOT NULL DEFAULT '',
+									ADD COLUMN ip_prefix TEXT NOT NULL DEFAULT ''`,
+	},
+	{
+		`ALTER TABLE users ADD COLUMN created_at BIGINT NOT NULL DEFAULT 0,
+						ADD COLUMN status TEXT NOT NULL DEFAULT '',
+						ADD COLUMN suspended_until BIGINT NOT NULL DEFAULT 0,
+						ADD COLUMN status_reason TEXT NOT NULL DEFAULT ''`,
+	},
+	{
+		`ALTER TABLE tickets ADD COLUMN scopes TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE sessions ADD COLUMN scopes TEXT NOT NULL DEFAULT ''`,
+	},
+}
@@ -0,0 +1,1402 @@
+// Package postgres implements model.Provider on PostgreSQL, so several
+// instances of the server can share their relational data, and write to it
+// at the same time.
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgconn"
+	_ "github.com/jackc/pgx/v4/stdlib" // registers the pgx driver
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"zood.dev/oscar/model"
+)
+
+// DefaultMaxConns is the size of the connection pool when none is given
+const DefaultMaxConns = 10
+
+// migrationLockID keys the advisory lock taken while the schema is
+// migrated, so instances starting together don't migrate it twice
+const migrationLockID = 0x6f73636172
+
+// uniqueViolation is the error code of a broken unique constraint
+const uniqueViolation = "23505"
+
+// postgresDB fulfills the model.Provider interface
+type postgresDB struct {
+	ctx context.Context
+	dbx *sqlx.DB
+}
+
+// WithContext returns a copy of db whose queries are cancelled along with ctx
+func (db postgresDB) WithContext(ctx context.Context) model.Provider {
+	db.ctx = ctx
+	return db
+}
+
+func (db postgresDB) context() context.Context {
+	if db.ctx == nil {
+		return context.Background()
+	}
+	return db.ctx
+}
+
+// New returns a model.Provider backed by the PostgreSQL database at dsn, a
+// connection string like "postgres://oscar:pass@db:5432/oscar". The pool
+// holds up to maxConns connections.
+func New(dsn string, maxConns int) (model.Provider, error) {
+	dbx, err := sqlx.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if maxConns <= 0 {
+		maxConns = DefaultMaxConns
+	}
+	dbx.SetMaxOpenConns(maxConns)
+	dbx.SetMaxIdleConns(maxConns)
+	dbx.SetConnMaxLifetime(time.Hour)
+
+	db := postgresDB{dbx: dbx}
+	if err = db.migrate(); err != nil {
+		dbx.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// NewReplica returns a model.Provider backed by a read replica of the
+// database at dsn. Unlike New, it leaves the schema alone, since replicas
+// can't be written to; it's migrated through the primary. It checks that
+// the replica can be reached, so a mistyped dsn fails at startup rather
+// than on every read.
+func NewReplica(dsn string, maxConns int) (model.Provider, error) {
+	dbx, err := sqlx.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if maxConns <= 0 {
+		maxConns = DefaultMaxConns
+	}
+	dbx.SetMaxOpenConns(maxConns)
+	dbx.SetMaxIdleConns(maxConns)
+	dbx.SetConnMaxLifetime(time.Hour)
+
+	if err = dbx.Ping(); err != nil {
+		dbx.Close()
+		return nil, errors.Wrap(err, "unable to reach the replica")
+	}
+	return postgresDB{dbx: dbx}, nil
+}
+
+// migrate brings the schema up to date
+func (db postgresDB) migrate() error {
+	tx, err := db.dbx.BeginTxx(db.context(), nil)
+	if err != nil {
+		return errors.Wrap(err, "unable to begin transaction for database migration")
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("SELECT pg_advisory_xact_lock($1)", migrationLockID); err != nil {
+		return errors.Wrap(err, "unable to lock the schema for migration")
+	}
+	_, err = tx.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)")
+	if err != nil {
+		return errors.Wrap(err, "unable to create the schema_version table")
+	}
+	var ver int
+	err = tx.QueryRowx("SELECT version FROM schema_version").Scan(&ver)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		if _, err = tx.Exec("INSERT INTO schema_version (version) VALUES (0)"); err != nil {
+			return errors.Wrap(err, "unable to insert the schema version")
+		}
+	default:
+		return errors.Wrap(err, "unable to read the schema version")
+	}
+
+	for ; ver < len(migrations); ver++ {
+		for _, q := range migrations[ver] {
+			if _, err = tx.Exec(q); err != nil {
+				return errors.Wrapf(err, "migrating the schema to version %d", ver+1)
+			}
+		}
+	}
+	if _, err = tx.Exec("UPDATE schema_version SET version=$1", ver); err != nil {
+		return errors.Wrap(err, "unable to update the schema version")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errors.Wrap(err, "error committing migration transaction")
+	}
+	return nil
+}
+
+func (db postgresDB) AccessToken(token string) (*model.AccessTokenRecord, error) {
+	const query = `
+	SELECT s.user_id, s.expires_at, s.platform, s.app_version, s.device_model, s.refresh_token,
+		COALESCE(r.last_used, 0) AS session_last_used, s.scopes, COALESCE(u.status, '') AS status,
+		COALESCE(u.suspended_until, 0) AS suspended_until, COALESCE(u.status_reason, '') AS status_reason
+	FROM sessions s LEFT JOIN refresh_tokens r ON r.token=s.refresh_token AND s.refresh_token<>''
+		LEFT JOIN users u ON u.id=s.user_id
+	WHERE s.token=$1`
+	atr := model.AccessTokenRecord{Token: token}
+	err := db.dbx.QueryRowxContext(db.context(), query, token).StructScan(&atr)
+	switch err {
+	case nil:
+		return &atr, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+func (db postgresDB) AccessTokens(afterToken string, now int64, limit int) ([]string, error) {
+	const query = `SELECT token FROM sessions WHERE token>$1 AND expires_at>=$2 ORDER BY token LIMIT $3`
+	tokens := make([]string, 0)
+	if err := db.dbx.SelectContext(db.context(), &tokens, query, afterToken, now, limit); err != nil {
+		return nil, errors.Wrap(err, "unable to select access tokens")
+	}
+	return tokens, nil
+}
+
+func (db postgresDB) APNSToken(token string) (*model.APNSTokenRecord, error) {
+	const query = `SELECT id, user_id, platform, app_version, device_model FROM user_apns_tokens WHERE token=$1`
+	ftr := model.APNSTokenRecord{Token: token}
+	err := db.dbx.QueryRowxContext(db.context(), query, token).StructScan(&ftr)
+	switch err {
+	case nil:
+		return &ftr, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+func (db postgresDB) APNSTokensRaw(userID int64) ([]string, error) {
+	const query = `SELECT token FROM user_apns_tokens WHERE user_id=$1`
+	tokens := make([]string, 0)
+	err := db.dbx.SelectContext(db.context(), &tokens, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (db postgresDB) APNSTokenUser(userID int64, token string) (*model.APNSTokenRecord, error) {
+	const query = "SELECT id FROM user_apns_tokens WHERE user_id=$1 AND token=$2"
+	var id int64
+	err := db.dbx.QueryRowContext(db.context(), query, userID, token).Scan(&id)
+	switch err {
+	case nil:
+		return &model.APNSTokenRecord{ID: id, UserID: userID, Token: token}, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+// ClientCounts groups the active sessions and the push tokens by the app
+// build they came from
+func (db postgresDB) ClientCounts(now int64) ([]model.ClientCountRecord, error) {
+	const query = `
+	SELECT platform, app_version, SUM(sessions)::BIGINT AS sessions, SUM(push_tokens)::BIGINT AS push_tokens FROM (
+		SELECT platform, app_version, 1 AS sessions, 0 AS push_tokens FROM sessions WHERE expires_at>=$1
+		UNION ALL SELECT platform, app_version, 0, 1 FROM user_apns_tokens
+		UNION ALL SELECT platform, app_version, 0, 1 FROM user_fcm_tokens
+	) AS clients GROUP BY platform, app_version ORDER BY platform, app_version`
+	counts := make([]model.ClientCountRecord, 0)
+	if err := db.dbx.SelectContext(db.context(), &counts, query, now); err != nil {
+		return nil, errors.Wrap(err, "failed to count clients")
+	}
+	return counts, nil
+}
+
+func (db postgresDB) Database() *sql.DB {
+	return db.dbx.DB
+}
+
+func (db postgresDB) DeleteAccessToken(token string) error {
+	tx, err := db.dbx.BeginTx(db.context(), nil)
+	if err != nil {
+		return errors.Wrap(err, "unable to start a transaction")
+	}
+	defer tx.Rollback()
+
+	var refreshToken string
+	const deleteSQL = `DELETE FROM sessions WHERE token=$1 RETURNING refresh_token`
+	err = tx.QueryRowContext(db.context(), deleteSQL, token).Scan(&refreshToken)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return nil
+	default:
+		return errors.Wrap(err, "unable to delete the access token")
+	}
+	if refreshToken != "" {
+		if _, err = tx.ExecContext(db.context(), `DELETE FROM sessions WHERE refresh_token=$1`, refreshToken); err != nil {
+			return errors.Wrap(err, "unable to delete access tokens of the refresh token")
+		}
+		if _, err = tx.ExecContext(db.context(), `DELETE FROM refresh_tokens WHERE token=$1`, refreshToken); err != nil {
+			return errors.Wrap(err, "unable to delete the refresh token")
+		}
+	}
+
+	return errors.Wrap(tx.Commit(), "failed to commit transaction")
+}
+
+func (db postgresDB) DeleteAccessTokensOfUser(userID int64) (int64, error) {
+	tx, err := db.dbx.BeginTx(db.context(), nil)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to start a transaction")
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(db.context(), "DELETE FROM sessions WHERE user_id=$1", userID)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to delete access tokens")
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to count deleted access tokens")
+	}
+	if _, err = tx.ExecContext(db.context(), "DELETE FROM refresh_tokens WHERE user_id=$1", userID); err != nil {
+		return 0, errors.Wrap(err, "unable to delete refresh tokens")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, errors.Wrap(err, "failed to commit transaction")
+	}
+	return affected, nil
+}
+
+func (db postgresDB) DeleteAPNSToken(token string) error {
+	const query = `DELETE FROM user_apns_tokens WHERE token=$1`
+	_, err := db.dbx.ExecContext(db.context(), query, token)
+	return err
+}
+
+func (db postgresDB) DeleteAPNSTokenOfUser(userID int64, token string) error {
+	const query = `DELETE FROM user_apns_tokens WHERE user_id=$1 AND token=$2`
+	_, err := db.dbx.ExecContext(db.context(), query, userID, token)
+	return err
+}
+
+func (db postgresDB) DeleteExpiredAccessTokens(now int64) (int64, error) {
+	result, err := db.dbx.ExecContext(db.context(), "DELETE FROM sessions WHERE expires_at<$1", now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (db postgresDB) DeleteExpiredRefreshTokens(now int64) (int64, error) {
+	result, err := db.dbx.ExecContext(db.context(), "DELETE FROM refresh_tokens WHERE expires_at<$1", now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (db postgresDB) DeleteFCMToken(token string) error {
+	const query = `DELETE FROM user_fcm_tokens WHERE token=$1`
+	_, err := db.dbx.ExecContext(db.context(), query, token)
+	return err
+}
+
+func (db postgresDB) DeleteFCMTokenOfUser(userID int64, token string) error {
+	const query = `DELETE FROM user_fcm_tokens WHERE user_id=$1 AND token=$2`
+	_, err := db.dbx.ExecContext(db.context(), query, userID, token)
+	return err
+}
+
+func (db postgresDB) DeleteMessageToRecipient(recipientID, msgID int64) error {
+	deleteSQL := `DELETE FROM messages WHERE recipient_id=$1 AND id=$2`
+	_, err := db.dbx.ExecContext(db.context(), deleteSQL, recipientID, msgID)
+	if err != nil {
+		return errors.Wrap(err, "unable to execute message deletion")
+	}
+
+	return nil
+}
+
+// DeleteMessagesToRecipient deletes the messages of recipientID among
+// msgIDs in a single statement, so either all of them are deleted or none
+// are. Ids of missing messages, or messages belonging to another user, are
+// skipped.
+func (db postgresDB) DeleteMessagesToRecipient(recipientID int64, msgIDs []int64) (int64, error) {
+	if len(msgIDs) == 0 {
+		return 0, nil
+	}
+	const deleteSQL = `DELETE FROM messages WHERE recipient_id=$1 AND id=ANY($2)`
+	result, err := db.dbx.ExecContext(db.context(), deleteSQL, recipientID, msgIDs)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to execute message deletion")
+	}
+
+	return result.RowsAffected()
+}
+
+func (db postgresDB) DeleteSession(userID, id int64) (bool, error) {
+	tx, err := db.dbx.BeginTx(db.context(), nil)
+	if err != nil {
+		return false, errors.Wrap(err, "unable to start a transaction")
+	}
+	defer tx.Rollback()
+
+	var refreshToken string
+	const deleteSQL = `DELETE FROM refresh_tokens WHERE id=$1 AND user_id=$2 RETURNING token`
+	err = tx.QueryRowContext(db.context(), deleteSQL, id, userID).Scan(&refreshToken)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return false, nil
+	default:
+		return false, errors.Wrap(err, "unable to delete the refresh token")
+	}
+	if _, err = tx.ExecContext(db.context(), `DELETE FROM sessions WHERE refresh_token=$1`, refreshToken); err != nil {
+		return false, errors.Wrap(err, "unable to delete access tokens of the refresh token")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return false, errors.Wrap(err, "failed to commit transaction")
+	}
+	return true, nil
+}
+
+func (db postgresDB) DeleteSessionChallengeID(id int64) error {
+	_, err := db.dbx.ExecContext(db.context(), "DELETE FROM session_challenges WHERE id=$1", id)
+	return err
+}
+
+func (db postgresDB) DeleteSessionChallengeUser(userID int64) error {
+	_, err := db.dbx.ExecContext(db.context(), "DELETE FROM session_challenges WHERE user_id=$1", userID)
+	return err
+}
+
+func (db postgresDB) DeleteSessionChallenges(olderThan int64) (int64, error) {
+	result, err := db.dbx.ExecContext(db.context(), "DELETE FROM session_challenges WHERE creation_date<$1", olderThan)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (db postgresDB) DeleteTickets(olderThan int64) error {
+	_, err := db.dbx.ExecContext(db.context(), "DELETE FROM tickets WHERE timestamp<=$1", olderThan)
+	return err
+}
+
+func (db postgresDB) DisavowEmail(token string) error {
+	const query = `DELETE FROM email_verification_tokens WHERE token=$1`
+	_, err := db.dbx.ExecContext(db.context(), query, token)
+	if err != nil {
+		return errors.Wrap(err, "unable to execute query")
+	}
+
+	return nil
+}
+
+// EmailEvents returns the most recent email events, newest first
+func (db postgresDB) EmailEvents(limit int) ([]model.EmailEventRecord, error) {
+	const query = `
+	SELECT id, provider_id, event, severity, recipient, message_id, reason, timestamp
+	FROM email_events ORDER BY timestamp DESC, id DESC LIMIT $1`
+	var events []model.EmailEventRecord
+	err := db.dbx.SelectContext(db.context(), &events, query, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to select email events")
+	}
+	return events, nil
+}
+
+// InsertEmailEvent records an event reported by the email provider. Events
+// that were already recorded, because the provider retried the webhook,
+// are ignored.
+func (db postgresDB) InsertEmailEvent(evt model.EmailEventRecord) error {
+	const query = `
+	INSERT INTO email_events (provider_id, event, severity, recipient, message_id, reason, timestamp)
+	VALUES (:provider_id, :event, :severity, :recipient, :message_id, :reason, :timestamp)
+	ON CONFLICT (provider_id) DO NOTHING`
+	_, err := db.dbx.NamedExecContext(db.context(), query, evt)
+	if err != nil {
+		return errors.Wrap(err, "failed to insert email event")
+	}
+	return nil
+}
+
+// InsertEmailVerificationToken fulfills model.Provider
+func (db postgresDB) InsertEmailVerificationToken(userID int64, email, token string) error {
+	tx, err := db.dbx.BeginTx(db.context(), nil)
+	if err != nil {
+		return errors.Wrap(err, "unable to start a transaction")
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(db.context(), `DELETE FROM email_verification_tokens WHERE user_id=$1`, userID)
+	if err != nil {
+		return errors.Wrap(err, "unable to delete pending verification tokens")
+	}
+	_, err = tx.ExecContext(db.context(), `INSERT INTO email_verification_tokens (user_id, token, email, send_date) VALUES ($1, $2, $3, $4)`,
+		userID, token, email, time.Now().Unix())
+	if err != nil {
+		return errors.Wrap(err, "unable to insert verification token")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errors.Wrap(err, "failed to commit transaction")
+	}
+	return nil
+}
+
+func (db postgresDB) EmailVerificationTokenRecord(token string) (*model.EmailVerificationTokenRecord, error) {
+	const query = `SELECT user_id, email, send_date FROM email_verification_tokens WHERE token=$1`
+	evtr := model.EmailVerificationTokenRecord{}
+	err := db.dbx.QueryRowContext(db.context(), query, token).Scan(&evtr.UserID, &evtr.Email, &evtr.SendDate)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+
+	evtr.Token = token
+
+	return &evtr, nil
+}
+
+func (db postgresDB) FCMToken(token string) (*model.FCMTokenRecord, error) {
+	const query = `SELECT id, user_id, platform, app_version, device_model FROM user_fcm_tokens WHERE token=$1`
+	ftr := model.FCMTokenRecord{Token: token}
+	err := db.dbx.QueryRowxContext(db.context(), query, token).StructScan(&ftr)
+	switch err {
+	case nil:
+		return &ftr, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+func (db postgresDB) FCMTokensRaw(userID int64) ([]string, error) {
+	const query = `SELECT token FROM user_fcm_tokens WHERE user_id=$1`
+	tokens := make([]string, 0)
+	err := db.dbx.SelectContext(db.context(), &tokens, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (db postgresDB) FCMTokenUser(userID int64, token string) (*model.FCMTokenRecord, error) {
+	const query = "SELECT id FROM user_fcm_tokens WHERE user_id=$1 AND token=$2"
+	var id int64
+	err := db.dbx.QueryRowContext(db.context(), query, userID, token).Scan(&id)
+	switch err {
+	case nil:
+		return &model.FCMTokenRecord{ID: id, UserID: userID, Token: token}, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+func (db postgresDB) InsertAccessToken(token string, userID int64, expiresAt int64, client model.ClientRecord) error {
+	const query = `
+	INSERT INTO sessions (token, user_id, expires_at, platform, app_version, device_model) VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err := db.dbx.ExecContext(db.context(), query, token, userID, expiresAt, client.Platform, client.AppVersion, client.DeviceModel)
+	return err
+}
+
+func (db postgresDB) InsertScopedAccessToken(token string, userID, expiresAt int64, scopes string) error {
+	const query = `INSERT INTO sessions (token, user_id, expires_at, scopes) VALUES ($1, $2, $3, $4)`
+	_, err := db.dbx.ExecContext(db.context(), query, token, userID, expiresAt, scopes)
+	return err
+}
+
+func (db postgresDB) InsertRefreshToken(rtr model.RefreshTokenRecord) error {
+	const query = `
+	INSERT INTO refresh_tokens (token, user_id, expires_at, platform, app_version, device_model, created_at, last_used, user_agent, ip_prefix)
+	VALUES (:token, :user_id, :expires_at, :platform, :app_version, :device_model, :created_at, :last_used, :user_agent, :ip_prefix)`
+	_, err := db.dbx.NamedExecContext(db.context(), query, rtr)
+	return err
+}
+
+func (db postgresDB) InsertRefreshedAccessToken(token, refreshToken string, expiresAt int64) error {
+	const query = `
+	INSERT INTO sessions (token, user_id, expires_at, platform, app_version, device_model, refresh_token)
+	SELECT $1, user_id, $2, platform, app_version, device_model, token FROM refresh_tokens WHERE token=$3`
+	result, err := db.dbx.ExecContext(db.context(), query, token, expiresAt, refreshToken)
+	if err != nil {
+		return err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if inserted == 0 {
+		return errors.New("unknown refresh token")
+	}
+	return nil
+}
+
+func (db postgresDB) InsertAPNSToken(userID int64, token string, client model.ClientRecord) error {
+	const query = `
+	INSERT INTO user_apns_tokens (user_id, token, platform, app_version, device_model) VALUES ($1, $2, $3, $4, $5)`
+	_, err := db.dbx.ExecContext(db.context(), query, userID, token, client.Platform, client.AppVersion, client.DeviceModel)
+	return err
+}
+
+func (db postgresDB) InsertFCMToken(userID int64, token string, client model.ClientRecord) error {
+	const query = `
+	INSERT INTO user_fcm_tokens (user_id, token, platform, app_version, device_model) VALUES ($1, $2, $3, $4, $5)`
+	_, err := db.dbx.ExecContext(db.context(), query, userID, token, client.Platform, client.AppVersion, client.DeviceModel)
+	return err
+}
+
+// queryRower is implemented by both the database and its transactions
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func (db postgresDB) InsertMessage(recipientID, senderID int64, cipherText, nonce []byte, sentDate int64) (int64, error) {
+	return db.insertMessage(db.dbx, model.MessageRecord{
+		RecipientID: recipientID,
+		SenderID:    senderID,
+		CipherText:  cipherText,
+		Nonce:       nonce,
+		SentDate:    sentDate,
+	})
+}
+
+// InsertSealedMessage stores a message whose envelope has been sealed to the
+// recipient's public key. Only the recipient is recorded in the clear.
+func (db postgresDB) InsertSealedMessage(recipientID int64, sealedEnvelope, nonce []byte) (int64, error) {
+	return db.insertMessage(db.dbx, model.MessageRecord{
+		RecipientID: recipientID,
+		CipherText:  sealedEnvelope,
+		Nonce:       nonce,
+		Sealed:      true,
+	})
+}
+
+func (db postgresDB) insertMessage(qr queryRower, msg model.MessageRecord) (int64, error) {
+	if msg.Sealed {
+		msg.SenderID = 0
+		msg.SentDate = 0
+		msg.System = false
+	}
+	insertSQL := `
+	INSERT INTO messages (recipient_id, sender_id, cipher_text, nonce, sent_date, sealed, system, urgent)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`
+	var msgID int64
+	err := qr.QueryRowContext(db.context(), insertSQL, msg.RecipientID, msg.SenderID, msg.CipherText, msg.Nonce, msg.SentDate, msg.Sealed, msg.System, msg.Urgent).Scan(&msgID)
+	if err != nil {
+		return 0, errors.Wrap(err, "SQL insert exec failed")
+	}
+
+	return msgID, nil
+}
+
+func (db postgresDB) InsertMessageWithOutbox(msg model.MessageRecord, entry model.OutboxRecord, maxQueued int64) (int64, int64, int64, error) {
+	tx, err := db.dbx.BeginTx(db.context(), nil)
+	if err != nil {
+		return 0, 0, 0, errors.Wrap(err, "unable to start a transaction")
+	}
+	defer tx.Rollback()
+
+	var evictedID int64
+	if maxQueued > 0 {
+		evictedID, err = db.makeRoomForMessage(tx, msg, maxQueued)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	msgID, err := db.insertMessage(tx, msg)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	insertSQL := `
+	INSERT INTO outbox (recipient_id, message_id, payload, urgent, next_attempt)
+	VALUES ($1, $2, $3, $4, $5) RETURNING id`
+	var entryID int64
+	err = tx.QueryRowContext(db.context(), insertSQL, entry.RecipientID, msgID, entry.Payload, entry.Urgent, entry.NextAttempt).Scan(&entryID)
+	if err != nil {
+		return 0, 0, 0, errors.Wrap(err, "unable to insert outbox entry")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, 0, 0, errors.Wrap(err, "failed to commit transaction")
+	}
+	return msgID, entryID, evictedID, nil
+}
+
+// makeRoomForMessage evicts the oldest message of the recipient that isn't
+// urgent when the recipient has maxQueued messages and msg is urgent. It
+// returns the id of the evicted message, or 0 if there was room. The
+// recipient's user row is locked first so concurrent senders can't both
+// take the last slot.
+func (db postgresDB) makeRoomForMessage(tx *sql.Tx, msg model.MessageRecord, maxQueued int64) (int64, error) {
+	_, err := tx.ExecContext(db.context(), "SELECT id FROM users WHERE id=$1 FOR UPDATE", msg.RecipientID)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to lock recipient")
+	}
+	var queued int64
+	err = tx.QueryRowContext(db.context(), "SELECT COUNT(*) FROM messages WHERE recipient_id=$1", msg.RecipientID).Scan(&queued)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to count queued messages")
+	}
+	if queued < maxQueued {
+		return 0, nil
+	}
+	if !msg.Urgent {
+		return 0, model.ErrQueueFull
+	}
+
+	const evictSQL = `
+	DELETE FROM messages WHERE id=(SELECT id FROM messages WHERE recipient_id=$1 AND NOT urgent ORDER BY id LIMIT 1)
+	RETURNING id`
+	var evictedID int64
+	err = tx.QueryRowContext(db.context(), evictSQL, msg.RecipientID).Scan(&evictedID)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return 0, model.ErrQueueFull
+	default:
+		return 0, errors.Wrap(err, "unable to evict message")
+	}
+	if _, err = tx.ExecContext(db.context(), "DELETE FROM outbox WHERE message_id=$1", evictedID); err != nil {
+		return 0, errors.Wrap(err, "unable to delete outbox entry of evicted message")
+	}
+
+	return evictedID, nil
+}
+
+// ClaimOutboxEntries claims the entries in a single statement. Entries
+// being claimed by another instance are skipped rather than waited for, so
+// the instances claim different entries.
+func (db postgresDB) ClaimOutboxEntries(now, leaseUntil int64, limit int) ([]model.OutboxRecord, error) {
+	const claimSQL = `
+	UPDATE outbox SET attempts=attempts+1, next_attempt=$2
+	WHERE id IN (SELECT id FROM outbox WHERE next_attempt<=$1 ORDER BY id LIMIT $3 FOR UPDATE SKIP LOCKED)
+	RETURNING id, recipient_id, message_id, payload, urgent, attempts, next_attempt`
+	entries := make([]model.OutboxRecord, 0)
+	if err := db.dbx.SelectContext(db.context(), &entries, claimSQL, now, leaseUntil, limit); err != nil {
+		return nil, errors.Wrap(err, "unable to claim outbox entries")
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries, nil
+}
+
+func (db postgresDB) DeleteOutboxEntry(id int64) error {
+	_, err := db.dbx.ExecContext(db.context(), "DELETE FROM outbox WHERE id=$1", id)
+	if err != nil {
+		return errors.Wrap(err, "unable to delete outbox entry")
+	}
+	return nil
+}
+
+func (db postgresDB) OutboxSize() (int64, error) {
+	var n int64
+	err := db.dbx.QueryRowContext(db.context(), "SELECT COUNT(*) FROM outbox").Scan(&n)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to count outbox entries")
+	}
+	return n, nil
+}
+
+func (db postgresDB) OutboxEntries(afterID int64, limit int) ([]model.OutboxRecord, error) {
+	const selectSQL = `
+	SELECT id, recipient_id, message_id, payload, urgent, attempts, next_attempt
+	FROM outbox WHERE id>$1 ORDER BY id LIMIT $2`
+	entries := make([]model.OutboxRecord, 0)
+	if err := db.dbx.SelectContext(db.context(), &entries, selectSQL, afterID, limit); err != nil {
+		return nil, errors.Wrap(err, "unable to select outbox entries")
+	}
+	return entries, nil
+}
+
+func (db postgresDB) UpdateOutboxPayload(id int64, payload []byte) error {
+	_, err := db.dbx.ExecContext(db.context(), "UPDATE outbox SET payload=$1 WHERE id=$2", payload, id)
+	if err != nil {
+		return errors.Wrap(err, "unable to update outbox entry")
+	}
+	return nil
+}
+
+func (db postgresDB) InsertSessionChallenge(userID int64, creationDate int64, challenge []byte) error {
+	insertSQL := `
+	INSERT INTO session_challenges (user_id, creation_date, challenge) VALUES ($1, $2, $3)`
+	_, err := db.dbx.ExecContext(db.context(), insertSQL, userID, creationDate, challenge)
+	if err != nil {
+		return errors.Wrap(err, "Unable to insert session challenge")
+	}
+
+	return nil
+}
+
+func (db postgresDB) InsertTicket(ticket string, userID int64, scopes string) error {
+	_, err := db.dbx.ExecContext(db.context(), "INSERT INTO tickets (ticket, user_id, scopes) VALUES ($1, $2, $3)", ticket, userID, scopes)
+	return err
+}
+
+func (db postgresDB) InsertUser(user model.UserRecord, verificationToken *string) (int64, error) {
+	// we don't insert the email, because it only gets inserted upon verification
+	insertSQL := `
+	INSERT INTO users (	username,
+						password_salt,
+						password_hash_algorithm,
+						password_hash_operations_limit,
+						password_hash_memory_limit,
+		 				public_key,
+						wrapped_secret_key,
+						wrapped_secret_key_nonce,
+						wrapped_symmetric_key,
+						wrapped_symmetric_key_nonce,
+						username_index,
+						locale,
+						created_at)
+						VALUES (:username,
+								:password_salt,
+								:password_hash_algorithm,
+								:password_hash_operations_limit,
+								:password_hash_memory_limit,
+								:public_key,
+								:wrapped_secret_key,
+								:wrapped_secret_key_nonce,
+								:wrapped_symmetric_key,
+								:wrapped_symmetric_key_nonce,
+								:username_index,
+								:locale,
+								:created_at)
+						RETURNING id`
+	tx, err := db.dbx.BeginTxx(db.context(), nil)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to start transaction")
+	}
+	defer tx.Rollback()
+
+	query, args, err := tx.BindNamed(insertSQL, user)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to bind the user record")
+	}
+	var userID int64
+	if err = tx.QueryRowxContext(db.context(), query, args...).Scan(&userID); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation && pgErr.ConstraintName == "users_username_unique_constraint" {
+			return 0, model.ErrDuplicateUsername
+		}
+		return 0, errors.Wrap(err, "failed to insert user into table")
+	}
+
+	// if there is a verification token, create a record for that as well
+	if verificationToken != nil && user.Email != nil {
+		insertSQL = `INSERT INTO email_verification_tokens (user_id, token, email, send_date) VALUES ($1, $2, $3, $4)`
+		_, err = tx.ExecContext(db.context(), insertSQL, userID, *verificationToken, user.Email, time.Now().Unix())
+		if err != nil {
+			return 0, errors.Wrap(err, "unable to insert verification token")
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, errors.Wrap(err, "failed to commit tx")
+	}
+
+	return userID, nil
+}
+
+func (db postgresDB) LimitedUserInfo(username string) (id int64, pubKey []byte, err error) {
+	err = db.dbx.QueryRowContext(db.context(), "SELECT id, public_key FROM users WHERE username=$1", username).Scan(&id, &pubKey)
+	switch err {
+	case nil:
+		return id, pubKey, nil
+	case sql.ErrNoRows:
+		return 0, nil, nil
+	default:
+		return 0, nil, err
+	}
+}
+
+// LimitedUserInfoIndex looks up a user by the blind index of their username
+func (db postgresDB) LimitedUserInfoIndex(index []byte) (id int64, username string, pubKey []byte, err error) {
+	err = db.dbx.QueryRowContext(db.context(), "SELECT id, username, public_key FROM users WHERE username_index=$1", index).Scan(&id, &username, &pubKey)
+	switch err {
+	case nil:
+		return id, username, pubKey, nil
+	case sql.ErrNoRows:
+		return 0, "", nil, nil
+	default:
+		return 0, "", nil, err
+	}
+}
+
+func (db postgresDB) LimitedUserInfoID(userID int64) (username string, pubKey []byte, err error) {
+	err = db.dbx.QueryRowContext(db.context(), "SELECT username, public_key FROM users WHERE id=$1", userID).Scan(&username, &pubKey)
+	switch err {
+	case nil:
+		return username, pubKey, nil
+	case sql.ErrNoRows:
+		return "", nil, nil
+	default:
+		return "", nil, err
+	}
+}
+
+func (db postgresDB) EachMessageRecord(recipientID int64, fn func(model.MessageRecord) error) error {
+	selectSQL := `
+	SELECT id, recipient_id, sender_id, cipher_text, nonce, sent_date, sealed, system, urgent FROM messages WHERE recipient_id=$1 ORDER BY id`
+	rows, err := db.dbx.QueryxContext(db.context(), selectSQL, recipientID)
+	if err != nil {
+		return errors.Wrap(err, "unable to execute select on messages table")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		msg := model.MessageRecord{}
+		if err = rows.StructScan(&msg); err != nil {
+			return errors.Wrap(err, "unable to scan a row")
+		}
+		if err = fn(msg); err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Wrap(err, "unable to read the messages")
+	}
+
+	return nil
+}
+
+func (db postgresDB) MessageRecords(recipientID int64) ([]model.MessageRecord, error) {
+	selectSQL := `
+	SELECT id, recipient_id, sender_id, cipher_text, nonce, sent_date, sealed, system, urgent FROM messages WHERE recipient_id=$1 ORDER BY id`
+	msgs := make([]model.MessageRecord, 0)
+	if err := db.dbx.SelectContext(db.context(), &msgs, selectSQL, recipientID); err != nil {
+		return nil, errors.Wrap(err, "unable to execute select on messages table")
+	}
+
+	return msgs, nil
+}
+
+func (db postgresDB) MessageToRecipient(recipientID, msgID int64) (*model.MessageRecord, error) {
+	selectSQL := `
+	SELECT id, recipient_id, sender_id, cipher_text, nonce, sent_date, sealed, system, urgent FROM messages WHERE recipient_id=$1 AND id=$2`
+	msg := model.MessageRecord{}
+	err := db.dbx.GetContext(db.context(), &msg, selectSQL, recipientID, msgID)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, errors.Wrap(err, "selecting message failed")
+	}
+
+	return &msg, nil
+}
+
+// MessagesToRecipient returns the messages of recipientID among msgIDs, in
+// order of id. Ids of missing messages, or messages belonging to another
+// user, are skipped.
+func (db postgresDB) MessagesToRecipient(recipientID int64, msgIDs []int64) ([]model.MessageRecord, error) {
+	msgs := make([]model.MessageRecord, 0, len(msgIDs))
+	if len(msgIDs) == 0 {
+		return msgs, nil
+	}
+	const selectSQL = `
+	SELECT id, recipient_id, sender_id, cipher_text, nonce, sent_date, sealed, system, urgent
+	FROM messages WHERE recipient_id=$1 AND id=ANY($2) ORDER BY id`
+	if err := db.dbx.SelectContext(db.context(), &msgs, selectSQL, recipientID, msgIDs); err != nil {
+		return nil, errors.Wrap(err, "selecting messages failed")
+	}
+
+	return msgs, nil
+}
+
+func (db postgresDB) RefreshToken(token string) (*model.RefreshTokenRecord, error) {
+	const query = `
+	SELECT id, user_id, expires_at, platform, app_version, device_model, created_at, last_used, user_agent, ip_prefix
+	FROM refresh_tokens WHERE token=$1`
+	rtr := model.RefreshTokenRecord{Token: token}
+	err := db.dbx.QueryRowxContext(db.context(), query, token).StructScan(&rtr)
+	switch err {
+	case nil:
+		return &rtr, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+func (db postgresDB) RotateRefreshToken(old, new string, expiresAt int64) (bool, error) {
+	tx, err := db.dbx.BeginTx(db.context(), nil)
+	if err != nil {
+		return false, errors.Wrap(err, "unable to start a transaction")
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(db.context(), `UPDATE refresh_tokens SET token=$1, expires_at=$2 WHERE token=$3`, new, expiresAt, old)
+	if err != nil {
+		return false, errors.Wrap(err, "unable to update the refresh token")
+	}
+	rotated, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "unable to count updated refresh tokens")
+	}
+	if rotated == 0 {
+		return false, nil
+	}
+	_, err = tx.ExecContext(db.context(), `UPDATE sessions SET refresh_token=$1 WHERE refresh_token=$2`, new, old)
+	if err != nil {
+		return false, errors.Wrap(err, "unable to update access tokens of the refresh token")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return false, errors.Wrap(err, "failed to commit transaction")
+	}
+	return true, nil
+}
+
+func (db postgresDB) ReplaceAPNSToken(old, new string) (rowsAffected int64, err error) {
+	const query = `UPDATE user_apns_tokens SET token=$1 WHERE token=$2`
+	var result sql.Result
+	result, err = db.dbx.ExecContext(db.context(), query, new, old)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to execute update query")
+	}
+	rowsAffected, err = result.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "Failure trying to get affected rows count")
+	}
+	return rowsAffected, nil
+}
+
+func (db postgresDB) ReplaceFCMToken(old, new string) (rowsAffected int64, err error) {
+	const query = `UPDATE user_fcm_tokens SET token=$1 WHERE token=$2`
+	var result sql.Result
+	result, err = db.dbx.ExecContext(db.context(), query, new, old)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to execute update query")
+	}
+	rowsAffected, err = result.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "Failure trying to get affected rows count")
+	}
+	return rowsAffected, nil
+}
+
+func (db postgresDB) SessionChallenge(userID int64) (*model.SessionChallengeRecord, error) {
+	const challengeSQL = `
+	SELECT id, creation_date, challenge, used FROM session_challenges WHERE user_id=$1`
+	var challenge model.SessionChallengeRecord
+	err := db.dbx.QueryRowxContext(db.context(), challengeSQL, userID).StructScan(&challenge)
+	switch err {
+	case nil:
+		challenge.UserID = userID
+		return &challenge, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, errors.Wrap(err, "Unable to query for session challenge")
+	}
+}
+
+func (db postgresDB) SessionChallengeCount() (int64, error) {
+	var count int64
+	err := db.dbx.QueryRowContext(db.context(), "SELECT COUNT(*) FROM session_challenges").Scan(&count)
+	return count, err
+}
+
+// Sessions returns the user's sessions that are still active at now, the
+// ones used last first
+func (db postgresDB) Sessions(userID, now int64) ([]model.RefreshTokenRecord, error) {
+	const query = `
+	SELECT id, token, user_id, expires_at, platform, app_version, device_model, created_at, last_used, user_agent, ip_prefix
+	FROM refresh_tokens WHERE user_id=$1 AND expires_at>=$2 ORDER BY last_used DESC, id DESC`
+	sessions := make([]model.RefreshTokenRecord, 0)
+	if err := db.dbx.SelectContext(db.context(), &sessions, query, userID, now); err != nil {
+		return nil, errors.Wrap(err, "failed to select sessions")
+	}
+	return sessions, nil
+}
+
+func (db postgresDB) Ticket(ticket string) (*model.TicketRecord, error) {
+	const query = `
+	SELECT t.user_id, t.timestamp, t.scopes, COALESCE(u.status, '') AS status,
+		COALESCE(u.suspended_until, 0) AS suspended_until, COALESCE(u.status_reason, '') AS status_reason
+	FROM tickets t LEFT JOIN users u ON u.id=t.user_id
+	WHERE t.ticket=$1`
+	tr := model.TicketRecord{}
+	err := db.dbx.GetContext(db.context(), &tr, query, ticket)
+	switch err {
+	case nil:
+		return &tr, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+func (db postgresDB) TouchSession(refreshToken string, lastUsed int64) error {
+	const query = `UPDATE refresh_tokens SET last_used=$1 WHERE token=$2`
+	_, err := db.dbx.ExecContext(db.context(), query, lastUsed, refreshToken)
+	return err
+}
+
+func (db postgresDB) UseSessionChallenge(id int64) (bool, error) {
+	result, err := db.dbx.ExecContext(db.context(), "UPDATE session_challenges SET used=TRUE WHERE id=$1 AND NOT used", id)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected == 1, err
+}
+
+func (db postgresDB) UpdateUserIDOfAPNSToken(newUserID int64, token string, client model.ClientRecord) error {
+	const query = `UPDATE user_apns_tokens SET user_id=$1, platform=$2, app_version=$3, device_model=$4 WHERE token=$5`
+	_, err := db.dbx.ExecContext(db.context(), query, newUserID, client.Platform, client.AppVersion, client.DeviceModel, token)
+	return err
+}
+
+func (db postgresDB) UpdateUserIDOfFCMToken(newUserID int64, token string, client model.ClientRecord) error {
+	const query = `UPDATE user_fcm_tokens SET user_id=$1, platform=$2, app_version=$3, device_model=$4 WHERE token=$5`
+	_, err := db.dbx.ExecContext(db.context(), query, newUserID, client.Platform, client.AppVersion, client.DeviceModel, token)
+	return err
+}
+
+// UsernamesWithoutIndex returns the usernames, keyed by user id, of users
+// whose username_index hasn't been set
+func (db postgresDB) UsernamesWithoutIndex() (map[int64]string, error) {
+	rows, err := db.dbx.QueryContext(db.context(), "SELECT id, username FROM users WHERE username_index IS NULL")
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to select users without a username index")
+	}
+	defer rows.Close()
+
+	usernames := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var username string
+		if err = rows.Scan(&id, &username); err != nil {
+			return nil, errors.Wrap(err, "unable to scan a row")
+		}
+		usernames[id] = username
+	}
+
+	return usernames, rows.Err()
+}
+
+// UsersWithIndexPrefix returns up to limit users whose username_index
+// starts with prefix
+func (db postgresDB) UsersWithIndexPrefix(prefix []byte, limit int) ([]model.UserIndexRecord, error) {
+	// bytea compares byte by byte, so a range query over the prefix can use
+	// the index on username_index
+	query := "SELECT id, public_key, username_index FROM users WHERE username_index >= $1"
+	args := []interface{}{prefix}
+	if upper := prefixUpperBound(prefix); upper != nil {
+		query += " AND username_index < $2"
+		args = append(args, upper)
+	}
+	args = append(args, limit)
+	query += " ORDER BY username_index LIMIT $" + strconv.Itoa(len(args))
+
+	users := make([]model.UserIndexRecord, 0)
+	if err := db.dbx.SelectContext(db.context(), &users, query, args...); err != nil {
+		return nil, errors.Wrap(err, "unable to select users by index prefix")
+	}
+
+	return users, nil
+}
+
+// prefixUpperBound returns the smallest value greater than every value that
+// starts with prefix, or nil if there isn't one (i.e. prefix is all 0xff).
+func prefixUpperBound(prefix []byte) []byte {
+	upper := append([]byte{}, prefix...)
+	for i := len(upper) - 1; i >= 0; i-- {
+		if upper[i] < 0xff {
+			upper[i]++
+			return upper[:i+1]
+		}
+	}
+	return nil
+}
+
+func (db postgresDB) SetUsernameIndex(userID int64, index []byte) error {
+	_, err := db.dbx.ExecContext(db.context(), "UPDATE users SET username_index=$1 WHERE id=$2", index, userID)
+	return err
+}
+
+// SetUserLocale sets the locale that emails to the user are written in
+func (db postgresDB) SetUserLocale(userID int64, locale string) error {
+	_, err := db.dbx.ExecContext(db.context(), "UPDATE users SET locale=$1 WHERE id=$2", locale, userID)
+	return err
+}
+
+func (db postgresDB) SetUserStatus(userID int64, status model.UserStatusRecord) (bool, error) {
+	const query = `UPDATE users SET status=$1, suspended_until=$2, status_reason=$3 WHERE id=$4`
+	result, err := db.dbx.ExecContext(db.context(), query, status.Status, status.SuspendedUntil, status.StatusReason, userID)
+	if err != nil {
+		return false, errors.Wrap(err, "unable to set user status")
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (db postgresDB) User(username string) (*model.UserRecord, error) {
+	query := `
+	SELECT 	id,
+			username,
+			public_key,
+			wrapped_secret_key,
+			wrapped_secret_key_nonce,
+			wrapped_symmetric_key,
+			wrapped_symmetric_key_nonce,
+			password_salt,
+			password_hash_algorithm,
+			password_hash_operations_limit,
+			password_hash_memory_limit,
+			email,
+			locale,
+			undeliverable_email,
+			created_at,
+			status,
+			suspended_until,
+			status_reason
+	FROM users WHERE username=$1`
+	user := model.UserRecord{}
+	err := db.dbx.GetContext(db.context(), &user, query, username)
+	switch err {
+	case nil:
+		return &user, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+func (db postgresDB) UserDataSummary(userID, now int64) (*model.UserDataSummary, error) {
+	const query = `
+	SELECT	(SELECT COUNT(*) FROM messages WHERE recipient_id=$1) AS pending_messages,
+			(SELECT COALESCE(SUM(OCTET_LENGTH(cipher_text)), 0)::BIGINT FROM messages WHERE recipient_id=$1) AS pending_message_bytes,
+			(SELECT COUNT(*) FROM user_apns_tokens WHERE user_id=$1) AS apns_tokens,
+			(SELECT COUNT(*) FROM user_fcm_tokens WHERE user_id=$1) AS fcm_tokens,
+			(SELECT COUNT(*) FROM sessions WHERE user_id=$1 AND expires_at>=$2) AS active_sessions`
+	summary := model.UserDataSummary{}
+	err := db.dbx.GetContext(db.context(), &summary, query, userID, now)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to summarize user data")
+	}
+
+	return &summary, nil
+}
+
+func (db postgresDB) Username(userID int64) string {
+	var username sql.NullString
+	err := db.dbx.QueryRowContext(db.context(), "SELECT username FROM users WHERE id=$1", userID).Scan(&username)
+	if err != nil {
+		return ""
+	}
+	return username.String
+}
+
+func (db postgresDB) RecentUsers(beforeID int64, limit int) ([]model.UserRecord, error) {
+	query := `SELECT id, username, email, locale, created_at, status, suspended_until, status_reason FROM users`
+	args := []interface{}{}
+	if beforeID > 0 {
+		query += " WHERE id<$1"
+		args = append(args, beforeID)
+	}
+	args = append(args, limit)
+	query += " ORDER BY id DESC LIMIT $" + strconv.Itoa(len(args))
+
+	users := make([]model.UserRecord, 0)
+	if err := db.dbx.SelectContext(db.context(), &users, query, args...); err != nil {
+		return nil, errors.Wrap(err, "unable to select recent users")
+	}
+	return users, nil
+}
+
+// ReserveUsernames keeps usernames from being registered, unless the user
+// signs up with email. An empty email reserves them for nobody. Existing
+// reservations of the usernames are replaced.
+func (db postgresDB) ReserveUsernames(usernames []string, email, note string) error {
+	tx, err := db.dbx.BeginTx(db.context(), nil)
+	if err != nil {
+		return errors.Wrap(err, "unable to start a transaction")
+	}
+	defer tx.Rollback()
+
+	const reserveSQL = `
+	INSERT INTO reserved_usernames (username, email, note) VALUES ($1, $2, $3)
+	ON CONFLICT (username) DO UPDATE SET email=EXCLUDED.email, note=EXCLUDED.note, created_at=EXCLUDED.created_at`
+	for _, username := range usernames {
+		if _, err = tx.ExecContext(db.context(), reserveSQL, username, email, note); err != nil {
+			return errors.Wrapf(err, "unable to reserve '%s'", username)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errors.Wrap(err, "failed to commit transaction")
+	}
+	return nil
+}
+
+func (db postgresDB) ReservedUsername(username string) (*model.ReservedUsernameRecord, error) {
+	const query = `SELECT username, email, note, created_at FROM reserved_usernames WHERE username=$1`
+	rec := model.ReservedUsernameRecord{}
+	err := db.dbx.GetContext(db.context(), &rec, query, username)
+	switch err {
+	case nil:
+		return &rec, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, errors.Wrap(err, "failed to select reserved username")
+	}
+}
+
+func (db postgresDB) ReservedUsernames() ([]model.ReservedUsernameRecord, error) {
+	const query = `SELECT username, email, note, created_at FROM reserved_usernames ORDER BY username`
+	recs := make([]model.ReservedUsernameRecord, 0)
+	err := db.dbx.SelectContext(db.context(), &recs, query)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to select reserved usernames")
+	}
+	return recs, nil
+}
+
+func (db postgresDB) DeleteReservedUsername(username string) (bool, error) {
+	result, err := db.dbx.ExecContext(db.context(), "DELETE FROM reserved_usernames WHERE username=$1", username)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to delete reserved username")
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (db postgresDB) UsernameAvailable(username string) (bool, error) {
+	checkUsernameSQL := "SELECT id FROM users WHERE username=$1"
+	var foundID int64
+	err := db.dbx.QueryRowContext(db.context(), checkUsernameSQL, username).Scan(&foundID)
+	switch err {
+	case nil:
+		return false, nil
+	case sql.ErrNoRows:
+		return true, nil
+	default:
+		return false, errors.Wrap(err, "error checking if username is available")
+	}
+}
+
+func (db postgresDB) UserPublicKey(userID int64) ([]byte, error) {
+	selectSQL := `SELECT public_key FROM users WHERE id=$1`
+	var pubKey []byte
+	err := db.dbx.QueryRowContext(db.context(), selectSQL, userID).Scan(&pubKey)
+	switch err {
+	case nil:
+		return pubKey, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, errors.Wrap(err, "unable to select user's public key")
+	}
+}
+
+// SuppressEmail stops email from being sent to, and removes it from the
+// users that verified it, along with any pending verifications of it. The
+// users keep it as their undeliverable email until they verify another. It
+// returns the number of users the address was removed from.
+func (db postgresDB) SuppressEmail(email, reason string) (int64, error) {
+	tx, err := db.dbx.BeginTx(db.context(), nil)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to start a transaction")
+	}
+	defer tx.Rollback()
+
+	const suppressSQL = `
+	INSERT INTO suppressed_emails (email, reason) VALUES ($1, $2)
+	ON CONFLICT (email) DO UPDATE SET reason=EXCLUDED.reason, created_at=EXCLUDED.created_at`
+	if _, err = tx.ExecContext(db.context(), suppressSQL, email, reason); err != nil {
+		return 0, errors.Wrap(err, "unable to insert suppressed email")
+	}
+	result, err := tx.ExecContext(db.context(), `UPDATE users SET undeliverable_email=email, email=NULL WHERE email=$1`, email)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to update users table")
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to count updated users")
+	}
+	_, err = tx.ExecContext(db.context(), `DELETE FROM email_verification_tokens WHERE email=$1`, email)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to delete verification tokens")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, errors.Wrap(err, "failed to commit transaction")
+	}
+	return affected, nil
+}
+
+// EmailSuppressed returns true if email was suppressed by SuppressEmail
+func (db postgresDB) EmailSuppressed(email string) (bool, error) {
+	var found string
+	err := db.dbx.QueryRowContext(db.context(), "SELECT email FROM suppressed_emails WHERE email=$1", email).Scan(&found)
+	switch err {
+	case nil:
+		return true, nil
+	case sql.ErrNoRows:
+		return false, nil
+	default:
+		return false, errors.Wrap(err, "error checking if email is suppressed")
+	}
+}
+
+// InsertAuditLogEntry records an action taken by actor
+func (db postgresDB) InsertAuditLogEntry(actor, action, details string) error {
+	_, err := db.dbx.ExecContext(db.context(), "INSERT INTO audit_log (actor, action, details) VALUES ($1, $2, $3)", actor, action, details)
+	if err != nil {
+		return errors.Wrap(err, "failed to insert audit log entry")
+	}
+	return nil
+}
+
+func (db postgresDB) VerifyEmail(email string, userID int64) error {
+	tx, err := db.dbx.BeginTx(db.context(), nil)
+	if err != nil {
+		return errors.Wrap(err, "unable to start a transaction")
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(db.context(), `UPDATE users SET email=$1, undeliverable_email=NULL WHERE id=$2`, email, userID)
+	if err != nil {
+		return errors.Wrap(err, "unable to update users table")
+	}
+	_, err = tx.ExecContext(db.context(), `DELETE FROM email_verification_tokens WHERE user_id=$1`, userID)
+	if err != nil {
+		return errors.Wrap(err, "unable to delete verification token from table")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "failed to commit transaction")
+	}
+
+	return nil
+}
@@ -0,0 +1,299 @@
+package postgres
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/model"
+)
+
+var dsnArg = flag.String("dsn", "", "Connection string of a disposable postgres database. Its tables are emptied by the tests.")
+
+func newDB(t *testing.T) postgresDB {
+	t.Helper()
+	if *dsnArg == "" {
+		t.Skip("No postgres dsn provided")
+	}
+
+	db, err := New(*dsnArg, 2)
+	require.NoError(t, err)
+	_, err = db.(postgresDB).dbx.Exec(`TRUNCATE email_verification_tokens, messages, session_challenges,
+		user_apns_tokens, user_fcm_tokens, users, tickets, sessions, email_events, suppressed_emails,
+		audit_log, reserved_usernames, outbox, refresh_tokens RESTART IDENTITY`)
+	require.NoError(t, err)
+	return db.(postgresDB)
+}
+
+func TestMigrateTwice(t *testing.T) {
+	db := newDB(t)
+	defer db.dbx.Close()
+
+	again, err := New(*dsnArg, 1)
+	require.NoError(t, err)
+	defer again.(postgresDB).dbx.Close()
+	var ver int
+	require.NoError(t, db.dbx.Get(&ver, "SELECT version FROM schema_version"))
+	require.Equal(t, len(migrations), ver)
+}
+
+func TestInsertUser(t *testing.T) {
+	db := newDB(t)
+	defer db.dbx.Close()
+	u := model.UserRecord{
+		PasswordHashAlgorithm:       "argon2id13",
+		PasswordHashMemoryLimit:     32768,
+		PasswordHashOperationsLimit: 6,
+		PasswordSalt:                []byte("password-salt"),
+		PublicKey:                   []byte("public-key"),
+		WrappedSecretKey:            []byte("wrapped-secret-key"),
+		WrappedSecretKeyNonce:       []byte("wrapped-secret-key-nonce"),
+		WrappedSymmetricKey:         []byte("wrapped-symmetric-ket"),
+		WrappedSymmetricKeyNonce:    []byte("wrapped-symmetric-key-nonce"),
+		Username:                    "alice",
+		Locale:                      "en-gb",
+	}
+	var err error
+	u.ID, err = db.InsertUser(u, nil)
+	require.NoError(t, err)
+	require.Greater(t, u.ID, int64(0))
+
+	_, err = db.InsertUser(u, nil)
+	require.Equal(t, model.ErrDuplicateUsername, err)
+
+	actual, err := db.User(u.Username)
+	require.NoError(t, err)
+	require.Equal(t, u, *actual)
+	actual, err = db.User("eve")
+	require.NoError(t, err)
+	require.Nil(t, actual)
+}
+
+func TestMessagesToRecipient(t *testing.T) {
+	db := newDB(t)
+	defer db.dbx.Close()
+
+	var ids []int64
+	for _, recipientID := range []int64{2, 2, 3} {
+		id, err := db.InsertMessage(recipientID, 4, []byte("cipher-text"), []byte("nonce"), 19495478)
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+
+	msgs, err := db.MessagesToRecipient(2, []int64{ids[2], ids[1], ids[0], 5000})
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	require.Equal(t, ids[0], msgs[0].ID)
+	require.Equal(t, ids[1], msgs[1].ID)
+
+	deleted, err := db.DeleteMessagesToRecipient(2, ids)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), deleted)
+	msgs, err = db.MessageRecords(3)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+}
+
+func TestUserDataSummary(t *testing.T) {
+	db := newDB(t)
+	defer db.dbx.Close()
+
+	_, err := db.InsertMessage(7, 8, []byte("12345"), []byte("nonce"), 1)
+	require.NoError(t, err)
+	_, err = db.InsertSealedMessage(7, []byte("123"), []byte("nonce"))
+	require.NoError(t, err)
+	require.NoError(t, db.InsertAPNSToken(7, "apns-summary-token", model.ClientRecord{}))
+	require.NoError(t, db.InsertAccessToken("summary-active", 7, 1000, model.ClientRecord{}))
+	require.NoError(t, db.InsertAccessToken("summary-expired", 7, 999, model.ClientRecord{}))
+
+	summary, err := db.UserDataSummary(7, 1000)
+	require.NoError(t, err)
+	require.Equal(t, model.UserDataSummary{
+		PendingMessages:     2,
+		PendingMessageBytes: 8,
+		APNSTokens:          1,
+		ActiveSessions:      1,
+	}, *summary)
+}
+
+func TestClientCounts(t *testing.T) {
+	db := newDB(t)
+	defer db.dbx.Close()
+
+	android := model.ClientRecord{Platform: "android", AppVersion: "1.4.2", DeviceModel: "Pixel 4a"}
+	require.NoError(t, db.InsertAccessToken("expired", 1, 999, android))
+	require.NoError(t, db.InsertAccessToken("older", 1, 1500, model.ClientRecord{}))
+	require.NoError(t, db.InsertAccessToken("newer", 1, 2000, android))
+	require.NoError(t, db.InsertFCMToken(1, "fcm-token", android))
+
+	counts, err := db.ClientCounts(1000)
+	require.NoError(t, err)
+	require.Equal(t, []model.ClientCountRecord{
+		{Platform: "", AppVersion: "", Sessions: 1, PushTokens: 0},
+		{Platform: "android", AppVersion: "1.4.2", Sessions: 1, PushTokens: 1},
+	}, counts)
+}
+
+func TestSessions(t *testing.T) {
+	db := newDB(t)
+	defer db.dbx.Close()
+
+	ios := model.ClientRecord{Platform: "ios", AppVersion: "2.1", DeviceModel: "iPhone12,1"}
+	newer := model.RefreshTokenRecord{Token: "newer", UserID: 1, ExpiresAt: 1500, ClientRecord: ios,
+		CreatedAt: 100, LastUsed: 900, UserAgent: "Oscar/2.1", IPPrefix: "203.0.113.0/24"}
+	for _, rtr := range []model.RefreshTokenRecord{
+		{Token: "expired", UserID: 1, ExpiresAt: 999, ClientRecord: ios, LastUsed: 950},
+		{Token: "older", UserID: 1, ExpiresAt: 2000, LastUsed: 500},
+		newer,
+		{Token: "other-user", UserID: 2, ExpiresAt: 2000, ClientRecord: ios},
+	} {
+		require.NoError(t, db.InsertRefreshToken(rtr))
+	}
+	require.NoError(t, db.InsertRefreshedAccessToken("newer-access", "newer", 1500))
+
+	sessions, err := db.Sessions(1, 1000)
+	require.NoError(t, err)
+	newer.ID = 3
+	require.Equal(t, []model.RefreshTokenRecord{
+		newer,
+		{ID: 2, Token: "older", UserID: 1, ExpiresAt: 2000, LastUsed: 500},
+	}, sessions)
+
+	require.NoError(t, db.TouchSession("older", 1000))
+	atr, err := db.AccessToken("newer-access")
+	require.NoError(t, err)
+	require.Equal(t, &model.AccessTokenRecord{Token: "newer-access", UserID: 1, ExpiresAt: 1500, ClientRecord: ios, RefreshToken: "newer", SessionLastUsed: 900}, atr)
+
+	deleted, err := db.DeleteSession(2, newer.ID)
+	require.NoError(t, err)
+	require.False(t, deleted)
+	deleted, err = db.DeleteSession(1, newer.ID)
+	require.NoError(t, err)
+	require.True(t, deleted)
+	atr, err = db.AccessToken("newer-access")
+	require.NoError(t, err)
+	require.Nil(t, atr)
+	sessions, err = db.Sessions(1, 1000)
+	require.NoError(t, err)
+	require.Equal(t, []string{"older"}, []string{sessions[0].Token})
+	require.Equal(t, int64(1000), sessions[0].LastUsed)
+}
+
+func TestReservedUsernames(t *testing.T) {
+	db := newDB(t)
+	defer db.dbx.Close()
+
+	require.NoError(t, db.ReserveUsernames([]string{"acmecorp", "acmehelp"}, "", "brand"))
+	// reserving again replaces the reservation
+	require.NoError(t, db.ReserveUsernames([]string{"acmehelp"}, "help@acme.example", ""))
+	rec, err := db.ReservedUsername("acmehelp")
+	require.NoError(t, err)
+	require.Equal(t, "help@acme.example", rec.Email)
+	require.NotZero(t, rec.CreatedAt)
+
+	deleted, err := db.DeleteReservedUsername("acmecorp")
+	require.NoError(t, err)
+	require.True(t, deleted)
+}
+
+func TestSessionChallenges(t *testing.T) {
+	db := newDB(t)
+	defer db.dbx.Close()
+
+	require.NoError(t, db.InsertSessionChallenge(5, 100, []byte("challenge")))
+	challenge, err := db.SessionChallenge(5)
+	require.NoError(t, err)
+	require.False(t, challenge.Used)
+	used, err := db.UseSessionChallenge(challenge.ID)
+	require.NoError(t, err)
+	require.True(t, used)
+	used, err = db.UseSessionChallenge(challenge.ID)
+	require.NoError(t, err)
+	require.False(t, used)
+}
+
+func TestOutbox(t *testing.T) {
+	db := newDB(t)
+	defer db.dbx.Close()
+
+	msg := model.MessageRecord{RecipientID: 2, SenderID: 3, CipherText: []byte("cipher-text"), Nonce: []byte("nonce"), SentDate: 19495478}
+	msgID, entryID, _, err := db.InsertMessageWithOutbox(msg, model.OutboxRecord{
+		RecipientID: msg.RecipientID,
+		Payload:     []byte("payload"),
+		Urgent:      true,
+		NextAttempt: 100,
+	}, 0)
+	require.NoError(t, err)
+
+	entries, err := db.ClaimOutboxEntries(99, 200, 10)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	entries, err = db.ClaimOutboxEntries(100, 200, 10)
+	require.NoError(t, err)
+	require.Equal(t, []model.OutboxRecord{{
+		ID:          entryID,
+		RecipientID: msg.RecipientID,
+		MessageID:   msgID,
+		Payload:     []byte("payload"),
+		Urgent:      true,
+		Attempts:    1,
+		NextAttempt: 200,
+	}}, entries)
+	// a claimed entry is held off until its lease runs out
+	entries, err = db.ClaimOutboxEntries(150, 300, 10)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	// listing includes the entries that aren't due
+	require.NoError(t, db.UpdateOutboxPayload(entryID, []byte("resealed")))
+	entries, err = db.OutboxEntries(0, 10)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, []byte("resealed"), entries[0].Payload)
+	entries, err = db.OutboxEntries(entryID, 10)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestQueueLimit(t *testing.T) {
+	db := newDB(t)
+	defer db.dbx.Close()
+
+	insert := func(urgent bool) (int64, int64, error) {
+		msg := model.MessageRecord{RecipientID: 2, SenderID: 3, CipherText: []byte("ct"), Nonce: []byte("nonce"), Urgent: urgent}
+		msgID, _, evictedID, err := db.InsertMessageWithOutbox(msg, model.OutboxRecord{RecipientID: 2, Payload: []byte("payload"), Urgent: urgent}, 2)
+		return msgID, evictedID, err
+	}
+	oldestID, _, err := insert(false)
+	require.NoError(t, err)
+	_, _, err = insert(false)
+	require.NoError(t, err)
+
+	_, _, err = insert(false)
+	require.Equal(t, model.ErrQueueFull, err)
+	_, evictedID, err := insert(true)
+	require.NoError(t, err)
+	require.Equal(t, oldestID, evictedID)
+	n, err := db.OutboxSize()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), n)
+}
+
+func TestEmailEvents(t *testing.T) {
+	db := newDB(t)
+	defer db.dbx.Close()
+
+	bounce := model.EmailEventRecord{ProviderID: "event-1", Event: "failed", Recipient: "alice@example.com", Timestamp: 1000}
+	require.NoError(t, db.InsertEmailEvent(bounce))
+	// webhooks that are retried are only recorded once
+	require.NoError(t, db.InsertEmailEvent(bounce))
+	events, err := db.EmailEvents(10)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+}
+
+func TestPrefixUpperBound(t *testing.T) {
+	require.Equal(t, []byte{1, 3}, prefixUpperBound([]byte{1, 2}))
+	require.Equal(t, []byte{2}, prefixUpperBound([]byte{1, 0xff}))
+	require.Nil(t, prefixUpperBound([]byte{0xff, 0xff}))
+}
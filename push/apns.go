@@ -0,0 +1,123 @@
+package push
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/sideshow/apns2"
+	"github.com/sideshow/apns2/token"
+)
+
+// apnsTopic is the bundle id of the app notifications are sent to
+const apnsTopic = "xyz.zood.michael"
+
+// maxAPNSPayloadSize is the largest payload APNS accepts
+const maxAPNSPayloadSize = 4096
+
+type apsPayload struct {
+	APS struct {
+		ContentAvailable int `json:"content-available"`
+	} `json:"aps"`
+	Data interface{} `json:"data"`
+}
+
+// apns delivers push notifications via the Apple Push Notification service
+type apns struct {
+	client *apns2.Client
+	// dryRun validates and logs notifications instead of sending them, since
+	// APNS has no way to validate without delivering
+	dryRun bool
+}
+
+// NewAPNS returns a Provider that pushes with the .p8 key at p8Path, to the
+// production or development environment of APNS
+func NewAPNS(p8Path, keyID, teamID string, production, dryRun bool) (Provider, error) {
+	key, err := token.AuthKeyFromFile(p8Path)
+	if err != nil {
+		return nil, err
+	}
+	client := apns2.NewTokenClient(&token.Token{
+		AuthKey: key,
+		KeyID:   keyID,
+		TeamID:  teamID,
+	})
+	if production {
+		client.Production()
+	} else {
+		client.Development()
+	}
+
+	return &apns{client: client, dryRun: dryRun}, nil
+}
+
+// Name fulfills Provider
+func (a *apns) Name() string {
+	return NameAPNS
+}
+
+// Send fulfills Provider. It sends payload as a background notification.
+// APNS doesn't accept its high priority of 10 for background pushes, so
+// PriorityHigh gets 5, and PriorityNormal gets 1, which never wakes the
+// device.
+func (a *apns) Send(ctx context.Context, token string, payload interface{}, opts Options) error {
+	aps := apsPayload{Data: payload}
+	aps.APS.ContentAvailable = 1
+
+	if a.dryRun {
+		buf, err := json.Marshal(aps)
+		if err != nil {
+			return err
+		}
+		if len(buf) > maxAPNSPayloadSize {
+			return fmt.Errorf("apns payload is %d bytes; the limit is %d", len(buf), maxAPNSPayloadSize)
+		}
+		log.Printf("apns dry run: %s", buf)
+		return nil
+	}
+
+	priority := apns2.PriorityLow
+	if opts.Priority == PriorityNormal {
+		priority = 1
+	}
+	resp, err := a.client.PushWithContext(ctx, &apns2.Notification{
+		DeviceToken: token,
+		Topic:       apnsTopic,
+		Priority:    priority,
+		PushType:    apns2.PushTypeBackground,
+		CollapseID:  opts.CollapseID,
+		Payload:     aps,
+	})
+	if err != nil {
+		return err
+	}
+	if resp.Sent() {
+		return nil
+	}
+	if resp.Reason == apns2.ReasonUnregistered || resp.Reason == apns2.ReasonBadDeviceToken {
+		return ErrUnregistered
+	}
+	return fmt.Errorf("apns refused the push because '%s'", resp.Reason)
+}
+
+// CheckHealth fulfills HealthChecker. It pushes to a device token that
+// doesn't exist. APNS only looks at the device token once it accepted the
+// provider token, so BadDeviceToken means pushes can be delivered.
+func (a *apns) CheckHealth(ctx context.Context) error {
+	n := &apns2.Notification{
+		DeviceToken: healthProbeToken,
+		Topic:       apnsTopic,
+		Priority:    5,
+		PushType:    apns2.PushTypeBackground,
+		Payload:     apsPayload{},
+	}
+	resp, err := a.client.PushWithContext(ctx, n)
+	if err != nil {
+		return err
+	}
+	if resp.Reason != apns2.ReasonBadDeviceToken {
+		return fmt.Errorf("apns probe failed with status %d: %s", resp.StatusCode, resp.Reason)
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+package push
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestAPNSDryRun(t *testing.T) {
+	// a dry run never touches the client, so a nil one is fine
+	p := &apns{dryRun: true}
+	if err := p.Send(context.Background(), "apns-token", map[string]string{"hello": "world"}, Options{Priority: PriorityHigh}); err != nil {
+		t.Fatal(err)
+	}
+	// oversized payloads are rejected rather than sent
+	err := p.Send(context.Background(), "apns-token", map[string]string{"hello": strings.Repeat("a", maxAPNSPayloadSize)}, Options{Priority: PriorityHigh})
+	if err == nil {
+		t.Fatal("an oversized payload should be rejected")
+	}
+}
@@ -0,0 +1,148 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+// FCMEndpoint is the legacy send endpoint of Firebase Cloud Messaging
+const FCMEndpoint = "https://fcm.googleapis.com/fcm/send"
+
+// fcmTimeout bounds a request to FCM, including reading its response, so a
+// stalled connection doesn't hold up the pushes queued behind it
+const fcmTimeout = 15 * time.Second
+
+type fcmResult struct {
+	MessageID      *string `json:"message_id,omitempty"`
+	Error          *string `json:"error,omitempty"`
+	RegistrationID *string `json:"registration_id,omitempty"`
+}
+
+type fcmResponse struct {
+	MulticastID  int64       `json:"multicast_id"`
+	Success      int         `json:"success"`
+	Failure      int         `json:"failure"`
+	CanonicalIDs int         `json:"canonical_ids"`
+	Results      []fcmResult `json:"results"`
+}
+
+type fcmMessage struct {
+	To          string      `json:"to"`
+	Priority    string      `json:"priority,omitempty"`
+	CollapseKey string      `json:"collapse_key,omitempty"`
+	Data        interface{} `json:"data"`
+	DryRun      bool        `json:"dry_run,omitempty"`
+}
+
+// fcm delivers push notifications via Firebase Cloud Messaging
+type fcm struct {
+	client    *http.Client
+	endpoint  string
+	serverKey string
+	// dryRun asks FCM to validate messages without delivering them
+	dryRun bool
+}
+
+// NewFCM returns a Provider that pushes with the FCM server key
+func NewFCM(serverKey string, dryRun bool) Provider {
+	return NewFCMWithEndpoint(serverKey, FCMEndpoint, dryRun)
+}
+
+// NewFCMWithEndpoint returns a Provider that pushes through the FCM
+// compatible send endpoint. It's useful to test against a fake FCM.
+func NewFCMWithEndpoint(serverKey, endpoint string, dryRun bool) Provider {
+	return &fcm{
+		client:    &http.Client{Timeout: fcmTimeout},
+		endpoint:  endpoint,
+		serverKey: serverKey,
+		dryRun:    dryRun,
+	}
+}
+
+// Name fulfills Provider
+func (f *fcm) Name() string {
+	return NameFCM
+}
+
+// Send fulfills Provider
+func (f *fcm) Send(ctx context.Context, token string, payload interface{}, opts Options) error {
+	msg := fcmMessage{To: token, Priority: "normal", CollapseKey: opts.CollapseID, Data: payload, DryRun: f.dryRun}
+	if opts.Priority == PriorityHigh {
+		msg.Priority = "high"
+	}
+	resp, err := f.post(ctx, msg)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		buf, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("fcm responded with status %d: %s", resp.StatusCode, buf)
+	}
+	body := fcmResponse{}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("decoding the fcm response: %w", err)
+	}
+	if len(body.Results) == 0 {
+		return errors.New("fcm responded without a result")
+	}
+
+	result := body.Results[0]
+	if result.Error != nil {
+		switch *result.Error {
+		case "InvalidRegistration", "NotRegistered":
+			return ErrUnregistered
+		default:
+			return fmt.Errorf("fcm refused the push: %s", *result.Error)
+		}
+	}
+	// FCM gave the device a canonical token, which should be used instead
+	if result.RegistrationID != nil {
+		return &TokenChangedError{Token: *result.RegistrationID}
+	}
+	return nil
+}
+
+// CheckHealth fulfills HealthChecker. It sends a dry run to a token that
+// doesn't exist. FCM only looks at the token once it accepted the server key,
+// so a successful response means pushes can be delivered.
+func (f *fcm) CheckHealth(ctx context.Context) error {
+	resp, err := f.post(ctx, fcmMessage{To: healthProbeToken, Data: map[string]string{}, DryRun: true})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized:
+		return errors.New("fcm rejected the server key")
+	default:
+		return fmt.Errorf("fcm probe failed with status %d", resp.StatusCode)
+	}
+}
+
+func (f *fcm) post(ctx context.Context, msg fcmMessage) (*http.Response, error) {
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	if msg.DryRun && msg.To != healthProbeToken {
+		log.Printf("fcm dry run: %s", buf)
+	}
+	req, err := http.NewRequest(http.MethodPost, f.endpoint, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "key="+f.serverKey)
+	return f.client.Do(req.WithContext(ctx))
+}
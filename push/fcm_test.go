@@ -0,0 +1,99 @@
+package push
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeFCM answers every message with result, and hands over the messages
+// it received
+func fakeFCM(t *testing.T, result string) (*httptest.Server, <-chan fcmMessage) {
+	t.Helper()
+
+	msgs := make(chan fcmMessage, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "key=server-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		msg := fcmMessage{}
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Error(err)
+		}
+		msgs <- msg
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"results": [` + result + `]}`))
+	}))
+	return server, msgs
+}
+
+func TestFCMSend(t *testing.T) {
+	server, msgs := fakeFCM(t, `{"message_id": "fake"}`)
+	defer server.Close()
+
+	p := NewFCMWithEndpoint("server-key", server.URL, true)
+	opts := Options{Priority: PriorityHigh, CollapseID: "location"}
+	if err := p.Send(context.Background(), "fcm-token", map[string]string{"hello": "world"}, opts); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-msgs
+	if msg.To != "fcm-token" || msg.Priority != "high" || msg.CollapseKey != "location" || !msg.DryRun {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+}
+
+func TestFCMTokenUpdates(t *testing.T) {
+	server, _ := fakeFCM(t, `{"error": "NotRegistered"}`)
+	p := NewFCMWithEndpoint("server-key", server.URL, false)
+	if err := p.Send(context.Background(), "fcm-token", nil, Options{}); err != ErrUnregistered {
+		t.Fatalf("expected ErrUnregistered, got %v", err)
+	}
+	server.Close()
+
+	server, _ = fakeFCM(t, `{"message_id": "fake", "registration_id": "canonical-token"}`)
+	defer server.Close()
+	p = NewFCMWithEndpoint("server-key", server.URL, false)
+	err := p.Send(context.Background(), "fcm-token", nil, Options{})
+	changed, ok := err.(*TokenChangedError)
+	if !ok || changed.Token != "canonical-token" {
+		t.Fatalf("expected the token to change, got %v", err)
+	}
+}
+
+func TestFCMCheckHealth(t *testing.T) {
+	server, msgs := fakeFCM(t, `{"error": "InvalidRegistration"}`)
+	defer server.Close()
+
+	p := NewFCMWithEndpoint("server-key", server.URL, false).(HealthChecker)
+	if err := p.CheckHealth(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-msgs; !msg.DryRun {
+		t.Fatal("the probe should be a dry run")
+	}
+	p = NewFCMWithEndpoint("revoked", server.URL, false).(HealthChecker)
+	if err := p.CheckHealth(context.Background()); err == nil {
+		t.Fatal("a rejected server key should fail the check")
+	}
+}
+
+func TestFCMSendCanceled(t *testing.T) {
+	stalled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stalled
+	}))
+	defer server.Close()
+	defer close(stalled)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	p := NewFCMWithEndpoint("server-key", server.URL, false)
+	if err := p.Send(ctx, "fcm-token", nil, Options{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the send to stop at the deadline, got %v", err)
+	}
+}
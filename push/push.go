@@ -0,0 +1,74 @@
+// Package push delivers payloads to apps through the push notification
+// services of their platforms.
+package push
+
+import (
+	"context"
+	"errors"
+)
+
+// Names of the push services, which are also the kinds of device tokens
+// they take
+const (
+	NameAPNS = "apns"
+	NameFCM  = "fcm"
+)
+
+// Priority says how soon a push should reach the device
+type Priority int
+
+const (
+	// PriorityNormal lets the service hold the push back to save the
+	// device's battery
+	PriorityNormal Priority = iota
+	// PriorityHigh asks for the push to be delivered right away, waking the
+	// device if needed
+	PriorityHigh
+)
+
+// MaxCollapseIDLength is the longest collapse ID, in bytes. It's the limit
+// of APNS.
+const MaxCollapseIDLength = 64
+
+// Options say how a push is delivered
+type Options struct {
+	Priority Priority `json:"priority"`
+	// CollapseID groups the pushes that replace each other on the device,
+	// so only the latest of them is kept. Empty means the push stands on its
+	// own.
+	CollapseID string `json:"collapse_id,omitempty"`
+}
+
+// Provider is implemented by each push notification service we can deliver
+// payloads through
+type Provider interface {
+	// Name is one of the Name constants
+	Name() string
+	// Send delivers payload, marshalled to JSON, to the device with token. It
+	// gives up when ctx is done.
+	Send(ctx context.Context, token string, payload interface{}, opts Options) error
+}
+
+// HealthChecker is implemented by the Providers that can check they're able
+// to deliver, without delivering anything
+type HealthChecker interface {
+	CheckHealth(ctx context.Context) error
+}
+
+// ErrUnregistered is returned by Send when the token no longer reaches a
+// device, so it should be forgotten
+var ErrUnregistered = errors.New("the device token is no longer registered")
+
+// TokenChangedError is returned by Send when the payload was delivered, but
+// the service wants Token used for the device from now on
+type TokenChangedError struct {
+	Token string
+}
+
+func (e *TokenChangedError) Error() string {
+	return "the device token was replaced by " + e.Token
+}
+
+// healthProbeToken is the device token of the health probes. No device has
+// it, so the probes are never delivered.
+const healthProbeToken = "oscar-health-probe"
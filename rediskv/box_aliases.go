@@ -0,0 +1,99 @@
+package rediskv
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"zood.dev/oscar/kvstor"
+)
+
+// Each alias is a key holding its box, which expires once the alias stops
+// being current. Each aliased box is a key holding its owner and its
+// current alias, separated by a colon.
+
+// addBoxAliasScript points KEYS[2], the key of the alias ARGV[2], at the box
+// ARGV[3], whose key is KEYS[1], for the owner ARGV[1]. The previous alias,
+// prefixed by ARGV[5], expires at ARGV[4]. It returns 0 when the box has
+// another owner.
+const addBoxAliasScript = `
+local cur = redis.call('GET', KEYS[1])
+if cur then
+	local sep = string.find(cur, ':', 1, true)
+	if string.sub(cur, 1, sep - 1) ~= ARGV[1] then return 0 end
+	local prev = ARGV[5] .. string.sub(cur, sep + 1)
+	if redis.call('EXISTS', prev) == 1 then redis.call('EXPIREAT', prev, ARGV[4]) end
+end
+redis.call('SET', KEYS[2], ARGV[3])
+redis.call('SET', KEYS[1], ARGV[1] .. ':' .. ARGV[2])
+return 1`
+
+// AddBoxAlias fulfills kvstor.BoxAliases
+func (rp redisProvider) AddBoxAlias(boxID, alias []byte, ownerID int64, graceUntil int64) error {
+	reply, err := rp.do("EVAL", addBoxAliasScript, 2,
+		rp.key("aliased_boxes", boxID), rp.key("box_aliases", alias),
+		ownerID, alias, boxID, graceUntil, rp.key("box_aliases", nil))
+	if err != nil {
+		return err
+	}
+	added, ok := reply.(int64)
+	if !ok {
+		return errors.Errorf("unexpected reply to the alias script: %v", reply)
+	}
+	if added == 0 {
+		return kvstor.ErrBoxOwner
+	}
+	return nil
+}
+
+// BoxOfAlias fulfills kvstor.BoxAliases
+func (rp redisProvider) BoxOfAlias(alias []byte) ([]byte, error) {
+	return rp.get(rp.key("box_aliases", alias))
+}
+
+// PurgeExpiredBoxAliases fulfills kvstor.BoxAliases. Redis deletes expired
+// aliases itself, so there's nothing to purge.
+func (rp redisProvider) PurgeExpiredBoxAliases(now int64) (int, error) {
+	return 0, nil
+}
+
+// ListBoxAliases fulfills kvstor.Lister. The expiry is read from the key's
+// remaining time to live, like with ListPackages.
+func (rp redisProvider) ListBoxAliases(fn func(alias, boxID []byte, ownerID int64, expires int64) error) error {
+	return rp.scan("box_aliases", func(alias []byte) error {
+		key := rp.key("box_aliases", alias)
+		boxID, err := rp.get(key)
+		if err != nil {
+			return err
+		}
+		reply, err := rp.do("PTTL", key)
+		if err != nil {
+			return err
+		}
+		ttl, ok := reply.(int64)
+		if !ok {
+			return errors.Errorf("unexpected reply to PTTL: %T", reply)
+		}
+		if boxID == nil || ttl == -2 {
+			return nil
+		}
+		var expires int64
+		if ttl >= 0 {
+			expires = time.Now().Add(time.Duration(ttl) * time.Millisecond).Unix()
+		}
+		buf, err := rp.get(rp.key("aliased_boxes", boxID))
+		if err != nil {
+			return err
+		}
+		sep := bytes.IndexByte(buf, ':')
+		if sep == -1 {
+			return errors.Errorf("unexpected aliases of box %x", boxID)
+		}
+		ownerID, err := strconv.ParseInt(string(buf[:sep]), 10, 64)
+		if err != nil {
+			return err
+		}
+		return fn(alias, boxID, ownerID, expires)
+	})
+}
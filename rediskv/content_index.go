@@ -0,0 +1,137 @@
+package rediskv
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Each name is a key holding its hash, and is also kept in a sorted set, so
+// names can be listed by prefix. Each hash has a key counting its
+// references, which is removed with the last reference.
+
+// linkScript points KEYS[1], the key of the name ARGV[3], at the hash
+// ARGV[1]. ARGV[2] prefixes the keys of the reference counts. It returns
+// the hash the name referenced before, or "", and its references left.
+const linkScript = `
+local cur = redis.call('GET', KEYS[1])
+if cur == ARGV[1] then return {'', 0} end
+redis.call('SET', KEYS[1], ARGV[1])
+redis.call('ZADD', KEYS[2], 0, ARGV[3])
+redis.call('INCR', ARGV[2] .. ARGV[1])
+if not cur then return {'', 0} end
+local refs = redis.call('DECR', ARGV[2] .. cur)
+if refs <= 0 then
+	redis.call('DEL', ARGV[2] .. cur)
+	refs = 0
+end
+return {cur, refs}`
+
+// unlinkScript removes the name ARGV[2], whose key is KEYS[1], and returns
+// like linkScript
+const unlinkScript = `
+local cur = redis.call('GET', KEYS[1])
+if not cur then return {'', 0} end
+redis.call('DEL', KEYS[1])
+redis.call('ZREM', KEYS[2], ARGV[2])
+local refs = redis.call('DECR', ARGV[1] .. cur)
+if refs <= 0 then
+	redis.call('DEL', ARGV[1] .. cur)
+	refs = 0
+end
+return {cur, refs}`
+
+// contentNamesPage is how many names ContentNames fetches at a time
+const contentNamesPage = 1000
+
+func (rp redisProvider) contentNameKey(name string) string {
+	return rp.key("content_names", []byte(name))
+}
+
+func (rp redisProvider) contentNamesSetKey() string {
+	return rp.prefix + "content_names"
+}
+
+func (rp redisProvider) contentRefsPrefix() string {
+	return rp.prefix + "content_refs:"
+}
+
+// ContentHash fulfills kvstor.ContentIndex
+func (rp redisProvider) ContentHash(name string) ([]byte, error) {
+	return rp.get(rp.contentNameKey(name))
+}
+
+// ContentReferences fulfills kvstor.ContentIndex
+func (rp redisProvider) ContentReferences(hash []byte) (int64, error) {
+	buf, err := rp.get(rp.contentRefsPrefix() + string(hash))
+	if err != nil || buf == nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(buf), 10, 64)
+}
+
+// evalLink runs one of the link scripts, and decodes its reply
+func (rp redisProvider) evalLink(script, name string, args ...interface{}) ([]byte, int64, error) {
+	cmd := append([]interface{}{"EVAL", script, 2, rp.contentNameKey(name), rp.contentNamesSetKey()}, args...)
+	reply, err := rp.do(cmd...)
+	if err != nil {
+		return nil, 0, err
+	}
+	arr, ok := reply.([]interface{})
+	if !ok || len(arr) != 2 {
+		return nil, 0, errors.Errorf("unexpected reply to the link script: %v", reply)
+	}
+	old, ok := arr[0].([]byte)
+	refs, ok2 := arr[1].(int64)
+	if !ok || !ok2 {
+		return nil, 0, errors.Errorf("unexpected reply to the link script: %v", reply)
+	}
+	if len(old) == 0 {
+		return nil, 0, nil
+	}
+	return old, refs, nil
+}
+
+// LinkContent fulfills kvstor.ContentIndex
+func (rp redisProvider) LinkContent(name string, hash []byte) ([]byte, int64, error) {
+	return rp.evalLink(linkScript, name, hash, rp.contentRefsPrefix(), name)
+}
+
+// UnlinkContent fulfills kvstor.ContentIndex
+func (rp redisProvider) UnlinkContent(name string) ([]byte, int64, error) {
+	return rp.evalLink(unlinkScript, name, rp.contentRefsPrefix(), name)
+}
+
+// ContentNames fulfills kvstor.ContentIndex. The names are fetched a page at
+// a time, so fn can change the index.
+func (rp redisProvider) ContentNames(prefix string, fn func(name string) error) error {
+	start := "[" + prefix
+	for {
+		reply, err := rp.do("ZRANGEBYLEX", rp.contentNamesSetKey(), start, "+", "LIMIT", 0, contentNamesPage)
+		if err != nil {
+			return err
+		}
+		arr, ok := reply.([]interface{})
+		if !ok {
+			return errors.Errorf("unexpected reply to ZRANGEBYLEX: %T", reply)
+		}
+		for _, item := range arr {
+			buf, ok := item.([]byte)
+			if !ok {
+				return errors.Errorf("unexpected name in reply to ZRANGEBYLEX: %T", item)
+			}
+			name := string(buf)
+			if !strings.HasPrefix(name, prefix) {
+				return nil
+			}
+			if err = fn(name); err != nil {
+				return err
+			}
+			start = "(" + name
+		}
+		if len(arr) < contentNamesPage {
+			return nil
+		}
+	}
+}
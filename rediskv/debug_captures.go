@@ -0,0 +1,74 @@
+package rediskv
+
+import (
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// The window of each capture is a key holding its end, and its records are
+// a list, trimmed as it's appended to.
+
+func (rp redisProvider) debugCaptureKeys(userID int64) (string, string) {
+	id := []byte(strconv.FormatInt(userID, 10))
+	return rp.key("debug_captures", id), rp.key("debug_capture_records", id)
+}
+
+// StartDebugCapture fulfills kvstor.DebugCaptures
+func (rp redisProvider) StartDebugCapture(userID int64, until int64) error {
+	untilKey, recordsKey := rp.debugCaptureKeys(userID)
+	if _, err := rp.do("DEL", recordsKey); err != nil {
+		return err
+	}
+	_, err := rp.do("SET", untilKey, until)
+	return err
+}
+
+// DebugCaptureUntil fulfills kvstor.DebugCaptures
+func (rp redisProvider) DebugCaptureUntil(userID int64) (int64, error) {
+	untilKey, _ := rp.debugCaptureKeys(userID)
+	buf, err := rp.get(untilKey)
+	if err != nil || buf == nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(buf), 10, 64)
+}
+
+// AppendDebugCapture fulfills kvstor.DebugCaptures
+func (rp redisProvider) AppendDebugCapture(userID int64, record []byte, max int) error {
+	_, recordsKey := rp.debugCaptureKeys(userID)
+	if _, err := rp.do("RPUSH", recordsKey, record); err != nil {
+		return err
+	}
+	_, err := rp.do("LTRIM", recordsKey, -max, -1)
+	return err
+}
+
+// DebugCapture fulfills kvstor.DebugCaptures
+func (rp redisProvider) DebugCapture(userID int64) ([][]byte, error) {
+	_, recordsKey := rp.debugCaptureKeys(userID)
+	reply, err := rp.do("LRANGE", recordsKey, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	arr, ok := reply.([]interface{})
+	if !ok {
+		return nil, errors.Errorf("unexpected reply to LRANGE: %T", reply)
+	}
+	records := make([][]byte, 0, len(arr))
+	for _, item := range arr {
+		buf, ok := item.([]byte)
+		if !ok {
+			return nil, errors.Errorf("unexpected record in reply to LRANGE: %T", item)
+		}
+		records = append(records, buf)
+	}
+	return records, nil
+}
+
+// DeleteDebugCapture fulfills kvstor.DebugCaptures
+func (rp redisProvider) DeleteDebugCapture(userID int64) error {
+	untilKey, recordsKey := rp.debugCaptureKeys(userID)
+	_, err := rp.do("DEL", untilKey, recordsKey)
+	return err
+}
@@ -0,0 +1,108 @@
+package rediskv
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Each queued email is a key holding the email, and the queue is a sorted
+// set of their ids, scored by when they're due. Dead letters are keys of
+// their own, only scanned when they're listed.
+
+func (rp redisProvider) emailQueueKey() string {
+	return rp.prefix + "email_queue"
+}
+
+// QueueEmail fulfills kvstor.EmailQueue. The email is stored before its id
+// is queued, so every queued id has an email.
+func (rp redisProvider) QueueEmail(id string, email []byte, due int64) error {
+	if _, err := rp.do("SET", rp.key("queued_emails", []byte(id)), email); err != nil {
+		return err
+	}
+	_, err := rp.do("ZADD", rp.emailQueueKey(), due, id)
+	return err
+}
+
+// DueEmails fulfills kvstor.EmailQueue
+func (rp redisProvider) DueEmails(now int64, max int) (map[string][]byte, error) {
+	reply, err := rp.do("ZRANGEBYSCORE", rp.emailQueueKey(), "-inf", now, "LIMIT", 0, max)
+	if err != nil {
+		return nil, err
+	}
+	arr, ok := reply.([]interface{})
+	if !ok {
+		return nil, errors.Errorf("unexpected reply to ZRANGEBYSCORE: %T", reply)
+	}
+	emails := make(map[string][]byte, len(arr))
+	for _, item := range arr {
+		id, ok := item.([]byte)
+		if !ok {
+			return nil, errors.Errorf("unexpected id in reply to ZRANGEBYSCORE: %T", item)
+		}
+		email, err := rp.get(rp.key("queued_emails", id))
+		if err != nil {
+			return nil, err
+		}
+		// dequeued meanwhile
+		if email == nil {
+			continue
+		}
+		emails[string(id)] = email
+	}
+	return emails, nil
+}
+
+// DequeueEmail fulfills kvstor.EmailQueue. The dead letter is stored before
+// the email is removed, so a failure can't lose both.
+func (rp redisProvider) DequeueEmail(id string, deadLetter []byte) error {
+	if deadLetter != nil {
+		if _, err := rp.do("SET", rp.key("dead_letters", []byte(id)), deadLetter); err != nil {
+			return err
+		}
+	}
+	if _, err := rp.do("ZREM", rp.emailQueueKey(), id); err != nil {
+		return err
+	}
+	_, err := rp.do("DEL", rp.key("queued_emails", []byte(id)))
+	return err
+}
+
+// ReplaceQueuedEmail fulfills kvstor.EmailQueue. The due time is the score
+// in the queue, which stays as it is.
+func (rp redisProvider) ReplaceQueuedEmail(id string, email []byte) (bool, error) {
+	return rp.replace(rp.key("queued_emails", []byte(id)), email)
+}
+
+// DeadLetters fulfills kvstor.EmailQueue
+func (rp redisProvider) DeadLetters() (map[string][]byte, error) {
+	letters := map[string][]byte{}
+	err := rp.scan("dead_letters", func(id []byte) error {
+		letter, err := rp.get(rp.key("dead_letters", id))
+		if err != nil || letter == nil {
+			return err
+		}
+		letters[string(id)] = letter
+		return nil
+	})
+	return letters, err
+}
+
+// DeleteDeadLetter fulfills kvstor.EmailQueue
+func (rp redisProvider) DeleteDeadLetter(id string) error {
+	_, err := rp.do("DEL", rp.key("dead_letters", []byte(id)))
+	return err
+}
+
+// ReplaceDeadLetter fulfills kvstor.EmailQueue
+func (rp redisProvider) ReplaceDeadLetter(id string, deadLetter []byte) (bool, error) {
+	return rp.replace(rp.key("dead_letters", []byte(id)), deadLetter)
+}
+
+// replace sets key to value only if it exists, and returns whether it did
+func (rp redisProvider) replace(key string, value []byte) (bool, error) {
+	reply, err := rp.do("SET", key, value, "XX")
+	if err != nil {
+		return false, err
+	}
+	// a nil reply means key didn't exist
+	return reply == "OK", nil
+}
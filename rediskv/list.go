@@ -0,0 +1,122 @@
+package rediskv
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// scanPage is how many keys each SCAN asks for
+const scanPage = 500
+
+// globEscape escapes the characters of s that are special in a SCAN pattern
+func globEscape(s string) string {
+	var sb strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
+
+// scan calls fn with the id of every key of kind. Redis may return a key
+// more than once, when the database is written to during the scan.
+func (rp redisProvider) scan(kind string, fn func(id []byte) error) error {
+	prefix := rp.key(kind, nil)
+	pattern := globEscape(prefix) + "*"
+	cursor := "0"
+	for {
+		reply, err := rp.do("SCAN", cursor, "MATCH", pattern, "COUNT", scanPage)
+		if err != nil {
+			return err
+		}
+		arr, ok := reply.([]interface{})
+		if !ok || len(arr) != 2 {
+			return errors.Errorf("unexpected reply to SCAN: %v", reply)
+		}
+		next, ok := arr[0].([]byte)
+		if !ok {
+			return errors.Errorf("unexpected cursor in reply to SCAN: %T", arr[0])
+		}
+		keys, ok := arr[1].([]interface{})
+		if !ok {
+			return errors.Errorf("unexpected keys in reply to SCAN: %T", arr[1])
+		}
+		for _, k := range keys {
+			buf, ok := k.([]byte)
+			if !ok {
+				return errors.Errorf("unexpected key in reply to SCAN: %T", k)
+			}
+			if err = fn(buf[len(prefix):]); err != nil {
+				return err
+			}
+		}
+		cursor = string(next)
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// ListPackages fulfills kvstor.Lister. The expiry is read from the key's
+// remaining time to live, so it's only accurate to the second.
+func (rp redisProvider) ListPackages(fn func(boxID, pkg []byte, expires int64) error) error {
+	return rp.scan("drop_boxes", func(boxID []byte) error {
+		key := rp.key("drop_boxes", boxID)
+		pkg, err := rp.get(key)
+		if err != nil {
+			return err
+		}
+		reply, err := rp.do("PTTL", key)
+		if err != nil {
+			return err
+		}
+		ttl, ok := reply.(int64)
+		if !ok {
+			return errors.Errorf("unexpected reply to PTTL: %T", reply)
+		}
+		// -2 is a key that expired since it was scanned
+		if pkg == nil || ttl == -2 {
+			return nil
+		}
+		var expires int64
+		if ttl >= 0 {
+			expires = time.Now().Add(time.Duration(ttl) * time.Millisecond).Unix()
+		}
+		return fn(boxID, pkg, expires)
+	})
+}
+
+// ListIDs fulfills kvstor.Lister
+func (rp redisProvider) ListIDs(fn func(userID int64, pubID []byte) error) error {
+	return rp.scan("public_ids", func(id []byte) error {
+		userID, err := strconv.ParseInt(string(id), 10, 64)
+		if err != nil {
+			return err
+		}
+		pubID, err := rp.get(rp.key("public_ids", id))
+		if err != nil || pubID == nil {
+			return err
+		}
+		return fn(userID, pubID)
+	})
+}
+
+// ListDebugCaptures fulfills kvstor.Lister
+func (rp redisProvider) ListDebugCaptures(fn func(userID int64, until int64) error) error {
+	return rp.scan("debug_captures", func(id []byte) error {
+		userID, err := strconv.ParseInt(string(id), 10, 64)
+		if err != nil {
+			return err
+		}
+		until, err := rp.DebugCaptureUntil(userID)
+		if err != nil || until == 0 {
+			return err
+		}
+		return fn(userID, until)
+	})
+}
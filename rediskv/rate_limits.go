@@ -0,0 +1,52 @@
+package rediskv
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Each rate limiting bucket is a key holding its tokens and when they were
+// counted, in milliseconds, separated by a colon. It expires once the
+// bucket would be full again, since a missing bucket is a full one.
+
+// takeTokenScript takes a token from the bucket KEYS[1], which holds up to
+// ARGV[2] tokens and gains ARGV[1] per second, at ARGV[3] milliseconds. It
+// returns 0 when a token was taken, or the milliseconds until one can be.
+// Clocks running behind the one that last counted the tokens don't refill
+// the bucket.
+const takeTokenScript = `
+local rate, burst, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local tokens, counted = burst, now
+local cur = redis.call('GET', KEYS[1])
+if cur then
+	local sep = string.find(cur, ':', 1, true)
+	tokens = tonumber(string.sub(cur, 1, sep - 1))
+	counted = tonumber(string.sub(cur, sep + 1))
+end
+if now > counted then
+	tokens = math.min(burst, tokens + (now - counted) * rate / 1000)
+	counted = now
+end
+if tokens < 1 then return math.ceil((1 - tokens) * 1000 / rate) end
+tokens = tokens - 1
+redis.call('SET', KEYS[1], tokens .. ':' .. counted, 'PX', math.ceil((burst - tokens) * 1000 / rate))
+return 0`
+
+// TakeToken takes a token from the rate limiting bucket, which holds up to
+// burst tokens and gains rate tokens per second. When the bucket is empty,
+// nothing is taken, and it returns how long until a token can be. Every
+// instance sharing the redis server draws from the same buckets.
+func (rp redisProvider) TakeToken(bucket string, rate float64, burst int, now time.Time) (time.Duration, error) {
+	reply, err := rp.do("EVAL", takeTokenScript, 1, rp.key("rate_limits", []byte(bucket)),
+		strconv.FormatFloat(rate, 'f', -1, 64), burst, now.UnixNano()/int64(time.Millisecond))
+	if err != nil {
+		return 0, err
+	}
+	wait, ok := reply.(int64)
+	if !ok {
+		return 0, errors.Errorf("unexpected reply to the token script: %v", reply)
+	}
+	return time.Duration(wait) * time.Millisecond, nil
+}
@@ -0,0 +1,174 @@
+// Package rediskv implements a kvstor.Provider backed by redis, so several
+// oscar instances can share drop boxes and the other kv data. The content
+// index is updated with Lua scripts, which touch keys they aren't passed,
+// so it needs a single redis instance rather than a cluster.
+package rediskv
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"zood.dev/oscar/kvstor"
+)
+
+// Config describes the redis server to connect to
+type Config struct {
+	// Address is the host:port of the server
+	Address  string
+	Password string
+	// DB is the number of the database to select
+	DB int
+	// KeyPrefix starts every key, so several deployments can share a
+	// database
+	KeyPrefix string
+	TLS       bool
+	// PoolSize is the most idle connections kept open. Defaults to 10.
+	PoolSize int
+	// MaxConns is the most connections open at once, idle or in use.
+	// Commands wait for a connection when they're all in use. Defaults to
+	// 50.
+	MaxConns int
+	// Timeout limits connecting and each command. Defaults to 5 seconds.
+	Timeout time.Duration
+}
+
+func (cfg Config) poolSize() int {
+	if cfg.PoolSize <= 0 {
+		return 10
+	}
+	return cfg.PoolSize
+}
+
+func (cfg Config) maxConns() int {
+	if cfg.MaxConns <= 0 {
+		return 50
+	}
+	return cfg.MaxConns
+}
+
+func (cfg Config) timeout() time.Duration {
+	if cfg.Timeout <= 0 {
+		return 5 * time.Second
+	}
+	return cfg.Timeout
+}
+
+type redisProvider struct {
+	pool   *pool
+	prefix string
+	// ctx limits waiting for a connection from the pool
+	ctx context.Context
+}
+
+// New returns a kvstor.Provider backed by the redis server described by cfg.
+// It fails when the server can't be reached.
+func New(cfg Config) (kvstor.Provider, error) {
+	if cfg.Address == "" {
+		return nil, errors.New("missing redis address")
+	}
+	rp := redisProvider{pool: newPool(cfg), prefix: cfg.KeyPrefix, ctx: context.Background()}
+	if _, err := rp.do("PING"); err != nil {
+		return nil, err
+	}
+	return rp, nil
+}
+
+// WithContext returns a copy of the provider whose commands stop waiting for
+// a connection when ctx is done
+func (rp redisProvider) WithContext(ctx context.Context) kvstor.Provider {
+	rp.ctx = ctx
+	return rp
+}
+
+// do runs a command on a connection from the pool
+func (rp redisProvider) do(args ...interface{}) (interface{}, error) {
+	return rp.pool.do(rp.ctx, args...)
+}
+
+func (rp redisProvider) key(kind string, id []byte) string {
+	return rp.prefix + kind + ":" + string(id)
+}
+
+// get returns the value of key, or nil
+func (rp redisProvider) get(key string) ([]byte, error) {
+	reply, err := rp.do("GET", key)
+	if err != nil {
+		return nil, err
+	}
+	buf, ok := reply.([]byte)
+	if !ok {
+		return nil, errors.Errorf("unexpected reply to GET: %T", reply)
+	}
+	return buf, nil
+}
+
+// DropPackage fulfills kvstor.Provider. It replaces any package already in
+// the box. The expiry is the key's own, so redis deletes the package when
+// it expires.
+func (rp redisProvider) DropPackage(pkg []byte, boxID []byte, expires int64) error {
+	key := rp.key("drop_boxes", boxID)
+	if expires == 0 {
+		_, err := rp.do("SET", key, pkg)
+		return err
+	}
+	ttl := time.Until(time.Unix(expires, 0)).Milliseconds()
+	if ttl <= 0 {
+		_, err := rp.do("DEL", key)
+		return err
+	}
+	_, err := rp.do("SET", key, pkg, "PX", ttl)
+	return err
+}
+
+// PickUpPackage fulfills kvstor.Provider
+func (rp redisProvider) PickUpPackage(boxID []byte) ([]byte, error) {
+	return rp.get(rp.key("drop_boxes", boxID))
+}
+
+// PurgeExpiredPackages fulfills kvstor.Provider. Redis deletes expired
+// packages itself, so there's nothing to purge.
+func (rp redisProvider) PurgeExpiredPackages(now int64) (int, error) {
+	return 0, nil
+}
+
+// Incident fulfills kvstor.IncidentNotice
+func (rp redisProvider) Incident() ([]byte, error) {
+	return rp.get(rp.key("server_status", []byte("incident")))
+}
+
+// SetIncident fulfills kvstor.IncidentNotice
+func (rp redisProvider) SetIncident(notice []byte) error {
+	key := rp.key("server_status", []byte("incident"))
+	if notice == nil {
+		_, err := rp.do("DEL", key)
+		return err
+	}
+	_, err := rp.do("SET", key, notice)
+	return err
+}
+
+// InsertIds fulfills kvstor.Provider. Both mappings are set at once.
+func (rp redisProvider) InsertIds(userID int64, pubID []byte) error {
+	userIDStr := strconv.FormatInt(userID, 10)
+	_, err := rp.do("MSET",
+		rp.key("user_ids", pubID), userIDStr,
+		rp.key("public_ids", []byte(userIDStr)), pubID)
+	return err
+}
+
+// PublicIDFromUserID fulfills kvstor.Provider
+func (rp redisProvider) PublicIDFromUserID(userID int64) ([]byte, error) {
+	return rp.get(rp.key("public_ids", []byte(strconv.FormatInt(userID, 10))))
+}
+
+// UserIDFromPublicID fulfills kvstor.Provider. It returns 0 when there's no
+// user with pubID.
+func (rp redisProvider) UserIDFromPublicID(pubID []byte) (int64, error) {
+	buf, err := rp.get(rp.key("user_ids", pubID))
+	if err != nil || buf == nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(buf), 10, 64)
+}
@@ -0,0 +1,714 @@
+package rediskv
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/kvstor"
+)
+
+// fakeRedis serves the commands used by the provider from memory. The
+// scripts are run natively, picked by their source.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+	mu       sync.Mutex
+	values   map[string][]byte
+	ttls     map[string]int64
+	lists    map[string][][]byte
+	names    map[string]bool
+	// scores are the members of the email queue, the only scored set
+	scores map[string]float64
+}
+
+func newFakeRedis(t *testing.T, password string) (*fakeRedis, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	fr := &fakeRedis{ln: ln, password: password, values: make(map[string][]byte), ttls: make(map[string]int64), lists: make(map[string][][]byte), names: make(map[string]bool), scores: make(map[string]float64)}
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fr.serve(nc)
+		}
+	}()
+	return fr, ln.Addr().String()
+}
+
+func (fr *fakeRedis) Close() {
+	fr.ln.Close()
+}
+
+func (fr *fakeRedis) serve(nc net.Conn) {
+	defer nc.Close()
+	r := bufio.NewReader(nc)
+	w := bufio.NewWriter(nc)
+	authed := fr.password == ""
+	for {
+		req, err := readReply(r)
+		if err != nil {
+			return
+		}
+		arr := req.([]interface{})
+		args := make([]string, len(arr))
+		for i, a := range arr {
+			args[i] = string(a.([]byte))
+		}
+		if !authed && args[0] != "AUTH" {
+			writeReply(w, Error("NOAUTH Authentication required."))
+		} else if args[0] == "AUTH" {
+			authed = args[1] == fr.password
+			if authed {
+				writeReply(w, "OK")
+			} else {
+				writeReply(w, Error("WRONGPASS invalid password"))
+			}
+		} else {
+			fr.mu.Lock()
+			writeReply(w, fr.exec(args))
+			fr.mu.Unlock()
+		}
+		w.Flush()
+	}
+}
+
+func (fr *fakeRedis) exec(args []string) interface{} {
+	switch args[0] {
+	case "PING":
+		return "PONG"
+	case "SELECT":
+		return "OK"
+	case "GET":
+		v, ok := fr.values[args[1]]
+		if !ok {
+			return []byte(nil)
+		}
+		return v
+	case "SET":
+		// only the NX, XX and PX options, which the provider uses
+		_, exists := fr.values[args[1]]
+		ttl := int64(-1)
+		for i := 3; i < len(args); i++ {
+			switch args[i] {
+			case "NX":
+				if exists {
+					return []byte(nil)
+				}
+			case "XX":
+				if !exists {
+					return []byte(nil)
+				}
+			case "PX":
+				i++
+				ttl, _ = strconv.ParseInt(args[i], 10, 64)
+			}
+		}
+		fr.values[args[1]] = []byte(args[2])
+		delete(fr.ttls, args[1])
+		if ttl >= 0 {
+			fr.ttls[args[1]] = ttl
+		}
+		return "OK"
+	case "DEL":
+		for _, key := range args[1:] {
+			delete(fr.values, key)
+			delete(fr.lists, key)
+		}
+		return int64(len(args) - 1)
+	case "RPUSH":
+		for _, v := range args[2:] {
+			fr.lists[args[1]] = append(fr.lists[args[1]], []byte(v))
+		}
+		return int64(len(fr.lists[args[1]]))
+	case "LTRIM":
+		// only the negative indexes the provider uses
+		start, _ := strconv.Atoi(args[2])
+		list := fr.lists[args[1]]
+		if len(list)+start > 0 {
+			fr.lists[args[1]] = list[len(list)+start:]
+		}
+		return "OK"
+	case "LRANGE":
+		out := []interface{}{}
+		for _, v := range fr.lists[args[1]] {
+			out = append(out, v)
+		}
+		return out
+	case "MSET":
+		for i := 1; i < len(args); i += 2 {
+			fr.values[args[i]] = []byte(args[i+1])
+		}
+		return "OK"
+	case "SCAN":
+		// every match at once, for patterns that are an escaped prefix
+		// followed by *
+		prefix := strings.NewReplacer(`\*`, "*", `\?`, "?", `\[`, "[", `\]`, "]", `\\`, `\`).Replace(strings.TrimSuffix(args[3], "*"))
+		keys := []interface{}{}
+		for key := range fr.values {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, []byte(key))
+			}
+		}
+		return []interface{}{[]byte("0"), keys}
+	case "PTTL":
+		if _, ok := fr.values[args[1]]; !ok {
+			return int64(-2)
+		}
+		if ttl, ok := fr.ttls[args[1]]; ok {
+			return ttl
+		}
+		return int64(-1)
+	case "ZRANGEBYLEX":
+		var names []string
+		for name := range fr.names {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		start := args[2]
+		limit, _ := strconv.Atoi(args[6])
+		var out []interface{}
+		for _, name := range names {
+			if (start[0] == '[' && name < start[1:]) || (start[0] == '(' && name <= start[1:]) {
+				continue
+			}
+			if len(out) == limit {
+				break
+			}
+			out = append(out, []byte(name))
+		}
+		return out
+	case "ZADD":
+		score, _ := strconv.ParseFloat(args[2], 64)
+		fr.scores[args[3]] = score
+		return int64(1)
+	case "ZREM":
+		delete(fr.scores, args[2])
+		return int64(1)
+	case "ZRANGEBYSCORE":
+		// only "-inf" as the minimum, like the provider uses
+		max, _ := strconv.ParseFloat(args[3], 64)
+		limit, _ := strconv.Atoi(args[6])
+		var members []string
+		for member, score := range fr.scores {
+			if score <= max {
+				members = append(members, member)
+			}
+		}
+		sort.Slice(members, func(i, j int) bool { return fr.scores[members[i]] < fr.scores[members[j]] })
+		out := []interface{}{}
+		for _, member := range members {
+			if len(out) == limit {
+				break
+			}
+			out = append(out, []byte(member))
+		}
+		return out
+	case "EVAL":
+		nkeys, _ := strconv.Atoi(args[2])
+		return fr.eval(args[1], args[3:3+nkeys], args[3+nkeys:])
+	}
+	return Error("ERR unknown command '" + args[0] + "'")
+}
+
+func (fr *fakeRedis) addRefs(key string, delta int64) int64 {
+	refs, _ := strconv.ParseInt(string(fr.values[key]), 10, 64)
+	refs += delta
+	if refs <= 0 {
+		delete(fr.values, key)
+		return 0
+	}
+	fr.values[key] = []byte(strconv.FormatInt(refs, 10))
+	return refs
+}
+
+func (fr *fakeRedis) eval(script string, keys, argv []string) interface{} {
+	nameKey := keys[0]
+	cur, ok := fr.values[nameKey]
+	switch script {
+	case addBoxAliasScript:
+		owner, alias, boxID, graceUntil, aliasPrefix := argv[0], argv[1], argv[2], argv[3], argv[4]
+		if ok {
+			sep := strings.IndexByte(string(cur), ':')
+			if string(cur[:sep]) != owner {
+				return int64(0)
+			}
+			prev := aliasPrefix + string(cur[sep+1:])
+			if _, ok := fr.values[prev]; ok {
+				until, _ := strconv.ParseInt(graceUntil, 10, 64)
+				if ttl := time.Until(time.Unix(until, 0)).Milliseconds(); ttl > 0 {
+					fr.ttls[prev] = ttl
+				} else {
+					delete(fr.values, prev)
+				}
+			}
+		}
+		fr.values[keys[1]] = []byte(boxID)
+		fr.values[nameKey] = []byte(owner + ":" + alias)
+		return int64(1)
+	case linkScript:
+		hash, refsPrefix, name := argv[0], argv[1], argv[2]
+		if ok && string(cur) == hash {
+			return []interface{}{[]byte{}, int64(0)}
+		}
+		fr.values[nameKey] = []byte(hash)
+		fr.names[name] = true
+		fr.addRefs(refsPrefix+hash, 1)
+		if !ok {
+			return []interface{}{[]byte{}, int64(0)}
+		}
+		return []interface{}{cur, fr.addRefs(refsPrefix+string(cur), -1)}
+	case unlinkScript:
+		refsPrefix, name := argv[0], argv[1]
+		if !ok {
+			return []interface{}{[]byte{}, int64(0)}
+		}
+		delete(fr.values, nameKey)
+		delete(fr.names, name)
+		return []interface{}{cur, fr.addRefs(refsPrefix+string(cur), -1)}
+	case takeTokenScript:
+		rate, _ := strconv.ParseFloat(argv[0], 64)
+		burst, _ := strconv.ParseFloat(argv[1], 64)
+		now, _ := strconv.ParseFloat(argv[2], 64)
+		tokens, counted := burst, now
+		if ok {
+			parts := strings.SplitN(string(cur), ":", 2)
+			tokens, _ = strconv.ParseFloat(parts[0], 64)
+			counted, _ = strconv.ParseFloat(parts[1], 64)
+		}
+		if now > counted {
+			tokens = math.Min(burst, tokens+(now-counted)*rate/1000)
+			counted = now
+		}
+		if tokens < 1 {
+			return int64(math.Ceil((1 - tokens) * 1000 / rate))
+		}
+		tokens--
+		fr.values[nameKey] = []byte(strconv.FormatFloat(tokens, 'f', -1, 64) + ":" + strconv.FormatFloat(counted, 'f', -1, 64))
+		fr.ttls[nameKey] = int64(math.Ceil((burst - tokens) * 1000 / rate))
+		return int64(0)
+	}
+	return Error("ERR unknown script")
+}
+
+func writeReply(w *bufio.Writer, reply interface{}) {
+	switch r := reply.(type) {
+	case string:
+		w.WriteString("+" + r + "\r\n")
+	case Error:
+		w.WriteString("-" + string(r) + "\r\n")
+	case int64:
+		w.WriteString(":" + strconv.FormatInt(r, 10) + "\r\n")
+	case []byte:
+		if r == nil {
+			w.WriteString("$-1\r\n")
+			return
+		}
+		w.WriteString("$" + strconv.Itoa(len(r)) + "\r\n")
+		w.Write(r)
+		w.WriteString("\r\n")
+	case []interface{}:
+		w.WriteString("*" + strconv.Itoa(len(r)) + "\r\n")
+		for _, item := range r {
+			writeReply(w, item)
+		}
+	}
+}
+
+func TestReadReply(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("*4\r\n+OK\r\n:-3\r\n$5\r\nhe\r\no\r\n$-1\r\n-ERR bad\r\n"))
+	reply, err := readReply(r)
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{"OK", int64(-3), []byte("he\r\no"), []byte(nil)}, reply)
+	reply, err = readReply(r)
+	require.NoError(t, err)
+	require.Equal(t, Error("ERR bad"), reply)
+
+	_, err = readReply(bufio.NewReader(strings.NewReader("?what\r\n")))
+	require.Error(t, err)
+}
+
+func TestAuth(t *testing.T) {
+	fr, addr := newFakeRedis(t, "secret")
+	defer fr.Close()
+	_, err := New(Config{Address: addr, Password: "wrong"})
+	require.Error(t, err)
+	_, err = New(Config{Address: addr, Password: "secret"})
+	require.NoError(t, err)
+}
+
+func TestPoolLimit(t *testing.T) {
+	fr, addr := newFakeRedis(t, "")
+	defer fr.Close()
+	kvs, err := New(Config{Address: addr, MaxConns: 1})
+	require.NoError(t, err)
+	rp := kvs.(redisProvider)
+
+	// the only connection is in use, so commands wait for it
+	c, err := rp.pool.get(context.Background())
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = rp.WithContext(ctx).PickUpPackage([]byte("box"))
+	require.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+
+	done := make(chan error)
+	go func() {
+		_, err := kvs.PickUpPackage([]byte("box"))
+		done <- err
+	}()
+	rp.pool.put(c)
+	require.NoError(t, <-done)
+}
+
+func TestPackagesAndIDs(t *testing.T) {
+	fr, addr := newFakeRedis(t, "")
+	defer fr.Close()
+	kvs, err := New(Config{Address: addr, KeyPrefix: "oscar:"})
+	require.NoError(t, err)
+
+	pkg, err := kvs.PickUpPackage([]byte("box"))
+	require.NoError(t, err)
+	require.Nil(t, pkg)
+	require.NoError(t, kvs.DropPackage([]byte("package"), []byte("box"), 0))
+	pkg, err = kvs.PickUpPackage([]byte("box"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("package"), pkg)
+
+	userID, err := kvs.UserIDFromPublicID([]byte("public id"))
+	require.NoError(t, err)
+	require.Zero(t, userID)
+	require.NoError(t, kvs.InsertIds(300, []byte("public id")))
+	userID, err = kvs.UserIDFromPublicID([]byte("public id"))
+	require.NoError(t, err)
+	require.Equal(t, int64(300), userID)
+	pubID, err := kvs.PublicIDFromUserID(300)
+	require.NoError(t, err)
+	require.Equal(t, []byte("public id"), pubID)
+}
+
+func TestPackageExpiry(t *testing.T) {
+	fr, addr := newFakeRedis(t, "")
+	defer fr.Close()
+	kvs, err := New(Config{Address: addr})
+	require.NoError(t, err)
+
+	// redis is left to expire the package
+	require.NoError(t, kvs.DropPackage([]byte("package"), []byte("box"), time.Now().Add(time.Minute).Unix()))
+	fr.mu.Lock()
+	ttl := fr.ttls["drop_boxes:box"]
+	fr.mu.Unlock()
+	require.True(t, ttl > 0 && ttl <= 60000, "ttl: %d", ttl)
+
+	// a package that already expired isn't stored
+	require.NoError(t, kvs.DropPackage([]byte("package"), []byte("box"), time.Now().Add(-time.Minute).Unix()))
+	pkg, err := kvs.PickUpPackage([]byte("box"))
+	require.NoError(t, err)
+	require.Nil(t, pkg)
+}
+
+func TestSharedBetweenInstances(t *testing.T) {
+	fr, addr := newFakeRedis(t, "")
+	defer fr.Close()
+	a, err := New(Config{Address: addr})
+	require.NoError(t, err)
+	b, err := New(Config{Address: addr})
+	require.NoError(t, err)
+
+	require.NoError(t, a.DropPackage([]byte("package"), []byte("box"), 0))
+	pkg, err := b.PickUpPackage([]byte("box"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("package"), pkg)
+}
+
+func TestContentIndex(t *testing.T) {
+	fr, addr := newFakeRedis(t, "")
+	defer fr.Close()
+	kvs, err := New(Config{Address: addr})
+	require.NoError(t, err)
+
+	old, _, err := kvs.LinkContent("backups/1", []byte("hash a"))
+	require.NoError(t, err)
+	require.Nil(t, old)
+	_, _, err = kvs.LinkContent("backups/2", []byte("hash a"))
+	require.NoError(t, err)
+	refs, err := kvs.ContentReferences([]byte("hash a"))
+	require.NoError(t, err)
+	require.Equal(t, int64(2), refs)
+
+	old, oldRefs, err := kvs.LinkContent("backups/1", []byte("hash b"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("hash a"), old)
+	require.Equal(t, int64(1), oldRefs)
+	hash, err := kvs.ContentHash("backups/1")
+	require.NoError(t, err)
+	require.Equal(t, []byte("hash b"), hash)
+
+	old, oldRefs, err = kvs.UnlinkContent("backups/2")
+	require.NoError(t, err)
+	require.Equal(t, []byte("hash a"), old)
+	require.Zero(t, oldRefs)
+	old, _, err = kvs.UnlinkContent("backups/2")
+	require.NoError(t, err)
+	require.Nil(t, old)
+}
+
+func TestContentNamesPages(t *testing.T) {
+	fr, addr := newFakeRedis(t, "")
+	defer fr.Close()
+	kvs, err := New(Config{Address: addr})
+	require.NoError(t, err)
+	var expected []string
+	for i := 0; i < contentNamesPage+5; i++ {
+		name := fmt.Sprintf("backups/%05d", i)
+		expected = append(expected, name)
+		_, _, err = kvs.LinkContent(name, []byte("hash"))
+		require.NoError(t, err)
+	}
+	_, _, err = kvs.LinkContent("other/1", []byte("hash"))
+	require.NoError(t, err)
+
+	var names []string
+	require.NoError(t, kvs.ContentNames("backups/", func(name string) error {
+		names = append(names, name)
+		return nil
+	}))
+	require.Equal(t, expected, names)
+}
+
+func TestDebugCaptures(t *testing.T) {
+	fr, addr := newFakeRedis(t, "")
+	defer fr.Close()
+	kvs, err := New(Config{Address: addr})
+	require.NoError(t, err)
+
+	until, err := kvs.DebugCaptureUntil(7)
+	require.NoError(t, err)
+	require.Zero(t, until)
+	require.NoError(t, kvs.StartDebugCapture(7, 1000))
+	until, err = kvs.DebugCaptureUntil(7)
+	require.NoError(t, err)
+	require.Equal(t, int64(1000), until)
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, kvs.AppendDebugCapture(7, []byte(fmt.Sprintf("record %d", i)), 3))
+	}
+	records, err := kvs.DebugCapture(7)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("record 2"), []byte("record 3"), []byte("record 4")}, records)
+
+	require.NoError(t, kvs.StartDebugCapture(7, 2000))
+	records, err = kvs.DebugCapture(7)
+	require.NoError(t, err)
+	require.Empty(t, records)
+
+	require.NoError(t, kvs.AppendDebugCapture(7, []byte("record"), 3))
+	require.NoError(t, kvs.DeleteDebugCapture(7))
+	until, err = kvs.DebugCaptureUntil(7)
+	require.NoError(t, err)
+	require.Zero(t, until)
+	records, err = kvs.DebugCapture(7)
+	require.NoError(t, err)
+	require.Empty(t, records)
+}
+
+func TestEmailQueue(t *testing.T) {
+	fr, addr := newFakeRedis(t, "")
+	defer fr.Close()
+	p, err := New(Config{Address: addr})
+	require.NoError(t, err)
+
+	require.NoError(t, p.QueueEmail("a", []byte("email a"), 100))
+	require.NoError(t, p.QueueEmail("b", []byte("email b"), 200))
+	due, err := p.DueEmails(150, 10)
+	require.NoError(t, err)
+	require.Equal(t, map[string][]byte{"a": []byte("email a")}, due)
+	due, err = p.DueEmails(250, 1)
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+
+	// queueing again reschedules
+	require.NoError(t, p.QueueEmail("a", []byte("retried a"), 300))
+	due, err = p.DueEmails(250, 10)
+	require.NoError(t, err)
+	require.Equal(t, map[string][]byte{"b": []byte("email b")}, due)
+
+	// replacing keeps when the email is due
+	replaced, err := p.ReplaceQueuedEmail("b", []byte("resealed b"))
+	require.NoError(t, err)
+	require.True(t, replaced)
+	due, err = p.DueEmails(250, 10)
+	require.NoError(t, err)
+	require.Equal(t, map[string][]byte{"b": []byte("resealed b")}, due)
+	replaced, err = p.ReplaceQueuedEmail("c", []byte("email c"))
+	require.NoError(t, err)
+	require.False(t, replaced)
+
+	require.NoError(t, p.DequeueEmail("b", nil))
+	require.NoError(t, p.DequeueEmail("a", []byte("dead a")))
+	due, err = p.DueEmails(1000, 10)
+	require.NoError(t, err)
+	require.Empty(t, due)
+	letters, err := p.DeadLetters()
+	require.NoError(t, err)
+	require.Equal(t, map[string][]byte{"a": []byte("dead a")}, letters)
+	replaced, err = p.ReplaceDeadLetter("a", []byte("resealed a"))
+	require.NoError(t, err)
+	require.True(t, replaced)
+	letters, err = p.DeadLetters()
+	require.NoError(t, err)
+	require.Equal(t, map[string][]byte{"a": []byte("resealed a")}, letters)
+
+	require.NoError(t, p.DeleteDeadLetter("a"))
+	letters, err = p.DeadLetters()
+	require.NoError(t, err)
+	require.Empty(t, letters)
+	replaced, err = p.ReplaceDeadLetter("a", []byte("resealed a"))
+	require.NoError(t, err)
+	require.False(t, replaced)
+}
+
+func TestSpentTokens(t *testing.T) {
+	fr, addr := newFakeRedis(t, "")
+	defer fr.Close()
+	p, err := New(Config{Address: addr})
+	require.NoError(t, err)
+
+	expires := time.Now().Add(time.Hour).Unix()
+	spent, err := p.SpendToken([]byte("a"), expires)
+	require.NoError(t, err)
+	require.True(t, spent)
+	spent, err = p.SpendToken([]byte("a"), expires)
+	require.NoError(t, err)
+	require.False(t, spent)
+	spent, err = p.SpendToken([]byte("b"), expires)
+	require.NoError(t, err)
+	require.True(t, spent)
+
+	// the id expires with the token
+	fr.mu.Lock()
+	ttl := fr.ttls["spent_tokens:a"]
+	fr.mu.Unlock()
+	require.InDelta(t, time.Hour.Milliseconds(), ttl, float64(time.Minute.Milliseconds()))
+}
+
+func TestBoxAliases(t *testing.T) {
+	fr, addr := newFakeRedis(t, "")
+	defer fr.Close()
+	kvs, err := New(Config{Address: addr, KeyPrefix: "oscar:"})
+	require.NoError(t, err)
+
+	now := time.Now().Unix()
+	require.NoError(t, kvs.AddBoxAlias([]byte("box"), []byte("alias 1"), 7, now+60))
+	require.NoError(t, kvs.AddBoxAlias([]byte("box"), []byte("alias 2"), 7, now+60))
+	require.NoError(t, kvs.AddBoxAlias([]byte("box"), []byte("alias 3"), 7, now-1))
+	require.Equal(t, kvstor.ErrBoxOwner, kvs.AddBoxAlias([]byte("box"), []byte("alias 4"), 8, now+60))
+
+	// alias 1 keeps the grace period it was given when alias 2 was added
+	for alias, expected := range map[string][]byte{"alias 1": []byte("box"), "alias 2": nil, "alias 3": []byte("box"), "alias 4": nil} {
+		box, err := kvs.BoxOfAlias([]byte(alias))
+		require.NoError(t, err)
+		require.Equal(t, expected, box, alias)
+	}
+
+	listed := map[string]int64{}
+	require.NoError(t, kvs.(kvstor.Lister).ListBoxAliases(func(alias, boxID []byte, ownerID int64, expires int64) error {
+		require.Equal(t, []byte("box"), boxID)
+		require.Equal(t, int64(7), ownerID)
+		listed[string(alias)] = expires
+		return nil
+	}))
+	require.Len(t, listed, 2)
+	require.Zero(t, listed["alias 3"])
+	diff := listed["alias 1"] - (now + 60)
+	require.True(t, diff >= -1 && diff <= 1, "expires: %d", listed["alias 1"])
+}
+
+func TestList(t *testing.T) {
+	fr, addr := newFakeRedis(t, "")
+	defer fr.Close()
+	kvs, err := New(Config{Address: addr, KeyPrefix: "oscar*:"})
+	require.NoError(t, err)
+	lister := kvs.(kvstor.Lister)
+
+	expires := time.Now().Add(time.Hour).Unix()
+	require.NoError(t, kvs.DropPackage([]byte("a"), []byte("box a"), 0))
+	require.NoError(t, kvs.DropPackage([]byte("b"), []byte("box b"), expires))
+	packages := map[string]int64{}
+	require.NoError(t, lister.ListPackages(func(boxID, pkg []byte, exp int64) error {
+		packages[string(boxID)+"="+string(pkg)] = exp
+		return nil
+	}))
+	require.Len(t, packages, 2)
+	require.Zero(t, packages["box a=a"])
+	// the ttl is rounded to the millisecond
+	diff := packages["box b=b"] - expires
+	require.True(t, diff >= -1 && diff <= 1, "expires: %d", packages["box b=b"])
+
+	require.NoError(t, kvs.InsertIds(300, []byte("public id")))
+	ids := map[int64]string{}
+	require.NoError(t, lister.ListIDs(func(userID int64, pubID []byte) error {
+		ids[userID] = string(pubID)
+		return nil
+	}))
+	require.Equal(t, map[int64]string{300: "public id"}, ids)
+
+	require.NoError(t, kvs.StartDebugCapture(7, 1000))
+	require.NoError(t, kvs.AppendDebugCapture(7, []byte("record"), 3))
+	captures := map[int64]int64{}
+	require.NoError(t, lister.ListDebugCaptures(func(userID int64, until int64) error {
+		captures[userID] = until
+		return nil
+	}))
+	require.Equal(t, map[int64]int64{7: 1000}, captures)
+}
+
+func TestTakeToken(t *testing.T) {
+	fr, addr := newFakeRedis(t, "")
+	defer fr.Close()
+	p, err := New(Config{Address: addr, KeyPrefix: "oscar:"})
+	require.NoError(t, err)
+	limiter := p.(interface {
+		TakeToken(bucket string, rate float64, burst int, now time.Time) (time.Duration, error)
+	})
+
+	now := time.Unix(1600000000, 0)
+	for i := 0; i < 2; i++ {
+		wait, err := limiter.TakeToken("a", 0.5, 2, now)
+		require.NoError(t, err)
+		require.Zero(t, wait)
+	}
+	wait, err := limiter.TakeToken("a", 0.5, 2, now)
+	require.NoError(t, err)
+	require.Equal(t, 2*time.Second, wait)
+	// other buckets are untouched
+	wait, err = limiter.TakeToken("b", 0.5, 2, now)
+	require.NoError(t, err)
+	require.Zero(t, wait)
+
+	// half a token later, the wait shrinks
+	wait, err = limiter.TakeToken("a", 0.5, 2, now.Add(time.Second))
+	require.NoError(t, err)
+	require.Equal(t, time.Second, wait)
+	wait, err = limiter.TakeToken("a", 0.5, 2, now.Add(2*time.Second))
+	require.NoError(t, err)
+	require.Zero(t, wait)
+
+	// the bucket expires once it would be full
+	fr.mu.Lock()
+	ttl := fr.ttls["oscar:rate_limits:a"]
+	fr.mu.Unlock()
+	require.Equal(t, int64(4000), ttl)
+}
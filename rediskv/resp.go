@@ -0,0 +1,240 @@
+package rediskv
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Error is an error reply from redis. The connection it came over is still
+// usable.
+type Error string
+
+func (e Error) Error() string {
+	return "redis: " + string(e)
+}
+
+// conn is a connection speaking RESP, the redis protocol. Replies are
+// decoded as string (simple strings), int64, []byte (bulk strings, nil when
+// null), []interface{} (arrays, nil when null) or Error.
+type conn struct {
+	nc      net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	timeout time.Duration
+}
+
+func dial(cfg Config) (*conn, error) {
+	dialer := &net.Dialer{Timeout: cfg.timeout()}
+	var nc net.Conn
+	var err error
+	if cfg.TLS {
+		nc, err = tls.DialWithDialer(dialer, "tcp", cfg.Address, nil)
+	} else {
+		nc, err = dialer.Dial("tcp", cfg.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &conn{nc: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc), timeout: cfg.timeout()}
+
+	if cfg.Password != "" {
+		if _, err = c.do("AUTH", cfg.Password); err != nil {
+			nc.Close()
+			return nil, errors.Wrap(err, "authenticating")
+		}
+	}
+	if cfg.DB != 0 {
+		if _, err = c.do("SELECT", cfg.DB); err != nil {
+			nc.Close()
+			return nil, errors.Wrapf(err, "selecting database %d", cfg.DB)
+		}
+	}
+	return c, nil
+}
+
+// do sends a command and reads its reply. An Error reply is returned as the
+// error.
+func (c *conn) do(args ...interface{}) (interface{}, error) {
+	if err := c.nc.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return nil, err
+	}
+	if err := writeCommand(c.w, args...); err != nil {
+		return nil, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	reply, err := readReply(c.r)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := reply.(Error); ok {
+		return nil, e
+	}
+	return reply, nil
+}
+
+func writeCommand(w *bufio.Writer, args ...interface{}) error {
+	w.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		var buf []byte
+		switch a := arg.(type) {
+		case string:
+			buf = []byte(a)
+		case []byte:
+			buf = a
+		case int:
+			buf = []byte(strconv.Itoa(a))
+		case int64:
+			buf = []byte(strconv.FormatInt(a, 10))
+		default:
+			return errors.Errorf("unsupported argument type %T", arg)
+		}
+		w.WriteString("$" + strconv.Itoa(len(buf)) + "\r\n")
+		w.Write(buf)
+		w.WriteString("\r\n")
+	}
+	return nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errors.Errorf("malformed reply line %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, errors.New("empty reply line")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return Error(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.Wrap(err, "malformed bulk string length")
+		}
+		if n < 0 {
+			return []byte(nil), nil
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.Wrap(err, "malformed array length")
+		}
+		if n < 0 {
+			return []interface{}(nil), nil
+		}
+		arr := make([]interface{}, n)
+		for i := range arr {
+			if arr[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	default:
+		return nil, errors.Errorf("unknown reply type %q", line[0])
+	}
+}
+
+// pool keeps idle connections for reuse, and opens at most
+// Config.MaxConns connections at once
+type pool struct {
+	cfg  Config
+	idle chan *conn
+	// slots holds a value for each open connection, idle or in use
+	slots chan struct{}
+}
+
+func newPool(cfg Config) *pool {
+	idle := cfg.poolSize()
+	if idle > cfg.maxConns() {
+		idle = cfg.maxConns()
+	}
+	return &pool{cfg: cfg, idle: make(chan *conn, idle), slots: make(chan struct{}, cfg.maxConns())}
+}
+
+// get returns an idle connection, or a new one if the pool isn't full.
+// Otherwise it waits for a connection to be returned, until ctx is done.
+func (p *pool) get(ctx context.Context) (*conn, error) {
+	select {
+	case c := <-p.idle:
+		return c, nil
+	default:
+	}
+
+	select {
+	case c := <-p.idle:
+		return c, nil
+	case p.slots <- struct{}{}:
+		c, err := dial(p.cfg)
+		if err != nil {
+			<-p.slots
+			return nil, errors.Wrap(err, "connecting to redis")
+		}
+		return c, nil
+	case <-ctx.Done():
+		return nil, errors.Wrap(ctx.Err(), "waiting for a redis connection")
+	}
+}
+
+// put returns c to the pool, or closes it if enough connections are idle
+func (p *pool) put(c *conn) {
+	select {
+	case p.idle <- c:
+	default:
+		p.discard(c)
+	}
+}
+
+// discard closes c, which frees its slot for a new connection
+func (p *pool) discard(c *conn) {
+	c.nc.Close()
+	<-p.slots
+}
+
+// do runs a command on a connection from the pool. Waiting for one is
+// limited by ctx, and by Config.Timeout.
+func (p *pool) do(ctx context.Context, args ...interface{}) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.timeout())
+	defer cancel()
+	c, err := p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := c.do(args...)
+	if _, ok := err.(Error); err != nil && !ok {
+		// the connection is in an unknown state
+		p.discard(c)
+		return nil, err
+	}
+	p.put(c)
+	return reply, err
+}
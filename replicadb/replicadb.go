@@ -0,0 +1,129 @@
+// Package replicadb provides a model.Provider that sends the lookups of the
+// read-heavy endpoints to read replicas of the database, and everything else
+// to the primary.
+package replicadb
+
+import (
+	"context"
+	"sync/atomic"
+
+	"zood.dev/oscar/model"
+)
+
+// Provider reads users and messages from its replicas, taking turns between
+// them. A read falls back to the primary when the replica fails, or when it
+// doesn't have what was asked for, which can be because the replica hasn't
+// caught up with the primary yet. Listing all the messages of a recipient
+// can't tell a lagging replica from an empty queue, so the listings go to
+// the primary.
+type Provider struct {
+	model.Provider
+	replicas []model.Provider
+	// next picks the replica of the next read. It's shared by the copies
+	// made by WithContext.
+	next *uint32
+}
+
+// New returns a Provider in front of primary. Without replicas, every
+// query goes to primary.
+func New(primary model.Provider, replicas ...model.Provider) *Provider {
+	return &Provider{Provider: primary, replicas: replicas, next: new(uint32)}
+}
+
+// WithContext fulfills model.Provider
+func (p *Provider) WithContext(ctx context.Context) model.Provider {
+	replicas := make([]model.Provider, len(p.replicas))
+	for i, r := range p.replicas {
+		replicas[i] = r.WithContext(ctx)
+	}
+	return &Provider{Provider: p.Provider.WithContext(ctx), replicas: replicas, next: p.next}
+}
+
+// replica returns the replica to read from next, or nil if there are none
+func (p *Provider) replica() model.Provider {
+	if len(p.replicas) == 0 {
+		return nil
+	}
+	i := atomic.AddUint32(p.next, 1) % uint32(len(p.replicas))
+	return p.replicas[i]
+}
+
+// read runs fn against a replica, and then against the primary if that
+// fails, or if missing reports that the replica didn't have the data
+func (p *Provider) read(fn func(db model.Provider) error, missing func() bool) error {
+	if r := p.replica(); r != nil {
+		if err := fn(r); err == nil && !missing() {
+			return nil
+		}
+	}
+	return fn(p.Provider)
+}
+
+// LimitedUserInfo fulfills model.Provider
+func (p *Provider) LimitedUserInfo(username string) (id int64, pubKey []byte, err error) {
+	err = p.read(func(db model.Provider) error {
+		id, pubKey, err = db.LimitedUserInfo(username)
+		return err
+	}, func() bool { return pubKey == nil })
+	return id, pubKey, err
+}
+
+// LimitedUserInfoID fulfills model.Provider
+func (p *Provider) LimitedUserInfoID(userID int64) (username string, pubKey []byte, err error) {
+	err = p.read(func(db model.Provider) error {
+		username, pubKey, err = db.LimitedUserInfoID(userID)
+		return err
+	}, func() bool { return pubKey == nil })
+	return username, pubKey, err
+}
+
+// LimitedUserInfoIndex fulfills model.Provider
+func (p *Provider) LimitedUserInfoIndex(index []byte) (id int64, username string, pubKey []byte, err error) {
+	err = p.read(func(db model.Provider) error {
+		id, username, pubKey, err = db.LimitedUserInfoIndex(index)
+		return err
+	}, func() bool { return pubKey == nil })
+	return id, username, pubKey, err
+}
+
+// MessageToRecipient fulfills model.Provider
+func (p *Provider) MessageToRecipient(recipientID, msgID int64) (msg *model.MessageRecord, err error) {
+	err = p.read(func(db model.Provider) error {
+		msg, err = db.MessageToRecipient(recipientID, msgID)
+		return err
+	}, func() bool { return msg == nil })
+	return msg, err
+}
+
+// MessagesToRecipient fulfills model.Provider. The primary is asked when the
+// replica has fewer of the messages than were asked for. It's also asked
+// for ids of messages that were never there, which clients don't send.
+func (p *Provider) MessagesToRecipient(recipientID int64, msgIDs []int64) (msgs []model.MessageRecord, err error) {
+	wanted := make(map[int64]bool, len(msgIDs))
+	for _, id := range msgIDs {
+		wanted[id] = true
+	}
+	err = p.read(func(db model.Provider) error {
+		msgs, err = db.MessagesToRecipient(recipientID, msgIDs)
+		return err
+	}, func() bool { return len(msgs) < len(wanted) })
+	return msgs, err
+}
+
+// UserPublicKey fulfills model.Provider
+func (p *Provider) UserPublicKey(userID int64) (pubKey []byte, err error) {
+	err = p.read(func(db model.Provider) error {
+		pubKey, err = db.UserPublicKey(userID)
+		return err
+	}, func() bool { return pubKey == nil })
+	return pubKey, err
+}
+
+// UsersWithIndexPrefix fulfills model.Provider
+func (p *Provider) UsersWithIndexPrefix(prefix []byte, limit int) (users []model.UserIndexRecord, err error) {
+	err = p.read(func(db model.Provider) error {
+		users, err = db.UsersWithIndexPrefix(prefix, limit)
+		return err
+	}, func() bool { return false })
+	return users, err
+}
@@ -0,0 +1,123 @@
+package replicadb
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/model"
+	"zood.dev/oscar/sqlite"
+)
+
+func insertUser(t *testing.T, db model.Provider, username string) int64 {
+	t.Helper()
+
+	id, err := db.InsertUser(model.UserRecord{
+		Username:                    username,
+		PublicKey:                   []byte("public-key"),
+		WrappedSecretKey:            []byte("wrapped-secret-key"),
+		WrappedSecretKeyNonce:       []byte("wrapped-secret-key-nonce"),
+		WrappedSymmetricKey:         []byte("wrapped-symmetric-key"),
+		WrappedSymmetricKeyNonce:    []byte("wrapped-symmetric-key-nonce"),
+		PasswordSalt:                []byte("salt"),
+		PasswordHashAlgorithm:       "argon2id13",
+		PasswordHashOperationsLimit: 1,
+		PasswordHashMemoryLimit:     1,
+	}, nil)
+	require.NoError(t, err)
+	return id
+}
+
+// countingDB counts the public key lookups made against it, and fails them
+// when err is set
+type countingDB struct {
+	model.Provider
+	lookups int
+	err     error
+}
+
+func (db *countingDB) UserPublicKey(userID int64) ([]byte, error) {
+	db.lookups++
+	if db.err != nil {
+		return nil, db.err
+	}
+	return db.Provider.UserPublicKey(userID)
+}
+
+func TestReadsFromReplicas(t *testing.T) {
+	primary := sqlite.NewMockDB(t)
+	userID := insertUser(t, primary, "replicated")
+	r1 := &countingDB{Provider: sqlite.NewMockDB(t)}
+	r2 := &countingDB{Provider: sqlite.NewMockDB(t)}
+	insertUser(t, r1, "replicated")
+	insertUser(t, r2, "replicated")
+
+	p := New(primary, r1, r2)
+	for i := 0; i < 4; i++ {
+		pubKey, err := p.UserPublicKey(userID)
+		require.NoError(t, err)
+		require.Equal(t, []byte("public-key"), pubKey)
+	}
+	require.Equal(t, 2, r1.lookups)
+	require.Equal(t, 2, r2.lookups)
+
+	// the primary answers when a replica fails
+	r1.err = errors.New("connection refused")
+	r2.err = r1.err
+	pubKey, err := p.UserPublicKey(userID)
+	require.NoError(t, err)
+	require.Equal(t, []byte("public-key"), pubKey)
+
+	// without replicas, everything goes to the primary
+	pubKey, err = New(primary).UserPublicKey(userID)
+	require.NoError(t, err)
+	require.Equal(t, []byte("public-key"), pubKey)
+}
+
+func TestFallsBackWhenReplicaLags(t *testing.T) {
+	primary := sqlite.NewMockDB(t)
+	replica := sqlite.NewMockDB(t)
+	p := New(primary, replica)
+
+	userID := insertUser(t, primary, "newcomer")
+	id, pubKey, err := p.LimitedUserInfo("newcomer")
+	require.NoError(t, err)
+	require.Equal(t, userID, id)
+	require.Equal(t, []byte("public-key"), pubKey)
+
+	msgID, err := primary.InsertMessage(userID, userID, []byte("cipher"), []byte("nonce"), 1)
+	require.NoError(t, err)
+	msg, err := p.MessageToRecipient(userID, msgID)
+	require.NoError(t, err)
+	require.NotNil(t, msg)
+	msgs, err := p.MessagesToRecipient(userID, []int64{msgID})
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+
+	// a missing user is missing from the primary too
+	_, pubKey, err = p.LimitedUserInfo("nobody")
+	require.NoError(t, err)
+	require.Nil(t, pubKey)
+}
+
+func TestListsMessagesFromPrimary(t *testing.T) {
+	primary := sqlite.NewMockDB(t)
+	replica := sqlite.NewMockDB(t)
+	p := New(primary, replica)
+	userID := insertUser(t, primary, "recipient")
+	insertUser(t, replica, "recipient")
+
+	// the replica hasn't caught up with the message yet
+	_, err := primary.InsertMessage(userID, userID, []byte("cipher"), []byte("nonce"), 1)
+	require.NoError(t, err)
+	msgs, err := p.MessageRecords(userID)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	n := 0
+	err = p.EachMessageRecord(userID, func(model.MessageRecord) error {
+		n++
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+}
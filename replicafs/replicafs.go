@@ -0,0 +1,163 @@
+// Package replicafs implements a filestor.Provider that keeps a copy of every
+// file in each of several other providers, so files survive the outage or loss
+// of any one of them.
+package replicafs
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+	"zood.dev/oscar/filestor"
+)
+
+// errWriteStopped aborts the writes to the other replicas when one of them
+// fails
+var errWriteStopped = errors.New("write to another replica failed")
+
+type replicaProvider struct {
+	replicas []filestor.Provider
+}
+
+// New returns a filestor.Provider that writes every file to all the replicas,
+// and reads from the first replica that can serve the file. A write only
+// succeeds when it succeeds on every replica, so a replica that was down
+// never silently holds an older copy of a file that was saved.
+func New(replicas ...filestor.Provider) (filestor.Provider, error) {
+	if len(replicas) < 2 {
+		return nil, errors.Errorf("need at least 2 replicas, got %d", len(replicas))
+	}
+	return replicaProvider{replicas: replicas}, nil
+}
+
+// WithContext fulfills filestor.Provider
+func (rp replicaProvider) WithContext(ctx context.Context) filestor.Provider {
+	replicas := make([]filestor.Provider, len(rp.replicas))
+	for i, p := range rp.replicas {
+		replicas[i] = p.WithContext(ctx)
+	}
+	return replicaProvider{replicas: replicas}
+}
+
+// FileSize fulfills filestor.Provider
+func (rp replicaProvider) FileSize(relPath string) (int64, error) {
+	var firstErr error
+	for _, p := range rp.replicas {
+		size, err := p.FileSize(relPath)
+		if err == nil {
+			return size, nil
+		}
+		firstErr = pickErr(firstErr, err)
+	}
+	return 0, firstErr
+}
+
+// ReadFile fulfills filestor.Provider. A replica that fails or doesn't have
+// the file is skipped. ErrFileNotExist is only returned when no replica has
+// the file.
+func (rp replicaProvider) ReadFile(relPath string) (io.ReadCloser, error) {
+	var firstErr error
+	for _, p := range rp.replicas {
+		rc, err := p.ReadFile(relPath)
+		if err == nil {
+			return rc, nil
+		}
+		firstErr = pickErr(firstErr, err)
+	}
+	return nil, firstErr
+}
+
+// pickErr returns the error to report after a replica failed with err. An
+// outage is more useful to report than a missing file, since the file might
+// be on the replica that's down.
+func pickErr(prev, err error) error {
+	if prev == nil || (prev == filestor.ErrFileNotExist && err != filestor.ErrFileNotExist) {
+		return err
+	}
+	return prev
+}
+
+// WriteFile fulfills filestor.Provider. src is streamed to every replica at
+// once. If src or any replica fails, the writes to the rest are aborted, so
+// they keep the previous contents of the file. Only a replica failing after
+// it received the whole file can leave the others with the new contents.
+func (rp replicaProvider) WriteFile(relPath string, src io.Reader) error {
+	pws := make([]*io.PipeWriter, len(rp.replicas))
+	writers := make([]io.Writer, len(rp.replicas))
+	errs := make([]error, len(rp.replicas))
+	wg := sync.WaitGroup{}
+	for i, p := range rp.replicas {
+		pr, pw := io.Pipe()
+		pws[i] = pw
+		writers[i] = pw
+		wg.Add(1)
+		go func(i int, p filestor.Provider, pr *io.PipeReader) {
+			defer wg.Done()
+			errs[i] = p.WriteFile(relPath, pr)
+			// unblock the copy if the write stopped early
+			pr.CloseWithError(errWriteStopped)
+		}(i, p, pr)
+	}
+
+	_, err := io.Copy(io.MultiWriter(writers...), src)
+	for _, pw := range pws {
+		if err != nil {
+			pw.CloseWithError(err)
+		} else {
+			pw.Close()
+		}
+	}
+	wg.Wait()
+
+	// report the replica that failed, rather than the ones it aborted
+	var aborted error
+	for i, replicaErr := range errs {
+		if replicaErr == nil {
+			continue
+		}
+		replicaErr = errors.Wrapf(replicaErr, "replica %d", i)
+		if errors.Cause(replicaErr) != errWriteStopped {
+			return replicaErr
+		}
+		if aborted == nil {
+			aborted = replicaErr
+		}
+	}
+	if aborted != nil {
+		return aborted
+	}
+	return err
+}
+
+// ListFiles fulfills filestor.Provider. Every replica is listed, so a file
+// that's only left on some of them is still found, and each path is reported
+// once.
+func (rp replicaProvider) ListFiles(dir string, fn func(relPath string) error) error {
+	seen := map[string]bool{}
+	for i, p := range rp.replicas {
+		err := p.ListFiles(dir, func(relPath string) error {
+			if seen[relPath] {
+				return nil
+			}
+			seen[relPath] = true
+			return fn(relPath)
+		})
+		if err != nil {
+			return errors.Wrapf(err, "replica %d", i)
+		}
+	}
+	return nil
+}
+
+// DeleteFile fulfills filestor.Provider. The file is deleted from every
+// replica, even when some of them fail.
+func (rp replicaProvider) DeleteFile(relPath string) error {
+	var firstErr error
+	for i, p := range rp.replicas {
+		if err := p.DeleteFile(relPath); err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "replica %d", i)
+		}
+	}
+	return firstErr
+}
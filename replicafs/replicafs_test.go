@@ -0,0 +1,145 @@
+package replicafs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/filestor"
+	"zood.dev/oscar/memfs"
+)
+
+var errOutage = errors.New("storage is down")
+
+// downProvider fails every operation, after reading a little of what it's
+// asked to write
+type downProvider struct{}
+
+func (downProvider) FileSize(string) (int64, error)                   { return 0, errOutage }
+func (downProvider) ReadFile(string) (io.ReadCloser, error)           { return nil, errOutage }
+func (downProvider) ListFiles(string, func(string) error) error       { return errOutage }
+func (downProvider) DeleteFile(string) error                          { return errOutage }
+func (dp downProvider) WithContext(context.Context) filestor.Provider { return dp }
+func (downProvider) WriteFile(relPath string, src io.Reader) error {
+	src.Read(make([]byte, 4))
+	return errOutage
+}
+
+func TestNeedsReplicas(t *testing.T) {
+	_, err := New(memfs.New())
+	require.Error(t, err)
+}
+
+func TestWritesToEveryReplica(t *testing.T) {
+	a, b := memfs.New(), memfs.New()
+	p, err := New(a, b)
+	require.NoError(t, err)
+	data := bytes.Repeat([]byte("backup"), 100000)
+	require.NoError(t, p.WriteFile("backups/1", bytes.NewReader(data)))
+
+	for _, replica := range []filestor.Provider{a, b} {
+		buf, err := filestor.ReadAll(replica, "backups/1")
+		require.NoError(t, err)
+		require.Equal(t, data, buf)
+	}
+	size, err := p.FileSize("backups/1")
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), size)
+}
+
+func TestReadsFromHealthyReplica(t *testing.T) {
+	b := memfs.New()
+	require.NoError(t, b.WriteFile("backups/1", bytes.NewReader([]byte("hello"))))
+	p, err := New(downProvider{}, b)
+	require.NoError(t, err)
+
+	buf, err := filestor.ReadAll(p, "backups/1")
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello"), buf)
+	size, err := p.FileSize("backups/1")
+	require.NoError(t, err)
+	require.Equal(t, int64(5), size)
+
+	// the file might be on the replica that's down
+	_, err = p.ReadFile("backups/2")
+	require.Equal(t, errOutage, err)
+
+	// a file that's on no replica doesn't exist
+	p, err = New(memfs.New(), b)
+	require.NoError(t, err)
+	_, err = p.ReadFile("backups/2")
+	require.Equal(t, filestor.ErrFileNotExist, err)
+	_, err = p.FileSize("backups/2")
+	require.Equal(t, filestor.ErrFileNotExist, err)
+}
+
+func TestFailedWriteKeepsFile(t *testing.T) {
+	b := memfs.New()
+	require.NoError(t, b.WriteFile("backups/1", bytes.NewReader([]byte("old"))))
+	p, err := New(downProvider{}, b)
+	require.NoError(t, err)
+
+	err = p.WriteFile("backups/1", bytes.NewReader(bytes.Repeat([]byte("new"), 100000)))
+	require.Error(t, err)
+	require.Equal(t, errOutage, errors.Cause(err))
+	buf, err := filestor.ReadAll(b, "backups/1")
+	require.NoError(t, err)
+	require.Equal(t, []byte("old"), buf)
+}
+
+func TestFailedSourceKeepsFile(t *testing.T) {
+	a, b := memfs.New(), memfs.New()
+	p, err := New(a, b)
+	require.NoError(t, err)
+	require.NoError(t, p.WriteFile("backups/1", bytes.NewReader([]byte("old"))))
+
+	src := io.MultiReader(bytes.NewReader([]byte("new")), failingReader{})
+	require.Error(t, p.WriteFile("backups/1", src))
+	for _, replica := range []filestor.Provider{a, b} {
+		buf, err := filestor.ReadAll(replica, "backups/1")
+		require.NoError(t, err)
+		require.Equal(t, []byte("old"), buf)
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestListAndDelete(t *testing.T) {
+	a, b := memfs.New(), memfs.New()
+	p, err := New(a, b)
+	require.NoError(t, err)
+	require.NoError(t, p.WriteFile("backups/1", bytes.NewReader([]byte("both"))))
+	// left on a single replica by an aborted write
+	require.NoError(t, b.WriteFile("backups/2", bytes.NewReader([]byte("one"))))
+
+	var listed []string
+	require.NoError(t, p.ListFiles("backups", func(relPath string) error {
+		listed = append(listed, relPath)
+		return nil
+	}))
+	require.ElementsMatch(t, []string{"backups/1", "backups/2"}, listed)
+
+	require.NoError(t, p.DeleteFile("backups/2"))
+	require.NoError(t, p.DeleteFile("backups/1"))
+	for _, replica := range []filestor.Provider{a, b} {
+		_, err = replica.FileSize("backups/1")
+		require.Equal(t, filestor.ErrFileNotExist, err)
+		_, err = replica.FileSize("backups/2")
+		require.Equal(t, filestor.ErrFileNotExist, err)
+	}
+
+	// the healthy replicas are still cleaned up when one fails
+	require.NoError(t, b.WriteFile("backups/3", bytes.NewReader([]byte("one"))))
+	p, err = New(downProvider{}, b)
+	require.NoError(t, err)
+	require.Error(t, p.DeleteFile("backups/3"))
+	_, err = b.FileSize("backups/3")
+	require.Equal(t, filestor.ErrFileNotExist, err)
+}
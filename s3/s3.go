@@ -0,0 +1,269 @@
+// Package s3 implements filestor.Provider against AWS S3, and S3-compatible
+// services like MinIO and Wasabi.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"zood.dev/oscar/filestor"
+)
+
+// Config describes the bucket the provider stores files in
+type Config struct {
+	Region string
+	Bucket string
+	// Endpoint is the root of an S3-compatible API, e.g.
+	// "https://s3.wasabisys.com". When empty, the AWS endpoint of Region is
+	// used.
+	Endpoint string
+	// PathStyle puts the bucket in the path of object urls, rather than in
+	// the host name. MinIO needs it, unless it's set up with a domain.
+	PathStyle       bool
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is only needed with temporary credentials
+	SessionToken string
+	// HTTPClient sends the requests. When nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+}
+
+type s3Provider struct {
+	ctx    context.Context
+	client *http.Client
+	signer signer
+	// base is the url of the bucket, without a trailing slash
+	base *url.URL
+	now  func() time.Time
+}
+
+// New returns a filestor.Provider backed by the S3 bucket in cfg. It checks
+// the bucket is reachable with the credentials.
+func New(cfg Config) (filestor.Provider, error) {
+	sp, err := newProvider(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err = sp.checkBucket(); err != nil {
+		return nil, errors.Wrapf(err, "unable to access bucket '%s'", cfg.Bucket)
+	}
+	return sp, nil
+}
+
+func newProvider(cfg Config) (s3Provider, error) {
+	if cfg.Bucket == "" {
+		return s3Provider{}, errors.New("must provide a bucket name")
+	}
+	if cfg.Region == "" {
+		return s3Provider{}, errors.New("must provide a region")
+	}
+	if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return s3Provider{}, errors.New("must provide an access key id and secret access key")
+	}
+
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", cfg.Region)
+	}
+	base, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		return s3Provider{}, errors.Wrap(err, "invalid endpoint")
+	}
+	if base.Scheme != "https" && base.Scheme != "http" {
+		return s3Provider{}, errors.Errorf("endpoint '%s' must be http or https", endpoint)
+	}
+	if cfg.PathStyle {
+		base.Path += "/" + cfg.Bucket
+	} else {
+		base.Host = cfg.Bucket + "." + base.Host
+	}
+
+	client := cfg.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return s3Provider{
+		ctx:    context.Background(),
+		client: client,
+		signer: signer{
+			accessKeyID:     cfg.AccessKeyID,
+			secretAccessKey: cfg.SecretAccessKey,
+			sessionToken:    cfg.SessionToken,
+			region:          cfg.Region,
+		},
+		base: base,
+		now:  time.Now,
+	}, nil
+}
+
+// WithContext fulfills filestor.Provider
+func (sp s3Provider) WithContext(ctx context.Context) filestor.Provider {
+	sp.ctx = ctx
+	return sp
+}
+
+func (sp s3Provider) FileSize(relPath string) (int64, error) {
+	resp, err := sp.do(http.MethodHead, relPath, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+func (sp s3Provider) ReadFile(relPath string) (io.ReadCloser, error) {
+	resp, err := sp.do(http.MethodGet, relPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// WriteFile buffers src in memory, since the signature covers the hash of
+// the body, and S3 needs its length up front
+func (sp s3Provider) WriteFile(relPath string, src io.Reader) error {
+	body, err := ioutil.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	resp, err := sp.do(http.MethodPut, relPath, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// listBucketResult is a page of a ListObjectsV2 response
+type listBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// ListFiles lists the bucket a page at a time, with ListObjectsV2
+func (sp s3Provider) ListFiles(dir string, fn func(relPath string) error) error {
+	q := url.Values{"list-type": {"2"}}
+	if dir != "" {
+		q.Set("prefix", strings.TrimSuffix(dir, "/")+"/")
+	}
+	for {
+		resp, err := sp.do(http.MethodGet, "?"+q.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		page := listBucketResult{}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return errors.Wrap(err, "invalid list response")
+		}
+		for _, obj := range page.Contents {
+			if err = fn(obj.Key); err != nil {
+				return err
+			}
+		}
+		if !page.IsTruncated {
+			return nil
+		}
+		q.Set("continuation-token", page.NextContinuationToken)
+	}
+}
+
+func (sp s3Provider) DeleteFile(relPath string) error {
+	resp, err := sp.do(http.MethodDelete, relPath, nil)
+	if err != nil {
+		if err == filestor.ErrFileNotExist {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// checkBucket makes a request the bucket's owner is always allowed to make
+func (sp s3Provider) checkBucket() error {
+	resp, err := sp.do(http.MethodHead, "", nil)
+	if err != nil {
+		if err == filestor.ErrFileNotExist {
+			return errors.New("the bucket does not exist")
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends a signed request for the object at relPath, or the bucket itself
+// when relPath is empty. relPath may carry a query, for requests about the
+// bucket. A 404 is returned as filestor.ErrFileNotExist, and other failures
+// as *Error.
+func (sp s3Provider) do(method, relPath string, body []byte) (*http.Response, error) {
+	u := *sp.base
+	if q := strings.IndexByte(relPath, '?'); q != -1 {
+		u.RawQuery = relPath[q+1:]
+		relPath = relPath[:q]
+	}
+	if relPath != "" {
+		u.Path += "/" + strings.TrimPrefix(relPath, "/")
+	}
+	// send the path escaped exactly the way it was signed
+	u.RawPath = escapePath(u.Path)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(sp.ctx)
+	// send the query escaped exactly the way it's signed
+	req.URL.RawQuery = canonicalQuery(req)
+	payloadHash := emptyPayloadHash
+	if body != nil {
+		payloadHash = hashHex(body)
+	}
+	sp.signer.sign(req, payloadHash, sp.now())
+
+	resp, err := sp.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, filestor.ErrFileNotExist
+	}
+	apiErr := &Error{StatusCode: resp.StatusCode}
+	// HEAD responses have no body, so only the status is known
+	buf, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	xml.Unmarshal(buf, apiErr)
+	return nil, apiErr
+}
+
+// Error is a failed request to S3
+type Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("s3: %s (%d): %s", e.Code, e.StatusCode, e.Message)
+}
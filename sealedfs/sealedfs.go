@@ -0,0 +1,283 @@
+// Package sealedfs wraps a filestor.Provider, so files are encrypted before
+// they reach it and decrypted when they're read back.
+package sealedfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+
+	"github.com/pkg/errors"
+	"zood.dev/oscar/filestor"
+	"zood.dev/oscar/sodium"
+)
+
+// magic starts every sealed file. It's followed by the id of the key, and
+// then a sodium secret stream.
+var magic = []byte("OSCRSFS1")
+
+const keyIDSize = 4
+
+const headerSize = 8 + keyIDSize
+
+type key struct {
+	id  []byte
+	key []byte
+}
+
+type sealedProvider struct {
+	p       filestor.Provider
+	current key
+	// previous keys can still open files sealed under them
+	previous []key
+}
+
+// New returns a filestor.Provider that seals every file written to p with
+// current. Files sealed under one of the previous keys can still be read.
+// Files without the sealed header are read as they are, so sealing can be
+// turned on for storage that already holds files. They're sealed the next
+// time they're written.
+func New(p filestor.Provider, current []byte, previous ...[]byte) (filestor.Provider, error) {
+	sp := sealedProvider{p: p}
+	var err error
+	if sp.current, err = newKey(current); err != nil {
+		return nil, err
+	}
+	for _, prev := range previous {
+		k, err := newKey(prev)
+		if err != nil {
+			return nil, err
+		}
+		sp.previous = append(sp.previous, k)
+	}
+	return sp, nil
+}
+
+func newKey(k []byte) (key, error) {
+	if len(k) != sodium.SymmetricKeySize {
+		return key{}, errors.Errorf("invalid key size (%d); should be %d bytes", len(k), sodium.SymmetricKeySize)
+	}
+	hash := sha256.Sum256(k)
+	return key{id: hash[:keyIDSize], key: k}, nil
+}
+
+func (sp sealedProvider) keyWithID(id []byte) []byte {
+	for _, k := range append([]key{sp.current}, sp.previous...) {
+		if bytes.Equal(k.id, id) {
+			return k.key
+		}
+	}
+	return nil
+}
+
+// WithContext fulfills filestor.Provider
+func (sp sealedProvider) WithContext(ctx context.Context) filestor.Provider {
+	sp.p = sp.p.WithContext(ctx)
+	return sp
+}
+
+// FileSize fulfills filestor.Provider. It returns the size of the plaintext,
+// which takes reading the header of the file.
+func (sp sealedProvider) FileSize(relPath string) (int64, error) {
+	size, err := sp.p.FileSize(relPath)
+	if err != nil {
+		return 0, err
+	}
+	rc, err := sp.p.ReadFile(relPath)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(rc, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+	if !bytes.HasPrefix(header[:n], magic) {
+		return size, nil
+	}
+	ptSize := sodium.SecretStreamPlaintextSize(size - headerSize)
+	if ptSize < 0 {
+		return 0, sodium.ErrSecretStreamCorrupt
+	}
+	return ptSize, nil
+}
+
+// readCloser decrypts with its Reader, and closes the underlying file
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// ReadFile fulfills filestor.Provider
+func (sp sealedProvider) ReadFile(relPath string) (io.ReadCloser, error) {
+	rc, err := sp.p.ReadFile(relPath)
+	if err != nil {
+		return nil, err
+	}
+	r, err := sp.open(rc)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return readCloser{Reader: r, Closer: rc}, nil
+}
+
+func (sp sealedProvider) open(src io.Reader) (io.Reader, error) {
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(src, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF || (err == nil && !bytes.HasPrefix(header, magic)) {
+		// written before sealing was turned on
+		return io.MultiReader(bytes.NewReader(header[:n]), src), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	k := sp.keyWithID(header[len(magic):])
+	if k == nil {
+		return nil, errors.New("file is sealed under an unknown key")
+	}
+	return sodium.NewSecretStreamReader(src, k)
+}
+
+// WriteFile fulfills filestor.Provider
+func (sp sealedProvider) WriteFile(relPath string, src io.Reader) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(sp.seal(src, pw))
+	}()
+	err := sp.p.WriteFile(relPath, pr)
+	// unblock the sealing if the write stopped early
+	pr.CloseWithError(errors.New("write stopped"))
+	return err
+}
+
+func (sp sealedProvider) seal(src io.Reader, dst io.Writer) error {
+	header := append(append([]byte{}, magic...), sp.current.id...)
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+	w, err := sodium.NewSecretStreamWriter(dst, sp.current.key)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, src); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// ListFiles fulfills filestor.Provider. Sealing doesn't change the paths of
+// files.
+func (sp sealedProvider) ListFiles(dir string, fn func(relPath string) error) error {
+	return sp.p.ListFiles(dir, fn)
+}
+
+// DeleteFile fulfills filestor.Provider
+func (sp sealedProvider) DeleteFile(relPath string) error {
+	return sp.p.DeleteFile(relPath)
+}
+
+// Reseal seals the files in dir that are sealed under one of the previous
+// keys of p again, under its current key, and returns how many it resealed.
+// p must have been returned by New. Files without the sealed header are left
+// as they are, since reading them takes no key.
+func Reseal(p filestor.Provider, dir string) (int, error) {
+	sp, ok := p.(sealedProvider)
+	if !ok {
+		return 0, errors.New("not a sealed provider")
+	}
+
+	// listed first, so the listing doesn't see the files being replaced
+	var stale []string
+	err := sp.p.ListFiles(dir, func(relPath string) error {
+		id, err := sp.keyID(relPath)
+		if err == filestor.ErrFileNotExist {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if id != nil && !bytes.Equal(id, sp.current.id) {
+			stale = append(stale, relPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, relPath := range stale {
+		rc, err := sp.ReadFile(relPath)
+		if err == filestor.ErrFileNotExist {
+			// deleted since it was listed
+			continue
+		}
+		if err != nil {
+			return n, errors.Wrapf(err, "reading %s", relPath)
+		}
+		// the file is only replaced once the write completes, so it can be
+		// read while it's written
+		err = sp.WriteFile(relPath, rc)
+		rc.Close()
+		if err != nil {
+			return n, errors.Wrapf(err, "resealing %s", relPath)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// KeyIDs counts the files in dir by the id of the key they're sealed under,
+// hex encoded. Key ids are the first 4 bytes of the SHA-256 of the key.
+// p must have been returned by New. Files without the sealed header aren't
+// counted.
+func KeyIDs(p filestor.Provider, dir string) (map[string]int, error) {
+	sp, ok := p.(sealedProvider)
+	if !ok {
+		return nil, errors.New("not a sealed provider")
+	}
+
+	counts := map[string]int{}
+	err := sp.p.ListFiles(dir, func(relPath string) error {
+		id, err := sp.keyID(relPath)
+		if err == filestor.ErrFileNotExist {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if id != nil {
+			counts[hex.EncodeToString(id)]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// keyID returns the id of the key the file is sealed under, or nil if it
+// isn't sealed
+func (sp sealedProvider) keyID(relPath string) ([]byte, error) {
+	rc, err := sp.p.ReadFile(relPath)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	header := make([]byte, headerSize)
+	if _, err = io.ReadFull(rc, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(header, magic) {
+		return nil, nil
+	}
+	return header[len(magic):], nil
+}
@@ -0,0 +1,162 @@
+package sealedfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/filestor"
+	"zood.dev/oscar/memfs"
+	"zood.dev/oscar/sodium"
+)
+
+func newKeyBytes(t *testing.T) []byte {
+	k := make([]byte, sodium.SymmetricKeySize)
+	require.NoError(t, sodium.Random(k))
+	return k
+}
+
+func TestSealedProvider(t *testing.T) {
+	under := memfs.New()
+	p, err := New(under, newKeyBytes(t))
+	require.NoError(t, err)
+
+	_, err = p.ReadFile("should-not-exist")
+	require.Equal(t, filestor.ErrFileNotExist, err)
+	_, err = p.FileSize("should-not-exist")
+	require.Equal(t, filestor.ErrFileNotExist, err)
+
+	for _, size := range []int{0, 1, sodium.SecretStreamChunkSize, 2*sodium.SecretStreamChunkSize + 7} {
+		data := make([]byte, size)
+		require.NoError(t, sodium.Random(data))
+		require.NoError(t, p.WriteFile("backups/1.db", bytes.NewReader(data)))
+
+		dst, err := filestor.ReadAll(p, "backups/1.db")
+		require.NoError(t, err)
+		require.Equal(t, data, dst)
+		ptSize, err := p.FileSize("backups/1.db")
+		require.NoError(t, err)
+		require.Equal(t, int64(size), ptSize)
+
+		// the underlying provider only holds the sealed file
+		raw, err := filestor.ReadAll(under, "backups/1.db")
+		require.NoError(t, err)
+		require.True(t, bytes.HasPrefix(raw, magic))
+		if size >= 16 {
+			require.False(t, bytes.Contains(raw, data))
+		}
+	}
+}
+
+func TestUnsealedFiles(t *testing.T) {
+	under := memfs.New()
+	p, err := New(under, newKeyBytes(t))
+	require.NoError(t, err)
+
+	for _, data := range []string{"", "short", "a plaintext file written before sealing was turned on"} {
+		require.NoError(t, under.WriteFile("old.txt", bytes.NewBufferString(data)))
+		dst, err := filestor.ReadAll(p, "old.txt")
+		require.NoError(t, err)
+		require.Equal(t, data, string(dst))
+		size, err := p.FileSize("old.txt")
+		require.NoError(t, err)
+		require.Equal(t, int64(len(data)), size)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	under := memfs.New()
+	oldKey := newKeyBytes(t)
+	p, err := New(under, oldKey)
+	require.NoError(t, err)
+	require.NoError(t, p.WriteFile("file", bytes.NewBufferString("sealed under the old key")))
+
+	// the old key still opens it once it's been rotated out
+	rotated, err := New(under, newKeyBytes(t), oldKey)
+	require.NoError(t, err)
+	dst, err := filestor.ReadAll(rotated, "file")
+	require.NoError(t, err)
+	require.Equal(t, "sealed under the old key", string(dst))
+
+	// but not once it's dropped
+	dropped, err := New(under, newKeyBytes(t))
+	require.NoError(t, err)
+	_, err = dropped.ReadFile("file")
+	require.Error(t, err)
+
+	_, err = New(under, []byte("too short"))
+	require.Error(t, err)
+}
+
+func TestReseal(t *testing.T) {
+	under := memfs.New()
+	oldKey := newKeyBytes(t)
+	p, err := New(under, oldKey)
+	require.NoError(t, err)
+	require.NoError(t, p.WriteFile("dir/old", bytes.NewBufferString("sealed under the old key")))
+	require.NoError(t, under.WriteFile("dir/plain", bytes.NewBufferString("never sealed")))
+
+	newKey := newKeyBytes(t)
+	rotated, err := New(under, newKey, oldKey)
+	require.NoError(t, err)
+	require.NoError(t, rotated.WriteFile("dir/new", bytes.NewBufferString("sealed under the new key")))
+	oldID, newID := sha256.Sum256(oldKey), sha256.Sum256(newKey)
+	ids, err := KeyIDs(rotated, "dir")
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{hex.EncodeToString(oldID[:4]): 1, hex.EncodeToString(newID[:4]): 1}, ids)
+	n, err := Reseal(rotated, "dir")
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	n, err = Reseal(rotated, "dir")
+	require.NoError(t, err)
+	require.Zero(t, n)
+	ids, err = KeyIDs(rotated, "dir")
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{hex.EncodeToString(newID[:4]): 2}, ids)
+
+	// the old key is no longer needed
+	dropped, err := New(under, newKey)
+	require.NoError(t, err)
+	for path, want := range map[string]string{
+		"dir/old":   "sealed under the old key",
+		"dir/new":   "sealed under the new key",
+		"dir/plain": "never sealed",
+	} {
+		dst, err := filestor.ReadAll(dropped, path)
+		require.NoError(t, err)
+		require.Equal(t, want, string(dst))
+	}
+
+	_, err = Reseal(under, "dir")
+	require.Error(t, err)
+}
+
+func TestTampering(t *testing.T) {
+	under := memfs.New()
+	p, err := New(under, newKeyBytes(t))
+	require.NoError(t, err)
+	require.NoError(t, p.WriteFile("file", bytes.NewBufferString("don't touch this")))
+
+	sealed, err := filestor.ReadAll(under, "file")
+	require.NoError(t, err)
+	sealed[len(sealed)-1] ^= 1
+	require.NoError(t, under.WriteFile("file", bytes.NewReader(sealed)))
+	_, err = filestor.ReadAll(p, "file")
+	require.Equal(t, sodium.ErrSecretStreamCorrupt, err)
+}
+
+func TestWithContext(t *testing.T) {
+	p, err := New(memfs.New(), newKeyBytes(t))
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	bound := p.WithContext(ctx)
+	require.Equal(t, context.Canceled, bound.WriteFile("file", bytes.NewBufferString("data")))
+	_, err = bound.ReadFile("file")
+	require.Equal(t, context.Canceled, err)
+	require.NoError(t, p.WriteFile("file", bytes.NewBufferString("data")))
+}
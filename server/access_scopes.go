@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"zood.dev/oscar/model"
+)
+
+// accessScope limits what a ticket or access token can be used for, so one
+// can be handed to something less trusted than the app, like a share link.
+// Tickets and access tokens without scopes can be used for anything.
+type accessScope string
+
+// Scopes routes can allow
+const (
+	scopeMessagesRead    accessScope = "messages-read"
+	scopeDropBoxReadOnly accessScope = "drop-box-read-only"
+)
+
+var knownScopes = map[accessScope]bool{
+	scopeMessagesRead:    true,
+	scopeDropBoxReadOnly: true,
+}
+
+// joinScopes checks that scopes are known, and returns them the way they're
+// stored, separated by spaces
+func joinScopes(scopes []accessScope) (string, error) {
+	names := make([]string, 0, len(scopes))
+	seen := map[accessScope]bool{}
+	for _, s := range scopes {
+		if !knownScopes[s] {
+			return "", fmt.Errorf("unknown scope '%s'", s)
+		}
+		if !seen[s] {
+			seen[s] = true
+			names = append(names, string(s))
+		}
+	}
+	return strings.Join(names, " "), nil
+}
+
+// sessionCredential is who an access token or ticket authenticates, and
+// what for
+type sessionCredential struct {
+	// userID is 0 when the access token and ticket were both invalid
+	userID int64
+	scopes string
+	status model.UserStatusRecord
+	// ticket is whether it's a ticket rather than an access token
+	ticket bool
+}
+
+// allows returns whether the credential can be used for a route that
+// allows scoped credentials with one of allowed
+func (sc sessionCredential) allows(allowed []accessScope) bool {
+	if sc.scopes == "" {
+		return true
+	}
+	for _, s := range strings.Fields(sc.scopes) {
+		for _, a := range allowed {
+			if accessScope(s) == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyCredential returns the credential of the access token, or of the
+// ticket when the access token isn't valid. The use of an access token is
+// recorded as its session's last, except by replicas, which don't write to
+// their storage.
+func verifyCredential(providers *serverProviders, token, ticket string) (sessionCredential, error) {
+	db := providers.db
+	now := providers.now()
+	atr, err := verifyAccessToken(db, token, now)
+	if err != nil {
+		return sessionCredential{}, err
+	}
+	if atr != nil {
+		if providers.replica == nil {
+			touchSession(db, atr, now)
+		}
+		return sessionCredential{userID: atr.UserID, scopes: atr.Scopes, status: atr.UserStatusRecord}, nil
+	}
+	tr, err := verifySessionTicket(db, ticket, now)
+	if err != nil {
+		return sessionCredential{}, err
+	}
+	if tr != nil {
+		return sessionCredential{userID: tr.UserID, scopes: tr.Scopes, status: tr.UserStatusRecord, ticket: true}, nil
+	}
+	return sessionCredential{}, nil
+}
+
+func sendScopeNotAllowed(w http.ResponseWriter) {
+	sendErr(w, "the scopes of the access token or ticket don't allow this request", http.StatusForbidden, errorInsufficientPermission)
+}
+
+// createScopedAccessTokenHandler handles POST /sessions/scoped-tokens. It
+// issues an access token that can only be used for the scopes in the body.
+// It lasts as long as other access tokens, and can't be refreshed.
+func createScopedAccessTokenHandler(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Scopes []accessScope `json:"scopes"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendBadReq(w, "unable to parse POST body: "+err.Error())
+		return
+	}
+	if len(body.Scopes) == 0 {
+		sendBadReq(w, "at least one scope is required")
+		return
+	}
+	scopes, err := joinScopes(body.Scopes)
+	if err != nil {
+		sendBadReq(w, err.Error())
+		return
+	}
+
+	userID := userIDFromContext(r.Context())
+	providers := providersCtx(r.Context())
+	db := providers.db
+	now := providers.now()
+	accessToken, err := sealAccessToken(providers.keys, sessionToken{
+		Name:         db.Username(userID),
+		CreationDate: now.Unix(),
+	})
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	expiresAt := now.Add(accessTokenTTL).Unix()
+	if err = db.InsertScopedAccessToken(accessToken, userID, expiresAt, scopes); err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+
+	sendSuccess(w, struct {
+		AccessToken string   `json:"access_token"`
+		ExpiresAt   int64    `json:"expires_at"`
+		Scopes      []string `json:"scopes"`
+	}{AccessToken: accessToken, ExpiresAt: expiresAt, Scopes: strings.Fields(scopes)})
+}
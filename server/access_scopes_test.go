@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/apierr"
+	"zood.dev/oscar/sodium"
+)
+
+func TestJoinScopes(t *testing.T) {
+	scopes, err := joinScopes(nil)
+	require.NoError(t, err)
+	require.Empty(t, scopes)
+	scopes, err = joinScopes([]accessScope{scopeMessagesRead, scopeDropBoxReadOnly, scopeMessagesRead})
+	require.NoError(t, err)
+	require.Equal(t, "messages-read drop-box-read-only", scopes)
+	_, err = joinScopes([]accessScope{"everything"})
+	require.Error(t, err)
+
+	require.True(t, sessionCredential{}.allows(nil))
+	require.False(t, sessionCredential{scopes: scopes}.allows(nil))
+	require.True(t, sessionCredential{scopes: scopes}.allows([]accessScope{scopeDropBoxReadOnly}))
+}
+
+func TestScopedCredentials(t *testing.T) {
+	providers := createTestProviders(t)
+	router := newOscarRouter(providers)
+	user, keyPair := createTestUser(t, providers)
+	accessToken := loginTestUser(t, providers, user, keyPair)
+
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("X-Oscar-Access-Token", token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	requireForbidden := func(w *httptest.ResponseRecorder) {
+		t.Helper()
+		require.Equal(t, http.StatusForbidden, w.Code, "Got: %s", w.Body.String())
+		body := apierr.Body{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		require.Equal(t, errorInsufficientPermission, body.Code)
+	}
+	ticket := func(body string) string {
+		w := do(http.MethodPost, "/1/sessions/expiring-tickets", accessToken, body)
+		require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+		resp := struct {
+			Ticket string `json:"ticket"`
+		}{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp.Ticket
+	}
+	boxID := make([]byte, dropBoxIDSize)
+	sodium.Random(boxID)
+	boxPath := "/1/drop-boxes/" + hex.EncodeToString(boxID)
+
+	// a ticket for a share link can only pick up packages
+	shared := ticket(`{"scopes":["drop-box-read-only"]}`)
+	require.Equal(t, http.StatusOK, do(http.MethodGet, boxPath+"?ticket="+shared, "", "").Code)
+	requireForbidden(do(http.MethodGet, "/1/messages?ticket="+shared, "", ""))
+	requireForbidden(do(http.MethodGet, "/1/sockets?ticket="+shared, "", ""))
+	// routes that don't allow scopes ignore the ticket parameter
+	require.Equal(t, http.StatusUnauthorized, do(http.MethodPut, boxPath+"?ticket="+shared, "", "package").Code)
+	require.Equal(t, http.StatusUnauthorized, do(http.MethodPost, "/1/sessions/expiring-tickets?ticket="+shared, "", "").Code)
+	require.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/1/users/me/sessions?ticket="+ticket(""), "", "").Code)
+	// tickets without scopes only open websockets
+	requireForbidden(do(http.MethodGet, "/1/messages?ticket="+ticket(""), "", ""))
+	requireForbidden(do(http.MethodGet, boxPath+"?ticket="+ticket(""), "", ""))
+	reader := ticket(`{"scopes":["messages-read"]}`)
+	require.Equal(t, http.StatusOK, do(http.MethodGet, "/1/messages?ticket="+reader, "", "").Code)
+	require.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/1/sessions/expiring-tickets", accessToken, `{"scopes":["everything"]}`).Code)
+
+	w := do(http.MethodPost, "/1/sessions/scoped-tokens", accessToken, `{"scopes":["messages-read"]}`)
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	resp := struct {
+		AccessToken string   `json:"access_token"`
+		Scopes      []string `json:"scopes"`
+	}{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Equal(t, []string{"messages-read"}, resp.Scopes)
+	require.Equal(t, http.StatusOK, do(http.MethodGet, "/1/messages", resp.AccessToken, "").Code)
+	requireForbidden(do(http.MethodDelete, "/1/messages", resp.AccessToken, "[]"))
+	requireForbidden(do(http.MethodGet, boxPath, resp.AccessToken, ""))
+	// scoped credentials can't be used to get broader ones
+	requireForbidden(do(http.MethodPost, "/1/sessions/scoped-tokens", resp.AccessToken, `{"scopes":["drop-box-read-only"]}`))
+	require.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/1/sessions/scoped-tokens", accessToken, `{"scopes":[]}`).Code)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"zood.dev/oscar/model"
+)
+
+// Admins can suspend a user, for a while or until they're reinstated, or ban
+// them for good. Either way the user can't log in, refresh a session or use
+// the sessions they have, which keeps them from sending messages and
+// packages, and their open websockets are closed. Delivery tokens don't
+// identify the user they were issued to, so the ones a user already holds
+// keep working for sealed sender messages until they expire, up to
+// deliveryTokenLifetime later.
+
+// accountStatusErr returns the error a user with status gets at now, or nil
+// when the user is active
+func accountStatusErr(status model.UserStatusRecord, now time.Time) *serverError {
+	switch status.Status {
+	case model.UserBanned:
+		return &serverError{code: errorAccountBanned, message: "The account is banned"}
+	case model.UserSuspended:
+		if status.SuspendedUntil == 0 {
+			return &serverError{code: errorAccountSuspended, message: "The account is suspended"}
+		}
+		// suspensions with an end lapse by themselves
+		if now.Unix() < status.SuspendedUntil {
+			until := time.Unix(status.SuspendedUntil, 0).UTC().Format(time.RFC3339)
+			return &serverError{code: errorAccountSuspended, message: "The account is suspended until " + until}
+		}
+	}
+	return nil
+}
+
+// refuseInactiveAccount sends the error of a suspended or banned user, and
+// returns whether it did
+func refuseInactiveAccount(w http.ResponseWriter, status model.UserStatusRecord, now time.Time) bool {
+	sErr := accountStatusErr(status, now)
+	if sErr == nil {
+		return false
+	}
+	sendErr(w, sErr.message, sErr.code.Status(), sErr.code)
+	return true
+}
+
+// registeredUser is a user as listed to admins
+type registeredUser struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email,omitempty"`
+	Locale   string `json:"locale,omitempty"`
+	// CreatedAt is 0 for users that registered before it was recorded
+	CreatedAt      int64  `json:"created_at"`
+	Status         string `json:"status,omitempty"`
+	SuspendedUntil int64  `json:"suspended_until,omitempty"`
+	StatusReason   string `json:"status_reason,omitempty"`
+}
+
+// recentUsersHandler handles GET /admin/users?before=&limit=. It lists the
+// users that registered last, the newest first. Pass the id of the last one
+// as before to get the next page.
+func recentUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var beforeID int64
+	if str := r.URL.Query().Get("before"); str != "" {
+		var err error
+		beforeID, err = strconv.ParseInt(str, 10, 64)
+		if err != nil || beforeID < 1 {
+			sendBadReq(w, "before must be a user id")
+			return
+		}
+	}
+	limit := 100
+	if str := r.URL.Query().Get("limit"); str != "" {
+		var err error
+		limit, err = strconv.Atoi(str)
+		if err != nil || limit < 1 || limit > 1000 {
+			sendBadReq(w, "limit must be between 1 and 1000")
+			return
+		}
+	}
+
+	records, err := providersCtx(r.Context()).db.RecentUsers(beforeID, limit)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	users := make([]registeredUser, 0, len(records))
+	for _, rec := range records {
+		user := registeredUser{
+			ID:             rec.ID,
+			Username:       rec.Username,
+			Locale:         rec.Locale,
+			CreatedAt:      rec.CreatedAt,
+			Status:         rec.Status,
+			SuspendedUntil: rec.SuspendedUntil,
+			StatusReason:   rec.StatusReason,
+		}
+		if rec.Email != nil {
+			user.Email = *rec.Email
+		}
+		users = append(users, user)
+	}
+
+	sendSuccess(w, users)
+}
+
+// adminUser returns the user named in the request's path, or sends an error
+// and returns nil
+func adminUser(w http.ResponseWriter, r *http.Request) *model.UserRecord {
+	username := strings.ToLower(mux.Vars(r)["username"])
+	user, err := providersCtx(r.Context()).db.User(username)
+	if err != nil {
+		sendInternalErr(w, err)
+		return nil
+	}
+	if user == nil {
+		sendNotFound(w, "user not found", errorUserNotFound)
+		return nil
+	}
+	return user
+}
+
+// setUserStatus stores the status of user, and records who changed it
+func setUserStatus(w http.ResponseWriter, r *http.Request, user *model.UserRecord, status model.UserStatusRecord, kind accountEventKind) {
+	providers := providersCtx(r.Context())
+	ok, err := providers.db.SetUserStatus(user.ID, status)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if !ok {
+		sendNotFound(w, "user not found", errorUserNotFound)
+		return
+	}
+	providers.events.emit(accountEvent{Kind: kind, Actor: actorAdmin, UserID: user.ID, Details: status.StatusReason})
+	// the sockets were opened while the user was active, and would keep
+	// receiving their messages
+	if sErr := accountStatusErr(status, providers.now()); sErr != nil {
+		liveSockets.closeUser(user.ID, websocket.ClosePolicyViolation, sErr.message)
+	}
+
+	sendSuccess(w, nil)
+}
+
+// suspendUserHandler handles POST /admin/users/{username}/suspend. The
+// suspension lasts until the unix time in the body's until, or until the
+// user is reinstated when it's 0.
+func suspendUserHandler(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Reason string `json:"reason"`
+		Until  int64  `json:"until"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendBadReq(w, "unable to parse POST body: "+err.Error())
+		return
+	}
+	providers := providersCtx(r.Context())
+	if body.Until < 0 || (body.Until != 0 && body.Until <= providers.now().Unix()) {
+		sendBadReq(w, "until must be in the future, or 0 for no end")
+		return
+	}
+	user := adminUser(w, r)
+	if user == nil {
+		return
+	}
+	// a ban is for good, so it isn't cut short by a suspension
+	if user.Status == model.UserBanned {
+		sendBadReq(w, fmt.Sprintf("'%s' is banned. Reinstate them before suspending them.", user.Username))
+		return
+	}
+
+	setUserStatus(w, r, user, model.UserStatusRecord{
+		Status:         model.UserSuspended,
+		SuspendedUntil: body.Until,
+		StatusReason:   body.Reason,
+	}, eventUserSuspended)
+}
+
+// banUserHandler handles POST /admin/users/{username}/ban
+func banUserHandler(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Reason string `json:"reason"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendBadReq(w, "unable to parse POST body: "+err.Error())
+		return
+	}
+	user := adminUser(w, r)
+	if user == nil {
+		return
+	}
+
+	setUserStatus(w, r, user, model.UserStatusRecord{Status: model.UserBanned, StatusReason: body.Reason}, eventUserBanned)
+}
+
+// reinstateUserHandler handles POST /admin/users/{username}/reinstate. It
+// lifts a suspension or a ban. The user's sessions work again, unless they
+// expired in the meantime.
+func reinstateUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := adminUser(w, r)
+	if user == nil {
+		return
+	}
+	if user.Status == model.UserActive {
+		sendNotFound(w, fmt.Sprintf("'%s' isn't suspended or banned", user.Username), errorNotFound)
+		return
+	}
+
+	setUserStatus(w, r, user, model.UserStatusRecord{Status: model.UserActive}, eventUserReinstated)
+}
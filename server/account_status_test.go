@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/apierr"
+	"zood.dev/oscar/model"
+)
+
+func TestAccountStatusErr(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	require.Nil(t, accountStatusErr(model.UserStatusRecord{}, now))
+	require.Equal(t, errorAccountBanned, accountStatusErr(model.UserStatusRecord{Status: model.UserBanned}, now).code)
+	require.Equal(t, errorAccountSuspended, accountStatusErr(model.UserStatusRecord{Status: model.UserSuspended}, now).code)
+	suspended := model.UserStatusRecord{Status: model.UserSuspended, SuspendedUntil: now.Add(time.Hour).Unix()}
+	require.Equal(t, errorAccountSuspended, accountStatusErr(suspended, now).code)
+	require.Nil(t, accountStatusErr(suspended, now.Add(time.Hour)))
+}
+
+func TestUserStatusAdmin(t *testing.T) {
+	providers := createTestProviders(t)
+	providers.adminToken = "admin-token"
+	clock := newFakeClock(time.Now())
+	providers.clock = clock
+	var events []accountEvent
+	providers.events = newEventBus()
+	providers.events.subscribe("test", func(evt accountEvent) error {
+		events = append(events, evt)
+		return nil
+	})
+	router := newOscarRouter(providers)
+	user, keyPair := createTestUser(t, providers)
+	accessToken := loginTestUser(t, providers, user, keyPair)
+	require.NoError(t, providers.db.InsertRefreshToken(model.RefreshTokenRecord{Token: "refresh-token", UserID: user.ID, ExpiresAt: clock.Now().Add(refreshTokenTTL).Unix()}))
+
+	admin := func(method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer admin-token")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	// the error code of each way the user can authenticate, the challenge,
+	// the refresh and the access token
+	refreshToken := "refresh-token"
+	userCodes := func() []ErrCode {
+		messages := httptest.NewRequest(http.MethodGet, "/1/messages", nil)
+		messages.Header.Set("X-Oscar-Access-Token", accessToken)
+		var codes []ErrCode
+		for _, r := range []*http.Request{
+			httptest.NewRequest(http.MethodPost, "/1/sessions/"+user.Username+"/challenge", nil),
+			httptest.NewRequest(http.MethodPost, "/1/sessions/refresh", strings.NewReader(`{"refresh_token":"`+refreshToken+`"}`)),
+			messages,
+		} {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code == http.StatusOK {
+				// refresh tokens are replaced each time they're used
+				resp := struct {
+					RefreshToken string `json:"refresh_token"`
+				}{}
+				if json.Unmarshal(w.Body.Bytes(), &resp) == nil && resp.RefreshToken != "" {
+					refreshToken = resp.RefreshToken
+				}
+				codes = append(codes, errorNone)
+				continue
+			}
+			body := apierr.Body{}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			codes = append(codes, body.Code)
+		}
+		return codes
+	}
+	require.Equal(t, []ErrCode{errorNone, errorNone, errorNone}, userCodes())
+	suspended := []ErrCode{errorAccountSuspended, errorAccountSuspended, errorAccountSuspended}
+	banned := []ErrCode{errorAccountBanned, errorAccountBanned, errorAccountBanned}
+
+	until := clock.Now().Add(time.Hour).Unix()
+	w := admin(http.MethodPost, "/admin/users/"+user.Username+"/suspend", fmt.Sprintf(`{"reason":"spam","until":%d}`, until))
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	require.Equal(t, suspended, userCodes())
+
+	// the suspension lapses by itself
+	clock.Advance(time.Hour)
+	require.Equal(t, []ErrCode{errorNone, errorNone, errorNone}, userCodes())
+
+	require.Equal(t, http.StatusOK, admin(http.MethodPost, "/admin/users/"+user.Username+"/ban", `{"reason":"more spam"}`).Code)
+	require.Equal(t, banned, userCodes())
+	// a ban can't be turned into a suspension
+	require.Equal(t, http.StatusBadRequest, admin(http.MethodPost, "/admin/users/"+user.Username+"/suspend", `{}`).Code)
+
+	w = admin(http.MethodGet, "/admin/users?limit=1", "")
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	var users []registeredUser
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &users))
+	require.Len(t, users, 1)
+	require.Equal(t, user.Username, users[0].Username)
+	require.Equal(t, model.UserBanned, users[0].Status)
+	require.Equal(t, "more spam", users[0].StatusReason)
+	require.NotZero(t, users[0].CreatedAt)
+
+	require.Equal(t, http.StatusOK, admin(http.MethodPost, "/admin/users/"+user.Username+"/reinstate", "").Code)
+	require.Equal(t, []ErrCode{errorNone, errorNone, errorNone}, userCodes())
+	require.Equal(t, http.StatusNotFound, admin(http.MethodPost, "/admin/users/"+user.Username+"/reinstate", "").Code)
+
+	require.Len(t, events, 3)
+	require.Equal(t, eventUserSuspended, events[0].Kind)
+	require.Equal(t, "spam", events[0].Details)
+	require.Equal(t, eventUserBanned, events[1].Kind)
+	require.Equal(t, eventUserReinstated, events[2].Kind)
+	require.Equal(t, user.ID, events[2].UserID)
+
+	require.Equal(t, http.StatusBadRequest, admin(http.MethodPost, "/admin/users/"+user.Username+"/suspend", `{"until":1}`).Code)
+	require.Equal(t, http.StatusNotFound, admin(http.MethodPost, "/admin/users/nobody/ban", `{}`).Code)
+	require.Equal(t, http.StatusBadRequest, admin(http.MethodGet, "/admin/users?before=x", "").Code)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/users", nil))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestSuspendClosesSockets(t *testing.T) {
+	providers := createTestProviders(t)
+	providers.adminToken = "admin-token"
+	server := httptest.NewServer(newOscarRouter(providers))
+	defer server.Close()
+	user, keyPair := createTestUser(t, providers)
+	accessToken := loginTestUser(t, providers, user, keyPair)
+	other, otherKeyPair := createTestUser(t, providers)
+	otherToken := loginTestUser(t, providers, other, otherKeyPair)
+
+	dial := func(token string) *websocket.Conn {
+		hdrs := make(http.Header)
+		hdrs.Set("Sec-Websocket-Protocol", token)
+		conn, _, err := (&websocket.Dialer{}).Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/1/sockets", hdrs)
+		require.NoError(t, err)
+		return conn
+	}
+	conn := dial(accessToken)
+	defer conn.Close()
+	otherConn := dial(otherToken)
+	defer otherConn.Close()
+
+	r, err := http.NewRequest(http.MethodPost, server.URL+"/admin/users/"+user.Username+"/suspend", strings.NewReader(`{"reason":"spam"}`))
+	require.NoError(t, err)
+	r.Header.Set("Authorization", "Bearer admin-token")
+	resp, err := http.DefaultClient.Do(r)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	closeErr, ok := err.(*websocket.CloseError)
+	require.True(t, ok, "expected a close frame. Got %v", err)
+	require.Equal(t, websocket.ClosePolicyViolation, closeErr.Code)
+
+	// only the suspended user's sockets are closed
+	otherConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err = otherConn.ReadMessage()
+	_, ok = err.(*websocket.CloseError)
+	require.False(t, ok, "unexpected close frame: %v", err)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"zood.dev/oscar/sodium"
+)
+
+// activityEvents are the account events users are told about, since they're
+// how someone else using the account would show up
+var activityEvents = map[accountEventKind]bool{
+	eventSessionCreated: true,
+	eventPushTokenAdded: true,
+	eventBackupReplaced: true,
+}
+
+// activityNotice is the content of the system messages about account
+// activity, before it's boxed to the user's public key
+type activityNotice struct {
+	Event   accountEventKind `json:"event"`
+	Time    int64            `json:"time"`
+	Details string           `json:"details,omitempty"`
+}
+
+// activityEmail is the data of the activity email templates
+type activityEmail struct {
+	ProductName  string
+	SupportEmail string
+	Username     string
+	Event        accountEventKind
+	Time         string
+}
+
+func newActivityEmail(b *branding, username string, evt accountEvent) activityEmail {
+	b = b.orDefault()
+	return activityEmail{
+		ProductName:  b.ProductName,
+		SupportEmail: b.SupportEmail,
+		Username:     username,
+		Event:        evt.Kind,
+		Time:         evt.Time.UTC().Format("Jan 2, 2006 at 15:04 UTC"),
+	}
+}
+
+func pushTokenAdded(userID int64, service string) accountEvent {
+	return accountEvent{Kind: eventPushTokenAdded, Actor: actorUser, UserID: userID, Details: service}
+}
+
+// activitySubscriber sends users a system message about the activity on
+// their account, which reaches all of their devices. When email is set, the
+// users with a verified email address are emailed too. providers must not be
+// bound to a request, since events can be emitted after the response is
+// sent.
+func activitySubscriber(providers *serverProviders, email bool) func(evt accountEvent) error {
+	return func(evt accountEvent) error {
+		if !activityEvents[evt.Kind] || evt.UserID == 0 {
+			return nil
+		}
+		if err := sendActivityMessage(providers, evt); err != nil {
+			return err
+		}
+		if email {
+			go func() {
+				if err := sendActivityEmail(providers, evt); err != nil {
+					logErr(errors.Wrapf(err, "emailing %s", evt.Kind))
+				}
+			}()
+		}
+		return nil
+	}
+}
+
+// sendActivityMessage stores a system message about evt for the user, and
+// delivers it in the background
+func sendActivityMessage(providers *serverProviders, evt accountEvent) error {
+	pubKey, err := providers.db.UserPublicKey(evt.UserID)
+	if err != nil {
+		return err
+	}
+	if pubKey == nil {
+		return nil
+	}
+	buf, err := json.Marshal(activityNotice{Event: evt.Kind, Time: evt.Time.Unix(), Details: evt.Details})
+	if err != nil {
+		return err
+	}
+	cipherText, nonce, err := sodium.PublicKeyEncrypt(buf, pubKey, providers.keyPair.Secret)
+	if err != nil {
+		return errors.Wrap(err, "boxing the activity notice")
+	}
+
+	msg := Message{CipherText: cipherText, Nonce: nonce, SentDate: evt.Time.Unix(), System: true}
+	entryID, _, err := storeMessage(providers, evt.UserID, &msg, false, nil, evt.Time)
+	if err != nil {
+		return err
+	}
+	go deliverOutboxEntry(providers, entryID, msg, evt.UserID, nil)
+	return nil
+}
+
+// sendActivityEmail emails the user about evt, if they have a verified email
+// address
+func sendActivityEmail(providers *serverProviders, evt accountEvent) error {
+	user, err := providers.db.User(providers.db.Username(evt.UserID))
+	if err != nil {
+		return err
+	}
+	if user == nil || user.Email == nil {
+		return nil
+	}
+	brand := providers.emailTemplates.brand()
+	data := newActivityEmail(brand, user.Username, evt)
+	subject, body, err := providers.emailTemplates.render(user.Locale, "activity", data)
+	if err != nil {
+		return err
+	}
+	html, err := providers.emailTemplates.renderHTML(user.Locale, "activity", data)
+	if err != nil {
+		return err
+	}
+	return providers.emailer.SendEmail(brand.EmailFrom, *user.Email, subject, body, html)
+}
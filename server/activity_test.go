@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/sodium"
+)
+
+// chanEmailer hands the recipient of every email to a channel
+type chanEmailer chan string
+
+func (ce chanEmailer) SendEmail(from, to, subj, textMsg string, htmlMsg *string) error {
+	ce <- to
+	return nil
+}
+
+func TestActivityNotifications(t *testing.T) {
+	providers := createTestProviders(t)
+	emails := make(chanEmailer, 1)
+	providers.emailer = emails
+	user, keyPair := createTestUser(t, providers)
+	require.NoError(t, providers.db.VerifyEmail("alice@example.com", user.ID))
+	token := loginTestUser(t, providers, user, keyPair)
+	providers.events = newEventBus()
+	providers.events.subscribe("activity", activitySubscriber(providers, true))
+
+	when := time.Unix(1600000000, 0)
+	providers.events.emit(accountEvent{Kind: eventSessionCreated, Actor: actorUser, UserID: user.ID, Details: "from 192.0.2.1:5000", Time: when})
+	// other events aren't reported to the user
+	providers.events.emit(accountEvent{Kind: eventEmailVerified, Actor: actorUser, UserID: user.ID})
+
+	select {
+	case to := <-emails:
+		require.Equal(t, "alice@example.com", to)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the activity email wasn't sent")
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/1/messages", nil)
+	r.Header.Set("X-Oscar-Access-Token", token)
+	w := httptest.NewRecorder()
+	newOscarRouter(providers).ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	var msgs []Message
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &msgs))
+	require.Len(t, msgs, 1)
+	msg := msgs[0]
+	require.True(t, msg.System)
+	require.False(t, msg.SealedSender)
+	require.Equal(t, when.Unix(), msg.SentDate)
+
+	// only the user can read it, knowing it came from the server
+	buf, ok := sodium.PublicKeyDecrypt(msg.CipherText, msg.Nonce, providers.keyPair.Public, keyPair.Secret)
+	require.True(t, ok)
+	notice := activityNotice{}
+	require.NoError(t, json.Unmarshal(buf, &notice))
+	require.Equal(t, activityNotice{Event: eventSessionCreated, Time: when.Unix(), Details: "from 192.0.2.1:5000"}, notice)
+}
+
+func TestBackupReplacedActivity(t *testing.T) {
+	providers := createTestProviders(t)
+	var events []accountEvent
+	providers.events = newEventBus()
+	providers.events.subscribe("test", func(evt accountEvent) error {
+		events = append(events, evt)
+		return nil
+	})
+	user, keyPair := createTestUser(t, providers)
+	token := loginTestUser(t, providers, user, keyPair)
+	router := newOscarRouter(providers)
+	upload := func() {
+		r := httptest.NewRequest(http.MethodPut, "/1/users/me/backup", strings.NewReader("backup"))
+		r.Header.Set("X-Oscar-Access-Token", token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	}
+
+	// the first backup doesn't replace anything
+	upload()
+	require.Empty(t, events)
+	upload()
+	require.Len(t, events, 1)
+	require.Equal(t, eventBackupReplaced, events[0].Kind)
+	require.Equal(t, user.ID, events[0].UserID)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// adminMiddleware only lets through requests bearing the admin token. When
+// the server has no admin token configured, every request is rejected.
+func (sp *serverProviders) adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !validAdminToken(sp.adminToken, token) {
+			sendErr(w, "invalid/missing admin token", http.StatusUnauthorized, errorInvalidAccessToken)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func validAdminToken(expected, actual string) bool {
+	if expected == "" || actual == "" {
+		return false
+	}
+	// compare digests, so the comparison doesn't leak the token's length
+	e := sha256.Sum256([]byte(expected))
+	a := sha256.Sum256([]byte(actual))
+	return subtle.ConstantTimeCompare(e[:], a[:]) == 1
+}
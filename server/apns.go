@@ -2,46 +2,14 @@ package main
 
 import (
 	"encoding/json"
-	"log"
 	"net/http"
 
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
-	"github.com/sideshow/apns2"
-	"github.com/sideshow/apns2/token"
 	"zood.dev/oscar/model"
+	"zood.dev/oscar/push"
 )
 
-var apnsClient *apns2.Client
-
-type apsPayload struct {
-	APS struct {
-		ContentAvailable int `json:"content-available"`
-	} `json:"aps"`
-	Data interface{} `json:"data"`
-}
-
-func createAPNSClient(p8Path, keyID, teamID string, production bool) error {
-	key, err := token.AuthKeyFromFile(p8Path)
-	if err != nil {
-		return err
-	}
-	token := &token.Token{
-		AuthKey: key,
-		KeyID:   keyID,
-		TeamID:  teamID,
-	}
-
-	apnsClient = apns2.NewTokenClient(token)
-	if production {
-		apnsClient.Production()
-	} else {
-		apnsClient.Development()
-	}
-
-	return nil
-}
-
 func addAPNSTokenHandler(w http.ResponseWriter, r *http.Request) {
 	userID := userIDFromContext(r.Context())
 
@@ -60,18 +28,22 @@ func addAPNSTokenHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// check if we already have this token in the db, and that it's associated with this user
-	db := providersCtx(r.Context()).db
+	providers := providersCtx(r.Context())
+	db := providers.db
 	atr, err := db.APNSToken(body.Token)
 	if err != nil {
 		sendInternalErr(w, err)
 		return
 	}
+	client := clientRecord(r)
 	if atr == nil {
 		// insert the token, then return
-		err = db.InsertAPNSToken(userID, body.Token)
+		err = db.InsertAPNSToken(userID, body.Token, client)
 		if err != nil {
 			sendInternalErr(w, err)
+			return
 		}
+		providers.events.emit(pushTokenAdded(userID, push.NameAPNS))
 		return
 	}
 
@@ -80,16 +52,20 @@ func addAPNSTokenHandler(w http.ResponseWriter, r *http.Request) {
 	// the case where a user logs out on their device and somebody else
 	// logs in. The device token will still be the same, so we need to make sure
 	// the user_id and device token are always in sync.
-	if atr.UserID == userID {
+	// The client is refreshed too, so an app update shows up in the stats.
+	if atr.UserID == userID && atr.ClientRecord == client {
 		sendSuccess(w, nil)
 		return
 	}
 
-	err = db.UpdateUserIDOfAPNSToken(userID, body.Token)
+	err = db.UpdateUserIDOfAPNSToken(userID, body.Token, client)
 	if err != nil {
 		sendInternalErr(w, err)
 		return
 	}
+	if atr.UserID != userID {
+		providers.events.emit(pushTokenAdded(userID, push.NameAPNS))
+	}
 	sendSuccess(w, nil)
 }
 
@@ -108,45 +84,18 @@ func deleteAPNSTokenHandler(w http.ResponseWriter, r *http.Request) {
 	sendSuccess(w, nil)
 }
 
-func sendAPNSMessage(db model.Provider, userID int64, payload interface{}) {
-	tokens, err := db.APNSTokensRaw(userID)
-	if err != nil {
-		logErr(err)
-		return
-	}
+// apnsTokens are the device tokens of APNS
+type apnsTokens struct{}
 
-	if len(tokens) == 0 {
-		return
-	}
-	n := &apns2.Notification{
-		Topic:    "xyz.zood.michael",
-		Priority: 5,
-		PushType: apns2.PushTypeBackground,
-	}
-	ap := apsPayload{}
-	ap.APS.ContentAvailable = 1
-	ap.Data = payload
-	n.Payload = ap
-
-	for _, t := range tokens {
-		n.DeviceToken = t
-		resp, err := apnsClient.Push(n)
-		if err != nil {
-			log.Printf("Error pushing to user %d with token %s: %v", userID, t, err)
-			continue
-		}
-		if !resp.Sent() {
-			if resp.Reason == apns2.ReasonUnregistered || resp.Reason == apns2.ReasonBadDeviceToken {
-				// remove the token
-				err = db.DeleteAPNSToken(t)
-				if err != nil {
-					logErr(err)
-				}
-			} else {
-				err = errors.Errorf("Push to user %d failed because '%s'", userID, resp.Reason)
-				logErr(err)
-			}
-		}
-	}
+func (apnsTokens) tokens(db model.Provider, userID int64) ([]string, error) {
+	return db.APNSTokensRaw(userID)
+}
+
+func (apnsTokens) forget(db model.Provider, token string) error {
+	return db.DeleteAPNSToken(token)
+}
 
+// replace fulfills pushTokens. APNS never replaces tokens, so it's an error.
+func (apnsTokens) replace(db model.Provider, userID int64, old, new string) error {
+	return errors.Errorf("apns asked to replace a token of user %d", userID)
 }
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"zood.dev/oscar/model"
+
+	"github.com/pkg/errors"
+)
+
+// usernameIndexSaltSize is the size of the salt used for username blind indexes
+const usernameIndexSaltSize = 16
+
+// usernameIndex computes the blind index of username. Clients compute the
+// same value to look up a user without revealing the username they're
+// searching for: HMAC-SHA256, keyed with the server's username index salt,
+// over the normalized (trimmed and lowercased) username.
+func usernameIndex(salt []byte, username string) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(strings.ToLower(strings.TrimSpace(username))))
+	return mac.Sum(nil)
+}
+
+// backfillUsernameIndexes sets the blind index of users created before the
+// index was introduced, or before a salt was configured.
+func backfillUsernameIndexes(db model.Provider, salt []byte) error {
+	usernames, err := db.UsernamesWithoutIndex()
+	if err != nil {
+		return err
+	}
+	for id, username := range usernames {
+		if err = db.SetUsernameIndex(id, usernameIndex(salt, username)); err != nil {
+			return errors.Wrapf(err, "setting username index of user %d", id)
+		}
+	}
+
+	return nil
+}
+
+// searchUsersByIndexHandler handles GET /users/blind-lookup
+func searchUsersByIndexHandler(w http.ResponseWriter, r *http.Request) {
+	providers := providersCtx(r.Context())
+	if providers.usernameIndexSalt == nil {
+		sendNotFound(w, "Hashed username lookups are not enabled on this server", errorNotAnEndpoint)
+		return
+	}
+
+	index, err := base64.StdEncoding.DecodeString(r.URL.Query().Get("username_hash"))
+	if err != nil || len(index) != sha256.Size {
+		sendBadReq(w, "'username_hash' must be a base64 encoded HMAC-SHA256")
+		return
+	}
+
+	user := User{}
+	db := providers.db
+	user.ID, user.Username, user.PublicKey, err = db.LimitedUserInfoIndex(index)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if user.PublicKey == nil {
+		sendNotFound(w, "user not found", errorUserNotFound)
+		return
+	}
+
+	user.PublicID, err = providers.kvs.PublicIDFromUserID(user.ID)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	sendSuccess(w, user)
+}
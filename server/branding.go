@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+// branding holds the names and addresses that identify the deployment to
+// its users, in server-info and emails. White-label deployments set them in
+// the config. Unset fields keep the Zood values.
+type branding struct {
+	ProductName string `json:"product_name,omitempty"`
+	// SupportEmail is where users can get help. It's optional.
+	SupportEmail string `json:"support_email,omitempty"`
+	// EmailFrom is the sender of emails, e.g. "Zood <no-reply@zood.xyz>"
+	EmailFrom string `json:"email_from,omitempty"`
+	// VerifyEmailURL and DisavowEmailURL are the pages linked to by the
+	// verification email. The token is added as the 't' query parameter.
+	VerifyEmailURL  string `json:"verify_email_url,omitempty"`
+	DisavowEmailURL string `json:"disavow_email_url,omitempty"`
+}
+
+var defaultBranding = branding{
+	ProductName:     "Zood Location",
+	EmailFrom:       notificationsEmailAddress,
+	VerifyEmailURL:  "https://www.zood.xyz/verify-email",
+	DisavowEmailURL: "https://www.zood.xyz/disavow-email",
+}
+
+// withDefaults fills the unset fields of b from defaultBranding, and checks
+// the URLs
+func (b branding) withDefaults() (branding, error) {
+	if b.ProductName == "" {
+		b.ProductName = defaultBranding.ProductName
+	}
+	if b.EmailFrom == "" {
+		b.EmailFrom = defaultBranding.EmailFrom
+	}
+	if b.VerifyEmailURL == "" {
+		b.VerifyEmailURL = defaultBranding.VerifyEmailURL
+	}
+	if b.DisavowEmailURL == "" {
+		b.DisavowEmailURL = defaultBranding.DisavowEmailURL
+	}
+	for _, u := range []string{b.VerifyEmailURL, b.DisavowEmailURL} {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return branding{}, errors.Wrapf(err, "invalid branding url '%s'", u)
+		}
+		if parsed.Scheme != "https" && parsed.Scheme != "http" {
+			return branding{}, errors.Errorf("branding url '%s' must be http or https", u)
+		}
+	}
+	return b, nil
+}
+
+// orDefault returns defaultBranding when b is nil
+func (b *branding) orDefault() *branding {
+	if b == nil {
+		return &defaultBranding
+	}
+	return b
+}
+
+// withToken returns base with the token added as the 't' query parameter
+func withToken(base, token string) string {
+	u, err := url.Parse(base)
+	if err != nil {
+		// the urls are checked when the config is loaded
+		return base
+	}
+	q := u.Query()
+	q.Set("t", token)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/smtp"
+)
+
+func TestBrandingDefaults(t *testing.T) {
+	b, err := branding{ProductName: "Acme Finder"}.withDefaults()
+	require.NoError(t, err)
+	require.Equal(t, "Acme Finder", b.ProductName)
+	require.Equal(t, defaultBranding.EmailFrom, b.EmailFrom)
+	require.Equal(t, defaultBranding.VerifyEmailURL, b.VerifyEmailURL)
+
+	_, err = branding{VerifyEmailURL: "ftp://example.com/verify"}.withDefaults()
+	require.Error(t, err)
+
+	require.Equal(t, "https://acme.example/verify?lang=en&t=a%2Bb", withToken("https://acme.example/verify?lang=en", "a+b"))
+}
+
+func TestBrandedVerificationEmail(t *testing.T) {
+	brand, err := branding{
+		ProductName:     "Acme Finder",
+		EmailFrom:       "Acme <no-reply@acme.example>",
+		VerifyEmailURL:  "https://acme.example/verify",
+		DisavowEmailURL: "https://acme.example/disavow",
+	}.withDefaults()
+	require.NoError(t, err)
+	templates, err := newEmailTemplates("", "", &brand)
+	require.NoError(t, err)
+
+	emailer := smtp.NewMockSendEmailer()
+	require.NoError(t, sendVerificationEmail(templates, "en", "token123", "alice@example.com", emailer))
+	require.Equal(t, "Acme <no-reply@acme.example>", emailer.From)
+	require.Equal(t, "Acme Finder: Email Verification", emailer.Subject)
+	require.Contains(t, emailer.Text, "https://acme.example/verify?t=token123")
+	require.Contains(t, emailer.Text, "https://acme.example/disavow?t=token123")
+	require.NotContains(t, emailer.Text, "zood")
+}
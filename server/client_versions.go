@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"zood.dev/oscar/model"
+
+	"github.com/pkg/errors"
+)
+
+// clientVersionHeader identifies the app build making a request, as
+// <platform>/<version>, e.g. "android/1.4.2" or "ios/2.0", optionally
+// followed by the device model in parentheses, e.g. "android/1.4.2 (Pixel 4a)".
+const clientVersionHeader = "X-Oscar-Client-Version"
+
+// The longest platform, app version and device model accepted in the
+// client version header
+const (
+	maxClientPlatformLength    = 32
+	maxClientAppVersionLength  = 32
+	maxClientDeviceModelLength = 64
+)
+
+// clientIdentifier is the parsed client version header. The app version
+// is kept as sent, since only the platforms with a minimum version need to
+// parse it.
+type clientIdentifier struct {
+	platform    string
+	appVersion  string
+	deviceModel string
+}
+
+// parseClientIdentifier parses the value of the client version header. The
+// platform is lowercased.
+func parseClientIdentifier(hdr string) (clientIdentifier, error) {
+	var ci clientIdentifier
+	hdr = strings.TrimSpace(hdr)
+	if open := strings.IndexByte(hdr, '('); open != -1 {
+		if !strings.HasSuffix(hdr, ")") {
+			return ci, errors.New("the device model must be in parentheses")
+		}
+		ci.deviceModel = strings.TrimSpace(hdr[open+1 : len(hdr)-1])
+		hdr = strings.TrimSpace(hdr[:open])
+	}
+	slash := strings.IndexByte(hdr, '/')
+	if slash == -1 {
+		return ci, errors.New("must be <platform>/<version>")
+	}
+	ci.platform = strings.ToLower(hdr[:slash])
+	ci.appVersion = hdr[slash+1:]
+	switch {
+	case ci.platform == "" || ci.appVersion == "":
+		return ci, errors.New("must be <platform>/<version>")
+	case len(ci.platform) > maxClientPlatformLength:
+		return ci, errors.New("platform is too long")
+	case len(ci.appVersion) > maxClientAppVersionLength:
+		return ci, errors.New("version is too long")
+	case len(ci.deviceModel) > maxClientDeviceModelLength:
+		return ci, errors.New("device model is too long")
+	}
+	return ci, nil
+}
+
+// clientRecord returns the client identified by the request's client
+// version header, or an empty record when it's missing or invalid
+func clientRecord(r *http.Request) model.ClientRecord {
+	ci, err := parseClientIdentifier(r.Header.Get(clientVersionHeader))
+	if err != nil {
+		return model.ClientRecord{}
+	}
+	return model.ClientRecord{Platform: ci.platform, AppVersion: ci.appVersion, DeviceModel: ci.deviceModel}
+}
+
+// clientVersion is a dotted version number, e.g. 1.4.2
+type clientVersion []int
+
+// parseClientVersion parses a dotted version number. Pre-release and build
+// suffixes, like the "-beta" of "1.4.2-beta", are ignored.
+func parseClientVersion(s string) (clientVersion, error) {
+	if i := strings.IndexAny(s, "-+"); i != -1 {
+		s = s[:i]
+	}
+	if s == "" {
+		return nil, errors.New("empty version")
+	}
+	parts := strings.Split(s, ".")
+	v := make(clientVersion, len(parts))
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, errors.Errorf("invalid version '%s'", s)
+		}
+		v[i] = n
+	}
+	return v, nil
+}
+
+// less reports whether v is older than other. Missing components are
+// treated as 0, so 1.4 and 1.4.0 are equal.
+func (v clientVersion) less(other clientVersion) bool {
+	for i := 0; i < len(v) || i < len(other); i++ {
+		var a, b int
+		if i < len(v) {
+			a = v[i]
+		}
+		if i < len(other) {
+			b = other[i]
+		}
+		if a != b {
+			return a < b
+		}
+	}
+	return false
+}
+
+func (v clientVersion) String() string {
+	parts := make([]string, len(v))
+	for i, n := range v {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ".")
+}
+
+// clientVersionPolicy holds the oldest version of each platform's app that
+// the server still supports. Requests without the client version header,
+// or from platforms without a minimum, are let through. A nil policy lets
+// every request through.
+type clientVersionPolicy struct {
+	minimums map[string]clientVersion
+}
+
+// newClientVersionPolicy parses the minimum versions in the config. Keys are
+// platform names, which are matched case-insensitively.
+func newClientVersionPolicy(minimums map[string]string) (*clientVersionPolicy, error) {
+	if len(minimums) == 0 {
+		return nil, nil
+	}
+	cvp := &clientVersionPolicy{minimums: map[string]clientVersion{}}
+	for platform, val := range minimums {
+		v, err := parseClientVersion(val)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid minimum version for '%s'", platform)
+		}
+		cvp.minimums[strings.ToLower(platform)] = v
+	}
+	return cvp, nil
+}
+
+// Middleware rejects requests from clients older than their platform's
+// minimum with errorClientUpgradeRequired
+func (cvp *clientVersionPolicy) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hdr := r.Header.Get(clientVersionHeader)
+		if cvp == nil || hdr == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ci, err := parseClientIdentifier(hdr)
+		if err != nil {
+			sendBadReq(w, fmt.Sprintf("%s %v", clientVersionHeader, err))
+			return
+		}
+		min, ok := cvp.minimums[ci.platform]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		v, err := parseClientVersion(ci.appVersion)
+		if err != nil {
+			sendBadReq(w, fmt.Sprintf("%s: %v", clientVersionHeader, err))
+			return
+		}
+		if v.less(min) {
+			msg := fmt.Sprintf("%s clients must be version %s or newer", ci.platform, min)
+			sendErr(w, msg, http.StatusUpgradeRequired, errorClientUpgradeRequired)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
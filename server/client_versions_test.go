@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/model"
+)
+
+func TestClientVersionLess(t *testing.T) {
+	v := func(s string) clientVersion {
+		cv, err := parseClientVersion(s)
+		require.NoError(t, err)
+		return cv
+	}
+	require.True(t, v("1.4.1").less(v("1.4.2")))
+	require.True(t, v("1.9").less(v("1.10")))
+	require.True(t, v("1.4").less(v("1.4.1")))
+	require.False(t, v("1.4").less(v("1.4.0")))
+	require.False(t, v("2.0.0-beta").less(v("2.0")))
+	require.False(t, v("2").less(v("1.99.99")))
+
+	for _, bad := range []string{"", "one", "1..2", "1.-2", "-beta"} {
+		_, err := parseClientVersion(bad)
+		require.Error(t, err, bad)
+	}
+}
+
+func TestParseClientIdentifier(t *testing.T) {
+	ci, err := parseClientIdentifier("Android/1.4.2 (Pixel 4a)")
+	require.NoError(t, err)
+	require.Equal(t, clientIdentifier{platform: "android", appVersion: "1.4.2", deviceModel: "Pixel 4a"}, ci)
+
+	ci, err = parseClientIdentifier("ios/2.0")
+	require.NoError(t, err)
+	require.Equal(t, clientIdentifier{platform: "ios", appVersion: "2.0"}, ci)
+
+	long := strings.Repeat("x", 65)
+	for _, bad := range []string{"", "android", "/1.0", "android/", "android/1.0 (Pixel", "android/1.0 (" + long + ")"} {
+		_, err := parseClientIdentifier(bad)
+		require.Error(t, err, bad)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/1/sessions", nil)
+	require.Equal(t, model.ClientRecord{}, clientRecord(r))
+	r.Header.Set(clientVersionHeader, "ios/2.1 (iPhone12,1)")
+	require.Equal(t, model.ClientRecord{Platform: "ios", AppVersion: "2.1", DeviceModel: "iPhone12,1"}, clientRecord(r))
+}
+
+func TestClientVersionMiddleware(t *testing.T) {
+	cvp, err := newClientVersionPolicy(map[string]string{"Android": "1.4.0", "ios": "2.1"})
+	require.NoError(t, err)
+	handler := cvp.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sendSuccess(w, nil)
+	}))
+
+	get := func(hdr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/1/messages", nil)
+		if hdr != "" {
+			r.Header.Set(clientVersionHeader, hdr)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	require.Equal(t, http.StatusOK, get("").Code)
+	require.Equal(t, http.StatusOK, get("android/1.4.0").Code)
+	require.Equal(t, http.StatusOK, get("ios/2.1.3").Code)
+	require.Equal(t, http.StatusOK, get("web/0.1").Code)
+	require.Equal(t, http.StatusOK, get("android/1.4.0 (Pixel 4a)").Code)
+	require.Equal(t, http.StatusBadRequest, get("android").Code)
+	require.Equal(t, http.StatusBadRequest, get("android/latest").Code)
+
+	w := get("android/1.3.9")
+	require.Equal(t, http.StatusUpgradeRequired, w.Code)
+	var errResp struct {
+		Code ErrCode `json:"error_code"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&errResp))
+	require.Equal(t, errorClientUpgradeRequired, errResp.Code)
+
+	// without minimums, every client is let through
+	cvp, err = newClientVersionPolicy(nil)
+	require.NoError(t, err)
+	require.Nil(t, cvp)
+	handler = cvp.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sendSuccess(w, nil)
+	}))
+	require.Equal(t, http.StatusOK, get("android/0.1").Code)
+
+	_, err = newClientVersionPolicy(map[string]string{"android": "soon"})
+	require.Error(t, err)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Clients act on the expiry dates the server hands them, like those of
+// delivery tokens, by their own clock. They can learn how far off it is from
+// GET /1/time, or the server_time of the auth responses. The skew tolerance
+// covers the drift that's left: expiry dates are checked against the
+// server's clock turned back by it, so a client running a little behind
+// doesn't see its tokens refused early.
+
+// clock tells the time. Handlers ask serverProviders.now instead of calling
+// time.Now, so tests can move the time forward past expiry dates, TTLs and
+// rate limit windows.
+type clock interface {
+	Now() time.Time
+}
+
+// expiryClock is the time expiry dates handed to clients are checked against
+func (sp *serverProviders) expiryClock(now time.Time) time.Time {
+	return now.Add(-sp.clockSkew)
+}
+
+// serverTimeHandler handles GET /1/time
+func serverTimeHandler(w http.ResponseWriter, r *http.Request) {
+	now := providersCtx(r.Context()).now()
+	w.Header().Set("Cache-Control", "no-store")
+	sendSuccess(w, struct {
+		ServerTime   int64 `json:"server_time"`
+		ServerTimeMS int64 `json:"server_time_ms"`
+	}{ServerTime: now.Unix(), ServerTimeMS: now.UnixNano() / int64(time.Millisecond)})
+}
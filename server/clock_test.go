@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a clock that only moves when told to. It's safe for
+// concurrent use.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+// Now fulfills clock
+func (fc *fakeClock) Now() time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.now
+}
+
+// Advance moves the clock forward by d
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.now = fc.now.Add(d)
+}
+
+func TestServerTimeHandler(t *testing.T) {
+	router := newOscarRouter(createTestProviders(t))
+	before := time.Now().Unix()
+	r := httptest.NewRequest(http.MethodGet, "/1/time", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+
+	resp := struct {
+		ServerTime   int64 `json:"server_time"`
+		ServerTimeMS int64 `json:"server_time_ms"`
+	}{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.True(t, resp.ServerTime >= before && resp.ServerTime <= time.Now().Unix())
+	require.Equal(t, resp.ServerTime, resp.ServerTimeMS/1000)
+}
+
+func TestClockSkewTolerance(t *testing.T) {
+	providers := createTestProviders(t)
+	now := time.Now()
+	// the token expired a minute ago, by the server's clock
+	issued := now.Add(-deliveryTokenLifetime - time.Minute)
+
+	providers.clock = newFakeClock(now)
+	token, err := issueDeliveryToken(providers.keys, providers.random(), issued)
+	require.NoError(t, err)
+	redeemed, err := redeemDeliveryToken(providers, token)
+	require.NoError(t, err)
+	require.False(t, redeemed)
+
+	providers.clockSkew = 2 * time.Minute
+	token, err = issueDeliveryToken(providers.keys, providers.random(), issued)
+	require.NoError(t, err)
+	redeemed, err = redeemDeliveryToken(providers, token)
+	require.NoError(t, err)
+	require.True(t, redeemed)
+	// and it stays spent while the skew keeps it valid
+	redeemed, err = redeemDeliveryToken(providers, token)
+	require.NoError(t, err)
+	require.False(t, redeemed)
+}
+
+func TestServerTimeFollowsClock(t *testing.T) {
+	providers := createTestProviders(t)
+	providers.clock = newFakeClock(time.Unix(1600000000, 5e8))
+
+	w := httptest.NewRecorder()
+	newOscarRouter(providers).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/1/time", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	resp := struct {
+		ServerTime   int64 `json:"server_time"`
+		ServerTimeMS int64 `json:"server_time_ms"`
+	}{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Equal(t, int64(1600000000), resp.ServerTime)
+	require.Equal(t, int64(1600000000500), resp.ServerTimeMS)
+}
@@ -4,61 +4,284 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"zood.dev/oscar/mailgun"
+	"zood.dev/oscar/smtp"
 	"zood.dev/oscar/sodium"
+	"zood.dev/oscar/sqlite"
 
 	"github.com/pkg/errors"
 )
 
 type serverConfig struct {
-	APNS struct {
+	// ActivityEmails also emails users about new sessions, devices and
+	// backups, when they have a verified email address. They're always
+	// told with a system message.
+	ActivityEmails bool `json:"activity_emails,omitempty"`
+	// AdminToken authorizes requests to the /admin routes, sent as a bearer
+	// token. The admin routes are disabled when it's empty.
+	AdminToken string `json:"admin_token,omitempty"`
+	APNS       struct {
 		KeyID      string `json:"key_id"`
 		P8Path     string `json:"p8_path"`
 		Production bool   `json:"production"`
 		TeamID     string `json:"team_id"`
 	} `json:"apns"`
-	AsymmetricKeys struct {
-		PublicHex string `json:"public"`
-		Public    []byte `json:"-"`
-		SecretHex string `json:"secret"`
-		Secret    []byte `json:"-"`
-	} `json:"asymmetric_keys"`
-	AutocertDirCache string `json:"autocert_dir_cache"`
-	Email            struct {
+	// AsymmetricKeys is the server's current key pair. Clients fetch its
+	// public key from /1/public-key.
+	AsymmetricKeys   asymmetricKeyConfig `json:"asymmetric_keys"`
+	AutocertDirCache string              `json:"autocert_dir_cache"`
+	// Branding replaces the product name, sender and links shown to users,
+	// for white-label deployments
+	Branding branding `json:"branding"`
+	// ClockSkewTolerance, a duration like "2m", is how long expiry dates
+	// handed to clients are honored after they pass, for clients whose
+	// clock runs behind. It's zero when empty.
+	ClockSkew          time.Duration `json:"-"`
+	ClockSkewTolerance string        `json:"clock_skew_tolerance,omitempty"`
+	// Database picks where the relational data is stored
+	Database databaseConfig `json:"database,omitempty"`
+	// DropBoxAliasGracePeriod, a duration like "168h", is how long a drop
+	// box alias keeps leading to its box after a newer alias is added, so
+	// the clients still using it can catch up. It's a week when empty.
+	DropBoxAliasGrace       time.Duration `json:"-"`
+	DropBoxAliasGracePeriod string        `json:"drop_box_alias_grace_period,omitempty"`
+	// DropBoxPackageTTL, a duration like "72h", is how long a package stays
+	// in its drop box. Clients can ask for less with the ttl parameter of a
+	// drop, but not for more. When empty, packages only expire when the
+	// client asks.
+	DropBoxTTL        time.Duration `json:"-"`
+	DropBoxPackageTTL string        `json:"drop_box_package_ttl,omitempty"`
+	Email             struct {
+		Provider      string `json:"provider"`
 		MailgunAPIKey string `json:"mailgun_api_key"`
-		Domain        string `json:"domain"`
+		// MailgunRegion is "us" (the default) or "eu", matching the region
+		// the domain was created in
+		MailgunRegion string `json:"mailgun_region,omitempty"`
+		// MailgunWebhookSigningKey verifies the delivery, bounce and
+		// complaint webhooks. The webhook endpoint is disabled without it.
+		MailgunWebhookSigningKey string `json:"mailgun_webhook_signing_key,omitempty"`
+		Domain                   string `json:"domain"`
+		// SMTPHost is the relay the smtp provider sends through. SMTPPort
+		// defaults to the usual port of SMTPSecurity, which is "starttls"
+		// (the default), "tls" for TLS from the start, or "none". The
+		// relay is only logged into when SMTPUsername is set.
+		SMTPHost     string `json:"smtp_host,omitempty"`
+		SMTPPort     int    `json:"smtp_port,omitempty"`
+		SMTPSecurity string `json:"smtp_security,omitempty"`
+		SMTPUsername string `json:"smtp_username,omitempty"`
+		SMTPPassword string `json:"smtp_password,omitempty"`
+		// TemplateDirectory holds a subdirectory of templates per locale,
+		// e.g. "fr/verification.tmpl", and optionally their html versions,
+		// e.g. "fr/verification.html.tmpl". DefaultLocale is used for users
+		// whose locale has no templates.
+		TemplateDirectory string `json:"template_directory,omitempty"`
+		DefaultLocale     string `json:"default_locale,omitempty"`
 	} `json:"email"`
-	FileStorage struct {
-		Type                 string `json:"type"`
-		GCPBucketName        string `json:"gcp_bucket_name"`
-		GCPCredentialsPath   string `json:"gcp_credentials_path"`
-		LocalDiskStoragePath string `json:"local_disk_storage_path"`
-	} `json:"file_storage"`
-	FCMServerKey    string `json:"fcm_server_key"`
-	Hostname        string `json:"hostname"`
-	KVDBDirectory   string `json:"kv_db_directory"`
-	Port            *int   `json:"port,omitempty"`
-	SQLDBDirectory  string `json:"sql_db_directory"`
-	SymmetricKey    []byte `json:"-"`
-	SymmetricKeyHex string `json:"symmetric_key"`
-	TLS             *bool  `json:"tls,omitempty"`
+	// FileGC deletes the backups of users that no longer exist from the
+	// file storage, every Interval, a duration like "24h". It's off when
+	// Interval is empty. DryRun only logs what would be deleted.
+	FileGC struct {
+		DryRun   bool          `json:"dry_run,omitempty"`
+		Every    time.Duration `json:"-"`
+		Interval string        `json:"interval,omitempty"`
+	} `json:"file_gc"`
+	FileStorage  fileStorageConfig `json:"file_storage"`
+	FCMServerKey string            `json:"fcm_server_key"`
+	Hostname     string            `json:"hostname"`
+	// HTTP tunes the timeouts and connection caps of the listeners
+	HTTP httpConfig `json:"http"`
+	// IngressPolicyURL, when set, is asked about every message and package
+	// before it's stored. It receives the metadata as JSON, and answers
+	// with a verdict of accept, throttle or reject.
+	IngressPolicyURL string `json:"ingress_policy_url,omitempty"`
+	// KV picks where the kv data is stored. KVDBDirectory is required even
+	// when it's not boltdb, since it also holds the log level file.
+	KV            kvStorageConfig `json:"kv,omitempty"`
+	KVDBDirectory string          `json:"kv_db_directory"`
+	// MinClientVersions rejects clients older than the minimum version for
+	// their platform, keyed by platform, e.g. {"android": "1.4.0"}.
+	MinClientVersions map[string]string `json:"min_client_versions,omitempty"`
+	// MaxQueuedMessages caps the messages kept for each recipient until
+	// they're fetched. Once it's reached, urgent messages evict the oldest
+	// ones that aren't urgent, and the others are rejected. Zero means no
+	// cap.
+	MaxQueuedMessages int64 `json:"max_queued_messages,omitempty"`
+	// ListenAddresses are the host:port pairs to serve on, e.g. "[::]:443"
+	// or "10.0.0.5:8080". When empty, the server listens on Port on all
+	// interfaces.
+	ListenAddresses []string `json:"listen_addresses,omitempty"`
+	// PaddingBuckets, when set, are the only sizes accepted for message
+	// cipher texts and drop box packages. Socket frames are padded to them.
+	PaddingBuckets []int `json:"padding_buckets,omitempty"`
+	Port           *int  `json:"port,omitempty"`
+	Push           struct {
+		// DebounceWindow, a duration like "30s", limits each recipient to
+		// one push per window. Pushes during the window are coalesced into
+		// the latest one, which is sent when the window ends. This keeps
+		// rapid streams of messages, like live location updates, from
+		// costing a push each.
+		Debounce       time.Duration `json:"-"`
+		DebounceWindow string        `json:"debounce_window,omitempty"`
+		// DryRun validates and logs native pushes without delivering them,
+		// so staging servers can use real device tokens
+		DryRun   bool   `json:"dry_run,omitempty"`
+		Provider string `json:"provider"`
+	} `json:"push"`
+	// PreviousAsymmetricKeys hold key pairs that were rotated out. Data
+	// clients address to them is still accepted, until they're retired by
+	// removing them. 'oscar rotate-keypair' does both.
+	PreviousAsymmetricKeys []asymmetricKeyConfig `json:"previous_asymmetric_keys,omitempty"`
+	// PreviousSymmetricKeysHex holds keys that were rotated out. Data sealed
+	// under them can still be read, and is resealed in the background.
+	PreviousSymmetricKeys    [][]byte `json:"-"`
+	PreviousSymmetricKeysHex []string `json:"previous_symmetric_keys,omitempty"`
+	// PrimaryURL makes this instance a read-only replica of the primary at
+	// that base url, e.g. "https://api.zood.xyz". The replica serves public
+	// keys, user info, messages and packages from its own storage, which
+	// the operator keeps replicated from the primary's, and proxies every
+	// other request to the primary.
+	PrimaryURL string `json:"primary_url,omitempty"`
+	// RateLimits throttles the requests of each client address
+	RateLimits rateLimitConfig `json:"rate_limits,omitempty"`
+	// ReplicaAddresses are the addresses or CIDR ranges the replicas of this
+	// primary connect from. The requests they proxy are attributed to the
+	// client address they add to X-Forwarded-For, rather than the replica's.
+	ReplicaAddresses []string `json:"replica_addresses,omitempty"`
+	// ReplicaURLs are the base urls of the replicas of this primary. They're
+	// advertised in server-info, so clients can pick the closest one.
+	ReplicaURLs []string `json:"replica_urls,omitempty"`
+	// RequestTimeout bounds how long a request may take, as a duration like
+	// "10s". RouteTimeouts overrides it for specific routes, keyed by path
+	// template, e.g. {"/1/users/me/backup": "1m"}. The backup route defaults
+	// to 10 minutes, and the websocket routes are never timed out.
+	RequestTimeout string            `json:"request_timeout,omitempty"`
+	RouteTimeouts  map[string]string `json:"route_timeouts,omitempty"`
+	// SocketDrain tunes how the websockets are closed when the server is
+	// asked to stop
+	SocketDrain    socketDrainConfig `json:"socket_drain,omitempty"`
+	SQLDBDirectory string            `json:"sql_db_directory"`
+	// SQLDBKey, when present, encrypts the sqlite database with SQLCipher. It
+	// is read from either sql_db_key or sql_db_key_file. The latter allows
+	// the key to be provisioned by a KMS agent or a mounted secret.
+	SQLDBKey     []byte `json:"-"`
+	SQLDBKeyFile string `json:"sql_db_key_file,omitempty"`
+	SQLDBKeyHex  string `json:"sql_db_key,omitempty"`
+	// StorageQuotaBytes caps the bytes each user can keep in the file
+	// storage. Zero means no cap.
+	StorageQuotaBytes int64 `json:"storage_quota_bytes,omitempty"`
+	// StorageSlowThreshold is how long a storage operation may take, a
+	// duration like "200ms", before it's logged as slow. It defaults to
+	// 200ms, and "0s" turns the logging off.
+	StorageSlow          time.Duration `json:"-"`
+	StorageSlowThreshold string        `json:"storage_slow_threshold,omitempty"`
+	// SealStoredMessages seals the envelope of stored messages to the
+	// recipient's public key, so the database only holds routing metadata
+	SealStoredMessages bool       `json:"seal_stored_messages,omitempty"`
+	SymmetricKey       []byte     `json:"-"`
+	SymmetricKeyHex    string     `json:"symmetric_key"`
+	TLS                *bool      `json:"tls,omitempty"`
+	Tor                *torConfig `json:"tor,omitempty"`
+	// UsernameIndexSalt keys the blind index used for hashed username
+	// lookups. It is public, since clients need it to compute the index.
+	// Changing it requires clearing the username_index column, so the
+	// indexes are recomputed on the next start.
+	UsernameIndexSalt    []byte `json:"-"`
+	UsernameIndexSaltHex string `json:"username_index_salt,omitempty"`
 }
 
-// var config *serverConfig
+// asymmetricKeyConfig is one of the server's key pairs, hex encoded
+type asymmetricKeyConfig struct {
+	PublicHex string `json:"public"`
+	Public    []byte `json:"-"`
+	SecretHex string `json:"secret"`
+	Secret    []byte `json:"-"`
+}
 
-func loadConfig(confPath string) (*serverConfig, error) {
-	f, err := os.Open(confPath)
+// decode decodes and checks the keys. name starts the error messages.
+func (akc *asymmetricKeyConfig) decode(name string) error {
+	var err error
+	akc.Public, err = hex.DecodeString(akc.PublicHex)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to open config file")
+		return errors.Wrapf(err, "%s public key decode failed", name)
+	}
+	akc.Secret, err = hex.DecodeString(akc.SecretHex)
+	if err != nil {
+		return errors.Wrapf(err, "%s secret key decode failed", name)
+	}
+	if len(akc.Public) != sodium.PublicKeySize {
+		return errors.Errorf("invalid %s public key size (%d); should be %d bytes", name, len(akc.Public), sodium.PublicKeySize)
 	}
+	if len(akc.Secret) != sodium.SecretKeySize {
+		return errors.Errorf("invalid %s secret key size (%d); should be %d bytes", name, len(akc.Secret), sodium.SecretKeySize)
+	}
+	return nil
+}
+
+// keyPair returns the decoded keys
+func (akc asymmetricKeyConfig) keyPair() sodium.KeyPair {
+	return sodium.KeyPair{Public: akc.Public, Secret: akc.Secret}
+}
+
+// torConfig describes the onion service published via the tor control port.
+// The onion service is served plain HTTP on ListenAddress, which should only
+// be reachable by tor; tor provides the encryption and authentication.
+type torConfig struct {
+	ControlAddress  string `json:"control_address"`
+	ControlPassword string `json:"control_password"`
+	CookiePath      string `json:"cookie_path"`
+	KeyPath         string `json:"key_path"`
+	ListenAddress   string `json:"listen_address"`
+}
+
+// Values for the email 'provider' field
+const (
+	emailProviderMailgun = "mailgun"
+	emailProviderSMTP    = "smtp"
+	emailProviderLog     = "log"
+)
+
+// Values for the push 'provider' field. The native provider delivers via
+// FCM and APNS.
+const (
+	pushProviderNative = "native"
+	pushProviderLog    = "log"
+)
+
+// var config *serverConfig
 
+// loadConfig reads and validates the config file at confPath. In sandbox
+// mode, the config file is optional, and any settings that would cause
+// side effects outside of this machine are overridden.
+func loadConfig(confPath string, sandbox bool) (*serverConfig, error) {
+	var err error
 	cfg := serverConfig{}
-	decoder := json.NewDecoder(f)
-	decoder.DisallowUnknownFields()
-	err = decoder.Decode(&cfg)
-	if err != nil {
-		return nil, errors.Wrap(err, "unable to parse config file")
+	if confPath != "" || !sandbox {
+		f, err := os.Open(confPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to open config file")
+		}
+		defer f.Close()
+
+		decoder := json.NewDecoder(f)
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&cfg)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to parse config file")
+		}
+	}
+
+	if sandbox {
+		err = cfg.applySandbox()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to apply sandbox settings")
+		}
 	}
 
 	// symmetric key
@@ -69,57 +292,201 @@ func loadConfig(confPath string) (*serverConfig, error) {
 	if len(cfg.SymmetricKey) != sodium.SymmetricKeySize {
 		return nil, errors.Errorf("invalid sym key size (%d); should be %d bytes", len(cfg.SymmetricKey), sodium.SymmetricKeySize)
 	}
-
-	if cfg.AutocertDirCache == "" {
-		return nil, errors.New("'autocert_dir_cache' field is missing")
+	for i, keyHex := range cfg.PreviousSymmetricKeysHex {
+		key, err := hex.DecodeString(keyHex)
+		if err != nil {
+			return nil, errors.Wrapf(err, "previous sym key %d decode failed", i)
+		}
+		if len(key) != sodium.SymmetricKeySize {
+			return nil, errors.Errorf("invalid previous sym key %d size (%d); should be %d bytes", i, len(key), sodium.SymmetricKeySize)
+		}
+		cfg.PreviousSymmetricKeys = append(cfg.PreviousSymmetricKeys, key)
 	}
 
 	// public/private keys
-	cfg.AsymmetricKeys.Public, err = hex.DecodeString(cfg.AsymmetricKeys.PublicHex)
-	if err != nil {
-		return nil, errors.Wrap(err, "asym public key decode failed")
-	}
-	cfg.AsymmetricKeys.Secret, err = hex.DecodeString(cfg.AsymmetricKeys.SecretHex)
-	if err != nil {
-		return nil, errors.Wrap(err, "asym secret key decode failed")
+	if err = cfg.AsymmetricKeys.decode("asym"); err != nil {
+		return nil, err
 	}
-	if len(cfg.AsymmetricKeys.Public) != sodium.PublicKeySize {
-		return nil, errors.Errorf("invalid public key size (%d); should be %d bytes", len(cfg.AsymmetricKeys.Public), sodium.PublicKeySize)
+	keyIDs := map[string]bool{serverKeyID(cfg.AsymmetricKeys.Public): true}
+	for i := range cfg.PreviousAsymmetricKeys {
+		prev := &cfg.PreviousAsymmetricKeys[i]
+		if err = prev.decode(fmt.Sprintf("previous asym key %d", i)); err != nil {
+			return nil, err
+		}
+		id := serverKeyID(prev.Public)
+		if keyIDs[id] {
+			return nil, errors.Errorf("previous asym key %d has the same key id (%s) as another key", i, id)
+		}
+		keyIDs[id] = true
 	}
-	if len(cfg.AsymmetricKeys.Secret) != sodium.SecretKeySize {
-		return nil, errors.Errorf("invalid secret key size (%d); should be %d bytes", len(cfg.AsymmetricKeys.Secret), sodium.SecretKeySize)
+
+	if cfg.UsernameIndexSaltHex != "" {
+		cfg.UsernameIndexSalt, err = hex.DecodeString(cfg.UsernameIndexSaltHex)
+		if err != nil {
+			return nil, errors.Wrap(err, "username index salt decode failed")
+		}
+		if len(cfg.UsernameIndexSalt) != usernameIndexSaltSize {
+			return nil, errors.Errorf("invalid username index salt size (%d); should be %d bytes", len(cfg.UsernameIndexSalt), usernameIndexSaltSize)
+		}
 	}
 
-	// Firebase cloud messaging
-	if cfg.FCMServerKey == "" {
-		return nil, errors.New("fcm_server_key is empty/missing")
+	if _, err = newPaddingPolicy(cfg.PaddingBuckets); err != nil {
+		return nil, err
+	}
+	if _, err = newTimeoutPolicy(cfg.RequestTimeout, cfg.RouteTimeouts); err != nil {
+		return nil, err
+	}
+	if _, err = newRateLimitPolicy(cfg.RateLimits, nil); err != nil {
+		return nil, err
+	}
+	if _, err = newHTTPLimits(cfg.HTTP); err != nil {
+		return nil, err
+	}
+	if cfg.StorageQuotaBytes < 0 {
+		return nil, errors.New("storage_quota_bytes can't be negative")
+	}
+	if cfg.MaxQueuedMessages < 0 {
+		return nil, errors.New("max_queued_messages can't be negative")
+	}
+	if _, err = newClientVersionPolicy(cfg.MinClientVersions); err != nil {
+		return nil, err
+	}
+	if _, err = newReplicaProxy(cfg.PrimaryURL); err != nil {
+		return nil, err
+	}
+	if cfg.IngressPolicyURL != "" {
+		if _, err = parseInstanceURL(cfg.IngressPolicyURL); err != nil {
+			return nil, errors.Wrap(err, "invalid ingress policy url")
+		}
+	}
+	if cfg.PrimaryURL != "" && len(cfg.ReplicaURLs) > 0 {
+		return nil, errors.New("replicas can't have replica_urls of their own")
+	}
+	for _, u := range cfg.ReplicaURLs {
+		if _, err = parseInstanceURL(u); err != nil {
+			return nil, errors.Wrap(err, "invalid replica url")
+		}
+	}
+	if cfg.PrimaryURL != "" && len(cfg.ReplicaAddresses) > 0 {
+		return nil, errors.New("replicas can't have replica_addresses of their own")
+	}
+	if _, err = parseProxySources(cfg.ReplicaAddresses); err != nil {
+		return nil, errors.Wrap(err, "invalid replica_addresses")
+	}
+	if cfg.Branding, err = cfg.Branding.withDefaults(); err != nil {
+		return nil, err
 	}
-	gFCMServerKey = cfg.FCMServerKey
 
-	// Apple push notifications
-	if cfg.APNS.KeyID == "" {
-		return nil, errors.New("apns 'key_id' is empty/missing")
+	switch cfg.Push.Provider {
+	case "":
+		cfg.Push.Provider = pushProviderNative
+		fallthrough
+	case pushProviderNative:
+		// Firebase cloud messaging
+		if cfg.FCMServerKey == "" {
+			return nil, errors.New("fcm_server_key is empty/missing")
+		}
+
+		// Apple push notifications
+		if cfg.APNS.KeyID == "" {
+			return nil, errors.New("apns 'key_id' is empty/missing")
+		}
+		if cfg.APNS.P8Path == "" {
+			return nil, errors.New("apns 'p8_path' is empty/missing")
+		}
+		if cfg.APNS.TeamID == "" {
+			return nil, errors.New("apns 'team_id' is empty/missing")
+		}
+	case pushProviderLog:
+	default:
+		return nil, errors.Errorf("unknown push provider: '%s'", cfg.Push.Provider)
+	}
+	if cfg.ClockSkewTolerance != "" {
+		cfg.ClockSkew, err = time.ParseDuration(cfg.ClockSkewTolerance)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid 'clock_skew_tolerance'")
+		}
+		if cfg.ClockSkew < 0 {
+			return nil, errors.New("'clock_skew_tolerance' can't be negative")
+		}
 	}
-	if cfg.APNS.P8Path == "" {
-		return nil, errors.New("apns 'p8_path' is empty/missing")
+	cfg.DropBoxAliasGrace = defaultDropBoxAliasGrace
+	if cfg.DropBoxAliasGracePeriod != "" {
+		cfg.DropBoxAliasGrace, err = time.ParseDuration(cfg.DropBoxAliasGracePeriod)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid 'drop_box_alias_grace_period'")
+		}
+		if cfg.DropBoxAliasGrace < 0 {
+			return nil, errors.New("'drop_box_alias_grace_period' can't be negative")
+		}
 	}
-	if cfg.APNS.TeamID == "" {
-		return nil, errors.New("apns 'team_id' is empty/missing")
+	if cfg.DropBoxPackageTTL != "" {
+		cfg.DropBoxTTL, err = time.ParseDuration(cfg.DropBoxPackageTTL)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid 'drop_box_package_ttl'")
+		}
+		if cfg.DropBoxTTL < time.Second {
+			return nil, errors.New("'drop_box_package_ttl' must be at least a second")
+		}
 	}
-	err = createAPNSClient(cfg.APNS.P8Path, cfg.APNS.KeyID, cfg.APNS.TeamID, cfg.APNS.Production)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to set up apple push notification service client")
+	cfg.StorageSlow = defaultStorageSlowThreshold
+	if cfg.StorageSlowThreshold != "" {
+		cfg.StorageSlow, err = time.ParseDuration(cfg.StorageSlowThreshold)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid 'storage_slow_threshold'")
+		}
+		if cfg.StorageSlow < 0 {
+			return nil, errors.New("'storage_slow_threshold' can't be negative")
+		}
+	}
+	if cfg.Push.DebounceWindow != "" {
+		cfg.Push.Debounce, err = time.ParseDuration(cfg.Push.DebounceWindow)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid push 'debounce_window'")
+		}
+		if cfg.Push.Debounce <= 0 {
+			return nil, errors.New("push 'debounce_window' must be positive")
+		}
 	}
 
 	// sql database
-	if cfg.SQLDBDirectory == "" {
-		return nil, fmt.Errorf("'sql_db_directory' is empty/missing")
+	if err = cfg.Database.validate(); err != nil {
+		return nil, err
 	}
-	if fi, err := os.Stat(cfg.SQLDBDirectory); err != nil {
-		return nil, fmt.Errorf("while stat'ing sql_db_directory: %w", err)
-	} else {
-		if !fi.IsDir() {
-			return nil, fmt.Errorf("'%s' is not a directory. need a directory for 'sql_db_directory'", cfg.SQLDBDirectory)
+	if cfg.Database.Type == "sqlite" {
+		if cfg.SQLDBDirectory == "" {
+			return nil, fmt.Errorf("'sql_db_directory' is empty/missing")
+		}
+		if fi, err := os.Stat(cfg.SQLDBDirectory); err != nil {
+			return nil, fmt.Errorf("while stat'ing sql_db_directory: %w", err)
+		} else {
+			if !fi.IsDir() {
+				return nil, fmt.Errorf("'%s' is not a directory. need a directory for 'sql_db_directory'", cfg.SQLDBDirectory)
+			}
+		}
+	}
+
+	if cfg.SQLDBKeyHex != "" && cfg.SQLDBKeyFile != "" {
+		return nil, errors.New("only one of 'sql_db_key' and 'sql_db_key_file' may be set")
+	}
+	keyHex := cfg.SQLDBKeyHex
+	if cfg.SQLDBKeyFile != "" {
+		buf, err := ioutil.ReadFile(cfg.SQLDBKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read sql_db_key_file")
+		}
+		keyHex = strings.TrimSpace(string(buf))
+	}
+	if keyHex != "" && cfg.Database.Type != "sqlite" {
+		return nil, errors.New("the sql db key only encrypts sqlite databases")
+	}
+	if keyHex != "" {
+		cfg.SQLDBKey, err = hex.DecodeString(keyHex)
+		if err != nil {
+			return nil, errors.Wrap(err, "sql db key decode failed")
+		}
+		if len(cfg.SQLDBKey) != sqlite.EncryptionKeySize {
+			return nil, errors.Errorf("invalid sql db key size (%d); should be %d bytes", len(cfg.SQLDBKey), sqlite.EncryptionKeySize)
 		}
 	}
 
@@ -134,10 +501,37 @@ func loadConfig(confPath string) (*serverConfig, error) {
 			return nil, fmt.Errorf("'%s' is not a directory. need a directory for 'kv_db_directory'", cfg.KVDBDirectory)
 		}
 	}
+	if err = cfg.KV.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.RateLimits.Store == rateLimitStoreRedis && cfg.KV.Type != "redis" {
+		return nil, errors.New("the redis rate limits store needs the redis kv storage")
+	}
 
 	// set up our file storage
-	if cfg.FileStorage.Type != "localdisk" && cfg.FileStorage.Type != "gcs" {
-		return nil, errors.Errorf("unknown filestor provider: '%s'", cfg.FileStorage.Type)
+	if err = cfg.FileStorage.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.FileGC.Interval != "" {
+		cfg.FileGC.Every, err = time.ParseDuration(cfg.FileGC.Interval)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid file_gc 'interval'")
+		}
+		if cfg.FileGC.Every <= 0 {
+			return nil, errors.New("file_gc 'interval' must be positive")
+		}
+	}
+	if cfg.FileStorage.EncryptionKeyHex != "" {
+		if !cfg.FileStorage.Encrypt {
+			return nil, errors.New("file_storage.encryption_key is set, but encrypt is off")
+		}
+		cfg.FileStorage.EncryptionKey, err = hex.DecodeString(cfg.FileStorage.EncryptionKeyHex)
+		if err != nil {
+			return nil, errors.Wrap(err, "file storage encryption key decode failed")
+		}
+		if len(cfg.FileStorage.EncryptionKey) != sodium.SymmetricKeySize {
+			return nil, errors.Errorf("invalid file storage encryption key size (%d); should be %d bytes", len(cfg.FileStorage.EncryptionKey), sodium.SymmetricKeySize)
+		}
 	}
 
 	// TLS info
@@ -146,6 +540,15 @@ func loadConfig(confPath string) (*serverConfig, error) {
 		cfg.Port = &port
 	}
 
+	if len(cfg.ListenAddresses) == 0 {
+		cfg.ListenAddresses = []string{fmt.Sprintf(":%d", *cfg.Port)}
+	}
+	for _, addr := range cfg.ListenAddresses {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, errors.Wrapf(err, "invalid listen address '%s'", addr)
+		}
+	}
+
 	if cfg.TLS == nil {
 		tls := true
 		cfg.TLS = &tls
@@ -155,15 +558,142 @@ func loadConfig(confPath string) (*serverConfig, error) {
 		if cfg.Hostname == "" {
 			return nil, errors.New("Hostname is required when TLS is enabled")
 		}
+		if cfg.AutocertDirCache == "" {
+			return nil, errors.New("'autocert_dir_cache' field is missing")
+		}
 	}
 
-	// mailgun info
-	if cfg.Email.MailgunAPIKey == "" {
-		return nil, errors.New("mailgun api key is missing")
+	if cfg.Tor != nil {
+		if cfg.Tor.ControlAddress == "" {
+			cfg.Tor.ControlAddress = "127.0.0.1:9051"
+		}
+		if cfg.Tor.ListenAddress == "" {
+			cfg.Tor.ListenAddress = "127.0.0.1:8081"
+		}
+		if cfg.Tor.KeyPath == "" {
+			return nil, errors.New("tor 'key_path' is empty/missing")
+		}
 	}
-	if cfg.Email.Domain == "" {
-		return nil, errors.New("email domain is missing")
+
+	switch cfg.Email.Provider {
+	case "":
+		cfg.Email.Provider = emailProviderMailgun
+		fallthrough
+	case emailProviderMailgun:
+		if cfg.Email.MailgunAPIKey == "" {
+			return nil, errors.New("mailgun api key is missing")
+		}
+		if cfg.Email.Domain == "" {
+			return nil, errors.New("email domain is missing")
+		}
+		if _, err = mailgun.BaseURLForRegion(cfg.Email.MailgunRegion); err != nil {
+			return nil, err
+		}
+	case emailProviderSMTP:
+		if cfg.Email.SMTPHost == "" {
+			return nil, errors.New("email smtp_host is missing")
+		}
+		if cfg.Email.SMTPPort < 0 || cfg.Email.SMTPPort > 65535 {
+			return nil, errors.Errorf("invalid email smtp_port %d", cfg.Email.SMTPPort)
+		}
+		if _, err = smtp.DefaultPort(cfg.Email.SMTPSecurity); err != nil {
+			return nil, err
+		}
+		if cfg.Email.SMTPUsername == "" && cfg.Email.SMTPPassword != "" {
+			return nil, errors.New("email smtp_password needs smtp_username")
+		}
+	case emailProviderLog:
+	default:
+		return nil, errors.Errorf("unknown email provider: '%s'", cfg.Email.Provider)
 	}
 
 	return &cfg, nil
 }
+
+// applySandbox forces the log based email and push providers, disables TLS,
+// Tor and the ingress policy webhook, keeps the instance from replicating a
+// primary, and points any unconfigured storage at a temporary directory. Keys
+// that are missing are generated, so a sandbox can be started without any config.
+func (cfg *serverConfig) applySandbox() error {
+	cfg.Email.Provider = emailProviderLog
+	cfg.Push.Provider = pushProviderLog
+
+	tls := false
+	cfg.TLS = &tls
+	// a replica would send its writes to the primary
+	cfg.PrimaryURL = ""
+	// a sandbox is never published as an onion service
+	cfg.Tor = nil
+	// nor does it send its traffic to a production ingress policy
+	cfg.IngressPolicyURL = ""
+	if cfg.Port == nil {
+		port := 8080
+		cfg.Port = &port
+	}
+
+	if cfg.SymmetricKeyHex == "" {
+		key := make([]byte, sodium.SymmetricKeySize)
+		if err := sodium.Random(key); err != nil {
+			return errors.Wrap(err, "failed to generate symmetric key")
+		}
+		cfg.SymmetricKeyHex = hex.EncodeToString(key)
+	}
+	if cfg.AsymmetricKeys.PublicHex == "" && cfg.AsymmetricKeys.SecretHex == "" {
+		kp, err := sodium.NewKeyPair()
+		if err != nil {
+			return errors.Wrap(err, "failed to generate key pair")
+		}
+		cfg.AsymmetricKeys.PublicHex = hex.EncodeToString(kp.Public)
+		cfg.AsymmetricKeys.SecretHex = hex.EncodeToString(kp.Secret)
+	}
+
+	if cfg.UsernameIndexSaltHex == "" {
+		salt := make([]byte, usernameIndexSaltSize)
+		if err := sodium.Random(salt); err != nil {
+			return errors.Wrap(err, "failed to generate username index salt")
+		}
+		cfg.UsernameIndexSaltHex = hex.EncodeToString(salt)
+	}
+
+	// memory storage is already free of side effects
+	if cfg.FileStorage.Type != "localdisk" && cfg.FileStorage.Type != "memory" {
+		cfg.FileStorage.Type = "localdisk"
+		cfg.FileStorage.LocalDiskStoragePath = ""
+		cfg.FileStorage.Replicas = nil
+	}
+	// the relational data stays out of any shared postgres database
+	cfg.Database = databaseConfig{Type: "sqlite"}
+	// and the kv data stays out of any shared redis database
+	if cfg.KV.Type != "memory" {
+		cfg.KV = kvStorageConfig{Type: "boltdb"}
+	}
+	dirs := []*string{&cfg.SQLDBDirectory, &cfg.KVDBDirectory}
+	names := []string{"sql", "kv"}
+	if cfg.FileStorage.Type == "localdisk" {
+		dirs = append(dirs, &cfg.FileStorage.LocalDiskStoragePath)
+		names = append(names, "files")
+	}
+	missing := false
+	for _, dir := range dirs {
+		missing = missing || *dir == ""
+	}
+	if !missing {
+		return nil
+	}
+
+	root, err := ioutil.TempDir("", "oscar-sandbox")
+	if err != nil {
+		return errors.Wrap(err, "failed to create sandbox directory")
+	}
+	for i, dir := range dirs {
+		if *dir != "" {
+			continue
+		}
+		*dir = filepath.Join(root, names[i])
+		if err := os.MkdirAll(*dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
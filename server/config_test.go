@@ -0,0 +1,33 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplySandbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oscar-sandbox-config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := &serverConfig{
+		PrimaryURL:       "https://primary.example.com",
+		SQLDBDirectory:   filepath.Join(dir, "sql"),
+		KVDBDirectory:    filepath.Join(dir, "kv"),
+		Tor:              &torConfig{},
+		IngressPolicyURL: "https://policy.example.com/check",
+	}
+	cfg.FileStorage.Type = "memory"
+	require.NoError(t, cfg.applySandbox())
+
+	require.Equal(t, emailProviderLog, cfg.Email.Provider)
+	require.Equal(t, pushProviderLog, cfg.Push.Provider)
+	require.False(t, *cfg.TLS)
+	require.Empty(t, cfg.PrimaryURL)
+	require.Nil(t, cfg.Tor)
+	require.Empty(t, cfg.IngressPolicyURL)
+}
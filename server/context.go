@@ -3,10 +3,12 @@ package main
 type contextKey string
 
 const (
+	contextAPIVersionKey                = contextKey("api_version")
 	contextUserIDKey                    = contextKey("user_id")
 	contextFileStorageProviderKey       = contextKey("file_storage_provider")
 	contextKeyValueProviderKey          = contextKey("key_value_provider")
 	contextRelationalStorageProviderKey = contextKey("relational_storage_provider")
+	contextRequestLogKey                = contextKey("request_log")
 	contextSendEmailerKey               = contextKey("send_emailer")
 	contextServerProvidersKey           = contextKey("server_providers")
 )
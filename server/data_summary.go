@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"zood.dev/oscar/filestor"
+)
+
+// dataSummary describes how much the server stores about a user, so apps
+// can show it on a privacy screen. Only counts and sizes are included.
+type dataSummary struct {
+	PendingMessages     int64 `json:"pending_messages"`
+	PendingMessageBytes int64 `json:"pending_message_bytes"`
+	// BackupVersions is 0 or 1, since each upload replaces the last backup
+	BackupVersions int64 `json:"backup_versions"`
+	BackupBytes    int64 `json:"backup_bytes"`
+	APNSTokens     int64 `json:"apns_tokens"`
+	FCMTokens      int64 `json:"fcm_tokens"`
+	ActiveSessions int64 `json:"active_sessions"`
+}
+
+// dataSummaryHandler handles GET /users/me/data-summary
+func dataSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromContext(r.Context())
+	providers := providersCtx(r.Context())
+	db := providers.db
+	if shouldLogInfo() {
+		log.Printf("data_summary: %s", db.Username(userID))
+	}
+
+	counts, err := db.UserDataSummary(userID, providers.now().Unix())
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	summary := dataSummary{
+		PendingMessages:     counts.PendingMessages,
+		PendingMessageBytes: counts.PendingMessageBytes,
+		APNSTokens:          counts.APNSTokens,
+		FCMTokens:           counts.FCMTokens,
+		ActiveSessions:      counts.ActiveSessions,
+	}
+
+	size, err := providers.fs.FileSize(backupPath(userID))
+	switch err {
+	case nil:
+		summary.BackupVersions = 1
+		summary.BackupBytes = size
+	case filestor.ErrFileNotExist:
+	default:
+		sendInternalErr(w, err)
+		return
+	}
+
+	sendSuccess(w, summary)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/model"
+)
+
+func TestDataSummaryHandler(t *testing.T) {
+	providers := createTestProviders(t)
+	router := newOscarRouter(providers)
+	user, keyPair := createTestUser(t, providers)
+	token := loginTestUser(t, providers, user, keyPair)
+
+	get := func() dataSummary {
+		r := httptest.NewRequest(http.MethodGet, "/1/users/me/data-summary", nil)
+		r.Header.Set("X-Oscar-Access-Token", token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.Bytes())
+		var summary dataSummary
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&summary))
+		return summary
+	}
+
+	summary := get()
+	require.Equal(t, dataSummary{ActiveSessions: 1}, summary)
+
+	_, err := providers.db.InsertMessage(user.ID, 0, []byte("cipher-text"), []byte("nonce"), 1234)
+	require.NoError(t, err)
+	require.NoError(t, providers.db.InsertFCMToken(user.ID, "fcm-token", model.ClientRecord{}))
+	require.NoError(t, providers.fs.WriteFile(backupPath(user.ID), bytes.NewReader(make([]byte, 100))))
+
+	summary = get()
+	require.Equal(t, dataSummary{
+		PendingMessages:     1,
+		PendingMessageBytes: int64(len("cipher-text")),
+		BackupVersions:      1,
+		BackupBytes:         100,
+		FCMTokens:           1,
+		ActiveSessions:      1,
+	}, summary)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"zood.dev/oscar/model"
+	"zood.dev/oscar/postgres"
+	"zood.dev/oscar/replicadb"
+	"zood.dev/oscar/sqlite"
+
+	"github.com/pkg/errors"
+)
+
+// databaseConfig picks where users, messages, sessions and the other
+// relational data are stored
+type databaseConfig struct {
+	// Type is sqlite (the default), which keeps the data in
+	// sql_db_directory, or postgres. sqlite allows a single instance, and a
+	// single writer, so instances can only share their relational data
+	// through postgres.
+	Type string `json:"type,omitempty"`
+	// PostgresMaxConns caps the pool of connections to postgres. It
+	// defaults to 10.
+	PostgresMaxConns int `json:"postgres_max_conns,omitempty"`
+	// PostgresURL is the connection string, like
+	// "postgres://oscar:password@db:5432/oscar". When it's empty, it's read
+	// from DATABASE_URL.
+	PostgresURL string `json:"postgres_url,omitempty"`
+	// PostgresReplicaURLs are connection strings of read replicas of the
+	// database. User lookups and fetches of messages by id are spread
+	// across them, and go to the primary when a replica fails or hasn't
+	// caught up yet. Listing a recipient's messages always goes to the
+	// primary. Each replica gets a pool of postgres_max_conns connections.
+	PostgresReplicaURLs []string `json:"postgres_replica_urls,omitempty"`
+	// SQLiteBusyTimeout, a duration like "5s", is how long a write waits
+	// for another one to finish before it fails. It defaults to 5s.
+	SQLiteBusy        time.Duration `json:"-"`
+	SQLiteBusyTimeout string        `json:"sqlite_busy_timeout,omitempty"`
+	// SQLiteMaxOpenConns caps the pool of connections to sqlite. Only one
+	// of them writes at a time, but the others can read meanwhile. It
+	// defaults to 4.
+	SQLiteMaxOpenConns int `json:"sqlite_max_open_conns,omitempty"`
+}
+
+// validate checks that the settings of the database type are present, and
+// fills in the ones that come from the environment
+func (dbc *databaseConfig) validate() error {
+	switch dbc.Type {
+	case "", "sqlite":
+		dbc.Type = "sqlite"
+		dbc.SQLiteBusy = sqlite.DefaultBusyTimeout
+		if dbc.SQLiteBusyTimeout != "" {
+			var err error
+			dbc.SQLiteBusy, err = time.ParseDuration(dbc.SQLiteBusyTimeout)
+			if err != nil {
+				return errors.Wrap(err, "invalid database 'sqlite_busy_timeout'")
+			}
+			if dbc.SQLiteBusy <= 0 {
+				return errors.New("database sqlite_busy_timeout must be positive")
+			}
+		}
+		if dbc.SQLiteMaxOpenConns < 0 {
+			return errors.New("database sqlite_max_open_conns can't be negative")
+		}
+		if dbc.SQLiteMaxOpenConns == 0 {
+			dbc.SQLiteMaxOpenConns = sqlite.DefaultMaxOpenConns
+		}
+	case "postgres":
+		if dbc.PostgresURL == "" {
+			dbc.PostgresURL = os.Getenv("DATABASE_URL")
+		}
+		if dbc.PostgresURL == "" {
+			return errors.New("postgres database needs postgres_url")
+		}
+		if dbc.PostgresMaxConns < 0 {
+			return errors.New("database postgres_max_conns can't be negative")
+		}
+		if dbc.PostgresMaxConns == 0 {
+			dbc.PostgresMaxConns = postgres.DefaultMaxConns
+		}
+	default:
+		return errors.Errorf("unknown database type: '%s'", dbc.Type)
+	}
+	if len(dbc.PostgresReplicaURLs) > 0 && dbc.Type != "postgres" {
+		return errors.New("database postgres_replica_urls needs the postgres type")
+	}
+	return nil
+}
+
+// newDatabase creates the model.Provider described by the config
+func newDatabase(cfg *serverConfig) (model.Provider, error) {
+	switch cfg.Database.Type {
+	case "sqlite":
+		dsn := fmt.Sprintf("file:%s", filepath.Join(cfg.SQLDBDirectory, "sqlite.db"))
+		opts := sqlite.Options{
+			BusyTimeout:  cfg.Database.SQLiteBusy,
+			MaxOpenConns: cfg.Database.SQLiteMaxOpenConns,
+		}
+		var db model.Provider
+		var err error
+		if cfg.SQLDBKey != nil {
+			db, err = sqlite.NewEncrypted(dsn, cfg.SQLDBKey, opts)
+		} else {
+			db, err = sqlite.New(dsn, opts)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to open sqlite db")
+		}
+		return db, nil
+	case "postgres":
+		db, err := postgres.New(cfg.Database.PostgresURL, cfg.Database.PostgresMaxConns)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to connect to postgres")
+		}
+		if len(cfg.Database.PostgresReplicaURLs) == 0 {
+			return db, nil
+		}
+		replicas := make([]model.Provider, len(cfg.Database.PostgresReplicaURLs))
+		for i, url := range cfg.Database.PostgresReplicaURLs {
+			replicas[i], err = postgres.NewReplica(url, cfg.Database.PostgresMaxConns)
+			if err != nil {
+				return nil, errors.Wrapf(err, "unable to connect to postgres replica %d", i)
+			}
+		}
+		return replicadb.New(db, replicas...), nil
+	default:
+		return nil, errors.Errorf("unknown database type: '%s'", cfg.Database.Type)
+	}
+}
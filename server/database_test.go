@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/postgres"
+	"zood.dev/oscar/sqlite"
+)
+
+func TestDatabaseConfig(t *testing.T) {
+	dbc := databaseConfig{}
+	require.NoError(t, dbc.validate())
+	require.Equal(t, "sqlite", dbc.Type)
+	require.Equal(t, sqlite.DefaultBusyTimeout, dbc.SQLiteBusy)
+	require.Equal(t, sqlite.DefaultMaxOpenConns, dbc.SQLiteMaxOpenConns)
+
+	dbc = databaseConfig{SQLiteBusyTimeout: "250ms", SQLiteMaxOpenConns: 8}
+	require.NoError(t, dbc.validate())
+	require.Equal(t, 250*time.Millisecond, dbc.SQLiteBusy)
+	require.Equal(t, 8, dbc.SQLiteMaxOpenConns)
+	dbc = databaseConfig{SQLiteBusyTimeout: "soon"}
+	require.Error(t, dbc.validate())
+	dbc = databaseConfig{SQLiteBusyTimeout: "0s"}
+	require.Error(t, dbc.validate())
+	dbc = databaseConfig{SQLiteMaxOpenConns: -1}
+	require.Error(t, dbc.validate())
+
+	dbc = databaseConfig{Type: "postgres"}
+	require.Error(t, dbc.validate())
+	dbc = databaseConfig{Type: "postgres", PostgresURL: "postgres://db/oscar", PostgresMaxConns: -1}
+	require.Error(t, dbc.validate())
+
+	os.Setenv("DATABASE_URL", "postgres://db/oscar")
+	defer os.Unsetenv("DATABASE_URL")
+	dbc = databaseConfig{Type: "postgres"}
+	require.NoError(t, dbc.validate())
+	require.Equal(t, "postgres://db/oscar", dbc.PostgresURL)
+	require.Equal(t, postgres.DefaultMaxConns, dbc.PostgresMaxConns)
+
+	dbc = databaseConfig{PostgresReplicaURLs: []string{"postgres://replica/oscar"}}
+	require.Error(t, dbc.validate())
+	dbc = databaseConfig{Type: "postgres", PostgresReplicaURLs: []string{"postgres://replica/oscar"}}
+	require.NoError(t, dbc.validate())
+
+	dbc = databaseConfig{Type: "mysql"}
+	require.Error(t, dbc.validate())
+}
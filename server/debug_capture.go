@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"zood.dev/oscar/apierr"
+)
+
+// A debug capture records the authenticated requests of one user for a
+// short window, so client bugs that only show up on a user's device can be
+// looked into. Only metadata is recorded: the route template rather than
+// the path, since paths hold public ids and tokens, and no headers or
+// bodies besides the client's version and user agent, and the code of
+// error responses.
+const (
+	defaultDebugCaptureWindow = 15 * time.Minute
+	maxDebugCaptureWindow     = time.Hour
+	// maxDebugCaptureRecords is how many of the latest requests are kept
+	maxDebugCaptureRecords = 500
+	// maxDebugCaptureErrBody is how much of an error response is kept to
+	// find its code
+	maxDebugCaptureErrBody = 1024
+)
+
+// debugCaptureRecord describes one captured request
+type debugCaptureRecord struct {
+	Time          int64   `json:"time"`
+	Method        string  `json:"method"`
+	Route         string  `json:"route"`
+	APIVersion    int     `json:"api_version"`
+	Status        int     `json:"status"`
+	ErrorCode     ErrCode `json:"error_code,omitempty"`
+	ErrorName     string  `json:"error_name,omitempty"`
+	RequestBytes  int64   `json:"request_bytes"`
+	ResponseBytes int64   `json:"response_bytes"`
+	DurationMS    int64   `json:"duration_ms"`
+	ClientVersion string  `json:"client_version,omitempty"`
+	UserAgent     string  `json:"user_agent,omitempty"`
+}
+
+// debugCaptureRecorder keeps the start of error responses, besides what a
+// statusRecorder records
+type debugCaptureRecorder struct {
+	*statusRecorder
+	errBody bytes.Buffer
+}
+
+func (dcr *debugCaptureRecorder) Write(p []byte) (int, error) {
+	n, err := dcr.statusRecorder.Write(p)
+	if dcr.status >= 400 && dcr.errBody.Len() < maxDebugCaptureErrBody {
+		dcr.errBody.Write(p[:n])
+	}
+	return n, err
+}
+
+// serveDebugCaptured serves r with next, and records it when userID is being
+// captured. Failing to record never fails the request.
+func serveDebugCaptured(providers *serverProviders, userID int64, next http.Handler, w http.ResponseWriter, r *http.Request) {
+	now := providers.now()
+	start := time.Now()
+	until, err := providers.kvs.DebugCaptureUntil(userID)
+	if err != nil {
+		logErr(errors.Wrap(err, "looking up the debug capture"))
+	}
+	if until <= now.Unix() {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	dcr := &debugCaptureRecorder{statusRecorder: &statusRecorder{ResponseWriter: w}}
+	next.ServeHTTP(dcr, r)
+
+	rec := debugCaptureRecord{
+		Time:          now.Unix(),
+		Method:        r.Method,
+		APIVersion:    int(apiVersionFromContext(r.Context())),
+		Status:        dcr.status,
+		RequestBytes:  r.ContentLength,
+		ResponseBytes: dcr.bytes,
+		DurationMS:    time.Since(start).Milliseconds(),
+		ClientVersion: r.Header.Get(clientVersionHeader),
+		UserAgent:     r.UserAgent(),
+	}
+	if route := mux.CurrentRoute(r); route != nil {
+		rec.Route, _ = route.GetPathTemplate()
+	}
+	if rec.Status == 0 {
+		rec.Status = http.StatusOK
+	}
+	if rec.Status >= 400 {
+		body := apierr.Body{}
+		if json.Unmarshal(dcr.errBody.Bytes(), &body) == nil {
+			rec.ErrorCode = body.Code
+			rec.ErrorName = body.Name
+		}
+	}
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		logErr(err)
+		return
+	}
+	if err = providers.kvs.AppendDebugCapture(userID, buf, maxDebugCaptureRecords); err != nil {
+		logErr(errors.Wrap(err, "recording a debug capture"))
+	}
+}
+
+// startDebugCaptureHandler handles POST /admin/debug-captures/{public_id}.
+// The optional duration, like "10m", defaults to defaultDebugCaptureWindow.
+// Starting a capture drops the records of the previous one.
+func startDebugCaptureHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := parseUserID(w, r)
+	if !ok {
+		return
+	}
+	body := struct {
+		Duration string `json:"duration"`
+	}{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			sendBadReq(w, "Unable to parse POST body: "+err.Error())
+			return
+		}
+	}
+	window := defaultDebugCaptureWindow
+	if body.Duration != "" {
+		var err error
+		window, err = time.ParseDuration(body.Duration)
+		if err != nil || window <= 0 || window > maxDebugCaptureWindow {
+			sendBadReq(w, "'duration' must be a positive duration of at most "+maxDebugCaptureWindow.String())
+			return
+		}
+	}
+
+	until := providersCtx(r.Context()).now().Add(window).Unix()
+	if err := providersCtx(r.Context()).kvs.StartDebugCapture(userID, until); err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	sendSuccess(w, struct {
+		Until int64 `json:"until"`
+	}{Until: until})
+}
+
+// debugCaptureHandler handles GET /admin/debug-captures/{public_id}
+func debugCaptureHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := parseUserID(w, r)
+	if !ok {
+		return
+	}
+	providers := providersCtx(r.Context())
+	kvs := providers.kvs
+	until, err := kvs.DebugCaptureUntil(userID)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if until == 0 {
+		sendNotFound(w, "the user hasn't been captured", errorNotFound)
+		return
+	}
+	bufs, err := kvs.DebugCapture(userID)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	records := make([]debugCaptureRecord, 0, len(bufs))
+	for _, buf := range bufs {
+		rec := debugCaptureRecord{}
+		if err = json.Unmarshal(buf, &rec); err != nil {
+			sendInternalErr(w, errors.Wrap(err, "decoding a debug capture record"))
+			return
+		}
+		records = append(records, rec)
+	}
+
+	sendSuccess(w, struct {
+		Until   int64                `json:"until"`
+		Active  bool                 `json:"active"`
+		Records []debugCaptureRecord `json:"records"`
+	}{Until: until, Active: until > providers.now().Unix(), Records: records})
+}
+
+// deleteDebugCaptureHandler handles DELETE /admin/debug-captures/{public_id}.
+// It ends the capture, if it's still running, and drops its records.
+func deleteDebugCaptureHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := parseUserID(w, r)
+	if !ok {
+		return
+	}
+	if err := providersCtx(r.Context()).kvs.DeleteDebugCapture(userID); err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	sendSuccess(w, nil)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebugCapture(t *testing.T) {
+	providers := createTestProviders(t)
+	providers.adminToken = "admin-token"
+	router := newOscarRouter(providers)
+	user, keyPair := createTestUser(t, providers)
+	token := loginTestUser(t, providers, user, keyPair)
+	capturePath := "/admin/debug-captures/" + hex.EncodeToString(user.PublicID)
+
+	admin := func(method, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, capturePath, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer admin-token")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	do := func(path string) {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("X-Oscar-Access-Token", token)
+		r.Header.Set(clientVersionHeader, "android/1.2.3")
+		router.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	// nothing is recorded before the capture starts
+	do("/1/users/me/data-summary")
+	require.Equal(t, http.StatusNotFound, admin(http.MethodGet, "").Code)
+
+	require.Equal(t, http.StatusBadRequest, admin(http.MethodPost, `{"duration": "2h"}`).Code)
+	w := admin(http.MethodPost, `{"duration": "10m"}`)
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+
+	do("/1/users/me/data-summary")
+	do("/1/users/0000")
+
+	w = admin(http.MethodGet, "")
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	capture := struct {
+		Active  bool                 `json:"active"`
+		Records []debugCaptureRecord `json:"records"`
+	}{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&capture))
+	require.True(t, capture.Active)
+	require.Len(t, capture.Records, 2)
+	require.Equal(t, "/1/users/me/data-summary", capture.Records[0].Route)
+	require.Equal(t, http.StatusOK, capture.Records[0].Status)
+	require.Equal(t, "android/1.2.3", capture.Records[0].ClientVersion)
+	require.NotZero(t, capture.Records[0].ResponseBytes)
+	// the route template is recorded, not the path
+	require.Equal(t, "/1/users/{public_id}", capture.Records[1].Route)
+	require.Equal(t, http.StatusNotFound, capture.Records[1].Status)
+	require.Equal(t, errorUserNotFound, capture.Records[1].ErrorCode)
+
+	require.Equal(t, http.StatusOK, admin(http.MethodDelete, "").Code)
+	require.Equal(t, http.StatusNotFound, admin(http.MethodGet, "").Code)
+	do("/1/users/me/data-summary")
+	records, err := providers.kvs.DebugCapture(user.ID)
+	require.NoError(t, err)
+	require.Empty(t, records)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"zood.dev/oscar/filestor"
+	"zood.dev/oscar/push"
+	"zood.dev/oscar/smtp"
+)
+
+// dependencyProbeInterval is how often the external services are probed
+const dependencyProbeInterval = time.Minute
+
+// dependencyProbeTimeout bounds how long a single probe may take
+const dependencyProbeTimeout = 10 * time.Second
+
+// healthProbePath is the file the storage probe asks for. It doesn't exist,
+// so a probe that gets as far as ErrFileNotExist reached the storage with
+// valid credentials.
+const healthProbePath = ".oscar-health-probe"
+
+// dependencyProbe checks that an external service is usable
+type dependencyProbe struct {
+	name string
+	// critical dependencies make the server unready while they're down
+	critical bool
+	check    func(ctx context.Context) error
+}
+
+// dependencyStatus is the outcome of the probes of a dependency
+type dependencyStatus struct {
+	critical    bool
+	checked     bool
+	healthy     bool
+	lastSuccess time.Time
+	errorStreak int
+	latency     time.Duration
+}
+
+// dependencyMonitor probes the external services the server relies on, so
+// an expired key or revoked credential is noticed before users notice what's
+// missing
+type dependencyMonitor struct {
+	probes []dependencyProbe
+
+	mu       sync.Mutex
+	statuses map[string]*dependencyStatus
+}
+
+func newDependencyMonitor(probes []dependencyProbe) *dependencyMonitor {
+	dm := &dependencyMonitor{probes: probes, statuses: map[string]*dependencyStatus{}}
+	for _, p := range probes {
+		dm.statuses[p.name] = &dependencyStatus{critical: p.critical}
+	}
+	return dm
+}
+
+// dependencyProbes returns the probes of the file storage, the email
+// provider and the push services of providers. Services that can't be
+// probed without side effects are left out.
+func dependencyProbes(providers *serverProviders) []dependencyProbe {
+	var probes []dependencyProbe
+	if fs := providers.fs; fs != nil {
+		probes = append(probes, dependencyProbe{
+			name:     "file_storage",
+			critical: true,
+			check: func(ctx context.Context) error {
+				_, err := fs.WithContext(ctx).FileSize(healthProbePath)
+				if err == filestor.ErrFileNotExist {
+					return nil
+				}
+				return err
+			},
+		})
+	}
+	if hc, ok := providers.emailer.(smtp.HealthChecker); ok {
+		probes = append(probes, dependencyProbe{name: "email", check: hc.CheckHealth})
+	}
+	for _, p := range providers.pushers {
+		if dp, ok := p.(*debouncedPusher); ok {
+			p = dp.next
+		}
+		tp, ok := p.(*tokenPusher)
+		if !ok {
+			continue
+		}
+		if hc, ok := tp.provider.(push.HealthChecker); ok {
+			probes = append(probes, dependencyProbe{name: tp.provider.Name(), check: hc.CheckHealth})
+		}
+	}
+	return probes
+}
+
+// probeAll runs every probe at once, and records the outcomes
+func (dm *dependencyMonitor) probeAll(now func() time.Time) {
+	wg := sync.WaitGroup{}
+	for _, p := range dm.probes {
+		wg.Add(1)
+		go func(p dependencyProbe) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), dependencyProbeTimeout)
+			defer cancel()
+			start := now()
+			err := p.check(ctx)
+			dm.record(p.name, err, now(), now().Sub(start))
+		}(p)
+	}
+	wg.Wait()
+}
+
+func (dm *dependencyMonitor) record(name string, err error, at time.Time, latency time.Duration) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	s := dm.statuses[name]
+	wasHealthy := s.healthy || !s.checked
+	s.checked = true
+	s.latency = latency
+	if err == nil {
+		s.healthy = true
+		s.lastSuccess = at
+		s.errorStreak = 0
+		return
+	}
+	s.healthy = false
+	s.errorStreak++
+	// only log when the dependency goes down, not on every failed probe
+	if wasHealthy {
+		logErr(errors.Wrapf(err, "dependency '%s' is unhealthy", name))
+	}
+}
+
+// runDependencyProbes probes the dependencies every interval, forever
+func runDependencyProbes(dm *dependencyMonitor, interval time.Duration) {
+	for {
+		dm.probeAll(time.Now)
+		time.Sleep(interval)
+	}
+}
+
+// snapshot returns a copy of the statuses, with the names sorted
+func (dm *dependencyMonitor) snapshot() ([]string, map[string]dependencyStatus) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	names := make([]string, 0, len(dm.statuses))
+	statuses := make(map[string]dependencyStatus, len(dm.statuses))
+	for name, s := range dm.statuses {
+		names = append(names, name)
+		statuses[name] = *s
+	}
+	sort.Strings(names)
+	return names, statuses
+}
+
+// healthy returns whether every dependency that has been probed passed its
+// last probe. A nil monitor has nothing to report, so it's healthy.
+func (dm *dependencyMonitor) healthy() bool {
+	if dm == nil {
+		return true
+	}
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	for _, s := range dm.statuses {
+		if s.checked && !s.healthy {
+			return false
+		}
+	}
+	return true
+}
+
+// readyzHandler handles GET /readyz. The server is unready while a critical
+// dependency is down. The others are reported, but a broken email or push
+// service isn't a reason to stop serving. Dependencies that haven't been
+// probed yet don't count against readiness.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	type depStatus struct {
+		Critical    bool  `json:"critical"`
+		Healthy     bool  `json:"healthy"`
+		LastSuccess int64 `json:"last_success,omitempty"`
+		ErrorStreak int   `json:"error_streak"`
+		LatencyMS   int64 `json:"latency_ms"`
+	}
+	resp := struct {
+		Ready        bool                 `json:"ready"`
+		Draining     bool                 `json:"draining,omitempty"`
+		Dependencies map[string]depStatus `json:"dependencies"`
+	}{Ready: true, Dependencies: map[string]depStatus{}}
+	// a draining server takes no new clients
+	if liveSockets.isDraining() {
+		resp.Ready = false
+		resp.Draining = true
+	}
+
+	if dm := providersCtx(r.Context()).dependencies; dm != nil {
+		_, statuses := dm.snapshot()
+		for name, s := range statuses {
+			if !s.checked {
+				continue
+			}
+			ds := depStatus{
+				Critical:    s.critical,
+				Healthy:     s.healthy,
+				ErrorStreak: s.errorStreak,
+				LatencyMS:   int64(s.latency / time.Millisecond),
+			}
+			if !s.lastSuccess.IsZero() {
+				ds.LastSuccess = s.lastSuccess.Unix()
+			}
+			resp.Dependencies[name] = ds
+			if s.critical && !s.healthy {
+				resp.Ready = false
+			}
+		}
+	}
+
+	status := http.StatusOK
+	if !resp.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	sendResponse(w, resp, status)
+}
+
+// metricsHandler handles GET /metrics, in the Prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	providers := providersCtx(r.Context())
+	writeRuntimeMetrics(w, providers)
+	if providers.storageMetrics != nil {
+		writeStorageMetrics(w, providers.storageMetrics)
+	}
+	dm := providers.dependencies
+	if dm == nil {
+		return
+	}
+	names, statuses := dm.snapshot()
+	metrics := []struct {
+		name, help, kind string
+		value            func(dependencyStatus) float64
+	}{
+		{"oscar_dependency_up", "Whether the last probe of the dependency succeeded.", "gauge", func(s dependencyStatus) float64 {
+			if s.healthy {
+				return 1
+			}
+			return 0
+		}},
+		{"oscar_dependency_last_success_timestamp_seconds", "When a probe of the dependency last succeeded.", "gauge", func(s dependencyStatus) float64 {
+			if s.lastSuccess.IsZero() {
+				return 0
+			}
+			return float64(s.lastSuccess.UnixNano()) / 1e9
+		}},
+		{"oscar_dependency_error_streak", "How many probes of the dependency failed in a row.", "gauge", func(s dependencyStatus) float64 {
+			return float64(s.errorStreak)
+		}},
+		{"oscar_dependency_probe_duration_seconds", "How long the last probe of the dependency took.", "gauge", func(s dependencyStatus) float64 {
+			return s.latency.Seconds()
+		}},
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, name := range names {
+			if s := statuses[name]; s.checked {
+				fmt.Fprintf(w, "%s{dependency=%q} %s\n", m.name, name, strconv.FormatFloat(m.value(s), 'f', -1, 64))
+			}
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDependencyMonitor(t *testing.T) {
+	var storageErr, emailErr error
+	dm := newDependencyMonitor([]dependencyProbe{
+		{name: "file_storage", critical: true, check: func(context.Context) error { return storageErr }},
+		{name: "email", check: func(context.Context) error { return emailErr }},
+	})
+	providers := createTestProviders(t)
+	providers.dependencies = dm
+	readyz := func() (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		providersInjector(providers, readyzHandler)(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		body := map[string]interface{}{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+		return w.Code, body
+	}
+
+	// nothing was probed yet
+	code, _ := readyz()
+	require.Equal(t, http.StatusOK, code)
+
+	now := time.Unix(1600000000, 0)
+	clock := func() time.Time { return now }
+	dm.probeAll(clock)
+	emailErr = errors.New("mailgun rejected the api key")
+	dm.probeAll(clock)
+	dm.probeAll(clock)
+
+	// a broken email provider is reported, but doesn't make the server unready
+	code, body := readyz()
+	require.Equal(t, http.StatusOK, code)
+	email := body["dependencies"].(map[string]interface{})["email"].(map[string]interface{})
+	require.Equal(t, false, email["healthy"])
+	require.Equal(t, float64(2), email["error_streak"])
+	require.Equal(t, float64(now.Unix()), email["last_success"])
+
+	storageErr = errors.New("credentials revoked")
+	dm.probeAll(clock)
+	code, body = readyz()
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, false, body["ready"])
+
+	w := httptest.NewRecorder()
+	providersInjector(providers, metricsHandler)(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	metrics := w.Body.String()
+	require.True(t, strings.Contains(metrics, `oscar_dependency_up{dependency="email"} 0`), metrics)
+	require.True(t, strings.Contains(metrics, `oscar_dependency_error_streak{dependency="email"} 3`), metrics)
+	require.True(t, strings.Contains(metrics, `oscar_dependency_last_success_timestamp_seconds{dependency="file_storage"} 1600000000`), metrics)
+}
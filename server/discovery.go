@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"zood.dev/oscar/encodable"
+)
+
+// Limits on contact discovery. Prefixes are truncated username indexes, so
+// a single prefix matches a handful of users, and the client picks out its
+// contacts by comparing the full indexes locally. The caps keep the endpoint
+// from being used to enumerate the user base.
+const (
+	discoveryMinPrefixSize       = 3
+	discoveryMaxPrefixSize       = 8
+	discoveryMaxPrefixes         = 256
+	discoveryMaxCandidates       = 16
+	discoveryPrefixesPerHour     = 2048
+	discoveryRateLimitWindowSize = time.Hour
+)
+
+var discoveryLimiter = newPrefixBudget(discoveryPrefixesPerHour, discoveryRateLimitWindowSize)
+
+// prefixBudget limits how many prefixes each user can look up per window
+type prefixBudget struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	usage  map[int64]*prefixUsage
+}
+
+type prefixUsage struct {
+	count int
+	start time.Time
+}
+
+func newPrefixBudget(limit int, window time.Duration) *prefixBudget {
+	return &prefixBudget{
+		limit:  limit,
+		window: window,
+		usage:  make(map[int64]*prefixUsage),
+	}
+}
+
+// spend records n lookups for userID, and returns false if that would exceed
+// the user's budget for the current window
+func (pb *prefixBudget) spend(userID int64, n int, now time.Time) bool {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	u := pb.usage[userID]
+	if u == nil || now.Sub(u.start) >= pb.window {
+		// drop stale entries while we're here, so the map doesn't grow forever
+		for id, other := range pb.usage {
+			if now.Sub(other.start) >= pb.window {
+				delete(pb.usage, id)
+			}
+		}
+		u = &prefixUsage{start: now}
+		pb.usage[userID] = u
+	}
+	if u.count+n > pb.limit {
+		return false
+	}
+	u.count += n
+	return true
+}
+
+// exhausted returns whether userID has used its whole budget for the current
+// window
+func (pb *prefixBudget) exhausted(userID int64, now time.Time) bool {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	u := pb.usage[userID]
+	return u != nil && now.Sub(u.start) < pb.window && u.count >= pb.limit
+}
+
+type discoveryCandidate struct {
+	ID            encodable.Bytes `json:"id"`
+	PublicKey     encodable.Bytes `json:"public_key"`
+	UsernameIndex encodable.Bytes `json:"username_hash"`
+}
+
+// discoverUsersHandler handles POST /users/discover
+func discoverUsersHandler(w http.ResponseWriter, r *http.Request) {
+	providers := providersCtx(r.Context())
+	if providers.usernameIndexSalt == nil {
+		sendNotFound(w, "Contact discovery is not enabled on this server", errorNotAnEndpoint)
+		return
+	}
+
+	body := struct {
+		Prefixes []encodable.Bytes `json:"prefixes"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendBadReq(w, "unable to decode body: "+err.Error())
+		return
+	}
+	if len(body.Prefixes) > discoveryMaxPrefixes {
+		sendBadReq(w, "too many prefixes in a single request")
+		return
+	}
+	for _, p := range body.Prefixes {
+		if len(p) < discoveryMinPrefixSize || len(p) > discoveryMaxPrefixSize {
+			sendBadReq(w, "prefixes must be between 3 and 8 bytes long")
+			return
+		}
+	}
+
+	userID := userIDFromContext(r.Context())
+	if !discoveryLimiter.spend(userID, len(body.Prefixes), providersCtx(r.Context()).now()) {
+		sendErr(w, "Contact discovery limit reached. Try again later.", http.StatusTooManyRequests, errorRateLimited)
+		return
+	}
+
+	candidates := make([]discoveryCandidate, 0)
+	for _, p := range body.Prefixes {
+		recs, err := providers.db.UsersWithIndexPrefix(p, discoveryMaxCandidates)
+		if err != nil {
+			sendInternalErr(w, err)
+			return
+		}
+		for _, rec := range recs {
+			pubID, err := providers.kvs.PublicIDFromUserID(rec.ID)
+			if err != nil {
+				sendInternalErr(w, err)
+				return
+			}
+			candidates = append(candidates, discoveryCandidate{
+				ID:            pubID,
+				PublicKey:     rec.PublicKey,
+				UsernameIndex: rec.UsernameIndex,
+			})
+		}
+	}
+
+	sendSuccess(w, struct {
+		Candidates []discoveryCandidate `json:"candidates"`
+	}{Candidates: candidates})
+}
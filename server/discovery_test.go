@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/encodable"
+)
+
+func TestPrefixBudget(t *testing.T) {
+	pb := newPrefixBudget(10, time.Hour)
+	now := time.Now()
+
+	require.True(t, pb.spend(1, 6, now))
+	require.False(t, pb.spend(1, 5, now))
+	require.True(t, pb.spend(2, 10, now))
+	require.True(t, pb.spend(1, 4, now))
+
+	// the budget resets with the next window
+	require.True(t, pb.spend(1, 10, now.Add(time.Hour)))
+}
+
+func TestDiscoverUsersHandler(t *testing.T) {
+	providers := createTestProviders(t)
+	providers.usernameIndexSalt = []byte("0123456789abcdef")
+	contact, _ := createTestUser(t, providers)
+	caller, _ := createTestUser(t, providers)
+
+	discover := func(prefixes ...[]byte) *httptest.ResponseRecorder {
+		body := struct {
+			Prefixes []encodable.Bytes `json:"prefixes"`
+		}{}
+		for _, p := range prefixes {
+			body.Prefixes = append(body.Prefixes, p)
+		}
+		buf, err := json.Marshal(body)
+		require.NoError(t, err)
+
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(buf))
+		ctx := context.WithValue(r.Context(), contextServerProvidersKey, providers)
+		ctx = context.WithValue(ctx, contextUserIDKey, caller.ID)
+		w := httptest.NewRecorder()
+		discoverUsersHandler(w, r.WithContext(ctx))
+		return w
+	}
+
+	index := usernameIndex(providers.usernameIndexSalt, contact.Username)
+	w := discover(index[:4])
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	resp := struct {
+		Candidates []discoveryCandidate `json:"candidates"`
+	}{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	found := false
+	for _, c := range resp.Candidates {
+		if bytes.Equal(c.UsernameIndex, index) {
+			found = true
+			require.Equal(t, contact.PublicID, c.ID)
+		}
+	}
+	require.True(t, found)
+
+	// prefixes that are too short, or too many of them, are rejected
+	require.Equal(t, http.StatusBadRequest, discover(index[:2]).Code)
+	tooMany := make([][]byte, discoveryMaxPrefixes+1)
+	for i := range tooMany {
+		tooMany[i] = index[:4]
+	}
+	require.Equal(t, http.StatusBadRequest, discover(tooMany...).Code)
+}
@@ -7,7 +7,9 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
@@ -17,6 +19,14 @@ import (
 
 const dropBoxIDSize = 16
 
+// packageReapInterval is how often expired packages and box aliases are
+// purged from the kv storage
+const packageReapInterval = 10 * time.Minute
+
+// defaultDropBoxAliasGrace is how long an alias keeps leading to its box
+// after a newer one is added, unless configured otherwise
+const defaultDropBoxAliasGrace = 7 * 24 * time.Hour
+
 var dropBoxPubSub = pubsub.New()
 
 const (
@@ -35,6 +45,7 @@ type packageListener struct {
 	conn      *websocket.Conn
 	kvs       kvstor.Provider
 	pkgs      chan []byte
+	stats     *socketConn
 	subs      map[string]subscriptionReader
 	waitGroup sync.WaitGroup
 }
@@ -55,6 +66,7 @@ func (pl *packageListener) ignore(boxID []byte) {
 
 	close(sr.closed)
 	delete(pl.subs, hexID)
+	pl.stats.subscribed(-1)
 }
 
 func (pl *packageListener) read() {
@@ -63,6 +75,7 @@ func (pl *packageListener) read() {
 		if err != nil {
 			break
 		}
+		pl.stats.frameReceived()
 		if msgType != websocket.BinaryMessage {
 			log.Printf("received a non-binary message")
 			break
@@ -101,6 +114,7 @@ func (pl *packageListener) stop() {
 	// perform the final clean up
 	pl.conn.Close()
 	close(pl.pkgs)
+	liveSockets.close(pl.stats)
 }
 
 func (pl *packageListener) start() {
@@ -122,16 +136,26 @@ func (pl *packageListener) watch(boxID []byte) {
 		return
 	}
 
+	// packages are published to the box, whichever of its ids they were
+	// dropped to
+	box, err := resolveDropBox(pl.kvs, boxID)
+	if err != nil {
+		logErr(err)
+		return
+	}
+	topic := hex.EncodeToString(box)
+
 	// create the subscription
-	sub := dropBoxPubSub.Sub(hexID)
+	sub := dropBoxPubSub.Sub(topic)
 	sr := subscriptionReader{
 		closed: make(chan bool),
 		sub:    sub,
 	}
 	pl.subs[hexID] = sr
+	pl.stats.subscribed(1)
 
 	// if there's already a package in the dropbox, send it
-	tmp, err := pl.kvs.PickUpPackage(boxID)
+	tmp, err := pl.kvs.PickUpPackage(box)
 	if err != nil {
 		logErr(err)
 	}
@@ -155,15 +179,18 @@ func (pl *packageListener) watch(boxID []byte) {
 				}
 				bytes := append([]byte{1}, boxID...)
 				bytes = append(bytes, pkg...)
+				pl.stats.frameQueued()
 				pl.pkgs <- bytes
 			}
 		}
-	}(hexID)
+	}(topic)
 }
 
 func (pl *packageListener) write() {
 	for msg := range pl.pkgs {
+		pl.stats.frameDequeued()
 		err := pl.conn.WriteMessage(websocket.BinaryMessage, msg)
+		pl.stats.frameSent(err)
 		if err != nil {
 			break
 		}
@@ -176,6 +203,7 @@ func newPackageListener(conn *websocket.Conn, kvs kvstor.Provider) *packageListe
 		conn:   conn,
 		kvs:    kvs,
 		pkgs:   make(chan []byte),
+		stats:  liveSockets.open(socketKindPackageWatcher, 0, conn),
 		subs:   make(map[string]subscriptionReader),
 	}
 }
@@ -198,6 +226,70 @@ func parseDropBoxID(w http.ResponseWriter, r *http.Request) ([]byte, string, boo
 	return boxID, boxIDStr, true
 }
 
+// resolveDropBox returns the box boxID leads to: the box it's an alias of,
+// or boxID itself. Packages are stored and published under the box's own
+// id.
+func resolveDropBox(kvs kvstor.Provider, boxID []byte) ([]byte, error) {
+	box, err := kvs.BoxOfAlias(boxID)
+	if err != nil || box == nil {
+		return boxID, err
+	}
+	return box, nil
+}
+
+// packageExpiry returns the unix time the packages dropped by r expire, or 0
+// when they don't. The ttl query parameter, in seconds, lets the client ask
+// for less than the deployment's TTL. When it's invalid, a bad request is
+// sent and ok is false.
+func packageExpiry(w http.ResponseWriter, r *http.Request, providers *serverProviders) (expires int64, ok bool) {
+	ttl := providers.dropBoxTTL
+	if ttlStr := r.URL.Query().Get("ttl"); ttlStr != "" {
+		secs, err := strconv.ParseInt(ttlStr, 10, 32)
+		if err != nil || secs <= 0 {
+			sendBadReq(w, "ttl must be a positive number of seconds")
+			return 0, false
+		}
+		if asked := time.Duration(secs) * time.Second; ttl == 0 || asked < ttl {
+			ttl = asked
+		}
+	}
+	if ttl == 0 {
+		return 0, true
+	}
+	return providers.now().Add(ttl).Unix(), true
+}
+
+// runPackageReaper purges the expired packages, box aliases and spent token
+// ids from the kv storage every interval
+func runPackageReaper(providers *serverProviders, interval time.Duration) {
+	for {
+		now := providers.now().Unix()
+		purged, err := providers.kvs.PurgeExpiredPackages(now)
+		if err != nil {
+			logErr(err)
+		}
+		if shouldLogInfo() && purged > 0 {
+			log.Printf("Purged %d expired packages", purged)
+		}
+		purged, err = providers.kvs.PurgeExpiredBoxAliases(now)
+		if err != nil {
+			logErr(err)
+		}
+		if shouldLogInfo() && purged > 0 {
+			log.Printf("Purged %d expired drop box aliases", purged)
+		}
+		purged, err = providers.kvs.PurgeSpentTokens(now)
+		if err != nil {
+			logErr(err)
+		}
+		if shouldLogInfo() && purged > 0 {
+			log.Printf("Purged %d expired spent token ids", purged)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
 // pickUpPackageHandler handles GET /drop-boxes/{box_id}
 func pickUpPackageHandler(w http.ResponseWriter, r *http.Request) {
 	boxID, _, ok := parseDropBoxID(w, r)
@@ -205,17 +297,23 @@ func pickUpPackageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
 	kvs := providersCtx(r.Context()).kvs
-	pkg, err := kvs.PickUpPackage(boxID)
+	box, err := resolveDropBox(kvs, boxID)
 	if err != nil {
 		sendInternalErr(w, err)
 		return
 	}
+	pkg, err := kvs.PickUpPackage(box)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
 	w.Write(pkg)
 }
 
-// sendMultiplePackagesHandler handles POST /drop-boxes/send
+// sendMultiplePackagesHandler handles POST /drop-boxes/send. The ttl query
+// parameter applies to every package.
 func sendMultiplePackagesHandler(w http.ResponseWriter, r *http.Request) {
 	rdr, err := r.MultipartReader()
 	if err != nil {
@@ -226,6 +324,10 @@ func sendMultiplePackagesHandler(w http.ResponseWriter, r *http.Request) {
 	var boxes string
 
 	providers := providersCtx(r.Context())
+	expires, ok := packageExpiry(w, r, providers)
+	if !ok {
+		return
+	}
 	// build the map of boxes => packages
 	pkgs := make(map[string][]byte)
 	for {
@@ -253,8 +355,19 @@ func sendMultiplePackagesHandler(w http.ResponseWriter, r *http.Request) {
 			sendBadReq(w, "invalid box id size")
 			return
 		}
+		if boxID, err = resolveDropBox(providers.kvs, boxID); err != nil {
+			sendInternalErr(w, err)
+			return
+		}
 
-		pkgs[hexBoxID] = data
+		if !checkPayloadSize(w, providers.padding, len(data)) {
+			return
+		}
+		in := ingress{Kind: ingressPackage, SenderID: userIDFromContext(r.Context()), BoxID: boxID, Size: len(data)}
+		if !checkIngress(w, r, providers.ingressPolicies, in) {
+			return
+		}
+		pkgs[hex.EncodeToString(boxID)] = data
 
 		if shouldLogInfo() {
 			boxes += hexBoxID + ", "
@@ -268,7 +381,7 @@ func sendMultiplePackagesHandler(w http.ResponseWriter, r *http.Request) {
 	kvs := providers.kvs
 	for hexBoxID, pkg := range pkgs {
 		boxID, _ := hex.DecodeString(hexBoxID)
-		err := kvs.DropPackage(pkg, boxID)
+		err := kvs.DropPackage(pkg, boxID, expires)
 		if err != nil {
 			sendInternalErr(w, err)
 			return
@@ -284,7 +397,8 @@ func sendMultiplePackagesHandler(w http.ResponseWriter, r *http.Request) {
 	}()
 }
 
-// dropPackageHandler handles PUT /drop-boxes/{box_id}
+// dropPackageHandler handles PUT /drop-boxes/{box_id}. The optional ttl query
+// parameter is how many seconds the package should stay in the box.
 func dropPackageHandler(w http.ResponseWriter, r *http.Request) {
 	boxID, hexBoxID, ok := parseDropBoxID(w, r)
 	if !ok {
@@ -297,6 +411,10 @@ func dropPackageHandler(w http.ResponseWriter, r *http.Request) {
 		db := providers.db
 		log.Printf("%s dropping pkg to %s", db.Username(userID), hexBoxID)
 	}
+	expires, ok := packageExpiry(w, r, providers)
+	if !ok {
+		return
+	}
 
 	if shouldLogDebug() {
 		log.Printf("\tdropPkg: about to read request body")
@@ -309,11 +427,23 @@ func dropPackageHandler(w http.ResponseWriter, r *http.Request) {
 		sendBadReq(w, "unable to read PUT body: "+err.Error())
 		return
 	}
+	if !checkPayloadSize(w, providers.padding, len(pkg)) {
+		return
+	}
+	box, err := resolveDropBox(providers.kvs, boxID)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	in := ingress{Kind: ingressPackage, SenderID: userIDFromContext(r.Context()), BoxID: box, Size: len(pkg)}
+	if !checkIngress(w, r, providers.ingressPolicies, in) {
+		return
+	}
 	if shouldLogDebug() {
 		log.Printf("\tdropPkg: about to update the bucket")
 	}
 	kvs := providers.kvs
-	err = kvs.DropPackage(pkg, boxID)
+	err = kvs.DropPackage(pkg, box, expires)
 	if shouldLogDebug() {
 		log.Printf("\tdropPkg: bucket update error? %v", err)
 	}
@@ -330,13 +460,54 @@ func dropPackageHandler(w http.ResponseWriter, r *http.Request) {
 	if shouldLogDebug() {
 		log.Printf("\tdropPkg: about to publish package")
 	}
-	dropBoxPubSub.Pub(pkg, hexBoxID)
+	dropBoxPubSub.Pub(pkg, hex.EncodeToString(box))
 	if shouldLogDebug() {
 		log.Printf("\tdropPkg: done publishing")
 	}
 }
 
+// addBoxAliasHandler handles POST /drop-boxes/{box_id}/aliases. It mints a
+// new alias leading to the box, which box_id may be an alias of, and has the
+// previous alias expire after the grace period. The user that added the
+// box's first alias is the only one who can add more.
+func addBoxAliasHandler(w http.ResponseWriter, r *http.Request) {
+	boxID, _, ok := parseDropBoxID(w, r)
+	if !ok {
+		return
+	}
+
+	providers := providersCtx(r.Context())
+	box, err := resolveDropBox(providers.kvs, boxID)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	alias := make([]byte, dropBoxIDSize)
+	if _, err = io.ReadFull(providers.random(), alias); err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	graceUntil := providers.now().Add(providers.boxAliasGrace).Unix()
+	err = providers.kvs.AddBoxAlias(box, alias, userIDFromContext(r.Context()), graceUntil)
+	if err == kvstor.ErrBoxOwner {
+		sendErr(w, "the drop box's aliases belong to another user", http.StatusForbidden, errorInsufficientPermission)
+		return
+	}
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+
+	sendSuccess(w, struct {
+		Alias             string `json:"alias"`
+		PreviousExpiresAt int64  `json:"previous_expires_at"`
+	}{Alias: hex.EncodeToString(alias), PreviousExpiresAt: graceUntil})
+}
+
 func createPackageWatcherHandler(w http.ResponseWriter, r *http.Request) {
+	if refuseWhileDraining(w) {
+		return
+	}
 	if shouldLogInfo() {
 		log.Printf("create_package_watcher")
 	}
@@ -350,6 +521,9 @@ func createPackageWatcherHandler(w http.ResponseWriter, r *http.Request) {
 		// we don't need to do anything. The upgrader sends 400 on our behalf.
 		return
 	}
+	// the connection outlives the request, so it can't keep the server's
+	// write deadline
+	conn.UnderlyingConn().SetWriteDeadline(time.Time{})
 
 	kvs := providersCtx(r.Context()).kvs
 	pl := newPackageListener(conn, kvs)
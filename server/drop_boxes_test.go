@@ -5,9 +5,11 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/require"
@@ -23,6 +25,8 @@ func TestDropPackageHandler(t *testing.T) {
 	r := httptest.NewRequest(http.MethodPut, "/", bytes.NewReader(pkg))
 	r = mux.SetURLVars(r, map[string]string{"box_id": hex.EncodeToString(dropBoxID)})
 	ctx := context.WithValue(r.Context(), contextServerProvidersKey, p)
+	// the route is behind sessionHandler
+	ctx = context.WithValue(ctx, contextUserIDKey, int64(1))
 	r = r.WithContext(ctx)
 
 	w := httptest.NewRecorder()
@@ -35,3 +39,127 @@ func TestDropPackageHandler(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, pkg, actualPkg)
 }
+
+func TestPackageExpiry(t *testing.T) {
+	p := createTestProviders(t)
+	now := time.Unix(1600000000, 0)
+	p.clock = newFakeClock(now)
+
+	tests := []struct {
+		deploymentTTL time.Duration
+		query         string
+		expires       int64
+		ok            bool
+	}{
+		{0, "", 0, true},
+		{0, "ttl=60", now.Unix() + 60, true},
+		{time.Hour, "", now.Unix() + 3600, true},
+		{time.Hour, "ttl=60", now.Unix() + 60, true},
+		// clients can't keep packages longer than the deployment allows
+		{time.Hour, "ttl=7200", now.Unix() + 3600, true},
+		{0, "ttl=0", 0, false},
+		{0, "ttl=-5", 0, false},
+		{0, "ttl=1h", 0, false},
+	}
+	for _, test := range tests {
+		p.dropBoxTTL = test.deploymentTTL
+		r := httptest.NewRequest(http.MethodPut, "/?"+test.query, nil)
+		w := httptest.NewRecorder()
+		expires, ok := packageExpiry(w, r, p)
+		require.Equal(t, test.ok, ok, test.query)
+		require.Equal(t, test.expires, expires, test.query)
+		if !ok {
+			require.Equal(t, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+func TestDropPackageWithTTL(t *testing.T) {
+	p := createTestProviders(t)
+	dropBoxID := make([]byte, dropBoxIDSize)
+	_, err := rand.Read(dropBoxID)
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodPut, "/?ttl=60", bytes.NewReader([]byte("short lived")))
+	r = mux.SetURLVars(r, map[string]string{"box_id": hex.EncodeToString(dropBoxID)})
+	ctx := context.WithValue(r.Context(), contextServerProvidersKey, p)
+	ctx = context.WithValue(ctx, contextUserIDKey, int64(1))
+	w := httptest.NewRecorder()
+	dropPackageHandler(w, r.WithContext(ctx))
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+
+	purged, err := p.kvs.PurgeExpiredPackages(time.Now().Unix())
+	require.NoError(t, err)
+	require.Zero(t, purged)
+	purged, err = p.kvs.PurgeExpiredPackages(time.Now().Add(2 * time.Minute).Unix())
+	require.NoError(t, err)
+	require.Equal(t, 1, purged)
+	pkg, err := p.kvs.PickUpPackage(dropBoxID)
+	require.NoError(t, err)
+	require.Nil(t, pkg)
+}
+
+func TestBoxAliases(t *testing.T) {
+	p := createTestProviders(t)
+	p.boxAliasGrace = time.Hour
+	owner, ownerKeys := createTestUser(t, p)
+	ownerToken := loginTestUser(t, p, owner, ownerKeys)
+	other, otherKeys := createTestUser(t, p)
+	otherToken := loginTestUser(t, p, other, otherKeys)
+	router := newOscarRouter(p)
+	box := make([]byte, dropBoxIDSize)
+	_, err := rand.Read(box)
+	require.NoError(t, err)
+
+	do := func(method, boxID, token string, body []byte) *httptest.ResponseRecorder {
+		path := "/1/drop-boxes/" + boxID
+		if method == http.MethodPost {
+			path += "/aliases"
+		}
+		r := httptest.NewRequest(method, path, bytes.NewReader(body))
+		r.Header.Set("X-Oscar-Access-Token", token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	addAlias := func(boxID string) string {
+		w := do(http.MethodPost, boxID, ownerToken, nil)
+		require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+		resp := struct {
+			Alias             string `json:"alias"`
+			PreviousExpiresAt int64  `json:"previous_expires_at"`
+		}{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		require.Equal(t, p.now().Add(p.boxAliasGrace).Unix(), resp.PreviousExpiresAt)
+		return resp.Alias
+	}
+
+	// packages dropped to an alias land in the box
+	alias1 := addAlias(hex.EncodeToString(box))
+	require.Equal(t, http.StatusOK, do(http.MethodPut, alias1, ownerToken, []byte("package")).Code)
+	pkg, err := p.kvs.PickUpPackage(box)
+	require.NoError(t, err)
+	require.Equal(t, []byte("package"), pkg)
+	w := do(http.MethodGet, alias1, ownerToken, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "package", w.Body.String())
+
+	// the previous alias lasts for the grace period, and aliases can be
+	// added through other aliases
+	alias2 := addAlias(alias1)
+	p.boxAliasGrace = 0
+	addAlias(alias2)
+	boxOf := func(alias string) []byte {
+		id, err := hex.DecodeString(alias)
+		require.NoError(t, err)
+		boxID, err := p.kvs.BoxOfAlias(id)
+		require.NoError(t, err)
+		return boxID
+	}
+	require.Equal(t, box, boxOf(alias1))
+	require.Nil(t, boxOf(alias2))
+
+	// only the owner can add aliases
+	w = do(http.MethodPost, hex.EncodeToString(box), otherToken, nil)
+	require.Equal(t, http.StatusForbidden, w.Code, "Got: %s", w.Body.String())
+}
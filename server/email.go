@@ -1,42 +1,163 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
-	"html/template"
+	"errors"
 	"net/http"
+	"strings"
 
+	"zood.dev/oscar/base62"
 	"zood.dev/oscar/smtp"
 
 	"github.com/gorilla/mux"
 )
 
-const welcomeEmailTemplate = `Hi,
+// defaultEmailTemplates is the built-in English template set. Each email is
+// a pair of templates named "<email>.subject" and "<email>.body".
+const defaultEmailTemplates = `{{define "verification.subject"}}{{.ProductName}}: Email Verification{{end}}
+{{define "verification.body"}}Hi,
 
-Thanks for signing up for Zood Location.
+Thanks for signing up for {{.ProductName}}.
 
 To verify your email address, click the link below:
-https://www.zood.xyz/verify-email?t={{.Token}}
+{{.VerifyURL}}
 
-I hope you enjoy using Zood Location as much as I enjoyed creating it. If you have any comments, questions or suggestions you can reply directly to this email.
+I hope you enjoy using {{.ProductName}} as much as I enjoyed creating it. If you have any comments, questions or suggestions you can reply directly to this email.
 
 Best,
 Arash
 
-If you didn't sign up for Zood Location, sorry for the inconvenience. Somebody signed up and mistakenly used your email address. You can click the link below to dissociate your email address from this account:
-https://www.zood.xyz/disavow-email?t={{.Token}}
-`
-
+If you didn't sign up for {{.ProductName}}, sorry for the inconvenience. Somebody signed up and mistakenly used your email address. You can click the link below to dissociate your email address from this account:
+{{.DisavowURL}}
+{{end}}
+{{define "activity.subject"}}{{.ProductName}}: New Activity on Your Account{{end}}
+{{define "activity.body"}}Hi {{.Username}},
+
+{{if eq .Event "session_created"}}Someone signed in to your account{{else if eq .Event "push_token_added"}}A new device was registered for notifications on your account{{else if eq .Event "backup_replaced"}}The backup of your account was replaced{{else}}There was activity on your account{{end}} on {{.Time}}.
+
+If this was you, there's nothing to do. If it wasn't, someone else may be using your account{{if .SupportEmail}}, and you can reach us at {{.SupportEmail}}{{end}}.
+{{end}}`
+
+// defaultEmailHTMLTemplates are the html versions of the built-in English
+// emails. Each is named "<email>.html".
+const defaultEmailHTMLTemplates = `{{define "verification.html"}}<!DOCTYPE html>
+<html>
+<body>
+<p>Hi,</p>
+<p>Thanks for signing up for {{.ProductName}}.</p>
+<p>To verify your email address, <a href="{{.VerifyURL}}">click here</a>.</p>
+<p>I hope you enjoy using {{.ProductName}} as much as I enjoyed creating it. If you have any comments, questions or suggestions you can reply directly to this email.</p>
+<p>Best,<br>Arash</p>
+<p><small>If you didn't sign up for {{.ProductName}}, sorry for the inconvenience. Somebody signed up and mistakenly used your email address. You can <a href="{{.DisavowURL}}">dissociate your email address from this account</a>.</small></p>
+</body>
+</html>
+{{end}}
+{{define "activity.html"}}<!DOCTYPE html>
+<html>
+<body>
+<p>Hi {{.Username}},</p>
+<p>{{if eq .Event "session_created"}}Someone signed in to your account{{else if eq .Event "push_token_added"}}A new device was registered for notifications on your account{{else if eq .Event "backup_replaced"}}The backup of your account was replaced{{else}}There was activity on your account{{end}} on {{.Time}}.</p>
+<p>If this was you, there's nothing to do. If it wasn't, someone else may be using your account{{if .SupportEmail}}, and you can reach us at <a href="mailto:{{.SupportEmail}}">{{.SupportEmail}}</a>{{end}}.</p>
+</body>
+</html>
+{{end}}`
+
+// notificationsEmailAddress is the sender of emails, unless the branding
+// config sets another
 const notificationsEmailAddress = "Zood Location <email-verification@notifications.zood.xyz>"
 
-func sendVerificationEmail(token, email string, emailer smtp.SendEmailer) error {
-	tmpl, err := template.New("").Parse(welcomeEmailTemplate)
+// verificationEmail is the data of the verification email templates
+type verificationEmail struct {
+	ProductName  string
+	SupportEmail string
+	Token        string
+	VerifyURL    string
+	DisavowURL   string
+}
+
+func newVerificationEmail(b *branding, token string) verificationEmail {
+	b = b.orDefault()
+	return verificationEmail{
+		ProductName:  b.ProductName,
+		SupportEmail: b.SupportEmail,
+		Token:        token,
+		VerifyURL:    withToken(b.VerifyEmailURL, token),
+		DisavowURL:   withToken(b.DisavowEmailURL, token),
+	}
+}
+
+func sendVerificationEmail(templates *emailTemplates, locale, token, email string, emailer smtp.SendEmailer) error {
+	brand := templates.brand()
+	data := newVerificationEmail(brand, token)
+	subject, body, err := templates.render(locale, "verification", data)
 	if err != nil {
 		return err
 	}
-	buf := &bytes.Buffer{}
-	tmpl.Execute(buf, struct{ Token string }{Token: token})
-	return emailer.SendEmail(notificationsEmailAddress, email, "Zood Location: Email Verification", buf.String(), nil)
+	html, err := templates.renderHTML(locale, "verification", data)
+	if err != nil {
+		return err
+	}
+	return emailer.SendEmail(brand.EmailFrom, email, subject, body, html)
+}
+
+// changeEmailHandler handles POST /users/me/email. It emails a verification
+// to the new address, which replaces the current one once it's verified.
+// Until then, the current address keeps getting the user's emails.
+func changeEmailHandler(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Email string `json:"email"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendBadReq(w, "Unable to parse POST body: "+err.Error())
+		return
+	}
+	email := strings.TrimSpace(strings.ToLower(body.Email))
+	if sErr := validateEmail(email); sErr != nil {
+		sendBadReqCode(w, sErr.message, sErr.code)
+		return
+	}
+
+	userID := userIDFromContext(r.Context())
+	providers := providersCtx(r.Context())
+	db := providers.db
+	user, err := db.User(db.Username(userID))
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if user == nil {
+		sendInternalErr(w, errors.New("the user of the session is missing"))
+		return
+	}
+	if user.Email != nil && *user.Email == email {
+		sendBadReqCode(w, "That's already the account's email address", errorInvalidEmail)
+		return
+	}
+	suppressed, err := db.EmailSuppressed(email)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if suppressed {
+		sendBadReqCode(w, "That email address can't receive emails", errorInvalidEmail)
+		return
+	}
+
+	token, err := base62.RandFrom(providers.random(), 16)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if err = db.InsertEmailVerificationToken(userID, email, token); err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if err = sendVerificationEmail(providers.emailTemplates, user.Locale, token, email, providers.emailer); err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+
+	sendSuccess(w, nil)
 }
 
 // verifyEmailHandler handles POST /email-verifications
@@ -54,7 +175,8 @@ func verifyEmailHandler(w http.ResponseWriter, r *http.Request) {
 		sendBadReqCode(w, "Missing verification token", errorBadRequest)
 	}
 
-	db := providersCtx(r.Context()).db
+	providers := providersCtx(r.Context())
+	db := providers.db
 	evtr, err := db.EmailVerificationTokenRecord(body.Token)
 	if err != nil {
 		sendInternalErr(w, err)
@@ -71,6 +193,8 @@ func verifyEmailHandler(w http.ResponseWriter, r *http.Request) {
 		sendInternalErr(w, err)
 		return
 	}
+	invalidateCachedUser(db, evtr.UserID)
+	providers.events.emit(accountEvent{Kind: eventEmailVerified, Actor: actorUser, UserID: evtr.UserID})
 
 	sendSuccess(w, nil)
 }
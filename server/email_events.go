@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"zood.dev/oscar/mailgun"
+	"zood.dev/oscar/model"
+	"zood.dev/oscar/smtp"
+)
+
+// emailEvent is an EmailEventRecord as shown to admins
+type emailEvent struct {
+	ProviderID string `json:"provider_id"`
+	Event      string `json:"event"`
+	Severity   string `json:"severity,omitempty"`
+	Recipient  string `json:"recipient"`
+	MessageID  string `json:"message_id"`
+	Reason     string `json:"reason,omitempty"`
+	Timestamp  int64  `json:"timestamp"`
+}
+
+// maxWebhookBodySize bounds the webhook bodies we're willing to read
+const maxWebhookBodySize = 1 << 20
+
+// mailgunWebhookHandler handles POST /email-events and its older path, POST
+// /email-events/mailgun
+func mailgunWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	providers := providersCtx(r.Context())
+	if providers.mailgunSigningKey == "" {
+		sendNotFound(w, "Not an endpoint", errorNotAnEndpoint)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodySize))
+	if err != nil {
+		sendBadReq(w, "unable to read webhook body")
+		return
+	}
+	evt, err := mailgun.ParseWebhook(body, providers.mailgunSigningKey, providers.now())
+	if err == mailgun.ErrInvalidSignature {
+		// mailgun doesn't retry webhooks rejected with a 406
+		sendErr(w, err.Error(), http.StatusNotAcceptable, errorInvalidAccessToken)
+		return
+	}
+	if err != nil {
+		sendBadReq(w, err.Error())
+		return
+	}
+
+	switch evt.Event {
+	case mailgun.EventDelivered, mailgun.EventFailed, mailgun.EventComplained:
+	default:
+		// we only keep the events that tell us whether our emails arrive
+		sendSuccess(w, nil)
+		return
+	}
+
+	err = providers.db.InsertEmailEvent(model.EmailEventRecord{
+		ProviderID: evt.ID,
+		Event:      evt.Event,
+		Severity:   evt.Severity,
+		Recipient:  evt.Recipient,
+		MessageID:  evt.MessageID,
+		Reason:     evt.Reason,
+		Timestamp:  evt.Timestamp.Unix(),
+	})
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if evt.Event != mailgun.EventDelivered && shouldLogWarn() {
+		log.Printf("email to %s %s: %s", evt.Recipient, evt.Event, evt.Reason)
+	}
+	if shouldSuppress(evt) {
+		if err = suppressEmail(providers.db, providers.events, evt); err != nil {
+			sendInternalErr(w, err)
+			return
+		}
+	}
+
+	sendSuccess(w, nil)
+}
+
+// emailEventsHandler handles GET /admin/email-events?limit=
+func emailEventsHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if str := r.URL.Query().Get("limit"); str != "" {
+		var err error
+		limit, err = strconv.Atoi(str)
+		if err != nil || limit < 1 || limit > 1000 {
+			sendBadReq(w, "limit must be between 1 and 1000")
+			return
+		}
+	}
+
+	records, err := providersCtx(r.Context()).db.EmailEvents(limit)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	events := make([]emailEvent, 0, len(records))
+	for _, rec := range records {
+		events = append(events, emailEvent{
+			ProviderID: rec.ProviderID,
+			Event:      rec.Event,
+			Severity:   rec.Severity,
+			Recipient:  rec.Recipient,
+			MessageID:  rec.MessageID,
+			Reason:     rec.Reason,
+			Timestamp:  rec.Timestamp,
+		})
+	}
+
+	sendSuccess(w, events)
+}
+
+// shouldSuppress returns true for events that mean we should stop sending
+// to the recipient: hard bounces and spam complaints. Soft bounces are
+// retried by mailgun, so they're left alone.
+func shouldSuppress(evt *mailgun.Event) bool {
+	switch evt.Event {
+	case mailgun.EventComplained:
+		return true
+	case mailgun.EventFailed:
+		return evt.Severity == "permanent"
+	default:
+		return false
+	}
+}
+
+// suppressEmail stops all email to the recipient of evt, and unverifies the
+// address on any account using it
+func suppressEmail(db model.Provider, events *eventBus, evt *mailgun.Event) error {
+	email := strings.ToLower(strings.TrimSpace(evt.Recipient))
+	reason := evt.Event
+	if evt.Reason != "" {
+		reason += ": " + evt.Reason
+	}
+	affected, err := db.SuppressEmail(email, reason)
+	if err != nil {
+		return err
+	}
+	events.emit(accountEvent{
+		Kind:    eventEmailSuppressed,
+		Actor:   actorMailgun,
+		Details: fmt.Sprintf("%s (%s); removed from %d users", email, reason, affected),
+	})
+	return nil
+}
+
+// errEmailSuppressed is returned when sending to a suppressed address
+var errEmailSuppressed = errors.New("the recipient's address is suppressed")
+
+// suppressingEmailer refuses to send email to suppressed addresses
+type suppressingEmailer struct {
+	smtp.SendEmailer
+	db model.Provider
+}
+
+// SendEmail fulfills smtp.SendEmailer
+func (se suppressingEmailer) SendEmail(from string, to string, subj string, textMsg string, htmlMsg *string) error {
+	suppressed, err := se.db.EmailSuppressed(strings.ToLower(strings.TrimSpace(to)))
+	if err != nil {
+		return err
+	}
+	if suppressed {
+		return errEmailSuppressed
+	}
+	return se.SendEmailer.SendEmail(from, to, subj, textMsg, htmlMsg)
+}
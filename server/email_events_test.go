@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/mailgun"
+	"zood.dev/oscar/smtp"
+)
+
+func TestMailgunWebhook(t *testing.T) {
+	providers := createTestProviders(t)
+	providers.adminToken = "admin-token"
+	user, keyPair := createTestUser(t, providers)
+	require.NoError(t, providers.db.VerifyEmail("alice@example.com", user.ID))
+	accessToken := loginTestUser(t, providers, user, keyPair)
+	router := newOscarRouter(providers)
+
+	post := func(key, event string) int {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		token := "webhook-token"
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte(timestamp + token))
+		body := fmt.Sprintf(`{
+			"signature": {"timestamp": "%s", "token": "%s", "signature": "%s"},
+			"event-data": {"id": "id-%s", "event": "%s", "recipient": "alice@example.com", "timestamp": %s}
+		}`, timestamp, token, hex.EncodeToString(mac.Sum(nil)), event, event, timestamp)
+		r := httptest.NewRequest(http.MethodPost, "/1/email-events", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// webhooks are disabled without a signing key
+	require.Equal(t, http.StatusNotFound, post("", "failed"))
+
+	providers.mailgunSigningKey = "signing-key"
+	require.Equal(t, http.StatusNotAcceptable, post("wrong-key", "failed"))
+	require.Equal(t, http.StatusOK, post("signing-key", "failed"))
+	// the bounce wasn't permanent, so the address is still usable
+	suppressed, err := providers.db.EmailSuppressed("alice@example.com")
+	require.NoError(t, err)
+	require.False(t, suppressed)
+	require.Equal(t, http.StatusOK, post("signing-key", "complained"))
+	suppressed, err = providers.db.EmailSuppressed("alice@example.com")
+	require.NoError(t, err)
+	require.True(t, suppressed)
+	// events we don't keep are still acknowledged
+	require.Equal(t, http.StatusOK, post("signing-key", "opened"))
+
+	// the user sees that their address stopped working
+	r := httptest.NewRequest(http.MethodGet, "/1/users/"+hex.EncodeToString(user.PublicID), nil)
+	r.Header.Set("X-Oscar-Access-Token", accessToken)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	info := User{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&info))
+	require.Empty(t, info.Email)
+	require.Equal(t, "alice@example.com", info.UndeliverableEmail)
+
+	r = httptest.NewRequest(http.MethodGet, "/admin/email-events", nil)
+	r.Header.Set("Authorization", "Bearer admin-token")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	var events []emailEvent
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&events))
+	require.Len(t, events, 2)
+	for _, evt := range events {
+		require.Equal(t, "alice@example.com", evt.Recipient)
+		require.NotEqual(t, "opened", evt.Event)
+	}
+}
+
+func TestSuppressingEmailer(t *testing.T) {
+	providers := createTestProviders(t)
+	user, _ := createTestUser(t, providers)
+	require.NoError(t, providers.db.VerifyEmail("alice@example.com", user.ID))
+
+	mock := smtp.NewMockSendEmailer()
+	emailer := suppressingEmailer{SendEmailer: mock, db: providers.db}
+	require.NoError(t, emailer.SendEmail("oscar@example.com", "alice@example.com", "hi", "hi", nil))
+	require.True(t, mock.SentEmail)
+
+	require.NoError(t, suppressEmail(providers.db, providers.events, &mailgun.Event{
+		Event:     mailgun.EventFailed,
+		Severity:  "permanent",
+		Recipient: "Alice@Example.com",
+		Reason:    "No such mailbox",
+	}))
+
+	// the address is no longer verified on the account, and isn't mailed
+	rec, err := providers.db.User(user.Username)
+	require.NoError(t, err)
+	require.Nil(t, rec.Email)
+	require.Equal(t, "alice@example.com", *rec.UndeliverableEmail)
+	mock.SentEmail = false
+	require.Equal(t, errEmailSuppressed, emailer.SendEmail("oscar@example.com", "alice@example.com", "hi", "hi", nil))
+	require.False(t, mock.SentEmail)
+
+	// verifying another address clears it
+	require.NoError(t, providers.db.VerifyEmail("alice@example.org", user.ID))
+	rec, err = providers.db.User(user.Username)
+	require.NoError(t, err)
+	require.Nil(t, rec.UndeliverableEmail)
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"zood.dev/oscar/kvstor"
+	"zood.dev/oscar/smtp"
+)
+
+// Emails are queued in the kv store, and sent from there in the background,
+// so a hiccup of the email provider delays an email rather than losing it.
+// A failed send is retried with exponential backoff, and the emails that
+// still fail after maxEmailAttempts are kept as dead letters, listed by
+// GET /admin/email-queue.
+const (
+	// emailQueuePollInterval is how often the queue is checked for emails
+	// whose retry is due. New emails are sent right away.
+	emailQueuePollInterval = 10 * time.Second
+	emailQueueBatchSize    = 50
+	// emailRetryBackoff is the wait before the first retry. It doubles
+	// with each one, up to maxEmailRetryBackoff.
+	emailRetryBackoff    = 30 * time.Second
+	maxEmailRetryBackoff = 6 * time.Hour
+	maxEmailAttempts     = 10
+)
+
+// queuedEmail is an email in the queue, or a dead letter. It's sealed in
+// the kv store, since verification emails carry tokens.
+type queuedEmail struct {
+	From      string  `json:"from"`
+	To        string  `json:"to"`
+	Subject   string  `json:"subject"`
+	Text      string  `json:"text"`
+	HTML      *string `json:"html,omitempty"`
+	Queued    int64   `json:"queued"`
+	Attempts  int     `json:"attempts"`
+	LastError string  `json:"last_error,omitempty"`
+}
+
+// emailQueueRun counts what a pass over the queue did
+type emailQueueRun struct {
+	Sent         int
+	Retried      int
+	DeadLettered int
+}
+
+// emailQueue is a smtp.SendEmailer that queues the emails for sender
+type emailQueue struct {
+	kvs    kvstor.EmailQueue
+	keys   *keyRing
+	sender smtp.SendEmailer
+	now    func() time.Time
+	// wake has run send the new emails without waiting for the next poll
+	wake chan struct{}
+	// mu keeps resealAll from replacing an email drain is rescheduling
+	// with an older copy
+	mu sync.Mutex
+}
+
+func newEmailQueue(kvs kvstor.EmailQueue, keys *keyRing, sender smtp.SendEmailer) *emailQueue {
+	return &emailQueue{kvs: kvs, keys: keys, sender: sender, now: time.Now, wake: make(chan struct{}, 1)}
+}
+
+// SendEmail fulfills smtp.SendEmailer. It only fails when the email can't
+// be queued.
+func (eq *emailQueue) SendEmail(from string, to string, subj string, textMsg string, htmlMsg *string) error {
+	id := make([]byte, 16)
+	if _, err := crand.Read(id); err != nil {
+		return err
+	}
+	now := eq.now()
+	email := queuedEmail{From: from, To: to, Subject: subj, Text: textMsg, HTML: htmlMsg, Queued: now.Unix()}
+	if err := eq.queue(hex.EncodeToString(id), email, now); err != nil {
+		return err
+	}
+	select {
+	case eq.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// queue stores email under id, to be sent at due
+func (eq *emailQueue) queue(id string, email queuedEmail, due time.Time) error {
+	sealed, err := eq.seal(email)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(eq.kvs.QueueEmail(id, sealed, due.Unix()), "queueing the email")
+}
+
+func (eq *emailQueue) seal(email queuedEmail) ([]byte, error) {
+	buf, err := json.Marshal(email)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := eq.keys.seal(buf)
+	return sealed, errors.Wrap(err, "sealing the email")
+}
+
+// openQueuedEmail recovers a queued email or a dead letter
+func openQueuedEmail(kr *keyRing, sealed []byte) (queuedEmail, error) {
+	buf, ok := kr.open(sealed)
+	if !ok {
+		return queuedEmail{}, errors.New("unable to open the email with any key in the ring")
+	}
+	email := queuedEmail{}
+	err := json.Unmarshal(buf, &email)
+	return email, errors.Wrap(err, "decoding the queued email")
+}
+
+// emailRetryDelay is how long to wait before the next attempt at an email
+// that failed attempts times
+func emailRetryDelay(attempts int) time.Duration {
+	delay := emailRetryBackoff
+	for i := 1; i < attempts && delay < maxEmailRetryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxEmailRetryBackoff {
+		return maxEmailRetryBackoff
+	}
+	return delay
+}
+
+// drain sends the emails that were due at now, until none are left
+func (eq *emailQueue) drain(now time.Time) (emailQueueRun, error) {
+	eq.mu.Lock()
+	defer eq.mu.Unlock()
+	run := emailQueueRun{}
+	for {
+		due, err := eq.kvs.DueEmails(now.Unix(), emailQueueBatchSize)
+		if err != nil {
+			return run, errors.Wrap(err, "reading the email queue")
+		}
+		// oldest first, since the ids are random
+		ids := make([]string, 0, len(due))
+		emails := make(map[string]queuedEmail, len(due))
+		for id, sealed := range due {
+			email, err := openQueuedEmail(eq.keys, sealed)
+			if err != nil {
+				logErr(errors.Wrapf(err, "dropping queued email %s", id))
+				if err = eq.kvs.DequeueEmail(id, nil); err != nil {
+					return run, err
+				}
+				continue
+			}
+			ids = append(ids, id)
+			emails[id] = email
+		}
+		sort.Slice(ids, func(i, j int) bool { return emails[ids[i]].Queued < emails[ids[j]].Queued })
+
+		for _, id := range ids {
+			if err = eq.send(id, emails[id], now, &run); err != nil {
+				return run, err
+			}
+		}
+		if len(due) < emailQueueBatchSize {
+			return run, nil
+		}
+	}
+}
+
+// send makes an attempt at email, and then dequeues it, reschedules it, or
+// turns it into a dead letter. It only fails when the queue can't be
+// updated.
+func (eq *emailQueue) send(id string, email queuedEmail, now time.Time, run *emailQueueRun) error {
+	err := eq.sender.SendEmail(email.From, email.To, email.Subject, email.Text, email.HTML)
+	if err == nil || err == errEmailSuppressed {
+		// a suppressed address won't take the email however often it's
+		// tried
+		run.Sent++
+		return eq.kvs.DequeueEmail(id, nil)
+	}
+
+	email.Attempts++
+	email.LastError = err.Error()
+	if email.Attempts < maxEmailAttempts {
+		run.Retried++
+		return eq.queue(id, email, now.Add(emailRetryDelay(email.Attempts)))
+	}
+	logErr(errors.Wrapf(err, "giving up on queued email %s after %d attempts", id, email.Attempts))
+	sealed, err := eq.seal(email)
+	if err != nil {
+		return err
+	}
+	run.DeadLettered++
+	return eq.kvs.DequeueEmail(id, sealed)
+}
+
+func (eq *emailQueue) name() string {
+	return "email queue"
+}
+
+// resealAll fulfills resealer, for the queued emails and the dead letters.
+// Emails no key opens are left to drain, which drops them.
+func (eq *emailQueue) resealAll(kr *keyRing) (int, error) {
+	eq.mu.Lock()
+	defer eq.mu.Unlock()
+
+	// every email is due by the end of time
+	queued, err := eq.kvs.DueEmails(math.MaxInt64, math.MaxInt32)
+	if err != nil {
+		return 0, errors.Wrap(err, "reading the email queue")
+	}
+	n, err := resealEmails(kr, queued, eq.kvs.ReplaceQueuedEmail)
+	if err != nil {
+		return n, err
+	}
+	letters, err := eq.kvs.DeadLetters()
+	if err != nil {
+		return n, errors.Wrap(err, "reading the dead letters")
+	}
+	m, err := resealEmails(kr, letters, eq.kvs.ReplaceDeadLetter)
+	return n + m, err
+}
+
+// countKeys fulfills keyCounter, for the queued emails and the dead letters
+func (eq *emailQueue) countKeys(now time.Time) (map[string]int, error) {
+	eq.mu.Lock()
+	defer eq.mu.Unlock()
+
+	queued, err := eq.kvs.DueEmails(math.MaxInt64, math.MaxInt32)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading the email queue")
+	}
+	letters, err := eq.kvs.DeadLetters()
+	if err != nil {
+		return nil, errors.Wrap(err, "reading the dead letters")
+	}
+	counts := map[string]int{}
+	for _, sealed := range []map[string][]byte{queued, letters} {
+		for _, email := range sealed {
+			counts[sealedKeyID(email)]++
+		}
+	}
+	return counts, nil
+}
+
+// resealEmails moves the sealed emails to the current key with replace, and
+// returns how many it replaced
+func resealEmails(kr *keyRing, sealed map[string][]byte, replace func(id string, email []byte) (bool, error)) (int, error) {
+	n := 0
+	for id, email := range sealed {
+		resealed, changed, err := kr.reseal(email)
+		if err == errUnknownKey {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		if !changed {
+			continue
+		}
+		replaced, err := replace(id, resealed)
+		if err != nil {
+			return n, err
+		}
+		// unless it was sent or deleted since it was read
+		if replaced {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// run sends the queued emails as they're queued, and retries the failed
+// ones every interval, forever
+func (eq *emailQueue) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		run, err := eq.drain(eq.now())
+		if err != nil {
+			logErr(err)
+		}
+		if shouldLogInfo() && (run.Retried > 0 || run.DeadLettered > 0) {
+			log.Printf("Sent %d queued emails, %d failed and will be retried, and %d were given up on", run.Sent, run.Retried, run.DeadLettered)
+		}
+
+		select {
+		case <-eq.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// directEmailer returns the emailer that sends the emails of emailer,
+// without the queue in between
+func directEmailer(emailer smtp.SendEmailer) smtp.SendEmailer {
+	if eq, ok := emailer.(*emailQueue); ok {
+		return eq.sender
+	}
+	return emailer
+}
+
+// deadLetter is how GET /admin/email-queue describes a dead letter. The
+// bodies are left out, since they can carry verification tokens.
+type deadLetter struct {
+	ID        string `json:"id"`
+	To        string `json:"to"`
+	Subject   string `json:"subject"`
+	Queued    int64  `json:"queued"`
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"last_error"`
+}
+
+// emailQueueHandler handles GET /admin/email-queue
+func emailQueueHandler(w http.ResponseWriter, r *http.Request) {
+	providers := providersCtx(r.Context())
+	sealed, err := providers.kvs.DeadLetters()
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	letters := make([]deadLetter, 0, len(sealed))
+	for id, buf := range sealed {
+		email, err := openQueuedEmail(providers.keys, buf)
+		if err != nil {
+			sendInternalErr(w, errors.Wrapf(err, "dead letter %s", id))
+			return
+		}
+		letters = append(letters, deadLetter{
+			ID:        id,
+			To:        email.To,
+			Subject:   email.Subject,
+			Queued:    email.Queued,
+			Attempts:  email.Attempts,
+			LastError: email.LastError,
+		})
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].Queued < letters[j].Queued })
+
+	sendSuccess(w, struct {
+		DeadLetters []deadLetter `json:"dead_letters"`
+	}{DeadLetters: letters})
+}
+
+// deleteDeadLetterHandler handles DELETE /admin/email-queue/dead-letters/{id}
+func deleteDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if err := providersCtx(r.Context()).kvs.DeleteDeadLetter(id); err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+
+	sendSuccess(w, nil)
+}
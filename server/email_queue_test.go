@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// flakyEmailer fails the first failures emails it's asked to send
+type flakyEmailer struct {
+	failures int
+	sent     []string
+}
+
+func (fe *flakyEmailer) SendEmail(from, to, subj, textMsg string, htmlMsg *string) error {
+	if fe.failures > 0 {
+		fe.failures--
+		return errors.New("provider unavailable")
+	}
+	fe.sent = append(fe.sent, to)
+	return nil
+}
+
+func TestEmailQueueRetries(t *testing.T) {
+	providers := createTestProviders(t)
+	sender := &flakyEmailer{failures: 1}
+	eq := newEmailQueue(providers.kvs, providers.keys, sender)
+	now := time.Now()
+	eq.now = func() time.Time { return now }
+
+	require.NoError(t, eq.SendEmail("from@example.com", "alice@example.com", "subject", "body", nil))
+	run, err := eq.drain(now)
+	require.NoError(t, err)
+	require.Equal(t, emailQueueRun{Retried: 1}, run)
+
+	// the retry waits for its backoff
+	run, err = eq.drain(now)
+	require.NoError(t, err)
+	require.Equal(t, emailQueueRun{}, run)
+	run, err = eq.drain(now.Add(emailRetryBackoff))
+	require.NoError(t, err)
+	require.Equal(t, emailQueueRun{Sent: 1}, run)
+	require.Equal(t, []string{"alice@example.com"}, sender.sent)
+
+	// suppressed addresses aren't retried
+	eq.sender = suppressedEmailer{}
+	require.NoError(t, eq.SendEmail("from@example.com", "bob@example.com", "subject", "body", nil))
+	run, err = eq.drain(now)
+	require.NoError(t, err)
+	require.Equal(t, emailQueueRun{Sent: 1}, run)
+	due, err := providers.kvs.DueEmails(now.Add(time.Hour).Unix(), 10)
+	require.NoError(t, err)
+	require.Empty(t, due)
+}
+
+type suppressedEmailer struct{}
+
+func (suppressedEmailer) SendEmail(from, to, subj, textMsg string, htmlMsg *string) error {
+	return errEmailSuppressed
+}
+
+func TestEmailQueueDeadLetters(t *testing.T) {
+	providers := createTestProviders(t)
+	providers.adminToken = "admin-token"
+	eq := newEmailQueue(providers.kvs, providers.keys, &flakyEmailer{failures: maxEmailAttempts})
+	providers.emailer = eq
+	now := time.Now()
+
+	require.NoError(t, eq.SendEmail("from@example.com", "alice@example.com", "Verify", "token", nil))
+	for i := 1; i < maxEmailAttempts; i++ {
+		run, err := eq.drain(now)
+		require.NoError(t, err)
+		require.Equal(t, emailQueueRun{Retried: 1}, run)
+		now = now.Add(emailRetryDelay(i))
+	}
+	run, err := eq.drain(now)
+	require.NoError(t, err)
+	require.Equal(t, emailQueueRun{DeadLettered: 1}, run)
+
+	router := newOscarRouter(providers)
+	do := func(method, target string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		r.Header.Set("Authorization", "Bearer admin-token")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	list := func() []deadLetter {
+		w := do(http.MethodGet, "/admin/email-queue")
+		require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+		resp := struct {
+			DeadLetters []deadLetter `json:"dead_letters"`
+		}{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		return resp.DeadLetters
+	}
+
+	letters := list()
+	require.Len(t, letters, 1)
+	require.Equal(t, "alice@example.com", letters[0].To)
+	require.Equal(t, maxEmailAttempts, letters[0].Attempts)
+	require.Equal(t, "provider unavailable", letters[0].LastError)
+
+	w := do(http.MethodDelete, "/admin/email-queue/dead-letters/"+letters[0].ID)
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	require.Empty(t, list())
+}
+
+func TestEmailRetryDelay(t *testing.T) {
+	require.Equal(t, emailRetryBackoff, emailRetryDelay(1))
+	require.Equal(t, 4*emailRetryBackoff, emailRetryDelay(3))
+	require.Equal(t, maxEmailRetryBackoff, emailRetryDelay(100))
+}
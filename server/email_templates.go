@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+const fallbackLocale = "en"
+
+var validLocalePattern = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})*$`)
+
+// htmlTemplateSuffix marks the files of html templates, which are escaped
+// as html. Every other ".tmpl" file holds text templates.
+const htmlTemplateSuffix = ".html.tmpl"
+
+// emailTemplates holds a template set per locale. Sets are loaded from the
+// subdirectories of the template directory, which are named after the
+// locale, e.g. "pt-br/verification.tmpl". A nil *emailTemplates only has
+// the built-in English set and the default branding.
+//
+// An email can also have an html version, named "<email>.html", defined in
+// "*.html.tmpl" files. It's sent alongside the text, and only comes from
+// the locale of the text, so a translated email isn't paired with the
+// built-in English html.
+type emailTemplates struct {
+	defaultLocale string
+	sets          map[string]*template.Template
+	htmlSets      map[string]*htmltemplate.Template
+	branding      *branding
+}
+
+var builtinEmailTemplates = template.Must(template.New(fallbackLocale).Parse(defaultEmailTemplates))
+
+var builtinEmailHTMLTemplates = htmltemplate.Must(htmltemplate.New(fallbackLocale).Parse(defaultEmailHTMLTemplates))
+
+// newEmailTemplates loads the template sets in dir. A set that doesn't
+// define an email falls back to the built-in English one. brand fills in
+// the product name and links of every email; nil uses the default.
+func newEmailTemplates(dir, defaultLocale string, brand *branding) (*emailTemplates, error) {
+	et := &emailTemplates{
+		defaultLocale: fallbackLocale,
+		sets:          map[string]*template.Template{fallbackLocale: builtinEmailTemplates},
+		htmlSets:      map[string]*htmltemplate.Template{fallbackLocale: builtinEmailHTMLTemplates},
+		branding:      brand,
+	}
+	if dir != "" {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read email template directory")
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			locale := normalizeLocale(entry.Name())
+			if locale == "" {
+				return nil, errors.Errorf("email template directory '%s' isn't named after a locale", entry.Name())
+			}
+			files, err := filepath.Glob(filepath.Join(dir, entry.Name(), "*.tmpl"))
+			if err != nil {
+				return nil, err
+			}
+			var textFiles, htmlFiles []string
+			for _, f := range files {
+				if strings.HasSuffix(f, htmlTemplateSuffix) {
+					htmlFiles = append(htmlFiles, f)
+				} else {
+					textFiles = append(textFiles, f)
+				}
+			}
+
+			set, err := builtinEmailTemplates.Clone()
+			if err != nil {
+				return nil, err
+			}
+			if len(textFiles) > 0 {
+				if _, err = set.ParseFiles(textFiles...); err != nil {
+					return nil, errors.Wrapf(err, "unable to parse '%s' email templates", entry.Name())
+				}
+			}
+			et.sets[locale] = set
+
+			// only English starts from the built-in html. It's parsed again
+			// rather than cloned, since html templates can't be cloned once
+			// they've run.
+			htmlSet := htmltemplate.New(locale)
+			if locale == fallbackLocale {
+				htmlSet = htmltemplate.Must(htmlSet.Parse(defaultEmailHTMLTemplates))
+			}
+			if len(htmlFiles) > 0 {
+				if _, err = htmlSet.ParseFiles(htmlFiles...); err != nil {
+					return nil, errors.Wrapf(err, "unable to parse '%s' html email templates", entry.Name())
+				}
+			}
+			et.htmlSets[locale] = htmlSet
+		}
+	}
+
+	if defaultLocale != "" {
+		defaultLocale = normalizeLocale(defaultLocale)
+		if et.sets[defaultLocale] == nil {
+			return nil, errors.Errorf("there are no email templates for the default locale '%s'", defaultLocale)
+		}
+		et.defaultLocale = defaultLocale
+	}
+
+	return et, nil
+}
+
+// brand returns the branding of the emails
+func (et *emailTemplates) brand() *branding {
+	if et == nil {
+		return &defaultBranding
+	}
+	return et.branding.orDefault()
+}
+
+// set returns the template set that best matches locale. It tries the
+// locale, then its base language, then the default locale.
+func (et *emailTemplates) set(locale string) *template.Template {
+	if et == nil {
+		return builtinEmailTemplates
+	}
+	return et.sets[et.match(locale)]
+}
+
+// htmlSet returns the html templates of the locale set returns
+func (et *emailTemplates) htmlSet(locale string) *htmltemplate.Template {
+	if et == nil {
+		return builtinEmailHTMLTemplates
+	}
+	return et.htmlSets[et.match(locale)]
+}
+
+// match returns the loaded locale that best matches locale
+func (et *emailTemplates) match(locale string) string {
+	locale = normalizeLocale(locale)
+	for locale != "" {
+		if _, ok := et.sets[locale]; ok {
+			return locale
+		}
+		i := strings.LastIndexByte(locale, '-')
+		if i < 0 {
+			break
+		}
+		locale = locale[:i]
+	}
+	return et.defaultLocale
+}
+
+// render returns the subject and body of the named email in locale
+func (et *emailTemplates) render(locale, name string, data interface{}) (subject, body string, err error) {
+	set := et.set(locale)
+	buf := &bytes.Buffer{}
+	if err = set.ExecuteTemplate(buf, name+".subject", data); err != nil {
+		return "", "", err
+	}
+	subject = strings.TrimSpace(buf.String())
+	buf.Reset()
+	if err = set.ExecuteTemplate(buf, name+".body", data); err != nil {
+		return "", "", err
+	}
+	return subject, buf.String(), nil
+}
+
+// renderHTML returns the html version of the named email in locale, or nil
+// if the locale doesn't have one
+func (et *emailTemplates) renderHTML(locale, name string, data interface{}) (*string, error) {
+	set := et.htmlSet(locale)
+	if set.Lookup(name+".html") == nil {
+		return nil, nil
+	}
+	buf := &bytes.Buffer{}
+	if err := set.ExecuteTemplate(buf, name+".html", data); err != nil {
+		return nil, err
+	}
+	html := buf.String()
+	return &html, nil
+}
+
+// normalizeLocale lowercases a language tag and uses '-' as the separator,
+// so "pt_BR" becomes "pt-br". It returns "" for invalid tags.
+func normalizeLocale(locale string) string {
+	locale = strings.ToLower(strings.TrimSpace(strings.Replace(locale, "_", "-", -1)))
+	if !validLocalePattern.MatchString(locale) {
+		return ""
+	}
+	return locale
+}
+
+// negotiateLocale returns the locale explicitly asked for, or the one the
+// client prefers most in its Accept-Language header. It returns "" if
+// neither names a valid locale.
+func negotiateLocale(explicit, acceptLanguage string) string {
+	if locale := normalizeLocale(explicit); locale != "" {
+		return locale
+	}
+
+	type weighted struct {
+		locale string
+		q      float64
+	}
+	var prefs []weighted
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(part, ";")
+		locale := normalizeLocale(fields[0])
+		if locale == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if parsed, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q > 0 {
+			prefs = append(prefs, weighted{locale: locale, q: q})
+		}
+	}
+	if len(prefs) == 0 {
+		return ""
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+	return prefs[0].locale
+}
+
+// emailSamples builds example data for every email, for previewing templates
+var emailSamples = map[string]func(b *branding) interface{}{
+	"activity": func(b *branding) interface{} {
+		return newActivityEmail(b, "sample", accountEvent{Kind: eventSessionCreated, Time: time.Unix(1600000000, 0)})
+	},
+	"verification": func(b *branding) interface{} { return newVerificationEmail(b, "SAMPLE-TOKEN") },
+}
+
+type emailPreview struct {
+	Locale  string  `json:"locale"`
+	Subject string  `json:"subject"`
+	Body    string  `json:"body"`
+	HTML    *string `json:"html,omitempty"`
+}
+
+// previewEmail renders the named email with sample data. ok is false if
+// there's no such email.
+func previewEmail(templates *emailTemplates, name, locale string) (preview emailPreview, ok bool, err error) {
+	sample, ok := emailSamples[name]
+	if !ok {
+		return emailPreview{}, false, nil
+	}
+	preview.Locale = locale
+	data := sample(templates.brand())
+	preview.Subject, preview.Body, err = templates.render(locale, name, data)
+	if err != nil {
+		return preview, true, err
+	}
+	preview.HTML, err = templates.renderHTML(locale, name, data)
+	return preview, true, err
+}
+
+// previewEmailHandler handles GET /admin/emails/{name}?locale=
+func previewEmailHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	locale := r.URL.Query().Get("locale")
+	preview, ok, err := previewEmail(providersCtx(r.Context()).emailTemplates, name, locale)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if !ok {
+		sendNotFound(w, fmt.Sprintf("there is no '%s' email", name), errorNotFound)
+		return
+	}
+
+	sendSuccess(w, preview)
+}
+
+// testSendEmailHandler handles POST /admin/emails/{name}/test-send
+func testSendEmailHandler(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		To     string `json:"to"`
+		Locale string `json:"locale"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendBadReq(w, "Unable to parse POST body: "+err.Error())
+		return
+	}
+	if !strings.Contains(body.To, "@") {
+		sendBadReqCode(w, "'to' must be an email address", errorInvalidEmail)
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	providers := providersCtx(r.Context())
+	preview, ok, err := previewEmail(providers.emailTemplates, name, body.Locale)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if !ok {
+		sendNotFound(w, fmt.Sprintf("there is no '%s' email", name), errorNotFound)
+		return
+	}
+	// sent right away, so a failure is reported
+	if err = directEmailer(providers.emailer).SendEmail(providers.emailTemplates.brand().EmailFrom, body.To, preview.Subject, preview.Body, preview.HTML); err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+
+	sendSuccess(w, preview)
+}
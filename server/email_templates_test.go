@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/smtp"
+)
+
+func TestEmailTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oscar-email-templates")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "pt-BR"), 0755))
+	ptBR := `{{define "verification.subject"}}Zood Location: Verificação de e-mail{{end}}
+{{define "verification.body"}}Olá! https://www.zood.xyz/verify-email?t={{.Token}}{{end}}`
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "pt-BR", "verification.tmpl"), []byte(ptBR), 0644))
+	ptBRHTML := `{{define "verification.html"}}<a href="{{.VerifyURL}}">Olá {{.Token}}</a>{{end}}`
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "pt-BR", "verification.html.tmpl"), []byte(ptBRHTML), 0644))
+	// a locale that doesn't define every email
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "fr"), 0755))
+	fr := `{{define "verification.subject"}}Zood Location : vérifiez l'adresse{{end}}`
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "fr", "verification.tmpl"), []byte(fr), 0644))
+
+	et, err := newEmailTemplates(dir, "", nil)
+	require.NoError(t, err)
+	data := newVerificationEmail(nil, "abc123")
+
+	subject, body, err := et.render("pt_br", "verification", data)
+	require.NoError(t, err)
+	require.Equal(t, "Zood Location: Verificação de e-mail", subject)
+	require.Equal(t, "Olá! https://www.zood.xyz/verify-email?t=abc123", body)
+	html, err := et.renderHTML("pt_br", "verification", newVerificationEmail(nil, "<b>"))
+	require.NoError(t, err)
+	require.NotNil(t, html)
+	require.Equal(t, `<a href="https://www.zood.xyz/verify-email?t=%3Cb%3E">Olá &lt;b&gt;</a>`, *html)
+
+	// regional variants fall back to the base language
+	subject, body, err = et.render("fr-CA", "verification", data)
+	require.NoError(t, err)
+	require.Equal(t, "Zood Location : vérifiez l'adresse", subject)
+	// and missing emails to the built-in ones
+	require.True(t, strings.HasPrefix(body, "Hi,"))
+	// but the translation isn't paired with the English html
+	html, err = et.renderHTML("fr-CA", "verification", data)
+	require.NoError(t, err)
+	require.Nil(t, html)
+
+	// unknown locales get the default
+	subject, _, err = et.render("de", "verification", data)
+	require.NoError(t, err)
+	require.Equal(t, "Zood Location: Email Verification", subject)
+
+	et, err = newEmailTemplates(dir, "pt-br", nil)
+	require.NoError(t, err)
+	subject, _, err = et.render("", "verification", data)
+	require.NoError(t, err)
+	require.Equal(t, "Zood Location: Verificação de e-mail", subject)
+
+	_, err = newEmailTemplates(dir, "de", nil)
+	require.Error(t, err)
+
+	// without any templates, the built-in ones are used
+	var builtin *emailTemplates
+	subject, body, err = builtin.render("fr", "verification", data)
+	require.NoError(t, err)
+	require.Equal(t, "Zood Location: Email Verification", subject)
+	require.Contains(t, body, "verify-email?t=abc123")
+	html, err = builtin.renderHTML("fr", "verification", data)
+	require.NoError(t, err)
+	require.NotNil(t, html)
+	require.Contains(t, *html, `href="https://www.zood.xyz/verify-email?t=abc123"`)
+}
+
+func TestNegotiateLocale(t *testing.T) {
+	require.Equal(t, "fr-ca", negotiateLocale("fr_CA", "de"))
+	require.Equal(t, "de", negotiateLocale("", "de"))
+	require.Equal(t, "pt-br", negotiateLocale("", "en;q=0.5, pt-BR, pt;q=0.9"))
+	require.Equal(t, "en", negotiateLocale("not a locale!", "*, en;q=0.1"))
+	require.Equal(t, "", negotiateLocale("", "fr;q=0"))
+	require.Equal(t, "", negotiateLocale("", ""))
+}
+
+func TestEmailAdminHandlers(t *testing.T) {
+	providers := createTestProviders(t)
+	providers.adminToken = "admin-token"
+	emailer := smtp.NewMockSendEmailer()
+	providers.emailer = emailer
+	router := newOscarRouter(providers)
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer admin-token")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do(http.MethodGet, "/admin/emails/verification?locale=en", "")
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	preview := emailPreview{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&preview))
+	require.Equal(t, "Zood Location: Email Verification", preview.Subject)
+	require.Contains(t, preview.Body, "SAMPLE-TOKEN")
+	require.NotNil(t, preview.HTML)
+	require.Contains(t, *preview.HTML, "SAMPLE-TOKEN")
+
+	require.Equal(t, http.StatusNotFound, do(http.MethodGet, "/admin/emails/newsletter", "").Code)
+
+	require.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/admin/emails/verification/test-send", `{"to": "nobody"}`).Code)
+	require.False(t, emailer.SentEmail)
+	w = do(http.MethodPost, "/admin/emails/verification/test-send", `{"to": "ops@example.com"}`)
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	require.True(t, emailer.SentEmail)
+	require.Equal(t, preview.Subject, emailer.Subject)
+	require.NotNil(t, emailer.HTML)
+	require.Equal(t, *preview.HTML, *emailer.HTML)
+}
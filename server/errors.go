@@ -3,40 +3,56 @@ package main
 import (
 	"fmt"
 	"log"
+	"net/http"
 	"path/filepath"
 	"runtime"
+	"time"
+
+	"zood.dev/oscar/apierr"
 )
 
-// ErrCode ...
-type ErrCode int
+// ErrCode identifies an error returned by the API. The codes, and the HTTP
+// status each is sent with, are defined in the apierr package.
+type ErrCode = apierr.Code
 
 // Errors used throughout this package
 const (
-	errorNone                            ErrCode = 0
-	errorInternal                        ErrCode = 1
-	errorBadRequest                      ErrCode = 2
-	errorInvalidUsername                 ErrCode = 3
-	errorInvalidPublicKey                ErrCode = 4
-	errorInvalidWrappedSecretKey         ErrCode = 5
-	errorInvalidWrappedSecretKeyNonce    ErrCode = 6
-	errorInvalidWrappedSymmetricKey      ErrCode = 7
-	errorInvalidWrappedSymmetricKeyNonce ErrCode = 8
-	errorInvalidPasswordSalt             ErrCode = 9
-	errorUsernameNotAvailable            ErrCode = 10
-	errorNotFound                        ErrCode = 11
-	errorInsufficientPermission          ErrCode = 12
-	errorArgon2iOpsLimitTooLow           ErrCode = 13
-	errorArgon2iMemLimitTooLow           ErrCode = 14
-	errorInvalidAccessToken              ErrCode = 15
-	errorUserNotFound                    ErrCode = 16
-	errorChallengeNotFound               ErrCode = 17
-	errorChallengeExpired                ErrCode = 18
-	errorLoginFailed                     ErrCode = 19
-	errorBackupNotFound                  ErrCode = 20
-	errorInvalidEmail                    ErrCode = 21
-	errorMissingVerificationToken        ErrCode = 22
-	errorInvalidPasswordHashAlgorithm    ErrCode = 23
-	errorNotAnEndpoint                   ErrCode = 24
+	errorNone                            = apierr.None
+	errorInternal                        = apierr.Internal
+	errorBadRequest                      = apierr.BadRequest
+	errorInvalidUsername                 = apierr.InvalidUsername
+	errorInvalidPublicKey                = apierr.InvalidPublicKey
+	errorInvalidWrappedSecretKey         = apierr.InvalidWrappedSecretKey
+	errorInvalidWrappedSecretKeyNonce    = apierr.InvalidWrappedSecretKeyNonce
+	errorInvalidWrappedSymmetricKey      = apierr.InvalidWrappedSymmetricKey
+	errorInvalidWrappedSymmetricKeyNonce = apierr.InvalidWrappedSymmetricKeyNonce
+	errorInvalidPasswordSalt             = apierr.InvalidPasswordSalt
+	errorUsernameNotAvailable            = apierr.UsernameNotAvailable
+	errorNotFound                        = apierr.NotFound
+	errorInsufficientPermission          = apierr.InsufficientPermission
+	errorArgon2iOpsLimitTooLow           = apierr.Argon2iOpsLimitTooLow
+	errorArgon2iMemLimitTooLow           = apierr.Argon2iMemLimitTooLow
+	errorInvalidAccessToken              = apierr.InvalidAccessToken
+	errorUserNotFound                    = apierr.UserNotFound
+	errorChallengeNotFound               = apierr.ChallengeNotFound
+	errorChallengeExpired                = apierr.ChallengeExpired
+	errorLoginFailed                     = apierr.LoginFailed
+	errorBackupNotFound                  = apierr.BackupNotFound
+	errorInvalidEmail                    = apierr.InvalidEmail
+	errorMissingVerificationToken        = apierr.MissingVerificationToken
+	errorInvalidPasswordHashAlgorithm    = apierr.InvalidPasswordHashAlgorithm
+	errorNotAnEndpoint                   = apierr.NotAnEndpoint
+	errorRateLimited                     = apierr.RateLimited
+	errorInvalidPayloadSize              = apierr.InvalidPayloadSize
+	errorRequestTimeout                  = apierr.RequestTimeout
+	errorClientUpgradeRequired           = apierr.ClientUpgradeRequired
+	errorContentRejected                 = apierr.ContentRejected
+	errorQuotaExceeded                   = apierr.QuotaExceeded
+	errorDraining                        = apierr.Draining
+	errorRecipientQueueFull              = apierr.RecipientQueueFull
+	errorInvalidRefreshToken             = apierr.InvalidRefreshToken
+	errorAccountSuspended                = apierr.AccountSuspended
+	errorAccountBanned                   = apierr.AccountBanned
 )
 
 type serverError struct {
@@ -65,3 +81,8 @@ func logErr(err error) {
 	file = filepath.Base(file)
 	log.Printf("%s:%d %v", file, line, err)
 }
+
+// errorCatalogHandler handles GET /1/errors
+func errorCatalogHandler(w http.ResponseWriter, r *http.Request) {
+	sendCacheable(w, r, apierr.Catalog(), time.Hour)
+}
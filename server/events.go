@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"zood.dev/oscar/model"
+)
+
+// accountEventKind identifies something that happened to an account, or to
+// the server's keys
+type accountEventKind string
+
+// Kinds of account events
+const (
+	eventUserCreated         accountEventKind = "user_created"
+	eventEmailVerified       accountEventKind = "email_verified"
+	eventEmailSuppressed     accountEventKind = "email_suppressed"
+	eventSymmetricKeyRotated accountEventKind = "symmetric_key_rotated"
+	eventUsernamesReserved   accountEventKind = "usernames_reserved"
+	eventLoginReplayed       accountEventKind = "login_replayed"
+	eventLoginLockedOut      accountEventKind = "login_locked_out"
+	eventLoginLockoutCleared accountEventKind = "login_lockout_cleared"
+	eventSessionCreated      accountEventKind = "session_created"
+	eventSessionsRevoked     accountEventKind = "sessions_revoked"
+	eventPushTokenAdded      accountEventKind = "push_token_added"
+	eventPushTokenPruned     accountEventKind = "push_token_pruned"
+	eventBackupReplaced      accountEventKind = "backup_replaced"
+	eventUserSuspended       accountEventKind = "user_suspended"
+	eventUserBanned          accountEventKind = "user_banned"
+	eventUserReinstated      accountEventKind = "user_reinstated"
+)
+
+// Actors that cause account events
+const (
+	actorAdmin   = "admin"
+	actorUser    = "user"
+	actorServer  = "server"
+	actorMailgun = "mailgun"
+)
+
+// accountEvent describes a change to an account, for the subsystems that
+// record or react to them
+type accountEvent struct {
+	Kind  accountEventKind
+	Actor string
+	// UserID is 0 when the event isn't about a single user
+	UserID  int64
+	Details string
+	Time    time.Time
+}
+
+func (evt accountEvent) String() string {
+	s := fmt.Sprintf("%s by %s", evt.Kind, evt.Actor)
+	if evt.UserID != 0 {
+		s += fmt.Sprintf(" for user %d", evt.UserID)
+	}
+	if evt.Details != "" {
+		s += ": " + evt.Details
+	}
+	return s
+}
+
+// eventSubscriber consumes account events. An error is logged, and doesn't
+// stop the event from reaching the other subscribers.
+type eventSubscriber struct {
+	name   string
+	handle func(evt accountEvent) error
+}
+
+// eventBus delivers account events to every subscriber, in the order they
+// subscribed. A nil bus drops events, which keeps tests that don't care
+// about them simple.
+type eventBus struct {
+	mu          sync.RWMutex
+	subscribers []eventSubscriber
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{}
+}
+
+// subscribe adds a subscriber, identified by name in logged errors
+func (eb *eventBus) subscribe(name string, handle func(evt accountEvent) error) {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	eb.subscribers = append(eb.subscribers, eventSubscriber{name: name, handle: handle})
+}
+
+// emit synchronously hands evt to every subscriber. Time is set when empty.
+func (eb *eventBus) emit(evt accountEvent) {
+	if eb == nil {
+		return
+	}
+	if evt.Time.IsZero() {
+		evt.Time = time.Now()
+	}
+
+	eb.mu.RLock()
+	defer eb.mu.RUnlock()
+	for _, s := range eb.subscribers {
+		if err := s.handle(evt); err != nil {
+			logErr(errors.Wrapf(err, "%s failed to handle %s", s.name, evt.Kind))
+		}
+	}
+}
+
+// auditLogSubscriber records events in the audit log. db must not be bound
+// to a request, since events can be emitted after the response is sent.
+func auditLogSubscriber(db model.Provider) func(evt accountEvent) error {
+	return func(evt accountEvent) error {
+		details := evt.Details
+		if evt.UserID != 0 {
+			details = fmt.Sprintf("user %d; %s", evt.UserID, details)
+		}
+		return db.InsertAuditLogEntry(evt.Actor, string(evt.Kind), details)
+	}
+}
+
+// logSubscriber writes events to the server log
+func logSubscriber(evt accountEvent) error {
+	if shouldLogInfo() {
+		log.Printf("event: %v", evt)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/mailgun"
+)
+
+func TestEventBus(t *testing.T) {
+	var nilBus *eventBus
+	nilBus.emit(accountEvent{Kind: eventUserCreated})
+
+	bus := newEventBus()
+	var order []string
+	var received accountEvent
+	bus.subscribe("failing", func(evt accountEvent) error {
+		order = append(order, "failing")
+		return errors.New("subscriber failed")
+	})
+	bus.subscribe("recording", func(evt accountEvent) error {
+		order = append(order, "recording")
+		received = evt
+		return nil
+	})
+
+	bus.emit(accountEvent{Kind: eventEmailVerified, Actor: actorUser, UserID: 5})
+	// a failing subscriber doesn't keep the event from the others
+	require.Equal(t, []string{"failing", "recording"}, order)
+	require.Equal(t, eventEmailVerified, received.Kind)
+	require.Equal(t, int64(5), received.UserID)
+	require.False(t, received.Time.IsZero())
+	require.Equal(t, "email_verified by user for user 5", received.String())
+}
+
+func TestAuditLogSubscriber(t *testing.T) {
+	providers := createTestProviders(t)
+	providers.events = newEventBus()
+	providers.events.subscribe("audit_log", auditLogSubscriber(providers.db))
+	var received []accountEvent
+	providers.events.subscribe("recording", func(evt accountEvent) error {
+		received = append(received, evt)
+		return nil
+	})
+
+	require.NoError(t, suppressEmail(providers.db, providers.events, &mailgun.Event{
+		Event:     mailgun.EventComplained,
+		Recipient: "bob@example.com",
+	}))
+	require.Len(t, received, 1)
+	require.Equal(t, eventEmailSuppressed, received[0].Kind)
+	require.Equal(t, actorMailgun, received[0].Actor)
+	require.Equal(t, "bob@example.com (complained); removed from 0 users", received[0].Details)
+	// the bus only logs subscriber errors, so check the audit log directly
+	require.NoError(t, auditLogSubscriber(providers.db)(received[0]))
+}
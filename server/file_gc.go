@@ -0,0 +1,132 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"zood.dev/oscar/filestor"
+	"zood.dev/oscar/model"
+)
+
+// fileGCRun counts what a garbage collection found
+type fileGCRun struct {
+	Scanned int64 `json:"scanned"`
+	// Orphaned files belong to no user. In a dry run, they're counted but
+	// not deleted.
+	Orphaned      int64 `json:"orphaned"`
+	OrphanedBytes int64 `json:"orphaned_bytes"`
+	Deleted       int64 `json:"deleted"`
+}
+
+// fileGCStats are the totals since the server started, reported by
+// GET /admin/file-gc
+type fileGCStats struct {
+	mu      sync.Mutex
+	dryRun  bool
+	runs    int64
+	total   fileGCRun
+	last    fileGCRun
+	lastRun time.Time
+}
+
+var fileGCs = &fileGCStats{}
+
+func (fgs *fileGCStats) record(run fileGCRun, dryRun bool, at time.Time) {
+	fgs.mu.Lock()
+	defer fgs.mu.Unlock()
+	fgs.dryRun = dryRun
+	fgs.runs++
+	fgs.total.Scanned += run.Scanned
+	fgs.total.Orphaned += run.Orphaned
+	fgs.total.OrphanedBytes += run.OrphanedBytes
+	fgs.total.Deleted += run.Deleted
+	fgs.last = run
+	fgs.lastRun = at
+}
+
+// backupOwner returns the user relPath is the backup of, or false if it
+// isn't a backup path
+func backupOwner(relPath string) (int64, bool) {
+	name := strings.TrimSuffix(filepath.Base(relPath), ".db")
+	userID, err := strconv.ParseInt(name, 10, 64)
+	if err != nil || relPath != backupPath(userID) {
+		return 0, false
+	}
+	return userID, true
+}
+
+// collectFileGarbage deletes the files in the backups directory that don't
+// belong to an existing user. Users are never deleted through the API, but
+// rows can be removed by hand or lost in a restore, and files are sometimes
+// left behind by other tools. Nothing outside the backups directory is
+// touched, since the server doesn't know what else shares the storage.
+func collectFileGarbage(db model.Provider, fs filestor.Provider, dryRun bool) (fileGCRun, error) {
+	run := fileGCRun{}
+	err := fs.ListFiles(dbBackupsDir, func(relPath string) error {
+		run.Scanned++
+		if userID, ok := backupOwner(relPath); ok {
+			username, _, err := db.LimitedUserInfoID(userID)
+			if err != nil {
+				return errors.Wrapf(err, "looking up the owner of '%s'", relPath)
+			}
+			if username != "" {
+				return nil
+			}
+		}
+
+		run.Orphaned++
+		if size, err := fs.FileSize(relPath); err == nil {
+			run.OrphanedBytes += size
+		}
+		if dryRun {
+			log.Printf("file_gc: would delete orphaned file '%s'", relPath)
+			return nil
+		}
+		if err := fs.DeleteFile(relPath); err != nil {
+			return errors.Wrapf(err, "deleting '%s'", relPath)
+		}
+		run.Deleted++
+		return nil
+	})
+	return run, err
+}
+
+// runFileGC collects file garbage every interval, forever
+func runFileGC(db model.Provider, fs filestor.Provider, interval time.Duration, dryRun bool) {
+	for {
+		time.Sleep(interval)
+
+		now := time.Now()
+		run, err := collectFileGarbage(db, fs, dryRun)
+		if err != nil {
+			logErr(err)
+		}
+		fileGCs.record(run, dryRun, now)
+		if shouldLogInfo() && run.Orphaned > 0 {
+			log.Printf("file_gc: found %d orphaned files (%d bytes) among %d, deleted %d", run.Orphaned, run.OrphanedBytes, run.Scanned, run.Deleted)
+		}
+	}
+}
+
+// fileGCStatsHandler handles GET /admin/file-gc
+func fileGCStatsHandler(w http.ResponseWriter, r *http.Request) {
+	fileGCs.mu.Lock()
+	defer fileGCs.mu.Unlock()
+	resp := struct {
+		DryRun  bool      `json:"dry_run"`
+		Runs    int64     `json:"runs"`
+		Total   fileGCRun `json:"total"`
+		Last    fileGCRun `json:"last"`
+		LastRun int64     `json:"last_run,omitempty"`
+	}{DryRun: fileGCs.dryRun, Runs: fileGCs.runs, Total: fileGCs.total, Last: fileGCs.last}
+	if !fileGCs.lastRun.IsZero() {
+		resp.LastRun = fileGCs.lastRun.Unix()
+	}
+	sendSuccess(w, resp)
+}
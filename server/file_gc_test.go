@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/filestor"
+)
+
+func TestCollectFileGarbage(t *testing.T) {
+	providers := createTestProviders(t)
+	user, _ := createTestUser(t, providers)
+	fs := providers.fs
+	kept := backupPath(user.ID)
+	orphans := []string{backupPath(user.ID + 1000), filepath.Join(dbBackupsDir, "stray.txt")}
+	for _, relPath := range append(orphans, kept) {
+		require.NoError(t, fs.WriteFile(relPath, bytes.NewBufferString("backup")))
+	}
+	// other files in the storage aren't ours to collect
+	require.NoError(t, fs.WriteFile("elsewhere/1.db", bytes.NewBufferString("other")))
+
+	run, err := collectFileGarbage(providers.db, fs, true)
+	require.NoError(t, err)
+	require.Equal(t, fileGCRun{Scanned: 3, Orphaned: 2, OrphanedBytes: 12}, run)
+	for _, relPath := range orphans {
+		_, err = fs.FileSize(relPath)
+		require.NoError(t, err)
+	}
+
+	run, err = collectFileGarbage(providers.db, fs, false)
+	require.NoError(t, err)
+	require.Equal(t, fileGCRun{Scanned: 3, Orphaned: 2, OrphanedBytes: 12, Deleted: 2}, run)
+	for _, relPath := range orphans {
+		_, err = fs.FileSize(relPath)
+		require.Equal(t, filestor.ErrFileNotExist, err)
+	}
+	_, err = fs.FileSize(kept)
+	require.NoError(t, err)
+	_, err = fs.FileSize("elsewhere/1.db")
+	require.NoError(t, err)
+}
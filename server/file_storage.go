@@ -0,0 +1,219 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"zood.dev/oscar/azureblob"
+	"zood.dev/oscar/b2"
+	"zood.dev/oscar/filestor"
+	"zood.dev/oscar/gcs"
+	"zood.dev/oscar/localdisk"
+	"zood.dev/oscar/memfs"
+	"zood.dev/oscar/replicafs"
+	"zood.dev/oscar/s3"
+	"zood.dev/oscar/sealedfs"
+
+	"github.com/pkg/errors"
+)
+
+// fileStorageConfig picks where files, like user backups, are stored
+type fileStorageConfig struct {
+	// Type is localdisk, gcs, azureblob, s3, b2, memory or replicated. The
+	// memory type loses every file on restart, so it's only for tests and
+	// local development.
+	Type string `json:"type"`
+	// The azureblob type stores files in an Azure Blob Storage
+	// container. It authenticates with the account key in
+	// AzureConnectionString, or else as the managed identity of the
+	// host, in which case AzureAccountName is required.
+	// AzureManagedIdentityClientID picks a user-assigned identity.
+	AzureAccountName             string `json:"azure_account_name,omitempty"`
+	AzureConnectionString        string `json:"azure_connection_string,omitempty"`
+	AzureContainer               string `json:"azure_container,omitempty"`
+	AzureManagedIdentityClientID string `json:"azure_managed_identity_client_id,omitempty"`
+	// The b2 type stores files in a Backblaze B2 bucket, with an
+	// application key. When the key is empty, it's read from
+	// B2_APPLICATION_KEY_ID and B2_APPLICATION_KEY. The bucket should keep
+	// only the last version of files, or replaced backups keep taking up
+	// space.
+	B2ApplicationKey   string `json:"b2_application_key,omitempty"`
+	B2ApplicationKeyID string `json:"b2_application_key_id,omitempty"`
+	B2Bucket           string `json:"b2_bucket,omitempty"`
+	// Deduplicate stores files with the same content once, so uploads of
+	// unchanged backups don't reach the storage. Which file uses which
+	// content is kept in the kv database, so the files can't be read
+	// without it.
+	Deduplicate bool `json:"deduplicate,omitempty"`
+	// Encrypt seals every file before it's stored, with EncryptionKey
+	// or, when that's empty, the symmetric key. Files sealed under the
+	// symmetric key are resealed in the background after it's rotated,
+	// and stay readable while it's in previous_symmetric_keys.
+	Encrypt              bool   `json:"encrypt,omitempty"`
+	EncryptionKey        []byte `json:"-"`
+	EncryptionKeyHex     string `json:"encryption_key,omitempty"`
+	GCPBucketName        string `json:"gcp_bucket_name"`
+	GCPCredentialsPath   string `json:"gcp_credentials_path"`
+	LocalDiskStoragePath string `json:"local_disk_storage_path"`
+	// The replicated type writes every file to all the Replicas, and reads
+	// from the first one that can serve it. Replicas are configured like
+	// file_storage itself, but can't be replicated or encrypted. Set
+	// encrypt or deduplicate on file_storage to apply them to every
+	// replica.
+	Replicas []fileStorageConfig `json:"replicas,omitempty"`
+	// The s3 type stores files in an S3 bucket. S3Endpoint points it at
+	// an S3-compatible service instead of AWS, and S3PathStyle puts the
+	// bucket in the path of urls, which MinIO needs. When the keys are
+	// empty, they're read from AWS_ACCESS_KEY_ID and
+	// AWS_SECRET_ACCESS_KEY.
+	S3AccessKeyID     string `json:"s3_access_key_id,omitempty"`
+	S3Bucket          string `json:"s3_bucket,omitempty"`
+	S3Endpoint        string `json:"s3_endpoint,omitempty"`
+	S3PathStyle       bool   `json:"s3_path_style,omitempty"`
+	S3Region          string `json:"s3_region,omitempty"`
+	S3SecretAccessKey string `json:"s3_secret_access_key,omitempty"`
+}
+
+// validate checks that the settings of the storage type are present, and
+// fills in the ones that come from the environment
+func (fsc *fileStorageConfig) validate() error {
+	switch fsc.Type {
+	case "localdisk", "gcs", "memory":
+	case "replicated":
+		if len(fsc.Replicas) < 2 {
+			return errors.New("replicated file storage needs at least 2 replicas")
+		}
+		for i := range fsc.Replicas {
+			r := &fsc.Replicas[i]
+			if r.Type == "replicated" || r.Encrypt || r.EncryptionKeyHex != "" || r.Deduplicate {
+				return errors.Errorf("file storage replica %d can't be replicated, encrypted or deduplicated", i)
+			}
+			if err := r.validate(); err != nil {
+				return errors.Wrapf(err, "file storage replica %d", i)
+			}
+		}
+	case "azureblob":
+		if fsc.AzureContainer == "" {
+			return errors.New("azureblob file storage needs azure_container")
+		}
+		if (fsc.AzureConnectionString == "") == (fsc.AzureAccountName == "") {
+			return errors.New("azureblob file storage needs either azure_connection_string or azure_account_name")
+		}
+	case "b2":
+		if fsc.B2Bucket == "" {
+			return errors.New("b2 file storage needs b2_bucket")
+		}
+		if fsc.B2ApplicationKeyID == "" {
+			fsc.B2ApplicationKeyID = os.Getenv("B2_APPLICATION_KEY_ID")
+		}
+		if fsc.B2ApplicationKey == "" {
+			fsc.B2ApplicationKey = os.Getenv("B2_APPLICATION_KEY")
+		}
+		if fsc.B2ApplicationKeyID == "" || fsc.B2ApplicationKey == "" {
+			return errors.New("b2 file storage needs an application key id and application key")
+		}
+	case "s3":
+		if fsc.S3Bucket == "" || fsc.S3Region == "" {
+			return errors.New("s3 file storage needs s3_bucket and s3_region")
+		}
+		if fsc.S3AccessKeyID == "" {
+			fsc.S3AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		}
+		if fsc.S3SecretAccessKey == "" {
+			fsc.S3SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		}
+		if fsc.S3AccessKeyID == "" || fsc.S3SecretAccessKey == "" {
+			return errors.New("s3 file storage needs an access key id and secret access key")
+		}
+	default:
+		return errors.Errorf("unknown filestor provider: '%s'", fsc.Type)
+	}
+	return nil
+}
+
+// newFileStorage creates the filestor.Provider described by fsc. Encryption
+// and deduplication are left to the caller.
+func newFileStorage(fsc fileStorageConfig) (filestor.Provider, error) {
+	var fs filestor.Provider
+	var err error
+	switch fsc.Type {
+	case "localdisk":
+		fs, err = localdisk.New(fsc.LocalDiskStoragePath)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create localdisk based filestor")
+		}
+	case "memory":
+		fs = memfs.New()
+	case "replicated":
+		replicas := make([]filestor.Provider, len(fsc.Replicas))
+		for i, r := range fsc.Replicas {
+			if replicas[i], err = newFileStorage(r); err != nil {
+				return nil, errors.Wrapf(err, "replica %d", i)
+			}
+		}
+		fs, err = replicafs.New(replicas...)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create replicated filestor")
+		}
+	case "gcs":
+		fs, err = gcs.New(fsc.GCPCredentialsPath, fsc.GCPBucketName)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create google cloud storage based filestor")
+		}
+	case "azureblob":
+		fs, err = azureblob.New(azureblob.Config{
+			Container:               fsc.AzureContainer,
+			ConnectionString:        fsc.AzureConnectionString,
+			AccountName:             fsc.AzureAccountName,
+			ManagedIdentityClientID: fsc.AzureManagedIdentityClientID,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create azure blob storage based filestor")
+		}
+	case "s3":
+		fs, err = s3.New(s3.Config{
+			Region:          fsc.S3Region,
+			Bucket:          fsc.S3Bucket,
+			Endpoint:        fsc.S3Endpoint,
+			PathStyle:       fsc.S3PathStyle,
+			AccessKeyID:     fsc.S3AccessKeyID,
+			SecretAccessKey: fsc.S3SecretAccessKey,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create s3 based filestor")
+		}
+	case "b2":
+		fs, err = b2.New(b2.Config{
+			KeyID:          fsc.B2ApplicationKeyID,
+			ApplicationKey: fsc.B2ApplicationKey,
+			Bucket:         fsc.B2Bucket,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create b2 based filestor")
+		}
+	default:
+		return nil, errors.Errorf("unknown filestor type: '%s'", fsc.Type)
+	}
+	return fs, nil
+}
+
+// sealedFilesResealer moves the files sealed under the symmetric key to its
+// current version. sealedfs has a format of its own, so fs is given the keys
+// of the ring when it's created, rather than on every pass.
+type sealedFilesResealer struct {
+	fs filestor.Provider
+}
+
+func (sfr sealedFilesResealer) name() string {
+	return "sealed files"
+}
+
+// resealAll fulfills resealer
+func (sfr sealedFilesResealer) resealAll(*keyRing) (int, error) {
+	return sealedfs.Reseal(sfr.fs, "")
+}
+
+// countKeys fulfills keyCounter
+func (sfr sealedFilesResealer) countKeys(time.Time) (map[string]int, error) {
+	return sealedfs.KeyIDs(sfr.fs, "")
+}
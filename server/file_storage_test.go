@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/filestor"
+)
+
+func TestReplicatedFileStorage(t *testing.T) {
+	fsc := fileStorageConfig{Type: "replicated", Replicas: []fileStorageConfig{{Type: "memory"}}}
+	require.Error(t, fsc.validate())
+
+	fsc.Replicas = append(fsc.Replicas, fileStorageConfig{Type: "replicated"})
+	require.Error(t, fsc.validate())
+
+	fsc.Replicas[1] = fileStorageConfig{Type: "memory", Encrypt: true}
+	require.Error(t, fsc.validate())
+
+	fsc.Replicas[1] = fileStorageConfig{Type: "memory", Deduplicate: true}
+	require.Error(t, fsc.validate())
+
+	fsc.Replicas[1] = fileStorageConfig{Type: "memory"}
+	require.NoError(t, fsc.validate())
+	fs, err := newFileStorage(fsc)
+	require.NoError(t, err)
+	require.NoError(t, fs.WriteFile("backups/1", bytes.NewReader([]byte("hello"))))
+	buf, err := filestor.ReadAll(fs, "backups/1")
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello"), buf)
+}
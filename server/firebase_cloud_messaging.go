@@ -1,176 +1,44 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
-	"fmt"
-	"io/ioutil"
-	"log"
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
 	"zood.dev/oscar/model"
+	"zood.dev/oscar/push"
 )
 
-var gFCMServerKey string
+// fcmTokens are the device tokens of FCM
+type fcmTokens struct{}
 
-type fcmResult struct {
-	MessageID      *string `json:"message_id,omitempty"`
-	Error          *string `json:"error,omitempty"`
-	RegistrationID *string `json:"registration_id,omitempty"`
+func (fcmTokens) tokens(db model.Provider, userID int64) ([]string, error) {
+	return db.FCMTokensRaw(userID)
 }
 
-func (r fcmResult) String() string {
-	buf, err := json.Marshal(r)
-	if err != nil {
-		return "err marshalling gcmresult: " + err.Error()
-	}
-	return string(buf)
-}
-
-type fcmResponse struct {
-	MulticastID  int64       `json:"multicast_id"`
-	Success      int         `json:"success"`
-	Failure      int         `json:"failure"`
-	CanonicalIDs int         `json:"canonical_ids"`
-	Results      []fcmResult `json:"results"`
-}
-
-type fcmUnicastMessage struct {
-	To       string      `json:"to"`
-	Priority string      `json:"priority,omitempty"`
-	Data     interface{} `json:"data"`
-}
-
-type fcmMulticastMessage struct {
-	Tokens   []string    `json:"registration_ids"`
-	Priority string      `json:"priority,omitempty"`
-	Data     interface{} `json:"data"`
+func (fcmTokens) forget(db model.Provider, token string) error {
+	return db.DeleteFCMToken(token)
 }
 
-func sendFirebaseMessage(db model.Provider, userID int64, payload interface{}, urgent bool) {
-	tokens, err := db.FCMTokensRaw(userID)
-	if err != nil {
-		logErr(err)
-		return
-	}
-
-	if len(tokens) == 0 {
-		return
-	}
-	priority := ""
-	if urgent {
-		priority = "high"
-	} else {
-		priority = "normal"
-	}
-	var msg interface{}
-	if len(tokens) == 1 {
-		msg = fcmUnicastMessage{
-			To:       tokens[0],
-			Priority: priority,
-			Data:     payload,
-		}
-	} else {
-		msg = fcmMulticastMessage{
-			Tokens:   tokens,
-			Priority: priority,
-			Data:     payload,
-		}
-	}
-
-	msgBytes, _ := json.Marshal(msg)
-	msgReader := bytes.NewReader(msgBytes)
-	req, err := http.NewRequest(
-		"POST",
-		"https://fcm.googleapis.com/fcm/send",
-		msgReader)
+// replace fulfills pushTokens. When the user already has the canonical
+// token, the old one is just dropped.
+func (fcmTokens) replace(db model.Provider, userID int64, old, new string) error {
+	tokRec, err := db.FCMTokenUser(userID, new)
 	if err != nil {
-		logErr(err)
-		return
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "key="+gFCMServerKey)
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		logErr(err)
-		return
+		return err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		buf, _ := ioutil.ReadAll(resp.Body)
-		err = fmt.Errorf("status code %d\nheaders:\n%v\n\nresponse:\n%s", resp.StatusCode, resp.Header, string(buf))
-		logErr(err)
-		return
+	if tokRec != nil {
+		return db.DeleteFCMToken(old)
 	}
-
-	fcmBody := &fcmResponse{}
-	err = json.NewDecoder(resp.Body).Decode(fcmBody)
+	rowsAffected, err := db.ReplaceFCMToken(old, new)
 	if err != nil {
-		logErr(err)
-		return
+		return err
 	}
-
-	// if everything went smoothly, we're done
-	if fcmBody.Failure == 0 && fcmBody.CanonicalIDs == 0 {
-		if shouldLogDebug() {
-			log.Printf("msg id %s", *fcmBody.Results[0].MessageID)
-		}
-		return
-	}
-
-	log.Printf("fcm send was less than normal")
-
-	// let's find out what went wrong
-	for i, result := range fcmBody.Results {
-		if result.MessageID != nil && result.RegistrationID != nil {
-			// We've been provided a canonical registration id. Check if we
-			// already have that ID. If so, just drop the old token. If not,
-			// update the old token to the new one.
-			log.Printf("| MessageID: %v, RegID: %v", result.MessageID, result.RegistrationID)
-			// check if we already have the canonical token for this user
-			tokRec, err := db.FCMTokenUser(userID, *result.RegistrationID)
-			if err == nil && tokRec != nil {
-				// we do, so drop the row with the old token
-				err := db.DeleteFCMToken(tokens[i])
-				if err != nil {
-					logErr(err)
-				}
-			} else if err == nil {
-				// nope, we don't. So replace the old token.
-				rowsAffected, err := db.ReplaceFCMToken(tokens[i], *result.RegistrationID)
-				if err != nil {
-					logErr(err)
-				} else {
-					if rowsAffected != 1 {
-						logErr(fmt.Errorf("received a registration id change, but no %d rows affected in db change\nmessage_id: %s\nregistration_id: %s\nuser id: %d\ntoken: %s",
-							rowsAffected,
-							*result.MessageID,
-							*result.RegistrationID,
-							userID,
-							tokens[i]))
-					}
-				}
-			}
-			continue
-		}
-
-		if result.Error != nil {
-			switch *result.Error {
-			case "Unavailable":
-				// TODO: retry request
-			case "InvalidRegistration":
-				fallthrough
-			case "NotRegistered":
-				// remove the token
-				db.DeleteFCMToken(tokens[i])
-			default:
-				logErr(fmt.Errorf("error sending via fcm: %s\nuser id: %d", *result.Error, userID))
-			}
-		}
+	if rowsAffected != 1 {
+		return errors.Errorf("replacing fcm token %s of user %d with %s affected %d rows", old, userID, new, rowsAffected)
 	}
+	return nil
 }
 
 func addFCMTokenHandler(w http.ResponseWriter, r *http.Request) {
@@ -191,18 +59,22 @@ func addFCMTokenHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// check if we already have this token in the db, and that it's associated with this user
-	db := providersCtx(r.Context()).db
+	providers := providersCtx(r.Context())
+	db := providers.db
 	ftr, err := db.FCMToken(body.Token)
 	if err != nil {
 		sendInternalErr(w, err)
 		return
 	}
+	client := clientRecord(r)
 	if ftr == nil {
 		// insert the token, then return
-		err = db.InsertFCMToken(userID, body.Token)
+		err = db.InsertFCMToken(userID, body.Token, client)
 		if err != nil {
 			sendInternalErr(w, err)
+			return
 		}
+		providers.events.emit(pushTokenAdded(userID, push.NameFCM))
 		return
 	}
 
@@ -211,16 +83,20 @@ func addFCMTokenHandler(w http.ResponseWriter, r *http.Request) {
 	// the case where a user logs out on their device and somebody else
 	// logs in. The device token will still be the same, so we need to make sure
 	// the user_id and device token are always in sync.
-	if ftr.UserID == userID {
+	// The client is refreshed too, so an app update shows up in the stats.
+	if ftr.UserID == userID && ftr.ClientRecord == client {
 		sendSuccess(w, nil)
 		return
 	}
 
-	err = db.UpdateUserIDOfFCMToken(userID, body.Token)
+	err = db.UpdateUserIDOfFCMToken(userID, body.Token, client)
 	if err != nil {
 		sendInternalErr(w, err)
 		return
 	}
+	if ftr.UserID != userID {
+		providers.events.emit(pushTokenAdded(userID, push.NameFCM))
+	}
 	sendSuccess(w, nil)
 }
 
@@ -1,19 +1,129 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"zood.dev/oscar/apierr"
 )
 
+// requestLog collects what is logged about a request as it's handled
+type requestLog struct {
+	// userID is set by the handlers that authenticate the caller
+	userID int64
+}
+
+// setRequestUser records the authenticated user of the request in its log
+// line
+func setRequestUser(ctx context.Context, userID int64) {
+	if rl, ok := ctx.Value(contextRequestLogKey).(*requestLog); ok {
+		rl.userID = userID
+	}
+}
+
+// statusRecorder records the status and size of a response. It can still be
+// hijacked and flushed, for the websockets.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(p)
+	sr.bytes += int64(n)
+	return n, err
+}
+
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := sr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer can't be hijacked")
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil && sr.status == 0 {
+		sr.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// logRequest writes one line describing a handled request. Server errors are
+// logged at the error level, client errors at warn, and the rest at info.
+func logRequest(r *http.Request, sr *statusRecorder, rl *requestLog, elapsed time.Duration) {
+	status := sr.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	switch {
+	case status >= 500:
+		if !shouldLogError() {
+			return
+		}
+	case status >= 400:
+		if !shouldLogWarn() {
+			return
+		}
+	default:
+		if !shouldLogInfo() {
+			return
+		}
+	}
+
+	// the query isn't logged, since it can hold tickets and tokens
+	line := fmt.Sprintf("method=%s path=%s status=%d bytes=%d duration=%s", r.Method, r.URL.Path, status, sr.bytes, elapsed.Round(time.Millisecond))
+	if rl.userID != 0 {
+		line += fmt.Sprintf(" user=%d", rl.userID)
+	}
+	line += " remote=" + r.RemoteAddr
+	log.Print(line)
+}
+
+// logMiddleware recovers from panics in the handlers, and logs every request
+// with its response status and the user that made it
 func logMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if shouldLogDebug() {
-			log.Printf("%s %s (%s)", r.Method, r.URL.Path, r.RemoteAddr)
-		}
+		start := time.Now()
+		rl := &requestLog{}
+		sr := &statusRecorder{ResponseWriter: w}
+		w = sr
+		r = r.WithContext(context.WithValue(r.Context(), contextRequestLogKey, rl))
+		// deferred first, so it runs after a panic has been turned into a 500
+		defer func() {
+			logRequest(r, sr, rl, time.Since(start))
+		}()
 
 		defer func() {
 			if r := recover(); r != nil {
@@ -45,13 +155,7 @@ func sendResponse(w http.ResponseWriter, response interface{}, httpCode int) {
 }
 
 func sendErr(w http.ResponseWriter, msg string, httpCode int, apiCode ErrCode) {
-	sendResponse(
-		w,
-		struct {
-			Msg  string  `json:"error_message"`
-			Code ErrCode `json:"error_code"`
-		}{Msg: msg, Code: apiCode},
-		httpCode)
+	sendResponse(w, apierr.NewBody(apiCode, msg), httpCode)
 }
 
 func sendBadReqCode(w http.ResponseWriter, msg string, apiCode ErrCode) {
@@ -87,3 +191,44 @@ func sendSuccess(w http.ResponseWriter, response interface{}) {
 
 	sendResponse(w, response, http.StatusOK)
 }
+
+// sendCacheable is like sendSuccess, but sets a strong ETag derived from the
+// body and a Cache-Control max-age. Conditional requests whose If-None-Match
+// matches the ETag get a 304 without a body.
+func sendCacheable(w http.ResponseWriter, r *http.Request, response interface{}, maxAge time.Duration) {
+	buf, err := json.Marshal(response)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	// match the output of json.Encoder used by sendResponse
+	buf = append(buf, '\n')
+
+	sum := sha256.Sum256(buf)
+	etag := `"` + base64.RawURLEncoding.EncodeToString(sum[:]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag.
+// If-None-Match uses the weak comparison, so W/ prefixes are ignored.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Defaults for the http config section
+const (
+	defaultReadHeaderTimeout = 5 * time.Second
+	defaultReadTimeout       = 5 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+	defaultMaxHeaderBytes    = 64 << 10
+	defaultMaxConnections    = 10000
+	defaultMaxConnsPerIP     = 64
+)
+
+// httpConfig tunes how the listeners treat slow and greedy clients.
+// Durations are strings like "5s". Fields left out get the defaults above,
+// and connection caps of -1 disable the cap.
+type httpConfig struct {
+	IdleTimeout         string `json:"idle_timeout,omitempty"`
+	MaxConnections      int    `json:"max_connections,omitempty"`
+	MaxConnectionsPerIP int    `json:"max_connections_per_ip,omitempty"`
+	MaxHeaderBytes      int    `json:"max_header_bytes,omitempty"`
+	// ProxyProtocolFrom lists the addresses or CIDR ranges of load
+	// balancers in TCP mode, like "10.0.0.0/8". Connections from them have
+	// to start with a PROXY protocol v2 header, and the client address in
+	// it is used as theirs, for the per-address connection cap and in the
+	// logs.
+	ProxyProtocolFrom []string `json:"proxy_protocol_from,omitempty"`
+	ReadHeaderTimeout string   `json:"read_header_timeout,omitempty"`
+	ReadTimeout       string   `json:"read_timeout,omitempty"`
+}
+
+// httpLimits are the parsed values of an httpConfig. A nil *httpLimits uses
+// the defaults.
+type httpLimits struct {
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	idleTimeout       time.Duration
+	maxHeaderBytes    int
+	maxConns          int
+	maxConnsPerIP     int
+	// proxyFrom are the load balancers that send PROXY protocol headers
+	proxyFrom []*net.IPNet
+}
+
+func newHTTPLimits(cfg httpConfig) (*httpLimits, error) {
+	hl := &httpLimits{
+		readHeaderTimeout: defaultReadHeaderTimeout,
+		readTimeout:       defaultReadTimeout,
+		idleTimeout:       defaultIdleTimeout,
+		maxHeaderBytes:    defaultMaxHeaderBytes,
+		maxConns:          defaultMaxConnections,
+		maxConnsPerIP:     defaultMaxConnsPerIP,
+	}
+
+	durations := []struct {
+		name string
+		val  string
+		dst  *time.Duration
+	}{
+		{"idle_timeout", cfg.IdleTimeout, &hl.idleTimeout},
+		{"read_header_timeout", cfg.ReadHeaderTimeout, &hl.readHeaderTimeout},
+		{"read_timeout", cfg.ReadTimeout, &hl.readTimeout},
+	}
+	for _, d := range durations {
+		if d.val == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(d.val)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid http '%s'", d.name)
+		}
+		if parsed <= 0 {
+			return nil, errors.Errorf("http '%s' must be positive", d.name)
+		}
+		*d.dst = parsed
+	}
+	if hl.readHeaderTimeout > hl.readTimeout {
+		return nil, errors.New("http 'read_header_timeout' can't be longer than 'read_timeout'")
+	}
+
+	if cfg.MaxHeaderBytes < 0 {
+		return nil, errors.New("http 'max_header_bytes' must be positive")
+	}
+	if cfg.MaxHeaderBytes > 0 {
+		hl.maxHeaderBytes = cfg.MaxHeaderBytes
+	}
+
+	caps := []struct {
+		name string
+		val  int
+		dst  *int
+	}{
+		{"max_connections", cfg.MaxConnections, &hl.maxConns},
+		{"max_connections_per_ip", cfg.MaxConnectionsPerIP, &hl.maxConnsPerIP},
+	}
+	for _, c := range caps {
+		switch {
+		case c.val == -1:
+			*c.dst = 0
+		case c.val < -1:
+			return nil, errors.Errorf("http '%s' must be positive, or -1 for no limit", c.name)
+		case c.val > 0:
+			*c.dst = c.val
+		}
+	}
+
+	var err error
+	if hl.proxyFrom, err = parseProxySources(cfg.ProxyProtocolFrom); err != nil {
+		return nil, errors.Wrap(err, "invalid http 'proxy_protocol_from'")
+	}
+
+	return hl, nil
+}
+
+// orDefault returns hl, or the default limits if hl is nil
+func (hl *httpLimits) orDefault() *httpLimits {
+	if hl != nil {
+		return hl
+	}
+	def, _ := newHTTPLimits(httpConfig{})
+	return def
+}
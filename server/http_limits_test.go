@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewHTTPLimits(t *testing.T) {
+	hl, err := newHTTPLimits(httpConfig{})
+	require.NoError(t, err)
+	require.Equal(t, defaultReadHeaderTimeout, hl.readHeaderTimeout)
+	require.Equal(t, defaultMaxHeaderBytes, hl.maxHeaderBytes)
+	require.Equal(t, defaultMaxConnections, hl.maxConns)
+	require.Equal(t, defaultMaxConnsPerIP, hl.maxConnsPerIP)
+
+	hl, err = newHTTPLimits(httpConfig{
+		IdleTimeout:         "30s",
+		MaxConnections:      -1,
+		MaxConnectionsPerIP: 8,
+		ReadHeaderTimeout:   "2s",
+		ReadTimeout:         "1m",
+	})
+	require.NoError(t, err)
+	require.Equal(t, 30*time.Second, hl.idleTimeout)
+	require.Equal(t, 0, hl.maxConns)
+	require.Equal(t, 8, hl.maxConnsPerIP)
+	require.Equal(t, 2*time.Second, hl.readHeaderTimeout)
+	require.Equal(t, time.Minute, hl.readTimeout)
+
+	_, err = newHTTPLimits(httpConfig{IdleTimeout: "a while"})
+	require.Error(t, err)
+	_, err = newHTTPLimits(httpConfig{ReadHeaderTimeout: "10s", ReadTimeout: "5s"})
+	require.Error(t, err)
+	_, err = newHTTPLimits(httpConfig{MaxConnectionsPerIP: -5})
+	require.Error(t, err)
+
+	hl, err = newHTTPLimits(httpConfig{ProxyProtocolFrom: []string{"10.0.0.0/8"}})
+	require.NoError(t, err)
+	require.Len(t, hl.proxyFrom, 1)
+	_, err = newHTTPLimits(httpConfig{ProxyProtocolFrom: []string{"the load balancer"}})
+	require.Error(t, err)
+}
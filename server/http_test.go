@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSendCacheable(t *testing.T) {
+	resp := map[string]string{"public_key": "abc"}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	sendCacheable(w, r, resp, time.Hour)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "public, max-age=3600", w.Header().Get("Cache-Control"))
+	etag := w.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+	require.JSONEq(t, `{"public_key":"abc"}`, w.Body.String())
+
+	// a matching conditional request gets a 304 and no body
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("If-None-Match", `"other", W/`+etag)
+	w = httptest.NewRecorder()
+	sendCacheable(w, r, resp, time.Hour)
+	require.Equal(t, http.StatusNotModified, w.Code)
+	require.Equal(t, etag, w.Header().Get("ETag"))
+	require.Zero(t, w.Body.Len())
+
+	// a different answer gets a different etag
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	sendCacheable(w, r, map[string]string{"public_key": "def"}, time.Hour)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NotEqual(t, etag, w.Header().Get("ETag"))
+}
+
+func TestSendErr(t *testing.T) {
+	w := httptest.NewRecorder()
+	sendNotFound(w, "user not found", errorUserNotFound)
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	body := struct {
+		Msg  string  `json:"error_message"`
+		Code ErrCode `json:"error_code"`
+		Name string  `json:"error_name"`
+	}{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+	require.Equal(t, "user not found", body.Msg)
+	require.Equal(t, errorUserNotFound, body.Code)
+	require.Equal(t, "user_not_found", body.Name)
+}
+
+func TestErrorCatalogHandler(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/1/errors", nil)
+	w := httptest.NewRecorder()
+	errorCatalogHandler(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var catalog []struct {
+		Code   ErrCode `json:"code"`
+		Name   string  `json:"name"`
+		Status int     `json:"http_status"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&catalog))
+	require.Len(t, catalog, int(errorAccountBanned)+1)
+	require.Equal(t, errorRateLimited, catalog[errorRateLimited].Code)
+	require.Equal(t, http.StatusTooManyRequests, catalog[errorRateLimited].Status)
+}
+
+func TestLogMiddleware(t *testing.T) {
+	defer setLogLevel(getLogLevel())
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+
+	providers := createTestProviders(t)
+	user, keyPair := createTestUser(t, providers)
+	token := loginTestUser(t, providers, user, keyPair)
+	router := newOscarRouter(providers)
+
+	get := func(path, token string) string {
+		buf.Reset()
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			r.Header.Set("X-Oscar-Access-Token", token)
+		}
+		router.ServeHTTP(httptest.NewRecorder(), r)
+		return buf.String()
+	}
+
+	setLogLevel(logLevelInfo)
+	line := get("/1/messages?ids=1", token)
+	require.Contains(t, line, "method=GET path=/1/messages status=200 bytes=")
+	require.Contains(t, line, fmt.Sprintf("user=%d", user.ID))
+	require.NotContains(t, line, "ids=")
+
+	line = get("/1/messages", "not-a-token")
+	require.Contains(t, line, "status=401")
+	require.NotContains(t, line, "user=")
+
+	// only failures are logged at the error level
+	setLogLevel(logLevelError)
+	require.Empty(t, get("/1/messages", token))
+	require.Empty(t, get("/1/messages", "not-a-token"))
+
+	// a panic is logged as a 500
+	buf.Reset()
+	panicky := logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("oops")
+	}))
+	w := httptest.NewRecorder()
+	panicky.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/oops", nil))
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Contains(t, lines[len(lines)-1], "method=GET path=/oops status=500")
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"zood.dev/oscar/model"
+)
+
+// Kinds of ingress checked by the ingress policies
+const (
+	ingressMessage       = "message"
+	ingressSealedMessage = "sealed_message"
+	ingressPackage       = "package"
+)
+
+// ingressRateWindow is the window ingress.Rate counts over
+const ingressRateWindow = time.Minute
+
+// ingressPolicyTimeout bounds how long the webhook policy may take
+const ingressPolicyTimeout = 2 * time.Second
+
+// ingress describes a message or package on its way in. Policies only see
+// this metadata, never the payload.
+type ingress struct {
+	Kind string
+	// SenderID is 0 for sealed sender messages
+	SenderID int64
+	// RecipientID is 0 for packages
+	RecipientID int64
+	// BoxID is only set for packages
+	BoxID []byte
+	Size  int
+	// Rate is how many items of this kind the sender has sent in the current
+	// minute, including this one. Sealed sender messages are counted per
+	// recipient instead, since the sender is unknown.
+	Rate int
+}
+
+// Verdicts of an ingress policy
+const (
+	ingressAccept   = "accept"
+	ingressThrottle = "throttle"
+	ingressReject   = "reject"
+)
+
+type ingressDecision struct {
+	Verdict string `json:"verdict"`
+	// RetryAfter is how long a throttled sender should wait, in seconds
+	RetryAfter int `json:"retry_after,omitempty"`
+	// Reason is logged, and sent to the client
+	Reason string `json:"reason,omitempty"`
+}
+
+// ingressPolicy is implemented by each abuse heuristic that can refuse
+// messages and packages. An error accepts the item, so a broken policy
+// doesn't stop delivery.
+type ingressPolicy interface {
+	check(ctx context.Context, in ingress) (ingressDecision, error)
+}
+
+// ingressRates counts the ingress of each sender in fixed windows
+type ingressRates struct {
+	mu     sync.Mutex
+	window time.Duration
+	counts map[string]*ingressCount
+}
+
+type ingressCount struct {
+	count int
+	start time.Time
+}
+
+var ingressRateCounter = newIngressRates(ingressRateWindow)
+
+func newIngressRates(window time.Duration) *ingressRates {
+	return &ingressRates{window: window, counts: map[string]*ingressCount{}}
+}
+
+// add counts one item for key, and returns the count in the current window
+func (ir *ingressRates) add(key string, now time.Time) int {
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+
+	c := ir.counts[key]
+	if c == nil || now.Sub(c.start) >= ir.window {
+		// drop stale entries while we're here, so the map doesn't grow forever
+		for k, other := range ir.counts {
+			if now.Sub(other.start) >= ir.window {
+				delete(ir.counts, k)
+			}
+		}
+		c = &ingressCount{start: now}
+		ir.counts[key] = c
+	}
+	c.count++
+	return c.count
+}
+
+// checkIngress passes in through every ingress policy. If one of them
+// throttles or rejects it, the error response is sent, and false is returned.
+func checkIngress(w http.ResponseWriter, r *http.Request, policies []ingressPolicy, in ingress) bool {
+	if len(policies) == 0 {
+		return true
+	}
+	key := fmt.Sprintf("%s:%d", in.Kind, in.SenderID)
+	if in.Kind == ingressSealedMessage {
+		key = fmt.Sprintf("%s:%d", in.Kind, in.RecipientID)
+	}
+	in.Rate = ingressRateCounter.add(key, providersCtx(r.Context()).now())
+
+	for _, p := range policies {
+		d, err := p.check(r.Context(), in)
+		if err != nil {
+			logErr(errors.Wrap(err, "ingress policy failed"))
+			continue
+		}
+		switch d.Verdict {
+		case ingressThrottle:
+			if shouldLogInfo() {
+				log.Printf("ingress: throttled %s from %d: %s", in.Kind, in.SenderID, d.Reason)
+			}
+			if d.RetryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(d.RetryAfter))
+			}
+			sendErr(w, reasonOr(d.Reason, "Too many messages. Try again later."), http.StatusTooManyRequests, errorRateLimited)
+			return false
+		case ingressReject:
+			if shouldLogInfo() {
+				log.Printf("ingress: rejected %s from %d: %s", in.Kind, in.SenderID, d.Reason)
+			}
+			sendErr(w, reasonOr(d.Reason, "Refused by the server's abuse policy"), http.StatusForbidden, errorContentRejected)
+			return false
+		}
+	}
+	return true
+}
+
+func reasonOr(reason, fallback string) string {
+	if reason == "" {
+		return fallback
+	}
+	return reason
+}
+
+// webhookIngressPolicy asks an operator's service about each ingress. It
+// POSTs the metadata as JSON, and expects an ingressDecision back.
+type webhookIngressPolicy struct {
+	url    string
+	client *http.Client
+	// db resolves user ids to usernames, which the operator can act on. It
+	// must not be bound to a request.
+	db model.Provider
+}
+
+func newWebhookIngressPolicy(url string, db model.Provider) *webhookIngressPolicy {
+	return &webhookIngressPolicy{
+		url:    url,
+		client: &http.Client{Timeout: ingressPolicyTimeout},
+		db:     db,
+	}
+}
+
+func (wp *webhookIngressPolicy) check(ctx context.Context, in ingress) (ingressDecision, error) {
+	body := struct {
+		Kind      string `json:"kind"`
+		Sender    string `json:"sender,omitempty"`
+		Recipient string `json:"recipient,omitempty"`
+		DropBox   string `json:"drop_box,omitempty"`
+		Size      int    `json:"size"`
+		Rate      int    `json:"rate"`
+	}{Kind: in.Kind, Size: in.Size, Rate: in.Rate}
+	if in.SenderID != 0 {
+		body.Sender = wp.db.Username(in.SenderID)
+	}
+	if in.RecipientID != 0 {
+		body.Recipient = wp.db.Username(in.RecipientID)
+	}
+	if in.BoxID != nil {
+		body.DropBox = hex.EncodeToString(in.BoxID)
+	}
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return ingressDecision{}, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, wp.url, bytes.NewReader(buf))
+	if err != nil {
+		return ingressDecision{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := wp.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return ingressDecision{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ingressDecision{}, errors.Errorf("ingress webhook responded with %d", resp.StatusCode)
+	}
+	d := ingressDecision{}
+	if err = json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return ingressDecision{}, errors.Wrap(err, "unable to decode ingress webhook response")
+	}
+	switch d.Verdict {
+	case ingressAccept, ingressThrottle, ingressReject:
+	default:
+		return ingressDecision{}, errors.Errorf("unknown ingress verdict '%s'", d.Verdict)
+	}
+	return d, nil
+}
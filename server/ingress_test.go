@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/apierr"
+	"zood.dev/oscar/encodable"
+)
+
+// stubIngressPolicy returns the same decision for everything, and records
+// what it was asked about
+type stubIngressPolicy struct {
+	decision ingressDecision
+	err      error
+	seen     []ingress
+}
+
+func (sp *stubIngressPolicy) check(ctx context.Context, in ingress) (ingressDecision, error) {
+	sp.seen = append(sp.seen, in)
+	return sp.decision, sp.err
+}
+
+func TestIngressRates(t *testing.T) {
+	ir := newIngressRates(time.Minute)
+	now := time.Now()
+	require.Equal(t, 1, ir.add("a", now))
+	require.Equal(t, 2, ir.add("a", now.Add(time.Second)))
+	require.Equal(t, 1, ir.add("b", now))
+	// a new window starts the count over
+	require.Equal(t, 1, ir.add("a", now.Add(time.Minute)))
+}
+
+func TestIngressPolicies(t *testing.T) {
+	providers := createTestProviders(t)
+	sender, keyPair := createTestUser(t, providers)
+	recipient, _ := createTestUser(t, providers)
+	token := loginTestUser(t, providers, sender, keyPair)
+	policy := &stubIngressPolicy{}
+	providers.ingressPolicies = []ingressPolicy{policy}
+	router := newOscarRouter(providers)
+
+	sendMessage := func() *httptest.ResponseRecorder {
+		buf, err := json.Marshal(map[string]interface{}{
+			"cipher_text": encodable.Bytes("cipher-text"),
+			"nonce":       encodable.Bytes("nonce"),
+			"transient":   true,
+		})
+		require.NoError(t, err)
+		r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/1/users/%s/messages", hex.EncodeToString(recipient.PublicID)), bytes.NewReader(buf))
+		r.Header.Set("X-Oscar-Access-Token", token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	policy.decision = ingressDecision{Verdict: ingressAccept}
+	w := sendMessage()
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	require.Len(t, policy.seen, 1)
+	require.Equal(t, ingress{Kind: ingressMessage, SenderID: sender.ID, RecipientID: recipient.ID, Size: len("cipher-text"), Rate: 1}, policy.seen[0])
+
+	policy.decision = ingressDecision{Verdict: ingressThrottle, RetryAfter: 30}
+	w = sendMessage()
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, "30", w.Header().Get("Retry-After"))
+
+	policy.decision = ingressDecision{Verdict: ingressReject, Reason: "looks like spam"}
+	w = sendMessage()
+	require.Equal(t, http.StatusForbidden, w.Code)
+	body := apierr.Body{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+	require.Equal(t, errorContentRejected, body.Code)
+	require.Equal(t, "looks like spam", body.Message)
+
+	// a failing policy doesn't stop delivery
+	policy.err = errors.New("the policy is broken")
+	require.Equal(t, http.StatusOK, sendMessage().Code)
+	require.Equal(t, 4, policy.seen[3].Rate)
+
+	// packages are checked too
+	policy.err = nil
+	boxID := bytes.Repeat([]byte{3}, dropBoxIDSize)
+	r := httptest.NewRequest(http.MethodPut, "/1/drop-boxes/"+hex.EncodeToString(boxID), bytes.NewReader([]byte("pkg")))
+	r.Header.Set("X-Oscar-Access-Token", token)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	require.Equal(t, http.StatusForbidden, w.Code)
+	last := policy.seen[len(policy.seen)-1]
+	require.Equal(t, ingressPackage, last.Kind)
+	require.Equal(t, boxID, last.BoxID)
+	pkg, err := providers.kvs.PickUpPackage(boxID)
+	require.NoError(t, err)
+	require.Empty(t, pkg)
+}
+
+func TestWebhookIngressPolicy(t *testing.T) {
+	providers := createTestProviders(t)
+	sender, _ := createTestUser(t, providers)
+
+	var received map[string]interface{}
+	verdict := ingressThrottle
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		fmt.Fprintf(w, `{"verdict": %q, "retry_after": 10}`, verdict)
+	}))
+	defer server.Close()
+
+	wp := newWebhookIngressPolicy(server.URL, providers.db)
+	boxID := bytes.Repeat([]byte{5}, dropBoxIDSize)
+	d, err := wp.check(context.Background(), ingress{Kind: ingressPackage, SenderID: sender.ID, BoxID: boxID, Size: 64, Rate: 3})
+	require.NoError(t, err)
+	require.Equal(t, ingressDecision{Verdict: ingressThrottle, RetryAfter: 10}, d)
+	require.Equal(t, map[string]interface{}{
+		"kind":     ingressPackage,
+		"sender":   sender.Username,
+		"drop_box": hex.EncodeToString(boxID),
+		"size":     float64(64),
+		"rate":     float64(3),
+	}, received)
+
+	verdict = "maybe"
+	_, err = wp.check(context.Background(), ingress{Kind: ingressMessage})
+	require.Error(t, err)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"zood.dev/oscar/sodium"
+
+	"github.com/pkg/errors"
+)
+
+// initCommand implements 'oscar init'. It generates the server's keys,
+// creates the storage directories under a data directory, and writes a
+// starter config file that loadConfig will accept as is.
+func initCommand(args []string) error {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	configPath := flags.String("config", "oscar.json", "Path of the config file to write")
+	dataDir := flags.String("data-dir", "oscar-data", "Directory under which the storage directories are created")
+	hostname := flags.String("hostname", "", "Public hostname of the server. When set, TLS is enabled via autocert.")
+	force := flags.Bool("force", false, "Overwrite an existing config file")
+	flags.Parse(args)
+
+	if !*force {
+		if _, err := os.Stat(*configPath); err == nil {
+			return errors.Errorf("'%s' already exists. Use --force to overwrite it.", *configPath)
+		}
+	}
+
+	cfg, err := newStarterConfig(*dataDir, *hostname)
+	if err != nil {
+		return err
+	}
+
+	buf, err := json.MarshalIndent(cfg, "", "    ")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode config")
+	}
+	// the config holds our secret keys, so keep it private
+	if err = ioutil.WriteFile(*configPath, append(buf, '\n'), 0600); err != nil {
+		return errors.Wrap(err, "failed to write config file")
+	}
+
+	fmt.Printf("Wrote config to %s\n", *configPath)
+	fmt.Println("Emails and push notifications are only logged until the 'email' and 'push' providers are configured.")
+	return nil
+}
+
+// newStarterConfig generates fresh keys and creates the storage directories
+// beneath dataDir.
+func newStarterConfig(dataDir, hostname string) (*serverConfig, error) {
+	cfg := &serverConfig{}
+
+	symKey := make([]byte, sodium.SymmetricKeySize)
+	if err := sodium.Random(symKey); err != nil {
+		return nil, errors.Wrap(err, "failed to generate symmetric key")
+	}
+	cfg.SymmetricKeyHex = hex.EncodeToString(symKey)
+
+	salt := make([]byte, usernameIndexSaltSize)
+	if err := sodium.Random(salt); err != nil {
+		return nil, errors.Wrap(err, "failed to generate username index salt")
+	}
+	cfg.UsernameIndexSaltHex = hex.EncodeToString(salt)
+
+	kp, err := sodium.NewKeyPair()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate key pair")
+	}
+	cfg.AsymmetricKeys.PublicHex = hex.EncodeToString(kp.Public)
+	cfg.AsymmetricKeys.SecretHex = hex.EncodeToString(kp.Secret)
+
+	dataDir, err = filepath.Abs(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	cfg.SQLDBDirectory = filepath.Join(dataDir, "sql")
+	cfg.KVDBDirectory = filepath.Join(dataDir, "kv")
+	cfg.FileStorage.Type = "localdisk"
+	cfg.FileStorage.LocalDiskStoragePath = filepath.Join(dataDir, "files")
+	dirs := []string{cfg.SQLDBDirectory, cfg.KVDBDirectory, cfg.FileStorage.LocalDiskStoragePath}
+
+	tls := hostname != ""
+	cfg.TLS = &tls
+	if tls {
+		cfg.Hostname = hostname
+		cfg.AutocertDirCache = filepath.Join(dataDir, "autocert")
+		dirs = append(dirs, cfg.AutocertDirCache)
+	} else {
+		port := 8080
+		cfg.Port = &port
+	}
+
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, errors.Wrapf(err, "failed to create '%s'", dir)
+		}
+	}
+
+	cfg.Email.Provider = emailProviderLog
+	cfg.Push.Provider = pushProviderLog
+
+	return cfg, nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInitCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oscar-init")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	confPath := filepath.Join(dir, "oscar.json")
+	args := []string{"--config", confPath, "--data-dir", filepath.Join(dir, "data")}
+	require.NoError(t, initCommand(args))
+
+	cfg, err := loadConfig(confPath, false)
+	require.NoError(t, err)
+	require.False(t, *cfg.TLS)
+	require.Equal(t, []string{":8080"}, cfg.ListenAddresses)
+	require.Equal(t, filepath.Join(dir, "data", "sql"), cfg.SQLDBDirectory)
+
+	// an existing config is left alone unless forced
+	require.Error(t, initCommand(args))
+	require.NoError(t, initCommand(append(args, "--force")))
+}
@@ -0,0 +1,547 @@
+//go:build integration
+// +build integration
+
+// The integration tests run the full oscar router against emulated versions
+// of the external services we depend on (google cloud storage, mailgun and
+// the push notification services), so those code paths get exercised without
+// any real credentials. Run them with:
+//
+//	go test -tags integration ./server/
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/base62"
+	"zood.dev/oscar/encodable"
+	"zood.dev/oscar/gcs"
+	"zood.dev/oscar/mailgun"
+	"zood.dev/oscar/memkv"
+	"zood.dev/oscar/model"
+	"zood.dev/oscar/push"
+	"zood.dev/oscar/sodium"
+	"zood.dev/oscar/sqlite"
+)
+
+const integrationBucketName = "oscar-integration"
+
+// fakeGCS emulates the subset of the google cloud storage JSON and XML APIs
+// used by the gcs package.
+type fakeGCS struct {
+	server  *httptest.Server
+	mutex   sync.Mutex
+	objects map[string][]byte
+}
+
+func newFakeGCS(t *testing.T) *fakeGCS {
+	t.Helper()
+
+	fg := &fakeGCS{objects: make(map[string][]byte)}
+	fg.server = httptest.NewServer(http.HandlerFunc(fg.serveHTTP))
+
+	return fg
+}
+
+// client returns an http.Client that sends every request, regardless of the
+// host, to the fake server.
+func (fg *fakeGCS) client() *http.Client {
+	target, _ := url.Parse(fg.server.URL)
+	return &http.Client{Transport: rewriteHostTransport{target: target}}
+}
+
+func (fg *fakeGCS) object(name string) ([]byte, bool) {
+	fg.mutex.Lock()
+	defer fg.mutex.Unlock()
+	obj, ok := fg.objects[name]
+	return obj, ok
+}
+
+func (fg *fakeGCS) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	bucketPath := "/storage/v1/b/" + integrationBucketName
+	uploadPath := "/upload/storage/v1/b/" + integrationBucketName + "/o"
+	objectPrefix := "/" + integrationBucketName + "/"
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == bucketPath:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"kind": "storage#bucket", "name": integrationBucketName})
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, bucketPath+"/o/"):
+		name := strings.TrimPrefix(r.URL.Path, bucketPath+"/o/")
+		obj, ok := fg.object(name)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(gcsObjectAttrs(name, obj))
+	case r.Method == http.MethodPost && r.URL.Path == uploadPath:
+		fg.upload(w, r)
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, objectPrefix):
+		obj, ok := fg.object(strings.TrimPrefix(r.URL.Path, objectPrefix))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(obj)))
+		w.Write(obj)
+	default:
+		http.Error(w, "unsupported fake gcs request: "+r.Method+" "+r.URL.Path, http.StatusNotImplemented)
+	}
+}
+
+func (fg *fakeGCS) upload(w http.ResponseWriter, r *http.Request) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// a multipart upload holds the object metadata in the first part, and the
+	// object data in the second
+	rdr := multipart.NewReader(r.Body, params["boundary"])
+	metaPart, err := rdr.NextPart()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	meta := struct {
+		Name string `json:"name"`
+	}{}
+	if err = json.NewDecoder(metaPart).Decode(&meta); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if meta.Name == "" {
+		meta.Name = r.URL.Query().Get("name")
+	}
+	dataPart, err := rdr.NextPart()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, err := ioutil.ReadAll(dataPart)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fg.mutex.Lock()
+	fg.objects[meta.Name] = data
+	fg.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(gcsObjectAttrs(meta.Name, data))
+}
+
+// gcsObjectAttrs returns the metadata of the object name holding data
+func gcsObjectAttrs(name string, data []byte) map[string]string {
+	return map[string]string{
+		"kind":   "storage#object",
+		"bucket": integrationBucketName,
+		"name":   name,
+		"size":   fmt.Sprintf("%d", len(data)),
+	}
+}
+
+type rewriteHostTransport struct {
+	target *url.URL
+}
+
+func (rht rewriteHostTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme = rht.target.Scheme
+	r.URL.Host = rht.target.Host
+	r.Host = rht.target.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+type recordedEmail struct {
+	From string
+	To   string
+	Subj string
+	Text string
+}
+
+// fakeMailgun records every message posted to the mailgun messages endpoint
+type fakeMailgun struct {
+	server *httptest.Server
+	mutex  sync.Mutex
+	emails []recordedEmail
+}
+
+func newFakeMailgun(t *testing.T, domain string) *fakeMailgun {
+	t.Helper()
+
+	fm := &fakeMailgun{}
+	fm.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/"+domain+"/messages" {
+			http.NotFound(w, r)
+			return
+		}
+		if _, key, ok := r.BasicAuth(); !ok || key == "" {
+			http.Error(w, "missing api key", http.StatusUnauthorized)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fm.mutex.Lock()
+		fm.emails = append(fm.emails, recordedEmail{
+			From: r.PostForm.Get("from"),
+			To:   r.PostForm.Get("to"),
+			Subj: r.PostForm.Get("subject"),
+			Text: r.PostForm.Get("text"),
+		})
+		fm.mutex.Unlock()
+		w.Write([]byte(`{"message": "Queued. Thank you."}`))
+	}))
+
+	return fm
+}
+
+func (fm *fakeMailgun) sent() []recordedEmail {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	return append([]recordedEmail(nil), fm.emails...)
+}
+
+// fcmMessage is the part of a message to the legacy FCM send endpoint the
+// tests look at
+type fcmMessage struct {
+	To       string `json:"to"`
+	Priority string `json:"priority"`
+}
+
+// fakeFCM records the messages sent to the legacy FCM send endpoint
+type fakeFCM struct {
+	server   *httptest.Server
+	mutex    sync.Mutex
+	messages []fcmMessage
+}
+
+func newFakeFCM(t *testing.T) *fakeFCM {
+	t.Helper()
+
+	ff := &fakeFCM{}
+	ff.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg := fcmMessage{}
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ff.mutex.Lock()
+		ff.messages = append(ff.messages, msg)
+		ff.mutex.Unlock()
+
+		sendSuccess(w, map[string]interface{}{
+			"success": 1,
+			"results": []map[string]string{{"message_id": base62.Rand(8)}},
+		})
+	}))
+
+	return ff
+}
+
+func (ff *fakeFCM) sent() []fcmMessage {
+	ff.mutex.Lock()
+	defer ff.mutex.Unlock()
+	return append([]fcmMessage(nil), ff.messages...)
+}
+
+type recordedPush struct {
+	UserID  int64
+	Payload interface{}
+	Opts    push.Options
+}
+
+// recordingPusher is a pusher that remembers everything it was asked to push
+type recordingPusher struct {
+	mutex  sync.Mutex
+	pushes []recordedPush
+}
+
+func (rp *recordingPusher) push(ctx context.Context, db model.Provider, userID int64, payload interface{}, opts push.Options) {
+	rp.mutex.Lock()
+	defer rp.mutex.Unlock()
+	rp.pushes = append(rp.pushes, recordedPush{UserID: userID, Payload: payload, Opts: opts})
+}
+
+func (rp *recordingPusher) recorded() []recordedPush {
+	rp.mutex.Lock()
+	defer rp.mutex.Unlock()
+	return append([]recordedPush(nil), rp.pushes...)
+}
+
+// integrationEnv is a running oscar server wired up to the fake services
+type integrationEnv struct {
+	server    *httptest.Server
+	providers *serverProviders
+	gcs       *fakeGCS
+	mailgun   *fakeMailgun
+	fcm       *fakeFCM
+	pusher    *recordingPusher
+}
+
+func newIntegrationEnv(t *testing.T) *integrationEnv {
+	t.Helper()
+
+	const emailDomain = "mg.oscar.test"
+	env := &integrationEnv{
+		gcs:     newFakeGCS(t),
+		mailgun: newFakeMailgun(t, emailDomain),
+		fcm:     newFakeFCM(t),
+		pusher:  &recordingPusher{},
+	}
+
+	fs, err := gcs.NewWithHTTPClient(env.gcs.client(), integrationBucketName)
+	require.NoError(t, err)
+
+	symKey := make([]byte, sodium.SymmetricKeySize)
+	require.NoError(t, sodium.Random(symKey))
+	keys, err := newKeyRing(symKey)
+	require.NoError(t, err)
+	keyPair, err := sodium.NewKeyPair()
+	require.NoError(t, err)
+
+	fcm, err := newTokenPusher(push.NewFCMWithEndpoint("fake-fcm-server-key", env.fcm.server.URL, false), nil)
+	require.NoError(t, err)
+
+	env.providers = &serverProviders{
+		db:      sqlite.NewMockDB(t),
+		emailer: mailgun.NewWithBaseURL("fake-mailgun-key", emailDomain, env.mailgun.server.URL),
+		fs:      fs,
+		kvs:     memkv.New(),
+		pushers: []pusher{env.pusher, fcm},
+		keys:    keys,
+		keyPair: keyPair,
+
+		loginLockouts: newLoginLockouts(),
+	}
+	env.server = httptest.NewServer(newOscarRouter(env.providers))
+
+	return env
+}
+
+func (env *integrationEnv) close() {
+	env.server.Close()
+	env.gcs.server.Close()
+	env.mailgun.server.Close()
+	env.fcm.server.Close()
+}
+
+// do performs an api request, and decodes the JSON response into respBody
+// if it's not nil
+func (env *integrationEnv) do(t *testing.T, method, path, accessToken string, body io.Reader, respBody interface{}) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(method, env.server.URL+path, body)
+	require.NoError(t, err)
+	if accessToken != "" {
+		req.Header.Set("X-Oscar-Access-Token", accessToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode, "%s %s: %s", method, path, buf)
+	if respBody != nil {
+		require.NoError(t, json.Unmarshal(buf, respBody), "%s %s: %s", method, path, buf)
+	}
+
+	return resp
+}
+
+func (env *integrationEnv) doJSON(t *testing.T, method, path, accessToken string, body, respBody interface{}) {
+	t.Helper()
+
+	buf, err := json.Marshal(body)
+	require.NoError(t, err)
+	env.do(t, method, path, accessToken, bytes.NewReader(buf), respBody)
+}
+
+type integrationUser struct {
+	User
+	keyPair     sodium.KeyPair
+	accessToken string
+}
+
+// signUp creates a new user via the api, then logs them in using the
+// challenge-response flow
+func (env *integrationEnv) signUp(t *testing.T, email string) integrationUser {
+	t.Helper()
+
+	keyPair, err := sodium.NewKeyPair()
+	require.NoError(t, err)
+	salt := make([]byte, sodium.PasswordStretchingSaltSize)
+	require.NoError(t, sodium.Random(salt))
+
+	iu := integrationUser{keyPair: keyPair}
+	iu.User = User{
+		Username:                    strings.ToLower(base62.Rand(10)),
+		Email:                       email,
+		PasswordSalt:                salt,
+		PasswordHashAlgorithm:       sodium.Argon2id13.Name,
+		PasswordHashOperationsLimit: sodium.Argon2id13.OpsLimitInteractive,
+		PasswordHashMemoryLimit:     sodium.Argon2id13.MemLimitInteractive,
+		PublicKey:                   keyPair.Public,
+		WrappedSecretKey:            []byte("wrapped-secret-key"),
+		WrappedSecretKeyNonce:       []byte("wrapped-secret-key-nonce"),
+		WrappedSymmetricKey:         []byte("wrapped-symmetric-key"),
+		WrappedSymmetricKeyNonce:    []byte("wrapped-symmetric-key-nonce"),
+	}
+	created := struct {
+		ID encodable.Bytes `json:"id"`
+	}{}
+	env.doJSON(t, http.MethodPost, "/1/users", "", iu.User, &created)
+	iu.PublicID = created.ID
+
+	challenge := struct {
+		Challenge    encodable.Bytes `json:"challenge"`
+		CreationDate encodable.Bytes `json:"creation_date"`
+	}{}
+	env.do(t, http.MethodPost, "/1/sessions/"+iu.Username+"/challenge", "", nil, &challenge)
+
+	serverPubKey := struct {
+		Key encodable.Bytes `json:"public_key"`
+	}{}
+	env.do(t, http.MethodGet, "/1/public-key", "", nil, &serverPubKey)
+
+	challengeCT, challengeNonce, err := sodium.PublicKeyEncrypt(challenge.Challenge, serverPubKey.Key, keyPair.Secret)
+	require.NoError(t, err)
+	cdCT, cdNonce, err := sodium.PublicKeyEncrypt(challenge.CreationDate, serverPubKey.Key, keyPair.Secret)
+	require.NoError(t, err)
+	answer := struct {
+		Challenge    encryptedData `json:"challenge"`
+		CreationDate encryptedData `json:"creation_date"`
+	}{
+		Challenge:    encryptedData{CipherText: challengeCT, Nonce: challengeNonce},
+		CreationDate: encryptedData{CipherText: cdCT, Nonce: cdNonce},
+	}
+	lr := loginResponse{}
+	env.doJSON(t, http.MethodPost, "/1/sessions/"+iu.Username+"/challenge-response", "", answer, &lr)
+	require.Equal(t, []byte(iu.PublicID), []byte(lr.ID))
+	iu.accessToken = lr.AccessToken
+
+	return iu
+}
+
+// eventually polls cond until it's true, or fails the test after a few seconds
+func eventually(t *testing.T, msg string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+var verificationTokenPattern = regexp.MustCompile(`verify-email\?t=([A-Za-z0-9]+)`)
+
+func TestIntegrationEmailVerification(t *testing.T) {
+	env := newIntegrationEnv(t)
+	defer env.close()
+
+	email := "integration-" + strings.ToLower(base62.Rand(6)) + "@oscar.test"
+	env.signUp(t, email)
+
+	var sent recordedEmail
+	eventually(t, "verification email", func() bool {
+		emails := env.mailgun.sent()
+		if len(emails) == 0 {
+			return false
+		}
+		sent = emails[0]
+		return true
+	})
+	require.Equal(t, email, sent.To)
+	require.Equal(t, notificationsEmailAddress, sent.From)
+
+	matches := verificationTokenPattern.FindStringSubmatch(sent.Text)
+	require.Len(t, matches, 2, "no verification link in: %s", sent.Text)
+	env.doJSON(t, http.MethodPost, "/1/email-verifications", "", map[string]string{"token": matches[1]}, nil)
+
+	evtr, err := env.providers.db.EmailVerificationTokenRecord(matches[1])
+	require.NoError(t, err)
+	require.Nil(t, evtr)
+}
+
+func TestIntegrationBackups(t *testing.T) {
+	env := newIntegrationEnv(t)
+	defer env.close()
+	user := env.signUp(t, "")
+
+	backup := []byte("pretend this is an encrypted database " + base62.Rand(16))
+	env.do(t, http.MethodPut, "/1/users/me/backup", user.accessToken, bytes.NewReader(backup), nil)
+
+	userID, err := env.providers.kvs.UserIDFromPublicID(user.PublicID)
+	require.NoError(t, err)
+	stored, ok := env.gcs.object(fmt.Sprintf("%s/%d.db", dbBackupsDir, userID))
+	require.True(t, ok, "backup was not written to storage")
+	require.Equal(t, backup, stored)
+
+	req, err := http.NewRequest(http.MethodGet, env.server.URL+"/1/users/me/backup", nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Oscar-Access-Token", user.accessToken)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	retrieved, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, backup, retrieved)
+}
+
+func TestIntegrationMessagePush(t *testing.T) {
+	env := newIntegrationEnv(t)
+	defer env.close()
+	sender := env.signUp(t, "")
+	recipient := env.signUp(t, "")
+
+	fcmToken := "fcm-token-" + base62.Rand(8)
+	env.doJSON(t, http.MethodPost, "/1/users/me/fcm-tokens", recipient.accessToken, map[string]string{"token": fcmToken}, nil)
+
+	msg := map[string]interface{}{
+		"cipher_text": encodable.Bytes("sealed message"),
+		"nonce":       encodable.Bytes("message nonce"),
+		"urgent":      true,
+	}
+	env.doJSON(t, http.MethodPost, "/1/users/"+hex.EncodeToString(recipient.PublicID)+"/messages", sender.accessToken, msg, nil)
+
+	recipientID, err := env.providers.kvs.UserIDFromPublicID(recipient.PublicID)
+	require.NoError(t, err)
+	eventually(t, "recorded push", func() bool {
+		return len(env.pusher.recorded()) == 1
+	})
+	recorded := env.pusher.recorded()[0]
+	require.Equal(t, recipientID, recorded.UserID)
+	require.Equal(t, push.PriorityHigh, recorded.Opts.Priority)
+
+	eventually(t, "fcm message", func() bool {
+		return len(env.fcm.sent()) == 1
+	})
+	fcmMsg := env.fcm.sent()[0]
+	require.Equal(t, fcmToken, fcmMsg.To)
+	require.Equal(t, "high", fcmMsg.Priority)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"zood.dev/oscar/model"
+)
+
+// accessTokenBatchSize is how many access tokens are read at a time
+const accessTokenBatchSize = 500
+
+// A keyCounter counts the live items it's responsible for by the id of the
+// symmetric key they're sealed under, hex encoded
+type keyCounter interface {
+	name() string
+	countKeys(now time.Time) (map[string]int, error)
+}
+
+// accessTokenCounter counts the access tokens that are still valid. They're
+// looked up rather than opened, so they keep working after their key is
+// dropped, but they reveal the key that sealed them until they expire.
+type accessTokenCounter struct {
+	db model.Provider
+}
+
+func (atc accessTokenCounter) name() string {
+	return "access tokens"
+}
+
+// countKeys fulfills keyCounter
+func (atc accessTokenCounter) countKeys(now time.Time) (map[string]int, error) {
+	counts := map[string]int{}
+	after := ""
+	for {
+		tokens, err := atc.db.AccessTokens(after, now.Unix(), accessTokenBatchSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, token := range tokens {
+			after = token
+			if sealed, err := base64.StdEncoding.DecodeString(token); err == nil {
+				counts[sealedKeyID(sealed)]++
+			}
+		}
+		if len(tokens) < accessTokenBatchSize {
+			return counts, nil
+		}
+	}
+}
+
+// keyUsage is how many of one kind of item are sealed under each key
+type keyUsage struct {
+	Name    string `json:"name"`
+	Current int    `json:"current"`
+	// Previous is keyed by the id of the previous key
+	Previous map[string]int `json:"previous"`
+	// Retired items are sealed under keys that are no longer in the ring.
+	// They can't be opened anymore.
+	Retired int `json:"retired"`
+}
+
+// symmetricKeysHandler handles GET /admin/symmetric-keys. It reports how
+// many live items are still sealed under keys other than the current one,
+// so the previous keys can be dropped from the config once none are left.
+// Delivery tokens aren't stored, so they aren't counted. They stop being
+// accepted a day after they're issued.
+func symmetricKeysHandler(w http.ResponseWriter, r *http.Request) {
+	providers := providersCtx(r.Context())
+	kr := providers.keys
+	currentID := hex.EncodeToString(kr.current.id)
+	previousIDs := make([]string, 0, len(kr.previous))
+	for _, k := range kr.previous {
+		previousIDs = append(previousIDs, hex.EncodeToString(k.id))
+	}
+
+	now := providers.now()
+	items := make([]keyUsage, 0, len(providers.keyCounters))
+	pending := 0
+	for _, kc := range providers.keyCounters {
+		counts, err := kc.countKeys(now)
+		if err != nil {
+			sendInternalErr(w, errors.Wrapf(err, "counting the keys of the %s", kc.name()))
+			return
+		}
+		usage := keyUsage{Name: kc.name(), Previous: map[string]int{}}
+		for _, id := range previousIDs {
+			usage.Previous[id] = 0
+		}
+		for id, n := range counts {
+			if id == currentID {
+				usage.Current += n
+			} else if _, ok := usage.Previous[id]; ok {
+				usage.Previous[id] += n
+				pending += n
+			} else {
+				usage.Retired += n
+			}
+		}
+		items = append(items, usage)
+	}
+
+	sendSuccess(w, struct {
+		CurrentKeyID   string     `json:"current_key_id"`
+		PreviousKeyIDs []string   `json:"previous_key_ids"`
+		Items          []keyUsage `json:"items"`
+		// Pending is the number of items still sealed under previous keys
+		Pending int `json:"pending"`
+	}{CurrentKeyID: currentID, PreviousKeyIDs: previousIDs, Items: items, Pending: pending})
+}
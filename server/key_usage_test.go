@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/model"
+	"zood.dev/oscar/sodium"
+)
+
+func TestSymmetricKeysHandler(t *testing.T) {
+	providers := createTestProviders(t)
+	providers.adminToken = "admin-token"
+	recipient, _ := createTestUser(t, providers)
+	now := time.Now()
+	oldKey := providers.keys.current.key
+	oldID := hex.EncodeToString(providers.keys.current.id)
+
+	// an access token, an outbox entry and an email sealed under the old key
+	for _, expiresAt := range []int64{now.Add(time.Hour).Unix(), now.Add(-time.Hour).Unix()} {
+		token, err := sealAccessToken(providers.keys, sessionToken{Name: recipient.Username, CreationDate: now.Unix()})
+		require.NoError(t, err)
+		require.NoError(t, providers.db.InsertAccessToken(token, recipient.ID, expiresAt, model.ClientRecord{}))
+	}
+	msg := Message{CipherText: []byte("cipher-text"), Nonce: []byte("nonce"), SealedSender: true}
+	_, _, err := storeMessage(providers, recipient.ID, &msg, false, nil, now)
+	require.NoError(t, err)
+	eq := newEmailQueue(providers.kvs, providers.keys, &flakyEmailer{})
+	require.NoError(t, eq.queue("queued", queuedEmail{To: "alice@example.com"}, now.Add(time.Hour)))
+
+	newKey := make([]byte, sodium.SymmetricKeySize)
+	sodium.Random(newKey)
+	ring, err := newKeyRing(newKey, oldKey)
+	require.NoError(t, err)
+	providers.keys = ring
+	eq.keys = ring
+	outbox := outboxResealer{db: providers.db}
+	providers.keyCounters = []keyCounter{accessTokenCounter{db: providers.db}, outbox, eq}
+	router := newOscarRouter(providers)
+
+	type report struct {
+		CurrentKeyID   string     `json:"current_key_id"`
+		PreviousKeyIDs []string   `json:"previous_key_ids"`
+		Items          []keyUsage `json:"items"`
+		Pending        int        `json:"pending"`
+	}
+	get := func() report {
+		r := httptest.NewRequest(http.MethodGet, "/admin/symmetric-keys", nil)
+		r.Header.Set("Authorization", "Bearer admin-token")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+		rep := report{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &rep))
+		return rep
+	}
+
+	rep := get()
+	require.Equal(t, hex.EncodeToString(ring.current.id), rep.CurrentKeyID)
+	require.Equal(t, []string{oldID}, rep.PreviousKeyIDs)
+	require.Equal(t, 3, rep.Pending)
+	require.Len(t, rep.Items, 3)
+	// the expired access token isn't counted
+	require.Equal(t, keyUsage{Name: "access tokens", Previous: map[string]int{oldID: 1}}, rep.Items[0])
+
+	_, err = outbox.resealAll(ring)
+	require.NoError(t, err)
+	_, err = eq.resealAll(ring)
+	require.NoError(t, err)
+	rep = get()
+	require.Equal(t, 1, rep.Pending)
+	require.Equal(t, keyUsage{Name: "outbox entries", Current: 1, Previous: map[string]int{oldID: 0}}, rep.Items[1])
+
+	// once the old key is dropped, what's left under it is retired
+	providers.keys, err = newKeyRing(newKey)
+	require.NoError(t, err)
+	rep = get()
+	require.Empty(t, rep.PreviousKeyIDs)
+	require.Zero(t, rep.Pending)
+	require.Equal(t, keyUsage{Name: "access tokens", Previous: map[string]int{}, Retired: 1}, rep.Items[0])
+}
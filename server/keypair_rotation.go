@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"zood.dev/oscar/sodium"
+
+	"github.com/pkg/errors"
+)
+
+// rotateKeyPairCommand implements 'oscar rotate-keypair'. It generates a new
+// current key pair in the config file, and keeps the old one as a previous
+// key pair, so clients still holding its public key can log in. With
+// -retire, it instead removes a previous key pair, once clients have had
+// time to fetch the new public key. The server picks up the change when
+// it's restarted.
+func rotateKeyPairCommand(args []string) error {
+	flags := flag.NewFlagSet("rotate-keypair", flag.ExitOnError)
+	configPath := flags.String("config", "oscar.json", "Path of the config file to update")
+	retire := flags.String("retire", "", "Key id of a previous key pair to remove, instead of rotating")
+	flags.Parse(args)
+
+	buf, err := ioutil.ReadFile(*configPath)
+	if err != nil {
+		return errors.Wrap(err, "unable to read config file")
+	}
+	buf, msg, err := rotateKeyPairs(buf, *retire)
+	if err != nil {
+		return err
+	}
+	// the config holds our secret keys, so keep it private
+	if err = ioutil.WriteFile(*configPath, buf, 0600); err != nil {
+		return errors.Wrap(err, "failed to write config file")
+	}
+
+	fmt.Println(msg)
+	fmt.Println("Restart the server to apply the change.")
+	return nil
+}
+
+// rotateKeyPairs rotates the key pairs in the config file conf, or retires
+// the previous one with the key id retire, and returns the updated config
+// with a message describing the change. The rest of the config is kept as
+// it was, other than the order of the top level settings.
+func rotateKeyPairs(conf []byte, retire string) ([]byte, string, error) {
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(conf, &raw); err != nil {
+		return nil, "", errors.Wrap(err, "unable to parse config file")
+	}
+	var current asymmetricKeyConfig
+	if err := json.Unmarshal(raw["asymmetric_keys"], &current); err != nil {
+		return nil, "", errors.Wrap(err, "unable to parse 'asymmetric_keys'")
+	}
+	if err := current.decode("asym"); err != nil {
+		return nil, "", err
+	}
+	var previous []asymmetricKeyConfig
+	if prev, ok := raw["previous_asymmetric_keys"]; ok {
+		if err := json.Unmarshal(prev, &previous); err != nil {
+			return nil, "", errors.Wrap(err, "unable to parse 'previous_asymmetric_keys'")
+		}
+	}
+
+	var msg string
+	if retire != "" {
+		if retire == serverKeyID(current.Public) {
+			return nil, "", errors.Errorf("%s is the current key pair. Rotate it before retiring it.", retire)
+		}
+		kept := make([]asymmetricKeyConfig, 0, len(previous))
+		for i, prev := range previous {
+			if err := prev.decode(fmt.Sprintf("previous asym key %d", i)); err != nil {
+				return nil, "", err
+			}
+			if serverKeyID(prev.Public) != retire {
+				kept = append(kept, prev)
+			}
+		}
+		if len(kept) == len(previous) {
+			return nil, "", errors.Errorf("there's no previous key pair with the id %s", retire)
+		}
+		previous = kept
+		msg = fmt.Sprintf("Retired the key pair %s. Data addressed to it is no longer accepted.", retire)
+	} else {
+		kp, err := sodium.NewKeyPair()
+		if err != nil {
+			return nil, "", errors.Wrap(err, "failed to generate key pair")
+		}
+		previous = append([]asymmetricKeyConfig{current}, previous...)
+		msg = fmt.Sprintf("Rotated the key pair %s out for %s. Retire %s with -retire once clients have fetched the new public key.",
+			serverKeyID(current.Public), serverKeyID(kp.Public), serverKeyID(current.Public))
+		current = asymmetricKeyConfig{PublicHex: hex.EncodeToString(kp.Public), SecretHex: hex.EncodeToString(kp.Secret)}
+	}
+
+	var err error
+	if raw["asymmetric_keys"], err = json.Marshal(current); err != nil {
+		return nil, "", err
+	}
+	if len(previous) == 0 {
+		delete(raw, "previous_asymmetric_keys")
+	} else if raw["previous_asymmetric_keys"], err = json.Marshal(previous); err != nil {
+		return nil, "", err
+	}
+	buf, err := json.MarshalIndent(raw, "", "    ")
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to encode config")
+	}
+	return append(buf, '\n'), msg, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotateKeyPairCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oscar-rotate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	confPath := filepath.Join(dir, "oscar.json")
+	require.NoError(t, initCommand([]string{"--config", confPath, "--data-dir", filepath.Join(dir, "data")}))
+	original, err := loadConfig(confPath, false)
+	require.NoError(t, err)
+	firstID := serverKeyID(original.AsymmetricKeys.Public)
+
+	// rotating twice keeps both old key pairs, newest first
+	require.NoError(t, rotateKeyPairCommand([]string{"--config", confPath}))
+	require.NoError(t, rotateKeyPairCommand([]string{"--config", confPath}))
+	cfg, err := loadConfig(confPath, false)
+	require.NoError(t, err)
+	require.Len(t, cfg.PreviousAsymmetricKeys, 2)
+	require.Equal(t, firstID, serverKeyID(cfg.PreviousAsymmetricKeys[1].Public))
+	require.Equal(t, original.SymmetricKeyHex, cfg.SymmetricKeyHex)
+	require.Equal(t, original.SQLDBDirectory, cfg.SQLDBDirectory)
+	secondID := serverKeyID(cfg.PreviousAsymmetricKeys[0].Public)
+
+	require.Error(t, rotateKeyPairCommand([]string{"--config", confPath, "--retire", serverKeyID(cfg.AsymmetricKeys.Public)}))
+	require.Error(t, rotateKeyPairCommand([]string{"--config", confPath, "--retire", "00000000"}))
+	require.NoError(t, rotateKeyPairCommand([]string{"--config", confPath, "--retire", firstID}))
+	cfg, err = loadConfig(confPath, false)
+	require.NoError(t, err)
+	require.Len(t, cfg.PreviousAsymmetricKeys, 1)
+	require.Equal(t, secondID, serverKeyID(cfg.PreviousAsymmetricKeys[0].Public))
+
+	require.NoError(t, rotateKeyPairCommand([]string{"--config", confPath, "--retire", secondID}))
+	buf, err := ioutil.ReadFile(confPath)
+	require.NoError(t, err)
+	require.NotContains(t, string(buf), "previous_asymmetric_keys")
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"zood.dev/oscar/sodium"
+
+	"github.com/pkg/errors"
+)
+
+const keyIDSize = 4
+
+// errUnknownKey is returned by reseal for data that none of the keys in the
+// ring opens. Resealing can't move it to the current key, nor is it needed to.
+var errUnknownKey = errors.New("unable to open sealed data with any key in the ring")
+
+// keyRing holds the server's symmetric keys. New data is always sealed under
+// the current key, while data sealed under one of the previous keys can still
+// be opened. Sealed data is prefixed with the id of the key that sealed it.
+type keyRing struct {
+	current  symmetricKey
+	previous []symmetricKey
+}
+
+type symmetricKey struct {
+	id  []byte
+	key []byte
+}
+
+func newSymmetricKey(key []byte) (symmetricKey, error) {
+	if len(key) != sodium.SymmetricKeySize {
+		return symmetricKey{}, errors.Errorf("invalid sym key size (%d); should be %d bytes", len(key), sodium.SymmetricKeySize)
+	}
+	hash := sha256.Sum256(key)
+	return symmetricKey{id: hash[:keyIDSize], key: key}, nil
+}
+
+func newKeyRing(current []byte, previous ...[]byte) (*keyRing, error) {
+	curr, err := newSymmetricKey(current)
+	if err != nil {
+		return nil, err
+	}
+	kr := &keyRing{current: curr}
+	for _, p := range previous {
+		k, err := newSymmetricKey(p)
+		if err != nil {
+			return nil, err
+		}
+		kr.previous = append(kr.previous, k)
+	}
+
+	return kr, nil
+}
+
+func (kr *keyRing) seal(msg []byte) ([]byte, error) {
+	ct, nonce, err := sodium.SymmetricKeyEncrypt(msg, kr.current.key)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := make([]byte, 0, keyIDSize+len(nonce)+len(ct))
+	sealed = append(sealed, kr.current.id...)
+	sealed = append(sealed, nonce...)
+	return append(sealed, ct...), nil
+}
+
+func (kr *keyRing) open(sealed []byte) ([]byte, bool) {
+	if len(sealed) < keyIDSize+sodium.SymmetricNonceSize {
+		return nil, false
+	}
+	id := sealed[:keyIDSize]
+	nonce := sealed[keyIDSize : keyIDSize+sodium.SymmetricNonceSize]
+	ct := sealed[keyIDSize+sodium.SymmetricNonceSize:]
+
+	for _, k := range append([]symmetricKey{kr.current}, kr.previous...) {
+		if bytes.Equal(k.id, id) {
+			return sodium.SymmetricKeyDecrypt(ct, nonce, k.key)
+		}
+	}
+
+	return nil, false
+}
+
+// sealedKeyID returns the id of the key sealed was sealed under, hex
+// encoded, or an empty string if it's too short to have one
+func sealedKeyID(sealed []byte) string {
+	if len(sealed) < keyIDSize {
+		return ""
+	}
+	return hex.EncodeToString(sealed[:keyIDSize])
+}
+
+// reseal re-encrypts sealed under the current key. The second return value
+// is false when sealed was already under the current key, and nothing changed.
+func (kr *keyRing) reseal(sealed []byte) ([]byte, bool, error) {
+	if len(sealed) >= keyIDSize && bytes.Equal(sealed[:keyIDSize], kr.current.id) {
+		return sealed, false, nil
+	}
+
+	msg, ok := kr.open(sealed)
+	if !ok {
+		return nil, false, errUnknownKey
+	}
+	resealed, err := kr.seal(msg)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return resealed, true, nil
+}
+
+// A resealer re-encrypts the items it is responsible for under the current
+// key of the ring, and returns the number of items that were changed.
+type resealer interface {
+	name() string
+	resealAll(kr *keyRing) (int, error)
+}
+
+// runResealJob periodically asks every resealer to move its items to the
+// current key. Once a full pass changes nothing and fails nowhere, the
+// previous keys are no longer needed to read stored data, and can be dropped
+// from the config. That completes the rotation, which is emitted on events.
+func runResealJob(kr *keyRing, resealers []resealer, events *eventBus, interval time.Duration) {
+	for {
+		total := 0
+		failed := false
+		for _, r := range resealers {
+			n, err := r.resealAll(kr)
+			total += n
+			if err != nil {
+				logErr(errors.Wrapf(err, "resealing %s", r.name()))
+				failed = true
+			}
+		}
+		if total == 0 && !failed {
+			log.Printf("All stored items are sealed under the current symmetric key")
+			events.emit(accountEvent{
+				Kind:    eventSymmetricKeyRotated,
+				Actor:   actorServer,
+				Details: "all stored items are sealed under the current key",
+			})
+			return
+		}
+		if shouldLogInfo() {
+			log.Printf("Resealed %d items under the current symmetric key", total)
+		}
+
+		time.Sleep(interval)
+	}
+}
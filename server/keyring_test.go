@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/sodium"
+)
+
+func TestKeyRingRotation(t *testing.T) {
+	oldKey := make([]byte, sodium.SymmetricKeySize)
+	newKey := make([]byte, sodium.SymmetricKeySize)
+	sodium.Random(oldKey)
+	sodium.Random(newKey)
+
+	oldRing, err := newKeyRing(oldKey)
+	require.NoError(t, err)
+	msg := []byte("sealed before the rotation")
+	sealed, err := oldRing.seal(msg)
+	require.NoError(t, err)
+
+	// after rotating, the old data can still be opened
+	ring, err := newKeyRing(newKey, oldKey)
+	require.NoError(t, err)
+	opened, ok := ring.open(sealed)
+	require.True(t, ok)
+	require.Equal(t, msg, opened)
+
+	// resealing moves it to the new key, after which the old key isn't needed
+	resealed, changed, err := ring.reseal(sealed)
+	require.NoError(t, err)
+	require.True(t, changed)
+	_, changed, err = ring.reseal(resealed)
+	require.NoError(t, err)
+	require.False(t, changed)
+
+	newRing, err := newKeyRing(newKey)
+	require.NoError(t, err)
+	opened, ok = newRing.open(resealed)
+	require.True(t, ok)
+	require.Equal(t, msg, opened)
+	_, ok = newRing.open(sealed)
+	require.False(t, ok)
+
+	_, err = newKeyRing(newKey, []byte("too short"))
+	require.Error(t, err)
+}
+
+func TestResealers(t *testing.T) {
+	providers := createTestProviders(t)
+	recipient, _ := createTestUser(t, providers)
+	now := time.Now()
+	msg := Message{CipherText: []byte("cipher-text"), Nonce: []byte("nonce"), SealedSender: true}
+	_, _, err := storeMessage(providers, recipient.ID, &msg, false, nil, now)
+	require.NoError(t, err)
+	eq := newEmailQueue(providers.kvs, providers.keys, &flakyEmailer{})
+	require.NoError(t, eq.queue("queued", queuedEmail{To: "alice@example.com"}, now.Add(time.Hour)))
+	dead, err := eq.seal(queuedEmail{To: "bob@example.com"})
+	require.NoError(t, err)
+	require.NoError(t, providers.kvs.DequeueEmail("dead", dead))
+
+	newKey := make([]byte, sodium.SymmetricKeySize)
+	sodium.Random(newKey)
+	ring, err := newKeyRing(newKey, providers.keys.current.key)
+	require.NoError(t, err)
+	eq.keys = ring
+	outbox := outboxResealer{db: providers.db}
+	n, err := outbox.resealAll(ring)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	n, err = eq.resealAll(ring)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	// a second pass has nothing left to do
+	n, err = outbox.resealAll(ring)
+	require.NoError(t, err)
+	require.Zero(t, n)
+	n, err = eq.resealAll(ring)
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	// and the old key is no longer needed
+	newRing, err := newKeyRing(newKey)
+	require.NoError(t, err)
+	entries, err := providers.db.OutboxEntries(0, outboxBatchSize)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	opened, _, err := openOutboxEntry(newRing, entries[0])
+	require.NoError(t, err)
+	require.Equal(t, msg.CipherText, opened.CipherText)
+	queued, err := providers.kvs.DueEmails(now.Add(time.Hour).Unix(), 10)
+	require.NoError(t, err)
+	email, err := openQueuedEmail(newRing, queued["queued"])
+	require.NoError(t, err)
+	require.Equal(t, "alice@example.com", email.To)
+	letters, err := providers.kvs.DeadLetters()
+	require.NoError(t, err)
+	email, err = openQueuedEmail(newRing, letters["dead"])
+	require.NoError(t, err)
+	require.Equal(t, "bob@example.com", email.To)
+}
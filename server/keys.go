@@ -1,14 +1,53 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"net/http"
+	"time"
 
 	"zood.dev/oscar/encodable"
+	"zood.dev/oscar/sodium"
 )
 
+// serverKeyID identifies the server key pair whose public key is pub, the
+// same way keyRing identifies symmetric keys
+func serverKeyID(pub []byte) string {
+	hash := sha256.Sum256(pub)
+	return hex.EncodeToString(hash[:keyIDSize])
+}
+
+type serverPublicKey struct {
+	Key   encodable.Bytes `json:"public_key"`
+	KeyID string          `json:"key_id"`
+}
+
 func getServerPublicKeyHandler(w http.ResponseWriter, r *http.Request) {
-	pubKey := providersCtx(r.Context()).keyPair.Public
-	sendSuccess(w, struct {
-		Key encodable.Bytes `json:"public_key"`
-	}{Key: pubKey})
+	providers := providersCtx(r.Context())
+	pubKey := providers.keyPair.Public
+	// the previous keys are listed so clients can still open the system
+	// messages that were sent from them
+	previous := make([]serverPublicKey, 0, len(providers.previousKeyPairs))
+	for _, kp := range providers.previousKeyPairs {
+		previous = append(previous, serverPublicKey{Key: kp.Public, KeyID: serverKeyID(kp.Public)})
+	}
+	sendCacheable(w, r, struct {
+		serverPublicKey
+		Previous []serverPublicKey `json:"previous_keys"`
+	}{serverPublicKey: serverPublicKey{Key: pubKey, KeyID: serverKeyID(pubKey)}, Previous: previous}, time.Hour)
+}
+
+// openFromUser opens a box that the user with the public key userPub
+// addressed to the server key pair with keyID. Clients that predate key ids
+// send none, and each key pair is tried, the current one first.
+func (sp *serverProviders) openFromUser(cipherText, nonce, userPub []byte, keyID string) ([]byte, bool) {
+	for _, kp := range append([]sodium.KeyPair{sp.keyPair}, sp.previousKeyPairs...) {
+		if keyID != "" && keyID != serverKeyID(kp.Public) {
+			continue
+		}
+		if msg, ok := sodium.PublicKeyDecrypt(cipherText, nonce, userPub, kp.Secret); ok {
+			return msg, true
+		}
+	}
+	return nil, false
 }
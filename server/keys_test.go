@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/sodium"
+)
+
+func TestServerPublicKeys(t *testing.T) {
+	providers := createTestProviders(t)
+	previous, err := sodium.NewKeyPair()
+	require.NoError(t, err)
+	retired, err := sodium.NewKeyPair()
+	require.NoError(t, err)
+	providers.previousKeyPairs = []sodium.KeyPair{previous}
+	router := newOscarRouter(providers)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/1/public-key", nil))
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	resp := struct {
+		serverPublicKey
+		Previous []serverPublicKey `json:"previous_keys"`
+	}{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Equal(t, []byte(providers.keyPair.Public), []byte(resp.Key))
+	require.Equal(t, serverKeyID(providers.keyPair.Public), resp.KeyID)
+	require.Len(t, resp.KeyID, 2*keyIDSize)
+	require.Len(t, resp.Previous, 1)
+	require.Equal(t, serverKeyID(previous.Public), resp.Previous[0].KeyID)
+
+	// boxes addressed to the current and previous key pairs are opened, with
+	// or without a key id, but not those addressed to retired ones
+	user, err := sodium.NewKeyPair()
+	require.NoError(t, err)
+	accepted := map[*sodium.KeyPair]bool{&providers.keyPair: true, &previous: true, &retired: false}
+	for kp, expected := range accepted {
+		ct, nonce, err := sodium.PublicKeyEncrypt([]byte("hello"), kp.Public, user.Secret)
+		require.NoError(t, err)
+		for _, keyID := range []string{"", serverKeyID(kp.Public)} {
+			msg, ok := providers.openFromUser(ct, nonce, user.Public, keyID)
+			require.Equal(t, expected, ok)
+			if ok {
+				require.Equal(t, []byte("hello"), msg)
+			}
+		}
+		_, ok := providers.openFromUser(ct, nonce, user.Public, "00000000")
+		require.False(t, ok)
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"zood.dev/oscar/kvstor"
+
+	"github.com/pkg/errors"
+)
+
+// kvMigrateProgressInterval is how many copied entries of a kind go by
+// between progress lines
+const kvMigrateProgressInterval = 1000
+
+// kvMigrateCommand implements 'oscar kv-migrate'. It copies the kv data
+// from one storage type to another, both set up by the kv section of the
+// config, then checks the copy. The server has to be stopped first: the
+// boltdb and badger files can only be opened by one process, and anything
+// written during the copy could be missed.
+func kvMigrateCommand(args []string) error {
+	flags := flag.NewFlagSet("kv-migrate", flag.ExitOnError)
+	configPath := flags.String("config", "", "Path to config file")
+	from := flags.String("from", "", "Storage type to copy from: boltdb, badger or redis")
+	to := flags.String("to", "", "Storage type to copy to: boltdb, badger or redis")
+	flags.Parse(args)
+
+	if *from == "" || *to == "" {
+		return errors.New("both --from and --to are required")
+	}
+	if *from == *to {
+		return errors.New("--from and --to must be different storage types")
+	}
+	if *from == "memory" || *to == "memory" {
+		return errors.New("the memory kv storage doesn't outlive the process, so it can't be migrated")
+	}
+	config, err := loadConfig(*configPath, false)
+	if err != nil {
+		return err
+	}
+
+	src, err := openMigrationKV(config, *from)
+	if err != nil {
+		return err
+	}
+	defer closeKV(src)
+	dst, err := openMigrationKV(config, *to)
+	if err != nil {
+		return err
+	}
+	defer closeKV(dst)
+
+	return migrateKV(src, dst, os.Stdout)
+}
+
+// openMigrationKV opens the kv storage of type typ, with the settings of
+// the config's kv section
+func openMigrationKV(config *serverConfig, typ string) (kvstor.Provider, error) {
+	kvc := config.KV
+	kvc.Type = typ
+	if err := kvc.validate(); err != nil {
+		return nil, err
+	}
+	kvs, err := newKVStorage(kvc, config.KVDBDirectory)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening the %s kv storage", typ)
+	}
+	return kvs, nil
+}
+
+func closeKV(kvs kvstor.Provider) {
+	if c, ok := kvs.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			logErr(errors.Wrap(err, "closing the kv storage"))
+		}
+	}
+}
+
+// migrateKV copies everything in src to dst, reporting its progress to
+// out, then checks that dst holds the same data. dst should start empty:
+// its content index counts references to hashes, which would be off if a
+// name was already linked.
+func migrateKV(src, dst kvstor.Provider, out io.Writer) error {
+	lister, ok := src.(kvstor.Lister)
+	if !ok {
+		return errors.New("the source kv storage can't be listed")
+	}
+	if err := copyKV(src, lister, dst, out); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, "Verifying the copy")
+	mismatches, err := verifyKV(src, lister, dst, out)
+	if err != nil {
+		return errors.Wrap(err, "verifying the copy")
+	}
+	if mismatches > 0 {
+		return errors.Errorf("the copy differs from the source in %d places", mismatches)
+	}
+	fmt.Fprintln(out, "The copy matches the source")
+	return nil
+}
+
+// migrateProgress counts the entries of a kind as they're copied
+type migrateProgress struct {
+	out    io.Writer
+	kind   string
+	copied int
+}
+
+func (p *migrateProgress) add() {
+	p.copied++
+	if p.copied%kvMigrateProgressInterval == 0 {
+		fmt.Fprintf(p.out, "Copied %d %s...\n", p.copied, p.kind)
+	}
+}
+
+func (p *migrateProgress) done() {
+	fmt.Fprintf(p.out, "Copied %d %s\n", p.copied, p.kind)
+}
+
+func copyKV(src kvstor.Provider, lister kvstor.Lister, dst kvstor.Provider, out io.Writer) error {
+	progress := &migrateProgress{out: out, kind: "packages"}
+	err := lister.ListPackages(func(boxID, pkg []byte, expires int64) error {
+		progress.add()
+		return dst.DropPackage(pkg, boxID, expires)
+	})
+	if err != nil {
+		return errors.Wrap(err, "copying the packages")
+	}
+	progress.done()
+
+	progress = &migrateProgress{out: out, kind: "user ids"}
+	err = lister.ListIDs(func(userID int64, pubID []byte) error {
+		progress.add()
+		return dst.InsertIds(userID, pubID)
+	})
+	if err != nil {
+		return errors.Wrap(err, "copying the user ids")
+	}
+	progress.done()
+
+	// the names are collected first, since the listing functions can't
+	// use the provider they list
+	names, err := contentNames(src)
+	if err != nil {
+		return errors.Wrap(err, "listing the content index")
+	}
+	progress = &migrateProgress{out: out, kind: "content names"}
+	for _, name := range names {
+		hash, err := src.ContentHash(name)
+		if err != nil {
+			return errors.Wrapf(err, "reading the content hash of %s", name)
+		}
+		if hash == nil {
+			continue
+		}
+		if _, _, err = dst.LinkContent(name, hash); err != nil {
+			return errors.Wrapf(err, "copying the content hash of %s", name)
+		}
+		progress.add()
+	}
+	progress.done()
+
+	captures, err := debugCaptures(lister)
+	if err != nil {
+		return errors.Wrap(err, "listing the debug captures")
+	}
+	progress = &migrateProgress{out: out, kind: "debug captures"}
+	for userID, until := range captures {
+		records, err := src.DebugCapture(userID)
+		if err != nil {
+			return errors.Wrapf(err, "reading the debug capture of user %d", userID)
+		}
+		if err = dst.StartDebugCapture(userID, until); err != nil {
+			return errors.Wrapf(err, "copying the debug capture of user %d", userID)
+		}
+		for _, record := range records {
+			if err = dst.AppendDebugCapture(userID, record, len(records)); err != nil {
+				return errors.Wrapf(err, "copying the debug capture of user %d", userID)
+			}
+		}
+		progress.add()
+	}
+	progress.done()
+
+	aliases, err := boxAliases(lister)
+	if err != nil {
+		return errors.Wrap(err, "listing the box aliases")
+	}
+	progress = &migrateProgress{out: out, kind: "box aliases"}
+	for i, a := range aliases {
+		// adding an alias sets the expiry of the one added before it
+		var graceUntil int64
+		if i > 0 && bytes.Equal(aliases[i-1].boxID, a.boxID) {
+			graceUntil = aliases[i-1].expires
+		}
+		if err = dst.AddBoxAlias(a.boxID, a.alias, a.ownerID, graceUntil); err != nil {
+			return errors.Wrapf(err, "copying the alias %x", a.alias)
+		}
+		progress.add()
+	}
+	progress.done()
+
+	notice, err := src.Incident()
+	if err != nil {
+		return errors.Wrap(err, "reading the incident notice")
+	}
+	if notice != nil {
+		if err = dst.SetIncident(notice); err != nil {
+			return errors.Wrap(err, "copying the incident notice")
+		}
+		fmt.Fprintln(out, "Copied the incident notice")
+	}
+	return nil
+}
+
+func contentNames(kvs kvstor.Provider) ([]string, error) {
+	var names []string
+	err := kvs.ContentNames("", func(name string) error {
+		names = append(names, name)
+		return nil
+	})
+	return names, err
+}
+
+func debugCaptures(lister kvstor.Lister) (map[int64]int64, error) {
+	captures := map[int64]int64{}
+	err := lister.ListDebugCaptures(func(userID int64, until int64) error {
+		captures[userID] = until
+		return nil
+	})
+	return captures, err
+}
+
+// listedAlias is a box alias, as listed by a kvstor.Lister
+type listedAlias struct {
+	alias, boxID []byte
+	ownerID      int64
+	expires      int64
+}
+
+// boxAliases lists the aliases of lister in the order they have to be added
+// to another provider to get the same expiries: by box, the aliases that
+// expire first first, and the current alias of each box last.
+func boxAliases(lister kvstor.Lister) ([]listedAlias, error) {
+	var aliases []listedAlias
+	err := lister.ListBoxAliases(func(alias, boxID []byte, ownerID int64, expires int64) error {
+		aliases = append(aliases, listedAlias{alias: alias, boxID: boxID, ownerID: ownerID, expires: expires})
+		return nil
+	})
+	sort.Slice(aliases, func(i, j int) bool {
+		a, b := aliases[i], aliases[j]
+		if c := bytes.Compare(a.boxID, b.boxID); c != 0 {
+			return c < 0
+		}
+		if (a.expires == 0) != (b.expires == 0) {
+			return b.expires == 0
+		}
+		return a.expires < b.expires
+	})
+	return aliases, err
+}
+
+// verifyKV lists src again, and reports every entry dst doesn't hold the
+// same way. It returns how many it found.
+func verifyKV(src kvstor.Provider, lister kvstor.Lister, dst kvstor.Provider, out io.Writer) (int, error) {
+	mismatches := 0
+	mismatch := func(format string, args ...interface{}) {
+		mismatches++
+		fmt.Fprintf(out, "Mismatch: "+format+"\n", args...)
+	}
+
+	err := lister.ListPackages(func(boxID, pkg []byte, expires int64) error {
+		copied, err := dst.PickUpPackage(boxID)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(copied, pkg) {
+			mismatch("package in box %x", boxID)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	err = lister.ListIDs(func(userID int64, pubID []byte) error {
+		copied, err := dst.PublicIDFromUserID(userID)
+		if err != nil {
+			return err
+		}
+		copiedUserID, err := dst.UserIDFromPublicID(pubID)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(copied, pubID) || copiedUserID != userID {
+			mismatch("ids of user %d", userID)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	names, err := contentNames(src)
+	if err != nil {
+		return 0, err
+	}
+	for _, name := range names {
+		hash, err := src.ContentHash(name)
+		if err != nil {
+			return 0, err
+		}
+		copied, err := dst.ContentHash(name)
+		if err != nil {
+			return 0, err
+		}
+		if !bytes.Equal(copied, hash) {
+			mismatch("content hash of %s", name)
+		}
+	}
+
+	captures, err := debugCaptures(lister)
+	if err != nil {
+		return 0, err
+	}
+	for userID, until := range captures {
+		copiedUntil, err := dst.DebugCaptureUntil(userID)
+		if err != nil {
+			return 0, err
+		}
+		records, err := src.DebugCapture(userID)
+		if err != nil {
+			return 0, err
+		}
+		copied, err := dst.DebugCapture(userID)
+		if err != nil {
+			return 0, err
+		}
+		if copiedUntil != until || !equalRecords(copied, records) {
+			mismatch("debug capture of user %d", userID)
+		}
+	}
+
+	err = lister.ListBoxAliases(func(alias, boxID []byte, ownerID int64, expires int64) error {
+		copied, err := dst.BoxOfAlias(alias)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(copied, boxID) {
+			mismatch("box alias %x", alias)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	notice, err := src.Incident()
+	if err != nil {
+		return 0, err
+	}
+	copied, err := dst.Incident()
+	if err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(copied, notice) {
+		mismatch("incident notice")
+	}
+	return mismatches, nil
+}
+
+func equalRecords(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/boltdb"
+	"zood.dev/oscar/kvstor"
+	"zood.dev/oscar/memkv"
+)
+
+func TestMigrateKV(t *testing.T) {
+	src := boltdb.Temp(t)
+	defer src.Close()
+	expires := time.Now().Add(time.Hour).Unix()
+	require.NoError(t, src.DropPackage([]byte("package"), []byte("box"), expires))
+	require.NoError(t, src.DropPackage([]byte("expired"), []byte("old box"), time.Now().Add(-time.Hour).Unix()))
+	require.NoError(t, src.InsertIds(300, []byte("public id")))
+	_, _, err := src.LinkContent("backups/1", []byte("hash"))
+	require.NoError(t, err)
+	_, _, err = src.LinkContent("backups/2", []byte("hash"))
+	require.NoError(t, err)
+	require.NoError(t, src.StartDebugCapture(7, expires))
+	require.NoError(t, src.AppendDebugCapture(7, []byte("record 1"), 5))
+	require.NoError(t, src.AppendDebugCapture(7, []byte("record 2"), 5))
+	require.NoError(t, src.SetIncident([]byte("delays")))
+	require.NoError(t, src.AddBoxAlias([]byte("box"), []byte("old alias"), 7, expires))
+	require.NoError(t, src.AddBoxAlias([]byte("box"), []byte("alias"), 7, expires))
+
+	dst := memkv.New()
+	out := &bytes.Buffer{}
+	require.NoError(t, migrateKV(src, dst, out))
+	require.Contains(t, out.String(), "Copied 1 packages")
+	require.Contains(t, out.String(), "Copied 2 content names")
+	require.Contains(t, out.String(), "Copied 2 box aliases")
+	require.Contains(t, out.String(), "The copy matches the source")
+
+	pkg, err := dst.PickUpPackage([]byte("box"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("package"), pkg)
+	pkg, err = dst.PickUpPackage([]byte("old box"))
+	require.NoError(t, err)
+	require.Nil(t, pkg)
+	userID, err := dst.UserIDFromPublicID([]byte("public id"))
+	require.NoError(t, err)
+	require.Equal(t, int64(300), userID)
+	refs, err := dst.ContentReferences([]byte("hash"))
+	require.NoError(t, err)
+	require.Equal(t, int64(2), refs)
+	records, err := dst.DebugCapture(7)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("record 1"), []byte("record 2")}, records)
+	notice, err := dst.Incident()
+	require.NoError(t, err)
+	require.Equal(t, []byte("delays"), notice)
+	box, err := dst.BoxOfAlias([]byte("old alias"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("box"), box)
+	// the copy keeps the owner
+	require.Equal(t, kvstor.ErrBoxOwner, dst.AddBoxAlias([]byte("box"), []byte("new alias"), 8, expires))
+	aliases, err := boxAliases(dst.(kvstor.Lister))
+	require.NoError(t, err)
+	require.Len(t, aliases, 2)
+	require.Equal(t, []byte("old alias"), aliases[0].alias)
+	require.Equal(t, expires, aliases[0].expires)
+	require.Equal(t, []byte("alias"), aliases[1].alias)
+	require.Zero(t, aliases[1].expires)
+
+	// the source has to be listable
+	unlisted := struct{ kvstor.Provider }{memkv.New()}
+	require.Error(t, migrateKV(unlisted, memkv.New(), &bytes.Buffer{}))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// kvSnapshotHandler handles GET /admin/kv-snapshot. It sends a consistent
+// copy of the bolt file, which opens like the original, while the server
+// carries on. The copy is written to a temporary file first, so a failure
+// is reported rather than sent as a truncated file, and a compaction only
+// waits for the local copy. Big files may need a longer timeout for this
+// route in route_timeouts.
+func kvSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	kf := providersCtx(r.Context()).kvFile
+	if kf == nil {
+		sendNotFound(w, "the kv storage isn't kept in a file", errorNotFound)
+		return
+	}
+
+	f, err := ioutil.TempFile("", "oscar-kv-snapshot")
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	size, err := kf.Snapshot(f)
+	if err != nil {
+		sendInternalErr(w, errors.Wrap(err, "taking a kv snapshot"))
+		return
+	}
+	if shouldLogInfo() {
+		log.Printf("Sending a %d byte kv snapshot", size)
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="kv.db"`)
+	http.ServeContent(w, r, "kv.db", time.Time{}, f)
+}
+
+// kvSnapshotCommand implements 'oscar kv-snapshot'. It downloads a snapshot
+// of the kv storage from a running server through the admin api, so the
+// server doesn't have to stop to be backed up.
+func kvSnapshotCommand(args []string) error {
+	flags := flag.NewFlagSet("kv-snapshot", flag.ExitOnError)
+	server := flags.String("server", "http://localhost:8080", "Base url of the server")
+	token := flags.String("token", os.Getenv("OSCAR_ADMIN_TOKEN"), "Admin token of the server. Defaults to $OSCAR_ADMIN_TOKEN.")
+	out := flags.String("out", "kv-snapshot.db", "Path of the snapshot file to write")
+	flags.Parse(args)
+
+	if *token == "" {
+		return errors.New("the admin token is missing. Pass it with --token, or set OSCAR_ADMIN_TOKEN.")
+	}
+	size, err := downloadKVSnapshot(http.DefaultClient, *server, *token, *out)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Wrote a %d byte snapshot to %s\n", size, *out)
+	return nil
+}
+
+// downloadKVSnapshot saves the kv snapshot of the server at baseURL to path.
+// The download goes to a file next to path, which is renamed once it's
+// complete, so path never holds a partial snapshot.
+func downloadKVSnapshot(client *http.Client, baseURL, token, path string) (int64, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(baseURL, "/")+"/admin/kv-snapshot", nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return 0, errors.Errorf("the server answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	// the snapshot holds the drop boxes, so keep it private
+	partial := path + ".partial"
+	f, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+	size, err := io.Copy(f, resp.Body)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		os.Remove(partial)
+		return 0, errors.Wrap(err, "failed to download the snapshot")
+	}
+	return size, os.Rename(partial, path)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/boltdb"
+)
+
+func TestKVSnapshot(t *testing.T) {
+	providers := createTestProviders(t)
+	providers.adminToken = "admin-token"
+	srv := httptest.NewServer(newOscarRouter(providers))
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "oscar-kv-snapshot")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "kv.db")
+
+	// only a file kv storage can be snapshotted
+	_, err = downloadKVSnapshot(srv.Client(), srv.URL, "admin-token", path)
+	require.Error(t, err)
+
+	kvFile := boltdb.Temp(t)
+	defer kvFile.Close()
+	require.NoError(t, kvFile.DropPackage([]byte("package"), []byte("box"), 0))
+	providers.kvFile = kvFile
+
+	_, err = downloadKVSnapshot(srv.Client(), srv.URL, "wrong-token", path)
+	require.Error(t, err)
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+
+	size, err := downloadKVSnapshot(srv.Client(), srv.URL+"/", "admin-token", path)
+	require.NoError(t, err)
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, size, fi.Size())
+	_, err = os.Stat(path + ".partial")
+	require.True(t, os.IsNotExist(err))
+
+	snapshot, err := boltdb.New(path)
+	require.NoError(t, err)
+	defer snapshot.Close()
+	pkg, err := snapshot.PickUpPackage([]byte("box"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("package"), pkg)
+}
+
+func TestKVSnapshotHandlerNotFound(t *testing.T) {
+	w := httptest.NewRecorder()
+	providersInjector(createTestProviders(t), kvSnapshotHandler)(w, httptest.NewRequest(http.MethodGet, "/admin/kv-snapshot", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
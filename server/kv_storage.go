@@ -0,0 +1,275 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"zood.dev/oscar/badgerdb"
+	"zood.dev/oscar/boltdb"
+	"zood.dev/oscar/kvstor"
+	"zood.dev/oscar/memkv"
+	"zood.dev/oscar/rediskv"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultBadgerGCInterval       = 10 * time.Minute
+	defaultBoltCompactionInterval = 24 * time.Hour
+)
+
+// boltCompactMinFree is the share of the bolt file that has to be free
+// before a scheduled compaction rewrites it
+const boltCompactMinFree = 0.25
+
+// kvStorageConfig picks where drop boxes, public ids and the other kv data
+// are stored
+type kvStorageConfig struct {
+	// Type is boltdb (the default) or badger, which keep the data in
+	// kv_db_directory, redis or memory. Instances can only share their kv
+	// data through redis. The memory type loses everything on restart, so
+	// it's only for tests and local development.
+	Type string `json:"type,omitempty"`
+	// BadgerGCInterval, a duration like "10m", is how often the badger
+	// value log is garbage collected. It defaults to 10 minutes.
+	BadgerGC         time.Duration `json:"-"`
+	BadgerGCInterval string        `json:"badger_gc_interval,omitempty"`
+	// BoltCompactionInterval, a duration like "24h", is how often the
+	// boltdb file is checked, and compacted when at least a quarter of it
+	// is free. It defaults to 24 hours, and "0s" turns it off.
+	BoltCompaction         time.Duration `json:"-"`
+	BoltCompactionInterval string        `json:"bolt_compaction_interval,omitempty"`
+	// The redis type needs a single redis server, not a cluster. When
+	// RedisPassword is empty, it's read from REDIS_PASSWORD. RedisKeyPrefix
+	// starts every key, so several deployments can share a database.
+	// RedisMaxConns is the most connections open to redis at once. It
+	// defaults to 50.
+	RedisAddress   string `json:"redis_address,omitempty"`
+	RedisDB        int    `json:"redis_db,omitempty"`
+	RedisKeyPrefix string `json:"redis_key_prefix,omitempty"`
+	RedisMaxConns  int    `json:"redis_max_conns,omitempty"`
+	RedisPassword  string `json:"redis_password,omitempty"`
+	RedisTLS       bool   `json:"redis_tls,omitempty"`
+}
+
+// validate checks that the settings of the storage type are present, and
+// fills in the ones that come from the environment
+func (kvc *kvStorageConfig) validate() error {
+	switch kvc.Type {
+	case "", "boltdb":
+		kvc.Type = "boltdb"
+		kvc.BoltCompaction = defaultBoltCompactionInterval
+		if kvc.BoltCompactionInterval != "" {
+			var err error
+			kvc.BoltCompaction, err = time.ParseDuration(kvc.BoltCompactionInterval)
+			if err != nil {
+				return errors.Wrap(err, "invalid kv 'bolt_compaction_interval'")
+			}
+			if kvc.BoltCompaction < 0 {
+				return errors.New("kv 'bolt_compaction_interval' can't be negative")
+			}
+		}
+	case "memory":
+	case "badger":
+		kvc.BadgerGC = defaultBadgerGCInterval
+		if kvc.BadgerGCInterval != "" {
+			var err error
+			kvc.BadgerGC, err = time.ParseDuration(kvc.BadgerGCInterval)
+			if err != nil {
+				return errors.Wrap(err, "invalid kv 'badger_gc_interval'")
+			}
+			if kvc.BadgerGC <= 0 {
+				return errors.New("kv 'badger_gc_interval' must be positive")
+			}
+		}
+	case "redis":
+		if kvc.RedisAddress == "" {
+			return errors.New("redis kv storage needs redis_address")
+		}
+		if kvc.RedisDB < 0 {
+			return errors.New("kv storage redis_db can't be negative")
+		}
+		if kvc.RedisMaxConns < 0 {
+			return errors.New("kv storage redis_max_conns can't be negative")
+		}
+		if kvc.RedisPassword == "" {
+			kvc.RedisPassword = os.Getenv("REDIS_PASSWORD")
+		}
+	default:
+		return errors.Errorf("unknown kv storage type: '%s'", kvc.Type)
+	}
+	return nil
+}
+
+// newKVStorage creates the kvstor.Provider described by kvc. The boltdb
+// type keeps its database in dir.
+func newKVStorage(kvc kvStorageConfig, dir string) (kvstor.Provider, error) {
+	switch kvc.Type {
+	case "boltdb":
+		kvs, err := boltdb.New(filepath.Join(dir, "kv.db"))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open boltdb")
+		}
+		return kvs, nil
+	case "memory":
+		return memkv.New(), nil
+	case "badger":
+		kvs, err := badgerdb.New(filepath.Join(dir, "badger"))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open badger")
+		}
+		return kvs, nil
+	case "redis":
+		kvs, err := rediskv.New(rediskv.Config{
+			Address:   kvc.RedisAddress,
+			Password:  kvc.RedisPassword,
+			DB:        kvc.RedisDB,
+			KeyPrefix: kvc.RedisKeyPrefix,
+			TLS:       kvc.RedisTLS,
+			MaxConns:  kvc.RedisMaxConns,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to connect to redis")
+		}
+		return kvs, nil
+	default:
+		return nil, errors.Errorf("unknown kv storage type: '%s'", kvc.Type)
+	}
+}
+
+// valueLogCollector is a kv storage whose log has to be garbage collected
+type valueLogCollector interface {
+	CollectValueLog() (int, error)
+}
+
+// runValueLogGC garbage collects the value log of vlc every interval, forever
+func runValueLogGC(vlc valueLogCollector, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		rewritten, err := vlc.CollectValueLog()
+		if err != nil {
+			logErr(errors.Wrap(err, "collecting the kv value log"))
+		}
+		if shouldLogInfo() && rewritten > 0 {
+			log.Printf("Rewrote %d kv value log files", rewritten)
+		}
+	}
+}
+
+// kvCompactor is a kv storage kept in a file that only shrinks when it's
+// compacted
+type kvCompactor interface {
+	Compact() (boltdb.CompactResult, error)
+	Stats() (boltdb.Stats, error)
+}
+
+// kvFileStorage is a kv storage kept in a single file, which can be
+// compacted, and copied while it's in use
+type kvFileStorage interface {
+	kvCompactor
+	Snapshot(w io.Writer) (int64, error)
+}
+
+// kvCompactionStats are the compactions since the server started, reported
+// by GET /admin/kv-stats
+type kvCompactionStats struct {
+	mu      sync.Mutex
+	runs    int64
+	last    boltdb.CompactResult
+	lastRun time.Time
+}
+
+var kvCompactions = &kvCompactionStats{}
+
+func (kcs *kvCompactionStats) record(res boltdb.CompactResult, at time.Time) {
+	kcs.mu.Lock()
+	defer kcs.mu.Unlock()
+	kcs.runs++
+	kcs.last = res
+	kcs.lastRun = at
+}
+
+// runKVCompaction compacts the file of kc every interval, forever, when
+// enough of it is free
+func runKVCompaction(kc kvCompactor, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		if err := compactKV(kc); err != nil {
+			logErr(errors.Wrap(err, "compacting the kv storage"))
+		}
+	}
+}
+
+// compactKV compacts the file of kc if at least boltCompactMinFree of it is
+// free
+func compactKV(kc kvCompactor) error {
+	stats, err := kc.Stats()
+	if err != nil {
+		return err
+	}
+	if stats.FileSize == 0 || float64(stats.FreeBytes) < boltCompactMinFree*float64(stats.FileSize) {
+		return nil
+	}
+
+	res, err := kc.Compact()
+	if err != nil {
+		return err
+	}
+	kvCompactions.record(res, time.Now())
+	if shouldLogInfo() {
+		log.Printf("Compacted the kv storage from %d to %d bytes", res.Before, res.After)
+	}
+	return nil
+}
+
+func kvStatsHandler(w http.ResponseWriter, r *http.Request) {
+	kc := providersCtx(r.Context()).kvFile
+	if kc == nil {
+		sendNotFound(w, "the kv storage isn't kept in a file", errorNotFound)
+		return
+	}
+	stats, err := kc.Stats()
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+
+	kvCompactions.mu.Lock()
+	defer kvCompactions.mu.Unlock()
+	type compaction struct {
+		Before int64 `json:"before"`
+		After  int64 `json:"after"`
+		At     int64 `json:"at"`
+	}
+	resp := struct {
+		FileSize      int64       `json:"file_size"`
+		FreePages     int         `json:"free_pages"`
+		PendingPages  int         `json:"pending_pages"`
+		FreeBytes     int64       `json:"free_bytes"`
+		FreelistBytes int         `json:"freelist_bytes"`
+		Compactions   int64       `json:"compactions"`
+		Last          *compaction `json:"last_compaction,omitempty"`
+	}{
+		FileSize:      stats.FileSize,
+		FreePages:     stats.FreePages,
+		PendingPages:  stats.PendingPages,
+		FreeBytes:     stats.FreeBytes,
+		FreelistBytes: stats.FreelistBytes,
+		Compactions:   kvCompactions.runs,
+	}
+	if !kvCompactions.lastRun.IsZero() {
+		resp.Last = &compaction{
+			Before: kvCompactions.last.Before,
+			After:  kvCompactions.last.After,
+			At:     kvCompactions.lastRun.Unix(),
+		}
+	}
+	sendSuccess(w, resp)
+}
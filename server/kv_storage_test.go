@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/boltdb"
+)
+
+func TestKVStorageConfig(t *testing.T) {
+	kvc := kvStorageConfig{}
+	require.NoError(t, kvc.validate())
+	require.Equal(t, "boltdb", kvc.Type)
+	require.Equal(t, defaultBoltCompactionInterval, kvc.BoltCompaction)
+	kvc = kvStorageConfig{BoltCompactionInterval: "0s"}
+	require.NoError(t, kvc.validate())
+	require.Zero(t, kvc.BoltCompaction)
+	kvc = kvStorageConfig{Type: "boltdb", BoltCompactionInterval: "weekly"}
+	require.Error(t, kvc.validate())
+
+	kvc = kvStorageConfig{Type: "memory"}
+	require.NoError(t, kvc.validate())
+	_, err := newKVStorage(kvc, "")
+	require.NoError(t, err)
+
+	kvc = kvStorageConfig{Type: "badger"}
+	require.NoError(t, kvc.validate())
+	require.Equal(t, defaultBadgerGCInterval, kvc.BadgerGC)
+	kvc = kvStorageConfig{Type: "badger", BadgerGCInterval: "1h"}
+	require.NoError(t, kvc.validate())
+	require.Equal(t, time.Hour, kvc.BadgerGC)
+	kvc = kvStorageConfig{Type: "badger", BadgerGCInterval: "-1m"}
+	require.Error(t, kvc.validate())
+
+	kvc = kvStorageConfig{Type: "redis"}
+	require.Error(t, kvc.validate())
+
+	kvc = kvStorageConfig{Type: "redis", RedisAddress: "localhost:6379", RedisDB: -1}
+	require.Error(t, kvc.validate())
+
+	os.Setenv("REDIS_PASSWORD", "from the environment")
+	defer os.Unsetenv("REDIS_PASSWORD")
+	kvc = kvStorageConfig{Type: "redis", RedisAddress: "localhost:6379"}
+	require.NoError(t, kvc.validate())
+	require.Equal(t, "from the environment", kvc.RedisPassword)
+
+	kvc = kvStorageConfig{Type: "etcd"}
+	require.Error(t, kvc.validate())
+}
+
+type fakeKVFile struct {
+	stats     boltdb.Stats
+	compacted int
+}
+
+func (fkc *fakeKVFile) Compact() (boltdb.CompactResult, error) {
+	fkc.compacted++
+	res := boltdb.CompactResult{Before: fkc.stats.FileSize, After: fkc.stats.FileSize - fkc.stats.FreeBytes}
+	fkc.stats = boltdb.Stats{FileSize: res.After}
+	return res, nil
+}
+
+func (fkc *fakeKVFile) Stats() (boltdb.Stats, error) {
+	return fkc.stats, nil
+}
+
+func (fkc *fakeKVFile) Snapshot(w io.Writer) (int64, error) {
+	n, err := w.Write([]byte("snapshot"))
+	return int64(n), err
+}
+
+func TestKVCompaction(t *testing.T) {
+	kc := &fakeKVFile{stats: boltdb.Stats{FileSize: 1000, FreeBytes: 200}}
+	providers := createTestProviders(t)
+	kvStats := func() (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		providersInjector(providers, kvStatsHandler)(w, httptest.NewRequest(http.MethodGet, "/admin/kv-stats", nil))
+		body := map[string]interface{}{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+		return w.Code, body
+	}
+
+	// only a file kv storage has stats
+	code, _ := kvStats()
+	require.Equal(t, http.StatusNotFound, code)
+	providers.kvFile = kc
+
+	// too little is free to be worth it
+	require.NoError(t, compactKV(kc))
+	require.Equal(t, 0, kc.compacted)
+
+	kc.stats.FreeBytes = 600
+	code, body := kvStats()
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, float64(600), body["free_bytes"])
+
+	runs := kvCompactions.runs
+	require.NoError(t, compactKV(kc))
+	require.Equal(t, 1, kc.compacted)
+	code, body = kvStats()
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, float64(400), body["file_size"])
+	require.Equal(t, float64(runs+1), body["compactions"])
+	last := body["last_compaction"].(map[string]interface{})
+	require.Equal(t, float64(1000), last["before"])
+	require.Equal(t, float64(400), last["after"])
+}
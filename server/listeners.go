@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// shutdownTimeout is how long in-flight requests get to finish when the
+// server shuts down
+const shutdownTimeout = 10 * time.Second
+
+type listener struct {
+	server *http.Server
+	tls    bool
+	// maxConns caps the connections open at once. Once reached, new
+	// connections wait in the accept queue. Zero means no limit.
+	maxConns int
+	// maxConnsPerIP caps the connections open at once from a single address.
+	// Connections over the cap are closed right away. Zero means no limit.
+	maxConnsPerIP int
+	// proxyFrom are the load balancers whose connections start with a PROXY
+	// protocol header
+	proxyFrom []*net.IPNet
+}
+
+// listen opens the listener's address, with its connection caps and PROXY
+// protocol support applied
+func (l listener) listen() (net.Listener, error) {
+	addr := l.server.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// the caps apply to the clients behind the load balancers
+	if len(l.proxyFrom) > 0 {
+		ln = newProxyListener(ln, l.proxyFrom)
+	}
+	if l.maxConns == 0 && l.maxConnsPerIP == 0 {
+		return ln, nil
+	}
+
+	cl := &capListener{
+		Listener: ln,
+		perIP:    l.maxConnsPerIP,
+		open:     map[string]int{},
+	}
+	if l.maxConns > 0 {
+		cl.slots = make(chan struct{}, l.maxConns)
+	}
+	return cl, nil
+}
+
+// serve runs all the listeners until one of them fails or the process is
+// asked to stop, and then shuts all of them down together. When asked to
+// stop, drain runs before the shutdown, while the listeners still serve.
+func serve(listeners []listener, drain func()) error {
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l listener) {
+			ln, err := l.listen()
+			if err == nil {
+				if l.tls {
+					err = l.server.ServeTLS(ln, "", "")
+				} else {
+					err = l.server.Serve(ln)
+				}
+			}
+			errs <- errors.Wrapf(err, "listener on %s", l.server.Addr)
+		}(l)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	var err error
+	select {
+	case err = <-errs:
+	case sig := <-sigs:
+		log.Printf("Received %v. Shutting down.", sig)
+		if drain != nil {
+			drain()
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, l := range listeners {
+		if shutdownErr := l.server.Shutdown(ctx); shutdownErr != nil {
+			logErr(errors.Wrapf(shutdownErr, "shutting down listener on %s", l.server.Addr))
+		}
+	}
+
+	return err
+}
+
+// capListener limits the connections that are open at once, in total and
+// per remote address, so a few clients holding connections open can't
+// exhaust the server's file descriptors or goroutines.
+type capListener struct {
+	net.Listener
+	// slots has room for each connection that may still be opened, or is nil
+	// when there's no total limit
+	slots chan struct{}
+	perIP int
+
+	mu   sync.Mutex
+	open map[string]int
+}
+
+func (cl *capListener) Accept() (net.Conn, error) {
+	for {
+		if cl.slots != nil {
+			cl.slots <- struct{}{}
+		}
+		conn, err := cl.Listener.Accept()
+		if err != nil {
+			cl.releaseSlot()
+			return nil, err
+		}
+
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if cl.acquireHost(host) {
+			return &capConn{Conn: conn, cl: cl, host: host}, nil
+		}
+		conn.Close()
+		cl.releaseSlot()
+	}
+}
+
+// acquireHost records a connection from host, unless host is at its limit
+func (cl *capListener) acquireHost(host string) bool {
+	if cl.perIP == 0 {
+		return true
+	}
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.open[host] >= cl.perIP {
+		return false
+	}
+	cl.open[host]++
+	return true
+}
+
+func (cl *capListener) releaseHost(host string) {
+	if cl.perIP == 0 {
+		return
+	}
+	cl.mu.Lock()
+	cl.open[host]--
+	if cl.open[host] <= 0 {
+		delete(cl.open, host)
+	}
+	cl.mu.Unlock()
+}
+
+func (cl *capListener) releaseSlot() {
+	if cl.slots != nil {
+		<-cl.slots
+	}
+}
+
+type capConn struct {
+	net.Conn
+	cl   *capListener
+	host string
+	once sync.Once
+}
+
+func (cc *capConn) Close() error {
+	err := cc.Conn.Close()
+	cc.once.Do(func() {
+		cc.cl.releaseHost(cc.host)
+		cc.cl.releaseSlot()
+	})
+	return err
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeShutsDownTogether(t *testing.T) {
+	// occupy a port, so the second listener fails to start
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer taken.Close()
+
+	handler := http.NotFoundHandler()
+	healthy := newHTTPServer("127.0.0.1:0", handler, nil, nil)
+	broken := newHTTPServer(taken.Addr().String(), handler, nil, nil)
+
+	err = serve([]listener{{server: healthy}, {server: broken}}, nil)
+	require.Error(t, err)
+
+	// the healthy listener was shut down along with the broken one
+	require.Equal(t, http.ErrServerClosed, healthy.ListenAndServe())
+}
+
+// startLimitedServer serves a trivial handler on a random port, with l's
+// connection caps applied
+func startLimitedServer(t *testing.T, limits *httpLimits, l listener) (string, *http.Server) {
+	t.Helper()
+
+	l.server = newHTTPServer("127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sendSuccess(w, nil)
+	}), limits, nil)
+	ln, err := l.listen()
+	require.NoError(t, err)
+	go l.server.Serve(ln)
+	return ln.Addr().String(), l.server
+}
+
+// dribble opens a connection that sends the start of a request and then
+// goes quiet, like a slowloris client
+func dribble(t *testing.T, addr string) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: oscar\r\n"))
+	require.NoError(t, err)
+	return conn
+}
+
+// closedByServer returns true if the server closes conn before the deadline
+func closedByServer(conn net.Conn, deadline time.Duration) bool {
+	conn.SetReadDeadline(time.Now().Add(deadline))
+	_, err := ioutil.ReadAll(conn)
+	return err == nil
+}
+
+// served returns true if a complete request on a new connection is answered
+func served(addr string) bool {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: oscar\r\n\r\n")); err != nil {
+		return false
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	return err == nil && strings.HasPrefix(line, "HTTP/1.1 200")
+}
+
+func TestSlowHeadersAreCutOff(t *testing.T) {
+	limits := &httpLimits{
+		readHeaderTimeout: 100 * time.Millisecond,
+		readTimeout:       time.Second,
+		idleTimeout:       time.Second,
+		maxHeaderBytes:    1 << 10,
+	}
+	addr, srv := startLimitedServer(t, limits, listener{})
+	defer srv.Close()
+
+	conn := dribble(t, addr)
+	defer conn.Close()
+	require.True(t, closedByServer(conn, 2*time.Second))
+
+	// oversized headers are rejected
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	req := "GET / HTTP/1.1\r\nHost: oscar\r\nX-Filler: " + strings.Repeat("a", 8<<10) + "\r\n\r\n"
+	_, err = conn.Write([]byte(req))
+	require.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(line, "HTTP/1.1 431"), "Got: %s", line)
+}
+
+func TestConnectionsPerIPAreCapped(t *testing.T) {
+	limits := &httpLimits{readHeaderTimeout: 5 * time.Second, readTimeout: 5 * time.Second}
+	addr, srv := startLimitedServer(t, limits, listener{maxConnsPerIP: 2})
+	defer srv.Close()
+
+	first := dribble(t, addr)
+	defer first.Close()
+	second := dribble(t, addr)
+	defer second.Close()
+
+	// a third connection from the same address is dropped right away
+	third, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer third.Close()
+	require.True(t, closedByServer(third, time.Second))
+
+	// once one of the slow clients goes away, there's room again
+	first.Close()
+	require.Eventually(t, func() bool { return served(addr) }, 2*time.Second, 20*time.Millisecond)
+}
+
+func TestTotalConnectionsAreCapped(t *testing.T) {
+	limits := &httpLimits{readHeaderTimeout: 5 * time.Second, readTimeout: 5 * time.Second}
+	addr, srv := startLimitedServer(t, limits, listener{maxConns: 2})
+	defer srv.Close()
+
+	first := dribble(t, addr)
+	defer first.Close()
+	second := dribble(t, addr)
+	defer second.Close()
+
+	// new connections wait until one of the slow clients goes away
+	require.False(t, served(addr))
+	first.Close()
+	require.Eventually(t, func() bool { return served(addr) }, 2*time.Second, 20*time.Millisecond)
+}
@@ -2,15 +2,23 @@ package main
 
 import (
 	"encoding/json"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
 
+	"github.com/pkg/errors"
 	"zood.dev/oscar/encodable"
 )
 
-// currLogLevel holds the current log detail desired
-var currLogLevel = logLevelError
+// currLogLevel holds the current log detail desired. It's changed at runtime
+// by setLogLevelHandler, so it must only be accessed via getLogLevel and
+// setLogLevel.
+var currLogLevel = int32(logLevelError)
 
-type logLevel int
+type logLevel int32
 
 // Log level values
 const (
@@ -33,30 +41,64 @@ func validLogLevel(lvl int) bool {
 	return true
 }
 
+func getLogLevel() logLevel {
+	return logLevel(atomic.LoadInt32(&currLogLevel))
+}
+
+func setLogLevel(lvl logLevel) {
+	atomic.StoreInt32(&currLogLevel, int32(lvl))
+}
+
+// loadLogLevel reads the log level persisted at path. It returns 0 if none
+// has been persisted.
+func loadLogLevel(path string) (logLevel, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	lvl, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+	if err != nil || !validLogLevel(lvl) {
+		return 0, errors.Errorf("invalid log level in %s", path)
+	}
+	return logLevel(lvl), nil
+}
+
+// saveLogLevel persists lvl at path, so it survives a restart
+func saveLogLevel(path string, lvl logLevel) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.Itoa(int(lvl))+"\n"), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
 func shouldLogDebug() bool {
-	return currLogLevel <= logLevelDebug
+	return getLogLevel() <= logLevelDebug
 }
 
 func shouldLogInfo() bool {
-	return currLogLevel <= logLevelInfo
+	return getLogLevel() <= logLevelInfo
 }
 
 func shouldLogWarn() bool {
-	return currLogLevel <= logLevelWarn
+	return getLogLevel() <= logLevelWarn
 }
 
 func shouldLogError() bool {
-	return currLogLevel <= logLevelError
+	return getLogLevel() <= logLevelError
 }
 
 // logLevelHandler handles GET /log-level
 func logLevelHandler(w http.ResponseWriter, r *http.Request) {
 	sendSuccess(w, map[string]logLevel{
-		"log_level": currLogLevel,
+		"log_level": getLogLevel(),
 	})
 }
 
-// setLogLevelHandler handles PUT /log-level
+// setLogLevelHandler handles PUT /admin/log-level
 func setLogLevelHandler(w http.ResponseWriter, r *http.Request) {
 	body := struct {
 		LogLevel int `json:"log_level"`
@@ -72,9 +114,16 @@ func setLogLevelHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	currLogLevel = logLevel(body.LogLevel)
+	lvl := logLevel(body.LogLevel)
+	if path := providersCtx(r.Context()).logLevelPath; path != "" {
+		if err = saveLogLevel(path, lvl); err != nil {
+			sendInternalErr(w, err)
+			return
+		}
+	}
+	setLogLevel(lvl)
 	sendSuccess(w, map[string]logLevel{
-		"log_level": currLogLevel,
+		"log_level": lvl,
 	})
 }
 
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetLogLevel(t *testing.T) {
+	defer setLogLevel(getLogLevel())
+
+	dir, err := ioutil.TempDir("", "oscar-log-level")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	providers := createTestProviders(t)
+	providers.logLevelPath = filepath.Join(dir, "log-level")
+	router := newOscarRouter(providers)
+
+	put := func(token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPut, "/admin/log-level", strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	// the admin routes are disabled without an admin token
+	require.Equal(t, http.StatusUnauthorized, put("", `{"log_level": 1}`).Code)
+
+	providers.adminToken = "correct horse battery staple"
+	require.Equal(t, http.StatusUnauthorized, put("wrong", `{"log_level": 1}`).Code)
+	require.Equal(t, http.StatusBadRequest, put(providers.adminToken, `{"log_level": 9}`).Code)
+
+	setLogLevel(logLevelError)
+	w := put(providers.adminToken, `{"log_level": 2}`)
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	require.Equal(t, logLevelInfo, getLogLevel())
+
+	// the level survives a restart
+	persisted, err := loadLogLevel(providers.logLevelPath)
+	require.NoError(t, err)
+	require.Equal(t, logLevelInfo, persisted)
+}
+
+func TestLoadLogLevel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oscar-log-level")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "log-level")
+
+	lvl, err := loadLogLevel(path)
+	require.NoError(t, err)
+	require.Equal(t, logLevel(0), lvl)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("12\n"), 0600))
+	_, err = loadLogLevel(path)
+	require.Error(t, err)
+}
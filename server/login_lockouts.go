@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Failed logins are counted per account and per client address, including
+// replayed challenge answers, expired refresh tokens, and unknown usernames
+// or refresh tokens, which only count toward the address. A few failures
+// are free. After that, each one makes the client wait before trying again,
+// twice as long as the one before, until enough of them lock it out
+// entirely. The failures are forgotten a window after the last one.
+const (
+	loginFailureWindow = 15 * time.Minute
+	loginFirstDelay    = time.Second
+	loginMaxDelay      = time.Minute
+	loginLockout       = 15 * time.Minute
+	// loginLockoutSweepInterval is how often the failures that have been
+	// forgotten are dropped
+	loginLockoutSweepInterval = time.Minute
+)
+
+// loginLimit is how many failures an account or address gets
+type loginLimit struct {
+	// free failures don't make the client wait
+	free int
+	// lockAt failures lock the client out for loginLockout
+	lockAt int
+}
+
+// Addresses get more failures than accounts, since many users can share one
+// behind a NAT
+var (
+	accountLoginLimit = loginLimit{free: 3, lockAt: 10}
+	addressLoginLimit = loginLimit{free: 20, lockAt: 100}
+)
+
+// wait returns how long after the last of count failures the client has to
+// wait before trying again
+func (ll loginLimit) wait(count int) time.Duration {
+	switch {
+	case count >= ll.lockAt:
+		return loginLockout
+	case count <= ll.free:
+		return 0
+	}
+	shift := count - ll.free - 1
+	if shift >= 32 || loginFirstDelay<<uint(shift) > loginMaxDelay {
+		return loginMaxDelay
+	}
+	return loginFirstDelay << uint(shift)
+}
+
+type loginFailures struct {
+	count int
+	last  time.Time
+}
+
+// loginLockouts tracks the failed logins of each account and address. It's
+// kept in memory, so each instance locks clients out on its own.
+type loginLockouts struct {
+	mu        sync.Mutex
+	accounts  map[int64]*loginFailures
+	addresses map[string]*loginFailures
+	lastSweep time.Time
+}
+
+func newLoginLockouts() *loginLockouts {
+	return &loginLockouts{
+		accounts:  make(map[int64]*loginFailures),
+		addresses: make(map[string]*loginFailures),
+	}
+}
+
+// lockoutAddress returns the key of the client at ip. IPv6 clients are
+// usually handed a whole /64, so it's counted as one address.
+func lockoutAddress(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	if ip.To4() == nil {
+		ip = ip.Mask(net.CIDRMask(64, 128))
+	}
+	return ip.String()
+}
+
+// loginAddress returns the lockout key of the client making r. A replica
+// that didn't forward its client's address isn't counted, so its clients
+// can't lock each other out.
+func loginAddress(providers *serverProviders, r *http.Request) string {
+	ip := remoteIP(r)
+	if providers.trustedReplicas.contains(ip) {
+		return ""
+	}
+	return lockoutAddress(ip)
+}
+
+// retryAfter returns how long the account userID and the client at addr
+// have to wait before logging in again. A userID of 0 or an empty addr
+// isn't checked.
+func (ll *loginLockouts) retryAfter(userID int64, addr string, now time.Time) time.Duration {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+
+	var wait time.Duration
+	if f := ll.accounts[userID]; userID != 0 && f != nil {
+		wait = f.last.Add(accountLoginLimit.wait(f.count)).Sub(now)
+	}
+	if f := ll.addresses[addr]; addr != "" && f != nil {
+		if w := f.last.Add(addressLoginLimit.wait(f.count)).Sub(now); w > wait {
+			wait = w
+		}
+	}
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// fail counts a failed login of the account userID from the client at addr,
+// and returns whether it locked the account out. A userID of 0 or an empty
+// addr isn't counted.
+func (ll *loginLockouts) fail(userID int64, addr string, now time.Time) bool {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+
+	// drop stale entries every so often, so the maps don't grow forever
+	if now.Sub(ll.lastSweep) >= loginLockoutSweepInterval {
+		for id, f := range ll.accounts {
+			if now.Sub(f.last) >= loginFailureWindow+loginLockout {
+				delete(ll.accounts, id)
+			}
+		}
+		for a, f := range ll.addresses {
+			if now.Sub(f.last) >= loginFailureWindow+loginLockout {
+				delete(ll.addresses, a)
+			}
+		}
+		ll.lastSweep = now
+	}
+
+	lockedOut := false
+	if userID != 0 {
+		f := countFailure(ll.accounts[userID], accountLoginLimit, now)
+		ll.accounts[userID] = f
+		lockedOut = f.count == accountLoginLimit.lockAt
+	}
+	if addr != "" {
+		ll.addresses[addr] = countFailure(ll.addresses[addr], addressLoginLimit, now)
+	}
+	return lockedOut
+}
+
+// countFailure adds a failure at now to f, which starts over when the
+// previous ones have been forgotten
+func countFailure(f *loginFailures, limit loginLimit, now time.Time) *loginFailures {
+	if f == nil || now.Sub(f.last) >= limit.wait(f.count)+loginFailureWindow {
+		f = &loginFailures{}
+	}
+	f.count++
+	f.last = now
+	return f
+}
+
+// succeed forgets the failures of the account userID. The address keeps
+// its failures, so logging into one account doesn't clear the way to guess
+// at others.
+func (ll *loginLockouts) succeed(userID int64) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	delete(ll.accounts, userID)
+}
+
+// clearAccount forgets the failures of the account userID, and returns
+// whether it had any
+func (ll *loginLockouts) clearAccount(userID int64) bool {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	_, ok := ll.accounts[userID]
+	delete(ll.accounts, userID)
+	return ok
+}
+
+// clearAddress forgets the failures of the client at addr, and returns
+// whether it had any
+func (ll *loginLockouts) clearAddress(addr string) bool {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	_, ok := ll.addresses[addr]
+	delete(ll.addresses, addr)
+	return ok
+}
+
+// loginLockoutInfo describes a client that has to wait before logging in
+type loginLockoutInfo struct {
+	UserID   int64  `json:"user_id,omitempty"`
+	Username string `json:"username,omitempty"`
+	Address  string `json:"address,omitempty"`
+	Failures int    `json:"failures"`
+	// Until is when the client can log in again
+	Until     int64 `json:"until"`
+	LockedOut bool  `json:"locked_out"`
+}
+
+// waiting returns the accounts and addresses that have to wait at now,
+// the longest waits first
+func (ll *loginLockouts) waiting(now time.Time) []loginLockoutInfo {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+
+	infos := []loginLockoutInfo{}
+	for id, f := range ll.accounts {
+		if until := f.last.Add(accountLoginLimit.wait(f.count)); until.After(now) {
+			infos = append(infos, loginLockoutInfo{UserID: id, Failures: f.count, Until: until.Unix(), LockedOut: f.count >= accountLoginLimit.lockAt})
+		}
+	}
+	for addr, f := range ll.addresses {
+		if until := f.last.Add(addressLoginLimit.wait(f.count)); until.After(now) {
+			infos = append(infos, loginLockoutInfo{Address: addr, Failures: f.count, Until: until.Unix(), LockedOut: f.count >= addressLoginLimit.lockAt})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Until != infos[j].Until {
+			return infos[i].Until > infos[j].Until
+		}
+		if infos[i].UserID != infos[j].UserID {
+			return infos[i].UserID > infos[j].UserID
+		}
+		return infos[i].Address < infos[j].Address
+	})
+	return infos
+}
+
+// sendLoginRetryAfter tells the client it has failed to log in too often,
+// and when it can try again
+func sendLoginRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	sendErr(w, "Too many failed logins. Try again later.", http.StatusTooManyRequests, errorRateLimited)
+}
+
+// loginLockoutsHandler handles GET /admin/login-lockouts
+func loginLockoutsHandler(w http.ResponseWriter, r *http.Request) {
+	providers := providersCtx(r.Context())
+	infos := providers.loginLockouts.waiting(providers.now())
+	for i := range infos {
+		if infos[i].UserID != 0 {
+			infos[i].Username = providers.db.Username(infos[i].UserID)
+		}
+	}
+
+	sendSuccess(w, infos)
+}
+
+// clearAccountLockoutHandler handles DELETE /admin/login-lockouts/users/{username}
+func clearAccountLockoutHandler(w http.ResponseWriter, r *http.Request) {
+	providers := providersCtx(r.Context())
+	username := strings.ToLower(mux.Vars(r)["username"])
+	user, err := providers.db.User(username)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if user == nil {
+		sendNotFound(w, "user not found", errorUserNotFound)
+		return
+	}
+	if !providers.loginLockouts.clearAccount(user.ID) {
+		sendNotFound(w, fmt.Sprintf("'%s' has no failed logins", username), errorNotFound)
+		return
+	}
+	providers.events.emit(accountEvent{Kind: eventLoginLockoutCleared, Actor: actorAdmin, UserID: user.ID})
+
+	sendSuccess(w, nil)
+}
+
+// clearAddressLockoutHandler handles DELETE /admin/login-lockouts/addresses/{address}
+func clearAddressLockoutHandler(w http.ResponseWriter, r *http.Request) {
+	providers := providersCtx(r.Context())
+	ip := net.ParseIP(mux.Vars(r)["address"])
+	if ip == nil {
+		sendBadReq(w, "invalid address")
+		return
+	}
+	addr := lockoutAddress(ip)
+	if !providers.loginLockouts.clearAddress(addr) {
+		sendNotFound(w, fmt.Sprintf("'%s' has no failed logins", addr), errorNotFound)
+		return
+	}
+	providers.events.emit(accountEvent{Kind: eventLoginLockoutCleared, Actor: actorAdmin, Details: "for " + addr})
+
+	sendSuccess(w, nil)
+}
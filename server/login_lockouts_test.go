@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginLimitWait(t *testing.T) {
+	ll := loginLimit{free: 2, lockAt: 12}
+	require.Zero(t, ll.wait(1))
+	require.Zero(t, ll.wait(2))
+	require.Equal(t, time.Second, ll.wait(3))
+	require.Equal(t, 2*time.Second, ll.wait(4))
+	require.Equal(t, 32*time.Second, ll.wait(8))
+	require.Equal(t, loginMaxDelay, ll.wait(9))
+	require.Equal(t, loginMaxDelay, ll.wait(11))
+	require.Equal(t, loginLockout, ll.wait(12))
+	require.Equal(t, loginMaxDelay, loginLimit{free: 0, lockAt: 1000}.wait(500))
+}
+
+func TestLoginLockouts(t *testing.T) {
+	ll := newLoginLockouts()
+	now := time.Unix(1600000000, 0)
+
+	for i := 0; i < accountLoginLimit.free; i++ {
+		require.False(t, ll.fail(7, "203.0.113.7", now))
+	}
+	require.Zero(t, ll.retryAfter(7, "203.0.113.7", now))
+	require.False(t, ll.fail(7, "203.0.113.7", now))
+	require.Equal(t, loginFirstDelay, ll.retryAfter(7, "203.0.113.7", now))
+	// the address isn't waiting yet, but the account is wherever it logs in from
+	require.Zero(t, ll.retryAfter(0, "203.0.113.7", now))
+	require.Equal(t, loginFirstDelay, ll.retryAfter(7, "198.51.100.1", now))
+	require.Equal(t, loginFirstDelay/2, ll.retryAfter(7, "", now.Add(loginFirstDelay/2)))
+
+	for i := accountLoginLimit.free + 1; i < accountLoginLimit.lockAt-1; i++ {
+		require.False(t, ll.fail(7, "", now))
+	}
+	require.True(t, ll.fail(7, "", now))
+	require.Equal(t, loginLockout, ll.retryAfter(7, "", now))
+	require.Len(t, ll.waiting(now), 1)
+
+	// logging in forgets the account's failures, but not the address's
+	for i := 0; i <= addressLoginLimit.free; i++ {
+		ll.fail(0, "198.51.100.9", now)
+	}
+	ll.succeed(7)
+	require.Zero(t, ll.retryAfter(7, "", now))
+	require.Equal(t, loginFirstDelay, ll.retryAfter(0, "198.51.100.9", now))
+
+	// failures are forgotten a window after the wait ends
+	later := now.Add(loginFirstDelay + loginFailureWindow)
+	require.False(t, ll.fail(0, "198.51.100.9", later))
+	require.Zero(t, ll.retryAfter(0, "198.51.100.9", later))
+
+	// stale failures are dropped by a later sweep
+	ll.fail(0, "192.0.2.1", later.Add(loginFailureWindow+loginLockout))
+	require.Len(t, ll.accounts, 0)
+	require.Len(t, ll.addresses, 1)
+
+	require.Equal(t, "2001:db8:1:2::", lockoutAddress(net.ParseIP("2001:db8:1:2:3:4:5:6")))
+	require.Equal(t, "203.0.113.7", lockoutAddress(net.ParseIP("203.0.113.7")))
+	require.Empty(t, lockoutAddress(nil))
+
+	// replicas that didn't forward their client's address aren't counted
+	providers := createTestProviders(t)
+	providers.trustedReplicas, _ = parseProxySources([]string{"192.0.2.0/24"})
+	r := httptest.NewRequest(http.MethodPost, "/1/sessions/refresh", nil)
+	r.RemoteAddr = "192.0.2.7:40000"
+	require.Empty(t, loginAddress(providers, r))
+	r.RemoteAddr = "203.0.113.7:40000"
+	require.Equal(t, "203.0.113.7", loginAddress(providers, r))
+}
+
+func TestLoginLockoutsAdmin(t *testing.T) {
+	providers := createTestProviders(t)
+	providers.adminToken = "admin-token"
+	clock := newFakeClock(time.Now())
+	providers.clock = clock
+	var events []accountEvent
+	providers.events = newEventBus()
+	providers.events.subscribe("test", func(evt accountEvent) error {
+		events = append(events, evt)
+		return nil
+	})
+	router := newOscarRouter(providers)
+	user, _ := createTestUser(t, providers)
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("Authorization", "Bearer admin-token")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < accountLoginLimit.lockAt; i++ {
+		providers.loginLockouts.fail(user.ID, "", clock.Now())
+	}
+	for i := 0; i <= addressLoginLimit.free; i++ {
+		providers.loginLockouts.fail(0, "192.0.2.1", clock.Now())
+	}
+	r := httptest.NewRequest(http.MethodPost, "/1/sessions/"+user.Username+"/challenge", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	w = do(http.MethodGet, "/admin/login-lockouts")
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	var infos []loginLockoutInfo
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &infos))
+	require.Len(t, infos, 2)
+	require.Equal(t, user.Username, infos[0].Username)
+	require.True(t, infos[0].LockedOut)
+	require.Equal(t, clock.Now().Add(loginLockout).Unix(), infos[0].Until)
+	require.Equal(t, "192.0.2.1", infos[1].Address)
+	require.False(t, infos[1].LockedOut)
+
+	require.Equal(t, http.StatusOK, do(http.MethodDelete, "/admin/login-lockouts/users/"+user.Username).Code)
+	require.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/admin/login-lockouts/users/"+user.Username).Code)
+	require.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/admin/login-lockouts/users/nobody").Code)
+	require.Equal(t, http.StatusOK, do(http.MethodDelete, "/admin/login-lockouts/addresses/192.0.2.1").Code)
+	require.Equal(t, http.StatusBadRequest, do(http.MethodDelete, "/admin/login-lockouts/addresses/nowhere").Code)
+	require.Len(t, events, 2)
+	require.Equal(t, eventLoginLockoutCleared, events[0].Kind)
+	require.Equal(t, user.ID, events[0].UserID)
+
+	// the user can ask for a challenge again
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+}
@@ -4,21 +4,24 @@ import (
 	"bytes"
 	"crypto/tls"
 	"flag"
-	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"golang.org/x/crypto/acme/autocert"
-	"zood.dev/oscar/boltdb"
+	"zood.dev/oscar/dedupfs"
 	"zood.dev/oscar/filestor"
-	"zood.dev/oscar/gcs"
-	"zood.dev/oscar/localdisk"
 	"zood.dev/oscar/mailgun"
+	"zood.dev/oscar/push"
+	"zood.dev/oscar/sealedfs"
+	"zood.dev/oscar/smtp"
 	"zood.dev/oscar/sodium"
-	"zood.dev/oscar/sqlite"
+	"zood.dev/oscar/storemetrics"
+	"zood.dev/oscar/usercache"
 )
 
 var defaultCiphers = []uint16{
@@ -33,78 +36,322 @@ var defaultCiphers = []uint16{
 func main() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 
+	if len(os.Args) > 1 && os.Args[1] == "init" {
+		if err := initCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "kv-snapshot" {
+		if err := kvSnapshotCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "rotate-keypair" {
+		if err := rotateKeyPairCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "kv-migrate" {
+		if err := kvMigrateCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	configPath := flag.String("config", "", "Path to config file")
 	lvl := flag.Int("log-level", 4, "Controls the amount of info logged. Range from 1-4. Default is 4, errors only.")
+	sandbox := flag.Bool("sandbox", false, "Disables all external side effects. Emails and push notifications are logged, storage is local and TLS is off.")
 	flag.Parse()
 
 	if !validLogLevel(*lvl) {
 		log.Fatalf("Invalid log level (%d). Must be between 1-4, inclusive.", *lvl)
 	}
 
-	currLogLevel = logLevel(*lvl)
+	config, err := loadConfig(*configPath, *sandbox)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// a log level given on the command line wins over the one persisted by
+	// PUT /admin/log-level
+	logLevelPath := filepath.Join(config.KVDBDirectory, "log-level")
+	setLogLevel(logLevel(*lvl))
+	lvlFlagSet := false
+	flag.Visit(func(f *flag.Flag) { lvlFlagSet = lvlFlagSet || f.Name == "log-level" })
+	if lvlFlagSet {
+		if err = saveLogLevel(logLevelPath, logLevel(*lvl)); err != nil {
+			log.Fatalf("Unable to save log level: %v", err)
+		}
+	} else if persisted, err := loadLogLevel(logLevelPath); err != nil {
+		log.Fatalf("Unable to load log level: %v", err)
+	} else if persisted != 0 {
+		setLogLevel(persisted)
+	}
+	if *sandbox {
+		sandboxMode = true
+		log.Printf("Running in sandbox mode. Emails and push notifications will only be logged.")
+	}
 
-	config, err := loadConfig(*configPath)
+	rs, err := newDatabase(config)
 	if err != nil {
 		log.Fatal(err)
 	}
+	// the cache sits in front of the recorder, so only the queries that
+	// reach the database are measured
+	storageMetrics := newStorageMetrics(config.StorageSlow)
+	rs = storemetrics.WrapDB(rs, storageMetrics)
+	rs = usercache.New(rs, 5*time.Minute, 10000)
 
-	dsn := fmt.Sprintf("file:%s", filepath.Join(config.SQLDBDirectory, "sqlite.db"))
-	rs, err := sqlite.New(dsn)
+	kvs, err := newKVStorage(config.KV, config.KVDBDirectory)
 	if err != nil {
-		log.Fatalf("Unable to open sqlite db: %v", err)
+		log.Fatalf("Failed to set up kv storage: %v", err)
 	}
+	vlc, collectsValueLog := kvs.(valueLogCollector)
+	kvFile, _ := kvs.(kvFileStorage)
+	var rateLimitTokens rateLimitStore = newMemoryRateLimits()
+	if config.RateLimits.Store == rateLimitStoreRedis {
+		rateLimitTokens = kvs.(rateLimitStore)
+	}
+	kvs = storemetrics.WrapKV(kvs, storageMetrics)
 
-	kvdbPath := filepath.Join(config.KVDBDirectory, "kv.db")
-	kvs, err := boltdb.New(kvdbPath)
+	fs, err := newFileStorage(config.FileStorage)
 	if err != nil {
-		log.Fatalf("Unable to open boltdb: %v", err)
+		log.Fatalf("Failed to set up file storage: %v", err)
+	}
+	// files sealed under the symmetric key are resealed after it's rotated,
+	// along with the other stored items
+	var sealedFiles filestor.Provider
+	if config.FileStorage.Encrypt {
+		if config.FileStorage.EncryptionKey != nil {
+			fs, err = sealedfs.New(fs, config.FileStorage.EncryptionKey)
+		} else {
+			fs, err = sealedfs.New(fs, config.SymmetricKey, config.PreviousSymmetricKeys...)
+			sealedFiles = fs
+		}
+		if err != nil {
+			log.Fatalf("Failed to create sealed filestor: %v", err)
+		}
+	}
+	// deduplicated by the plaintext, since sealing the same content twice
+	// gives different files
+	if config.FileStorage.Deduplicate {
+		fs = dedupfs.New(fs, kvs)
 	}
 
-	var fs filestor.Provider
-	switch config.FileStorage.Type {
-	case "localdisk":
-		fs, err = localdisk.New(config.FileStorage.LocalDiskStoragePath)
+	var emailer smtp.SendEmailer
+	switch config.Email.Provider {
+	case emailProviderMailgun:
+		baseURL, _ := mailgun.BaseURLForRegion(config.Email.MailgunRegion)
+		emailer = mailgun.NewWithBaseURL(config.Email.MailgunAPIKey, config.Email.Domain, baseURL)
+	case emailProviderSMTP:
+		emailer, err = smtp.NewRelay(smtp.RelayConfig{
+			Host:     config.Email.SMTPHost,
+			Port:     config.Email.SMTPPort,
+			Security: config.Email.SMTPSecurity,
+			Username: config.Email.SMTPUsername,
+			Password: config.Email.SMTPPassword,
+		})
 		if err != nil {
-			log.Fatalf("Failed to create localdisk based filestor: %v", err)
+			log.Fatalf("Unable to set up the smtp emailer: %v", err)
 		}
-	case "gcs":
-		fs, err = gcs.New(config.FileStorage.GCPCredentialsPath, config.FileStorage.GCPBucketName)
+	case emailProviderLog:
+		emailer = smtp.NewLogSendEmailer()
+	}
+	emailer = suppressingEmailer{SendEmailer: emailer, db: rs}
+
+	templates, err := newEmailTemplates(config.Email.TemplateDirectory, config.Email.DefaultLocale, &config.Branding)
+	if err != nil {
+		log.Fatalf("Unable to load email templates: %v", err)
+	}
+
+	events := newEventBus()
+	var pushers []pusher
+	switch config.Push.Provider {
+	case pushProviderNative:
+		apns, err := push.NewAPNS(config.APNS.P8Path, config.APNS.KeyID, config.APNS.TeamID, config.APNS.Production, config.Push.DryRun)
 		if err != nil {
-			log.Fatalf("Failed to create google cloud storage based filestor: %v", err)
+			log.Fatalf("Failed to set up apple push notification service client: %v", err)
+		}
+		if config.Push.DryRun {
+			log.Printf("Push notifications are in dry run mode. They will be validated, but not delivered.")
+		}
+		for _, p := range []push.Provider{push.NewFCM(config.FCMServerKey, config.Push.DryRun), apns} {
+			tp, err := newTokenPusher(p, events)
+			if err != nil {
+				log.Fatalf("Unable to set up push notifications: %v", err)
+			}
+			pushers = append(pushers, tp)
+		}
+	case pushProviderLog:
+		pushers = []pusher{logPusher{}}
+	}
+	if config.Push.Debounce > 0 {
+		for i, p := range pushers {
+			pushers[i] = newDebouncedPusher(p, config.Push.Debounce)
 		}
-	default:
-		log.Fatalf("Unknown filestor type: '%s'", config.FileStorage.Type)
 	}
 
-	emailer := mailgun.New(config.Email.MailgunAPIKey, config.Email.Domain)
+	keys, err := newKeyRing(config.SymmetricKey, config.PreviousSymmetricKeys...)
+	if err != nil {
+		log.Fatalf("Unable to load symmetric keys: %v", err)
+	}
+
+	var previousKeyPairs []sodium.KeyPair
+	for _, akc := range config.PreviousAsymmetricKeys {
+		previousKeyPairs = append(previousKeyPairs, akc.keyPair())
+	}
+
+	padding, err := newPaddingPolicy(config.PaddingBuckets)
+	if err != nil {
+		log.Fatalf("Invalid padding buckets: %v", err)
+	}
+
+	timeouts, err := newTimeoutPolicy(config.RequestTimeout, config.RouteTimeouts)
+	if err != nil {
+		log.Fatalf("Invalid timeouts: %v", err)
+	}
+	rateLimits, err := newRateLimitPolicy(config.RateLimits, rateLimitTokens)
+	if err != nil {
+		log.Fatalf("Invalid rate limits: %v", err)
+	}
+	limits, err := newHTTPLimits(config.HTTP)
+	if err != nil {
+		log.Fatalf("Invalid http limits: %v", err)
+	}
+	drain, err := newSocketDrain(config.SocketDrain)
+	if err != nil {
+		log.Fatalf("Invalid socket drain: %v", err)
+	}
+	clientVersions, err := newClientVersionPolicy(config.MinClientVersions)
+	if err != nil {
+		log.Fatalf("Invalid minimum client versions: %v", err)
+	}
+	replica, err := newReplicaProxy(config.PrimaryURL)
+	if err != nil {
+		log.Fatalf("Invalid replica config: %v", err)
+	}
+	replicaSources, err := parseProxySources(config.ReplicaAddresses)
+	if err != nil {
+		log.Fatalf("Invalid replica addresses: %v", err)
+	}
+	if replica != nil {
+		log.Printf("Serving as a read-only replica of %s", replica.primary)
+	}
+
+	// replicas hand the writes that send emails to the primary, so only the
+	// primary sends queued emails
+	var queue *emailQueue
+	if replica == nil {
+		queue = newEmailQueue(kvs, keys, emailer)
+		emailer = queue
+	}
 
 	// playground()
 	providers := &serverProviders{
-		db:      rs,
-		emailer: emailer,
-		fs:      fs,
-		kvs:     kvs,
-		symKey:  config.SymmetricKey,
-		keyPair: sodium.KeyPair{
-			Public: config.AsymmetricKeys.Public,
-			Secret: config.AsymmetricKeys.Secret,
-		},
+		adminToken:        config.AdminToken,
+		db:                rs,
+		emailer:           emailer,
+		emailTemplates:    templates,
+		mailgunSigningKey: config.Email.MailgunWebhookSigningKey,
+		fs:                fs,
+		kvs:               kvs,
+		kvFile:            kvFile,
+		pushers:           pushers,
+		keys:              keys,
+		keyPair:           config.AsymmetricKeys.keyPair(),
+		previousKeyPairs:  previousKeyPairs,
+		padding:           padding,
+		timeouts:          timeouts,
+		rateLimits:        rateLimits,
+		clientVersions:    clientVersions,
+		replica:           replica,
+		replicaURLs:       config.ReplicaURLs,
+		trustedReplicas:   replicaSources,
+		loginLockouts:     newLoginLockouts(),
+		logLevelPath:      logLevelPath,
+		sealMessages:      config.SealStoredMessages,
+		clockSkew:         config.ClockSkew,
+		storageQuota:      config.StorageQuotaBytes,
+		maxQueuedMessages: config.MaxQueuedMessages,
+		dropBoxTTL:        config.DropBoxTTL,
+		boxAliasGrace:     config.DropBoxAliasGrace,
+		usernameIndexSalt: config.UsernameIndexSalt,
+		events:            events,
+		storageMetrics:    storageMetrics,
+		branding:          &config.Branding,
+	}
+	if config.IngressPolicyURL != "" {
+		providers.ingressPolicies = append(providers.ingressPolicies, newWebhookIngressPolicy(config.IngressPolicyURL, rs))
+	}
+	providers.events.subscribe("audit_log", auditLogSubscriber(rs))
+	providers.events.subscribe("log", logSubscriber)
+	providers.events.subscribe("activity", activitySubscriber(providers, config.ActivityEmails))
+	// replicas don't write to their storage. The primary does this work,
+	// and it reaches them through replication.
+	if providers.usernameIndexSalt != nil && replica == nil {
+		if err = backfillUsernameIndexes(rs, providers.usernameIndexSalt); err != nil {
+			log.Fatalf("Unable to backfill username indexes: %v", err)
+		}
+	}
+	if replica == nil {
+		go runSessionSweeper(providers, sessionSweepInterval)
+		go runOutbox(providers, outboxPollInterval)
+		go queue.run(emailQueuePollInterval)
+		go runPackageReaper(providers, packageReapInterval)
+		if collectsValueLog {
+			go runValueLogGC(vlc, config.KV.BadgerGC)
+		}
+		if kvFile != nil && config.KV.BoltCompaction > 0 {
+			go runKVCompaction(kvFile, config.KV.BoltCompaction)
+		}
+	}
+	providers.dependencies = newDependencyMonitor(dependencyProbes(providers))
+	go runDependencyProbes(providers.dependencies, dependencyProbeInterval)
+	if config.FileGC.Every > 0 && replica == nil {
+		go runFileGC(rs, fs, config.FileGC.Every, config.FileGC.DryRun)
+	}
+	if replica == nil {
+		providers.keyCounters = []keyCounter{accessTokenCounter{db: rs}, outboxResealer{db: rs}, queue}
+		if sealedFiles != nil {
+			providers.keyCounters = append(providers.keyCounters, sealedFilesResealer{fs: sealedFiles})
+		}
+	}
+	if len(config.PreviousSymmetricKeys) > 0 && replica == nil {
+		providers.resealers = []resealer{outboxResealer{db: rs}, queue}
+		if sealedFiles != nil {
+			providers.resealers = append(providers.resealers, sealedFilesResealer{fs: sealedFiles})
+		}
+		go runResealJob(providers.keys, providers.resealers, providers.events, time.Hour)
 	}
 	router := newOscarRouter(providers)
 
-	hostAddress := fmt.Sprintf(":%d", *config.Port)
-	server := http.Server{
-		Addr:         hostAddress,
-		Handler:      router,
-		ErrorLog:     log.New(&tlsHandshakeFilter{}, "", 0),
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  120 * time.Second,
+	var listeners []listener
+	if config.Tor != nil {
+		tc, addr, err := publishOnionService(config.Tor)
+		if err != nil {
+			log.Fatalf("Unable to publish onion service: %v", err)
+		}
+		// the onion service only lives as long as the control connection
+		defer tc.Close()
+		onionAddress = addr
+
+		// autocert can't issue certificates for onion addresses, so the
+		// onion listener never uses TLS
+		log.Printf("Publishing onion service at %s", onionAddress)
+		// every onion client connects from tor's address, so only the total
+		// connection cap applies
+		listeners = append(listeners, listener{
+			server:   newHTTPServer(config.Tor.ListenAddress, router, limits, timeouts),
+			maxConns: limits.maxConns,
+		})
 	}
 
-	log.Printf("Starting server for %s:%d", config.Hostname, *config.Port)
+	var tlsConfig *tls.Config
 	if *config.TLS {
-		tlsConfig := &tls.Config{}
+		tlsConfig = &tls.Config{}
 		tlsConfig.CipherSuites = defaultCiphers
 		tlsConfig.MinVersion = tls.VersionTLS12
 		tlsConfig.PreferServerCipherSuites = true
@@ -118,62 +365,92 @@ func main() {
 			Cache:      autocert.DirCache(config.AutocertDirCache),
 		}
 		tlsConfig.GetCertificate = m.GetCertificate
-		server.TLSConfig = tlsConfig
 		go http.ListenAndServe(":http", m.HTTPHandler(nil)) // this just runs for the sake of the autocert manager
-		log.Fatal(server.ListenAndServeTLS("", ""))
-	} else {
-		log.Fatal(server.ListenAndServe())
+	}
+	for _, addr := range config.ListenAddresses {
+		server := newHTTPServer(addr, router, limits, timeouts)
+		server.TLSConfig = tlsConfig
+		listeners = append(listeners, listener{
+			server:        server,
+			tls:           *config.TLS,
+			maxConns:      limits.maxConns,
+			maxConnsPerIP: limits.maxConnsPerIP,
+			proxyFrom:     limits.proxyFrom,
+		})
+	}
+
+	log.Printf("Starting server for %s on %s", config.Hostname, strings.Join(config.ListenAddresses, ", "))
+	if err = serve(listeners, func() { drain.drain(liveSockets) }); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newHTTPServer returns a server for handler. The write timeout leaves room
+// for the slowest route to finish and send its response; the long-lived
+// routes clear it after hijacking the connection.
+func newHTTPServer(addr string, handler http.Handler, limits *httpLimits, timeouts *timeoutPolicy) *http.Server {
+	limits = limits.orDefault()
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ErrorLog:          log.New(&tlsHandshakeFilter{}, "", 0),
+		ReadHeaderTimeout: limits.readHeaderTimeout,
+		ReadTimeout:       limits.readTimeout,
+		WriteTimeout:      timeouts.longest() + timeoutGrace,
+		IdleTimeout:       limits.idleTimeout,
+		MaxHeaderBytes:    limits.maxHeaderBytes,
 	}
 }
 
 func newOscarRouter(p *serverProviders) http.Handler {
 	r := mux.NewRouter()
 	r.HandleFunc("/server-info", serverInfoHandler).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/readyz", readyzHandler).Methods(http.MethodGet)
+	r.Handle("/metrics", p.adminMiddleware(http.HandlerFunc(metricsHandler))).Methods(http.MethodGet)
 	r.HandleFunc("/log-level", logLevelHandler).Methods(http.MethodGet, http.MethodOptions)
-	// r.HandleFunc("/log-level", setLogLevelHandler).Methods(http.MethodPut, http.MethodOptions)
-	v1 := r.PathPrefix("/1").Subrouter()
-
-	v1.Handle("/users", sessionHandler(searchUsersHandler)).Methods(http.MethodGet, http.MethodOptions)
-	v1.HandleFunc("/users", createUserHandler).Methods(http.MethodPost, http.MethodOptions)
-	v1.Handle("/users/me/apns-tokens", sessionHandler(addAPNSTokenHandler)).Methods(http.MethodPost, http.MethodOptions)
-	v1.Handle("/users/me/apns-tokens/{token}", sessionHandler(deleteAPNSTokenHandler)).Methods(http.MethodDelete, http.MethodOptions)
-	v1.Handle("/users/me/fcm-tokens", sessionHandler(addFCMTokenHandler)).Methods(http.MethodPost, http.MethodOptions)
-	v1.Handle("/users/me/fcm-tokens/{token}", sessionHandler(deleteFCMTokenHandler)).Methods(http.MethodDelete, http.MethodOptions)
-	v1.Handle("/users/me/backup", sessionHandler(retrieveBackupHandler)).Methods(http.MethodGet, http.MethodOptions)
-	v1.Handle("/users/me/backup", sessionHandler(saveBackupHandler)).Methods(http.MethodPut, http.MethodOptions)
-	v1.Handle("/users/{public_id}", sessionHandler(getUserInfoHandler)).Methods(http.MethodGet, http.MethodOptions)
-	v1.Handle("/users/{public_id}/messages", sessionHandler(sendMessageToUserHandler)).Methods(http.MethodPost, http.MethodOptions)
-	v1.HandleFunc("/users/{public_id}/public-key", getUserPublicKeyHandler).Methods(http.MethodGet, http.MethodOptions)
-
-	v1.Handle("/messages", sessionHandler(getMessagesHandler)).Methods(http.MethodGet, http.MethodOptions)
-	v1.Handle("/messages/{message_id:[0-9]+}", sessionHandler(getMessageHandler)).Methods(http.MethodGet, http.MethodOptions)
-	v1.Handle("/messages/{message_id:[0-9]+}", sessionHandler(deleteMessageHandler)).Methods(http.MethodDelete, http.MethodOptions)
-
-	// this has to come first, so it has a chance to match before the box_id urls
-	v1.HandleFunc("/drop-boxes/watch", createPackageWatcherHandler).Methods(http.MethodGet, http.MethodOptions)
-	v1.Handle("/drop-boxes/send", sessionHandler(sendMultiplePackagesHandler)).Methods(http.MethodPost, http.MethodOptions)
-	v1.Handle("/drop-boxes/{box_id}", sessionHandler(pickUpPackageHandler)).Methods(http.MethodGet, http.MethodOptions)
-	v1.Handle("/drop-boxes/{box_id}", sessionHandler(dropPackageHandler)).Methods(http.MethodPut, http.MethodOptions)
-
-	v1.HandleFunc("/public-key", getServerPublicKeyHandler).Methods(http.MethodGet, http.MethodOptions)
-
-	// We have to name the tickets endpoint with something that isn't a valid username, otherwise we would have just used /tickets
-	v1.Handle("/sessions/expiring-tickets", sessionHandler(createTicketHandler)).Methods(http.MethodPost, http.MethodOptions)
-	v1.HandleFunc("/sessions/{username}/challenge", createAuthChallengeHandler).Methods(http.MethodPost, http.MethodOptions)
-	v1.HandleFunc("/sessions/{username}/challenge-response", finishAuthChallengeHandler).Methods(http.MethodPost, http.MethodOptions)
-
-	v1.HandleFunc("/sockets", createSocketHandler).Methods(http.MethodGet, http.MethodOptions)
-
-	v1.HandleFunc("/email-verifications", verifyEmailHandler).Methods(http.MethodPost, http.MethodOptions)
-	v1.HandleFunc("/email-verifications/{token}", disavowEmailHandler).Methods(http.MethodDelete, http.MethodOptions)
-
-	v1.HandleFunc("/goroutine-stacks", goroutineStacksHandler).Methods(http.MethodGet, http.MethodOptions)
-	v1.HandleFunc("/logs", recordLogMessageHandler).Methods(http.MethodGet, http.MethodOptions)
+
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(p.adminMiddleware)
+	admin.HandleFunc("/log-level", setLogLevelHandler).Methods(http.MethodPut)
+	admin.HandleFunc("/debug-captures/{public_id}", startDebugCaptureHandler).Methods(http.MethodPost)
+	admin.HandleFunc("/debug-captures/{public_id}", debugCaptureHandler).Methods(http.MethodGet)
+	admin.HandleFunc("/debug-captures/{public_id}", deleteDebugCaptureHandler).Methods(http.MethodDelete)
+	admin.HandleFunc("/emails/{name}", previewEmailHandler).Methods(http.MethodGet)
+	admin.HandleFunc("/emails/{name}/test-send", testSendEmailHandler).Methods(http.MethodPost)
+	admin.HandleFunc("/email-events", emailEventsHandler).Methods(http.MethodGet)
+	admin.HandleFunc("/email-queue", emailQueueHandler).Methods(http.MethodGet)
+	admin.HandleFunc("/email-queue/dead-letters/{id}", deleteDeadLetterHandler).Methods(http.MethodDelete)
+	admin.HandleFunc("/file-gc", fileGCStatsHandler).Methods(http.MethodGet)
+	admin.HandleFunc("/incident", setIncidentHandler).Methods(http.MethodPut)
+	admin.HandleFunc("/incident", clearIncidentHandler).Methods(http.MethodDelete)
+	admin.HandleFunc("/kv-snapshot", kvSnapshotHandler).Methods(http.MethodGet)
+	admin.HandleFunc("/kv-stats", kvStatsHandler).Methods(http.MethodGet)
+	admin.HandleFunc("/login-lockouts", loginLockoutsHandler).Methods(http.MethodGet)
+	admin.HandleFunc("/login-lockouts/addresses/{address}", clearAddressLockoutHandler).Methods(http.MethodDelete)
+	admin.HandleFunc("/login-lockouts/users/{username}", clearAccountLockoutHandler).Methods(http.MethodDelete)
+	admin.HandleFunc("/outbox", outboxStatsHandler).Methods(http.MethodGet)
+	admin.HandleFunc("/reserved-usernames", reserveUsernamesHandler).Methods(http.MethodPost)
+	admin.HandleFunc("/reserved-usernames", reservedUsernamesHandler).Methods(http.MethodGet)
+	admin.HandleFunc("/reserved-usernames/{username}", deleteReservedUsernameHandler).Methods(http.MethodDelete)
+	admin.HandleFunc("/sessions", sessionStatsHandler).Methods(http.MethodGet)
+	admin.HandleFunc("/sockets", socketsHandler).Methods(http.MethodGet)
+	admin.HandleFunc("/symmetric-keys", symmetricKeysHandler).Methods(http.MethodGet)
+	admin.HandleFunc("/users", recentUsersHandler).Methods(http.MethodGet)
+	admin.HandleFunc("/users/import", importUsersHandler).Methods(http.MethodPost)
+	admin.HandleFunc("/users/{username}/ban", banUserHandler).Methods(http.MethodPost)
+	admin.HandleFunc("/users/{username}/reinstate", reinstateUserHandler).Methods(http.MethodPost)
+	admin.HandleFunc("/users/{username}/suspend", suspendUserHandler).Methods(http.MethodPost)
+
+	registerAPIRoutes(r, apiRoutes())
 
 	r.NotFoundHandler = http.HandlerFunc(notFoundHandler)
 	r.MethodNotAllowedHandler = http.HandlerFunc(notFoundHandler)
 
-	r.Use(logMiddleware, corsMiddleware, p.Middleware)
+	// replicas proxy writes before anything else happens to them, so the
+	// primary's middleware handles them the same as direct requests. They
+	// throttle their clients first, and the primary sees the clients'
+	// addresses when it trusts the replicas.
+	r.Use(p.trustedReplicas.Middleware, logMiddleware, p.rateLimits.Middleware, p.replica.Middleware, corsMiddleware, p.clientVersions.Middleware, p.timeouts.Middleware, p.Middleware)
 
 	return r
 }
@@ -1,16 +1,22 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"zood.dev/oscar/encodable"
+	"zood.dev/oscar/kvstor"
 	"zood.dev/oscar/model"
+	"zood.dev/oscar/push"
+	"zood.dev/oscar/sodium"
 )
 
 // Message ...
@@ -22,6 +28,95 @@ type Message struct {
 	CipherText     encodable.Bytes `json:"cipher_text"`
 	Nonce          encodable.Bytes `json:"nonce"`
 	SentDate       int64           `json:"sent_date"`
+	// SealedSender is set when the message was sent anonymously with a
+	// delivery token. The sender is only identified inside CipherText.
+	SealedSender bool `json:"sealed_sender,omitempty"`
+	// System is set when the server sent the message, to tell the user about
+	// activity on their account. CipherText is boxed to the recipient's
+	// public key with the server's key pair.
+	System bool `json:"system,omitempty"`
+	// SealedEnvelope is set instead of the fields above when the message was
+	// stored sealed to the recipient's public key. It holds an ephemeral
+	// public key followed by the box of the sealedEnvelope JSON. Nonce holds
+	// the box's nonce.
+	SealedEnvelope encodable.Bytes `json:"sealed_envelope,omitempty"`
+}
+
+// sealedEnvelope is the part of a message that is hidden from the server
+// while it is stored
+type sealedEnvelope struct {
+	SenderID   encodable.Bytes `json:"sender_id"`
+	CipherText encodable.Bytes `json:"cipher_text"`
+	Nonce      encodable.Bytes `json:"nonce"`
+	SentDate   int64           `json:"sent_date"`
+	// SealedSender is set when the sender is only identified inside CipherText
+	SealedSender bool `json:"sealed_sender,omitempty"`
+	System       bool `json:"system,omitempty"`
+}
+
+// sealMessage boxes the envelope of msg to recipientPubKey using an ephemeral
+// key pair, so only the recipient can open it.
+func sealMessage(msg Message, recipientPubKey []byte) (envelope, nonce []byte, err error) {
+	buf, err := json.Marshal(sealedEnvelope{
+		SenderID:     msg.PublicSenderID,
+		CipherText:   msg.CipherText,
+		Nonce:        msg.Nonce,
+		SentDate:     msg.SentDate,
+		SealedSender: msg.SealedSender,
+		System:       msg.System,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ephemeral, err := sodium.NewKeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+	ct, nonce, err := sodium.PublicKeyEncrypt(buf, recipientPubKey, ephemeral.Secret)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return append(ephemeral.Public, ct...), nonce, nil
+}
+
+// messageFromRecord converts a stored message into the form sent to clients
+func messageFromRecord(kvs kvstor.Provider, rec model.MessageRecord) (Message, error) {
+	if rec.Sealed {
+		return Message{
+			ID:             rec.ID,
+			RecipientID:    rec.RecipientID,
+			Nonce:          rec.Nonce,
+			SealedEnvelope: rec.CipherText,
+		}, nil
+	}
+
+	msg := Message{
+		ID:          rec.ID,
+		RecipientID: rec.RecipientID,
+		CipherText:  rec.CipherText,
+		Nonce:       rec.Nonce,
+		SentDate:    rec.SentDate,
+		System:      rec.System,
+	}
+	// messages without a sender were sent with sealed sender, unless the
+	// server sent them
+	if rec.System {
+		return msg, nil
+	}
+	if rec.SenderID == 0 {
+		msg.SealedSender = true
+		return msg, nil
+	}
+
+	pubID, err := kvs.PublicIDFromUserID(rec.SenderID)
+	if err != nil {
+		return Message{}, err
+	}
+	msg.SenderID = rec.SenderID
+	msg.PublicSenderID = pubID
+	return msg, nil
 }
 
 // sendMessageToUserHandler handles POST /users/{public_id}/messages
@@ -39,14 +134,28 @@ func sendMessageToUserHandler(w http.ResponseWriter, r *http.Request) {
 		Nonce      encodable.Bytes `json:"nonce"`
 		Urgent     bool            `json:"urgent"`
 		Transient  bool            `json:"transient"`
+		Priority   string          `json:"priority"`
+		CollapseID string          `json:"collapse_id"`
 	}{}
 	err := json.NewDecoder(r.Body).Decode(&body)
 	if err != nil {
 		sendBadReq(w, "unable to decode body: "+err.Error())
 		return
 	}
+	notify, err := notificationOptions(body.Urgent, body.Priority, body.CollapseID)
+	if err != nil {
+		sendBadReq(w, err.Error())
+		return
+	}
 
 	providers := providersCtx(r.Context())
+	if !checkPayloadSize(w, providers.padding, len(body.CipherText)) {
+		return
+	}
+	in := ingress{Kind: ingressMessage, SenderID: sessionUserID, RecipientID: userID, Size: len(body.CipherText)}
+	if !checkIngress(w, r, providers.ingressPolicies, in) {
+		return
+	}
 	db := providers.db
 	if shouldLogInfo() {
 		log.Printf("send_message: %s => %s (urgent? %t, transient? %t)",
@@ -55,28 +164,82 @@ func sendMessageToUserHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	kvs := providers.kvs
+	now := providers.now()
 	msg := Message{}
+	msg.SenderID = sessionUserID
 	msg.CipherText = body.CipherText
 	msg.Nonce = body.Nonce
+	msg.SentDate = now.Unix()
 	msg.PublicSenderID, err = kvs.PublicIDFromUserID(sessionUserID)
 	if err != nil {
 		sendInternalErr(w, err)
 		return
 	}
 
-	if !body.Transient {
-		msg.ID, err = db.InsertMessage(userID, sessionUserID, body.CipherText, body.Nonce, time.Now().Unix())
-		if err != nil {
-			sendInternalErr(w, err)
-			return
+	sendAndDeliver(w, providers, userID, msg, body.Urgent, body.Transient, notify, now)
+}
+
+// notificationOptions returns how a message is pushed to the recipient's
+// devices, or nil when it's only published to their open sockets. Urgent
+// messages are pushed at high priority, unless the sender asked for another
+// one. The others are only pushed when the sender asked for a priority.
+// Pushes with the same collapse id replace each other on the device, which
+// suits updates that make the previous ones moot, like locations.
+func notificationOptions(urgent bool, priority, collapseID string) (*push.Options, error) {
+	if len(collapseID) > push.MaxCollapseIDLength {
+		return nil, fmt.Errorf("collapse_id is longer than %d bytes", push.MaxCollapseIDLength)
+	}
+	opts := push.Options{Priority: push.PriorityHigh, CollapseID: collapseID}
+	switch priority {
+	case "":
+		if !urgent {
+			return nil, nil
 		}
+	case "high":
+	case "normal":
+		opts.Priority = push.PriorityNormal
+	default:
+		return nil, fmt.Errorf("priority must be 'high' or 'normal', not '%s'", priority)
 	}
+	return &opts, nil
+}
 
-	sendSuccess(w, nil)
+// sendResultEvictedOldest is the result of a send that made room in the
+// recipient's full queue by evicting their oldest message that wasn't
+// urgent
+const sendResultEvictedOldest = "evicted_oldest"
 
-	go func() {
-		pushMessageToUser(db, msg, userID, body.Urgent)
-	}()
+// sendAndDeliver stores msg to recipientID, unless it's transient, responds,
+// and then delivers it, pushing it with notify if it's not nil. Stored
+// messages are delivered through the outbox. Transient ones aren't kept
+// anywhere, so they're delivered best effort.
+func sendAndDeliver(w http.ResponseWriter, providers *serverProviders, recipientID int64, msg Message, urgent, transient bool, notify *push.Options, now time.Time) {
+	if transient {
+		sendSuccess(w, nil)
+		go pushMessageToUser(providers.detached(), msg, recipientID, notify)
+		return
+	}
+
+	entryID, evictedID, err := storeMessage(providers, recipientID, &msg, urgent, notify, now)
+	if err == model.ErrQueueFull {
+		sendErr(w, "The recipient's message queue is full", http.StatusTooManyRequests, errorRecipientQueueFull)
+		return
+	}
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if evictedID == 0 {
+		sendSuccess(w, nil)
+	} else {
+		if shouldLogInfo() {
+			log.Printf("send_message: evicted message %d of %d for an urgent one", evictedID, recipientID)
+		}
+		sendSuccess(w, struct {
+			Result string `json:"result"`
+		}{Result: sendResultEvictedOldest})
+	}
+	go deliverOutboxEntry(providers.detached(), entryID, msg, recipientID, notify)
 }
 
 // getMessageHandler handles GET /messages/{message_id}
@@ -106,60 +269,182 @@ func getMessageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	kvs := providers.kvs
-	pubID, err := kvs.PublicIDFromUserID(rec.SenderID)
+	msg, err := messageFromRecord(providers.kvs, *rec)
 	if err != nil {
 		sendInternalErr(w, err)
 		return
 	}
-	msg := Message{
-		ID:             rec.ID,
-		RecipientID:    rec.RecipientID,
-		SenderID:       rec.SenderID,
-		CipherText:     rec.CipherText,
-		Nonce:          rec.Nonce,
-		SentDate:       rec.SentDate,
-		PublicSenderID: pubID,
-	}
 
 	sendSuccess(w, msg)
 }
 
-// getMessagesHandler handles GET /messages
+// maxMessageIDs is the most messages that can be requested by id at once
+const maxMessageIDs = 100
+
+// parseMessageIDs parses a comma separated list of message ids, dropping
+// duplicates
+func parseMessageIDs(s string) ([]int64, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) > maxMessageIDs {
+		return nil, fmt.Errorf("at most %d ids can be requested", maxMessageIDs)
+	}
+	ids := make([]int64, 0, len(parts))
+	seen := make(map[int64]bool, len(parts))
+	for _, p := range parts {
+		id, err := strconv.ParseInt(strings.TrimSpace(p), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid message id '%s'", p)
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// getMessagesHandler handles GET /messages. When the 'ids' query parameter
+// holds a comma separated list of message ids, only those messages are
+// returned. Ids that don't match a message of the user are skipped.
 func getMessagesHandler(w http.ResponseWriter, r *http.Request) {
 	userID := userIDFromContext(r.Context())
 	providers := providersCtx(r.Context())
 	db := providers.db
+
+	if idsStr, ok := r.URL.Query()["ids"]; ok {
+		ids, err := parseMessageIDs(strings.Join(idsStr, ","))
+		if err != nil {
+			sendBadReq(w, err.Error())
+			return
+		}
+		if shouldLogInfo() {
+			log.Printf("get_messages: %s %v", db.Username(userID), ids)
+		}
+		records, err := db.MessagesToRecipient(userID, ids)
+		if err != nil {
+			sendInternalErr(w, err)
+			return
+		}
+		streamMessages(w, providers.kvs, func(fn func(model.MessageRecord) error) error {
+			for _, rec := range records {
+				if err := fn(rec); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		return
+	}
+
 	if shouldLogInfo() {
 		log.Printf("get_messages: %s", db.Username(userID))
 	}
+	streamMessages(w, providers.kvs, func(fn func(model.MessageRecord) error) error {
+		return db.EachMessageRecord(userID, fn)
+	})
+}
 
-	records, err := db.MessageRecords(userID)
-	if err != nil {
-		sendInternalErr(w, err)
-		return
-	}
-	kvs := providers.kvs
-	msgs := make([]Message, 0)
-	for _, r := range records {
-		pubID, err := kvs.PublicIDFromUserID(r.SenderID)
-		if err != nil {
+// messageFetchWorkers is how many messages of a fetch are prepared at once
+const messageFetchWorkers = 8
+
+// errFetchAborted stops the records of a fetch from being read once the
+// response has failed
+var errFetchAborted = errors.New("the fetch was aborted")
+
+// preparedMessage is a message of a fetch, encoded and ready to be written
+type preparedMessage struct {
+	buf []byte
+	err error
+}
+
+// streamMessages writes the messages of the records that each yields as a
+// JSON array, while they're still being read. Up to messageFetchWorkers of
+// them are prepared at once, since each can need a lookup of its sender.
+// The response starts with the first message, so a failure before then is
+// an internal error. Afterwards it can only be logged, and the client sees
+// a truncated array.
+func streamMessages(w http.ResponseWriter, kvs kvstor.Provider, each func(fn func(model.MessageRecord) error) error) {
+	// each record gets a channel for its result, queued in the order of the
+	// records, so the messages are written in that order however the
+	// workers finish. The queue bounds the messages in flight.
+	pending := make(chan chan preparedMessage, messageFetchWorkers)
+	aborted := make(chan struct{})
+	var eachErr error
+	go func() {
+		defer close(pending)
+		eachErr = each(func(rec model.MessageRecord) error {
+			result := make(chan preparedMessage, 1)
+			select {
+			case pending <- result:
+			case <-aborted:
+				return errFetchAborted
+			}
+			go func() {
+				msg, err := messageFromRecord(kvs, rec)
+				if err != nil {
+					result <- preparedMessage{err: err}
+					return
+				}
+				buf, err := json.Marshal(msg)
+				result <- preparedMessage{buf: buf, err: err}
+			}()
+			return nil
+		})
+	}()
+
+	started := false
+	abort := func(err error) {
+		close(aborted)
+		// let the reading finish, so it's done with the database
+		for range pending {
+		}
+		if started {
+			logErr(fmt.Errorf("streaming messages: %w", err))
+		} else {
 			sendInternalErr(w, err)
+		}
+	}
+	for result := range pending {
+		prepared := <-result
+		if prepared.err != nil {
+			abort(prepared.err)
+			return
+		}
+		sep := []byte(",")
+		if !started {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			started = true
+			sep = []byte("[")
+		}
+		if _, err := w.Write(append(sep, prepared.buf...)); err != nil {
+			abort(err)
 			return
 		}
-		msg := Message{
-			ID:             r.ID,
-			RecipientID:    r.RecipientID,
-			SenderID:       r.SenderID,
-			CipherText:     r.CipherText,
-			Nonce:          r.Nonce,
-			SentDate:       r.SentDate,
-			PublicSenderID: pubID,
+		// the first message goes out right away, rather than once the
+		// buffer of the connection fills up
+		if sep[0] == '[' {
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
 		}
-		msgs = append(msgs, msg)
 	}
-
-	sendSuccess(w, msgs)
+	if eachErr != nil {
+		if started {
+			logErr(fmt.Errorf("streaming messages: %w", eachErr))
+		} else {
+			sendInternalErr(w, eachErr)
+		}
+		return
+	}
+	if !started {
+		sendSuccess(w, []Message{})
+		return
+	}
+	// match the output of json.Encoder used by sendSuccess
+	if _, err := w.Write([]byte("]\n")); err != nil {
+		logErr(fmt.Errorf("streaming messages: %w", err))
+	}
 }
 
 // handles DELETE /messages/{message_id}
@@ -188,7 +473,42 @@ func deleteMessageHandler(w http.ResponseWriter, r *http.Request) {
 	sendSuccess(w, nil)
 }
 
-func pushMessageToUser(db model.Provider, msg Message, userID int64, urgent bool) {
+// ackMessagesHandler handles DELETE /messages?ids=1,2,3. It acknowledges
+// receipt of a batch of messages, deleting all of them at once, so clients
+// don't have to delete each message they fetch.
+func ackMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromContext(r.Context())
+	idsStr, ok := r.URL.Query()["ids"]
+	if !ok {
+		sendBadReq(w, "missing 'ids' of the messages to acknowledge")
+		return
+	}
+	ids, err := parseMessageIDs(strings.Join(idsStr, ","))
+	if err != nil {
+		sendBadReq(w, err.Error())
+		return
+	}
+
+	db := providersCtx(r.Context()).db
+	if shouldLogInfo() {
+		log.Printf("ack_messages: %s %v", db.Username(userID), ids)
+	}
+
+	deleted, err := db.DeleteMessagesToRecipient(userID, ids)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+
+	sendSuccess(w, struct {
+		Deleted int64 `json:"deleted"`
+	}{Deleted: deleted})
+}
+
+// pushMessageToUser publishes msg to the open sockets of userID, and pushes
+// it with notify if it's not nil. It runs after the response has been sent,
+// so the pushes aren't bound to a request.
+func pushMessageToUser(providers *serverProviders, msg Message, userID int64, notify *push.Options) {
 	msgMap := map[string]interface{}{
 		"id":          strconv.FormatInt(msg.ID, 10),
 		"cipher_text": msg.CipherText,
@@ -197,6 +517,19 @@ func pushMessageToUser(db model.Provider, msg Message, userID int64, urgent bool
 		"sent_date":   strconv.FormatInt(msg.SentDate, 10),
 		"type":        "message_received",
 	}
+	if msg.SealedSender {
+		msgMap["sealed_sender"] = true
+	}
+	// messages recovered from the outbox of a server that seals them are
+	// only known sealed
+	if len(msg.SealedEnvelope) > 0 {
+		msgMap = map[string]interface{}{
+			"id":              strconv.FormatInt(msg.ID, 10),
+			"nonce":           msg.Nonce,
+			"sealed_envelope": msg.SealedEnvelope,
+			"type":            "message_received",
+		}
+	}
 
 	buf, err := json.Marshal(msgMap)
 	if err != nil {
@@ -205,16 +538,16 @@ func pushMessageToUser(db model.Provider, msg Message, userID int64, urgent bool
 	}
 
 	// try to publish it directly via socket
-	messagesPubSub.Pub(buf, userID)
+	messagesPubSub.Pub(providers.padding.padJSON(buf), userID)
 
-	// only bother pushing via FCM or APNS if it's urgent
-	if !urgent {
+	if notify == nil {
 		return
 	}
 
 	if len(buf) <= 3584 {
-		sendFirebaseMessage(db, userID, msgMap, urgent)
-		sendAPNSMessage(db, userID, msgMap)
+		for _, p := range providers.pushers {
+			p.push(context.Background(), providers.db, userID, msgMap, *notify)
+		}
 		return
 	}
 
@@ -228,6 +561,7 @@ func pushMessageToUser(db model.Provider, msg Message, userID int64, urgent bool
 		Type      string `json:"type"`
 		MessageID string `json:"message_id"`
 	}{Type: "message_sync_needed", MessageID: strconv.FormatInt(msg.ID, 10)}
-	sendFirebaseMessage(db, userID, syncPayload, urgent)
-	sendAPNSMessage(db, userID, syncPayload)
+	for _, p := range providers.pushers {
+		p.push(context.Background(), providers.db, userID, syncPayload, *notify)
+	}
 }
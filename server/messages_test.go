@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/apierr"
+	"zood.dev/oscar/encodable"
+	"zood.dev/oscar/kvstor"
+	"zood.dev/oscar/model"
+	"zood.dev/oscar/push"
+	"zood.dev/oscar/sodium"
+)
+
+func TestSealedMessageStorage(t *testing.T) {
+	providers := createTestProviders(t)
+	providers.sealMessages = true
+	recipient, recipientKeys := createTestUser(t, providers)
+	sender, _ := createTestUser(t, providers)
+
+	senderPubID, err := providers.kvs.PublicIDFromUserID(sender.ID)
+	require.NoError(t, err)
+	msg := Message{
+		PublicSenderID: senderPubID,
+		CipherText:     []byte("cipher-text"),
+		Nonce:          []byte("nonce"),
+		SentDate:       1234,
+	}
+	_, _, err = storeMessage(providers, recipient.ID, &msg, false, nil, time.Now())
+	require.NoError(t, err)
+
+	rec, err := providers.db.MessageToRecipient(recipient.ID, msg.ID)
+	require.NoError(t, err)
+	require.True(t, rec.Sealed)
+	require.Zero(t, rec.SenderID)
+
+	// only the recipient can open what's delivered
+	delivered, err := messageFromRecord(providers.kvs, *rec)
+	require.NoError(t, err)
+	ephemeralPubKey := delivered.SealedEnvelope[:sodium.PublicKeySize]
+	ct := delivered.SealedEnvelope[sodium.PublicKeySize:]
+	buf, ok := sodium.PublicKeyDecrypt(ct, delivered.Nonce, ephemeralPubKey, recipientKeys.Secret)
+	require.True(t, ok)
+
+	envelope := sealedEnvelope{}
+	require.NoError(t, json.Unmarshal(buf, &envelope))
+	require.Equal(t, msg.CipherText, envelope.CipherText)
+	require.Equal(t, msg.Nonce, envelope.Nonce)
+	require.Equal(t, msg.SentDate, envelope.SentDate)
+	require.Equal(t, senderPubID, []byte(envelope.SenderID))
+}
+
+func TestRecipientQueueLimit(t *testing.T) {
+	providers := createTestProviders(t)
+	providers.maxQueuedMessages = 2
+	sender, keyPair := createTestUser(t, providers)
+	recipient, _ := createTestUser(t, providers)
+	token := loginTestUser(t, providers, sender, keyPair)
+	router := newOscarRouter(providers)
+
+	send := func(urgent bool) *httptest.ResponseRecorder {
+		buf, err := json.Marshal(map[string]interface{}{
+			"cipher_text": encodable.Bytes("cipher-text"),
+			"nonce":       encodable.Bytes("nonce"),
+			"urgent":      urgent,
+		})
+		require.NoError(t, err)
+		r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/1/users/%s/messages", hex.EncodeToString(recipient.PublicID)), bytes.NewReader(buf))
+		r.Header.Set("X-Oscar-Access-Token", token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		w := send(false)
+		require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	}
+	msgs, err := providers.db.MessageRecords(recipient.ID)
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+
+	w := send(false)
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	body := apierr.Body{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+	require.Equal(t, errorRecipientQueueFull, body.Code)
+
+	// an urgent message takes the place of the oldest one, and the sender
+	// is told
+	w = send(true)
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	result := struct {
+		Result string `json:"result"`
+	}{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&result))
+	require.Equal(t, sendResultEvictedOldest, result.Result)
+	remaining, err := providers.db.MessageRecords(recipient.ID)
+	require.NoError(t, err)
+	require.Len(t, remaining, 2)
+	require.NotEqual(t, msgs[0].ID, remaining[0].ID)
+	require.Equal(t, msgs[1].ID, remaining[0].ID)
+	require.True(t, remaining[1].Urgent)
+}
+
+func TestGetMessagesByID(t *testing.T) {
+	providers := createTestProviders(t)
+	router := newOscarRouter(providers)
+	recipient, keyPair := createTestUser(t, providers)
+	token := loginTestUser(t, providers, recipient, keyPair)
+	other, _ := createTestUser(t, providers)
+
+	var ids []int64
+	for i := 0; i < 3; i++ {
+		id, err := providers.db.InsertMessage(recipient.ID, other.ID, []byte("cipher-text"), []byte("nonce"), 1234)
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+	othersID, err := providers.db.InsertMessage(other.ID, recipient.ID, []byte("cipher-text"), []byte("nonce"), 1234)
+	require.NoError(t, err)
+
+	get := func(query string) (int, []Message) {
+		r := httptest.NewRequest(http.MethodGet, "/1/messages?ids="+query, nil)
+		r.Header.Set("X-Oscar-Access-Token", token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		var msgs []Message
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&msgs))
+		}
+		return w.Code, msgs
+	}
+
+	// another user's message and duplicates are skipped
+	code, msgs := get(fmt.Sprintf("%d,%d,%d,%d", ids[2], othersID, ids[0], ids[2]))
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, msgs, 2)
+	require.Equal(t, ids[0], msgs[0].ID)
+	require.Equal(t, ids[2], msgs[1].ID)
+
+	code, _ = get("1,two")
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = get(strings.Repeat("1,", maxMessageIDs) + "1")
+	require.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestGetMessagesStreams(t *testing.T) {
+	providers := createTestProviders(t)
+	router := newOscarRouter(providers)
+	recipient, keyPair := createTestUser(t, providers)
+	token := loginTestUser(t, providers, recipient, keyPair)
+	other, _ := createTestUser(t, providers)
+
+	get := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/1/messages", nil)
+		r.Header.Set("X-Oscar-Access-Token", token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get()
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "[]\n", w.Body.String())
+
+	// more messages than there are workers preparing them
+	var ids []int64
+	for i := 0; i < 3*messageFetchWorkers; i++ {
+		var id int64
+		var err error
+		if i%3 == 0 {
+			id, err = providers.db.InsertSealedMessage(recipient.ID, []byte("envelope"), []byte("nonce"))
+		} else {
+			id, err = providers.db.InsertMessage(recipient.ID, other.ID, []byte("cipher-text"), []byte("nonce"), int64(i))
+		}
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+
+	w = get()
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	require.True(t, strings.HasSuffix(w.Body.String(), "]\n"))
+	var msgs []Message
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &msgs))
+	require.Len(t, msgs, len(ids))
+	for i, msg := range msgs {
+		require.Equal(t, ids[i], msg.ID)
+		if i%3 == 0 {
+			require.Equal(t, []byte("envelope"), []byte(msg.SealedEnvelope))
+		} else {
+			require.Equal(t, []byte(other.PublicID), []byte(msg.PublicSenderID))
+			require.Equal(t, int64(i), msg.SentDate)
+		}
+	}
+}
+
+// pausedMessages holds back every message record after the first, until
+// release is closed
+type pausedMessages struct {
+	model.Provider
+	release chan struct{}
+}
+
+func (pm pausedMessages) WithContext(ctx context.Context) model.Provider {
+	return pausedMessages{Provider: pm.Provider.WithContext(ctx), release: pm.release}
+}
+
+func (pm pausedMessages) EachMessageRecord(userID int64, fn func(model.MessageRecord) error) error {
+	first := true
+	return pm.Provider.EachMessageRecord(userID, func(rec model.MessageRecord) error {
+		if !first {
+			<-pm.release
+		}
+		first = false
+		return fn(rec)
+	})
+}
+
+func TestGetMessagesStreamsThroughRouter(t *testing.T) {
+	providers := createTestProviders(t)
+	recipient, keyPair := createTestUser(t, providers)
+	token := loginTestUser(t, providers, recipient, keyPair)
+	other, _ := createTestUser(t, providers)
+	for i := 0; i < 2; i++ {
+		_, err := providers.db.InsertMessage(recipient.ID, other.ID, []byte("cipher-text"), []byte("nonce"), int64(i))
+		require.NoError(t, err)
+	}
+	release := make(chan struct{})
+	providers.db = pausedMessages{Provider: providers.db, release: release}
+	srv := httptest.NewServer(newOscarRouter(providers))
+	defer srv.Close()
+
+	r, err := http.NewRequest(http.MethodGet, srv.URL+"/1/messages", nil)
+	require.NoError(t, err)
+	r.Header.Set("X-Oscar-Access-Token", token)
+	resp, err := http.DefaultClient.Do(r)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// the first message arrives while the rest are still being read, so
+	// none of the middleware buffers the response
+	dec := json.NewDecoder(resp.Body)
+	first := make(chan error, 1)
+	go func() {
+		if _, err := dec.Token(); err != nil {
+			first <- err
+			return
+		}
+		first <- dec.Decode(&Message{})
+	}()
+	select {
+	case err = <-first:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("the first message wasn't sent before the response completed")
+	}
+	close(release)
+	require.True(t, dec.More())
+	require.NoError(t, dec.Decode(&Message{}))
+	require.False(t, dec.More())
+}
+
+func TestStreamMessagesFailures(t *testing.T) {
+	providers := createTestProviders(t)
+	records := func(n int, err error) func(fn func(model.MessageRecord) error) error {
+		return func(fn func(model.MessageRecord) error) error {
+			for i := 1; i <= n; i++ {
+				rec := model.MessageRecord{ID: int64(i), CipherText: []byte("ct"), Nonce: []byte("nonce"), Sealed: true}
+				if err := fn(rec); err != nil {
+					return err
+				}
+			}
+			return err
+		}
+	}
+
+	// nothing was written yet, so the failure is reported
+	w := httptest.NewRecorder()
+	streamMessages(w, providers.kvs, records(0, errors.New("db is down")))
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+
+	// afterwards, the array is cut short
+	w = httptest.NewRecorder()
+	streamMessages(w, providers.kvs, records(3, errors.New("db is down")))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.False(t, strings.HasSuffix(w.Body.String(), "]\n"))
+	require.Error(t, json.Unmarshal(w.Body.Bytes(), &[]Message{}))
+
+	// a sender that can't be looked up stops the stream
+	w = httptest.NewRecorder()
+	streamMessages(w, failingPublicIDs{providers.kvs}, func(fn func(model.MessageRecord) error) error {
+		return fn(model.MessageRecord{ID: 1, SenderID: 5000, CipherText: []byte("ct"), Nonce: []byte("nonce")})
+	})
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+// failingPublicIDs fails every lookup of a public id
+type failingPublicIDs struct {
+	kvstor.Provider
+}
+
+func (failingPublicIDs) PublicIDFromUserID(userID int64) ([]byte, error) {
+	return nil, errors.New("kv is down")
+}
+
+func TestAckMessages(t *testing.T) {
+	providers := createTestProviders(t)
+	router := newOscarRouter(providers)
+	recipient, keyPair := createTestUser(t, providers)
+	token := loginTestUser(t, providers, recipient, keyPair)
+	other, _ := createTestUser(t, providers)
+
+	var ids []int64
+	for i := 0; i < 2; i++ {
+		id, err := providers.db.InsertMessage(recipient.ID, other.ID, []byte("cipher-text"), []byte("nonce"), 1234)
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+	othersID, err := providers.db.InsertMessage(other.ID, recipient.ID, []byte("cipher-text"), []byte("nonce"), 1234)
+	require.NoError(t, err)
+
+	ack := func(query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodDelete, "/1/messages"+query, nil)
+		r.Header.Set("X-Oscar-Access-Token", token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	// acknowledging requires the ids, so a bare DELETE can't clear the inbox
+	require.Equal(t, http.StatusBadRequest, ack("").Code)
+
+	w := ack(fmt.Sprintf("?ids=%d,%d,%d", ids[0], ids[1], othersID))
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		Deleted int64 `json:"deleted"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	require.Equal(t, int64(2), resp.Deleted)
+
+	remaining, err := providers.db.MessageRecords(recipient.ID)
+	require.NoError(t, err)
+	require.Empty(t, remaining)
+	// another user's messages can't be acknowledged
+	rec, err := providers.db.MessageToRecipient(other.ID, othersID)
+	require.NoError(t, err)
+	require.NotNil(t, rec)
+}
+
+func TestNotificationOptions(t *testing.T) {
+	// without a priority, only urgent messages are pushed
+	notify, err := notificationOptions(false, "", "location")
+	require.NoError(t, err)
+	require.Nil(t, notify)
+	notify, err = notificationOptions(true, "", "")
+	require.NoError(t, err)
+	require.Equal(t, &push.Options{Priority: push.PriorityHigh}, notify)
+
+	notify, err = notificationOptions(false, "normal", "location")
+	require.NoError(t, err)
+	require.Equal(t, &push.Options{Priority: push.PriorityNormal, CollapseID: "location"}, notify)
+	notify, err = notificationOptions(true, "normal", "")
+	require.NoError(t, err)
+	require.Equal(t, push.PriorityNormal, notify.Priority)
+
+	_, err = notificationOptions(true, "urgent", "")
+	require.Error(t, err)
+	_, err = notificationOptions(true, "high", strings.Repeat("a", push.MaxCollapseIDLength+1))
+	require.Error(t, err)
+}
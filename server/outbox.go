@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"zood.dev/oscar/model"
+	"zood.dev/oscar/push"
+)
+
+// A stored message is written along with an outbox entry for publishing
+// and pushing it. The handler delivers it right after responding, and
+// removes the entry. Entries whose delivery never finished, because the
+// server stopped or crashed, are claimed and delivered by runOutbox, so a
+// recipient can get a notification twice, but never misses one.
+const (
+	// outboxLease is how long a delivery has to finish before its entry is
+	// claimed again
+	outboxLease = 30 * time.Second
+	// outboxPollInterval is how often runOutbox looks for leftover entries
+	outboxPollInterval = 10 * time.Second
+	outboxBatchSize    = 100
+	// maxOutboxAttempts is how often an entry is claimed before it's given
+	// up on. Delivering the same entry over and over means it stops the
+	// server every time.
+	maxOutboxAttempts = 5
+)
+
+// outboxRun counts what a pass over the outbox did
+type outboxRun struct {
+	Delivered int `json:"delivered"`
+	Dropped   int `json:"dropped"`
+}
+
+// outboxStats are the totals since the server started, reported by
+// GET /admin/outbox
+type outboxStats struct {
+	mu      sync.Mutex
+	total   outboxRun
+	lastRun time.Time
+}
+
+var outboxes = &outboxStats{}
+
+func (obs *outboxStats) record(run outboxRun, at time.Time) {
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	obs.total.Delivered += run.Delivered
+	obs.total.Dropped += run.Dropped
+	obs.lastRun = at
+}
+
+func (obs *outboxStats) get() (outboxRun, time.Time) {
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	return obs.total, obs.lastRun
+}
+
+// outboxPayload is what an outbox entry delivers. Entries from before push
+// options were kept have no Notify, and are pushed at high priority when
+// they're urgent.
+type outboxPayload struct {
+	Message
+	Notify *push.Options `json:"notify,omitempty"`
+}
+
+// storeMessage stores msg to recipientID along with the outbox entry for its
+// delivery with notify, and sets the id of msg. It returns the id of the
+// entry, and the id of the message evicted to make room for msg, or 0 if
+// none was. When the recipient's queue is full and msg can't evict one, the
+// error is model.ErrQueueFull.
+func storeMessage(providers *serverProviders, recipientID int64, msg *Message, urgent bool, notify *push.Options, now time.Time) (entryID, evictedID int64, err error) {
+	rec := model.MessageRecord{
+		RecipientID: recipientID,
+		SenderID:    msg.SenderID,
+		CipherText:  msg.CipherText,
+		Nonce:       msg.Nonce,
+		SentDate:    msg.SentDate,
+		System:      msg.System,
+		Urgent:      urgent,
+	}
+	// the entry holds the message as it's delivered. When messages are
+	// sealed, that's the sealed form, the way it's fetched, so the outbox
+	// reveals no more than the messages table.
+	delivered := *msg
+	if providers.sealMessages {
+		pubKey, err := providers.db.UserPublicKey(recipientID)
+		if err != nil {
+			return 0, 0, err
+		}
+		envelope, nonce, err := sealMessage(*msg, pubKey)
+		if err != nil {
+			return 0, 0, err
+		}
+		rec = model.MessageRecord{RecipientID: recipientID, CipherText: envelope, Nonce: nonce, Sealed: true, Urgent: urgent}
+		delivered = Message{Nonce: nonce, SealedEnvelope: envelope}
+	}
+	buf, err := json.Marshal(outboxPayload{Message: delivered, Notify: notify})
+	if err != nil {
+		return 0, 0, err
+	}
+	payload, err := providers.keys.seal(buf)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "sealing the outbox entry")
+	}
+
+	entry := model.OutboxRecord{
+		RecipientID: recipientID,
+		Payload:     payload,
+		Urgent:      urgent,
+		NextAttempt: now.Add(outboxLease).Unix(),
+	}
+	msgID, entryID, evictedID, err := providers.db.InsertMessageWithOutbox(rec, entry, providers.maxQueuedMessages)
+	if err != nil {
+		return 0, 0, err
+	}
+	msg.ID = msgID
+	return entryID, evictedID, nil
+}
+
+// deliverOutboxEntry publishes and pushes msg, and then removes the entry
+// it was stored with
+func deliverOutboxEntry(providers *serverProviders, entryID int64, msg Message, recipientID int64, notify *push.Options) {
+	pushMessageToUser(providers, msg, recipientID, notify)
+	if err := providers.db.DeleteOutboxEntry(entryID); err != nil {
+		logErr(err)
+	}
+}
+
+// openOutboxEntry recovers the message that entry delivers, and how it's
+// pushed
+func openOutboxEntry(kr *keyRing, entry model.OutboxRecord) (Message, *push.Options, error) {
+	buf, ok := kr.open(entry.Payload)
+	if !ok {
+		return Message{}, nil, errors.New("unable to open the outbox entry with any key in the ring")
+	}
+	payload := outboxPayload{}
+	if err := json.Unmarshal(buf, &payload); err != nil {
+		return Message{}, nil, errors.Wrap(err, "decoding the outbox entry")
+	}
+	msg := payload.Message
+	msg.ID = entry.MessageID
+	msg.RecipientID = entry.RecipientID
+	if payload.Notify == nil && entry.Urgent {
+		payload.Notify = &push.Options{Priority: push.PriorityHigh}
+	}
+	return msg, payload.Notify, nil
+}
+
+// outboxResealer moves the payloads of the outbox entries to the current
+// symmetric key
+type outboxResealer struct {
+	db model.Provider
+}
+
+func (or outboxResealer) name() string {
+	return "outbox entries"
+}
+
+// resealAll fulfills resealer. Entries no key opens are left to drainOutbox,
+// which drops them.
+func (or outboxResealer) resealAll(kr *keyRing) (int, error) {
+	n := 0
+	var afterID int64
+	for {
+		entries, err := or.db.OutboxEntries(afterID, outboxBatchSize)
+		if err != nil {
+			return n, err
+		}
+		for _, e := range entries {
+			afterID = e.ID
+			payload, changed, err := kr.reseal(e.Payload)
+			if err == errUnknownKey {
+				continue
+			}
+			if err != nil {
+				return n, err
+			}
+			if !changed {
+				continue
+			}
+			if err = or.db.UpdateOutboxPayload(e.ID, payload); err != nil {
+				return n, err
+			}
+			n++
+		}
+		if len(entries) < outboxBatchSize {
+			return n, nil
+		}
+	}
+}
+
+// countKeys fulfills keyCounter
+func (or outboxResealer) countKeys(now time.Time) (map[string]int, error) {
+	counts := map[string]int{}
+	var afterID int64
+	for {
+		entries, err := or.db.OutboxEntries(afterID, outboxBatchSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			afterID = e.ID
+			counts[sealedKeyID(e.Payload)]++
+		}
+		if len(entries) < outboxBatchSize {
+			return counts, nil
+		}
+	}
+}
+
+// drainOutbox delivers the outbox entries that were due at now, until none
+// are left
+func drainOutbox(providers *serverProviders, now time.Time) (outboxRun, error) {
+	run := outboxRun{}
+	for {
+		entries, err := providers.db.ClaimOutboxEntries(now.Unix(), now.Add(outboxLease).Unix(), outboxBatchSize)
+		if err != nil {
+			return run, errors.Wrap(err, "claiming outbox entries")
+		}
+		for _, e := range entries {
+			msg, notify, err := openOutboxEntry(providers.keys, e)
+			if err == nil && e.Attempts > maxOutboxAttempts {
+				err = errors.Errorf("gave up after %d attempts", maxOutboxAttempts)
+			}
+			if err != nil {
+				logErr(errors.Wrapf(err, "dropping outbox entry %d", e.ID))
+				if err = providers.db.DeleteOutboxEntry(e.ID); err != nil {
+					return run, err
+				}
+				run.Dropped++
+				continue
+			}
+			deliverOutboxEntry(providers, e.ID, msg, e.RecipientID, notify)
+			run.Delivered++
+		}
+		if len(entries) < outboxBatchSize {
+			return run, nil
+		}
+	}
+}
+
+// runOutbox delivers the leftover outbox entries every interval, forever
+func runOutbox(providers *serverProviders, interval time.Duration) {
+	for {
+		now := providers.now()
+		run, err := drainOutbox(providers, now)
+		if err != nil {
+			logErr(err)
+		}
+		outboxes.record(run, now)
+		if shouldLogInfo() && (run.Delivered > 0 || run.Dropped > 0) {
+			log.Printf("Delivered %d leftover outbox entries, and dropped %d", run.Delivered, run.Dropped)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// outboxStatsHandler handles GET /admin/outbox
+func outboxStatsHandler(w http.ResponseWriter, r *http.Request) {
+	pending, err := providersCtx(r.Context()).db.OutboxSize()
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	total, lastRun := outboxes.get()
+	resp := struct {
+		Pending int64     `json:"pending"`
+		Total   outboxRun `json:"total"`
+		LastRun int64     `json:"last_run,omitempty"`
+	}{Pending: pending, Total: total}
+	if !lastRun.IsZero() {
+		resp.LastRun = lastRun.Unix()
+	}
+	sendSuccess(w, resp)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/push"
+)
+
+func TestOutbox(t *testing.T) {
+	providers := createTestProviders(t)
+	pushes := &sentPushes{}
+	providers.pushers = []pusher{pushes}
+	recipient, _ := createTestUser(t, providers)
+	sender, _ := createTestUser(t, providers)
+	senderPubID, err := providers.kvs.PublicIDFromUserID(sender.ID)
+	require.NoError(t, err)
+
+	now := time.Now()
+	msg := Message{
+		SenderID:       sender.ID,
+		PublicSenderID: senderPubID,
+		CipherText:     []byte("cipher-text"),
+		Nonce:          []byte("nonce"),
+		SentDate:       now.Unix(),
+	}
+	notify := &push.Options{Priority: push.PriorityNormal, CollapseID: "location"}
+	entryID, _, err := storeMessage(providers, recipient.ID, &msg, true, notify, now)
+	require.NoError(t, err)
+	require.NotZero(t, msg.ID)
+	pending, err := providers.db.OutboxSize()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), pending)
+
+	// the entry is left to the handler that stored it, until its lease runs out
+	run, err := drainOutbox(providers, now)
+	require.NoError(t, err)
+	require.Equal(t, outboxRun{}, run)
+	require.Empty(t, pushes.recorded())
+
+	// after that, it's delivered as if the server had stopped before
+	// getting to it
+	run, err = drainOutbox(providers, now.Add(outboxLease))
+	require.NoError(t, err)
+	require.Equal(t, outboxRun{Delivered: 1}, run)
+	require.Len(t, pushes.recorded(), 1)
+	sent := pushes.recorded()[0]
+	require.Equal(t, recipient.ID, sent.userID)
+	// it's pushed the way the sender asked
+	require.Equal(t, *notify, sent.opts)
+	payload := sent.payload.(map[string]interface{})
+	require.Equal(t, "message_received", payload["type"])
+	require.EqualValues(t, msg.CipherText, payload["cipher_text"])
+
+	pending, err = providers.db.OutboxSize()
+	require.NoError(t, err)
+	require.Zero(t, pending)
+
+	// a delivery by the handler removes the entry too
+	entryID, _, err = storeMessage(providers, recipient.ID, &msg, false, nil, now)
+	require.NoError(t, err)
+	deliverOutboxEntry(providers, entryID, msg, recipient.ID, nil)
+	pending, err = providers.db.OutboxSize()
+	require.NoError(t, err)
+	require.Zero(t, pending)
+}
+
+func TestOutboxDropsUndeliverableEntries(t *testing.T) {
+	providers := createTestProviders(t)
+	recipient, _ := createTestUser(t, providers)
+	msg := Message{CipherText: []byte("cipher-text"), Nonce: []byte("nonce"), SealedSender: true}
+	now := time.Now()
+	_, _, err := storeMessage(providers, recipient.ID, &msg, false, nil, now)
+	require.NoError(t, err)
+
+	// the entry was sealed with a key the server no longer has
+	providers.keys, err = newKeyRing(make([]byte, len(providers.keys.current.key)))
+	require.NoError(t, err)
+	run, err := drainOutbox(providers, now.Add(outboxLease))
+	require.NoError(t, err)
+	require.Equal(t, outboxRun{Dropped: 1}, run)
+	pending, err := providers.db.OutboxSize()
+	require.NoError(t, err)
+	require.Zero(t, pending)
+}
+
+func TestOutboxSealedMessages(t *testing.T) {
+	providers := createTestProviders(t)
+	providers.sealMessages = true
+	pushes := &sentPushes{}
+	providers.pushers = []pusher{pushes}
+	recipient, _ := createTestUser(t, providers)
+	sender, _ := createTestUser(t, providers)
+	senderPubID, err := providers.kvs.PublicIDFromUserID(sender.ID)
+	require.NoError(t, err)
+
+	now := time.Now()
+	msg := Message{SenderID: sender.ID, PublicSenderID: senderPubID, CipherText: []byte("cipher-text"), Nonce: []byte("nonce"), SentDate: now.Unix()}
+	_, _, err = storeMessage(providers, recipient.ID, &msg, false, &push.Options{}, now)
+	require.NoError(t, err)
+
+	// the entry holds the message as sealed in the messages table
+	recs, err := providers.db.MessageRecords(recipient.ID)
+	require.NoError(t, err)
+	require.Len(t, recs, 1)
+	entries, err := providers.db.OutboxEntries(0, outboxBatchSize)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	delivered, _, err := openOutboxEntry(providers.keys, entries[0])
+	require.NoError(t, err)
+	require.Equal(t, recs[0].CipherText, []byte(delivered.SealedEnvelope))
+	require.Equal(t, recs[0].Nonce, []byte(delivered.Nonce))
+	require.Empty(t, delivered.PublicSenderID)
+	require.Empty(t, delivered.CipherText)
+	require.Zero(t, delivered.SentDate)
+
+	_, err = drainOutbox(providers, now.Add(outboxLease))
+	require.NoError(t, err)
+	require.Len(t, pushes.recorded(), 1)
+	payload := pushes.recorded()[0].payload.(map[string]interface{})
+	require.EqualValues(t, recs[0].CipherText, payload["sealed_envelope"])
+	require.NotContains(t, payload, "sender_id")
+	require.NotContains(t, payload, "cipher_text")
+}
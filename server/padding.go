@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// paddingPolicy holds the payload sizes allowed by the deployment. Clients
+// pad message cipher texts and drop box packages to one of the buckets, so
+// the sizes seen by the network and the storage layer reveal little about
+// the content. A nil policy means padding is disabled.
+type paddingPolicy struct {
+	buckets []int
+}
+
+func newPaddingPolicy(buckets []int) (*paddingPolicy, error) {
+	if len(buckets) == 0 {
+		return nil, nil
+	}
+	for i, b := range buckets {
+		if b <= 0 {
+			return nil, errors.Errorf("padding bucket sizes must be positive (found %d)", b)
+		}
+		if i > 0 && b <= buckets[i-1] {
+			return nil, errors.New("padding bucket sizes must be in increasing order")
+		}
+	}
+
+	return &paddingPolicy{buckets: buckets}, nil
+}
+
+// validSize returns true if size is exactly one of the buckets
+func (pp *paddingPolicy) validSize(size int) bool {
+	if pp == nil {
+		return true
+	}
+	for _, b := range pp.buckets {
+		if b == size {
+			return true
+		}
+	}
+	return false
+}
+
+// padJSON pads a JSON payload with trailing whitespace, which JSON parsers
+// ignore, up to the next bucket boundary. Payloads larger than the largest
+// bucket are padded to a multiple of it.
+func (pp *paddingPolicy) padJSON(buf []byte) []byte {
+	if pp == nil {
+		return buf
+	}
+
+	target := 0
+	for _, b := range pp.buckets {
+		if b >= len(buf) {
+			target = b
+			break
+		}
+	}
+	if target == 0 {
+		largest := pp.buckets[len(pp.buckets)-1]
+		target = (len(buf) + largest - 1) / largest * largest
+	}
+
+	return append(buf, bytes.Repeat([]byte{' '}, target-len(buf))...)
+}
+
+// checkPayloadSize sends an error response and returns false if size isn't
+// allowed by the deployment's padding policy
+func checkPayloadSize(w http.ResponseWriter, pp *paddingPolicy, size int) bool {
+	if pp.validSize(size) {
+		return true
+	}
+	sendBadReqCode(w, "payload size must match one of the server's padding buckets", errorInvalidPayloadSize)
+	return false
+}
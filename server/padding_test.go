@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPaddingPolicy(t *testing.T) {
+	pp, err := newPaddingPolicy([]int{256, 1024, 4096})
+	require.NoError(t, err)
+
+	require.True(t, pp.validSize(1024))
+	require.False(t, pp.validSize(1000))
+
+	buf, err := json.Marshal(map[string]string{"type": "message_received"})
+	require.NoError(t, err)
+	padded := pp.padJSON(buf)
+	require.Len(t, padded, 256)
+	// padding mustn't break the payload
+	decoded := map[string]string{}
+	require.NoError(t, json.Unmarshal(padded, &decoded))
+	require.Equal(t, "message_received", decoded["type"])
+
+	require.Len(t, pp.padJSON(make([]byte, 5000)), 8192)
+
+	// a nil policy allows anything, and doesn't pad
+	var disabled *paddingPolicy
+	require.True(t, disabled.validSize(1000))
+	require.Equal(t, buf, disabled.padJSON(buf))
+
+	_, err = newPaddingPolicy([]int{1024, 256})
+	require.Error(t, err)
+	_, err = newPaddingPolicy([]int{0})
+	require.Error(t, err)
+}
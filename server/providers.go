@@ -3,36 +3,158 @@ package main
 import (
 	"context"
 	crand "crypto/rand"
-	"fmt"
+	"io"
 	"net/http"
-	"os"
-	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
-	"zood.dev/oscar/boltdb"
 	"zood.dev/oscar/filestor"
 	"zood.dev/oscar/kvstor"
-	"zood.dev/oscar/localdisk"
+	"zood.dev/oscar/memfs"
+	"zood.dev/oscar/memkv"
 	"zood.dev/oscar/model"
 	"zood.dev/oscar/smtp"
 	"zood.dev/oscar/sodium"
 	"zood.dev/oscar/sqlite"
+	"zood.dev/oscar/storemetrics"
 )
 
 type serverProviders struct {
-	db      model.Provider
-	emailer smtp.SendEmailer
-	fs      filestor.Provider
-	kvs     kvstor.Provider
-	symKey  []byte
-	keyPair sodium.KeyPair
+	// adminToken authorizes requests to the /admin routes. When empty, the
+	// admin routes are disabled.
+	adminToken string
+	db         model.Provider
+	emailer    smtp.SendEmailer
+	// emailTemplates are the localized emails. When nil, only the built-in
+	// English emails are sent.
+	emailTemplates *emailTemplates
+	// mailgunSigningKey verifies mailgun webhooks. When empty, webhooks are
+	// rejected.
+	mailgunSigningKey string
+	fs                filestor.Provider
+	kvs               kvstor.Provider
+	// kvFile is kvs when it's kept in a single file, which has to be
+	// compacted. When nil, /admin/kv-stats and /admin/kv-snapshot are not
+	// found.
+	kvFile  kvFileStorage
+	pushers []pusher
+	// ingressPolicies can refuse messages and packages before they're stored
+	ingressPolicies []ingressPolicy
+	keys            *keyRing
+	// keyPair is the server's current key pair. Data addressed to one of
+	// previousKeyPairs is still accepted, while they haven't been retired.
+	keyPair          sodium.KeyPair
+	previousKeyPairs []sodium.KeyPair
+	// usernameIndexSalt keys the blind index of usernames. When nil, hashed
+	// username lookups are disabled.
+	usernameIndexSalt []byte
+	// padding is nil unless payload padding is enabled
+	padding *paddingPolicy
+	// timeouts bound how long each route may take
+	timeouts *timeoutPolicy
+	// rateLimits throttles each client address. When nil, nothing is
+	// throttled.
+	rateLimits *rateLimitPolicy
+	// clientVersions rejects app builds that are too old to talk to us
+	clientVersions *clientVersionPolicy
+	// replica proxies writes to the primary. When nil, this instance is the
+	// primary.
+	replica *replicaProxy
+	// replicaURLs are advertised in server-info by the primary
+	replicaURLs []string
+	// trustedReplicas are where the primary's replicas connect from
+	trustedReplicas trustedReplicas
+	// loginLockouts counts the failed logins of each account and address
+	loginLockouts *loginLockouts
+	// branding identifies the deployment in server-info. When nil, the Zood
+	// values are used.
+	branding *branding
+	// dependencies probes the external services. When nil, /readyz and
+	// /metrics report no dependencies.
+	dependencies *dependencyMonitor
+	// storageMetrics records the latencies of the db and kvs operations.
+	// When nil, /metrics reports no storage metrics.
+	storageMetrics *storemetrics.Recorder
+	// events carries account lifecycle events to the audit log and the
+	// server log. When nil, events are dropped.
+	events *eventBus
+	// logLevelPath is where the runtime log level is persisted. When empty,
+	// changes to the log level only last until the process exits.
+	logLevelPath string
+	// sealMessages causes stored messages to be sealed to their recipient
+	sealMessages bool
+	// clockSkew is how far behind the server a client's clock may be, and
+	// still have expiry dates it was handed honored
+	clockSkew time.Duration
+	// storageQuota caps the bytes a user can keep in fs. Zero means no cap.
+	storageQuota int64
+	// maxQueuedMessages caps the messages stored for each recipient. Zero
+	// means no cap.
+	maxQueuedMessages int64
+	// dropBoxTTL is how long packages stay in their drop box, and the most
+	// a client can ask for. Zero means they stay until replaced.
+	dropBoxTTL time.Duration
+	// boxAliasGrace is how long a drop box alias still leads to its box
+	// once a newer one is added
+	boxAliasGrace time.Duration
+	// resealers re-encrypt stored items after the symmetric key is rotated
+	resealers []resealer
+	// keyCounters count the live items sealed under each symmetric key, for
+	// /admin/symmetric-keys
+	keyCounters []keyCounter
+	// rand is the source of randomness for tokens, challenges and ids. When
+	// nil, crypto/rand is used. Tests can swap in a seeded source to make
+	// those values deterministic.
+	rand io.Reader
+	// clock tells the time for expiry checks, TTLs and rate limits. When
+	// nil, the system clock is used. Tests can swap in a fakeClock to move
+	// past expiry dates without waiting.
+	clock clock
+	// unbound is the providers this copy was bound to a request context
+	// from, or nil if this copy isn't bound to one
+	unbound *serverProviders
+}
+
+// withContext returns a copy of sp whose storage providers are cancelled
+// along with ctx
+func (sp *serverProviders) withContext(ctx context.Context) *serverProviders {
+	bound := *sp
+	bound.unbound = sp.detached()
+	bound.db = sp.db.WithContext(ctx)
+	if sp.fs != nil {
+		bound.fs = sp.fs.WithContext(ctx)
+	}
+	return &bound
+}
+
+// detached returns providers that aren't bound to any request, for work that
+// continues after the response has been sent
+func (sp *serverProviders) detached() *serverProviders {
+	if sp.unbound != nil {
+		return sp.unbound
+	}
+	return sp
+}
+
+func (sp *serverProviders) random() io.Reader {
+	if sp.rand == nil {
+		return crand.Reader
+	}
+	return sp.rand
+}
+
+func (sp *serverProviders) now() time.Time {
+	if sp.clock == nil {
+		return time.Now()
+	}
+	return sp.clock.Now()
 }
 
 func (sp *serverProviders) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx := context.WithValue(r.Context(), contextServerProvidersKey, sp)
+		ctx := r.Context()
+		ctx = context.WithValue(ctx, contextServerProvidersKey, sp.withContext(ctx))
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -42,25 +164,24 @@ func createTestProviders(t *testing.T) *serverProviders {
 
 	db := sqlite.NewMockDB(t)
 
-	kvs := boltdb.Temp(t)
+	kvs := memkv.New()
 	symKey := make([]byte, sodium.SymmetricKeySize)
 	crand.Read(symKey)
-	keyPair, err := sodium.NewKeyPair()
+	keys, err := newKeyRing(symKey)
 	require.NoError(t, err)
-
-	tmpDir := filepath.Join(os.TempDir(), fmt.Sprintf("%s-%d", t.Name(), time.Now().Unix()))
-	err = os.MkdirAll(tmpDir, 0755)
-	require.NoError(t, err)
-	fstor, err := localdisk.New(tmpDir)
+	keyPair, err := sodium.NewKeyPair()
 	require.NoError(t, err)
 
 	return &serverProviders{
 		db:      db,
 		emailer: smtp.NewMockSendEmailer(),
 		kvs:     kvs,
-		symKey:  symKey,
+		keys:    keys,
 		keyPair: keyPair,
-		fs:      fstor,
+		fs:      memfs.New(),
+		rand:    crand.Reader,
+
+		loginLockouts: newLoginLockouts(),
 	}
 }
 
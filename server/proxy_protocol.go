@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// proxyHeaderTimeout is how long a proxy gets to send the PROXY protocol
+// header of a connection. Proxies send it as soon as they connect, so it's
+// short.
+const proxyHeaderTimeout = 2 * time.Second
+
+// proxyHeaderMaxLength caps the addresses and TLVs that follow the fixed
+// part of a header
+const proxyHeaderMaxLength = 2048
+
+// proxySignature starts every PROXY protocol v2 header
+var proxySignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyCommandLocal = 0x0
+	proxyCommandProxy = 0x1
+	proxyFamilyInet   = 0x1
+	proxyFamilyInet6  = 0x2
+)
+
+// parseProxySources parses the addresses and CIDR ranges allowed to send
+// PROXY protocol headers. A lone address is a range of its own.
+func parseProxySources(sources []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(sources))
+	for _, src := range sources {
+		if !strings.Contains(src, "/") {
+			ip := net.ParseIP(src)
+			if ip == nil {
+				return nil, errors.Errorf("invalid proxy address '%s'", src)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(src)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid proxy range '%s'", src)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// proxyListener reads the PROXY protocol v2 header that the proxies in from
+// send at the start of each connection, so the connection reports the
+// address of the client behind the proxy. Connections from elsewhere are
+// left as they are, so they can't claim another address. Each header is
+// read on a goroutine of its own, so a slow or silent client doesn't hold
+// up the connections accepted after it.
+type proxyListener struct {
+	net.Listener
+	from []*net.IPNet
+	// ready has the connections whose header has been read, and errs the
+	// errors of the underlying listener
+	ready     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newProxyListener(ln net.Listener, from []*net.IPNet) *proxyListener {
+	pl := &proxyListener{
+		Listener: ln,
+		from:     from,
+		ready:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+	go pl.acceptAll()
+	return pl
+}
+
+func (pl *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-pl.ready:
+		return conn, nil
+	case err := <-pl.errs:
+		return nil, err
+	case <-pl.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (pl *proxyListener) Close() error {
+	pl.closeOnce.Do(func() { close(pl.done) })
+	return pl.Listener.Close()
+}
+
+// acceptAll accepts the connections of the underlying listener until it
+// fails for good, and hands them to Accept once their header is read
+func (pl *proxyListener) acceptAll() {
+	for {
+		conn, err := pl.Listener.Accept()
+		if err != nil {
+			select {
+			case pl.errs <- err:
+			case <-pl.done:
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		if !pl.trusted(conn.RemoteAddr()) {
+			pl.handOver(conn)
+			continue
+		}
+		go func() {
+			if conn := readProxyConn(conn); conn != nil {
+				pl.handOver(conn)
+			}
+		}()
+	}
+}
+
+// handOver passes conn to Accept, or closes it if the listener is closed
+// first
+func (pl *proxyListener) handOver(conn net.Conn) {
+	select {
+	case pl.ready <- conn:
+	case <-pl.done:
+		conn.Close()
+	}
+}
+
+// readProxyConn reads the header of conn, and returns the connection
+// reporting the client's address. Connections with a broken header are
+// closed, and nil is returned.
+func readProxyConn(conn net.Conn) net.Conn {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	remote, err := readProxyHeader(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		if shouldLogDebug() {
+			logErr(errors.Wrapf(err, "PROXY header from %s", conn.RemoteAddr()))
+		}
+		conn.Close()
+		return nil
+	}
+	if remote == nil {
+		return conn
+	}
+	return &proxyConn{Conn: conn, remote: remote}
+}
+
+// trusted returns true if addr is one of the proxies
+func (pl *proxyListener) trusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range pl.from {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader reads a PROXY protocol v2 header from r, and returns the
+// address of the client it carries. The address is nil for the proxy's own
+// connections, like health checks, and for clients that aren't on TCP.
+func readProxyHeader(r io.Reader) (*net.TCPAddr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, errors.Wrap(err, "reading the header")
+	}
+	if !bytes.Equal(hdr[:12], proxySignature) {
+		return nil, errors.New("not a PROXY protocol v2 header")
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, errors.Errorf("unsupported PROXY protocol version %d", hdr[12]>>4)
+	}
+	length := int(binary.BigEndian.Uint16(hdr[14:16]))
+	if length > proxyHeaderMaxLength {
+		return nil, errors.Errorf("header of %d bytes is too long", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, errors.Wrap(err, "reading the addresses")
+	}
+
+	switch hdr[12] & 0xf {
+	case proxyCommandLocal:
+		return nil, nil
+	case proxyCommandProxy:
+	default:
+		return nil, errors.Errorf("unknown PROXY command %d", hdr[12]&0xf)
+	}
+	// the source address and port follow the destination address
+	var ipLen int
+	switch hdr[13] >> 4 {
+	case proxyFamilyInet:
+		ipLen = net.IPv4len
+	case proxyFamilyInet6:
+		ipLen = net.IPv6len
+	default:
+		return nil, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, errors.New("addresses are cut short")
+	}
+	ip := make(net.IP, ipLen)
+	copy(ip, body[:ipLen])
+	port := binary.BigEndian.Uint16(body[2*ipLen:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// proxyConn is a connection through a proxy, which reports the address of
+// the client behind the proxy
+type proxyConn struct {
+	net.Conn
+	remote *net.TCPAddr
+}
+
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	return pc.remote
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// proxyHeader builds a PROXY protocol v2 header for a connection from src to
+// dst
+func proxyHeader(command byte, src, dst *net.TCPAddr) []byte {
+	family := byte(proxyFamilyInet)
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	if srcIP == nil {
+		family = proxyFamilyInet6
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	}
+	body := append(append([]byte{}, srcIP...), dstIP...)
+	body = append(body, byte(src.Port>>8), byte(src.Port), byte(dst.Port>>8), byte(dst.Port))
+	hdr := append([]byte{}, proxySignature...)
+	hdr = append(hdr, 0x20|command, family<<4|0x1, 0, 0)
+	binary.BigEndian.PutUint16(hdr[14:], uint16(len(body)))
+	return append(hdr, body...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}
+	src := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51000}
+	hdr := proxyHeader(proxyCommandProxy, src, dst)
+	// the request that follows is left unread
+	r := bytes.NewReader(append(hdr, "GET /"...))
+	addr, err := readProxyHeader(r)
+	require.NoError(t, err)
+	require.Equal(t, "203.0.113.7:51000", addr.String())
+	rest, _ := ioutil.ReadAll(r)
+	require.Equal(t, "GET /", string(rest))
+
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 51000}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+	addr, err = readProxyHeader(bytes.NewReader(proxyHeader(proxyCommandProxy, src6, dst6)))
+	require.NoError(t, err)
+	require.Equal(t, "[2001:db8::7]:51000", addr.String())
+
+	// health checks of the proxy keep its address
+	addr, err = readProxyHeader(bytes.NewReader(proxyHeader(proxyCommandLocal, src, dst)))
+	require.NoError(t, err)
+	require.Nil(t, addr)
+
+	_, err = readProxyHeader(bytes.NewReader([]byte("GET / HTTP/1.1\r\nHost: oscar\r\n\r\n")))
+	require.Error(t, err)
+	_, err = readProxyHeader(bytes.NewReader(hdr[:20]))
+	require.Error(t, err)
+	long := append([]byte{}, hdr...)
+	binary.BigEndian.PutUint16(long[14:], proxyHeaderMaxLength+1)
+	_, err = readProxyHeader(bytes.NewReader(long))
+	require.Error(t, err)
+}
+
+func TestParseProxySources(t *testing.T) {
+	nets, err := parseProxySources([]string{"10.0.0.0/8", "192.0.2.4", "2001:db8::1"})
+	require.NoError(t, err)
+	require.Len(t, nets, 3)
+	require.True(t, nets[0].Contains(net.ParseIP("10.1.2.3")))
+	require.True(t, nets[1].Contains(net.ParseIP("192.0.2.4")))
+	require.False(t, nets[1].Contains(net.ParseIP("192.0.2.5")))
+	require.True(t, nets[2].Contains(net.ParseIP("2001:db8::1")))
+
+	_, err = parseProxySources([]string{"proxy.example.com"})
+	require.Error(t, err)
+	_, err = parseProxySources([]string{"10.0.0.0/33"})
+	require.Error(t, err)
+}
+
+func TestProxyListener(t *testing.T) {
+	start := func(from string) (string, *http.Server) {
+		nets, err := parseProxySources([]string{from})
+		require.NoError(t, err)
+		l := listener{proxyFrom: nets, maxConnsPerIP: 1}
+		l.server = newHTTPServer("127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.RemoteAddr))
+		}), nil, nil)
+		ln, err := l.listen()
+		require.NoError(t, err)
+		go l.server.Serve(ln)
+		return ln.Addr().String(), l.server
+	}
+	// get sends prefix, and then a request, and returns what the server saw
+	// as the remote address
+	get := func(addr string, prefix []byte) string {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+		_, err = conn.Write(append(prefix, "GET / HTTP/1.1\r\nHost: oscar\r\nConnection: close\r\n\r\n"...))
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return ""
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	addr, server := start("127.0.0.1")
+	defer server.Close()
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	require.NoError(t, err)
+	client := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51000}
+	require.Equal(t, "203.0.113.7:51000", get(addr, proxyHeader(proxyCommandProxy, client, tcpAddr)))
+
+	// the per-address cap counts the clients, not the proxy, so another
+	// client gets through while the first holds a connection open
+	held, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer held.Close()
+	_, err = held.Write(proxyHeader(proxyCommandProxy, client, tcpAddr))
+	require.NoError(t, err)
+	other := &net.TCPAddr{IP: net.ParseIP("203.0.113.8"), Port: 51000}
+	require.Equal(t, "203.0.113.8:51000", get(addr, proxyHeader(proxyCommandProxy, other, tcpAddr)))
+
+	// a connection from a proxy without a header is dropped
+	require.Empty(t, get(addr, nil))
+
+	// a connection that hasn't sent its header yet doesn't hold up the
+	// others, which get answered well before the header timeout
+	silent, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer silent.Close()
+	started := time.Now()
+	require.Equal(t, "203.0.113.8:51000", get(addr, proxyHeader(proxyCommandProxy, other, tcpAddr)))
+	require.True(t, time.Since(started) < proxyHeaderTimeout)
+
+	// clients that aren't proxies can't claim another address
+	addr, server = start("10.0.0.0/8")
+	defer server.Close()
+	require.Contains(t, get(addr, nil), "127.0.0.1:")
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"zood.dev/oscar/model"
+	"zood.dev/oscar/push"
+)
+
+// debouncedPusher sends at most one push per recipient per window. The first
+// push to a recipient goes out right away. Pushes during the window are
+// coalesced, and the latest of them is sent when the window ends, which
+// starts a new window. Coalesced payloads are dropped, so recipients have to
+// sync to see every message, like they do after a message_sync_needed push.
+type debouncedPusher struct {
+	next   pusher
+	window time.Duration
+
+	mu         sync.Mutex
+	recipients map[int64]*debounceState
+}
+
+type debounceState struct {
+	// pending is the latest push held back during the window
+	pending *pendingPush
+}
+
+type pendingPush struct {
+	db      model.Provider
+	payload interface{}
+	opts    push.Options
+}
+
+func newDebouncedPusher(next pusher, window time.Duration) *debouncedPusher {
+	return &debouncedPusher{
+		next:       next,
+		window:     window,
+		recipients: map[int64]*debounceState{},
+	}
+}
+
+func (dp *debouncedPusher) push(ctx context.Context, db model.Provider, userID int64, payload interface{}, opts push.Options) {
+	dp.mu.Lock()
+	if st := dp.recipients[userID]; st != nil {
+		// a high priority push keeps its priority when it's coalesced
+		if st.pending != nil && st.pending.opts.Priority > opts.Priority {
+			opts.Priority = st.pending.opts.Priority
+		}
+		st.pending = &pendingPush{db: db, payload: payload, opts: opts}
+		dp.mu.Unlock()
+		return
+	}
+	dp.recipients[userID] = &debounceState{}
+	time.AfterFunc(dp.window, func() { dp.endWindow(userID) })
+	dp.mu.Unlock()
+
+	dp.next.push(ctx, db, userID, payload, opts)
+}
+
+// endWindow sends the push held back during the window, if there is one.
+// Otherwise the recipient's next push goes out right away. The caller of the
+// held back push has moved on, so it isn't bound to the caller's context.
+func (dp *debouncedPusher) endWindow(userID int64) {
+	dp.mu.Lock()
+	st := dp.recipients[userID]
+	p := st.pending
+	if p == nil {
+		delete(dp.recipients, userID)
+		dp.mu.Unlock()
+		return
+	}
+	st.pending = nil
+	time.AfterFunc(dp.window, func() { dp.endWindow(userID) })
+	dp.mu.Unlock()
+
+	dp.next.push(context.Background(), p.db, userID, p.payload, p.opts)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"zood.dev/oscar/model"
+	"zood.dev/oscar/push"
+
+	"github.com/stretchr/testify/require"
+)
+
+type sentPush struct {
+	userID  int64
+	payload interface{}
+	opts    push.Options
+}
+
+type sentPushes struct {
+	mu     sync.Mutex
+	pushes []sentPush
+}
+
+func (rp *sentPushes) push(ctx context.Context, db model.Provider, userID int64, payload interface{}, opts push.Options) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	rp.pushes = append(rp.pushes, sentPush{userID: userID, payload: payload, opts: opts})
+}
+
+func (rp *sentPushes) recorded() []sentPush {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return append([]sentPush(nil), rp.pushes...)
+}
+
+func TestDebouncedPusher(t *testing.T) {
+	rec := &sentPushes{}
+	window := 50 * time.Millisecond
+	dp := newDebouncedPusher(rec, window)
+
+	normal := push.Options{Priority: push.PriorityNormal}
+	high := push.Options{Priority: push.PriorityHigh}
+
+	// the first push goes out right away, the rest wait for the window
+	dp.push(context.Background(), nil, 1, "a", normal)
+	dp.push(context.Background(), nil, 1, "b", high)
+	dp.push(context.Background(), nil, 1, "c", normal)
+	dp.push(context.Background(), nil, 2, "x", normal)
+	require.Equal(t, []sentPush{{1, "a", normal}, {2, "x", normal}}, rec.recorded())
+
+	// the latest push is sent at the end of the window, keeping the priority
+	// of the ones it replaced
+	time.Sleep(window * 2)
+	require.Equal(t, []sentPush{{1, "a", normal}, {2, "x", normal}, {1, "c", high}}, rec.recorded())
+
+	// once a window passes without pushes, the next one goes out right away
+	time.Sleep(window * 2)
+	dp.push(context.Background(), nil, 1, "d", normal)
+	require.Len(t, rec.recorded(), 4)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/pkg/errors"
+	"zood.dev/oscar/model"
+	"zood.dev/oscar/push"
+)
+
+// pusher delivers payloads to the devices of a user. It gives up on the
+// deliveries still under way when ctx is done.
+type pusher interface {
+	push(ctx context.Context, db model.Provider, userID int64, payload interface{}, opts push.Options)
+}
+
+// pushTokens keeps the device tokens users registered with one push service
+type pushTokens interface {
+	tokens(db model.Provider, userID int64) ([]string, error)
+	// forget drops a token that no longer reaches a device
+	forget(db model.Provider, token string) error
+	// replace swaps a token of the user for the one the service wants used
+	// instead
+	replace(db model.Provider, userID int64, old, new string) error
+}
+
+// pushTokenStores has the device tokens of each push service, by the name
+// of its push.Provider. A new service needs its tokens added here.
+var pushTokenStores = map[string]pushTokens{
+	push.NameAPNS: apnsTokens{},
+	push.NameFCM:  fcmTokens{},
+}
+
+// tokenPusher delivers payloads through a push.Provider, to every device
+// the user registered a token of the provider's for. The tokens the
+// provider reports as unregistered are pruned, so uninstalled apps aren't
+// pushed to forever.
+type tokenPusher struct {
+	provider push.Provider
+	store    pushTokens
+	// events gets an event for each pruned token
+	events *eventBus
+}
+
+func newTokenPusher(p push.Provider, events *eventBus) (*tokenPusher, error) {
+	store, ok := pushTokenStores[p.Name()]
+	if !ok {
+		return nil, errors.Errorf("no device tokens are kept for push provider '%s'", p.Name())
+	}
+	return &tokenPusher{provider: p, store: store, events: events}, nil
+}
+
+func (tp *tokenPusher) push(ctx context.Context, db model.Provider, userID int64, payload interface{}, opts push.Options) {
+	tokens, err := tp.store.tokens(db, userID)
+	if err != nil {
+		logErr(err)
+		return
+	}
+
+	for _, t := range tokens {
+		err = tp.provider.Send(ctx, t, payload, opts)
+		if err == nil {
+			continue
+		}
+		if err == push.ErrUnregistered {
+			if err = tp.store.forget(db, t); err == nil {
+				tp.events.emit(accountEvent{
+					Kind:    eventPushTokenPruned,
+					Actor:   actorServer,
+					UserID:  userID,
+					Details: tp.provider.Name() + " reported the token as unregistered",
+				})
+			}
+		} else if changed, ok := err.(*push.TokenChangedError); ok {
+			err = tp.store.replace(db, userID, t, changed.Token)
+		} else {
+			err = errors.Wrapf(err, "%s push to user %d", tp.provider.Name(), userID)
+		}
+		if err != nil {
+			logErr(err)
+		}
+	}
+}
+
+// logPusher writes notifications to the log instead of delivering them
+type logPusher struct{}
+
+func (logPusher) push(ctx context.Context, db model.Provider, userID int64, payload interface{}, opts push.Options) {
+	buf, err := json.Marshal(payload)
+	if err != nil {
+		logErr(err)
+		return
+	}
+	log.Printf("push to %s (high priority? %t, collapse id %q): %s", db.Username(userID), opts.Priority == push.PriorityHigh, opts.CollapseID, buf)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/model"
+	"zood.dev/oscar/push"
+)
+
+// fakePushProvider records the tokens it's asked to push to, and fails the
+// pushes to the tokens in errs
+type fakePushProvider struct {
+	errs     map[string]error
+	sent     []string
+	priority push.Priority
+}
+
+func (fp *fakePushProvider) Name() string {
+	return push.NameFCM
+}
+
+func (fp *fakePushProvider) Send(ctx context.Context, token string, payload interface{}, opts push.Options) error {
+	fp.sent = append(fp.sent, token)
+	fp.priority = opts.Priority
+	return fp.errs[token]
+}
+
+func TestTokenPusher(t *testing.T) {
+	providers := createTestProviders(t)
+	user, _ := createTestUser(t, providers)
+	db := providers.db
+	for _, token := range []string{"current", "stale", "uninstalled"} {
+		require.NoError(t, db.InsertFCMToken(user.ID, token, model.ClientRecord{}))
+	}
+
+	provider := &fakePushProvider{errs: map[string]error{
+		"stale":       &push.TokenChangedError{Token: "canonical"},
+		"uninstalled": push.ErrUnregistered,
+	}}
+	events := newEventBus()
+	var pruned []accountEvent
+	events.subscribe("test", func(evt accountEvent) error {
+		pruned = append(pruned, evt)
+		return nil
+	})
+	tp, err := newTokenPusher(provider, events)
+	require.NoError(t, err)
+	tp.push(context.Background(), db, user.ID, map[string]string{"hello": "world"}, push.Options{Priority: push.PriorityHigh})
+	require.ElementsMatch(t, []string{"current", "stale", "uninstalled"}, provider.sent)
+	require.Equal(t, push.PriorityHigh, provider.priority)
+
+	// the tokens are fixed up as the provider asked
+	tokens, err := db.FCMTokensRaw(user.ID)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"current", "canonical"}, tokens)
+	require.Len(t, pruned, 1)
+	require.Equal(t, eventPushTokenPruned, pruned[0].Kind)
+	require.Equal(t, user.ID, pruned[0].UserID)
+
+	// the pruned token isn't pushed to again
+	provider.sent = nil
+	tp.push(context.Background(), db, user.ID, map[string]string{"hello": "world"}, push.Options{})
+	require.ElementsMatch(t, []string{"current", "canonical"}, provider.sent)
+}
+
+// unknownPushProvider is a push service no device tokens are kept for
+type unknownPushProvider struct{ fakePushProvider }
+
+func (unknownPushProvider) Name() string {
+	return "pigeon"
+}
+
+func TestNewTokenPusher(t *testing.T) {
+	_, err := newTokenPusher(&unknownPushProvider{}, nil)
+	require.Error(t, err)
+}
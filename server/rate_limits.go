@@ -0,0 +1,248 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// Values for the rate limits 'store' field
+const (
+	rateLimitStoreMemory = "memory"
+	rateLimitStoreRedis  = "redis"
+)
+
+// rateLimitSweepInterval is how often the memory store drops the buckets
+// that have filled up again
+const rateLimitSweepInterval = time.Minute
+
+// rateLimitConfig throttles the requests of each client address, with a
+// token bucket per group of routes. Without groups or a default, nothing is
+// throttled.
+type rateLimitConfig struct {
+	// Store keeps the buckets. It's "memory" (the default), which throttles
+	// the requests each instance receives on its own, or "redis", which
+	// shares the buckets through the redis kv storage, so the limits hold
+	// across instances.
+	Store string `json:"store,omitempty"`
+	// Groups are keyed by a name of your choosing. Routes in no group use
+	// Default, and aren't throttled without it.
+	Groups  map[string]rateLimitGroupConfig `json:"groups,omitempty"`
+	Default *rateLimitGroupConfig           `json:"default,omitempty"`
+	// Exempt lists the addresses or CIDR ranges that are never throttled,
+	// like "10.0.0.0/8". Replicas the primary doesn't list in
+	// replica_addresses should be exempted, since the requests they proxy
+	// all come from their address.
+	Exempt []string `json:"exempt,omitempty"`
+}
+
+// rateLimitGroupConfig is the limit shared by a group of routes. A client
+// can make Burst requests at once, and Rate more each second after that.
+type rateLimitGroupConfig struct {
+	// Routes are path templates as registered with the router, e.g.
+	// "/1/sessions". They're ignored in the default group.
+	Routes []string `json:"routes,omitempty"`
+	Rate   float64  `json:"rate"`
+	Burst  int      `json:"burst"`
+}
+
+// rateLimitStore keeps the token buckets of the rate limits
+type rateLimitStore interface {
+	// TakeToken takes a token from bucket, which holds up to burst tokens
+	// and gains rate tokens per second. When the bucket is empty, nothing
+	// is taken, and it returns how long until a token can be.
+	TakeToken(bucket string, rate float64, burst int, now time.Time) (time.Duration, error)
+}
+
+// rateLimitGroup is a parsed rateLimitGroupConfig
+type rateLimitGroup struct {
+	name  string
+	rate  float64
+	burst int
+}
+
+// rateLimitPolicy throttles each client address by the group of the route
+// it requests. A nil policy throttles nothing.
+type rateLimitPolicy struct {
+	store rateLimitStore
+	// groups are keyed by path template
+	groups   map[string]rateLimitGroup
+	fallback *rateLimitGroup
+	exempt   []*net.IPNet
+	// clock tells the time the buckets are refilled by. When nil, the
+	// system clock is used.
+	clock clock
+}
+
+// newRateLimitPolicy parses the limits in the config, which take their
+// tokens from store. It returns nil when nothing is throttled.
+func newRateLimitPolicy(cfg rateLimitConfig, store rateLimitStore) (*rateLimitPolicy, error) {
+	switch cfg.Store {
+	case "", rateLimitStoreMemory, rateLimitStoreRedis:
+	default:
+		return nil, errors.Errorf("unknown rate limits store: '%s'", cfg.Store)
+	}
+
+	rlp := &rateLimitPolicy{store: store, groups: map[string]rateLimitGroup{}}
+	for name, gc := range cfg.Groups {
+		g, err := newRateLimitGroup(name, gc)
+		if err != nil {
+			return nil, err
+		}
+		if len(gc.Routes) == 0 {
+			return nil, errors.Errorf("rate limit group '%s' has no routes", name)
+		}
+		for _, route := range gc.Routes {
+			if other, ok := rlp.groups[route]; ok {
+				return nil, errors.Errorf("'%s' is in both rate limit groups '%s' and '%s'", route, other.name, name)
+			}
+			rlp.groups[route] = g
+		}
+	}
+	if cfg.Default != nil {
+		g, err := newRateLimitGroup("default", *cfg.Default)
+		if err != nil {
+			return nil, err
+		}
+		rlp.fallback = &g
+	}
+
+	var err error
+	if rlp.exempt, err = parseProxySources(cfg.Exempt); err != nil {
+		return nil, errors.Wrap(err, "invalid rate limits 'exempt'")
+	}
+
+	if len(rlp.groups) == 0 && rlp.fallback == nil {
+		return nil, nil
+	}
+	return rlp, nil
+}
+
+func newRateLimitGroup(name string, gc rateLimitGroupConfig) (rateLimitGroup, error) {
+	if gc.Rate <= 0 || math.IsInf(gc.Rate, 0) {
+		return rateLimitGroup{}, errors.Errorf("rate limit group '%s' needs a positive rate", name)
+	}
+	if gc.Burst < 1 {
+		return rateLimitGroup{}, errors.Errorf("rate limit group '%s' needs a burst of at least 1", name)
+	}
+	return rateLimitGroup{name: name, rate: gc.Rate, burst: gc.Burst}, nil
+}
+
+// group returns the group of the route with path template tmpl, or nil if
+// the route isn't throttled
+func (rlp *rateLimitPolicy) group(tmpl string) *rateLimitGroup {
+	if g, ok := rlp.groups[tmpl]; ok {
+		return &g
+	}
+	return rlp.fallback
+}
+
+// isExempt returns whether requests from ip are never throttled
+func (rlp *rateLimitPolicy) isExempt(ip net.IP) bool {
+	for _, n := range rlp.exempt {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rlp *rateLimitPolicy) now() time.Time {
+	if rlp.clock == nil {
+		return time.Now()
+	}
+	return rlp.clock.Now()
+}
+
+// Middleware rejects the requests of clients that have used up the tokens
+// of the route's group, with a 429 telling them when to retry. Requests
+// whose address can't be told are let through, and so are all requests
+// when the store fails, so an outage of redis doesn't take down the api.
+func (rlp *rateLimitPolicy) Middleware(next http.Handler) http.Handler {
+	if rlp == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tmpl := ""
+		if route := mux.CurrentRoute(r); route != nil {
+			tmpl, _ = route.GetPathTemplate()
+		}
+		g := rlp.group(tmpl)
+		ip := remoteIP(r)
+		if g == nil || ip == nil || rlp.isExempt(ip) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		wait, err := rlp.store.TakeToken(g.name+":"+ip.String(), g.rate, g.burst, rlp.now())
+		if err != nil {
+			logErr(errors.Wrap(err, "unable to take a rate limit token"))
+			next.ServeHTTP(w, r)
+			return
+		}
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			sendErr(w, "Too many requests. Try again later.", http.StatusTooManyRequests, errorRateLimited)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// memoryRateLimits keeps the token buckets in memory, so each instance
+// throttles the requests it receives on its own
+type memoryRateLimits struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// tokenBucket holds the tokens left when they were last counted
+type tokenBucket struct {
+	tokens  float64
+	counted time.Time
+	// full is when the bucket will have refilled
+	full time.Time
+}
+
+func newMemoryRateLimits() *memoryRateLimits {
+	return &memoryRateLimits{buckets: map[string]*tokenBucket{}}
+}
+
+// TakeToken fulfills rateLimitStore
+func (mrl *memoryRateLimits) TakeToken(bucket string, rate float64, burst int, now time.Time) (time.Duration, error) {
+	mrl.mu.Lock()
+	defer mrl.mu.Unlock()
+
+	if now.Sub(mrl.lastSweep) >= rateLimitSweepInterval {
+		// a missing bucket is a full one
+		for key, b := range mrl.buckets {
+			if !now.Before(b.full) {
+				delete(mrl.buckets, key)
+			}
+		}
+		mrl.lastSweep = now
+	}
+
+	b, ok := mrl.buckets[bucket]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), counted: now}
+		mrl.buckets[bucket] = b
+	}
+	if now.After(b.counted) {
+		b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.counted).Seconds()*rate)
+		b.counted = now
+	}
+	if b.tokens < 1 {
+		return time.Duration(math.Ceil((1 - b.tokens) / rate * float64(time.Second))), nil
+	}
+	b.tokens--
+	b.full = b.counted.Add(time.Duration((float64(burst) - b.tokens) / rate * float64(time.Second)))
+	return 0, nil
+}
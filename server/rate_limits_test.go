@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/apierr"
+)
+
+func TestRateLimitPolicy(t *testing.T) {
+	rlp, err := newRateLimitPolicy(rateLimitConfig{}, newMemoryRateLimits())
+	require.NoError(t, err)
+	require.Nil(t, rlp)
+
+	rlp, err = newRateLimitPolicy(rateLimitConfig{
+		Groups:  map[string]rateLimitGroupConfig{"auth": {Routes: []string{"/1/sessions"}, Rate: 1, Burst: 5}},
+		Default: &rateLimitGroupConfig{Rate: 10, Burst: 20},
+	}, newMemoryRateLimits())
+	require.NoError(t, err)
+	require.Equal(t, "auth", rlp.group("/1/sessions").name)
+	require.Equal(t, "default", rlp.group("/1/messages").name)
+
+	bad := []rateLimitConfig{
+		{Store: "disk"},
+		{Default: &rateLimitGroupConfig{Rate: 0, Burst: 1}},
+		{Default: &rateLimitGroupConfig{Rate: 1, Burst: 0}},
+		{Groups: map[string]rateLimitGroupConfig{"auth": {Rate: 1, Burst: 1}}},
+		{Groups: map[string]rateLimitGroupConfig{
+			"a": {Routes: []string{"/1/sessions"}, Rate: 1, Burst: 1},
+			"b": {Routes: []string{"/1/sessions"}, Rate: 1, Burst: 1},
+		}},
+		{Default: &rateLimitGroupConfig{Rate: 1, Burst: 1}, Exempt: []string{"10.0.0.0/33"}},
+	}
+	for _, cfg := range bad {
+		_, err = newRateLimitPolicy(cfg, nil)
+		require.Error(t, err, "%+v", cfg)
+	}
+}
+
+func TestMemoryRateLimits(t *testing.T) {
+	mrl := newMemoryRateLimits()
+	now := time.Unix(1600000000, 0)
+
+	for i := 0; i < 2; i++ {
+		wait, err := mrl.TakeToken("a", 0.5, 2, now)
+		require.NoError(t, err)
+		require.Zero(t, wait)
+	}
+	wait, err := mrl.TakeToken("a", 0.5, 2, now)
+	require.NoError(t, err)
+	require.Equal(t, 2*time.Second, wait)
+	wait, err = mrl.TakeToken("b", 0.5, 2, now)
+	require.NoError(t, err)
+	require.Zero(t, wait)
+
+	wait, err = mrl.TakeToken("a", 0.5, 2, now.Add(time.Second))
+	require.NoError(t, err)
+	require.Equal(t, time.Second, wait)
+	wait, err = mrl.TakeToken("a", 0.5, 2, now.Add(2*time.Second))
+	require.NoError(t, err)
+	require.Zero(t, wait)
+
+	// buckets are dropped once they've filled up again
+	_, err = mrl.TakeToken("c", 0.5, 2, now.Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, mrl.buckets, 1)
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	rlp, err := newRateLimitPolicy(rateLimitConfig{
+		Groups: map[string]rateLimitGroupConfig{"auth": {Routes: []string{"/1/sessions"}, Rate: 0.1, Burst: 2}},
+		Exempt: []string{"10.0.0.0/8"},
+	}, newMemoryRateLimits())
+	require.NoError(t, err)
+	clock := newFakeClock(time.Unix(1600000000, 0))
+	rlp.clock = clock
+
+	r := mux.NewRouter()
+	ok := func(w http.ResponseWriter, r *http.Request) { sendSuccess(w, nil) }
+	r.HandleFunc("/1/sessions", ok)
+	r.HandleFunc("/1/messages", ok)
+	r.Use(rlp.Middleware)
+
+	request := func(path, addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		require.Equal(t, http.StatusOK, request("/1/sessions", "203.0.113.7:1234").Code)
+	}
+	w := request("/1/sessions", "203.0.113.7:4321")
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, "10", w.Header().Get("Retry-After"))
+	body := apierr.Body{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+	require.Equal(t, errorRateLimited, body.Code)
+
+	// other clients, ungrouped routes and exempt networks are let through
+	require.Equal(t, http.StatusOK, request("/1/sessions", "203.0.113.8:1234").Code)
+	require.Equal(t, http.StatusOK, request("/1/messages", "203.0.113.7:1234").Code)
+	for i := 0; i < 3; i++ {
+		require.Equal(t, http.StatusOK, request("/1/sessions", "10.1.2.3:1234").Code)
+	}
+
+	clock.Advance(10 * time.Second)
+	require.Equal(t, http.StatusOK, request("/1/sessions", "203.0.113.7:1234").Code)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net"
+	"net/http"
+)
+
+// The networks ipPrefix truncates addresses to. They're about the size
+// handed to a single household or office, so they tell where a request came
+// from without pinpointing the device.
+const (
+	ipv4PrefixBits = 24
+	ipv6PrefixBits = 48
+)
+
+// remoteIP returns the address the request came from, or nil if it can't be
+// parsed. Behind a proxy speaking the PROXY protocol, it's the address of
+// the client rather than the proxy.
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// ipPrefix returns the network ip is in, e.g. 203.0.113.0/24, or an empty
+// string when ip is nil
+func ipPrefix(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(ipv4PrefixBits, 32)), Mask: net.CIDRMask(ipv4PrefixBits, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(ipv6PrefixBits, 128)), Mask: net.CIDRMask(ipv6PrefixBits, 128)}).String()
+}
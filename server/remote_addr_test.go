@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPPrefix(t *testing.T) {
+	for remoteAddr, prefix := range map[string]string{
+		"203.0.113.57:4321":            "203.0.113.0/24",
+		"[2001:db8:1234:5678::1]:4321": "2001:db8:1234::/48",
+		"[::ffff:203.0.113.57]:4321":   "203.0.113.0/24",
+		"198.51.100.7":                 "198.51.100.0/24",
+		"not an address":               "",
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remoteAddr
+		require.Equal(t, prefix, ipPrefix(remoteIP(r)), remoteAddr)
+	}
+}
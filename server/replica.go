@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// replicaLocalRoutes are served by a replica from its own copy of the
+// storage, keyed by path template and then method. They only read, so a
+// replica lagging behind the primary serves stale data rather than losing
+// writes. Every other request is proxied to the primary, including the
+// websockets, since drops are only broadcast by the instance that stores
+// them.
+var replicaLocalRoutes = map[string]map[string]bool{
+	"/server-info":                    {http.MethodGet: true, http.MethodOptions: true},
+	"/readyz":                         {http.MethodGet: true},
+	"/metrics":                        {http.MethodGet: true},
+	"/log-level":                      {http.MethodGet: true, http.MethodOptions: true},
+	"/admin/log-level":                {http.MethodPut: true},
+	"/1/users/{public_id}":            {http.MethodGet: true, http.MethodOptions: true},
+	"/1/users/{public_id}/public-key": {http.MethodGet: true, http.MethodOptions: true},
+	"/1/messages":                     {http.MethodGet: true, http.MethodOptions: true},
+	"/1/messages/{message_id:[0-9]+}": {http.MethodGet: true, http.MethodOptions: true},
+	"/1/drop-boxes/{box_id}":          {http.MethodGet: true, http.MethodOptions: true},
+	"/1/errors":                       {http.MethodGet: true, http.MethodOptions: true},
+	"/1/public-key":                   {http.MethodGet: true, http.MethodOptions: true},
+	"/1/time":                         {http.MethodGet: true, http.MethodOptions: true},
+	"/1/goroutine-stacks":             {http.MethodGet: true, http.MethodOptions: true},
+}
+
+// replicaProxy makes this instance a read-only replica of the primary at
+// primary. A nil proxy means this instance is the primary, and serves every
+// request itself.
+type replicaProxy struct {
+	primary *url.URL
+	proxy   *httputil.ReverseProxy
+}
+
+// newReplicaProxy returns a proxy to the primary at primaryURL, or nil if
+// primaryURL is empty
+func newReplicaProxy(primaryURL string) (*replicaProxy, error) {
+	if primaryURL == "" {
+		return nil, nil
+	}
+	primary, err := parseInstanceURL(primaryURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid primary url")
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(primary)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		// the primary may be behind a load balancer that routes by host
+		r.Host = primary.Host
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		logErr(errors.Wrapf(err, "unable to proxy %s %s to the primary", r.Method, r.URL.Path))
+		sendErr(w, "The primary server is unreachable", http.StatusBadGateway, errorInternal)
+	}
+
+	return &replicaProxy{primary: primary, proxy: proxy}, nil
+}
+
+// parseInstanceURL parses the base url of another oscar instance
+func parseInstanceURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, errors.Errorf("'%s' must be http or https", s)
+	}
+	if u.Host == "" {
+		return nil, errors.Errorf("'%s' has no host", s)
+	}
+	return u, nil
+}
+
+// Middleware serves the replicaLocalRoutes, and proxies everything else to
+// the primary
+func (rp *replicaProxy) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rp == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tmpl := ""
+		if route := mux.CurrentRoute(r); route != nil {
+			tmpl, _ = route.GetPathTemplate()
+		}
+		if replicaLocalRoutes[tmpl][r.Method] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rp.proxy.ServeHTTP(w, r)
+	})
+}
+
+// trustedReplicas are the addresses or ranges the replicas of a primary
+// connect from
+type trustedReplicas []*net.IPNet
+
+// Middleware attributes the requests a replica proxied to the client the
+// replica received them from, which the proxy appends to X-Forwarded-For.
+// The earlier entries of the header came from the client, so they aren't
+// trusted.
+func (tr trustedReplicas) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(tr) == 0 || !tr.contains(remoteIP(r)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		forwarded := r.Header.Get("X-Forwarded-For")
+		client := net.ParseIP(strings.TrimSpace(forwarded[strings.LastIndex(forwarded, ",")+1:]))
+		if client != nil {
+			r = r.WithContext(r.Context())
+			r.RemoteAddr = net.JoinHostPort(client.String(), "0")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (tr trustedReplicas) contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range tr {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
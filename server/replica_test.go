@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewReplicaProxy(t *testing.T) {
+	rp, err := newReplicaProxy("")
+	require.NoError(t, err)
+	require.Nil(t, rp)
+
+	for _, bad := range []string{"api.zood.xyz", "ftp://api.zood.xyz", "https://", "%zz"} {
+		_, err = newReplicaProxy(bad)
+		require.Error(t, err, bad)
+	}
+}
+
+func TestReplicaProxiesWrites(t *testing.T) {
+	var mu sync.Mutex
+	var proxied []string
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		proxied = append(proxied, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		sendSuccess(w, nil)
+	}))
+	defer primary.Close()
+
+	providers := createTestProviders(t)
+	var err error
+	providers.replica, err = newReplicaProxy(primary.URL)
+	require.NoError(t, err)
+	router := newOscarRouter(providers)
+
+	// creating a user writes, so it goes to the primary
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/1/users", strings.NewReader("{}"))
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// the server's public key is served by the replica
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/1/public-key", nil)
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// so are the messages, from the replicated storage
+	clock := newFakeClock(time.Now())
+	providers.clock = clock
+	user, keyPair := createTestUser(t, providers)
+	token := loginTestUser(t, providers, user, keyPair)
+	clock.Advance(sessionTouchInterval)
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/1/messages", nil)
+	req.Header.Set("X-Oscar-Access-Token", token)
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	// without recording the use of the session, since the replicated
+	// storage is read-only
+	sessions, err := providers.db.Sessions(user.ID, clock.Now().Unix())
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	require.Equal(t, clock.Now().Add(-sessionTouchInterval).Unix(), sessions[0].LastUsed)
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/server-info", nil)
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	info := map[string]interface{}{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&info))
+	require.Equal(t, primary.URL, info["primary_url"])
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, []string{"POST /1/users"}, proxied)
+}
+
+func TestReplicaPrimaryUnreachable(t *testing.T) {
+	primary := httptest.NewServer(http.NotFoundHandler())
+	primaryURL := primary.URL
+	primary.Close()
+
+	providers := createTestProviders(t)
+	var err error
+	providers.replica, err = newReplicaProxy(primaryURL)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/1/users", strings.NewReader("{}"))
+	newOscarRouter(providers).ServeHTTP(w, req)
+	require.Equal(t, http.StatusBadGateway, w.Code)
+}
+
+func TestTrustedReplicas(t *testing.T) {
+	sources, err := parseProxySources([]string{"192.0.2.0/24"})
+	require.NoError(t, err)
+	handler := trustedReplicas(sources).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(ipPrefix(remoteIP(r))))
+	}))
+	prefix := func(remoteAddr, forwarded string) string {
+		r := httptest.NewRequest(http.MethodPost, "/1/sessions/alice/finish-login", nil)
+		r.RemoteAddr = remoteAddr
+		if forwarded != "" {
+			r.Header.Set("X-Forwarded-For", forwarded)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	// a replica's request is the client's, as the replica appended it
+	require.Equal(t, "203.0.113.0/24", prefix("192.0.2.7:40000", "198.51.100.1, 203.0.113.9"))
+	require.Equal(t, "192.0.2.0/24", prefix("192.0.2.7:40000", ""))
+	// anyone else can't claim an address
+	require.Equal(t, "198.51.100.0/24", prefix("198.51.100.1:40000", "203.0.113.9"))
+}
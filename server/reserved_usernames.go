@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// maxReservationsPerRequest bounds the usernames reserved by one request
+const maxReservationsPerRequest = 1000
+
+// reservedUsername is the JSON form of model.ReservedUsernameRecord
+type reservedUsername struct {
+	Username  string `json:"username"`
+	Email     string `json:"email,omitempty"`
+	Note      string `json:"note,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// reserveUsernamesHandler handles POST /admin/reserved-usernames. The
+// usernames can only be registered by signing up with email. Without an
+// email, nobody can register them until the reservation is deleted.
+func reserveUsernamesHandler(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Usernames []string `json:"usernames"`
+		Email     string   `json:"email"`
+		Note      string   `json:"note"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendBadReq(w, "Unable to parse POST body: "+err.Error())
+		return
+	}
+	if len(body.Usernames) == 0 || len(body.Usernames) > maxReservationsPerRequest {
+		sendBadReq(w, fmt.Sprintf("between 1 and %d usernames can be reserved at once", maxReservationsPerRequest))
+		return
+	}
+	usernames := make([]string, 0, len(body.Usernames))
+	for _, u := range body.Usernames {
+		u = strings.ToLower(strings.TrimSpace(u))
+		if len(u) > 32 || !validUsernamePattern.MatchString(u) {
+			sendBadReqCode(w, fmt.Sprintf("'%s' isn't a valid username", u), errorInvalidUsername)
+			return
+		}
+		usernames = append(usernames, u)
+	}
+	email := strings.ToLower(strings.TrimSpace(body.Email))
+	if email != "" && !strings.Contains(email, "@") {
+		sendBadReqCode(w, "'email' must be an email address", errorInvalidEmail)
+		return
+	}
+
+	providers := providersCtx(r.Context())
+	if err := providers.db.ReserveUsernames(usernames, email, body.Note); err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	details := fmt.Sprintf("%d usernames", len(usernames))
+	if email != "" {
+		details += " for " + email
+	}
+	providers.events.emit(accountEvent{Kind: eventUsernamesReserved, Actor: actorAdmin, Details: details})
+
+	sendSuccess(w, struct {
+		Reserved int `json:"reserved"`
+	}{Reserved: len(usernames)})
+}
+
+// reservedUsernamesHandler handles GET /admin/reserved-usernames
+func reservedUsernamesHandler(w http.ResponseWriter, r *http.Request) {
+	records, err := providersCtx(r.Context()).db.ReservedUsernames()
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	reservations := make([]reservedUsername, 0, len(records))
+	for _, rec := range records {
+		reservations = append(reservations, reservedUsername{
+			Username:  rec.Username,
+			Email:     rec.Email,
+			Note:      rec.Note,
+			CreatedAt: rec.CreatedAt,
+		})
+	}
+
+	sendSuccess(w, reservations)
+}
+
+// deleteReservedUsernameHandler handles DELETE /admin/reserved-usernames/{username}
+func deleteReservedUsernameHandler(w http.ResponseWriter, r *http.Request) {
+	username := strings.ToLower(mux.Vars(r)["username"])
+	deleted, err := providersCtx(r.Context()).db.DeleteReservedUsername(username)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if !deleted {
+		sendNotFound(w, fmt.Sprintf("'%s' isn't reserved", username), errorNotFound)
+		return
+	}
+
+	sendSuccess(w, nil)
+}
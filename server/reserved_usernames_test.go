@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/smtp"
+	"zood.dev/oscar/sodium"
+)
+
+func TestReservedUsernames(t *testing.T) {
+	providers := createTestProviders(t)
+	providers.adminToken = "admin-token"
+	router := newOscarRouter(providers)
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer admin-token")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	require.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/admin/reserved-usernames", `{"usernames": ["no"]}`).Code)
+	w := do(http.MethodPost, "/admin/reserved-usernames", `{"usernames": ["AcmeCorp", "acmesupport"], "note": "brand"}`)
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	w = do(http.MethodPost, "/admin/reserved-usernames", `{"usernames": ["janedoe"], "email": "Jane@Acme.example"}`)
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+
+	w = do(http.MethodGet, "/admin/reserved-usernames", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var reservations []reservedUsername
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&reservations))
+	require.Len(t, reservations, 3)
+	require.Equal(t, "acmecorp", reservations[0].Username)
+	require.Equal(t, "jane@acme.example", reservations[2].Email)
+
+	signUp := func(username, email string) *serverError {
+		keyPair, err := sodium.NewKeyPair()
+		require.NoError(t, err)
+		_, sErr := createUser(providers.db, providers.kvs, smtp.NewMockSendEmailer(), nil, providers.random(), nil, User{
+			Email:                       email,
+			PasswordHashAlgorithm:       sodium.Argon2id13.Name,
+			PasswordHashMemoryLimit:     sodium.Argon2id13.MemLimitInteractive,
+			PasswordHashOperationsLimit: sodium.Argon2id13.OpsLimitInteractive,
+			PasswordSalt:                []byte("password-salt"),
+			PublicKey:                   keyPair.Public,
+			Username:                    username,
+			WrappedSecretKey:            []byte("wrapped-secret-key"),
+			WrappedSecretKeyNonce:       []byte("wrapped-secret-key-nonce"),
+			WrappedSymmetricKey:         []byte("wrapped-symmetric-key"),
+			WrappedSymmetricKeyNonce:    []byte("wrapped-symmetric-key-nonce"),
+		})
+		return sErr
+	}
+
+	// reserved for nobody
+	sErr := signUp("acmecorp", "")
+	require.NotNil(t, sErr)
+	require.Equal(t, errorUsernameNotAvailable, sErr.code)
+	// reserved for someone else
+	sErr = signUp("janedoe", "mallory@example.com")
+	require.NotNil(t, sErr)
+	require.Equal(t, errorUsernameNotAvailable, sErr.code)
+	// claimed by the right email, which uses up the reservation
+	require.Nil(t, signUp("janedoe", "jane@acme.example"))
+	rec, err := providers.db.ReservedUsername("janedoe")
+	require.NoError(t, err)
+	require.Nil(t, rec)
+
+	require.Equal(t, http.StatusOK, do(http.MethodDelete, "/admin/reserved-usernames/acmecorp", "").Code)
+	require.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/admin/reserved-usernames/acmecorp", "").Code)
+	require.Nil(t, signUp("acmecorp", ""))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// apiVersion is a major version of the API. Version n is served under /n.
+type apiVersion int
+
+// API versions, oldest first
+const (
+	apiV1 apiVersion = 1
+)
+
+// currentAPIVersion is the newest version of the API
+const currentAPIVersion = apiV1
+
+// apiRoute is an endpoint of the versioned API. The same handler serves
+// every version the route supports, and a shim can adapt the request or
+// response for the versions that differ.
+type apiRoute struct {
+	method  string
+	path    string
+	handler http.Handler
+	// since is the first version serving the route
+	since apiVersion
+	// until is the last version serving the route, or 0 if it's still
+	// served by the current version
+	until apiVersion
+	// shims wrap the handler for specific versions
+	shims map[apiVersion]func(http.Handler) http.Handler
+	// serverToServer routes aren't called from browsers, so they don't
+	// answer CORS preflight requests
+	serverToServer bool
+}
+
+// servedBy returns whether v serves the route
+func (ar apiRoute) servedBy(v apiVersion) bool {
+	return v >= ar.since && (ar.until == 0 || v <= ar.until)
+}
+
+// apiRoutes returns the endpoints of every version of the API. Routes are
+// matched in order, so a literal path has to come before a variable one that
+// would also match it.
+func apiRoutes() []apiRoute {
+	return []apiRoute{
+		{method: http.MethodGet, path: "/users", handler: sessionHandler(searchUsersHandler), since: apiV1},
+		// this has to come before /users/{public_id}
+		{method: http.MethodGet, path: "/users/blind-lookup", handler: sessionHandler(searchUsersByIndexHandler), since: apiV1},
+		{method: http.MethodPost, path: "/users/discover", handler: sessionHandler(discoverUsersHandler), since: apiV1},
+		{method: http.MethodPost, path: "/users", handler: http.HandlerFunc(createUserHandler), since: apiV1},
+		{method: http.MethodPost, path: "/users/me/apns-tokens", handler: sessionHandler(addAPNSTokenHandler), since: apiV1},
+		{method: http.MethodDelete, path: "/users/me/apns-tokens/{token}", handler: sessionHandler(deleteAPNSTokenHandler), since: apiV1},
+		{method: http.MethodPost, path: "/users/me/fcm-tokens", handler: sessionHandler(addFCMTokenHandler), since: apiV1},
+		{method: http.MethodDelete, path: "/users/me/fcm-tokens/{token}", handler: sessionHandler(deleteFCMTokenHandler), since: apiV1},
+		{method: http.MethodGet, path: "/users/me/data-summary", handler: sessionHandler(dataSummaryHandler), since: apiV1},
+		{method: http.MethodGet, path: "/users/me/sessions", handler: sessionHandler(listSessionsHandler), since: apiV1},
+		{method: http.MethodDelete, path: "/users/me/sessions/{id}", handler: sessionHandler(deleteSessionHandler), since: apiV1},
+		{method: http.MethodGet, path: "/users/me/storage", handler: sessionHandler(storageUsageHandler), since: apiV1},
+		{method: http.MethodPut, path: "/users/me/locale", handler: sessionHandler(setLocaleHandler), since: apiV1},
+		{method: http.MethodPost, path: "/users/me/email", handler: sessionHandler(changeEmailHandler), since: apiV1},
+		{method: http.MethodGet, path: "/users/me/backup", handler: sessionHandler(retrieveBackupHandler), since: apiV1},
+		{method: http.MethodPut, path: "/users/me/backup", handler: sessionHandler(saveBackupHandler), since: apiV1},
+		{method: http.MethodGet, path: "/users/{public_id}", handler: sessionHandler(getUserInfoHandler), since: apiV1},
+		{method: http.MethodPost, path: "/users/{public_id}/messages", handler: sessionHandler(sendMessageToUserHandler), since: apiV1},
+		{method: http.MethodPost, path: "/users/{public_id}/sealed-messages", handler: http.HandlerFunc(sendSealedSenderMessageHandler), since: apiV1},
+		{method: http.MethodGet, path: "/users/{public_id}/public-key", handler: http.HandlerFunc(getUserPublicKeyHandler), since: apiV1},
+
+		{method: http.MethodPost, path: "/delivery-tokens", handler: sessionHandler(createDeliveryTokensHandler), since: apiV1},
+
+		{method: http.MethodGet, path: "/messages", handler: sessionHandler(getMessagesHandler, scopeMessagesRead), since: apiV1},
+		{method: http.MethodDelete, path: "/messages", handler: sessionHandler(ackMessagesHandler), since: apiV1},
+		{method: http.MethodGet, path: "/messages/{message_id:[0-9]+}", handler: sessionHandler(getMessageHandler, scopeMessagesRead), since: apiV1},
+		{method: http.MethodDelete, path: "/messages/{message_id:[0-9]+}", handler: sessionHandler(deleteMessageHandler), since: apiV1},
+
+		// this has to come first, so it has a chance to match before the box_id urls
+		{method: http.MethodGet, path: "/drop-boxes/watch", handler: http.HandlerFunc(createPackageWatcherHandler), since: apiV1},
+		{method: http.MethodPost, path: "/drop-boxes/send", handler: sessionHandler(sendMultiplePackagesHandler), since: apiV1},
+		{method: http.MethodGet, path: "/drop-boxes/{box_id}", handler: sessionHandler(pickUpPackageHandler, scopeDropBoxReadOnly), since: apiV1},
+		{method: http.MethodPut, path: "/drop-boxes/{box_id}", handler: sessionHandler(dropPackageHandler), since: apiV1},
+		{method: http.MethodPost, path: "/drop-boxes/{box_id}/aliases", handler: sessionHandler(addBoxAliasHandler), since: apiV1},
+
+		{method: http.MethodGet, path: "/errors", handler: http.HandlerFunc(errorCatalogHandler), since: apiV1},
+		{method: http.MethodGet, path: "/public-key", handler: http.HandlerFunc(getServerPublicKeyHandler), since: apiV1},
+		{method: http.MethodGet, path: "/status", handler: http.HandlerFunc(statusHandler), since: apiV1},
+		{method: http.MethodGet, path: "/time", handler: http.HandlerFunc(serverTimeHandler), since: apiV1},
+
+		// We have to name the tickets endpoint with something that isn't a valid username, otherwise we would have just used /tickets
+		{method: http.MethodPost, path: "/sessions/expiring-tickets", handler: sessionHandler(createTicketHandler), since: apiV1},
+		{method: http.MethodPost, path: "/sessions/scoped-tokens", handler: sessionHandler(createScopedAccessTokenHandler), since: apiV1},
+		{method: http.MethodDelete, path: "/sessions/me", handler: sessionHandler(revokeSessionHandler), since: apiV1},
+		{method: http.MethodDelete, path: "/sessions", handler: sessionHandler(revokeAllSessionsHandler), since: apiV1},
+		{method: http.MethodPost, path: "/sessions/refresh", handler: http.HandlerFunc(refreshSessionHandler), since: apiV1},
+		{method: http.MethodPost, path: "/sessions/{username}/challenge", handler: http.HandlerFunc(createAuthChallengeHandler), since: apiV1},
+		{method: http.MethodPost, path: "/sessions/{username}/challenge-response", handler: http.HandlerFunc(finishAuthChallengeHandler), since: apiV1},
+
+		{method: http.MethodGet, path: "/sockets", handler: http.HandlerFunc(createSocketHandler), since: apiV1},
+
+		{method: http.MethodPost, path: "/email-events", handler: http.HandlerFunc(mailgunWebhookHandler), since: apiV1, serverToServer: true},
+		{method: http.MethodPost, path: "/email-events/mailgun", handler: http.HandlerFunc(mailgunWebhookHandler), since: apiV1, serverToServer: true},
+		{method: http.MethodPost, path: "/email-verifications", handler: http.HandlerFunc(verifyEmailHandler), since: apiV1},
+		{method: http.MethodDelete, path: "/email-verifications/{token}", handler: http.HandlerFunc(disavowEmailHandler), since: apiV1},
+
+		{method: http.MethodGet, path: "/goroutine-stacks", handler: http.HandlerFunc(goroutineStacksHandler), since: apiV1},
+		{method: http.MethodGet, path: "/logs", handler: http.HandlerFunc(recordLogMessageHandler), since: apiV1},
+	}
+}
+
+// registerAPIRoutes adds a subrouter for every version of the API up to
+// currentAPIVersion, serving the routes that version supports
+func registerAPIRoutes(r *mux.Router, routes []apiRoute) {
+	for v := apiV1; v <= currentAPIVersion; v++ {
+		sub := r.PathPrefix(fmt.Sprintf("/%d", v)).Subrouter()
+		sub.Use(apiVersionMiddleware(v))
+		for _, ar := range routes {
+			if !ar.servedBy(v) {
+				continue
+			}
+			handler := ar.handler
+			if shim := ar.shims[v]; shim != nil {
+				handler = shim(handler)
+			}
+			methods := []string{ar.method, http.MethodOptions}
+			if ar.serverToServer {
+				methods = methods[:1]
+			}
+			sub.Handle(ar.path, handler).Methods(methods...)
+		}
+	}
+}
+
+// apiVersionMiddleware records the version of the API a request was made to
+func apiVersionMiddleware(v apiVersion) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), contextAPIVersionKey, v)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// apiVersionFromContext returns the version of the API the request was made
+// to, or currentAPIVersion for requests outside the versioned API
+func apiVersionFromContext(ctx context.Context) apiVersion {
+	if v, ok := ctx.Value(contextAPIVersionKey).(apiVersion); ok {
+		return v
+	}
+	return currentAPIVersion
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterAPIRoutes(t *testing.T) {
+	versionHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strconv.Itoa(int(apiVersionFromContext(r.Context())))))
+	})
+	shimmed := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Shim", "yes")
+			next.ServeHTTP(w, r)
+		})
+	}
+	r := mux.NewRouter()
+	registerAPIRoutes(r, []apiRoute{
+		{method: http.MethodGet, path: "/current", handler: versionHandler, since: apiV1},
+		{method: http.MethodGet, path: "/shimmed", handler: versionHandler, since: apiV1, shims: map[apiVersion]func(http.Handler) http.Handler{apiV1: shimmed}},
+		{method: http.MethodGet, path: "/future", handler: versionHandler, since: currentAPIVersion + 1},
+		{method: http.MethodPost, path: "/webhook", handler: versionHandler, since: apiV1, serverToServer: true},
+	})
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	w := serve(http.MethodGet, "/1/current")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "1", w.Body.String())
+	require.Empty(t, w.Header().Get("X-Shim"))
+	require.Equal(t, http.StatusOK, serve(http.MethodOptions, "/1/current").Code)
+
+	w = serve(http.MethodGet, "/1/shimmed")
+	require.Equal(t, "yes", w.Header().Get("X-Shim"))
+
+	require.Equal(t, http.StatusNotFound, serve(http.MethodGet, "/1/future").Code)
+	require.Equal(t, http.StatusMethodNotAllowed, serve(http.MethodOptions, "/1/webhook").Code)
+	require.Equal(t, http.StatusNotFound, serve(http.MethodGet, "/2/current").Code)
+}
+
+func TestAPIRouteServedBy(t *testing.T) {
+	ar := apiRoute{since: 2, until: 3}
+	require.False(t, ar.servedBy(1))
+	require.True(t, ar.servedBy(2))
+	require.True(t, ar.servedBy(3))
+	require.False(t, ar.servedBy(4))
+	require.True(t, apiRoute{since: 1}.servedBy(5))
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"zood.dev/oscar/encodable"
+)
+
+// Delivery tokens authorize sealed sender messages in place of a session.
+// They're sealed with the server's key ring and don't identify the user they
+// were issued to, so a sealed sender message reveals only its recipient. It
+// also means the tokens of a user who is suspended or banned can't be told
+// apart, and keep working until they expire. Only issuing them needs an
+// active account.
+const (
+	deliveryTokenLifetime  = 24 * time.Hour
+	deliveryTokenIDSize    = 16
+	maxDeliveryTokensIssue = 100
+)
+
+type deliveryToken struct {
+	ID        []byte `json:"id"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+func issueDeliveryToken(kr *keyRing, rand io.Reader, now time.Time) (string, error) {
+	token := deliveryToken{
+		ID:        make([]byte, deliveryTokenIDSize),
+		ExpiresAt: now.Add(deliveryTokenLifetime).Unix(),
+	}
+	if _, err := io.ReadFull(rand, token.ID); err != nil {
+		return "", err
+	}
+	buf, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := kr.seal(buf)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// redeemDeliveryToken returns true if token is valid, unexpired and hasn't
+// been used before. A token can only be redeemed once, so its id is kept in
+// the kv storage for as long as the token would still be accepted, which
+// includes the clock skew the server tolerates. The error is only for
+// failures of the kv storage.
+func redeemDeliveryToken(providers *serverProviders, token string) (bool, error) {
+	sealed, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return false, nil
+	}
+	buf, ok := providers.keys.open(sealed)
+	if !ok {
+		return false, nil
+	}
+	dt := deliveryToken{}
+	if err = json.Unmarshal(buf, &dt); err != nil {
+		return false, nil
+	}
+	if dt.ExpiresAt < providers.expiryClock(providers.now()).Unix() {
+		return false, nil
+	}
+
+	spendable := time.Unix(dt.ExpiresAt, 0).Add(providers.clockSkew)
+	return providers.kvs.SpendToken(dt.ID, spendable.Unix())
+}
+
+// createDeliveryTokensHandler handles POST /delivery-tokens
+func createDeliveryTokensHandler(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Count int `json:"count"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendBadReq(w, "unable to decode body: "+err.Error())
+		return
+	}
+	if body.Count < 1 || body.Count > maxDeliveryTokensIssue {
+		sendBadReq(w, "'count' must be between 1 and 100")
+		return
+	}
+
+	providers := providersCtx(r.Context())
+	now := providers.now()
+	tokens := make([]string, body.Count)
+	for i := range tokens {
+		var err error
+		tokens[i], err = issueDeliveryToken(providers.keys, providers.random(), now)
+		if err != nil {
+			sendInternalErr(w, err)
+			return
+		}
+	}
+
+	sendSuccess(w, struct {
+		Tokens    []string `json:"tokens"`
+		ExpiresAt int64    `json:"expires_at"`
+	}{Tokens: tokens, ExpiresAt: now.Add(deliveryTokenLifetime).Unix()})
+}
+
+// sendSealedSenderMessageHandler handles POST /users/{public_id}/sealed-messages
+//
+// The request isn't tied to a session. The sender's identity is expected to
+// be inside the cipher text, where only the recipient can see it.
+func sendSealedSenderMessageHandler(w http.ResponseWriter, r *http.Request) {
+	providers := providersCtx(r.Context())
+	userID, ok := parseUserID(w, r)
+	if !ok {
+		return
+	}
+
+	body := struct {
+		CipherText encodable.Bytes `json:"cipher_text"`
+		Nonce      encodable.Bytes `json:"nonce"`
+		Urgent     bool            `json:"urgent"`
+		Transient  bool            `json:"transient"`
+		Priority   string          `json:"priority"`
+		CollapseID string          `json:"collapse_id"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendBadReq(w, "unable to decode body: "+err.Error())
+		return
+	}
+	notify, err := notificationOptions(body.Urgent, body.Priority, body.CollapseID)
+	if err != nil {
+		sendBadReq(w, err.Error())
+		return
+	}
+
+	if !checkPayloadSize(w, providers.padding, len(body.CipherText)) {
+		return
+	}
+	in := ingress{Kind: ingressSealedMessage, RecipientID: userID, Size: len(body.CipherText)}
+	if !checkIngress(w, r, providers.ingressPolicies, in) {
+		return
+	}
+
+	// the token is only spent once the message is known to be acceptable, so
+	// a bad request doesn't cost the sender one of their tokens
+	redeemed, err := redeemDeliveryToken(providers, r.Header.Get("X-Oscar-Delivery-Token"))
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if !redeemed {
+		sendErr(w, "invalid, expired or already used delivery token", http.StatusUnauthorized, errorInvalidAccessToken)
+		return
+	}
+
+	db := providers.db
+	if shouldLogInfo() {
+		log.Printf("send_sealed_sender_message: => %s (urgent? %t, transient? %t)", db.Username(userID), body.Urgent, body.Transient)
+	}
+
+	now := providers.now()
+	msg := Message{
+		CipherText:   body.CipherText,
+		Nonce:        body.Nonce,
+		SentDate:     now.Unix(),
+		SealedSender: true,
+	}
+	sendAndDeliver(w, providers, userID, msg, body.Urgent, body.Transient, notify, now)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/encodable"
+)
+
+func TestDeliveryTokens(t *testing.T) {
+	providers := createTestProviders(t)
+	now := time.Now()
+
+	redeem := func(token string) bool {
+		redeemed, err := redeemDeliveryToken(providers, token)
+		require.NoError(t, err)
+		return redeemed
+	}
+	token, err := issueDeliveryToken(providers.keys, providers.random(), now)
+	require.NoError(t, err)
+	require.True(t, redeem(token))
+	// tokens are single use
+	require.False(t, redeem(token))
+
+	expired, err := issueDeliveryToken(providers.keys, providers.random(), now.Add(-deliveryTokenLifetime-time.Second))
+	require.NoError(t, err)
+	require.False(t, redeem(expired))
+
+	require.False(t, redeem("bogus"))
+}
+
+func TestSendSealedSenderMessageHandler(t *testing.T) {
+	providers := createTestProviders(t)
+	recipient, _ := createTestUser(t, providers)
+
+	send := func(token, publicID string) *httptest.ResponseRecorder {
+		buf, err := json.Marshal(map[string]interface{}{
+			"cipher_text": encodable.Bytes("cipher-text"),
+			"nonce":       encodable.Bytes("nonce"),
+		})
+		require.NoError(t, err)
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(buf))
+		r.Header.Set("X-Oscar-Delivery-Token", token)
+		r = mux.SetURLVars(r, map[string]string{"public_id": publicID})
+		r = r.WithContext(context.WithValue(r.Context(), contextServerProvidersKey, providers))
+		w := httptest.NewRecorder()
+		sendSealedSenderMessageHandler(w, r)
+		return w
+	}
+
+	token, err := issueDeliveryToken(providers.keys, providers.random(), time.Now())
+	require.NoError(t, err)
+	// an unknown recipient doesn't spend the token
+	require.Equal(t, http.StatusNotFound, send(token, hex.EncodeToString(make([]byte, 16))).Code)
+	w := send(token, hex.EncodeToString(recipient.PublicID))
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	require.Equal(t, http.StatusUnauthorized, send(token, hex.EncodeToString(recipient.PublicID)).Code)
+
+	recs, err := providers.db.MessageRecords(recipient.ID)
+	require.NoError(t, err)
+	require.Len(t, recs, 1)
+	require.Zero(t, recs[0].SenderID)
+
+	msg, err := messageFromRecord(providers.kvs, recs[0])
+	require.NoError(t, err)
+	require.True(t, msg.SealedSender)
+	require.Equal(t, encodable.Bytes("cipher-text"), msg.CipherText)
+}
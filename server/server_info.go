@@ -1,26 +1,120 @@
 package main
 
 import (
+	"fmt"
+	"io"
 	"net/http"
 	"runtime"
 	"runtime/pprof"
+	"time"
+
+	"zood.dev/oscar/encodable"
+	"zood.dev/oscar/usercache"
 )
 
 // ServerBuildTime is set via the linker at build time
 var ServerBuildTime string
 
+// sandboxMode is set when the server was started with the --sandbox flag
+var sandboxMode bool
+
+const sandboxBanner = "This is a sandbox server. Emails and push notifications are not delivered, and data may be deleted at any time."
+
+// Capabilities are the optional features a server can have, as named in the
+// capabilities of server-info. Clients rely on these names, so they must
+// never change. A feature that's retired stays listed as false.
+const (
+	// capabilityBackups is GET and PUT /users/me/backup
+	capabilityBackups = "backups"
+	// capabilityContactDiscovery is POST /users/discover
+	capabilityContactDiscovery = "contact_discovery"
+	// capabilityHashedUsernameLookup is GET /users/blind-lookup
+	capabilityHashedUsernameLookup = "hashed_username_lookup"
+	// capabilityOnionService is reaching the server at its onion_address
+	capabilityOnionService = "onion_service"
+	// capabilityPayloadPadding is the padding of messages and packages to
+	// one of the padding_buckets
+	capabilityPayloadPadding = "payload_padding"
+	// capabilityReplicas is reading from one of the replica_urls
+	capabilityReplicas = "replicas"
+	// capabilitySealedSender is POST /users/{public_id}/sealed-messages
+	capabilitySealedSender = "sealed_sender"
+	// capabilitySealedStorage is the sealing of stored messages to their
+	// recipient
+	capabilitySealedStorage = "sealed_storage"
+)
+
+// serverCapabilities reports which optional features are enabled. Every
+// capability is listed, so clients can tell a disabled feature from one this
+// server predates.
+func serverCapabilities(providers *serverProviders) map[string]bool {
+	return map[string]bool{
+		capabilityBackups:              providers.fs != nil,
+		capabilityContactDiscovery:     providers.usernameIndexSalt != nil,
+		capabilityHashedUsernameLookup: providers.usernameIndexSalt != nil,
+		capabilityOnionService:         onionAddress != "",
+		capabilityPayloadPadding:       providers.padding != nil,
+		capabilityReplicas:             len(providers.replicaURLs) > 0,
+		capabilitySealedSender:         true,
+		capabilitySealedStorage:        providers.sealMessages,
+	}
+}
+
 func goroutineStacksHandler(w http.ResponseWriter, r *http.Request) {
 	pprof.Lookup("goroutine").WriteTo(w, 1)
 }
 
+// serverInfoHandler handles GET /server-info. The body is cached by clients
+// and proxies, so it only holds what changes with the config. Runtime stats
+// are in /metrics.
 func serverInfoHandler(w http.ResponseWriter, r *http.Request) {
+	providers := providersCtx(r.Context())
+	brand := providers.branding.orDefault()
+	info := map[string]interface{}{
+		"build_time":   ServerBuildTime,
+		"capabilities": serverCapabilities(providers),
+		"product_name": brand.ProductName,
+	}
+	if brand.SupportEmail != "" {
+		info["support_email"] = brand.SupportEmail
+	}
+	if providers.padding != nil {
+		info["padding_buckets"] = providers.padding.buckets
+	}
+	if salt := providers.usernameIndexSalt; salt != nil {
+		info["username_index_salt"] = encodable.Bytes(salt)
+	}
+	if providers.replica != nil {
+		info["primary_url"] = providers.replica.primary.String()
+	}
+	if len(providers.replicaURLs) > 0 {
+		info["replica_urls"] = providers.replicaURLs
+	}
+	if onionAddress != "" {
+		info["onion_address"] = onionAddress
+	}
+	if sandboxMode {
+		info["sandbox"] = true
+		info["banner"] = sandboxBanner
+	}
+
+	sendCacheable(w, r, info, time.Minute)
+}
+
+// writeRuntimeMetrics writes the heap size and the user cache counters in the
+// prometheus text format
+func writeRuntimeMetrics(w io.Writer, providers *serverProviders) {
 	ms := &runtime.MemStats{}
 	runtime.ReadMemStats(ms)
+	fmt.Fprintf(w, "# HELP oscar_heap_alloc_bytes Bytes of allocated heap objects.\n# TYPE oscar_heap_alloc_bytes gauge\n")
+	fmt.Fprintf(w, "oscar_heap_alloc_bytes %d\n", ms.HeapAlloc)
 
-	info := map[string]interface{}{
-		"build_time": ServerBuildTime,
-		"sys_bytes":  ms.HeapAlloc,
+	uc, ok := providers.db.(*usercache.Provider)
+	if !ok {
+		return
 	}
-
-	sendSuccess(w, info)
+	hits, misses := uc.Stats()
+	fmt.Fprintf(w, "# HELP oscar_user_cache_lookups_total Lookups of users by whether the cache had them.\n# TYPE oscar_user_cache_lookups_total counter\n")
+	fmt.Fprintf(w, "oscar_user_cache_lookups_total{result=\"hit\"} %d\n", hits)
+	fmt.Fprintf(w, "oscar_user_cache_lookups_total{result=\"miss\"} %d\n", misses)
 }
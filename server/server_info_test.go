@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/usercache"
+)
+
+func TestServerInfoCapabilities(t *testing.T) {
+	providers := createTestProviders(t)
+	providers.usernameIndexSalt = nil
+	providers.sealMessages = true
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/server-info", nil)
+	providersInjector(providers, serverInfoHandler)(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	info := struct {
+		Capabilities map[string]bool `json:"capabilities"`
+	}{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&info))
+	// disabled features are listed too
+	require.Len(t, info.Capabilities, len(serverCapabilities(providers)))
+	require.False(t, info.Capabilities[capabilityContactDiscovery])
+	require.False(t, info.Capabilities[capabilityHashedUsernameLookup])
+	require.True(t, info.Capabilities[capabilityBackups])
+	require.True(t, info.Capabilities[capabilitySealedSender])
+	require.True(t, info.Capabilities[capabilitySealedStorage])
+}
+
+func TestServerInfoStable(t *testing.T) {
+	providers := createTestProviders(t)
+	providers.db = usercache.New(providers.db, time.Hour, 100)
+
+	get := func(etag string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/server-info", nil)
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		providersInjector(providers, serverInfoHandler)(w, r)
+		return w
+	}
+	w := get("")
+	require.Equal(t, http.StatusOK, w.Code)
+	// runtime stats would change the body between requests
+	providers.db.Username(1)
+	require.Equal(t, http.StatusNotModified, get(w.Header().Get("ETag")).Code)
+
+	w = httptest.NewRecorder()
+	providersInjector(providers, metricsHandler)(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	metrics := w.Body.String()
+	require.True(t, strings.Contains(metrics, "# TYPE oscar_heap_alloc_bytes gauge"), metrics)
+	require.True(t, strings.Contains(metrics, `oscar_user_cache_lookups_total{result="miss"} 1`), metrics)
+}
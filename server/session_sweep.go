@@ -0,0 +1,137 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"zood.dev/oscar/model"
+)
+
+// challengeTTL is how long a client has to answer an auth challenge
+const challengeTTL = 2 * time.Minute
+
+// ticketTTL is how long an expiring ticket can be used for
+const ticketTTL = 60 * time.Second
+
+// accessTokenTTL is how long an access token can be used for. Clients
+// exchange their refresh token for a new one before then.
+const accessTokenTTL = time.Hour
+
+// refreshTokenTTL is how long a refresh token can be exchanged for access
+// tokens, after which the user has to log in again
+const refreshTokenTTL = 365 * 24 * time.Hour
+
+// sessionSweepInterval is how often expired session state is purged
+const sessionSweepInterval = 5 * time.Minute
+
+// sessionSweep counts what a sweep purged
+type sessionSweep struct {
+	Challenges    int64 `json:"challenges"`
+	AccessTokens  int64 `json:"access_tokens"`
+	RefreshTokens int64 `json:"refresh_tokens"`
+}
+
+// sessionSweepStats are the totals since the server started, reported by
+// GET /admin/sessions
+type sessionSweepStats struct {
+	mu        sync.Mutex
+	purged    sessionSweep
+	lastSweep time.Time
+}
+
+var sessionSweeps = &sessionSweepStats{}
+
+func (sss *sessionSweepStats) record(s sessionSweep, at time.Time) {
+	sss.mu.Lock()
+	defer sss.mu.Unlock()
+	sss.purged.Challenges += s.Challenges
+	sss.purged.AccessTokens += s.AccessTokens
+	sss.purged.RefreshTokens += s.RefreshTokens
+	sss.lastSweep = at
+}
+
+func (sss *sessionSweepStats) get() (sessionSweep, time.Time) {
+	sss.mu.Lock()
+	defer sss.mu.Unlock()
+	return sss.purged, sss.lastSweep
+}
+
+// sweepSessions deletes the auth challenges, tickets, access tokens and
+// refresh tokens that expired before now. Challenges are otherwise only deleted when a user logs
+// in, so the ones that are never answered, e.g. from scanners, would pile up.
+func sweepSessions(db model.Provider, now time.Time) (sessionSweep, error) {
+	s := sessionSweep{}
+	var err error
+	s.Challenges, err = db.DeleteSessionChallenges(now.Add(-challengeTTL).Unix())
+	if err != nil {
+		return s, errors.Wrap(err, "deleting expired challenges")
+	}
+	if err = db.DeleteTickets(now.Add(-ticketTTL).Unix()); err != nil {
+		return s, errors.Wrap(err, "deleting expired tickets")
+	}
+	s.AccessTokens, err = db.DeleteExpiredAccessTokens(now.Unix())
+	if err != nil {
+		return s, errors.Wrap(err, "deleting expired access tokens")
+	}
+	s.RefreshTokens, err = db.DeleteExpiredRefreshTokens(now.Unix())
+	if err != nil {
+		return s, errors.Wrap(err, "deleting expired refresh tokens")
+	}
+	return s, nil
+}
+
+// runSessionSweeper sweeps expired session state every interval, forever
+func runSessionSweeper(providers *serverProviders, interval time.Duration) {
+	for {
+		now := providers.now()
+		s, err := sweepSessions(providers.db, now)
+		if err != nil {
+			logErr(err)
+		}
+		sessionSweeps.record(s, now)
+		if shouldLogInfo() && (s.Challenges > 0 || s.AccessTokens > 0 || s.RefreshTokens > 0) {
+			log.Printf("Purged %d expired auth challenges, %d expired access tokens and %d expired refresh tokens", s.Challenges, s.AccessTokens, s.RefreshTokens)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// sessionStatsHandler handles GET /admin/sessions
+func sessionStatsHandler(w http.ResponseWriter, r *http.Request) {
+	providers := providersCtx(r.Context())
+	outstanding, err := providers.db.SessionChallengeCount()
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	counts, err := providers.db.ClientCounts(providers.now().Unix())
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	type clientCount struct {
+		Platform   string `json:"platform"`
+		AppVersion string `json:"app_version"`
+		Sessions   int64  `json:"sessions"`
+		PushTokens int64  `json:"push_tokens"`
+	}
+	clients := make([]clientCount, 0, len(counts))
+	for _, c := range counts {
+		clients = append(clients, clientCount(c))
+	}
+	purged, lastSweep := sessionSweeps.get()
+	resp := struct {
+		OutstandingChallenges int64         `json:"outstanding_challenges"`
+		Purged                sessionSweep  `json:"purged"`
+		LastSweep             int64         `json:"last_sweep,omitempty"`
+		Clients               []clientCount `json:"clients"`
+	}{OutstandingChallenges: outstanding, Purged: purged, Clients: clients}
+	if !lastSweep.IsZero() {
+		resp.LastSweep = lastSweep.Unix()
+	}
+	sendSuccess(w, resp)
+}
@@ -3,11 +3,12 @@ package main
 import (
 	"bytes"
 	"context"
-	crand "crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,7 +16,6 @@ import (
 	"zood.dev/oscar/base62"
 	"zood.dev/oscar/encodable"
 	"zood.dev/oscar/model"
-	"zood.dev/oscar/sodium"
 )
 
 type encryptedData struct {
@@ -32,28 +32,61 @@ type sessionToken struct {
 type loginResponse struct {
 	ID                       encodable.Bytes `json:"id"`
 	AccessToken              string          `json:"access_token"`
+	RefreshToken             string          `json:"refresh_token,omitempty"`
 	WrappedSymmetricKey      encodable.Bytes `json:"wrapped_symmetric_key"`
 	WrappedSymmetricKeyNonce encodable.Bytes `json:"wrapped_symmetric_key_nonce"`
+	// AccessTokenExpiresAt is when the access token has to be replaced, by
+	// exchanging RefreshToken at /sessions/refresh
+	AccessTokenExpiresAt int64 `json:"access_token_expires_at"`
+	// ServerTime lets clients tell how far their clock is off
+	ServerTime int64 `json:"server_time"`
 }
 
 const ticketLength = 16
 
+const refreshTokenLength = 32
+
+// sessionTouchInterval is how stale the last use of a session can get
+// before a request records a new one, so most requests don't write to the
+// database
+const sessionTouchInterval = 5 * time.Minute
+
+// maxSessionUserAgentLength is the most of a User-Agent header kept with a
+// session
+const maxSessionUserAgentLength = 256
+
 func createAuthChallengeHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	username := vars["username"]
 	username = strings.ToLower(username)
 
 	// find the user
-	db := providersCtx(r.Context()).db
+	providers := providersCtx(r.Context())
+	db := providers.db
 	userRec, err := db.User(username)
 	if err != nil {
 		sendInternalErr(w, err)
 		return
 	}
+	now := providers.now()
+	addr := loginAddress(providers, r)
+	var userID int64
+	if userRec != nil {
+		userID = userRec.ID
+	}
+	if wait := providers.loginLockouts.retryAfter(userID, addr, now); wait > 0 {
+		sendLoginRetryAfter(w, wait)
+		return
+	}
 	if userRec == nil {
+		// guessing at usernames counts against the address
+		providers.loginLockouts.fail(0, addr, now)
 		sendNotFound(w, "user not found", errorUserNotFound)
 		return
 	}
+	if refuseInactiveAccount(w, userRec.UserStatusRecord, now) {
+		return
+	}
 
 	// only a subset of the user should be returned for an authentication challenge
 	user := User{
@@ -67,7 +100,10 @@ func createAuthChallengeHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	challenge := make([]byte, 255)
-	crand.Read(challenge)
+	if _, err = io.ReadFull(providers.random(), challenge); err != nil {
+		sendInternalErr(w, err)
+		return
+	}
 
 	// delete any existing challenge for this user
 	err = db.DeleteSessionChallengeUser(userRec.ID)
@@ -76,7 +112,7 @@ func createAuthChallengeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	creationDate := time.Now().Unix()
+	creationDate := now.Unix()
 
 	err = db.InsertSessionChallenge(userRec.ID, creationDate, challenge)
 	if err != nil {
@@ -88,16 +124,40 @@ func createAuthChallengeHandler(w http.ResponseWriter, r *http.Request) {
 		User         User            `json:"user"`
 		Challenge    encodable.Bytes `json:"challenge"`
 		CreationDate encodable.Bytes `json:"creation_date"`
-	}{User: user, Challenge: challenge, CreationDate: int64ToBytes(creationDate)}
+		ServerTime   int64           `json:"server_time"`
+	}{User: user, Challenge: challenge, CreationDate: int64ToBytes(creationDate), ServerTime: creationDate}
 
 	sendSuccess(w, resp)
 }
 
+// createTicketHandler handles POST /sessions/expiring-tickets. The body can
+// list the scopes the ticket is limited to. Tickets end up in URLs, so only
+// scoped ones are accepted by the routes that allow those scopes. Without
+// scopes, a ticket can only open a websocket.
 func createTicketHandler(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Scopes []accessScope `json:"scopes"`
+	}{}
+	// clients from before scopes send no body
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		sendBadReq(w, "unable to parse POST body: "+err.Error())
+		return
+	}
+	scopes, err := joinScopes(body.Scopes)
+	if err != nil {
+		sendBadReq(w, err.Error())
+		return
+	}
+
 	userID := userIDFromContext(r.Context())
-	ticket := base62.Rand(ticketLength)
-	db := providersCtx(r.Context()).db
-	err := db.InsertTicket(ticket, userID)
+	providers := providersCtx(r.Context())
+	ticket, err := base62.RandFrom(providers.random(), ticketLength)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	db := providers.db
+	err = db.InsertTicket(ticket, userID, scopes)
 	if err != nil {
 		sendInternalErr(w, err)
 		return
@@ -112,6 +172,13 @@ func finishAuthChallengeHandler(w http.ResponseWriter, r *http.Request) {
 	authResponse := struct {
 		Challenge    encryptedData `json:"challenge"`
 		CreationDate encryptedData `json:"creation_date"`
+		// RefreshTokens is set by clients that exchange refresh tokens at
+		// /sessions/refresh. The others keep getting access tokens that last
+		// as long as a refresh token.
+		RefreshTokens bool `json:"refresh_tokens"`
+		// KeyID is the server key pair the answer is addressed to, as given
+		// by /public-key
+		KeyID string `json:"key_id"`
 	}{}
 	err := json.NewDecoder(r.Body).Decode(&authResponse)
 	if err != nil {
@@ -130,10 +197,24 @@ func finishAuthChallengeHandler(w http.ResponseWriter, r *http.Request) {
 		sendInternalErr(w, err)
 		return
 	}
+	now := providers.now()
+	addr := loginAddress(providers, r)
+	var userID int64
+	if user != nil {
+		userID = user.ID
+	}
+	if wait := providers.loginLockouts.retryAfter(userID, addr, now); wait > 0 {
+		sendLoginRetryAfter(w, wait)
+		return
+	}
 	if user == nil {
+		providers.loginLockouts.fail(0, addr, now)
 		sendNotFound(w, "unknown user", errorUserNotFound)
 		return
 	}
+	if refuseInactiveAccount(w, user.UserStatusRecord, now) {
+		return
+	}
 
 	// find the challenge for this user
 	challenge, err := db.SessionChallenge(user.ID)
@@ -146,68 +227,107 @@ func finishAuthChallengeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// if the challenge was created more than 2 minutes ago, then consider it expired
-	if (time.Now().Unix() - challenge.CreationDate) > 120 {
+	if !now.Before(time.Unix(challenge.CreationDate, 0).Add(challengeTTL)) {
 		sendBadReqCode(w, "challenge expired", errorChallengeExpired)
-		go db.DeleteSessionChallengeID(challenge.ID)
+		go providers.detached().db.DeleteSessionChallengeID(challenge.ID)
 		return
 	}
 
-	decryptedChallenge, ok := sodium.PublicKeyDecrypt(authResponse.Challenge.CipherText, authResponse.Challenge.Nonce, user.PublicKey, providers.keyPair.Secret)
+	decryptedChallenge, ok := providers.openFromUser(authResponse.Challenge.CipherText, authResponse.Challenge.Nonce, user.PublicKey, authResponse.KeyID)
 	if !ok {
-		sendErr(w, "login failed", http.StatusUnauthorized, errorLoginFailed)
+		loginFailed(w, r, user.ID, now)
 		return
 	}
 	if len(decryptedChallenge) == 0 {
-		sendErr(w, "login failed", http.StatusUnauthorized, errorLoginFailed)
+		loginFailed(w, r, user.ID, now)
 		return
 	}
 	// compare the decrypted message with the challenge we sent the user
 	if !bytes.Equal(decryptedChallenge, challenge.Challenge) {
 		// this is not what we wanted them to encrypt
-		sendErr(w, "login failed", http.StatusUnauthorized, errorLoginFailed)
+		loginFailed(w, r, user.ID, now)
 		return
 	}
 
-	decryptedCreationDate, ok := sodium.PublicKeyDecrypt(authResponse.CreationDate.CipherText, authResponse.CreationDate.Nonce, user.PublicKey, providers.keyPair.Secret)
+	decryptedCreationDate, ok := providers.openFromUser(authResponse.CreationDate.CipherText, authResponse.CreationDate.Nonce, user.PublicKey, authResponse.KeyID)
 	if !ok {
-		sendErr(w, "login failed", http.StatusUnauthorized, errorLoginFailed)
+		loginFailed(w, r, user.ID, now)
 		return
 	}
 	// compare the decrypted creation date with the original
 	if !bytes.Equal(decryptedCreationDate, int64ToBytes(challenge.CreationDate)) {
-		sendErr(w, "login failed", http.StatusUnauthorized, errorLoginFailed)
+		loginFailed(w, r, user.ID, now)
 		return
 	}
 
-	// successful challenge; create a token for the user
-	// raw token -> json -> encrypt with server sym key -> base64 -> give to user
-	token := sessionToken{
-		Name:                  username,
-		CreationDate:          challenge.CreationDate,
-		EncryptedCreationDate: append(authResponse.CreationDate.Nonce, authResponse.CreationDate.CipherText...),
+	// the challenge can only be answered once, so a valid answer to a used
+	// challenge is a replay. That includes losing the race against another
+	// request with the same answer.
+	fresh := false
+	if !challenge.Used {
+		fresh, err = db.UseSessionChallenge(challenge.ID)
+		if err != nil {
+			sendInternalErr(w, err)
+			return
+		}
+	}
+	if !fresh {
+		loginReplayed(w, r, user.ID, challenge.ID)
+		return
 	}
 
-	tokenBytes, err := json.Marshal(token)
+	// successful challenge; create a refresh token for the user, and the
+	// first access token from it
+	providers.loginLockouts.succeed(user.ID)
+	refreshToken, err := base62.RandFrom(providers.random(), refreshTokenLength)
 	if err != nil {
 		sendInternalErr(w, err)
 		return
 	}
-
-	tokenCT, tokenNonce, err := sodium.SymmetricKeyEncrypt(tokenBytes, providers.symKey)
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxSessionUserAgentLength {
+		userAgent = userAgent[:maxSessionUserAgentLength]
+	}
+	err = db.InsertRefreshToken(model.RefreshTokenRecord{
+		Token:        refreshToken,
+		UserID:       user.ID,
+		ExpiresAt:    now.Add(refreshTokenTTL).Unix(),
+		ClientRecord: clientRecord(r),
+		CreatedAt:    now.Unix(),
+		LastUsed:     now.Unix(),
+		UserAgent:    userAgent,
+		IPPrefix:     ipPrefix(remoteIP(r)),
+	})
 	if err != nil {
 		sendInternalErr(w, err)
 		return
 	}
 
-	accessToken := append(tokenNonce, tokenCT...)
-	accessTokenB64 := base64.StdEncoding.EncodeToString(accessToken)
-	oneYearFromNow := time.Now().Add(365 * 24 * time.Hour)
-	err = db.InsertAccessToken(accessTokenB64, user.ID, oneYearFromNow.Unix())
+	accessToken, err := sealAccessToken(providers.keys, sessionToken{
+		Name:                  username,
+		CreationDate:          challenge.CreationDate,
+		EncryptedCreationDate: append(authResponse.CreationDate.Nonce, authResponse.CreationDate.CipherText...),
+	})
 	if err != nil {
 		sendInternalErr(w, err)
 		return
 	}
+	accessTokenTTL := accessTokenTTL
+	if !authResponse.RefreshTokens {
+		accessTokenTTL = refreshTokenTTL
+	}
+	accessTokenExpiresAt := now.Add(accessTokenTTL).Unix()
+	err = db.InsertRefreshedAccessToken(accessToken, refreshToken, accessTokenExpiresAt)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	providers.events.emit(accountEvent{
+		Kind:    eventSessionCreated,
+		Actor:   actorUser,
+		UserID:  user.ID,
+		Details: "from " + r.RemoteAddr,
+	})
 
 	kvs := providersCtx(r.Context()).kvs
 	pubID, err := kvs.PublicIDFromUserID(user.ID)
@@ -216,83 +336,393 @@ func finishAuthChallengeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !authResponse.RefreshTokens {
+		// the client wouldn't know what to do with it
+		refreshToken = ""
+	}
 	sendSuccess(w, loginResponse{
 		ID:                       pubID,
-		AccessToken:              accessTokenB64,
+		AccessToken:              accessToken,
+		RefreshToken:             refreshToken,
 		WrappedSymmetricKey:      user.WrappedSymmetricKey,
-		WrappedSymmetricKeyNonce: user.WrappedSymmetricKeyNonce})
+		WrappedSymmetricKeyNonce: user.WrappedSymmetricKeyNonce,
+		AccessTokenExpiresAt:     accessTokenExpiresAt,
+		ServerTime:               now.Unix()})
+}
+
+// refreshSessionHandler handles POST /sessions/refresh. It exchanges a
+// refresh token for a new access token, so access tokens can be short lived
+// without the user having to log in again. The refresh token is replaced
+// with a new one each time, so it can only be used once. Refreshing counts
+// toward the same limit as failed logins.
+func refreshSessionHandler(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		RefreshToken string `json:"refresh_token"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendBadReq(w, "unable to parse POST body: "+err.Error())
+		return
+	}
+
+	providers := providersCtx(r.Context())
+	db := providers.db
+	now := providers.now()
+	rtr, err := db.RefreshToken(body.RefreshToken)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	addr := loginAddress(providers, r)
+	var userID int64
+	if rtr != nil {
+		userID = rtr.UserID
+	}
+	if wait := providers.loginLockouts.retryAfter(userID, addr, now); wait > 0 {
+		sendLoginRetryAfter(w, wait)
+		return
+	}
+	if rtr == nil {
+		providers.loginLockouts.fail(0, addr, now)
+		sendInvalidRefreshToken(w)
+		return
+	}
+	if now.Unix() > rtr.ExpiresAt {
+		countLoginFailure(r, rtr.UserID, now)
+		sendInvalidRefreshToken(w)
+		return
+	}
+	user, err := db.User(db.Username(rtr.UserID))
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if user != nil && refuseInactiveAccount(w, user.UserStatusRecord, now) {
+		return
+	}
+
+	refreshToken, err := base62.RandFrom(providers.random(), refreshTokenLength)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	// losing the race against another request with the same refresh token
+	// leaves it unknown
+	rotated, err := db.RotateRefreshToken(rtr.Token, refreshToken, now.Add(refreshTokenTTL).Unix())
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if !rotated {
+		sendInvalidRefreshToken(w)
+		return
+	}
+
+	accessToken, err := sealAccessToken(providers.keys, sessionToken{
+		Name:         db.Username(rtr.UserID),
+		CreationDate: now.Unix(),
+	})
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	expiresAt := now.Add(accessTokenTTL).Unix()
+	if err = db.InsertRefreshedAccessToken(accessToken, refreshToken, expiresAt); err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if err = db.TouchSession(refreshToken, now.Unix()); err != nil {
+		logErr(err)
+	}
+
+	sendSuccess(w, struct {
+		AccessToken          string `json:"access_token"`
+		AccessTokenExpiresAt int64  `json:"access_token_expires_at"`
+		RefreshToken         string `json:"refresh_token"`
+		ServerTime           int64  `json:"server_time"`
+	}{AccessToken: accessToken, AccessTokenExpiresAt: expiresAt, RefreshToken: refreshToken, ServerTime: now.Unix()})
+}
+
+func sendInvalidRefreshToken(w http.ResponseWriter) {
+	sendErr(w, "invalid/expired refresh token", http.StatusUnauthorized, errorInvalidRefreshToken)
+}
+
+// sealAccessToken returns the access token for token
+// raw token -> json -> encrypt with server sym key -> base64 -> give to user
+func sealAccessToken(keys *keyRing, token sessionToken) (string, error) {
+	tokenBytes, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := keys.seal(tokenBytes)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// loginFailed counts a failed login at now toward the limits of the user
+// and the client's address
+func loginFailed(w http.ResponseWriter, r *http.Request, userID int64, now time.Time) {
+	countLoginFailure(r, userID, now)
+	sendErr(w, "login failed", http.StatusUnauthorized, errorLoginFailed)
+}
 
-	go db.DeleteSessionChallengeID(challenge.ID)
+// countLoginFailure counts a failed login at now, and records in the audit
+// log when it locks the user out
+func countLoginFailure(r *http.Request, userID int64, now time.Time) {
+	providers := providersCtx(r.Context())
+	if providers.loginLockouts.fail(userID, loginAddress(providers, r), now) {
+		providers.events.emit(accountEvent{
+			Kind:    eventLoginLockedOut,
+			Actor:   actorServer,
+			UserID:  userID,
+			Details: "after failed logins from " + r.RemoteAddr,
+		})
+	}
+}
+
+// loginReplayed handles an answer to a challenge that was already used. It's
+// recorded in the audit log, and counted as a failed login.
+func loginReplayed(w http.ResponseWriter, r *http.Request, userID, challengeID int64) {
+	providers := providersCtx(r.Context())
+	providers.events.emit(accountEvent{
+		Kind:    eventLoginReplayed,
+		Actor:   actorUser,
+		UserID:  userID,
+		Details: fmt.Sprintf("challenge %d answered again from %s", challengeID, r.RemoteAddr),
+	})
+	loginFailed(w, r, userID, providers.now())
 }
 
 func sendInvalidAccessToken(w http.ResponseWriter) {
 	sendErr(w, "invalid/missing access token", http.StatusUnauthorized, errorInvalidAccessToken)
 }
 
-func sessionHandler(next http.HandlerFunc) http.HandlerFunc {
+// sessionHandler only lets through requests authenticated with an access
+// token. Access tokens with scopes are refused, unless one of their scopes is
+// in allowed. Routes that allow scopes also take a scoped ticket in the
+// ticket query parameter, for share links. Query strings end up in logs and
+// browser history, so the rest don't read it, and tickets without scopes are
+// refused.
+func sessionHandler(next http.HandlerFunc, allowed ...accessScope) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		token := r.Header.Get("X-Oscar-Access-Token")
 		providers := providersCtx(r.Context())
-		userID, err := verifyAccessToken(providers.db, token)
+		now := providers.now()
+		ticket := ""
+		if len(allowed) > 0 {
+			ticket = r.URL.Query().Get("ticket")
+		}
+		cred, err := verifyCredential(providers, r.Header.Get("X-Oscar-Access-Token"), ticket)
 		if err != nil {
 			sendInternalErr(w, err)
 			return
 		}
-		if userID == 0 {
+		if cred.userID == 0 {
 			sendInvalidAccessToken(w)
 			return
 		}
+		if refuseInactiveAccount(w, cred.status, now) {
+			return
+		}
+		if cred.ticket && cred.scopes == "" {
+			sendErr(w, "tickets in the query must have scopes", http.StatusForbidden, errorInsufficientPermission)
+			return
+		}
+		if !cred.allows(allowed) {
+			sendScopeNotAllowed(w)
+			return
+		}
 
 		// everything checks out!
-		ctx := context.WithValue(r.Context(), contextUserIDKey, userID)
-		next.ServeHTTP(w, r.WithContext(ctx))
+		setRequestUser(r.Context(), cred.userID)
+		ctx := context.WithValue(r.Context(), contextUserIDKey, cred.userID)
+		serveDebugCaptured(providers, cred.userID, next, w, r.WithContext(ctx))
+	}
+}
+
+// listSessionsHandler handles GET /users/me/sessions. It lists the user's
+// unexpired sessions, i.e. the logins they haven't revoked, with the device
+// and app each was created from. The tokens themselves aren't returned.
+func listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromContext(r.Context())
+	providers := providersCtx(r.Context())
+	records, err := providers.db.Sessions(userID, providers.now().Unix())
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	atr, err := providers.db.AccessToken(r.Header.Get("X-Oscar-Access-Token"))
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+
+	type session struct {
+		ID          int64  `json:"id"`
+		Current     bool   `json:"current"`
+		CreatedAt   int64  `json:"created_at"`
+		LastUsed    int64  `json:"last_used"`
+		ExpiresAt   int64  `json:"expires_at"`
+		UserAgent   string `json:"user_agent"`
+		IPPrefix    string `json:"ip_prefix"`
+		Platform    string `json:"platform"`
+		AppVersion  string `json:"app_version"`
+		DeviceModel string `json:"device_model"`
+	}
+	sessions := make([]session, 0, len(records))
+	for _, rec := range records {
+		sessions = append(sessions, session{
+			ID:          rec.ID,
+			Current:     atr != nil && rec.Token == atr.RefreshToken,
+			CreatedAt:   rec.CreatedAt,
+			LastUsed:    rec.LastUsed,
+			ExpiresAt:   rec.ExpiresAt,
+			UserAgent:   rec.UserAgent,
+			IPPrefix:    rec.IPPrefix,
+			Platform:    rec.Platform,
+			AppVersion:  rec.AppVersion,
+			DeviceModel: rec.DeviceModel,
+		})
+	}
+	sendSuccess(w, struct {
+		Sessions []session `json:"sessions"`
+	}{Sessions: sessions})
+}
+
+// deleteSessionHandler handles DELETE /users/me/sessions/{id}. It ends one of
+// the user's sessions, by its id from listSessionsHandler, so the user can
+// sign another device out.
+func deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		sendBadReq(w, "invalid session id")
+		return
+	}
+	userID := userIDFromContext(r.Context())
+	providers := providersCtx(r.Context())
+	deleted, err := providers.db.DeleteSession(userID, id)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if !deleted {
+		sendNotFound(w, "session not found", errorNotFound)
+		return
 	}
+	providers.events.emit(accountEvent{
+		Kind:    eventSessionsRevoked,
+		Actor:   actorUser,
+		UserID:  userID,
+		Details: fmt.Sprintf("session %d", id),
+	})
+
+	sendSuccess(w, nil)
+}
+
+// revokeSessionHandler handles DELETE /sessions/me. It ends the session of
+// the request's access token, like a log out. The refresh token the access
+// token came from is revoked too.
+func revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	providers := providersCtx(r.Context())
+	if err := providers.db.DeleteAccessToken(r.Header.Get("X-Oscar-Access-Token")); err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	providers.events.emit(accountEvent{
+		Kind:    eventSessionsRevoked,
+		Actor:   actorUser,
+		UserID:  userIDFromContext(r.Context()),
+		Details: "the current session",
+	})
+
+	sendSuccess(w, nil)
+}
+
+// revokeAllSessionsHandler handles DELETE /sessions. It ends every session
+// of the user, including the request's, for when a device was lost or a
+// token leaked.
+func revokeAllSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromContext(r.Context())
+	providers := providersCtx(r.Context())
+	revoked, err := providers.db.DeleteAccessTokensOfUser(userID)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	providers.events.emit(accountEvent{
+		Kind:    eventSessionsRevoked,
+		Actor:   actorUser,
+		UserID:  userID,
+		Details: fmt.Sprintf("all %d sessions", revoked),
+	})
+
+	sendSuccess(w, struct {
+		Revoked int64 `json:"revoked"`
+	}{Revoked: revoked})
 }
 
 func userIDFromContext(ctx context.Context) int64 {
 	return ctx.Value(contextUserIDKey).(int64)
 }
 
-func verifyAccessToken(db model.Provider, token string) (int64, error) {
+// verifyAccessToken returns the record of token, or nil when it's unknown
+// or expired at now. Revoking a session deletes it, so revoked tokens are
+// unknown from then on.
+func verifyAccessToken(db model.Provider, token string, now time.Time) (*model.AccessTokenRecord, error) {
 	if token == "" {
-		return 0, nil
+		return nil, nil
 	}
 
 	atr, err := db.AccessToken(token)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	if atr == nil {
-		return 0, nil
+		return nil, nil
 	}
 
 	// check if the access token is expired
-	if time.Now().Unix() > atr.ExpiresAt {
-		return 0, nil
+	if now.Unix() > atr.ExpiresAt {
+		return nil, nil
 	}
 
-	return atr.UserID, nil
+	return atr, nil
 }
 
-func verifySessionTicket(db model.Provider, ticket string) (int64, error) {
-	userID, timestamp, err := db.Ticket(ticket)
+// touchSession records now as the last use of the session of atr, unless
+// one was recorded in the last sessionTouchInterval
+func touchSession(db model.Provider, atr *model.AccessTokenRecord, now time.Time) {
+	if atr.RefreshToken == "" || now.Sub(time.Unix(atr.SessionLastUsed, 0)) < sessionTouchInterval {
+		return
+	}
+	if err := db.TouchSession(atr.RefreshToken, now.Unix()); err != nil {
+		logErr(err)
+	}
+}
+
+// verifySessionTicket returns the record of ticket, or nil when it's
+// unknown or too old at now
+func verifySessionTicket(db model.Provider, ticket string, now time.Time) (*model.TicketRecord, error) {
+	if ticket == "" {
+		return nil, nil
+	}
+	tr, err := db.Ticket(ticket)
 	if err != nil {
-		return 0, fmt.Errorf("failed to query for ticket: %w", err)
+		return nil, fmt.Errorf("failed to query for ticket: %w", err)
 	}
 
-	if userID == 0 {
-		return 0, nil
+	if tr == nil {
+		return nil, nil
 	}
 
 	// We found it, but we have to make sure it's not too old.
 	// Also, use this opportunity to delete old tickets
-	now := time.Now().Unix()
-	defer db.DeleteTickets(now - 60)
+	oldest := now.Unix() - int64(ticketTTL/time.Second)
+	defer db.DeleteTickets(oldest)
 
-	// the ticket can't be older than 60 seconds
-	if timestamp < now-60 {
-		return 0, nil
+	if tr.Timestamp < oldest {
+		return nil, nil
 	}
 	// we're good to go!
-	return userID, nil
+	return tr, nil
 }
@@ -6,12 +6,15 @@ import (
 	crand "crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	mrand "math/rand"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/base62"
 	"zood.dev/oscar/encodable"
 	"zood.dev/oscar/model"
 	"zood.dev/oscar/sodium"
@@ -21,7 +24,7 @@ import (
 func loginTestUser(t *testing.T, providers *serverProviders, user User, userKeyPair sodium.KeyPair) (accessToken string) {
 	t.Helper()
 
-	creationDate := time.Now().Unix()
+	creationDate := providers.now().Unix()
 	challenge := make([]byte, 255)
 	crand.Read(challenge)
 
@@ -35,16 +38,23 @@ func loginTestUser(t *testing.T, providers *serverProviders, user User, userKeyP
 	}
 	tokenBytes, err := json.Marshal(token)
 	require.NoError(t, err)
-	tokenCT, tokeNonce, err := sodium.SymmetricKeyEncrypt(tokenBytes, providers.symKey)
+	accessTokenBytes, err := providers.keys.seal(tokenBytes)
 	require.NoError(t, err)
-	accessTokenBytes := append(tokeNonce, tokenCT...)
 	accessToken = base64.StdEncoding.EncodeToString(accessTokenBytes)
-	providers.db.InsertAccessToken(accessToken, user.ID, time.Now().Add(24*time.Hour).Unix())
+	refreshToken := base62.Rand(refreshTokenLength)
+	require.NoError(t, providers.db.InsertRefreshToken(model.RefreshTokenRecord{
+		Token:     refreshToken,
+		UserID:    user.ID,
+		ExpiresAt: providers.now().Add(refreshTokenTTL).Unix(),
+		CreatedAt: creationDate,
+		LastUsed:  creationDate,
+	}))
+	require.NoError(t, providers.db.InsertRefreshedAccessToken(accessToken, refreshToken, providers.now().Add(24*time.Hour).Unix()))
 	return
 }
 
 func TestCreateTicketHandler(t *testing.T) {
-	db, _ := sqlite.New(sqlite.InMemoryDSN)
+	db, _ := sqlite.New(sqlite.InMemoryDSN, sqlite.Options{})
 	var userID int64 = 34
 
 	r := httptest.NewRequest(http.MethodPost, "/sessions/expiring-tickets", nil)
@@ -74,39 +84,39 @@ func TestCreateTicketHandler(t *testing.T) {
 	}
 
 	// make sure it's in the database
-	retrieved, _, _ := db.Ticket(respBody.Ticket)
-	if retrieved != userID {
-		t.Fatalf("ticket not found or wrong user id. Got %d", retrieved)
+	retrieved, _ := db.Ticket(respBody.Ticket)
+	if retrieved == nil || retrieved.UserID != userID {
+		t.Fatalf("ticket not found or wrong user id. Got %+v", retrieved)
 	}
 }
 
 func TestVerifySessionTicket(t *testing.T) {
-	db, _ := sqlite.New(sqlite.InMemoryDSN)
+	db, _ := sqlite.New(sqlite.InMemoryDSN, sqlite.Options{})
 
-	userID, err := verifySessionTicket(db, "")
+	tr, err := verifySessionTicket(db, "", time.Now())
 	if err != nil {
 		t.Fatal(err)
 	}
-	if userID != 0 {
-		t.Fatalf("Should not have found user. Got %d", userID)
+	if tr != nil {
+		t.Fatalf("Should not have found user. Got %d", tr.UserID)
 	}
 
 	// put a valid token in there
 	ticket := "deadbeeffeebdaed"
 	var expectedUserID int64 = 19
-	db.InsertTicket(ticket, expectedUserID)
+	db.InsertTicket(ticket, expectedUserID, "")
 
-	userID, err = verifySessionTicket(db, ticket)
+	tr, err = verifySessionTicket(db, ticket, time.Now())
 	if err != nil {
 		t.Fatal(err)
 	}
-	if userID != expectedUserID {
-		t.Fatalf("user id mismatch: %d != %d", userID, expectedUserID)
+	if tr == nil || tr.UserID != expectedUserID {
+		t.Fatalf("user id mismatch: %+v != %d", tr, expectedUserID)
 	}
 
 	ticket = "anotherticket"
 	expectedUserID = 24
-	db.InsertTicket(ticket, expectedUserID)
+	db.InsertTicket(ticket, expectedUserID, "")
 	// manually change the timestamp to something older
 	sqldb := db.(sqlite.Databaser).Database()
 	_, err = sqldb.Exec(`UPDATE tickets SET timestamp=? WHERE ticket=?`, time.Now().Unix()-120, ticket)
@@ -114,12 +124,12 @@ func TestVerifySessionTicket(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	userID, err = verifySessionTicket(db, ticket)
+	tr, err = verifySessionTicket(db, ticket, time.Now())
 	if err != nil {
 		t.Fatal(err)
 	}
-	if userID != 0 {
-		t.Fatalf("User id should not have matched. Got %d", userID)
+	if tr != nil {
+		t.Fatalf("User id should not have matched. Got %d", tr.UserID)
 	}
 }
 
@@ -259,6 +269,13 @@ func TestFinishAuthChallengeHandler(t *testing.T) {
 	if !bytes.Equal(lr.WrappedSymmetricKeyNonce, user.WrappedSymmetricKeyNonce) {
 		t.Fatal("wrapped sym key nonce mismatch")
 	}
+	// clients that didn't ask for refresh tokens get long lived access tokens
+	if lr.RefreshToken != "" {
+		t.Fatal("unrequested refresh token")
+	}
+	if lr.AccessTokenExpiresAt < providers.now().Add(refreshTokenTTL-time.Minute).Unix() {
+		t.Fatalf("access token expires at %d", lr.AccessTokenExpiresAt)
+	}
 
 	// the access token should be base64. try to decode it to verify
 	encdToken, err := base64.StdEncoding.DecodeString(lr.AccessToken)
@@ -266,7 +283,7 @@ func TestFinishAuthChallengeHandler(t *testing.T) {
 		t.Fatal(err)
 	}
 	// decrypt the bytes
-	msg, success := sodium.SymmetricKeyDecrypt(encdToken[sodium.SymmetricNonceSize:], encdToken[:sodium.SymmetricNonceSize], providers.symKey)
+	msg, success := providers.keys.open(encdToken)
 	if !success {
 		t.Fatal("failed to decrypt session token")
 	}
@@ -294,13 +311,72 @@ func TestFinishAuthChallengeHandler(t *testing.T) {
 	}
 }
 
+func TestChallengeReplay(t *testing.T) {
+	providers := createTestProviders(t)
+	var events []accountEvent
+	providers.events = newEventBus()
+	providers.events.subscribe("test", func(evt accountEvent) error {
+		events = append(events, evt)
+		return nil
+	})
+	router := newOscarRouter(providers)
+	user, keyPair := createTestUser(t, providers)
+
+	challenge := make([]byte, 255)
+	crand.Read(challenge)
+	creationDate := time.Now().Unix()
+	require.NoError(t, providers.db.InsertSessionChallenge(user.ID, creationDate, challenge))
+	challengeCT, challengeNonce, err := sodium.PublicKeyEncrypt(challenge, providers.keyPair.Public, keyPair.Secret)
+	require.NoError(t, err)
+	cdCT, cdNonce, err := sodium.PublicKeyEncrypt(int64ToBytes(creationDate), providers.keyPair.Public, keyPair.Secret)
+	require.NoError(t, err)
+	answer, err := json.Marshal(map[string]encryptedData{
+		"challenge":     {CipherText: challengeCT, Nonce: challengeNonce},
+		"creation_date": {CipherText: cdCT, Nonce: cdNonce},
+	})
+	require.NoError(t, err)
+
+	finish := func(body []byte) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/1/sessions/"+user.Username+"/challenge-response", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := finish(answer)
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	require.Len(t, events, 1)
+	require.Equal(t, eventSessionCreated, events[0].Kind)
+
+	// the same answer can't mint a second session
+	w = finish(answer)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.Len(t, events, 2)
+	require.Equal(t, eventLoginReplayed, events[1].Kind)
+	require.Equal(t, user.ID, events[1].UserID)
+
+	// a wrong answer isn't reported as a replay, but both count toward the limit
+	wrong, err := json.Marshal(map[string]encryptedData{
+		"challenge":     {CipherText: cdCT, Nonce: cdNonce},
+		"creation_date": {CipherText: cdCT, Nonce: cdNonce},
+	})
+	require.NoError(t, err)
+	for i := 0; i < accountLoginLimit.free; i++ {
+		require.Equal(t, http.StatusUnauthorized, finish(wrong).Code)
+	}
+	require.Len(t, events, 2)
+	w = finish(answer)
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, "1", w.Header().Get("Retry-After"))
+}
+
 func TestVerifyAccessToken(t *testing.T) {
 	db := sqlite.NewMockDB(t)
 
 	// Test verification with no token in the database
-	actual, err := verifyAccessToken(db, "not-a-token")
+	actual, err := verifyAccessToken(db, "not-a-token", time.Now())
 	require.NoError(t, err)
-	require.Zero(t, actual)
+	require.Nil(t, actual)
 
 	// Test that present tokens are properly verified
 	atr := model.AccessTokenRecord{
@@ -308,12 +384,13 @@ func TestVerifyAccessToken(t *testing.T) {
 		ExpiresAt: time.Now().Add(time.Hour).Unix(),
 		UserID:    15,
 	}
-	err = db.InsertAccessToken(atr.Token, atr.UserID, atr.ExpiresAt)
+	err = db.InsertAccessToken(atr.Token, atr.UserID, atr.ExpiresAt, model.ClientRecord{})
 	require.NoError(t, err)
 
-	actual, err = verifyAccessToken(db, atr.Token)
+	actual, err = verifyAccessToken(db, atr.Token, time.Now())
 	require.NoError(t, err)
-	require.Equal(t, atr.UserID, actual)
+	require.NotNil(t, actual)
+	require.Equal(t, atr.UserID, actual.UserID)
 
 	// Test verification with an expired token
 	atr = model.AccessTokenRecord{
@@ -321,12 +398,12 @@ func TestVerifyAccessToken(t *testing.T) {
 		ExpiresAt: time.Now().Add(-time.Hour).Unix(),
 		UserID:    20,
 	}
-	err = db.InsertAccessToken(atr.Token, atr.UserID, atr.ExpiresAt)
+	err = db.InsertAccessToken(atr.Token, atr.UserID, atr.ExpiresAt, model.ClientRecord{})
 	require.NoError(t, err)
 
-	actual, err = verifyAccessToken(db, atr.Token)
+	actual, err = verifyAccessToken(db, atr.Token, time.Now())
 	require.NoError(t, err)
-	require.Zero(t, actual)
+	require.Nil(t, actual)
 }
 
 func TestSessionHandler(t *testing.T) {
@@ -359,3 +436,310 @@ func TestSessionHandler(t *testing.T) {
 
 	require.Equal(t, http.StatusUnauthorized, w.Code, "Got: %s", w.Body.Bytes())
 }
+
+func TestDeterministicChallenge(t *testing.T) {
+	providers := createTestProviders(t)
+	user, _ := createTestUser(t, providers)
+	providers.rand = mrand.New(mrand.NewSource(42))
+
+	r := httptest.NewRequest(http.MethodPost, "/1/sessions/"+user.Username+"/challenge", nil)
+	w := httptest.NewRecorder()
+	newOscarRouter(providers).ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.Bytes())
+
+	resp := struct {
+		Challenge encodable.Bytes `json:"challenge"`
+	}{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+
+	expected := make([]byte, 255)
+	mrand.New(mrand.NewSource(42)).Read(expected)
+	require.Equal(t, expected, []byte(resp.Challenge))
+}
+
+func TestSweepSessions(t *testing.T) {
+	providers := createTestProviders(t)
+	providers.adminToken = "admin-token"
+	db := providers.db
+	now := time.Now()
+
+	require.NoError(t, db.InsertSessionChallenge(1, now.Add(-challengeTTL-time.Second).Unix(), []byte("unanswered")))
+	require.NoError(t, db.InsertSessionChallenge(2, now.Unix(), []byte("pending")))
+	android := model.ClientRecord{Platform: "android", AppVersion: "1.4.2", DeviceModel: "Pixel 4a"}
+	require.NoError(t, db.InsertAccessToken("expired-token", 1, now.Add(-time.Hour).Unix(), android))
+	require.NoError(t, db.InsertAccessToken("current-token", 2, now.Add(time.Hour).Unix(), android))
+	require.NoError(t, db.InsertFCMToken(2, "fcm-token", android))
+
+	s, err := sweepSessions(db, now)
+	require.NoError(t, err)
+	require.Equal(t, sessionSweep{Challenges: 1, AccessTokens: 1}, s)
+	challenge, err := db.SessionChallenge(2)
+	require.NoError(t, err)
+	require.NotNil(t, challenge)
+
+	// the pending challenge is reported as outstanding
+	sessionSweeps.record(s, now)
+	r := httptest.NewRequest(http.MethodGet, "/admin/sessions", nil)
+	r.Header.Set("Authorization", "Bearer "+providers.adminToken)
+	w := httptest.NewRecorder()
+	newOscarRouter(providers).ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	body := struct {
+		OutstandingChallenges int64        `json:"outstanding_challenges"`
+		Purged                sessionSweep `json:"purged"`
+		LastSweep             int64        `json:"last_sweep"`
+		Clients               []struct {
+			Platform   string `json:"platform"`
+			AppVersion string `json:"app_version"`
+			Sessions   int64  `json:"sessions"`
+			PushTokens int64  `json:"push_tokens"`
+		} `json:"clients"`
+	}{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+	require.Equal(t, int64(1), body.OutstandingChallenges)
+	require.True(t, body.Purged.Challenges >= 1)
+	require.Equal(t, now.Unix(), body.LastSweep)
+	require.Len(t, body.Clients, 1)
+	require.Equal(t, "android", body.Clients[0].Platform)
+	require.Equal(t, "1.4.2", body.Clients[0].AppVersion)
+	require.Equal(t, int64(1), body.Clients[0].Sessions)
+	require.Equal(t, int64(1), body.Clients[0].PushTokens)
+}
+
+func TestListSessions(t *testing.T) {
+	providers := createTestProviders(t)
+	clock := newFakeClock(time.Now())
+	providers.clock = clock
+	user, keyPair := createTestUser(t, providers)
+	token := loginTestUser(t, providers, user, keyPair)
+	now := clock.Now()
+	ios := model.ClientRecord{Platform: "ios", AppVersion: "2.1", DeviceModel: "iPhone12,1"}
+	for _, rtr := range []model.RefreshTokenRecord{
+		{Token: "other-refresh", UserID: user.ID, ExpiresAt: now.Add(time.Hour).Unix(), ClientRecord: ios,
+			CreatedAt: now.Add(-time.Hour).Unix(), LastUsed: now.Add(-time.Hour).Unix(), UserAgent: "Oscar/2.1", IPPrefix: "203.0.113.0/24"},
+		{Token: "expired-refresh", UserID: user.ID, ExpiresAt: now.Add(-time.Hour).Unix()},
+		{Token: "someone-elses-refresh", UserID: user.ID + 1, ExpiresAt: now.Add(time.Hour).Unix()},
+	} {
+		require.NoError(t, providers.db.InsertRefreshToken(rtr))
+	}
+	router := newOscarRouter(providers)
+
+	type session struct {
+		ID          int64  `json:"id"`
+		Current     bool   `json:"current"`
+		CreatedAt   int64  `json:"created_at"`
+		LastUsed    int64  `json:"last_used"`
+		ExpiresAt   int64  `json:"expires_at"`
+		UserAgent   string `json:"user_agent"`
+		IPPrefix    string `json:"ip_prefix"`
+		Platform    string `json:"platform"`
+		AppVersion  string `json:"app_version"`
+		DeviceModel string `json:"device_model"`
+	}
+	list := func() []session {
+		r := httptest.NewRequest(http.MethodGet, "/1/users/me/sessions", nil)
+		r.Header.Set("X-Oscar-Access-Token", token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+		require.NotContains(t, w.Body.String(), "other-refresh")
+		body := struct {
+			Sessions []session `json:"sessions"`
+		}{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+		return body.Sessions
+	}
+
+	// last used first
+	sessions := list()
+	require.Len(t, sessions, 2)
+	require.True(t, sessions[0].Current)
+	require.Equal(t, now.Unix(), sessions[0].LastUsed)
+	require.False(t, sessions[1].Current)
+	require.Equal(t, session{
+		ID:          sessions[1].ID,
+		CreatedAt:   now.Add(-time.Hour).Unix(),
+		LastUsed:    now.Add(-time.Hour).Unix(),
+		ExpiresAt:   now.Add(time.Hour).Unix(),
+		UserAgent:   "Oscar/2.1",
+		IPPrefix:    "203.0.113.0/24",
+		Platform:    "ios",
+		AppVersion:  "2.1",
+		DeviceModel: "iPhone12,1",
+	}, sessions[1])
+
+	// using the session records it as used, but not more often than
+	// sessionTouchInterval
+	clock.Advance(sessionTouchInterval - time.Second)
+	require.Equal(t, now.Unix(), list()[0].LastUsed)
+	clock.Advance(time.Second)
+	require.Equal(t, clock.Now().Unix(), list()[0].LastUsed)
+}
+
+func TestDeleteSession(t *testing.T) {
+	providers := createTestProviders(t)
+	user, keyPair := createTestUser(t, providers)
+	token := loginTestUser(t, providers, user, keyPair)
+	otherDevice := loginTestUser(t, providers, user, keyPair)
+	someone, someoneKeyPair := createTestUser(t, providers)
+	someonesToken := loginTestUser(t, providers, someone, someoneKeyPair)
+	router := newOscarRouter(providers)
+
+	do := func(method, target, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		r.Header.Set("X-Oscar-Access-Token", token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	sessionID := func(token string) int64 {
+		atr, err := providers.db.AccessToken(token)
+		require.NoError(t, err)
+		rtr, err := providers.db.RefreshToken(atr.RefreshToken)
+		require.NoError(t, err)
+		return rtr.ID
+	}
+	target := func(id int64) string {
+		return fmt.Sprintf("/1/users/me/sessions/%d", id)
+	}
+
+	// sessions of other users are unknown
+	w := do(http.MethodDelete, target(sessionID(someonesToken)), token)
+	require.Equal(t, http.StatusNotFound, w.Code, "Got: %s", w.Body.String())
+	require.Equal(t, http.StatusOK, do(http.MethodGet, "/1/users/me/sessions", someonesToken).Code)
+
+	w = do(http.MethodDelete, target(sessionID(otherDevice)), token)
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	require.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/1/users/me/sessions", otherDevice).Code)
+	require.Equal(t, http.StatusOK, do(http.MethodGet, "/1/users/me/sessions", token).Code)
+
+	w = do(http.MethodDelete, "/1/users/me/sessions/nope", token)
+	require.Equal(t, http.StatusBadRequest, w.Code, "Got: %s", w.Body.String())
+}
+
+func TestAccessTokenExpiresOnClock(t *testing.T) {
+	providers := createTestProviders(t)
+	clock := newFakeClock(time.Now())
+	providers.clock = clock
+	user, keyPair := createTestUser(t, providers)
+	token := loginTestUser(t, providers, user, keyPair)
+
+	get := func() int {
+		r := httptest.NewRequest(http.MethodGet, "/1/test", nil)
+		r.Header.Set("X-Oscar-Access-Token", token)
+		r = r.WithContext(context.WithValue(r.Context(), contextServerProvidersKey, providers))
+		w := httptest.NewRecorder()
+		sessionHandler(func(w http.ResponseWriter, r *http.Request) {})(w, r)
+		return w.Code
+	}
+	require.Equal(t, http.StatusOK, get())
+
+	// the test tokens last a day
+	clock.Advance(23 * time.Hour)
+	require.Equal(t, http.StatusOK, get())
+	clock.Advance(2 * time.Hour)
+	require.Equal(t, http.StatusUnauthorized, get())
+}
+
+func TestRevokeSessions(t *testing.T) {
+	providers := createTestProviders(t)
+	user, keyPair := createTestUser(t, providers)
+	first := loginTestUser(t, providers, user, keyPair)
+	second := loginTestUser(t, providers, user, keyPair)
+	third := loginTestUser(t, providers, user, keyPair)
+	other, otherKeyPair := createTestUser(t, providers)
+	othersToken := loginTestUser(t, providers, other, otherKeyPair)
+	router := newOscarRouter(providers)
+
+	do := func(method, target, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		r.Header.Set("X-Oscar-Access-Token", token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	signedIn := func(token string) bool {
+		return do(http.MethodGet, "/1/users/me/sessions", token).Code == http.StatusOK
+	}
+
+	w := do(http.MethodDelete, "/1/sessions/me", first)
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	require.False(t, signedIn(first))
+	require.True(t, signedIn(second))
+
+	w = do(http.MethodDelete, "/1/sessions", second)
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	require.JSONEq(t, `{"revoked": 2}`, w.Body.String())
+	require.False(t, signedIn(second))
+	require.False(t, signedIn(third))
+	// other users stay signed in
+	require.True(t, signedIn(othersToken))
+}
+
+func TestRefreshSession(t *testing.T) {
+	providers := createTestProviders(t)
+	clock := newFakeClock(time.Now())
+	providers.clock = clock
+	user, _ := createTestUser(t, providers)
+	require.NoError(t, providers.db.InsertRefreshToken(model.RefreshTokenRecord{Token: "refresh-token", UserID: user.ID, ExpiresAt: clock.Now().Add(refreshTokenTTL).Unix()}))
+	router := newOscarRouter(providers)
+
+	type refreshResponse struct {
+		AccessToken          string `json:"access_token"`
+		AccessTokenExpiresAt int64  `json:"access_token_expires_at"`
+		RefreshToken         string `json:"refresh_token"`
+	}
+	refresh := func(refreshToken string) (*httptest.ResponseRecorder, refreshResponse) {
+		body, err := json.Marshal(map[string]string{"refresh_token": refreshToken})
+		require.NoError(t, err)
+		r := httptest.NewRequest(http.MethodPost, "/1/sessions/refresh", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		resp := refreshResponse{}
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		}
+		return w, resp
+	}
+	signedIn := func(token string) bool {
+		r := httptest.NewRequest(http.MethodGet, "/1/users/me/sessions", nil)
+		r.Header.Set("X-Oscar-Access-Token", token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code == http.StatusOK
+	}
+
+	w, first := refresh("refresh-token")
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	require.Equal(t, clock.Now().Add(accessTokenTTL).Unix(), first.AccessTokenExpiresAt)
+	require.NotEqual(t, "refresh-token", first.RefreshToken)
+	require.True(t, signedIn(first.AccessToken))
+
+	// a refresh token can only be used once
+	w, _ = refresh("refresh-token")
+	require.Equal(t, http.StatusUnauthorized, w.Code, "Got: %s", w.Body.String())
+
+	// the access token expires, but the new refresh token gets another one
+	clock.Advance(accessTokenTTL + time.Minute)
+	require.False(t, signedIn(first.AccessToken))
+	w, second := refresh(first.RefreshToken)
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	require.True(t, signedIn(second.AccessToken))
+
+	// logging out revokes the refresh token
+	r := httptest.NewRequest(http.MethodDelete, "/1/sessions/me", nil)
+	r.Header.Set("X-Oscar-Access-Token", second.AccessToken)
+	router.ServeHTTP(httptest.NewRecorder(), r)
+	w, _ = refresh(second.RefreshToken)
+	require.Equal(t, http.StatusUnauthorized, w.Code, "Got: %s", w.Body.String())
+	w, _ = refresh("unknown")
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// users locked out of logging in can't refresh either
+	require.NoError(t, providers.db.InsertRefreshToken(model.RefreshTokenRecord{Token: "locked-out", UserID: user.ID, ExpiresAt: clock.Now().Add(refreshTokenTTL).Unix()}))
+	for i := 0; i < accountLoginLimit.lockAt; i++ {
+		providers.loginLockouts.fail(user.ID, "", clock.Now())
+	}
+	w, _ = refresh("locked-out")
+	require.Equal(t, http.StatusTooManyRequests, w.Code, "Got: %s", w.Body.String())
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+// When the server is asked to stop, it drains its websockets rather than
+// dropping all of them at once, which would have every client of the
+// instance reconnect at the same moment. It fails /readyz, so the load
+// balancer stops sending it traffic, refuses new websockets, and closes the
+// open ones spread evenly over the drain window. Each gets a close frame
+// with code 1012 (service restart), whose reason tells the client how long
+// to wait before reconnecting, e.g. {"reconnect_after_ms":7350}.
+
+// Defaults for the socket_drain config section
+const (
+	defaultDrainWindow         = 20 * time.Second
+	defaultDrainReconnectAfter = 10 * time.Second
+	defaultDrainJitter         = 5 * time.Second
+	// drainCloseGrace is how long a client has to answer a close frame
+	// before its connection is closed anyway
+	drainCloseGrace = 5 * time.Second
+)
+
+// socketDrainConfig tunes how websockets are drained on shutdown. Durations
+// are strings like "20s". Clients are told to reconnect after
+// ReconnectAfter, give or take Jitter. The drain window has to fit in the
+// time the orchestrator gives the process to stop, along with the 10
+// seconds requests get to finish.
+type socketDrainConfig struct {
+	Jitter         string `json:"jitter,omitempty"`
+	ReconnectAfter string `json:"reconnect_after,omitempty"`
+	Window         string `json:"window,omitempty"`
+}
+
+// socketDrain is the parsed form of a socketDrainConfig
+type socketDrain struct {
+	window         time.Duration
+	reconnectAfter time.Duration
+	jitter         time.Duration
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func newSocketDrain(cfg socketDrainConfig) (*socketDrain, error) {
+	sd := &socketDrain{
+		window:         defaultDrainWindow,
+		reconnectAfter: defaultDrainReconnectAfter,
+		jitter:         defaultDrainJitter,
+		rand:           rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	durations := []struct {
+		name string
+		val  string
+		dst  *time.Duration
+	}{
+		{"jitter", cfg.Jitter, &sd.jitter},
+		{"reconnect_after", cfg.ReconnectAfter, &sd.reconnectAfter},
+		{"window", cfg.Window, &sd.window},
+	}
+	for _, d := range durations {
+		if d.val == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(d.val)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid socket_drain '%s'", d.name)
+		}
+		if parsed < 0 {
+			return nil, errors.Errorf("socket_drain '%s' can't be negative", d.name)
+		}
+		*d.dst = parsed
+	}
+	if sd.jitter > sd.reconnectAfter {
+		return nil, errors.New("socket_drain 'jitter' can't be longer than 'reconnect_after'")
+	}
+	return sd, nil
+}
+
+// reconnectDelay picks how long a client waits before reconnecting
+func (sd *socketDrain) reconnectDelay() time.Duration {
+	if sd.jitter == 0 {
+		return sd.reconnectAfter
+	}
+	sd.mu.Lock()
+	offset := time.Duration(sd.rand.Int63n(int64(2*sd.jitter) + 1))
+	sd.mu.Unlock()
+	return sd.reconnectAfter - sd.jitter + offset
+}
+
+// drain stops sr from taking new websockets, and closes the open ones,
+// spread over the window. It returns once the last close frame is sent.
+func (sd *socketDrain) drain(sr *socketRegistry) {
+	sr.startDraining(sd.reconnectAfter)
+	conns := sr.list()
+	if len(conns) == 0 {
+		return
+	}
+	log.Printf("Draining %d websockets over %v", len(conns), sd.window)
+
+	interval := sd.window / time.Duration(len(conns))
+	for i, sc := range conns {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+		sc.closeForRestart(sd.reconnectDelay())
+	}
+}
+
+// closeForRestart asks the client to reconnect after a delay. The
+// connection is closed once the client answers, or after drainCloseGrace.
+func (sc *socketConn) closeForRestart(after time.Duration) {
+	reason, _ := json.Marshal(struct {
+		ReconnectAfterMS int64 `json:"reconnect_after_ms"`
+	}{ReconnectAfterMS: int64(after / time.Millisecond)})
+	sc.closeWith(websocket.CloseServiceRestart, string(reason))
+}
+
+// closeWith sends the client a close frame with code and reason. The
+// connection is closed once the client answers, or after drainCloseGrace.
+func (sc *socketConn) closeWith(code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	if err := sc.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second)); err != nil {
+		sc.conn.Close()
+		return
+	}
+	time.AfterFunc(drainCloseGrace, func() { sc.conn.Close() })
+}
+
+// startDraining refuses new websockets from now on. Clients that try are
+// told to retry after retryAfter.
+func (sr *socketRegistry) startDraining(retryAfter time.Duration) {
+	atomic.StoreInt64(&sr.drainRetryAfter, int64(retryAfter))
+	atomic.StoreInt32(&sr.draining, 1)
+}
+
+func (sr *socketRegistry) isDraining() bool {
+	return atomic.LoadInt32(&sr.draining) == 1
+}
+
+// refuseWhileDraining rejects the request, if websockets are being drained
+func refuseWhileDraining(w http.ResponseWriter) bool {
+	if !liveSockets.isDraining() {
+		return false
+	}
+	retryAfter := time.Duration(atomic.LoadInt64(&liveSockets.drainRetryAfter))
+	w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+	sendErr(w, "The server is shutting down", http.StatusServiceUnavailable, errorDraining)
+	return true
+}
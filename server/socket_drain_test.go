@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSocketDrain(t *testing.T) {
+	sd, err := newSocketDrain(socketDrainConfig{})
+	require.NoError(t, err)
+	require.Equal(t, defaultDrainWindow, sd.window)
+	for i := 0; i < 100; i++ {
+		d := sd.reconnectDelay()
+		require.True(t, d >= defaultDrainReconnectAfter-defaultDrainJitter && d <= defaultDrainReconnectAfter+defaultDrainJitter, "delay %v", d)
+	}
+
+	_, err = newSocketDrain(socketDrainConfig{Window: "-1s"})
+	require.Error(t, err)
+	_, err = newSocketDrain(socketDrainConfig{ReconnectAfter: "2s", Jitter: "3s"})
+	require.Error(t, err)
+	sd, err = newSocketDrain(socketDrainConfig{ReconnectAfter: "2s", Jitter: "0s"})
+	require.NoError(t, err)
+	require.Equal(t, 2*time.Second, sd.reconnectDelay())
+}
+
+func TestDrainSockets(t *testing.T) {
+	providers := createTestProviders(t)
+	server := httptest.NewServer(newOscarRouter(providers))
+	defer server.Close()
+	endpoint := "ws" + strings.TrimPrefix(server.URL, "http") + "/1/drop-boxes/watch"
+
+	conn, _, err := (&websocket.Dialer{}).Dial(endpoint, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	sd, err := newSocketDrain(socketDrainConfig{Window: "0s", ReconnectAfter: "10s", Jitter: "5s"})
+	require.NoError(t, err)
+	defer atomic.StoreInt32(&liveSockets.draining, 0)
+	sd.drain(liveSockets)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	closeErr, ok := err.(*websocket.CloseError)
+	require.True(t, ok, "expected a close frame. Got %v", err)
+	require.Equal(t, websocket.CloseServiceRestart, closeErr.Code)
+	reason := struct {
+		ReconnectAfterMS int64 `json:"reconnect_after_ms"`
+	}{}
+	require.NoError(t, json.Unmarshal([]byte(closeErr.Text), &reason))
+	require.True(t, reason.ReconnectAfterMS >= 5000 && reason.ReconnectAfterMS <= 15000, "reconnect after %d", reason.ReconnectAfterMS)
+
+	// no new websockets, and the load balancer is told to stop sending
+	// traffic
+	_, resp, err := (&websocket.Dialer{}).Dial(endpoint, nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, "10", resp.Header.Get("Retry-After"))
+
+	w := httptest.NewRecorder()
+	newOscarRouter(providers).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Contains(t, w.Body.String(), `"draining":true`)
+}
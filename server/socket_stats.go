@@ -0,0 +1,229 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Kinds of websocket connections
+const (
+	socketKindSocket         = "socket"
+	socketKindPackageWatcher = "package_watcher"
+)
+
+// liveSockets tracks every open websocket, for GET /admin/sockets
+var liveSockets = newSocketRegistry()
+
+// socketConn holds the diagnostics of one websocket. The counters are
+// updated by the connection's goroutines, and read by the admin handler.
+type socketConn struct {
+	// the 64-bit atomics come first, so they're aligned on 32-bit platforms
+	subscriptions int64
+	// queued counts the frames handed to the writer that it hasn't written
+	queued       int64
+	lastActivity int64
+	received     uint64
+	sent         uint64
+
+	registry    *socketRegistry
+	conn        *websocket.Conn
+	id          int64
+	kind        string
+	userID      int64
+	remoteAddr  string
+	connectedAt time.Time
+}
+
+func (sc *socketConn) touch() {
+	atomic.StoreInt64(&sc.lastActivity, time.Now().UnixNano())
+}
+
+// frameReceived records a frame read from the client
+func (sc *socketConn) frameReceived() {
+	sc.touch()
+	atomic.AddUint64(&sc.received, 1)
+	atomic.AddUint64(&sc.registry.received, 1)
+}
+
+// frameQueued records a frame waiting for the writer
+func (sc *socketConn) frameQueued() {
+	atomic.AddInt64(&sc.queued, 1)
+}
+
+// frameDequeued records the writer taking a queued frame
+func (sc *socketConn) frameDequeued() {
+	atomic.AddInt64(&sc.queued, -1)
+}
+
+// frameSent records the outcome of writing a frame to the client
+func (sc *socketConn) frameSent(err error) {
+	if err != nil {
+		atomic.AddUint64(&sc.registry.writeErrors, 1)
+		return
+	}
+	sc.touch()
+	atomic.AddUint64(&sc.sent, 1)
+	atomic.AddUint64(&sc.registry.sent, 1)
+}
+
+// subscribed adds delta to the number of watched drop boxes
+func (sc *socketConn) subscribed(delta int64) {
+	atomic.AddInt64(&sc.subscriptions, delta)
+}
+
+// socketRegistry holds the open websockets, and counters over all of them
+type socketRegistry struct {
+	opened      uint64
+	closed      uint64
+	received    uint64
+	sent        uint64
+	writeErrors uint64
+	// drainRetryAfter is how long refused clients are told to wait
+	drainRetryAfter int64
+	// draining is set once the server starts shutting down. No websockets
+	// are opened after.
+	draining int32
+
+	mu     sync.Mutex
+	nextID int64
+	conns  map[int64]*socketConn
+}
+
+func newSocketRegistry() *socketRegistry {
+	return &socketRegistry{conns: map[int64]*socketConn{}}
+}
+
+// open registers a new websocket. userID is 0 for package watchers, since
+// they're anonymous.
+func (sr *socketRegistry) open(kind string, userID int64, conn *websocket.Conn) *socketConn {
+	now := time.Now()
+	sc := &socketConn{
+		lastActivity: now.UnixNano(),
+		registry:     sr,
+		conn:         conn,
+		kind:         kind,
+		userID:       userID,
+		remoteAddr:   conn.RemoteAddr().String(),
+		connectedAt:  now,
+	}
+	atomic.AddUint64(&sr.opened, 1)
+
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.nextID++
+	sc.id = sr.nextID
+	sr.conns[sc.id] = sc
+	return sc
+}
+
+// close unregisters a websocket
+func (sr *socketRegistry) close(sc *socketConn) {
+	atomic.AddUint64(&sr.closed, 1)
+
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	delete(sr.conns, sc.id)
+}
+
+// list returns the open websockets, oldest first
+func (sr *socketRegistry) list() []*socketConn {
+	sr.mu.Lock()
+	conns := make([]*socketConn, 0, len(sr.conns))
+	for _, sc := range sr.conns {
+		conns = append(conns, sc)
+	}
+	sr.mu.Unlock()
+
+	sort.Slice(conns, func(i, j int) bool { return conns[i].id < conns[j].id })
+	return conns
+}
+
+// closeUser closes the websockets of userID with code and reason, and
+// returns how many it closed. Package watchers are anonymous, so they're
+// left open.
+func (sr *socketRegistry) closeUser(userID int64, code int, reason string) int {
+	n := 0
+	for _, sc := range sr.list() {
+		if sc.kind == socketKindSocket && sc.userID == userID {
+			sc.closeWith(code, reason)
+			n++
+		}
+	}
+	return n
+}
+
+// socketInfo is the JSON form of a socketConn
+type socketInfo struct {
+	ID            int64  `json:"id"`
+	Kind          string `json:"kind"`
+	Username      string `json:"username,omitempty"`
+	RemoteAddr    string `json:"remote_addr"`
+	ConnectedAt   int64  `json:"connected_at"`
+	LastActivity  int64  `json:"last_activity"`
+	Subscriptions int64  `json:"subscriptions"`
+	QueuedFrames  int64  `json:"queued_frames"`
+	Received      uint64 `json:"frames_received"`
+	Sent          uint64 `json:"frames_sent"`
+}
+
+// socketsHandler handles GET /admin/sockets. The connections can be limited
+// to one user with the 'username' query parameter.
+func socketsHandler(w http.ResponseWriter, r *http.Request) {
+	db := providersCtx(r.Context()).db
+	username := strings.ToLower(r.URL.Query().Get("username"))
+	var userID int64
+	if username != "" {
+		var pubKey []byte
+		var err error
+		userID, pubKey, err = db.LimitedUserInfo(username)
+		if err != nil {
+			sendInternalErr(w, err)
+			return
+		}
+		if pubKey == nil {
+			sendNotFound(w, "user not found", errorUserNotFound)
+			return
+		}
+	}
+
+	open := liveSockets.list()
+	conns := []socketInfo{}
+	for _, sc := range open {
+		if userID != 0 && sc.userID != userID {
+			continue
+		}
+		info := socketInfo{
+			ID:            sc.id,
+			Kind:          sc.kind,
+			RemoteAddr:    sc.remoteAddr,
+			ConnectedAt:   sc.connectedAt.Unix(),
+			LastActivity:  time.Unix(0, atomic.LoadInt64(&sc.lastActivity)).Unix(),
+			Subscriptions: atomic.LoadInt64(&sc.subscriptions),
+			QueuedFrames:  atomic.LoadInt64(&sc.queued),
+			Received:      atomic.LoadUint64(&sc.received),
+			Sent:          atomic.LoadUint64(&sc.sent),
+		}
+		if sc.userID != 0 {
+			info.Username = db.Username(sc.userID)
+		}
+		conns = append(conns, info)
+	}
+
+	sendSuccess(w, map[string]interface{}{
+		"connections": conns,
+		"totals": map[string]uint64{
+			"open":            uint64(len(open)),
+			"opened":          atomic.LoadUint64(&liveSockets.opened),
+			"closed":          atomic.LoadUint64(&liveSockets.closed),
+			"frames_received": atomic.LoadUint64(&liveSockets.received),
+			"frames_sent":     atomic.LoadUint64(&liveSockets.sent),
+			"write_errors":    atomic.LoadUint64(&liveSockets.writeErrors),
+		},
+	})
+}
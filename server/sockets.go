@@ -1,24 +1,33 @@
 package main
 
 import (
+	"encoding/binary"
 	"encoding/hex"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"zood.dev/oscar/internal/pubsub"
 	"zood.dev/oscar/kvstor"
+	"zood.dev/oscar/model"
 )
 
 const (
 	socketClientCmdNop    byte = 0
 	socketClientCmdWatch  byte = 1
 	socketClientCmdIgnore byte = 2
+	// socketClientCmdAckMessages is followed by the ids of received messages
+	// as big-endian uint64s. The messages are deleted.
+	socketClientCmdAckMessages byte = 3
 )
 
 const (
 	socketServerCmdPackage          byte = 1
 	socketServerCmdPushNotification byte = 2
+	// socketServerCmdMessagesAcked echoes the ids of an ack once the
+	// messages have been deleted
+	socketServerCmdMessagesAcked byte = 3
 )
 
 var messagesPubSub = pubsub.NewInt64()
@@ -26,23 +35,56 @@ var messagesPubSub = pubsub.NewInt64()
 type socketServer struct {
 	conn     *websocket.Conn
 	closed   chan bool
+	db       model.Provider
 	kvs      kvstor.Provider
 	messages chan []byte
 	pkgs     chan []byte
-	pkgSubs  map[string]chan []byte
+	pkgSubs  map[string]boxSubscription
+	stats    *socketConn
 	userID   int64
 }
 
+// boxSubscription is a watched drop box's subscription, and the topic it's
+// subscribed to, which is the box's own id when it was watched by an alias
+type boxSubscription struct {
+	sub   chan []byte
+	topic string
+}
+
+func (ss socketServer) ackMessages(buf []byte) {
+	if len(buf) == 0 || len(buf)%8 != 0 || len(buf)/8 > maxMessageIDs {
+		log.Printf("invalid message ack length (%d)", len(buf))
+		return
+	}
+	ids := make([]int64, len(buf)/8)
+	for i := range ids {
+		ids[i] = int64(binary.BigEndian.Uint64(buf[i*8:]))
+	}
+	if _, err := ss.db.DeleteMessagesToRecipient(ss.userID, ids); err != nil {
+		logErr(err)
+		return
+	}
+
+	ack := append([]byte{socketServerCmdMessagesAcked}, buf...)
+	ss.stats.frameQueued()
+	select {
+	case ss.pkgs <- ack:
+	case <-ss.closed:
+		ss.stats.frameDequeued()
+	}
+}
+
 func (ss socketServer) ignoreBox(boxID []byte) {
 	hexID := hex.EncodeToString(boxID)
-	sub := ss.pkgSubs[hexID]
-	if sub == nil {
+	bs, ok := ss.pkgSubs[hexID]
+	if !ok {
 		// We don't have a subscription for this box. Client error!
 		log.Printf("A client tried unsubscribing from a drop box to which they hadn't subscribed")
 		return
 	}
-	dropBoxPubSub.Unsub(sub, hexID)
+	dropBoxPubSub.Unsub(bs.sub, bs.topic)
 	delete(ss.pkgSubs, hexID)
+	ss.stats.subscribed(-1)
 }
 
 func (ss socketServer) readConn() {
@@ -53,6 +95,7 @@ func (ss socketServer) readConn() {
 		if err != nil {
 			break
 		}
+		ss.stats.frameReceived()
 		if msgType != websocket.BinaryMessage {
 			log.Printf("received a non-binary message")
 			break
@@ -67,6 +110,8 @@ func (ss socketServer) readConn() {
 			ss.watchBox(buf[1:])
 		case socketClientCmdIgnore:
 			ss.ignoreBox(buf[1:])
+		case socketClientCmdAckMessages:
+			ss.ackMessages(buf[1:])
 		default:
 			log.Printf("unknown socket command: %d", buf[0])
 		}
@@ -85,13 +130,14 @@ func (ss socketServer) stop() {
 	<-ss.closed
 
 	// stop listening for packages
-	for hexBoxID, sub := range ss.pkgSubs {
-		dropBoxPubSub.Unsub(sub, hexBoxID)
+	for _, bs := range ss.pkgSubs {
+		dropBoxPubSub.Unsub(bs.sub, bs.topic)
 	}
 	// stop listening for messages
 	messagesPubSub.Unsub(ss.messages, ss.userID)
 
 	ss.conn.Close()
+	liveSockets.close(ss.stats)
 }
 
 func (ss socketServer) watchBox(boxID []byte) {
@@ -102,17 +148,24 @@ func (ss socketServer) watchBox(boxID []byte) {
 	hexID := hex.EncodeToString(boxID)
 
 	// if there's already a sub for this id, skip it
-	if ss.pkgSubs[hexID] != nil {
+	if _, ok := ss.pkgSubs[hexID]; ok {
 		log.Printf("A client requested a 'watch' for the same box more than once")
 		return
 	}
+	box, err := resolveDropBox(ss.kvs, boxID)
+	if err != nil {
+		logErr(err)
+		return
+	}
 
 	// create a subscription
-	sub := dropBoxPubSub.Sub(hexID)
-	ss.pkgSubs[hexID] = sub
+	topic := hex.EncodeToString(box)
+	sub := dropBoxPubSub.Sub(topic)
+	ss.pkgSubs[hexID] = boxSubscription{sub: sub, topic: topic}
+	ss.stats.subscribed(1)
 
 	// If there's already a package in the dropbox, send it
-	tmp, err := ss.kvs.PickUpPackage(boxID)
+	tmp, err := ss.kvs.PickUpPackage(box)
 	if err != nil {
 		logErr(err)
 	}
@@ -133,6 +186,7 @@ func (ss socketServer) watchBox(boxID []byte) {
 				buf = append(buf, pkg...)
 				// Send it to our writing goroutine to send it across
 				// the socket,
+				ss.stats.frameQueued()
 				ss.pkgs <- buf
 			}
 		}
@@ -147,14 +201,19 @@ func (ss socketServer) writeConn() {
 				return
 			}
 			buf := append([]byte{socketServerCmdPushNotification}, msg...)
-			if err := ss.conn.WriteMessage(websocket.BinaryMessage, buf); err != nil {
+			err := ss.conn.WriteMessage(websocket.BinaryMessage, buf)
+			ss.stats.frameSent(err)
+			if err != nil {
 				return
 			}
 		case pkg := <-ss.pkgs:
 			if pkg == nil {
 				return
 			}
-			if err := ss.conn.WriteMessage(websocket.BinaryMessage, pkg); err != nil {
+			ss.stats.frameDequeued()
+			err := ss.conn.WriteMessage(websocket.BinaryMessage, pkg)
+			ss.stats.frameSent(err)
+			if err != nil {
 				return
 			}
 		case <-ss.closed:
@@ -163,42 +222,48 @@ func (ss socketServer) writeConn() {
 	}
 }
 
-func newSocketServer(conn *websocket.Conn, userID int64, kvs kvstor.Provider) socketServer {
+func newSocketServer(conn *websocket.Conn, userID int64, db model.Provider, kvs kvstor.Provider) socketServer {
 	return socketServer{
 		closed:  make(chan bool),
 		conn:    conn,
+		db:      db,
 		kvs:     kvs,
 		pkgs:    make(chan []byte, 5),
-		pkgSubs: map[string]chan []byte{},
+		pkgSubs: map[string]boxSubscription{},
+		stats:   liveSockets.open(socketKindSocket, userID, conn),
 		userID:  userID,
 	}
 }
 
 func createSocketHandler(w http.ResponseWriter, r *http.Request) {
+	if refuseWhileDraining(w) {
+		return
+	}
 	// check the 'Sec-Websocket-Protocol' header for an access token
 	token := r.Header.Get("Sec-Websocket-Protocol")
 	providers := providersCtx(r.Context())
-	db := providers.db
-	userID, err := verifyAccessToken(db, token)
+	now := providers.now()
+	cred, err := verifyCredential(providers, token, r.URL.Query().Get("ticket"))
 	if err != nil {
 		sendInternalErr(w, err)
 		return
 	}
-
-	if userID == 0 {
-		// check if they specified a ticket
-		ticket := r.URL.Query().Get("ticket")
-		userID, err = verifySessionTicket(db, ticket)
-		if err != nil {
-			sendInternalErr(w, err)
-			return
-		}
-		// if the user id is still 0, then reject the request
-		if userID == 0 {
-			sendInvalidAccessToken(w)
-			return
-		}
+	if cred.userID == 0 {
+		sendInvalidAccessToken(w)
+		return
+	}
+	if refuseInactiveAccount(w, cred.status, now) {
+		return
 	}
+	// sockets deliver and acknowledge messages, so none of the scopes are
+	// enough to open one
+	if !cred.allows(nil) {
+		sendScopeNotAllowed(w)
+		return
+	}
+	userID := cred.userID
+
+	setRequestUser(r.Context(), userID)
 
 	upgrade := websocket.Upgrader{
 		ReadBufferSize:  1024,
@@ -210,8 +275,12 @@ func createSocketHandler(w http.ResponseWriter, r *http.Request) {
 		// we don't need to do anything. The upgrader sends 400 on our behalf.
 		return
 	}
+	// the connection outlives the request, so it can't keep the server's
+	// write deadline
+	conn.UnderlyingConn().SetWriteDeadline(time.Time{})
 
-	kvs := providers.kvs
-	ss := newSocketServer(conn, userID, kvs)
+	// the socket outlives the request
+	unbound := providers.detached()
+	ss := newSocketServer(conn, userID, unbound.db, unbound.kvs)
 	ss.start()
 }
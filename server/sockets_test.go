@@ -1,12 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
 	"zood.dev/oscar/base62"
 )
 
@@ -40,7 +45,7 @@ func TestCreateSocketHandler(t *testing.T) {
 
 	// try logging in with a ticket
 	ticket := base62.Rand(ticketLength)
-	providers.db.InsertTicket(ticket, user.ID)
+	providers.db.InsertTicket(ticket, user.ID, "")
 
 	endpoint = "ws" + strings.TrimPrefix(server.URL, "http") + "?ticket=" + ticket
 	conn, _, err = dialer.Dial(endpoint, nil)
@@ -49,3 +54,98 @@ func TestCreateSocketHandler(t *testing.T) {
 	}
 	conn.Close()
 }
+
+func TestSocketAckMessages(t *testing.T) {
+	providers := createTestProviders(t)
+	user, keyPair := createTestUser(t, providers)
+	accessToken := loginTestUser(t, providers, user, keyPair)
+
+	server := httptest.NewServer(providersInjector(providers, createSocketHandler))
+	defer server.Close()
+	hdrs := make(http.Header)
+	hdrs.Set("Sec-Websocket-Protocol", accessToken)
+	conn, _, err := (&websocket.Dialer{}).Dial("ws"+strings.TrimPrefix(server.URL, "http"), hdrs)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	msgID, err := providers.db.InsertMessage(user.ID, 0, []byte("cipher-text"), []byte("nonce"), 1234)
+	require.NoError(t, err)
+
+	ack := make([]byte, 9)
+	ack[0] = socketClientCmdAckMessages
+	binary.BigEndian.PutUint64(ack[1:], uint64(msgID))
+	require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, ack))
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, buf, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, socketServerCmdMessagesAcked, buf[0])
+	require.Equal(t, ack[1:], buf[1:])
+
+	rec, err := providers.db.MessageToRecipient(user.ID, msgID)
+	require.NoError(t, err)
+	require.Nil(t, rec)
+}
+
+func TestSocketsHandler(t *testing.T) {
+	providers := createTestProviders(t)
+	providers.adminToken = "admin-token"
+	user, keyPair := createTestUser(t, providers)
+	accessToken := loginTestUser(t, providers, user, keyPair)
+
+	server := httptest.NewServer(newOscarRouter(providers))
+	defer server.Close()
+	hdrs := make(http.Header)
+	hdrs.Set("Sec-Websocket-Protocol", accessToken)
+	conn, _, err := (&websocket.Dialer{}).Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/1/sockets", hdrs)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	watch := append([]byte{socketClientCmdWatch}, bytes.Repeat([]byte{9}, dropBoxIDSize)...)
+	require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, watch))
+
+	list := func(username string) (conns []socketInfo, totals map[string]uint64) {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/admin/sockets?username="+username, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+providers.adminToken)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		body := struct {
+			Connections []socketInfo      `json:"connections"`
+			Totals      map[string]uint64 `json:"totals"`
+		}{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return body.Connections, body.Totals
+	}
+
+	// the watch is handled asynchronously
+	deadline := time.Now().Add(5 * time.Second)
+	var conns []socketInfo
+	var totals map[string]uint64
+	for {
+		conns, totals = list(user.Username)
+		if len(conns) == 1 && conns[0].Subscriptions == 1 {
+			break
+		}
+		require.True(t, time.Now().Before(deadline), "the watch wasn't counted")
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, socketKindSocket, conns[0].Kind)
+	require.Equal(t, user.Username, conns[0].Username)
+	require.Equal(t, uint64(1), conns[0].Received)
+	require.Zero(t, conns[0].QueuedFrames)
+	require.NotZero(t, totals["open"])
+
+	// the connection goes away once it's closed
+	conn.Close()
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		if conns, _ = list(user.Username); len(conns) == 0 {
+			break
+		}
+		require.True(t, time.Now().Before(deadline), "the connection wasn't unregistered")
+		time.Sleep(10 * time.Millisecond)
+	}
+}
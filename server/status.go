@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxIncidentMessageLength bounds the incident message, in characters, so
+// it fits in the banner of the client apps
+const maxIncidentMessageLength = 280
+
+// The operational states reported by GET /status
+const (
+	statusOperational = "operational"
+	statusDegraded    = "degraded"
+)
+
+// incidentSeverities are the severities an incident can be posted with
+var incidentSeverities = map[string]bool{
+	"info":     true,
+	"warning":  true,
+	"critical": true,
+}
+
+// incident is a notice about a problem with the service, like delays in
+// message delivery, which the client apps show to users
+type incident struct {
+	Message  string `json:"message"`
+	Severity string `json:"severity"`
+	// Since is when the incident was posted, in unix time
+	Since int64 `json:"since"`
+}
+
+// currentIncident returns the incident stored in kvs, or nil when there's
+// none
+func currentIncident(providers *serverProviders) (*incident, error) {
+	buf, err := providers.kvs.Incident()
+	if err != nil || buf == nil {
+		return nil, err
+	}
+	inc := &incident{}
+	if err := json.Unmarshal(buf, inc); err != nil {
+		return nil, errors.Wrap(err, "corrupt incident notice")
+	}
+	return inc, nil
+}
+
+// statusHandler handles GET /status. It needs no session, so the apps can
+// show the incident before the user signs in. The service is degraded while
+// a dependency is down.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	providers := providersCtx(r.Context())
+	inc, err := currentIncident(providers)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	resp := struct {
+		Status   string    `json:"status"`
+		Incident *incident `json:"incident,omitempty"`
+	}{Status: statusOperational, Incident: inc}
+	if !providers.dependencies.healthy() {
+		resp.Status = statusDegraded
+	}
+	sendSuccess(w, resp)
+}
+
+// setIncidentHandler handles PUT /admin/incident, replacing the incident
+// shown to users
+func setIncidentHandler(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Message  string `json:"message"`
+		Severity string `json:"severity"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendBadReq(w, "Unable to parse PUT body: "+err.Error())
+		return
+	}
+	msg := strings.TrimSpace(body.Message)
+	if msg == "" || len([]rune(msg)) > maxIncidentMessageLength {
+		sendBadReq(w, fmt.Sprintf("'message' must be between 1 and %d characters", maxIncidentMessageLength))
+		return
+	}
+	if !incidentSeverities[body.Severity] {
+		sendBadReq(w, "'severity' must be info, warning or critical")
+		return
+	}
+
+	providers := providersCtx(r.Context())
+	inc := incident{Message: msg, Severity: body.Severity, Since: providers.now().Unix()}
+	buf, err := json.Marshal(inc)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	if err := providers.kvs.SetIncident(buf); err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	sendSuccess(w, inc)
+}
+
+// clearIncidentHandler handles DELETE /admin/incident
+func clearIncidentHandler(w http.ResponseWriter, r *http.Request) {
+	if err := providersCtx(r.Context()).kvs.SetIncident(nil); err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	sendSuccess(w, nil)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatus(t *testing.T) {
+	providers := createTestProviders(t)
+	providers.adminToken = "admin-token"
+	providers.clock = newFakeClock(time.Unix(1600000000, 0))
+	var storageErr error
+	providers.dependencies = newDependencyMonitor([]dependencyProbe{
+		{name: "file_storage", critical: true, check: func(context.Context) error { return storageErr }},
+	})
+	router := newOscarRouter(providers)
+	admin := func(method, body string) int {
+		r := httptest.NewRequest(method, "/admin/incident", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer admin-token")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+	type statusResp struct {
+		Status   string    `json:"status"`
+		Incident *incident `json:"incident"`
+	}
+	status := func() statusResp {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/1/status", nil))
+		require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+		resp := statusResp{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		return resp
+	}
+
+	require.Equal(t, statusResp{Status: statusOperational}, status())
+
+	require.Equal(t, http.StatusBadRequest, admin(http.MethodPut, `{"message": "slow", "severity": "dire"}`))
+	require.Equal(t, http.StatusBadRequest, admin(http.MethodPut, `{"message": " ", "severity": "info"}`))
+	require.Equal(t, http.StatusOK, admin(http.MethodPut, `{"message": "Delays in message delivery", "severity": "warning"}`))
+	want := &incident{Message: "Delays in message delivery", Severity: "warning", Since: 1600000000}
+	require.Equal(t, statusResp{Status: statusOperational, Incident: want}, status())
+
+	// a dependency that's down degrades the service
+	storageErr = errors.New("bucket is gone")
+	providers.dependencies.probeAll(time.Now)
+	require.Equal(t, statusResp{Status: statusDegraded, Incident: want}, status())
+
+	require.Equal(t, http.StatusOK, admin(http.MethodDelete, ""))
+	require.Nil(t, status().Incident)
+}
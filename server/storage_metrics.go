@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"time"
+
+	"zood.dev/oscar/storemetrics"
+)
+
+// defaultStorageSlowThreshold is how long a storage operation may take before
+// it's logged, unless the config says otherwise
+const defaultStorageSlowThreshold = 200 * time.Millisecond
+
+// newStorageMetrics returns the recorder of the storage latencies, logging
+// the operations slower than slowThreshold
+func newStorageMetrics(slowThreshold time.Duration) *storemetrics.Recorder {
+	return storemetrics.NewRecorder(slowThreshold, logSlowStorageOp)
+}
+
+func logSlowStorageOp(store, op string, elapsed time.Duration, err error) {
+	if !shouldLogWarn() {
+		return
+	}
+	if err != nil {
+		log.Printf("Slow %s storage operation %s took %v and failed: %v", store, op, elapsed, err)
+		return
+	}
+	log.Printf("Slow %s storage operation %s took %v", store, op, elapsed)
+}
+
+// writeStorageMetrics writes the latency histograms and error counts of the
+// storage operations in the prometheus text format
+func writeStorageMetrics(w io.Writer, sm *storemetrics.Recorder) {
+	stats := sm.Snapshot()
+	if len(stats) == 0 {
+		return
+	}
+	seconds := func(d time.Duration) string {
+		return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+	}
+
+	name := "oscar_storage_operation_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s How long the storage operations took.\n# TYPE %s histogram\n", name, name)
+	for _, s := range stats {
+		for i, le := range storemetrics.Buckets {
+			fmt.Fprintf(w, "%s_bucket{store=%q,op=%q,le=%q} %d\n", name, s.Store, s.Op, seconds(le), s.Cumulative[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{store=%q,op=%q,le=\"+Inf\"} %d\n", name, s.Store, s.Op, s.Count)
+		fmt.Fprintf(w, "%s_sum{store=%q,op=%q} %s\n", name, s.Store, s.Op, seconds(s.Sum))
+		fmt.Fprintf(w, "%s_count{store=%q,op=%q} %d\n", name, s.Store, s.Op, s.Count)
+	}
+
+	name = "oscar_storage_operation_errors_total"
+	fmt.Fprintf(w, "# HELP %s How many storage operations failed.\n# TYPE %s counter\n", name, name)
+	for _, s := range stats {
+		fmt.Fprintf(w, "%s{store=%q,op=%q} %d\n", name, s.Store, s.Op, s.Errors)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/storemetrics"
+)
+
+func TestStorageMetrics(t *testing.T) {
+	providers := createTestProviders(t)
+	providers.storageMetrics = newStorageMetrics(defaultStorageSlowThreshold)
+	providers.db = storemetrics.WrapDB(providers.db, providers.storageMetrics)
+	providers.kvs = storemetrics.WrapKV(providers.kvs, providers.storageMetrics)
+
+	_, err := providers.kvs.PickUpPackage([]byte("box"))
+	require.NoError(t, err)
+	_, err = providers.db.User("alice")
+	require.NoError(t, err)
+	providers.storageMetrics.Observe("kv", "DropPackage", 2*time.Second, errors.New("disk full"))
+
+	w := httptest.NewRecorder()
+	providersInjector(providers, metricsHandler)(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	metrics := w.Body.String()
+	for _, line := range []string{
+		"# TYPE oscar_storage_operation_duration_seconds histogram",
+		`oscar_storage_operation_duration_seconds_count{store="kv",op="PickUpPackage"} 1`,
+		`oscar_storage_operation_duration_seconds_count{store="sql",op="User"} 1`,
+		`oscar_storage_operation_duration_seconds_bucket{store="kv",op="DropPackage",le="1"} 0`,
+		`oscar_storage_operation_duration_seconds_bucket{store="kv",op="DropPackage",le="5"} 1`,
+		`oscar_storage_operation_duration_seconds_bucket{store="kv",op="DropPackage",le="+Inf"} 1`,
+		`oscar_storage_operation_duration_seconds_sum{store="kv",op="DropPackage"} 2`,
+		`oscar_storage_operation_errors_total{store="kv",op="DropPackage"} 1`,
+		`oscar_storage_operation_errors_total{store="kv",op="PickUpPackage"} 0`,
+	} {
+		require.True(t, strings.Contains(metrics, line+"\n"), "missing %q in\n%s", line, metrics)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"zood.dev/oscar/filestor"
+)
+
+// storageUsage is how many bytes a user keeps in the file storage
+type storageUsage struct {
+	BackupBytes int64 `json:"backup_bytes"`
+	UsedBytes   int64 `json:"used_bytes"`
+	// QuotaBytes is omitted when there's no quota
+	QuotaBytes int64 `json:"quota_bytes,omitempty"`
+}
+
+// userStorageUsage adds up the sizes of the files userID keeps in fs. The
+// backup is the only one for now. Anything else users come to store, like
+// attachments, has to be counted here too, so it's covered by the quota.
+func userStorageUsage(fs filestor.Provider, userID int64, quota int64) (storageUsage, error) {
+	usage := storageUsage{QuotaBytes: quota}
+	size, err := fs.FileSize(backupPath(userID))
+	switch err {
+	case nil:
+		usage.BackupBytes = size
+	case filestor.ErrFileNotExist:
+	default:
+		return usage, errors.Wrap(err, "sizing the backup")
+	}
+	usage.UsedBytes = usage.BackupBytes
+	return usage, nil
+}
+
+// errQuotaExceeded stops an upload that goes over the quota
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// quotaReader fails with errQuotaExceeded once more than remaining bytes
+// are read, so the write is abandoned and the previous file kept
+type quotaReader struct {
+	r         io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+// allowedBackupSize is how big the backup of userID may be under quota,
+// given the replaced backup no longer counts. -1 means unlimited.
+func allowedBackupSize(fs filestor.Provider, userID int64, quota int64) (int64, error) {
+	if quota == 0 {
+		return -1, nil
+	}
+	usage, err := userStorageUsage(fs, userID, quota)
+	if err != nil {
+		return 0, err
+	}
+	allowed := quota - (usage.UsedBytes - usage.BackupBytes)
+	if allowed < 0 {
+		allowed = 0
+	}
+	return allowed, nil
+}
+
+func (qr *quotaReader) Read(p []byte) (int, error) {
+	// read one byte past the limit, to tell an upload that fits exactly
+	// from one that's too big
+	if int64(len(p)) > qr.remaining+1 {
+		p = p[:qr.remaining+1]
+	}
+	n, err := qr.r.Read(p)
+	qr.remaining -= int64(n)
+	if qr.remaining < 0 {
+		qr.exceeded = true
+		return 0, errQuotaExceeded
+	}
+	return n, err
+}
+
+// storageUsageHandler handles GET /1/users/me/storage
+func storageUsageHandler(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromContext(r.Context())
+	providers := providersCtx(r.Context())
+	usage, err := userStorageUsage(providers.fs, userID, providers.storageQuota)
+	if err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	sendSuccess(w, usage)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/filestor"
+)
+
+func TestQuotaReader(t *testing.T) {
+	qr := &quotaReader{r: bytes.NewReader([]byte("12345")), remaining: 5}
+	data, err := ioutil.ReadAll(qr)
+	require.NoError(t, err)
+	require.Equal(t, "12345", string(data))
+	require.False(t, qr.exceeded)
+
+	qr = &quotaReader{r: bytes.NewReader([]byte("123456")), remaining: 5}
+	_, err = ioutil.ReadAll(qr)
+	require.Equal(t, errQuotaExceeded, err)
+	require.True(t, qr.exceeded)
+}
+
+func TestStorageQuota(t *testing.T) {
+	providers := createTestProviders(t)
+	providers.storageQuota = 1000
+	user, keyPair := createTestUser(t, providers)
+	token := loginTestUser(t, providers, user, keyPair)
+	router := newOscarRouter(providers)
+
+	request := func(method, path string, body io.Reader) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, body)
+		r.Header.Set("X-Oscar-Access-Token", token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	usage := func() storageUsage {
+		w := request(http.MethodGet, "/1/users/me/storage", nil)
+		require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+		var u storageUsage
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &u))
+		return u
+	}
+
+	require.Equal(t, storageUsage{QuotaBytes: 1000}, usage())
+
+	data := bytes.Repeat([]byte("b"), 800)
+	w := request(http.MethodPut, "/1/users/me/backup", bytes.NewReader(data))
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	require.Equal(t, storageUsage{BackupBytes: 800, UsedBytes: 800, QuotaBytes: 1000}, usage())
+
+	// the replaced backup doesn't count, so a backup of the full quota fits
+	data = bytes.Repeat([]byte("c"), 1000)
+	w = request(http.MethodPut, "/1/users/me/backup", bytes.NewReader(data))
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+
+	// rejected by its declared length
+	w = request(http.MethodPut, "/1/users/me/backup", bytes.NewReader(make([]byte, 1001)))
+	require.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	require.Contains(t, w.Body.String(), "quota_exceeded")
+
+	// rejected while streaming, when the length isn't declared
+	w = request(http.MethodPut, "/1/users/me/backup", io.MultiReader(bytes.NewReader(make([]byte, 1001))))
+	require.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	// either way the previous backup is kept
+	stored, err := filestor.ReadAll(providers.fs, backupPath(user.ID))
+	require.NoError(t, err)
+	require.Equal(t, data, stored)
+}
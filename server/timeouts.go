@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"zood.dev/oscar/apierr"
+)
+
+// defaultRouteTimeout bounds requests to routes without their own timeout
+const defaultRouteTimeout = 10 * time.Second
+
+// longLivedRoutes hold the connection open for as long as the client wants,
+// so they're never timed out. Both are websockets, and clear the server's
+// write deadline once they've been hijacked.
+var longLivedRoutes = map[string]bool{
+	"/1/drop-boxes/watch": true,
+	"/1/sockets":          true,
+}
+
+// bulkRoutes move large bodies, in either direction, so they get their own
+// longer timeout unless the config sets one. Their request bodies may take
+// as long as the timeout to read, past the server's read timeout.
+var bulkRoutes = map[string]time.Duration{
+	"/1/users/me/backup": 10 * time.Minute,
+}
+
+// timeoutPolicy holds how long each route may take to produce its response.
+// When the timeout passes, the request context is cancelled, and the client
+// receives a 503 unless the response had already started. A nil policy uses defaultRouteTimeout for every route.
+type timeoutPolicy struct {
+	fallback time.Duration
+	routes   map[string]time.Duration
+}
+
+// newTimeoutPolicy parses the durations in the config. Keys of routes are
+// path templates as registered with the router, e.g. "/1/users/me/backup".
+func newTimeoutPolicy(fallback string, routes map[string]string) (*timeoutPolicy, error) {
+	tp := &timeoutPolicy{fallback: defaultRouteTimeout, routes: map[string]time.Duration{}}
+	if fallback != "" {
+		d, err := time.ParseDuration(fallback)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid request timeout")
+		}
+		if d <= 0 {
+			return nil, errors.New("request timeout must be positive")
+		}
+		tp.fallback = d
+	}
+	for route, val := range routes {
+		if longLivedRoutes[route] {
+			return nil, errors.Errorf("'%s' is long-lived and can't have a timeout", route)
+		}
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid timeout for '%s'", route)
+		}
+		if d <= 0 {
+			return nil, errors.Errorf("timeout for '%s' must be positive", route)
+		}
+		tp.routes[route] = d
+	}
+
+	return tp, nil
+}
+
+// timeout returns the timeout for the route with path template tmpl, or 0
+// if the route is long-lived
+func (tp *timeoutPolicy) timeout(tmpl string) time.Duration {
+	if longLivedRoutes[tmpl] {
+		return 0
+	}
+	if tp != nil {
+		if d, ok := tp.routes[tmpl]; ok {
+			return d
+		}
+	}
+	if d, ok := bulkRoutes[tmpl]; ok {
+		return d
+	}
+	if tp == nil {
+		return defaultRouteTimeout
+	}
+	return tp.fallback
+}
+
+// longest returns the largest timeout of any route
+func (tp *timeoutPolicy) longest() time.Duration {
+	longest := tp.timeout("")
+	for tmpl := range bulkRoutes {
+		if d := tp.timeout(tmpl); d > longest {
+			longest = d
+		}
+	}
+	if tp != nil {
+		for _, d := range tp.routes {
+			if d > longest {
+				longest = d
+			}
+		}
+	}
+	return longest
+}
+
+// timeoutGrace is how long past its timeout a request may take to write its
+// response, so a handler that gave up can still send the error
+const timeoutGrace = 5 * time.Second
+
+var timeoutBody = func() string {
+	buf, _ := json.Marshal(apierr.NewBody(errorRequestTimeout, "the request took too long"))
+	return string(buf)
+}()
+
+// timeoutWriter passes the response through as the handler writes it, so
+// streamed responses reach the client right away. When the request times out
+// before the handler has started its response, the response becomes the
+// timeout error, whatever the handler tries to send.
+type timeoutWriter struct {
+	http.ResponseWriter
+	ctx         context.Context
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	if tw.wroteHeader {
+		return
+	}
+	tw.wroteHeader = true
+	if tw.ctx.Err() == context.DeadlineExceeded {
+		tw.timedOut = true
+		h := tw.ResponseWriter.Header()
+		h.Del("Content-Length")
+		h.Set("Content-Type", "application/json; charset=utf-8")
+		tw.ResponseWriter.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(tw.ResponseWriter, timeoutBody)
+		return
+	}
+	tw.ResponseWriter.WriteHeader(code)
+}
+
+func (tw *timeoutWriter) Write(buf []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	// the handler's own response is dropped without an error, since
+	// sendResponse panics on failed writes
+	if tw.timedOut {
+		return len(buf), nil
+	}
+	return tw.ResponseWriter.Write(buf)
+}
+
+func (tw *timeoutWriter) Flush() {
+	if tw.timedOut {
+		return
+	}
+	if f, ok := tw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// Middleware bounds each request by the timeout of the route it matched. The
+// request context is cancelled when the timeout passes, and the connection's
+// write deadline follows the timeout, so a client that stops reading can't
+// hold the handler either. The long-lived routes are left alone.
+func (tp *timeoutPolicy) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tmpl := ""
+		if route := mux.CurrentRoute(r); route != nil {
+			tmpl, _ = route.GetPathTemplate()
+		}
+		d := tp.timeout(tmpl)
+		if d == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// ResponseWriters that don't support deadlines, like those of
+		// tests, only get the context timeout
+		rc := http.NewResponseController(w)
+		rc.SetWriteDeadline(time.Now().Add(d + timeoutGrace))
+		if _, ok := bulkRoutes[tmpl]; ok {
+			rc.SetReadDeadline(time.Now().Add(d))
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		tw := &timeoutWriter{ResponseWriter: w, ctx: ctx}
+		next.ServeHTTP(tw, r.WithContext(ctx))
+		if !tw.wroteHeader && ctx.Err() == context.DeadlineExceeded {
+			tw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeoutPolicy(t *testing.T) {
+	tp, err := newTimeoutPolicy("5s", map[string]string{"/1/users/me/backup": "1m"})
+	require.NoError(t, err)
+	require.Equal(t, 5*time.Second, tp.timeout("/1/messages"))
+	require.Equal(t, time.Minute, tp.timeout("/1/users/me/backup"))
+	require.Equal(t, time.Duration(0), tp.timeout("/1/sockets"))
+	require.Equal(t, time.Minute, tp.longest())
+
+	// the bulk routes have a longer timeout of their own
+	tp, err = newTimeoutPolicy("5s", nil)
+	require.NoError(t, err)
+	require.Equal(t, bulkRoutes["/1/users/me/backup"], tp.timeout("/1/users/me/backup"))
+	require.Equal(t, bulkRoutes["/1/users/me/backup"], tp.longest())
+
+	var fallback *timeoutPolicy
+	require.Equal(t, defaultRouteTimeout, fallback.timeout("/1/messages"))
+	require.Equal(t, bulkRoutes["/1/users/me/backup"], fallback.timeout("/1/users/me/backup"))
+	require.Equal(t, time.Duration(0), fallback.timeout("/1/drop-boxes/watch"))
+
+	_, err = newTimeoutPolicy("soon", nil)
+	require.Error(t, err)
+	_, err = newTimeoutPolicy("", map[string]string{"/1/messages": "-1s"})
+	require.Error(t, err)
+	_, err = newTimeoutPolicy("", map[string]string{"/1/sockets": "1m"})
+	require.Error(t, err)
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	tp, err := newTimeoutPolicy("20ms", nil)
+	require.NoError(t, err)
+
+	cancelled := make(chan bool, 1)
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			cancelled <- true
+		case <-time.After(time.Second):
+			cancelled <- false
+		}
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/1/messages", slow)
+	r.HandleFunc("/1/users/me", func(w http.ResponseWriter, r *http.Request) {
+		// a handler that gives up on the cancelled context still sends
+		// the timeout
+		<-r.Context().Done()
+		sendInternalErr(w, nil)
+	})
+	release := make(chan struct{})
+	r.HandleFunc("/1/drop-boxes/{box_id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("second"))
+	})
+	r.HandleFunc("/1/sockets", func(w http.ResponseWriter, r *http.Request) {
+		// the long-lived routes must still be able to hijack the connection
+		_, ok := w.(http.Hijacker)
+		require.True(t, ok)
+		sendSuccess(w, nil)
+	})
+	r.Use(tp.Middleware)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/1/messages", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.True(t, <-cancelled)
+	errResp := struct {
+		Code ErrCode `json:"error_code"`
+	}{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &errResp))
+	require.Equal(t, errorRequestTimeout, errResp.Code)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/1/users/me", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/1/sockets")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// responses aren't buffered, so the client sees what's flushed before
+	// the handler returns
+	resp, err = http.Get(srv.URL + "/1/drop-boxes/box")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	buf := make([]byte, len("first"))
+	_, err = io.ReadFull(resp.Body, buf)
+	require.NoError(t, err)
+	require.Equal(t, "first", string(buf))
+	close(release)
+	rest, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "second", string(rest))
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// onionAddress is set when the server is published as a Tor onion service
+var onionAddress string
+
+// torController speaks the Tor control protocol
+// (https://gitweb.torproject.org/torspec.git/tree/control-spec.txt), just
+// enough to publish an onion service. Tor removes the service once the
+// control connection is closed, so the controller lives as long as the server.
+type torController struct {
+	conn net.Conn
+	text *textproto.Conn
+}
+
+func dialTorController(address string) (*torController, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to connect to tor control port")
+	}
+	return &torController{
+		conn: conn,
+		text: textproto.NewConn(conn),
+	}, nil
+}
+
+// command sends cmd and returns the lines of a successful (250) reply
+func (tc *torController) command(cmd string) ([]string, error) {
+	if err := tc.text.PrintfLine("%s", cmd); err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for {
+		line, err := tc.text.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) < 4 {
+			return nil, errors.Errorf("malformed reply from tor: %q", line)
+		}
+		if line[:3] != "250" {
+			return nil, errors.Errorf("tor command failed: %s", line)
+		}
+		lines = append(lines, line[4:])
+		// a space after the status code marks the final line of the reply
+		if line[3] == ' ' {
+			return lines, nil
+		}
+	}
+}
+
+// authenticate uses the cookie file if one is given, then the password, and
+// finally no credentials at all
+func (tc *torController) authenticate(password, cookiePath string) error {
+	cmd := "AUTHENTICATE"
+	if cookiePath != "" {
+		cookie, err := ioutil.ReadFile(cookiePath)
+		if err != nil {
+			return errors.Wrap(err, "unable to read tor auth cookie")
+		}
+		cmd += " " + hex.EncodeToString(cookie)
+	} else if password != "" {
+		cmd += fmt.Sprintf(" %q", password)
+	}
+
+	_, err := tc.command(cmd)
+	return err
+}
+
+// addOnion publishes a service that forwards virtualPort to target. The
+// service key is read from keyPath, or generated and saved there if the file
+// doesn't exist yet, so the onion address stays the same across restarts.
+func (tc *torController) addOnion(keyPath string, virtualPort int, target string) (string, error) {
+	key := "NEW:ED25519-V3"
+	buf, err := ioutil.ReadFile(keyPath)
+	switch {
+	case err == nil:
+		key = strings.TrimSpace(string(buf))
+	case os.IsNotExist(err):
+	default:
+		return "", errors.Wrap(err, "unable to read onion service key")
+	}
+
+	lines, err := tc.command(fmt.Sprintf("ADD_ONION %s Port=%d,%s", key, virtualPort, target))
+	if err != nil {
+		return "", err
+	}
+
+	var serviceID, privateKey string
+	for _, l := range lines {
+		if strings.HasPrefix(l, "ServiceID=") {
+			serviceID = strings.TrimPrefix(l, "ServiceID=")
+		} else if strings.HasPrefix(l, "PrivateKey=") {
+			privateKey = strings.TrimPrefix(l, "PrivateKey=")
+		}
+	}
+	if serviceID == "" {
+		return "", errors.New("tor didn't return an onion service id")
+	}
+	if privateKey != "" {
+		if err = ioutil.WriteFile(keyPath, []byte(privateKey+"\n"), 0600); err != nil {
+			return "", errors.Wrap(err, "unable to save onion service key")
+		}
+	}
+
+	return serviceID + ".onion", nil
+}
+
+func (tc *torController) Close() error {
+	return tc.conn.Close()
+}
+
+// publishOnionService connects to tor and publishes the service described by
+// cfg. The returned controller must be kept open for the service to stay up.
+func publishOnionService(cfg *torConfig) (*torController, string, error) {
+	tc, err := dialTorController(cfg.ControlAddress)
+	if err != nil {
+		return nil, "", err
+	}
+	if err = tc.authenticate(cfg.ControlPassword, cfg.CookiePath); err != nil {
+		tc.Close()
+		return nil, "", err
+	}
+	addr, err := tc.addOnion(cfg.KeyPath, 80, cfg.ListenAddress)
+	if err != nil {
+		tc.Close()
+		return nil, "", err
+	}
+
+	return tc, addr, nil
+}
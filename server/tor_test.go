@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTorControl accepts one control connection, records the commands it
+// receives and answers them like tor would
+func fakeTorControl(t *testing.T) (string, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	cmds := make(chan string, 10)
+
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rdr := bufio.NewReader(conn)
+		for {
+			line, err := rdr.ReadString('\n')
+			if err != nil {
+				close(cmds)
+				return
+			}
+			line = strings.TrimSpace(line)
+			cmds <- line
+			switch {
+			case strings.HasPrefix(line, "AUTHENTICATE"):
+				conn.Write([]byte("250 OK\r\n"))
+			case strings.HasPrefix(line, "ADD_ONION NEW:"):
+				conn.Write([]byte("250-ServiceID=abcdefghijklmnop\r\n250-PrivateKey=ED25519-V3:c2VjcmV0\r\n250 OK\r\n"))
+			case strings.HasPrefix(line, "ADD_ONION"):
+				conn.Write([]byte("250-ServiceID=abcdefghijklmnop\r\n250 OK\r\n"))
+			default:
+				conn.Write([]byte("510 Unrecognized command\r\n"))
+			}
+		}
+	}()
+
+	return l.Addr().String(), cmds
+}
+
+func TestPublishOnionService(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oscar-tor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	keyPath := filepath.Join(dir, "onion.key")
+
+	addr, cmds := fakeTorControl(t)
+	tc, onion, err := publishOnionService(&torConfig{
+		ControlAddress:  addr,
+		ControlPassword: "hunter2",
+		KeyPath:         keyPath,
+		ListenAddress:   "127.0.0.1:8081",
+	})
+	require.NoError(t, err)
+	defer tc.Close()
+
+	require.Equal(t, "abcdefghijklmnop.onion", onion)
+	require.Equal(t, `AUTHENTICATE "hunter2"`, <-cmds)
+	require.Equal(t, "ADD_ONION NEW:ED25519-V3 Port=80,127.0.0.1:8081", <-cmds)
+
+	// the generated key is saved, so it's reused on the next start
+	key, err := ioutil.ReadFile(keyPath)
+	require.NoError(t, err)
+	require.Equal(t, "ED25519-V3:c2VjcmV0\n", string(key))
+
+	_, err = tc.command("BOGUS")
+	require.Error(t, err)
+}
@@ -1,19 +1,25 @@
 package main
 
 import (
-	"bytes"
-	"io/ioutil"
+	"io"
 	"log"
 	"net/http"
 	"path/filepath"
 	"strconv"
 
+	"github.com/pkg/errors"
 	"zood.dev/oscar/filestor"
 )
 
 // const userDBsBucketName = "db_backups"
 const dbBackupsDir = "db_backups"
 
+// backupPath is where the backup of userID is stored. Each user has a
+// single backup, which is replaced by each upload.
+func backupPath(userID int64) string {
+	return filepath.Join(dbBackupsDir, strconv.FormatInt(userID, 10)+".db")
+}
+
 func retrieveBackupHandler(w http.ResponseWriter, r *http.Request) {
 	userID := userIDFromContext(r.Context())
 	providers := providersCtx(r.Context())
@@ -22,18 +28,24 @@ func retrieveBackupHandler(w http.ResponseWriter, r *http.Request) {
 		log.Printf("download_backup: %s", db.Username(userID))
 	}
 
-	relPath := filepath.Join(dbBackupsDir, strconv.FormatInt(userID, 10)+".db")
+	relPath := backupPath(userID)
 	fs := providers.fs
-	err := fs.ReadFile(relPath, w)
+	rc, err := fs.ReadFile(relPath)
 	if err != nil {
 		if err == filestor.ErrFileNotExist {
 			sendNotFound(w, "no backup found", errorBackupNotFound)
 			return
 		}
-		// this might not be the best response, but let's try it out
 		sendInternalErr(w, err)
 		return
 	}
+	defer rc.Close()
+
+	// the status has been sent once the copy starts, so a failure can only
+	// be logged. The client sees a truncated body.
+	if _, err = io.Copy(w, rc); err != nil {
+		logErr(errors.Wrap(err, "streaming backup"))
+	}
 }
 
 func saveBackupHandler(w http.ResponseWriter, r *http.Request) {
@@ -44,19 +56,63 @@ func saveBackupHandler(w http.ResponseWriter, r *http.Request) {
 		log.Printf("backup: %s", db.Username(userID))
 	}
 
-	buf, err := ioutil.ReadAll(r.Body)
+	// the body is streamed into storage. If the upload breaks off, the
+	// previous backup is kept.
+	relPath := backupPath(userID)
+	fs := providers.fs
+	// replacing a backup is reported to the user, in case someone else did it
+	_, err := fs.FileSize(relPath)
+	if err != nil && err != filestor.ErrFileNotExist {
+		sendInternalErr(w, err)
+		return
+	}
+	replaced := err == nil
+	allowed, err := allowedBackupSize(fs, userID, providers.storageQuota)
 	if err != nil {
-		sendBadReq(w, "Unable to read PUT body: "+err.Error())
+		sendInternalErr(w, err)
+		return
+	}
+	if allowed >= 0 && r.ContentLength > allowed {
+		sendErr(w, "The backup would exceed your storage quota", http.StatusRequestEntityTooLarge, errorQuotaExceeded)
+		return
+	}
+	body := &bodyReader{r: r.Body}
+	var upload io.Reader = body
+	// the length may be unknown up front, so the stream is capped too
+	quota := &quotaReader{r: body, remaining: allowed}
+	if allowed >= 0 {
+		upload = quota
+	}
+	err = fs.WriteFile(relPath, upload)
+	if quota.exceeded {
+		sendErr(w, "The backup would exceed your storage quota", http.StatusRequestEntityTooLarge, errorQuotaExceeded)
+		return
+	}
+	if body.err != nil {
+		sendBadReq(w, "Unable to read PUT body: "+body.err.Error())
 		return
 	}
-
-	relPath := filepath.Join(dbBackupsDir, strconv.FormatInt(userID, 10)+".db")
-	rdr := bytes.NewReader(buf)
-	fs := providers.fs
-	err = fs.WriteFile(relPath, rdr)
 	if err != nil {
 		sendInternalErr(w, err)
 		return
 	}
+	if replaced {
+		providers.events.emit(accountEvent{Kind: eventBackupReplaced, Actor: actorUser, UserID: userID})
+	}
 	sendSuccess(w, nil)
 }
+
+// bodyReader remembers the error reading the request body, so it can be
+// told apart from a failure of the storage it's streamed into
+type bodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (br *bodyReader) Read(p []byte) (int, error) {
+	n, err := br.r.Read(p)
+	if err != nil && err != io.EOF {
+		br.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/filestor"
+)
+
+// brokenBody returns its data, and then fails like a dropped connection
+type brokenBody struct {
+	data []byte
+}
+
+func (bb *brokenBody) Read(p []byte) (int, error) {
+	if len(bb.data) == 0 {
+		return 0, errors.New("connection reset")
+	}
+	n := copy(p, bb.data)
+	bb.data = bb.data[n:]
+	return n, nil
+}
+
+func TestBackupHandlers(t *testing.T) {
+	providers := createTestProviders(t)
+	user, keyPair := createTestUser(t, providers)
+	token := loginTestUser(t, providers, user, keyPair)
+	router := newOscarRouter(providers)
+
+	backup := func(method string, body io.Reader) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/1/users/me/backup", body)
+		r.Header.Set("X-Oscar-Access-Token", token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	require.Equal(t, http.StatusNotFound, backup(http.MethodGet, nil).Code)
+
+	data := bytes.Repeat([]byte("backup"), 50000)
+	w := backup(http.MethodPut, bytes.NewReader(data))
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	w = backup(http.MethodGet, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, data, w.Body.Bytes())
+
+	// an upload that breaks off leaves the previous backup alone
+	w = backup(http.MethodPut, &brokenBody{data: []byte("partial")})
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	stored, err := filestor.ReadAll(providers.fs, backupPath(user.ID))
+	require.NoError(t, err)
+	require.Equal(t, data, stored)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"zood.dev/oscar/apierr"
+	"zood.dev/oscar/encodable"
+)
+
+// maxImportedUsersPerRequest bounds the users provisioned by one request
+const maxImportedUsersPerRequest = 500
+
+// importedUser is the outcome of provisioning one user. Exactly one of ID and
+// Error is set.
+type importedUser struct {
+	Username string          `json:"username"`
+	ID       encodable.Bytes `json:"id,omitempty"`
+	Error    *apierr.Body    `json:"error,omitempty"`
+}
+
+// importUsersHandler handles POST /admin/users/import. It creates accounts
+// from the usernames, public keys, wrapped keys and password hash
+// parameters exported from another instance, so users can sign in with
+// their existing password. Each user is validated like a sign up, and
+// created independently, so one bad row doesn't fail the rest. The users
+// get new public ids, which are reported with the outcome of each row.
+func importUsersHandler(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Users []User `json:"users"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendBadReq(w, "Unable to parse POST body: "+err.Error())
+		return
+	}
+	if len(body.Users) == 0 || len(body.Users) > maxImportedUsersPerRequest {
+		sendBadReq(w, fmt.Sprintf("between 1 and %d users can be imported at once", maxImportedUsersPerRequest))
+		return
+	}
+
+	providers := providersCtx(r.Context())
+	results := make([]importedUser, 0, len(body.Users))
+	created := 0
+	for _, user := range body.Users {
+		result := importedUser{Username: user.Username}
+		user.Locale = negotiateLocale(user.Locale, "")
+		pubID, sErr := createUser(providers.db, providers.kvs, providers.emailer, providers.emailTemplates, providers.random(), providers.usernameIndexSalt, user)
+		if sErr != nil {
+			errBody := apierr.NewBody(sErr.code, sErr.message)
+			result.Error = &errBody
+			results = append(results, result)
+			continue
+		}
+		result.ID = pubID
+		results = append(results, result)
+		created++
+		if userID, err := providers.kvs.UserIDFromPublicID(pubID); err != nil {
+			logErr(err)
+		} else {
+			providers.events.emit(accountEvent{Kind: eventUserCreated, Actor: actorAdmin, UserID: userID, Details: "imported"})
+		}
+	}
+
+	sendSuccess(w, struct {
+		Created int            `json:"created"`
+		Failed  int            `json:"failed"`
+		Users   []importedUser `json:"users"`
+	}{Created: created, Failed: len(body.Users) - created, Users: results})
+}
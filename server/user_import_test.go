@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/sodium"
+)
+
+func TestImportUsers(t *testing.T) {
+	providers := createTestProviders(t)
+	providers.adminToken = "admin-token"
+	router := newOscarRouter(providers)
+	existing, _ := createTestUser(t, providers)
+
+	exported := func(username string) User {
+		kp, err := sodium.NewKeyPair()
+		require.NoError(t, err)
+		return User{
+			Username:                    username,
+			PasswordHashAlgorithm:       sodium.Argon2id13.Name,
+			PasswordHashMemoryLimit:     sodium.Argon2id13.MemLimitInteractive,
+			PasswordHashOperationsLimit: sodium.Argon2id13.OpsLimitInteractive,
+			PasswordSalt:                []byte("password salt"),
+			PublicKey:                   kp.Public,
+			WrappedSecretKey:            []byte("wrapped-secret-key"),
+			WrappedSecretKeyNonce:       []byte("wrapped-secret-key-nonce"),
+			WrappedSymmetricKey:         []byte("wrapped-symmetric-key"),
+			WrappedSymmetricKeyNonce:    []byte("wrapped-symmetric-key-nonce"),
+		}
+	}
+	badKey := exported("badkey1")
+	badKey.PublicKey = []byte("too short")
+	users := []User{exported("imported1"), badKey, exported(existing.Username), exported("imported2")}
+	importUsers := func(users []User) *httptest.ResponseRecorder {
+		buf, err := json.Marshal(struct {
+			Users []User `json:"users"`
+		}{Users: users})
+		require.NoError(t, err)
+		r := httptest.NewRequest(http.MethodPost, "/admin/users/import", bytes.NewReader(buf))
+		r.Header.Set("Authorization", "Bearer admin-token")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	require.Equal(t, http.StatusBadRequest, importUsers(nil).Code)
+	w := importUsers(users)
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	resp := struct {
+		Created int            `json:"created"`
+		Failed  int            `json:"failed"`
+		Users   []importedUser `json:"users"`
+	}{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	require.Equal(t, 2, resp.Created)
+	require.Equal(t, 2, resp.Failed)
+	require.Len(t, resp.Users, 4)
+
+	// every row is reported, in order
+	require.Nil(t, resp.Users[0].Error)
+	require.Equal(t, errorInvalidPublicKey, resp.Users[1].Error.Code)
+	require.Empty(t, resp.Users[1].ID)
+	require.Equal(t, errorUsernameNotAvailable, resp.Users[2].Error.Code)
+	require.Nil(t, resp.Users[3].Error)
+
+	// the imported users keep their keys, under their new public ids
+	userID, err := providers.kvs.UserIDFromPublicID(resp.Users[3].ID)
+	require.NoError(t, err)
+	pubKey, err := providers.db.UserPublicKey(userID)
+	require.NoError(t, err)
+	require.Equal(t, []byte(users[3].PublicKey), pubKey)
+	user, err := providers.db.User("imported2")
+	require.NoError(t, err)
+	require.Equal(t, []byte("password salt"), user.PasswordSalt)
+}
@@ -1,13 +1,14 @@
 package main
 
 import (
-	crand "crypto/rand"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"regexp"
 	"strings"
+	"time"
 
 	"zood.dev/oscar/base62"
 	"zood.dev/oscar/encodable"
@@ -15,6 +16,7 @@ import (
 	"zood.dev/oscar/model"
 	"zood.dev/oscar/smtp"
 	"zood.dev/oscar/sodium"
+	"zood.dev/oscar/usercache"
 
 	"github.com/gorilla/mux"
 )
@@ -38,6 +40,13 @@ type User struct {
 	WrappedSymmetricKey         encodable.Bytes `json:"wrapped_symmetric_key,omitempty" db:"wrapped_symmetric_key"`
 	WrappedSymmetricKeyNonce    encodable.Bytes `json:"wrapped_symmetric_key_nonce,omitempty" db:"wrapped_symmetric_key_nonce"`
 	Email                       string          `json:"email" db:"email"`
+	// Locale is the language emails to the user are written in. When it's
+	// not provided at registration, it's taken from Accept-Language.
+	Locale string `json:"locale,omitempty" db:"locale"`
+	// UndeliverableEmail is the address that was removed from the account
+	// after bouncing or drawing a complaint. Like Email, it's only shown
+	// to the user.
+	UndeliverableEmail string `json:"undeliverable_email,omitempty"`
 }
 
 func parseUserID(w http.ResponseWriter, r *http.Request) (int64, bool) {
@@ -73,9 +82,11 @@ func createUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	user.Locale = negotiateLocale(user.Locale, r.Header.Get("Accept-Language"))
+
 	ctx := r.Context()
 	providers := providersCtx(ctx)
-	pubID, sErr := createUser(providers.db, providers.kvs, providers.emailer, user)
+	pubID, sErr := createUser(providers.db, providers.kvs, providers.emailer, providers.emailTemplates, providers.random(), providers.usernameIndexSalt, user)
 	if sErr != nil {
 		if sErr.code == errorInternal {
 			sendInternalErr(w, err)
@@ -84,13 +95,20 @@ func createUserHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	if userID, err := providers.kvs.UserIDFromPublicID(pubID); err != nil {
+		logErr(err)
+	} else {
+		providers.events.emit(accountEvent{Kind: eventUserCreated, Actor: actorUser, UserID: userID})
+	}
 
 	sendSuccess(w, struct {
 		ID encodable.Bytes `json:"id"`
 	}{ID: pubID})
 }
 
-func createUser(db model.Provider, kvs kvstor.Provider, emailer smtp.SendEmailer, user User) ([]byte, *serverError) {
+// createUser validates and stores a new user. When indexSalt is not nil, the
+// blind index of the username is stored too.
+func createUser(db model.Provider, kvs kvstor.Provider, emailer smtp.SendEmailer, templates *emailTemplates, rand io.Reader, indexSalt []byte, user User) ([]byte, *serverError) {
 	user.Username = strings.ToLower(strings.TrimSpace(user.Username))
 	if user.Username == "" {
 		return nil, &serverError{code: errorInvalidUsername, message: "Username can not be empty"}
@@ -141,27 +159,16 @@ func createUser(db model.Provider, kvs kvstor.Provider, emailer smtp.SendEmailer
 	user.Email = strings.TrimSpace(strings.ToLower(user.Email))
 	var emailVerificationToken *string
 	if user.Email != "" {
-		if len(user.Email) > 254 {
-			return nil, &serverError{code: errorInvalidEmail, message: "Email address is too long"}
-		}
-		parts := strings.Split(user.Email, "@")
-		if len(parts) != 2 {
-			return nil, &serverError{code: errorInvalidEmail, message: "Email address doesn't have a user and domain separated by an '@'"}
-		}
-		if parts[0] == "" {
-			return nil, &serverError{code: errorInvalidEmail, message: "Invalid local component in email"}
-		}
-		domainParts := strings.Split(parts[1], ".")
-		if len(domainParts) < 2 {
-			return nil, &serverError{code: errorInvalidEmail, message: "Invalid domain in email address"}
-		}
-		tld := domainParts[len(domainParts)-1]
-		if len(tld) < 2 {
-			return nil, &serverError{code: errorInvalidEmail, message: "Invalid tld in domain"}
+		if sErr := validateEmail(user.Email); sErr != nil {
+			return nil, sErr
 		}
 
 		// everything looks good, so let's generate a verification token
-		token := base62.Rand(16)
+		token, err := base62.RandFrom(rand, 16)
+		if err != nil {
+			logErr(err)
+			return nil, newInternalErr()
+		}
 		emailVerificationToken = &token
 	}
 
@@ -174,6 +181,16 @@ func createUser(db model.Provider, kvs kvstor.Provider, emailer smtp.SendEmailer
 	if !available {
 		return nil, &serverError{code: errorUsernameNotAvailable, message: "That username is already in use"}
 	}
+	// reserved usernames can only be taken with the email they're reserved
+	// for. They look taken to everyone else, so reservations aren't revealed.
+	reservation, err := db.ReservedUsername(user.Username)
+	if err != nil {
+		logErr(err)
+		return nil, newInternalErr()
+	}
+	if reservation != nil && (reservation.Email == "" || reservation.Email != user.Email) {
+		return nil, &serverError{code: errorUsernameNotAvailable, message: "That username is already in use"}
+	}
 
 	userRec := model.UserRecord{
 		Username:                    user.Username,
@@ -187,19 +204,31 @@ func createUser(db model.Provider, kvs kvstor.Provider, emailer smtp.SendEmailer
 		WrappedSymmetricKey:         user.WrappedSymmetricKey,
 		WrappedSymmetricKeyNonce:    user.WrappedSymmetricKeyNonce,
 		Email:                       &user.Email,
+		Locale:                      user.Locale,
+		CreatedAt:                   time.Now().Unix(),
+	}
+	if indexSalt != nil {
+		userRec.UsernameIndex = usernameIndex(indexSalt, user.Username)
 	}
 	id, err := db.InsertUser(userRec, emailVerificationToken)
 	if err != nil {
 		logErr(err)
 		return nil, newInternalErr()
 	}
+	invalidateCachedUser(db, id)
+	if reservation != nil {
+		// the reservation has been claimed
+		if _, err = db.DeleteReservedUsername(user.Username); err != nil {
+			logErr(err)
+		}
+	}
 
 	// create an id for public use
 	pubID := make([]byte, publicUserIDSize)
 	idExists := true
 
 	for idExists {
-		_, err = crand.Read(pubID)
+		_, err = io.ReadFull(rand, pubID)
 		if err != nil {
 			logErr(err)
 			return nil, newInternalErr()
@@ -226,7 +255,7 @@ func createUser(db model.Provider, kvs kvstor.Provider, emailer smtp.SendEmailer
 
 	if emailVerificationToken != nil {
 		go func() {
-			err = sendVerificationEmail(*emailVerificationToken, user.Email, emailer)
+			err := sendVerificationEmail(templates, user.Locale, *emailVerificationToken, user.Email, emailer)
 			if err != nil {
 				logErr(err)
 			}
@@ -255,7 +284,7 @@ func getUserPublicKeyHandler(w http.ResponseWriter, r *http.Request) {
 		PublicKey encodable.Bytes `json:"public_key"`
 	}{PublicKey: pubKey}
 
-	sendSuccess(w, resp)
+	sendCacheable(w, r, resp, 5*time.Minute)
 }
 
 // searchUsersHandler handles GET /users
@@ -305,6 +334,78 @@ func getUserInfoHandler(w http.ResponseWriter, r *http.Request) {
 		Username:  username,
 		PublicKey: pubKey,
 	}
+	// users looking themselves up also learn whether email reaches them
+	if userID == userIDFromContext(r.Context()) {
+		rec, err := db.User(username)
+		if err != nil {
+			sendInternalErr(w, err)
+			return
+		}
+		if rec.Email != nil {
+			user.Email = *rec.Email
+		}
+		if rec.UndeliverableEmail != nil {
+			user.UndeliverableEmail = *rec.UndeliverableEmail
+		}
+	}
 
 	sendSuccess(w, user)
 }
+
+// validateEmail checks that email, which has been lowercased and trimmed,
+// looks like an address that can be emailed
+func validateEmail(email string) *serverError {
+	if len(email) > 254 {
+		return &serverError{code: errorInvalidEmail, message: "Email address is too long"}
+	}
+	parts := strings.Split(email, "@")
+	if len(parts) != 2 {
+		return &serverError{code: errorInvalidEmail, message: "Email address doesn't have a user and domain separated by an '@'"}
+	}
+	if parts[0] == "" {
+		return &serverError{code: errorInvalidEmail, message: "Invalid local component in email"}
+	}
+	domainParts := strings.Split(parts[1], ".")
+	if len(domainParts) < 2 {
+		return &serverError{code: errorInvalidEmail, message: "Invalid domain in email address"}
+	}
+	tld := domainParts[len(domainParts)-1]
+	if len(tld) < 2 {
+		return &serverError{code: errorInvalidEmail, message: "Invalid tld in domain"}
+	}
+	return nil
+}
+
+// setLocaleHandler handles PUT /users/me/locale
+func setLocaleHandler(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Locale string `json:"locale"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendBadReq(w, "Unable to parse PUT body: "+err.Error())
+		return
+	}
+	locale := normalizeLocale(body.Locale)
+	if body.Locale != "" && locale == "" {
+		sendBadReq(w, "Invalid locale")
+		return
+	}
+
+	userID := userIDFromContext(r.Context())
+	db := providersCtx(r.Context()).db
+	if err := db.SetUserLocale(userID, locale); err != nil {
+		sendInternalErr(w, err)
+		return
+	}
+	invalidateCachedUser(db, userID)
+
+	sendSuccess(w, nil)
+}
+
+// invalidateCachedUser drops what the user cache holds about userID, once
+// the user's record was written to. It does nothing when db isn't cached.
+func invalidateCachedUser(db model.Provider, userID int64) {
+	if uc, ok := db.(*usercache.Provider); ok {
+		uc.InvalidateUser(userID)
+	}
+}
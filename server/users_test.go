@@ -3,21 +3,25 @@ package main
 import (
 	"bytes"
 	"context"
+	crand "crypto/rand"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
 	"zood.dev/oscar/base62"
-	"zood.dev/oscar/boltdb"
 	"zood.dev/oscar/encodable"
+	"zood.dev/oscar/memkv"
 	"zood.dev/oscar/smtp"
 	"zood.dev/oscar/sodium"
 	"zood.dev/oscar/sqlite"
+	"zood.dev/oscar/usercache"
 )
 
 func createTestUser(t *testing.T, providers *serverProviders) (user User, keyPair sodium.KeyPair) {
@@ -45,7 +49,7 @@ func createTestUser(t *testing.T, providers *serverProviders) (user User, keyPai
 		WrappedSymmetricKey:         []byte("wrapped-symmetric-key"),
 		WrappedSymmetricKeyNonce:    []byte("wrapped-symmetric-key-nonce"),
 	}
-	pubID, sErr := createUser(providers.db, providers.kvs, smtp.NewMockSendEmailer(), user)
+	pubID, sErr := createUser(providers.db, providers.kvs, smtp.NewMockSendEmailer(), nil, providers.random(), providers.usernameIndexSalt, user)
 	require.Nil(t, sErr)
 
 	user.PublicID = pubID
@@ -56,8 +60,8 @@ func createTestUser(t *testing.T, providers *serverProviders) (user User, keyPai
 }
 
 func TestCreateUserNoEmail(t *testing.T) {
-	db, _ := sqlite.New(sqlite.InMemoryDSN)
-	kvs := boltdb.Temp(t)
+	db, _ := sqlite.New(sqlite.InMemoryDSN, sqlite.Options{})
+	kvs := memkv.New()
 
 	user := User{Username: "Arash"}
 	salt := make([]byte, sodium.PasswordStretchingSaltSize)
@@ -76,7 +80,7 @@ func TestCreateUserNoEmail(t *testing.T) {
 
 	emailer := smtp.NewMockSendEmailer()
 
-	pubID, serr := createUser(db, kvs, emailer, user)
+	pubID, serr := createUser(db, kvs, emailer, nil, crand.Reader, nil, user)
 	if serr != nil {
 		t.Fatal(serr)
 	}
@@ -106,8 +110,8 @@ func TestCreateUserNoEmail(t *testing.T) {
 }
 
 func TestCreateUserWithEmail(t *testing.T) {
-	db, _ := sqlite.New(sqlite.InMemoryDSN)
-	kvs := boltdb.Temp(t)
+	db, _ := sqlite.New(sqlite.InMemoryDSN, sqlite.Options{})
+	kvs := memkv.New()
 
 	user := User{
 		Username: "Arash",
@@ -129,7 +133,7 @@ func TestCreateUserWithEmail(t *testing.T) {
 
 	emailer := smtp.NewMockSendEmailer()
 
-	pubID, serr := createUser(db, kvs, emailer, user)
+	pubID, serr := createUser(db, kvs, emailer, nil, crand.Reader, nil, user)
 	if serr != nil {
 		t.Fatal(serr)
 	}
@@ -215,3 +219,120 @@ func TestCreateUserHandler(t *testing.T) {
 		t.Fatalf("user id mismatch: %d != %d", arash.ID, uid)
 	}
 }
+
+func TestSearchUsersByIndexHandler(t *testing.T) {
+	providers := createTestProviders(t)
+	providers.usernameIndexSalt = []byte("0123456789abcdef")
+	user, _ := createTestUser(t, providers)
+
+	search := func(hash []byte) *httptest.ResponseRecorder {
+		target := "/?username_hash=" + url.QueryEscape(base64.StdEncoding.EncodeToString(hash))
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r = r.WithContext(context.WithValue(r.Context(), contextServerProvidersKey, providers))
+		w := httptest.NewRecorder()
+		searchUsersByIndexHandler(w, r)
+		return w
+	}
+
+	w := search(usernameIndex(providers.usernameIndexSalt, " "+strings.ToUpper(user.Username)))
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	found := User{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&found))
+	require.Equal(t, user.Username, found.Username)
+	require.Equal(t, user.PublicID, found.PublicID)
+
+	w = search(usernameIndex(providers.usernameIndexSalt, "nobody"))
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	// users created without an index are found after the backfill
+	providers.db.SetUsernameIndex(user.ID, nil)
+	w = search(usernameIndex(providers.usernameIndexSalt, user.Username))
+	require.Equal(t, http.StatusNotFound, w.Code)
+	require.NoError(t, backfillUsernameIndexes(providers.db, providers.usernameIndexSalt))
+	w = search(usernameIndex(providers.usernameIndexSalt, user.Username))
+	require.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestChangeEmail(t *testing.T) {
+	providers := createTestProviders(t)
+	emailer := smtp.NewMockSendEmailer()
+	providers.emailer = emailer
+	user, keyPair := createTestUser(t, providers)
+	require.NoError(t, providers.db.VerifyEmail("alice@example.com", user.ID))
+	accessToken := loginTestUser(t, providers, user, keyPair)
+	router := newOscarRouter(providers)
+
+	do := func(method, target string, body interface{}) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		r := httptest.NewRequest(method, target, bytes.NewReader(data))
+		r.Header.Set("X-Oscar-Access-Token", accessToken)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	currentEmail := func() string {
+		rec, err := providers.db.User(user.Username)
+		require.NoError(t, err)
+		require.NotNil(t, rec.Email)
+		return *rec.Email
+	}
+
+	w := do(http.MethodPost, "/1/users/me/email", map[string]string{"email": "not-an-email"})
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	w = do(http.MethodPost, "/1/users/me/email", map[string]string{"email": "Alice@example.com"})
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = do(http.MethodPost, "/1/users/me/email", map[string]string{"email": " Alice@Example.org"})
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	require.Equal(t, "alice@example.org", emailer.To)
+	// the current address stays until the new one is verified
+	require.Equal(t, "alice@example.com", currentEmail())
+
+	idx := strings.Index(emailer.Text, "?t=")
+	require.True(t, idx >= 0, "no verification link in: %s", emailer.Text)
+	token := strings.Fields(emailer.Text[idx+3:])[0]
+	w = do(http.MethodPost, "/1/email-verifications", map[string]string{"token": token})
+	require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	require.Equal(t, "alice@example.org", currentEmail())
+}
+
+func TestUserWritesInvalidateCache(t *testing.T) {
+	providers := createTestProviders(t)
+	cache := usercache.New(providers.db, time.Hour, 100)
+	providers.db = cache
+	emailer := smtp.NewMockSendEmailer()
+	providers.emailer = emailer
+	user, keyPair := createTestUser(t, providers)
+	accessToken := loginTestUser(t, providers, user, keyPair)
+	router := newOscarRouter(providers)
+
+	do := func(method, target string, body interface{}) {
+		data, _ := json.Marshal(body)
+		r := httptest.NewRequest(method, target, bytes.NewReader(data))
+		r.Header.Set("X-Oscar-Access-Token", accessToken)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code, "Got: %s", w.Body.String())
+	}
+	// readAfterWrite reads the user after a write, and checks the read
+	// went to the database
+	readAfterWrite := func(write func()) {
+		require.Equal(t, user.Username, cache.Username(user.ID))
+		_, misses := cache.Stats()
+		write()
+		require.Equal(t, user.Username, cache.Username(user.ID))
+		_, after := cache.Stats()
+		require.Equal(t, misses+1, after)
+	}
+
+	readAfterWrite(func() {
+		do(http.MethodPut, "/1/users/me/locale", map[string]string{"locale": "de"})
+	})
+	do(http.MethodPost, "/1/users/me/email", map[string]string{"email": "alice@example.org"})
+	idx := strings.Index(emailer.Text, "?t=")
+	require.True(t, idx >= 0, "no verification link in: %s", emailer.Text)
+	token := strings.Fields(emailer.Text[idx+3:])[0]
+	readAfterWrite(func() {
+		do(http.MethodPost, "/1/email-verifications", map[string]string{"token": token})
+	})
+}
@@ -1,18 +1,37 @@
 package smtp
 
+import "context"
+
 // SendEmailer defines an interface a backend can provide for sending an email
 type SendEmailer interface {
 	SendEmail(from string, to string, subj string, textMsg string, htmlMsg *string) error
 }
 
+// HealthChecker is implemented by the SendEmailers that can check they're
+// able to send, without sending anything
+type HealthChecker interface {
+	CheckHealth(ctx context.Context) error
+}
+
 // MockSendEmailer is useful for unit tests
 type MockSendEmailer struct {
 	SentEmail bool
+	// From, To, Subject, Text and HTML hold the last email sent
+	From    string
+	To      string
+	Subject string
+	Text    string
+	HTML    *string
 }
 
 // SendEmail fulfills the SendEmailer interface
 func (m *MockSendEmailer) SendEmail(from string, to string, subj string, textMsg string, htmlMsg *string) error {
 	m.SentEmail = true
+	m.From = from
+	m.To = to
+	m.Subject = subj
+	m.Text = textMsg
+	m.HTML = htmlMsg
 	return nil
 }
 
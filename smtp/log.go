@@ -0,0 +1,20 @@
+package smtp
+
+import (
+	"log"
+)
+
+// LogSendEmailer writes emails to the log instead of delivering them. It's
+// useful for staging environments that shouldn't be emailing real people.
+type LogSendEmailer struct{}
+
+// SendEmail fulfills the SendEmailer interface
+func (LogSendEmailer) SendEmail(from string, to string, subj string, textMsg string, htmlMsg *string) error {
+	log.Printf("email from: %s, to: %s, subject: %s\n%s", from, to, subj, textMsg)
+	return nil
+}
+
+// NewLogSendEmailer returns a SendEmailer that logs every email it's asked to send
+func NewLogSendEmailer() SendEmailer {
+	return LogSendEmailer{}
+}
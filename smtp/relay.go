@@ -0,0 +1,247 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	netsmtp "net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Ways of securing the connection to a relay
+const (
+	// SecurityStartTLS upgrades a plain connection with STARTTLS, and fails
+	// if the relay doesn't offer it
+	SecurityStartTLS = "starttls"
+	// SecurityTLS connects over TLS from the start, usually on port 465
+	SecurityTLS = "tls"
+	// SecurityNone sends everything in the clear. It's only meant for relays
+	// on the same host or network, and credentials are only sent to one on
+	// localhost.
+	SecurityNone = "none"
+)
+
+// relayTimeout bounds the whole exchange with the relay, from dialing to
+// QUIT
+const relayTimeout = 30 * time.Second
+
+// RelayConfig says how to reach an SMTP relay
+type RelayConfig struct {
+	Host string
+	// Port defaults to the usual one for Security
+	Port int
+	// Security is one of the Security constants. It defaults to STARTTLS.
+	Security string
+	// Username and Password authenticate with PLAIN auth. It's skipped when
+	// Username is empty.
+	Username string
+	Password string
+}
+
+// DefaultPort returns the port relays usually listen on with security
+func DefaultPort(security string) (int, error) {
+	switch security {
+	case "", SecurityStartTLS:
+		return 587, nil
+	case SecurityTLS:
+		return 465, nil
+	case SecurityNone:
+		return 25, nil
+	default:
+		return 0, fmt.Errorf("unknown smtp security '%s'", security)
+	}
+}
+
+type relay struct {
+	cfg  RelayConfig
+	addr string
+}
+
+// NewRelay returns a SendEmailer that hands emails to the SMTP relay
+// described by cfg
+func NewRelay(cfg RelayConfig) (SendEmailer, error) {
+	if cfg.Host == "" {
+		return nil, fmt.Errorf("smtp relay host is missing")
+	}
+	if cfg.Security == "" {
+		cfg.Security = SecurityStartTLS
+	}
+	port, err := DefaultPort(cfg.Security)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Port == 0 {
+		cfg.Port = port
+	}
+	return &relay{cfg: cfg, addr: net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))}, nil
+}
+
+// SendEmail fulfills the SendEmailer interface
+func (r *relay) SendEmail(from string, to string, subj string, textMsg string, htmlMsg *string) error {
+	fromAddr, err := mail.ParseAddress(from)
+	if err != nil {
+		return fmt.Errorf("invalid sender '%s': %w", from, err)
+	}
+	toAddr, err := mail.ParseAddress(to)
+	if err != nil {
+		return fmt.Errorf("invalid recipient '%s': %w", to, err)
+	}
+	msg, err := composeMessage(fromAddr, toAddr, subj, textMsg, htmlMsg)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), relayTimeout)
+	defer cancel()
+	c, err := r.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err = c.Mail(fromAddr.Address); err != nil {
+		return fmt.Errorf("relay refused the sender: %w", err)
+	}
+	if err = c.Rcpt(toAddr.Address); err != nil {
+		return fmt.Errorf("relay refused the recipient: %w", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		w.Close()
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return fmt.Errorf("relay refused the message: %w", err)
+	}
+	return c.Quit()
+}
+
+// CheckHealth fulfills HealthChecker. It connects and authenticates without
+// sending anything.
+func (r *relay) CheckHealth(ctx context.Context) error {
+	c, err := r.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.Quit()
+}
+
+// dial connects to the relay, secures the connection and authenticates.
+// The connection is cut when ctx is done.
+func (r *relay) dial(ctx context.Context) (*netsmtp.Client, error) {
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", r.addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	tlsConfig := &tls.Config{ServerName: r.cfg.Host}
+	if r.cfg.Security == SecurityTLS {
+		conn = tls.Client(conn, tlsConfig)
+	}
+	c, err := netsmtp.NewClient(conn, r.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if r.cfg.Security == SecurityStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			c.Close()
+			return nil, fmt.Errorf("smtp relay %s doesn't support STARTTLS", r.addr)
+		}
+		if err = c.StartTLS(tlsConfig); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if r.cfg.Username != "" {
+		auth := netsmtp.PlainAuth("", r.cfg.Username, r.cfg.Password, r.cfg.Host)
+		if err = c.Auth(auth); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("smtp relay rejected the credentials: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// composeMessage builds the headers and body of an email. When there's an
+// html version, the text one comes first as the fallback.
+func composeMessage(from, to *mail.Address, subj, textMsg string, htmlMsg *string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From: %s\r\n", from.String())
+	fmt.Fprintf(buf, "To: %s\r\n", to.String())
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subj))
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "Message-ID: %s\r\n", messageID(from))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+
+	if htmlMsg == nil {
+		buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+		buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		if err := writeQuotedPrintable(buf, textMsg); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	mw := multipart.NewWriter(buf)
+	fmt.Fprintf(buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+	parts := []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", textMsg},
+		{"text/html; charset=utf-8", *htmlMsg},
+	}
+	for _, p := range parts {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err = writeQuotedPrintable(pw, p.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeQuotedPrintable(w io.Writer, s string) error {
+	qw := quotedprintable.NewWriter(w)
+	if _, err := qw.Write([]byte(s)); err != nil {
+		return err
+	}
+	return qw.Close()
+}
+
+// messageID makes a unique Message-ID in the domain of the sender
+func messageID(from *mail.Address) string {
+	domain := "localhost"
+	if at := strings.LastIndex(from.Address, "@"); at >= 0 {
+		domain = from.Address[at+1:]
+	}
+	nonce := make([]byte, 12)
+	rand.Read(nonce)
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), base64.RawURLEncoding.EncodeToString(nonce), domain)
+}
@@ -0,0 +1,126 @@
+package smtp
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeRelay accepts a single connection, answers the commands of a plain
+// SMTP session, and hands over the data of the message it received
+func fakeRelay(t *testing.T, startTLS bool) (RelayConfig, <-chan string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make(chan string, 1)
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tc := textproto.NewConn(conn)
+		tc.PrintfLine("220 fake relay")
+		for {
+			line, err := tc.ReadLine()
+			if err != nil {
+				close(data)
+				return
+			}
+			switch cmd := strings.ToUpper(strings.Fields(line)[0]); cmd {
+			case "EHLO":
+				if startTLS {
+					tc.PrintfLine("250-fake relay")
+					tc.PrintfLine("250 STARTTLS")
+				} else {
+					tc.PrintfLine("250 fake relay")
+				}
+			case "DATA":
+				tc.PrintfLine("354 go ahead")
+				buf, err := tc.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				data <- string(buf)
+				tc.PrintfLine("250 queued")
+			case "QUIT":
+				tc.PrintfLine("221 bye")
+				return
+			default:
+				tc.PrintfLine("250 ok")
+			}
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return RelayConfig{Host: host, Port: p, Security: SecurityNone}, data
+}
+
+func TestRelaySendEmail(t *testing.T) {
+	cfg, data := fakeRelay(t, false)
+	emailer, err := NewRelay(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	html := "<p>Welcome</p>"
+	err = emailer.SendEmail("Zood <notify@example.com>", "alice@example.com", "Héllo", "Welcome aboard", &html)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := <-data
+	for _, want := range []string{
+		"From: \"Zood\" <notify@example.com>",
+		"To: <alice@example.com>",
+		"Subject: =?utf-8?q?H=C3=A9llo?=",
+		"multipart/alternative",
+		"Welcome aboard",
+		"<p>Welcome</p>",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Fatalf("message is missing %q:\n%s", want, msg)
+		}
+	}
+
+	if err = emailer.SendEmail("not an address", "alice@example.com", "subject", "body", nil); err == nil {
+		t.Fatal("an invalid sender should be refused")
+	}
+}
+
+func TestRelayNeedsStartTLS(t *testing.T) {
+	cfg, _ := fakeRelay(t, false)
+	cfg.Security = SecurityStartTLS
+	emailer, err := NewRelay(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// credentials mustn't go out in the clear because the relay doesn't
+	// offer STARTTLS
+	if err = emailer.(HealthChecker).CheckHealth(context.Background()); err == nil {
+		t.Fatal("a relay without STARTTLS should fail the check")
+	}
+}
+
+func TestNewRelay(t *testing.T) {
+	if _, err := NewRelay(RelayConfig{}); err == nil {
+		t.Fatal("a relay needs a host")
+	}
+	if _, err := NewRelay(RelayConfig{Host: "mail.example.com", Security: "ssl"}); err == nil {
+		t.Fatal("unknown security should be refused")
+	}
+	emailer, err := NewRelay(RelayConfig{Host: "mail.example.com", Security: SecurityTLS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := emailer.(*relay).addr; addr != "mail.example.com:465" {
+		t.Fatalf("expected the implicit TLS port, got %s", addr)
+	}
+}
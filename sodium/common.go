@@ -0,0 +1,39 @@
+package sodium
+
+import (
+	crand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// KeyPair holds a public and secret key that can be used for asymmetric encryption
+type KeyPair struct {
+	Public []byte
+	Secret []byte
+}
+
+// Algorithm is a descriptor of an algorithm for password stretching
+type Algorithm struct {
+	Name                string
+	ID                  int
+	SaltLength          uint
+	OpsLimitInteractive uint
+	OpsLimitModerate    uint
+	OpsLimitSensitive   uint
+
+	MemLimitInteractive uint64
+	MemLimitModerate    uint64
+	MemLimitSensitive   uint64
+}
+
+func (kp KeyPair) String() string {
+	return fmt.Sprintf("public: %s\nsecret: %s",
+		hex.EncodeToString(kp.Public),
+		hex.EncodeToString(kp.Secret))
+}
+
+// Random overwrites b with random data.
+func Random(b []byte) error {
+	_, err := crand.Read(b)
+	return err
+}
@@ -0,0 +1,244 @@
+package sodium
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// SecretStreamChunkSize is the maximum amount of plaintext sealed into each
+// chunk of a secret stream
+const SecretStreamChunkSize = 64 * 1024
+
+const secretStreamVersion byte = 1
+const secretStreamIDSize = 16
+
+// every chunk's plaintext is prefixed with the stream id, the chunk counter
+// and a tag, so chunks can't be reordered, dropped or spliced in from another
+// stream without detection
+const secretStreamChunkHeaderSize = secretStreamIDSize + 8 + 1
+
+const (
+	secretStreamTagMessage byte = 0
+	secretStreamTagFinal   byte = 1
+)
+
+// ErrSecretStreamTruncated is returned when a secret stream ends before its final chunk
+var ErrSecretStreamTruncated = errors.New("secret stream is truncated")
+
+// ErrSecretStreamCorrupt is returned when a chunk of a secret stream fails
+// authentication, or appears out of order
+var ErrSecretStreamCorrupt = errors.New("secret stream is corrupt")
+
+// secretStreamChunkOverhead is what sealing adds to each chunk: its length,
+// nonce, MAC and header
+const secretStreamChunkOverhead = 4 + SymmetricNonceSize + secretBoxMACSize + secretStreamChunkHeaderSize
+
+// SecretStreamPlaintextSize returns the size of the plaintext in a secret
+// stream of streamSize bytes, without having to open it. It returns -1 if no
+// stream can have that size.
+func SecretStreamPlaintextSize(streamSize int64) int64 {
+	body := streamSize - 1 - secretStreamIDSize
+	if body < secretStreamChunkOverhead {
+		return -1
+	}
+	// every chunk but the last is full, and the last one is never empty
+	// unless the whole stream is
+	fullChunk := int64(secretStreamChunkOverhead + SecretStreamChunkSize)
+	chunks := (body + fullChunk - 1) / fullChunk
+	size := body - chunks*secretStreamChunkOverhead
+	if chunks > 1 && size <= (chunks-1)*SecretStreamChunkSize {
+		return -1
+	}
+	return size
+}
+
+type secretStreamWriter struct {
+	buf     []byte
+	closed  bool
+	counter uint64
+	dst     io.Writer
+	id      []byte
+	key     []byte
+}
+
+// NewSecretStreamWriter returns a writer that encrypts everything written to
+// it with key, in chunks of SecretStreamChunkSize, and writes the result to
+// dst. Only one chunk is held in memory at a time. The stream must be closed
+// to write the final chunk, otherwise readers will consider it truncated.
+func NewSecretStreamWriter(dst io.Writer, key []byte) (io.WriteCloser, error) {
+	if len(key) != SymmetricKeySize {
+		return nil, errors.New("key should be 'SymmetricKeySize' bytes long")
+	}
+
+	id := make([]byte, secretStreamIDSize)
+	if err := Random(id); err != nil {
+		return nil, err
+	}
+	if _, err := dst.Write(append([]byte{secretStreamVersion}, id...)); err != nil {
+		return nil, err
+	}
+
+	return &secretStreamWriter{
+		buf: make([]byte, 0, SecretStreamChunkSize),
+		dst: dst,
+		id:  id,
+		key: key,
+	}, nil
+}
+
+func (ssw *secretStreamWriter) Write(p []byte) (int, error) {
+	if ssw.closed {
+		return 0, errors.New("write to a closed secret stream")
+	}
+
+	n := 0
+	for len(p) > 0 {
+		// A full buffer is only sealed once more data arrives, so the final
+		// chunk written by Close() is never empty unless the stream is.
+		if len(ssw.buf) == SecretStreamChunkSize {
+			if err := ssw.seal(secretStreamTagMessage); err != nil {
+				return n, err
+			}
+		}
+		space := SecretStreamChunkSize - len(ssw.buf)
+		if space > len(p) {
+			space = len(p)
+		}
+		ssw.buf = append(ssw.buf, p[:space]...)
+		p = p[space:]
+		n += space
+	}
+
+	return n, nil
+}
+
+// Close seals the final chunk. It does not close the underlying writer.
+func (ssw *secretStreamWriter) Close() error {
+	if ssw.closed {
+		return nil
+	}
+	ssw.closed = true
+	return ssw.seal(secretStreamTagFinal)
+}
+
+func (ssw *secretStreamWriter) seal(tag byte) error {
+	msg := make([]byte, secretStreamChunkHeaderSize, secretStreamChunkHeaderSize+len(ssw.buf))
+	copy(msg, ssw.id)
+	binary.BigEndian.PutUint64(msg[secretStreamIDSize:], ssw.counter)
+	msg[secretStreamChunkHeaderSize-1] = tag
+	msg = append(msg, ssw.buf...)
+
+	cipherText, nonce, err := SymmetricKeyEncrypt(msg, ssw.key)
+	if err != nil {
+		return err
+	}
+
+	chunk := make([]byte, 4, 4+len(nonce)+len(cipherText))
+	binary.BigEndian.PutUint32(chunk, uint32(len(cipherText)))
+	chunk = append(chunk, nonce...)
+	chunk = append(chunk, cipherText...)
+	if _, err = ssw.dst.Write(chunk); err != nil {
+		return err
+	}
+
+	ssw.counter++
+	ssw.buf = ssw.buf[:0]
+	return nil
+}
+
+type secretStreamReader struct {
+	buf     []byte
+	counter uint64
+	done    bool
+	id      []byte
+	key     []byte
+	src     io.Reader
+}
+
+// NewSecretStreamReader returns a reader that decrypts a stream produced by
+// a secret stream writer. Read returns ErrSecretStreamCorrupt if any chunk was
+// tampered with, and ErrSecretStreamTruncated if src ends before the final
+// chunk.
+func NewSecretStreamReader(src io.Reader, key []byte) (io.Reader, error) {
+	if len(key) != SymmetricKeySize {
+		return nil, errors.New("key should be 'SymmetricKeySize' bytes long")
+	}
+
+	header := make([]byte, 1+secretStreamIDSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrSecretStreamTruncated
+		}
+		return nil, err
+	}
+	if header[0] != secretStreamVersion {
+		return nil, ErrSecretStreamCorrupt
+	}
+
+	return &secretStreamReader{
+		id:  header[1:],
+		key: key,
+		src: src,
+	}, nil
+}
+
+func (ssr *secretStreamReader) Read(p []byte) (int, error) {
+	for len(ssr.buf) == 0 {
+		if ssr.done {
+			return 0, io.EOF
+		}
+		if err := ssr.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, ssr.buf)
+	ssr.buf = ssr.buf[n:]
+	return n, nil
+}
+
+func (ssr *secretStreamReader) open() error {
+	lenBuf := make([]byte, 4)
+	if _, err := io.ReadFull(ssr.src, lenBuf); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrSecretStreamTruncated
+		}
+		return err
+	}
+	ctLen := int(binary.BigEndian.Uint32(lenBuf))
+	if ctLen < secretBoxMACSize+secretStreamChunkHeaderSize || ctLen > secretBoxMACSize+secretStreamChunkHeaderSize+SecretStreamChunkSize {
+		return ErrSecretStreamCorrupt
+	}
+
+	chunk := make([]byte, SymmetricNonceSize+ctLen)
+	if _, err := io.ReadFull(ssr.src, chunk); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrSecretStreamTruncated
+		}
+		return err
+	}
+	msg, ok := SymmetricKeyDecrypt(chunk[SymmetricNonceSize:], chunk[:SymmetricNonceSize], ssr.key)
+	if !ok {
+		return ErrSecretStreamCorrupt
+	}
+
+	if !bytes.Equal(msg[:secretStreamIDSize], ssr.id) {
+		return ErrSecretStreamCorrupt
+	}
+	if binary.BigEndian.Uint64(msg[secretStreamIDSize:]) != ssr.counter {
+		return ErrSecretStreamCorrupt
+	}
+	switch msg[secretStreamChunkHeaderSize-1] {
+	case secretStreamTagMessage:
+	case secretStreamTagFinal:
+		ssr.done = true
+	default:
+		return ErrSecretStreamCorrupt
+	}
+
+	ssr.counter++
+	ssr.buf = msg[secretStreamChunkHeaderSize:]
+	return nil
+}
@@ -0,0 +1,110 @@
+package sodium
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func sealStream(t *testing.T, key, msg []byte) []byte {
+	t.Helper()
+
+	sealed := &bytes.Buffer{}
+	w, err := NewSecretStreamWriter(sealed, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// write in uneven pieces to exercise the chunking
+	for len(msg) > 0 {
+		n := 1000
+		if n > len(msg) {
+			n = len(msg)
+		}
+		if _, err = w.Write(msg[:n]); err != nil {
+			t.Fatal(err)
+		}
+		msg = msg[n:]
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return sealed.Bytes()
+}
+
+func openStream(key, sealed []byte) ([]byte, error) {
+	r, err := NewSecretStreamReader(bytes.NewReader(sealed), key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestSecretStream(t *testing.T) {
+	key := make([]byte, SymmetricKeySize)
+	Random(key)
+
+	for _, size := range []int{0, 1, SecretStreamChunkSize, 3*SecretStreamChunkSize + 17} {
+		msg := make([]byte, size)
+		Random(msg)
+
+		sealed := sealStream(t, key, msg)
+		opened, err := openStream(key, sealed)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(msg, opened) {
+			t.Fatalf("size %d: opened stream didn't match the original", size)
+		}
+		if ptSize := SecretStreamPlaintextSize(int64(len(sealed))); ptSize != int64(size) {
+			t.Fatalf("size %d: plaintext size was computed as %d", size, ptSize)
+		}
+	}
+}
+
+func TestSecretStreamFailures(t *testing.T) {
+	key := make([]byte, SymmetricKeySize)
+	Random(key)
+	msg := make([]byte, 2*SecretStreamChunkSize+5)
+	Random(msg)
+	sealed := sealStream(t, key, msg)
+
+	// dropping the final chunk
+	firstChunkLen := 1 + secretStreamIDSize + 4 + SymmetricNonceSize + secretBoxMACSize + secretStreamChunkHeaderSize + SecretStreamChunkSize
+	if _, err := openStream(key, sealed[:2*firstChunkLen-1]); err != ErrSecretStreamTruncated {
+		t.Fatalf("Expected truncation error. Got %v", err)
+	}
+	if _, err := openStream(key, sealed[:5]); err != ErrSecretStreamTruncated {
+		t.Fatalf("Expected truncation error. Got %v", err)
+	}
+
+	// flipping a bit
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := openStream(key, tampered); err != ErrSecretStreamCorrupt {
+		t.Fatalf("Expected corruption error. Got %v", err)
+	}
+
+	// the wrong key
+	otherKey := make([]byte, SymmetricKeySize)
+	Random(otherKey)
+	if _, err := openStream(otherKey, sealed); err != ErrSecretStreamCorrupt {
+		t.Fatalf("Expected corruption error. Got %v", err)
+	}
+
+	// writing after close
+	w, err := NewSecretStreamWriter(ioutil.Discard, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if _, err = w.Write(msg); err == nil {
+		t.Fatal("Write after Close should have failed")
+	}
+
+	_, err = NewSecretStreamReader(bytes.NewReader(sealed), nil)
+	if err == nil || err == io.EOF {
+		t.Fatal("There should have been an error when passing a nil key")
+	}
+}
@@ -1,3 +1,6 @@
+//go:build !purego
+// +build !purego
+
 package sodium
 
 /*
@@ -9,7 +12,6 @@ package sodium
 import "C"
 import (
 	crand "crypto/rand"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"unsafe"
@@ -19,26 +21,6 @@ func init() {
 	C.sodium_init()
 }
 
-// KeyPair holds a public and secret key that can be used for asymmetric encryption
-type KeyPair struct {
-	Public []byte
-	Secret []byte
-}
-
-// Algorithm is a descriptor of an algorithm for password stretching
-type Algorithm struct {
-	Name                string
-	ID                  int
-	SaltLength          uint
-	OpsLimitInteractive uint
-	OpsLimitModerate    uint
-	OpsLimitSensitive   uint
-
-	MemLimitInteractive uint64
-	MemLimitModerate    uint64
-	MemLimitSensitive   uint64
-}
-
 // Argon2i13 is the older password stretching algorithm
 var Argon2i13 = Algorithm{
 	Name:                "argon2i13",
@@ -81,17 +63,20 @@ const SecretKeySize = C.crypto_box_SECRETKEYBYTES
 // PasswordStretchingSaltSize is the size in bytes of the salt required for stretching a password
 const PasswordStretchingSaltSize = C.crypto_pwhash_SALTBYTES
 
+// SignPublicKeySize is the size in bytes of a public key used to verify signatures
+const SignPublicKeySize = C.crypto_sign_PUBLICKEYBYTES
+
+// SignSecretKeySize is the size in bytes of a secret key used for signing
+const SignSecretKeySize = C.crypto_sign_SECRETKEYBYTES
+
+// SignatureSize is the size in bytes of a detached signature
+const SignatureSize = C.crypto_sign_BYTES
+
 const boxNonceSize = C.crypto_box_NONCEBYTES
 const boxMACSize = C.crypto_box_MACBYTES
 const secretBoxMACSize = C.crypto_secretbox_MACBYTES
 const secretBoxNonceSize = C.crypto_secretbox_NONCEBYTES
 
-func (kp KeyPair) String() string {
-	return fmt.Sprintf("public: %s\nsecret: %s",
-		hex.EncodeToString(kp.Public),
-		hex.EncodeToString(kp.Secret))
-}
-
 // NewKeyPair creates an asymmetric pair of keys
 func NewKeyPair() (KeyPair, error) {
 	kp := KeyPair{}
@@ -142,10 +127,57 @@ func PublicKeyEncrypt(msg, receiverPubKey, senderSecretKey []byte) (cipherText,
 	return
 }
 
-// Random overwrites b with random data.
-func Random(b []byte) error {
-	_, err := crand.Read(b)
-	return err
+// NewSignKeyPair creates a pair of keys for signing messages
+func NewSignKeyPair() (KeyPair, error) {
+	kp := KeyPair{}
+	kp.Public = make([]byte, SignPublicKeySize)
+	kp.Secret = make([]byte, SignSecretKeySize)
+	result := C.crypto_sign_keypair((*C.uchar)(&kp.Public[0]), (*C.uchar)(&kp.Secret[0]))
+	if result != 0 {
+		return kp, fmt.Errorf("unknown error generating sign key pair (%d)", result)
+	}
+
+	return kp, nil
+}
+
+// Sign returns a detached signature of msg
+func Sign(msg, secretKey []byte) ([]byte, error) {
+	if len(secretKey) != SignSecretKeySize {
+		return nil, errors.New("key should be 'SignSecretKeySize' bytes long")
+	}
+	sig := make([]byte, SignatureSize)
+	var msgPtr *C.uchar
+	if len(msg) > 0 {
+		msgPtr = (*C.uchar)(&msg[0])
+	}
+	result := C.crypto_sign_detached(
+		(*C.uchar)(&sig[0]),
+		nil,
+		msgPtr,
+		C.ulonglong(len(msg)),
+		(*C.uchar)(&secretKey[0]))
+	if result != 0 {
+		return nil, fmt.Errorf("unknown error signing message (%d)", result)
+	}
+
+	return sig, nil
+}
+
+// SignVerify reports whether sig is a valid signature of msg by publicKey
+func SignVerify(msg, sig, publicKey []byte) bool {
+	if len(sig) != SignatureSize || len(publicKey) != SignPublicKeySize {
+		return false
+	}
+	var msgPtr *C.uchar
+	if len(msg) > 0 {
+		msgPtr = (*C.uchar)(&msg[0])
+	}
+	result := C.crypto_sign_verify_detached(
+		(*C.uchar)(&sig[0]),
+		msgPtr,
+		C.ulonglong(len(msg)),
+		(*C.uchar)(&publicKey[0]))
+	return result == 0
 }
 
 // StretchPassword stretches a password to keySize bytes
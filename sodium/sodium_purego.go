@@ -0,0 +1,209 @@
+//go:build purego
+// +build purego
+
+// This file provides the sodium API without cgo or libsodium, using the
+// equivalent primitives from golang.org/x/crypto. The output of each function
+// is compatible with its libsodium counterpart. Build with '-tags purego' to
+// use it.
+
+package sodium
+
+import (
+	"crypto/ed25519"
+	crand "crypto/rand"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Argon2i13 is the older password stretching algorithm
+var Argon2i13 = Algorithm{
+	Name:                "argon2i13",
+	ID:                  1,
+	SaltLength:          16,
+	OpsLimitInteractive: 4,
+	OpsLimitModerate:    6,
+	OpsLimitSensitive:   8,
+	MemLimitInteractive: 33554432,
+	MemLimitModerate:    134217728,
+	MemLimitSensitive:   536870912}
+
+// Argon2id13 is the newer/better password stretching algorithm
+var Argon2id13 = Algorithm{
+	Name:                "argon2id13",
+	ID:                  2,
+	SaltLength:          16,
+	OpsLimitInteractive: 2,
+	OpsLimitModerate:    3,
+	OpsLimitSensitive:   4,
+	MemLimitInteractive: 67108864,
+	MemLimitModerate:    268435456,
+	MemLimitSensitive:   1073741824}
+
+// SymmetricKeySize is the length in bytes of a key for symmetric crypto operations
+const SymmetricKeySize = 32
+
+// SymmetricNonceSize is the length of the nonce used in a symmetric crypto operation
+const SymmetricNonceSize = 24
+
+// AsymmetricNonceSize is the size in bytes of a nonce used in public-secret key crypto operation
+const AsymmetricNonceSize = 24
+
+// PublicKeySize is the size in bytes of a public key in a KeyPair
+const PublicKeySize = 32
+
+// SecretKeySize is the size in bytes of a secret key in a KeyPair
+const SecretKeySize = 32
+
+// PasswordStretchingSaltSize is the size in bytes of the salt required for stretching a password
+const PasswordStretchingSaltSize = 16
+
+// SignPublicKeySize is the size in bytes of a public key used to verify signatures
+const SignPublicKeySize = ed25519.PublicKeySize
+
+// SignSecretKeySize is the size in bytes of a secret key used for signing
+const SignSecretKeySize = ed25519.PrivateKeySize
+
+// SignatureSize is the size in bytes of a detached signature
+const SignatureSize = ed25519.SignatureSize
+
+const boxNonceSize = AsymmetricNonceSize
+const boxMACSize = box.Overhead
+const secretBoxMACSize = secretbox.Overhead
+const secretBoxNonceSize = SymmetricNonceSize
+
+// NewKeyPair creates an asymmetric pair of keys
+func NewKeyPair() (KeyPair, error) {
+	pub, sec, err := box.GenerateKey(crand.Reader)
+	if err != nil {
+		return KeyPair{}, fmt.Errorf("error generating key pair: %w", err)
+	}
+
+	return KeyPair{Public: pub[:], Secret: sec[:]}, nil
+}
+
+// NewSignKeyPair creates a pair of keys for signing messages
+func NewSignKeyPair() (KeyPair, error) {
+	pub, sec, err := ed25519.GenerateKey(crand.Reader)
+	if err != nil {
+		return KeyPair{}, fmt.Errorf("error generating sign key pair: %w", err)
+	}
+
+	return KeyPair{Public: pub, Secret: sec}, nil
+}
+
+// PublicKeyDecrypt decrypts a message using asymmetric cryptography
+func PublicKeyDecrypt(cipherText, nonce, senderPublicKey, receiverSecretKey []byte) ([]byte, bool) {
+	if len(cipherText) < boxMACSize || len(nonce) != boxNonceSize ||
+		len(senderPublicKey) != PublicKeySize || len(receiverSecretKey) != SecretKeySize {
+		return nil, false
+	}
+
+	var n [boxNonceSize]byte
+	var pub [PublicKeySize]byte
+	var sec [SecretKeySize]byte
+	copy(n[:], nonce)
+	copy(pub[:], senderPublicKey)
+	copy(sec[:], receiverSecretKey)
+	msg, ok := box.Open(nil, cipherText, &n, &pub, &sec)
+	if !ok {
+		// message has been forged
+		return nil, false
+	}
+
+	return msg, true
+}
+
+// PublicKeyEncrypt encrypts a message using asymmetric cryptography
+func PublicKeyEncrypt(msg, receiverPubKey, senderSecretKey []byte) (cipherText, nonce []byte, err error) {
+	if len(receiverPubKey) != PublicKeySize {
+		return nil, nil, errors.New("public key should be 'PublicKeySize' bytes long")
+	}
+	if len(senderSecretKey) != SecretKeySize {
+		return nil, nil, errors.New("secret key should be 'SecretKeySize' bytes long")
+	}
+
+	var n [boxNonceSize]byte
+	var pub [PublicKeySize]byte
+	var sec [SecretKeySize]byte
+	if _, err = crand.Read(n[:]); err != nil {
+		return nil, nil, err
+	}
+	copy(pub[:], receiverPubKey)
+	copy(sec[:], senderSecretKey)
+
+	return box.Seal(nil, msg, &n, &pub, &sec), n[:], nil
+}
+
+// Sign returns a detached signature of msg
+func Sign(msg, secretKey []byte) ([]byte, error) {
+	if len(secretKey) != SignSecretKeySize {
+		return nil, errors.New("key should be 'SignSecretKeySize' bytes long")
+	}
+
+	return ed25519.Sign(ed25519.PrivateKey(secretKey), msg), nil
+}
+
+// SignVerify reports whether sig is a valid signature of msg by publicKey
+func SignVerify(msg, sig, publicKey []byte) bool {
+	if len(sig) != SignatureSize || len(publicKey) != SignPublicKeySize {
+		return false
+	}
+
+	return ed25519.Verify(ed25519.PublicKey(publicKey), msg, sig)
+}
+
+// StretchPassword stretches a password to keySize bytes
+func StretchPassword(keySize int, pw string, salt []byte, alg Algorithm, opsLimit uint, memLimit uint64) ([]byte, error) {
+	if len(salt) != PasswordStretchingSaltSize {
+		return nil, errors.New("salt should be 'PasswordStretchingSaltSize' bytes long")
+	}
+
+	// libsodium measures memory in bytes, and always uses a single thread
+	memKiB := uint32(memLimit / 1024)
+	switch alg.ID {
+	case Argon2i13.ID:
+		return argon2.Key([]byte(pw), salt, uint32(opsLimit), memKiB, 1, uint32(keySize)), nil
+	case Argon2id13.ID:
+		return argon2.IDKey([]byte(pw), salt, uint32(opsLimit), memKiB, 1, uint32(keySize)), nil
+	default:
+		return nil, fmt.Errorf("unknown password hash algorithm (%d)", alg.ID)
+	}
+}
+
+// SymmetricKeyEncrypt encrypts a message using symmetric cryptography
+func SymmetricKeyEncrypt(msg, key []byte) (cipherText, nonce []byte, err error) {
+	if len(key) != SymmetricKeySize {
+		return nil, nil, errors.New("key should be 'SymmetricKeySize' bytes long")
+	}
+
+	var n [secretBoxNonceSize]byte
+	var k [SymmetricKeySize]byte
+	if _, err = crand.Read(n[:]); err != nil {
+		return nil, nil, err
+	}
+	copy(k[:], key)
+
+	return secretbox.Seal(nil, msg, &n, &k), n[:], nil
+}
+
+// SymmetricKeyDecrypt decrypts a message using symmetric cryptography
+func SymmetricKeyDecrypt(cipherText, nonce, key []byte) ([]byte, bool) {
+	if len(key) != SymmetricKeySize || len(nonce) != secretBoxNonceSize || len(cipherText) < secretBoxMACSize {
+		return nil, false
+	}
+
+	var n [secretBoxNonceSize]byte
+	var k [SymmetricKeySize]byte
+	copy(n[:], nonce)
+	copy(k[:], key)
+	msg, ok := secretbox.Open(nil, cipherText, &n, &k)
+	if !ok {
+		return nil, false
+	}
+
+	return msg, true
+}
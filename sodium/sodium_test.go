@@ -115,3 +115,36 @@ func TestSymmetricCrypto(t *testing.T) {
 		t.Fatal("Decryption should have failed")
 	}
 }
+
+func TestSign(t *testing.T) {
+	kp, err := NewSignKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kp.Public) != SignPublicKeySize || len(kp.Secret) != SignSecretKeySize {
+		t.Fatal("Invalid sign key pair")
+	}
+
+	msg := []byte("Hello, world!")
+	sig, err := Sign(msg, kp.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sig) != SignatureSize {
+		t.Fatalf("Incorrect signature size: %d", len(sig))
+	}
+	if !SignVerify(msg, sig, kp.Public) {
+		t.Fatal("Signature verification failed")
+	}
+
+	// test failure cases
+	if SignVerify([]byte("Goodbye, world!"), sig, kp.Public) {
+		t.Fatal("Verification of a different message should have failed")
+	}
+	if SignVerify(msg, sig[1:], kp.Public) {
+		t.Fatal("Verification of a truncated signature should have failed")
+	}
+	if _, err = Sign(msg, nil); err == nil {
+		t.Fatal("There should have been an error when passing a nil key")
+	}
+}
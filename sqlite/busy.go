@@ -0,0 +1,105 @@
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	// DefaultBusyTimeout is how long a statement waits for a lock when
+	// Options doesn't say
+	DefaultBusyTimeout = 5 * time.Second
+	// DefaultMaxOpenConns is the size of the connection pool when Options
+	// doesn't say
+	DefaultMaxOpenConns = 4
+)
+
+// busyRetries is how many more times a transaction is started after the
+// database stayed locked for the whole busy timeout
+const busyRetries = 3
+
+// busyBackoff is the wait before the first retry. It doubles with each one.
+var busyBackoff = 50 * time.Millisecond
+
+// Options tune how the database is opened. The zero value uses the
+// defaults.
+type Options struct {
+	// BusyTimeout is how long a statement waits for another connection to
+	// release its lock before failing with SQLITE_BUSY
+	BusyTimeout time.Duration
+	// MaxOpenConns caps the pool of connections. The database is in WAL
+	// mode, so reads go on while another connection writes. In-memory
+	// databases always use a single connection, since each connection
+	// would get a database of its own.
+	MaxOpenConns int
+}
+
+// withDefaults fills in the options that were left out
+func (o Options) withDefaults(dsn string) Options {
+	if o.BusyTimeout <= 0 {
+		o.BusyTimeout = DefaultBusyTimeout
+	}
+	if o.MaxOpenConns <= 0 {
+		o.MaxOpenConns = DefaultMaxOpenConns
+	}
+	if strings.Contains(dsn, InMemoryDSN) || strings.Contains(dsn, "mode=memory") {
+		o.MaxOpenConns = 1
+	}
+	return o
+}
+
+// dsn adds the busy timeout to dsn, and makes transactions take the write
+// lock when they begin. A deferred transaction that reads and then writes
+// gets SQLITE_BUSY right away when another connection is writing, without
+// waiting out the busy timeout.
+func (o Options) dsn(dsn string) string {
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	return fmt.Sprintf("%s%s_busy_timeout=%d&_txlock=immediate", dsn, sep, o.BusyTimeout/time.Millisecond)
+}
+
+// isBusy reports whether err comes from the database staying locked by
+// another connection
+func isBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+}
+
+// beginTx starts a transaction, and tries again a few times when the
+// database is busy, so a burst of writes is slowed down rather than failed
+func (db sqliteDB) beginTx() (*sqlx.Tx, error) {
+	backoff := busyBackoff
+	for i := 0; ; i++ {
+		tx, err := db.dbx.BeginTxx(db.context(), nil)
+		if err == nil || !isBusy(err) || i == busyRetries {
+			return tx, err
+		}
+		if err = sleepContext(db.context(), backoff); err != nil {
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+// sleepContext waits for d, or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
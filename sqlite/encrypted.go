@@ -0,0 +1,64 @@
+package sqlite
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+	"zood.dev/oscar/model"
+)
+
+// EncryptionKeySize is the size of the key used for encrypted databases
+const EncryptionKeySize = 32
+
+var encryptedDriverCount int32
+
+// NewEncrypted returns a model.Provider backed by a SQLCipher encrypted
+// sqlite database. The binary has to be linked against SQLCipher instead of
+// the bundled sqlite (e.g. build with the 'libsqlite3' tag and
+// CGO_LDFLAGS=-lsqlcipher). Otherwise an error is returned, rather than
+// silently storing the data in plaintext.
+func NewEncrypted(dsn string, key []byte, opts Options) (model.Provider, error) {
+	if len(key) != EncryptionKeySize {
+		return nil, errors.Errorf("invalid database key size (%d); should be %d bytes", len(key), EncryptionKeySize)
+	}
+
+	// The key has to be set on every new connection before it is used, and
+	// the connect hook is the only place to do that. Each key gets its own
+	// registered driver, because drivers can't be unregistered or replaced.
+	pragma := fmt.Sprintf(`PRAGMA key = "x'%s'"`, hex.EncodeToString(key))
+	driverName := fmt.Sprintf("sqlite3-sqlcipher-%d", atomic.AddInt32(&encryptedDriverCount, 1))
+	sql.Register(driverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			_, err := conn.Exec(pragma, nil)
+			return err
+		},
+	})
+
+	opts = opts.withDefaults(dsn)
+	sqlDB, err := sql.Open(driverName, opts.dsn(dsn))
+	if err != nil {
+		return nil, err
+	}
+	dbx := sqlx.NewDb(sqlDB, "sqlite3")
+
+	// plain sqlite silently ignores the key pragma, so make sure we're
+	// actually talking to SQLCipher
+	var cipherVersion string
+	if err = dbx.Get(&cipherVersion, "PRAGMA cipher_version"); err != nil || cipherVersion == "" {
+		dbx.Close()
+		return nil, errors.New("sqlite is not built with SQLCipher support")
+	}
+	// a wrong key only shows up once the database is read
+	var tableCount int
+	if err = dbx.Get(&tableCount, "SELECT count(*) FROM sqlite_master"); err != nil {
+		dbx.Close()
+		return nil, errors.Wrap(err, "unable to read database. is the key correct?")
+	}
+
+	return newSqliteDB(dbx, opts)
+}
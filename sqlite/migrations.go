@@ -49,3 +49,124 @@ var migrationQueries003 = []string{
 							user_id INTEGER NOT NULL,
 							expires_at INTEGER NOT NULL)`,
 }
+
+var migrationQueries004 = []string{
+	`ALTER TABLE messages ADD COLUMN sealed INTEGER NOT NULL DEFAULT 0`,
+}
+
+var migrationQueries005 = []string{
+	`ALTER TABLE users ADD COLUMN username_index BLOB`,
+	`CREATE UNIQUE INDEX users_username_index_unique_constraint ON users(username_index)`,
+}
+
+var migrationQueries006 = []string{
+	`ALTER TABLE users ADD COLUMN locale TEXT NOT NULL DEFAULT ''`,
+}
+
+var migrationQueries007 = []string{
+	`CREATE TABLE email_events (id INTEGER PRIMARY KEY,
+								provider_id TEXT NOT NULL,
+								event TEXT NOT NULL,
+								severity TEXT NOT NULL,
+								recipient TEXT NOT NULL,
+								message_id TEXT NOT NULL,
+								reason TEXT NOT NULL,
+								timestamp INTEGER NOT NULL)`,
+	`CREATE UNIQUE INDEX email_events_provider_id_unique_constraint ON email_events(provider_id)`,
+}
+
+var migrationQueries008 = []string{
+	`CREATE TABLE suppressed_emails (email TEXT PRIMARY KEY,
+									 reason TEXT NOT NULL,
+									 created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')))`,
+	`CREATE TABLE audit_log (id INTEGER PRIMARY KEY,
+							 created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+							 actor TEXT NOT NULL,
+							 action TEXT NOT NULL,
+							 details TEXT NOT NULL)`,
+}
+
+var migrationQueries009 = []string{
+	`CREATE TABLE reserved_usernames (username TEXT PRIMARY KEY,
+									  email TEXT NOT NULL DEFAULT '',
+									  note TEXT NOT NULL DEFAULT '',
+									  created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')))`,
+}
+
+var migrationQueries010 = []string{
+	`ALTER TABLE session_challenges ADD COLUMN used INTEGER NOT NULL DEFAULT 0`,
+}
+
+var migrationQueries011 = []string{
+	`CREATE TABLE outbox (id INTEGER PRIMARY KEY,
+						  recipient_id INTEGER NOT NULL,
+						  message_id INTEGER NOT NULL,
+						  payload BLOB NOT NULL,
+						  urgent INTEGER NOT NULL DEFAULT 0,
+						  attempts INTEGER NOT NULL DEFAULT 0,
+						  next_attempt INTEGER NOT NULL)`,
+	`CREATE INDEX outbox_next_attempt ON outbox(next_attempt)`,
+}
+
+var migrationQueries012 = []string{
+	`ALTER TABLE messages ADD COLUMN system INTEGER NOT NULL DEFAULT 0`,
+}
+
+var migrationQueries013 = []string{
+	`ALTER TABLE sessions ADD COLUMN platform TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE sessions ADD COLUMN app_version TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE sessions ADD COLUMN device_model TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE user_apns_tokens ADD COLUMN platform TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE user_apns_tokens ADD COLUMN app_version TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE user_apns_tokens ADD COLUMN device_model TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE user_fcm_tokens ADD COLUMN platform TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE user_fcm_tokens ADD COLUMN app_version TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE user_fcm_tokens ADD COLUMN device_model TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX sessions_user_id ON sessions(user_id)`,
+}
+
+var migrationQueries014 = []string{
+	`ALTER TABLE messages ADD COLUMN urgent INTEGER NOT NULL DEFAULT 0`,
+}
+
+var migrationQueries015 = []string{
+	`ALTER TABLE users ADD COLUMN undeliverable_email TEXT`,
+}
+
+var migrationQueries016 = []string{
+	`CREATE TABLE refresh_tokens (id INTEGER PRIMARY KEY,
+								  token TEXT NOT NULL,
+								  user_id INTEGER NOT NULL,
+								  expires_at INTEGER NOT NULL,
+								  platform TEXT NOT NULL DEFAULT '',
+								  app_version TEXT NOT NULL DEFAULT '',
+								  device_model TEXT NOT NULL DEFAULT '')`,
+	`CREATE UNIQUE INDEX refresh_tokens_token_unique_constraint ON refresh_tokens(token)`,
+	`CREATE INDEX refresh_tokens_user_id ON refresh_tokens(user_id)`,
+	`ALTER TABLE sessions ADD COLUMN refresh_token TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX sessions_refresh_token ON sessions(refresh_token)`,
+	// sessions from before refresh tokens are their own refresh token, so
+	// they can be revoked like the others
+	`INSERT INTO refresh_tokens (token, user_id, expires_at, platform, app_version, device_model)
+	SELECT token, user_id, expires_at, platform, app_version, device_model FROM sessions`,
+	`UPDATE sessions SET refresh_token=token`,
+}
+
+var migrationQueries017 = []string{
+	`ALTER TABLE refresh_tokens ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE refresh_tokens ADD COLUMN last_used INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE refresh_tokens ADD COLUMN user_agent TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE refresh_tokens ADD COLUMN ip_prefix TEXT NOT NULL DEFAULT ''`,
+}
+
+var migrationQueries018 = []string{
+	`ALTER TABLE users ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE users ADD COLUMN status TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE users ADD COLUMN suspended_until INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE users ADD COLUMN status_reason TEXT NOT NULL DEFAULT ''`,
+}
+
+var migrationQueries019 = []string{
+	`ALTER TABLE tickets ADD COLUMN scopes TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE sessions ADD COLUMN scopes TEXT NOT NULL DEFAULT ''`,
+}
@@ -10,7 +10,7 @@ import (
 func NewMockDB(t *testing.T) model.Provider {
 	t.Helper()
 
-	db, err := New(InMemoryDSN)
+	db, err := New(InMemoryDSN, Options{})
 	require.NoError(t, err)
 	return db
 }
@@ -1,6 +1,7 @@
 package sqlite
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
@@ -23,21 +24,49 @@ const (
 
 // sqliteDB fulfills the model.Provider interface
 type sqliteDB struct {
+	ctx context.Context
 	dbx *sqlx.DB
 }
 
+// WithContext returns a copy of db whose queries are cancelled along with ctx
+func (db sqliteDB) WithContext(ctx context.Context) model.Provider {
+	db.ctx = ctx
+	return db
+}
+
+func (db sqliteDB) context() context.Context {
+	if db.ctx == nil {
+		return context.Background()
+	}
+	return db.ctx
+}
+
 // New returns a model.Provider backed by sqlite
-func New(dsn string) (model.Provider, error) {
-	dbx, err := sqlx.Open("sqlite3", dsn)
+func New(dsn string, opts Options) (model.Provider, error) {
+	opts = opts.withDefaults(dsn)
+	dbx, err := sqlx.Open("sqlite3", opts.dsn(dsn))
 	if err != nil {
 		return nil, err
 	}
-	dbx.SetMaxOpenConns(1)
+
+	return newSqliteDB(dbx, opts)
+}
+
+// newSqliteDB switches dbx to WAL mode, brings its schema up to date, and
+// wraps it
+func newSqliteDB(dbx *sqlx.DB, opts Options) (model.Provider, error) {
+	dbx.SetMaxOpenConns(opts.MaxOpenConns)
+	dbx.SetMaxIdleConns(opts.MaxOpenConns)
+	// the journal mode is kept in the file, so it only has to be set once.
+	// In-memory databases stay in memory mode.
+	if _, err := dbx.Exec("PRAGMA journal_mode=WAL"); err != nil {
+		return nil, errors.Wrap(err, "unable to switch to WAL mode")
+	}
 
 	db := sqliteDB{dbx: dbx}
 	// check db version
 	ver := db.schemaVersion()
-	tx, err := db.dbx.Beginx()
+	tx, err := db.dbx.BeginTxx(db.context(), nil)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to begin transaction for database migration")
 	}
@@ -66,10 +95,138 @@ func New(dsn string) (model.Provider, error) {
 				return nil, err
 			}
 		}
+		fallthrough
 	case 3:
+		for _, q := range migrationQueries004 {
+			_, err := tx.Exec(q)
+			if err != nil {
+				return nil, err
+			}
+		}
+		fallthrough
+	case 4:
+		for _, q := range migrationQueries005 {
+			_, err := tx.Exec(q)
+			if err != nil {
+				return nil, err
+			}
+		}
+		fallthrough
+	case 5:
+		for _, q := range migrationQueries006 {
+			_, err := tx.Exec(q)
+			if err != nil {
+				return nil, err
+			}
+		}
+		fallthrough
+	case 6:
+		for _, q := range migrationQueries007 {
+			_, err := tx.Exec(q)
+			if err != nil {
+				return nil, err
+			}
+		}
+		fallthrough
+	case 7:
+		for _, q := range migrationQueries008 {
+			_, err := tx.Exec(q)
+			if err != nil {
+				return nil, err
+			}
+		}
+		fallthrough
+	case 8:
+		for _, q := range migrationQueries009 {
+			_, err := tx.Exec(q)
+			if err != nil {
+				return nil, err
+			}
+		}
+		fallthrough
+	case 9:
+		for _, q := range migrationQueries010 {
+			_, err := tx.Exec(q)
+			if err != nil {
+				return nil, err
+			}
+		}
+		fallthrough
+	case 10:
+		for _, q := range migrationQueries011 {
+			_, err := tx.Exec(q)
+			if err != nil {
+				return nil, err
+			}
+		}
+		fallthrough
+	case 11:
+		for _, q := range migrationQueries012 {
+			_, err := tx.Exec(q)
+			if err != nil {
+				return nil, err
+			}
+		}
+		fallthrough
+	case 12:
+		for _, q := range migrationQueries013 {
+			_, err := tx.Exec(q)
+			if err != nil {
+				return nil, err
+			}
+		}
+		fallthrough
+	case 13:
+		for _, q := range migrationQueries014 {
+			_, err := tx.Exec(q)
+			if err != nil {
+				return nil, err
+			}
+		}
+		fallthrough
+	case 14:
+		for _, q := range migrationQueries015 {
+			_, err := tx.Exec(q)
+			if err != nil {
+				return nil, err
+			}
+		}
+		fallthrough
+	case 15:
+		for _, q := range migrationQueries016 {
+			_, err := tx.Exec(q)
+			if err != nil {
+				return nil, err
+			}
+		}
+		fallthrough
+	case 16:
+		for _, q := range migrationQueries017 {
+			_, err := tx.Exec(q)
+			if err != nil {
+				return nil, err
+			}
+		}
+		fallthrough
+	case 17:
+		for _, q := range migrationQueries018 {
+			_, err := tx.Exec(q)
+			if err != nil {
+				return nil, err
+			}
+		}
+		fallthrough
+	case 18:
+		for _, q := range migrationQueries019 {
+			_, err := tx.Exec(q)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case 19:
 		// database schema is up to date. nothing to do.
 	}
-	db.setSchemaVersion(tx, 3)
+	db.setSchemaVersion(tx, 19)
 
 	err = tx.Commit()
 	if err != nil {
@@ -80,9 +237,15 @@ func New(dsn string) (model.Provider, error) {
 }
 
 func (db sqliteDB) AccessToken(token string) (*model.AccessTokenRecord, error) {
-	const query = `SELECT user_id, expires_at FROM sessions WHERE token=?`
+	const query = `
+	SELECT s.user_id, s.expires_at, s.platform, s.app_version, s.device_model, s.refresh_token,
+		COALESCE(r.last_used, 0) AS session_last_used, s.scopes, COALESCE(u.status, '') AS status,
+		COALESCE(u.suspended_until, 0) AS suspended_until, COALESCE(u.status_reason, '') AS status_reason
+	FROM sessions s LEFT JOIN refresh_tokens r ON r.token=s.refresh_token AND s.refresh_token<>''
+		LEFT JOIN users u ON u.id=s.user_id
+	WHERE s.token=?`
 	atr := model.AccessTokenRecord{Token: token}
-	err := db.dbx.QueryRowx(query, token).StructScan(&atr)
+	err := db.dbx.QueryRowxContext(db.context(), query, token).StructScan(&atr)
 	switch err {
 	case nil:
 		return &atr, nil
@@ -93,10 +256,19 @@ func (db sqliteDB) AccessToken(token string) (*model.AccessTokenRecord, error) {
 	}
 }
 
+func (db sqliteDB) AccessTokens(afterToken string, now int64, limit int) ([]string, error) {
+	const query = `SELECT token FROM sessions WHERE token>? AND expires_at>=? ORDER BY token LIMIT ?`
+	tokens := make([]string, 0)
+	if err := db.dbx.SelectContext(db.context(), &tokens, query, afterToken, now, limit); err != nil {
+		return nil, errors.Wrap(err, "unable to select access tokens")
+	}
+	return tokens, nil
+}
+
 func (db sqliteDB) APNSToken(token string) (*model.APNSTokenRecord, error) {
-	const query = `SELECT id, user_id FROM user_apns_tokens WHERE token=?`
+	const query = `SELECT id, user_id, platform, app_version, device_model FROM user_apns_tokens WHERE token=?`
 	ftr := model.APNSTokenRecord{Token: token}
-	err := db.dbx.QueryRowx(query, token).StructScan(&ftr)
+	err := db.dbx.QueryRowxContext(db.context(), query, token).StructScan(&ftr)
 	switch err {
 	case nil:
 		return &ftr, nil
@@ -110,7 +282,7 @@ func (db sqliteDB) APNSToken(token string) (*model.APNSTokenRecord, error) {
 func (db sqliteDB) APNSTokensRaw(userID int64) ([]string, error) {
 	const query = `SELECT token FROM user_apns_tokens WHERE user_id=?`
 	tokens := make([]string, 0)
-	err := db.dbx.Select(&tokens, query, userID)
+	err := db.dbx.SelectContext(db.context(), &tokens, query, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -120,7 +292,7 @@ func (db sqliteDB) APNSTokensRaw(userID int64) ([]string, error) {
 func (db sqliteDB) APNSTokenUser(userID int64, token string) (*model.APNSTokenRecord, error) {
 	const query = "SELECT id FROM user_apns_tokens WHERE user_id=? AND token=?"
 	var id int64
-	err := db.dbx.QueryRow(query, userID, token).Scan(&id)
+	err := db.dbx.QueryRowContext(db.context(), query, userID, token).Scan(&id)
 	switch err {
 	case nil:
 		return &model.APNSTokenRecord{ID: id, UserID: userID, Token: token}, nil
@@ -131,37 +303,125 @@ func (db sqliteDB) APNSTokenUser(userID int64, token string) (*model.APNSTokenRe
 	}
 }
 
+// ClientCounts groups the active sessions and the push tokens by the app
+// build they came from
+func (db sqliteDB) ClientCounts(now int64) ([]model.ClientCountRecord, error) {
+	const query = `
+	SELECT platform, app_version, SUM(sessions) AS sessions, SUM(push_tokens) AS push_tokens FROM (
+		SELECT platform, app_version, 1 AS sessions, 0 AS push_tokens FROM sessions WHERE expires_at>=?
+		UNION ALL SELECT platform, app_version, 0, 1 FROM user_apns_tokens
+		UNION ALL SELECT platform, app_version, 0, 1 FROM user_fcm_tokens
+	) AS clients GROUP BY platform, app_version ORDER BY platform, app_version`
+	counts := make([]model.ClientCountRecord, 0)
+	if err := db.dbx.SelectContext(db.context(), &counts, query, now); err != nil {
+		return nil, errors.Wrap(err, "failed to count clients")
+	}
+	return counts, nil
+}
+
 func (db sqliteDB) Database() *sql.DB {
 	return db.dbx.DB
 }
 
+func (db sqliteDB) DeleteAccessToken(token string) error {
+	tx, err := db.beginTx()
+	if err != nil {
+		return errors.Wrap(err, "unable to start a transaction")
+	}
+	defer tx.Rollback()
+
+	var refreshToken string
+	err = tx.QueryRow(`SELECT refresh_token FROM sessions WHERE token=?`, token).Scan(&refreshToken)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return nil
+	default:
+		return errors.Wrap(err, "unable to find the refresh token")
+	}
+	if _, err = tx.Exec(`DELETE FROM sessions WHERE token=?`, token); err != nil {
+		return errors.Wrap(err, "unable to delete the access token")
+	}
+	if refreshToken != "" {
+		if _, err = tx.Exec(`DELETE FROM sessions WHERE refresh_token=?`, refreshToken); err != nil {
+			return errors.Wrap(err, "unable to delete access tokens of the refresh token")
+		}
+		if _, err = tx.Exec(`DELETE FROM refresh_tokens WHERE token=?`, refreshToken); err != nil {
+			return errors.Wrap(err, "unable to delete the refresh token")
+		}
+	}
+
+	return errors.Wrap(tx.Commit(), "failed to commit transaction")
+}
+
+func (db sqliteDB) DeleteAccessTokensOfUser(userID int64) (int64, error) {
+	tx, err := db.beginTx()
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to start a transaction")
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM sessions WHERE user_id=?", userID)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to delete access tokens")
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to count deleted access tokens")
+	}
+	if _, err = tx.Exec("DELETE FROM refresh_tokens WHERE user_id=?", userID); err != nil {
+		return 0, errors.Wrap(err, "unable to delete refresh tokens")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, errors.Wrap(err, "failed to commit transaction")
+	}
+	return affected, nil
+}
+
 func (db sqliteDB) DeleteAPNSToken(token string) error {
 	const query = `DELETE FROM user_apns_tokens WHERE token=?`
-	_, err := db.dbx.Exec(query, token)
+	_, err := db.dbx.ExecContext(db.context(), query, token)
 	return err
 }
 
 func (db sqliteDB) DeleteAPNSTokenOfUser(userID int64, token string) error {
 	const query = `DELETE FROM user_apns_tokens WHERE user_id=? AND token=?`
-	_, err := db.dbx.Exec(query, userID, token)
+	_, err := db.dbx.ExecContext(db.context(), query, userID, token)
 	return err
 }
 
+func (db sqliteDB) DeleteExpiredAccessTokens(now int64) (int64, error) {
+	result, err := db.dbx.ExecContext(db.context(), "DELETE FROM sessions WHERE expires_at<?", now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (db sqliteDB) DeleteExpiredRefreshTokens(now int64) (int64, error) {
+	result, err := db.dbx.ExecContext(db.context(), "DELETE FROM refresh_tokens WHERE expires_at<?", now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 func (db sqliteDB) DeleteFCMToken(token string) error {
 	const query = `DELETE FROM user_fcm_tokens WHERE token=?`
-	_, err := db.dbx.Exec(query, token)
+	_, err := db.dbx.ExecContext(db.context(), query, token)
 	return err
 }
 
 func (db sqliteDB) DeleteFCMTokenOfUser(userID int64, token string) error {
 	const query = `DELETE FROM user_fcm_tokens WHERE user_id=? AND token=?`
-	_, err := db.dbx.Exec(query, userID, token)
+	_, err := db.dbx.ExecContext(db.context(), query, userID, token)
 	return err
 }
 
 func (db sqliteDB) DeleteMessageToRecipient(recipientID, msgID int64) error {
 	deleteSQL := `DELETE FROM messages WHERE recipient_id=? AND id=?`
-	_, err := db.dbx.Exec(deleteSQL, recipientID, msgID)
+	_, err := db.dbx.ExecContext(db.context(), deleteSQL, recipientID, msgID)
 	if err != nil {
 		return errors.Wrap(err, "unable to execute message deletion")
 	}
@@ -169,26 +429,81 @@ func (db sqliteDB) DeleteMessageToRecipient(recipientID, msgID int64) error {
 	return nil
 }
 
+// DeleteMessagesToRecipient deletes the messages of recipientID among
+// msgIDs in a single statement, so either all of them are deleted or none
+// are. Ids of missing messages, or messages belonging to another user, are
+// skipped.
+func (db sqliteDB) DeleteMessagesToRecipient(recipientID int64, msgIDs []int64) (int64, error) {
+	if len(msgIDs) == 0 {
+		return 0, nil
+	}
+	result, err := squirrel.Delete("messages").
+		Where(squirrel.Eq{"recipient_id": recipientID, "id": msgIDs}).
+		RunWith(db.dbx.DB).ExecContext(db.context())
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to execute message deletion")
+	}
+
+	return result.RowsAffected()
+}
+
+func (db sqliteDB) DeleteSession(userID, id int64) (bool, error) {
+	tx, err := db.beginTx()
+	if err != nil {
+		return false, errors.Wrap(err, "unable to start a transaction")
+	}
+	defer tx.Rollback()
+
+	var refreshToken string
+	err = tx.QueryRow(`SELECT token FROM refresh_tokens WHERE id=? AND user_id=?`, id, userID).Scan(&refreshToken)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return false, nil
+	default:
+		return false, errors.Wrap(err, "unable to find the refresh token")
+	}
+	if _, err = tx.Exec(`DELETE FROM sessions WHERE refresh_token=?`, refreshToken); err != nil {
+		return false, errors.Wrap(err, "unable to delete access tokens of the refresh token")
+	}
+	if _, err = tx.Exec(`DELETE FROM refresh_tokens WHERE id=?`, id); err != nil {
+		return false, errors.Wrap(err, "unable to delete the refresh token")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return false, errors.Wrap(err, "failed to commit transaction")
+	}
+	return true, nil
+}
+
 func (db sqliteDB) DeleteSessionChallengeID(id int64) error {
-	_, err := db.dbx.Exec("DELETE FROM session_challenges WHERE id=?", id)
+	_, err := db.dbx.ExecContext(db.context(), "DELETE FROM session_challenges WHERE id=?", id)
 	return err
 }
 
 func (db sqliteDB) DeleteSessionChallengeUser(userID int64) error {
-	_, err := db.dbx.Exec("DELETE FROM session_challenges WHERE user_id=?", userID)
+	_, err := db.dbx.ExecContext(db.context(), "DELETE FROM session_challenges WHERE user_id=?", userID)
 	return err
 }
 
+func (db sqliteDB) DeleteSessionChallenges(olderThan int64) (int64, error) {
+	result, err := db.dbx.ExecContext(db.context(), "DELETE FROM session_challenges WHERE creation_date<?", olderThan)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 func (db sqliteDB) DeleteTickets(olderThan int64) error {
 	_, err := squirrel.Delete(tableTickets).
 		Where(squirrel.LtOrEq{"timestamp": olderThan}).
-		RunWith(db.dbx.DB).Exec()
+		RunWith(db.dbx.DB).ExecContext(db.context())
 	return err
 }
 
 func (db sqliteDB) DisavowEmail(token string) error {
 	const query = `DELETE FROM email_verification_tokens WHERE token=?`
-	_, err := db.dbx.Exec(query, token)
+	_, err := db.dbx.ExecContext(db.context(), query, token)
 	if err != nil {
 		return errors.Wrap(err, "unable to execute query")
 	}
@@ -196,10 +511,61 @@ func (db sqliteDB) DisavowEmail(token string) error {
 	return nil
 }
 
+// EmailEvents returns the most recent email events, newest first
+func (db sqliteDB) EmailEvents(limit int) ([]model.EmailEventRecord, error) {
+	const query = `
+	SELECT id, provider_id, event, severity, recipient, message_id, reason, timestamp
+	FROM email_events ORDER BY timestamp DESC, id DESC LIMIT ?`
+	var events []model.EmailEventRecord
+	err := db.dbx.SelectContext(db.context(), &events, query, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to select email events")
+	}
+	return events, nil
+}
+
+// InsertEmailEvent records an event reported by the email provider. Events
+// that were already recorded, because the provider retried the webhook,
+// are ignored.
+func (db sqliteDB) InsertEmailEvent(evt model.EmailEventRecord) error {
+	const query = `
+	INSERT OR IGNORE INTO email_events (provider_id, event, severity, recipient, message_id, reason, timestamp)
+	VALUES (:provider_id, :event, :severity, :recipient, :message_id, :reason, :timestamp)`
+	_, err := db.dbx.NamedExecContext(db.context(), query, evt)
+	if err != nil {
+		return errors.Wrap(err, "failed to insert email event")
+	}
+	return nil
+}
+
+// InsertEmailVerificationToken fulfills model.Provider
+func (db sqliteDB) InsertEmailVerificationToken(userID int64, email, token string) error {
+	tx, err := db.beginTx()
+	if err != nil {
+		return errors.Wrap(err, "unable to start a transaction")
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM email_verification_tokens WHERE user_id=?`, userID)
+	if err != nil {
+		return errors.Wrap(err, "unable to delete pending verification tokens")
+	}
+	_, err = tx.Exec(`INSERT INTO email_verification_tokens (user_id, token, email, send_date) VALUES (?, ?, ?, ?)`,
+		userID, token, email, time.Now().Unix())
+	if err != nil {
+		return errors.Wrap(err, "unable to insert verification token")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errors.Wrap(err, "failed to commit transaction")
+	}
+	return nil
+}
+
 func (db sqliteDB) EmailVerificationTokenRecord(token string) (*model.EmailVerificationTokenRecord, error) {
 	const query = `SELECT user_id, email, send_date FROM email_verification_tokens WHERE token=?`
 	evtr := model.EmailVerificationTokenRecord{}
-	err := db.dbx.QueryRow(query, token).Scan(&evtr.UserID, &evtr.Email, &evtr.SendDate)
+	err := db.dbx.QueryRowContext(db.context(), query, token).Scan(&evtr.UserID, &evtr.Email, &evtr.SendDate)
 	switch err {
 	case nil:
 	case sql.ErrNoRows:
@@ -214,9 +580,9 @@ func (db sqliteDB) EmailVerificationTokenRecord(token string) (*model.EmailVerif
 }
 
 func (db sqliteDB) FCMToken(token string) (*model.FCMTokenRecord, error) {
-	const query = `SELECT id, user_id FROM user_fcm_tokens WHERE token=?`
+	const query = `SELECT id, user_id, platform, app_version, device_model FROM user_fcm_tokens WHERE token=?`
 	ftr := model.FCMTokenRecord{Token: token}
-	err := db.dbx.QueryRowx(query, token).StructScan(&ftr)
+	err := db.dbx.QueryRowxContext(db.context(), query, token).StructScan(&ftr)
 	switch err {
 	case nil:
 		return &ftr, nil
@@ -230,7 +596,7 @@ func (db sqliteDB) FCMToken(token string) (*model.FCMTokenRecord, error) {
 func (db sqliteDB) FCMTokensRaw(userID int64) ([]string, error) {
 	const query = `SELECT token FROM user_fcm_tokens WHERE user_id=?`
 	tokens := make([]string, 0)
-	err := db.dbx.Select(&tokens, query, userID)
+	err := db.dbx.SelectContext(db.context(), &tokens, query, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -240,7 +606,7 @@ func (db sqliteDB) FCMTokensRaw(userID int64) ([]string, error) {
 func (db sqliteDB) FCMTokenUser(userID int64, token string) (*model.FCMTokenRecord, error) {
 	const query = "SELECT id FROM user_fcm_tokens WHERE user_id=? AND token=?"
 	var id int64
-	err := db.dbx.QueryRow(query, userID, token).Scan(&id)
+	err := db.dbx.QueryRowContext(db.context(), query, userID, token).Scan(&id)
 	switch err {
 	case nil:
 		return &model.FCMTokenRecord{ID: id, UserID: userID, Token: token}, nil
@@ -251,31 +617,97 @@ func (db sqliteDB) FCMTokenUser(userID int64, token string) (*model.FCMTokenReco
 	}
 }
 
-func (db sqliteDB) InsertAccessToken(token string, userID int64, expiresAt int64) error {
+func (db sqliteDB) InsertAccessToken(token string, userID int64, expiresAt int64, client model.ClientRecord) error {
 	_, err := squirrel.Insert("sessions").SetMap(map[string]interface{}{
-		"token":      token,
-		"user_id":    userID,
-		"expires_at": expiresAt,
-	}).RunWith(db.dbx.DB).Exec()
+		"token":        token,
+		"user_id":      userID,
+		"expires_at":   expiresAt,
+		"platform":     client.Platform,
+		"app_version":  client.AppVersion,
+		"device_model": client.DeviceModel,
+	}).RunWith(db.dbx.DB).ExecContext(db.context())
 	return err
 }
 
-func (db sqliteDB) InsertAPNSToken(userID int64, token string) error {
-	const query = `INSERT INTO user_apns_tokens (user_id, token) VALUES (?, ?)`
-	_, err := db.dbx.Exec(query, userID, token)
+func (db sqliteDB) InsertScopedAccessToken(token string, userID, expiresAt int64, scopes string) error {
+	const query = `INSERT INTO sessions (token, user_id, expires_at, scopes) VALUES (?, ?, ?, ?)`
+	_, err := db.dbx.ExecContext(db.context(), query, token, userID, expiresAt, scopes)
 	return err
 }
 
-func (db sqliteDB) InsertFCMToken(userID int64, token string) error {
-	const query = `INSERT INTO user_fcm_tokens (user_id, token) VALUES (?, ?)`
-	_, err := db.dbx.Exec(query, userID, token)
+func (db sqliteDB) InsertRefreshToken(rtr model.RefreshTokenRecord) error {
+	const query = `
+	INSERT INTO refresh_tokens (token, user_id, expires_at, platform, app_version, device_model, created_at, last_used, user_agent, ip_prefix)
+	VALUES (:token, :user_id, :expires_at, :platform, :app_version, :device_model, :created_at, :last_used, :user_agent, :ip_prefix)`
+	_, err := db.dbx.NamedExecContext(db.context(), query, rtr)
 	return err
 }
 
+func (db sqliteDB) InsertRefreshedAccessToken(token, refreshToken string, expiresAt int64) error {
+	const query = `
+	INSERT INTO sessions (token, user_id, expires_at, platform, app_version, device_model, refresh_token)
+	SELECT ?, user_id, ?, platform, app_version, device_model, token FROM refresh_tokens WHERE token=?`
+	result, err := db.dbx.ExecContext(db.context(), query, token, expiresAt, refreshToken)
+	if err != nil {
+		return err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if inserted == 0 {
+		return errors.New("unknown refresh token")
+	}
+	return nil
+}
+
+func (db sqliteDB) InsertAPNSToken(userID int64, token string, client model.ClientRecord) error {
+	const query = `INSERT INTO user_apns_tokens (user_id, token, platform, app_version, device_model) VALUES (?, ?, ?, ?, ?)`
+	_, err := db.dbx.ExecContext(db.context(), query, userID, token, client.Platform, client.AppVersion, client.DeviceModel)
+	return err
+}
+
+func (db sqliteDB) InsertFCMToken(userID int64, token string, client model.ClientRecord) error {
+	const query = `INSERT INTO user_fcm_tokens (user_id, token, platform, app_version, device_model) VALUES (?, ?, ?, ?, ?)`
+	_, err := db.dbx.ExecContext(db.context(), query, userID, token, client.Platform, client.AppVersion, client.DeviceModel)
+	return err
+}
+
+// execer is implemented by both the database and its transactions
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
 func (db sqliteDB) InsertMessage(recipientID, senderID int64, cipherText, nonce []byte, sentDate int64) (int64, error) {
+	return db.insertMessage(db.dbx, model.MessageRecord{
+		RecipientID: recipientID,
+		SenderID:    senderID,
+		CipherText:  cipherText,
+		Nonce:       nonce,
+		SentDate:    sentDate,
+	})
+}
+
+// InsertSealedMessage stores a message whose envelope has been sealed to the
+// recipient's public key. Only the recipient is recorded in the clear.
+func (db sqliteDB) InsertSealedMessage(recipientID int64, sealedEnvelope, nonce []byte) (int64, error) {
+	return db.insertMessage(db.dbx, model.MessageRecord{
+		RecipientID: recipientID,
+		CipherText:  sealedEnvelope,
+		Nonce:       nonce,
+		Sealed:      true,
+	})
+}
+
+func (db sqliteDB) insertMessage(ex execer, msg model.MessageRecord) (int64, error) {
+	if msg.Sealed {
+		msg.SenderID = 0
+		msg.SentDate = 0
+		msg.System = false
+	}
 	insertSQL := `
-	INSERT INTO messages (recipient_id, sender_id, cipher_text, nonce, sent_date) VALUES (?, ?, ?, ?, ?)`
-	result, err := db.dbx.Exec(insertSQL, recipientID, senderID, cipherText, nonce, sentDate)
+	INSERT INTO messages (recipient_id, sender_id, cipher_text, nonce, sent_date, sealed, system, urgent) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := ex.ExecContext(db.context(), insertSQL, msg.RecipientID, msg.SenderID, msg.CipherText, msg.Nonce, msg.SentDate, msg.Sealed, msg.System, msg.Urgent)
 	if err != nil {
 		return 0, errors.Wrap(err, "SQL insert exec failed")
 	}
@@ -287,10 +719,146 @@ func (db sqliteDB) InsertMessage(recipientID, senderID int64, cipherText, nonce
 	return msgID, nil
 }
 
+func (db sqliteDB) InsertMessageWithOutbox(msg model.MessageRecord, entry model.OutboxRecord, maxQueued int64) (int64, int64, int64, error) {
+	tx, err := db.beginTx()
+	if err != nil {
+		return 0, 0, 0, errors.Wrap(err, "unable to start a transaction")
+	}
+	defer tx.Rollback()
+
+	var evictedID int64
+	if maxQueued > 0 {
+		evictedID, err = db.makeRoomForMessage(tx.Tx, msg, maxQueued)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	msgID, err := db.insertMessage(tx, msg)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	insertSQL := `
+	INSERT INTO outbox (recipient_id, message_id, payload, urgent, next_attempt) VALUES (?, ?, ?, ?, ?)`
+	result, err := tx.Exec(insertSQL, entry.RecipientID, msgID, entry.Payload, entry.Urgent, entry.NextAttempt)
+	if err != nil {
+		return 0, 0, 0, errors.Wrap(err, "unable to insert outbox entry")
+	}
+	entryID, err := result.LastInsertId()
+	if err != nil {
+		return 0, 0, 0, errors.Wrap(err, "unable to retrieve id of new outbox entry")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, 0, 0, errors.Wrap(err, "failed to commit transaction")
+	}
+	return msgID, entryID, evictedID, nil
+}
+
+// makeRoomForMessage evicts the oldest message of the recipient that isn't
+// urgent when the recipient has maxQueued messages and msg is urgent. It
+// returns the id of the evicted message, or 0 if there was room.
+func (db sqliteDB) makeRoomForMessage(tx *sql.Tx, msg model.MessageRecord, maxQueued int64) (int64, error) {
+	var queued int64
+	err := tx.QueryRowContext(db.context(), "SELECT COUNT(*) FROM messages WHERE recipient_id=?", msg.RecipientID).Scan(&queued)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to count queued messages")
+	}
+	if queued < maxQueued {
+		return 0, nil
+	}
+	if !msg.Urgent {
+		return 0, model.ErrQueueFull
+	}
+
+	var evictedID int64
+	selectSQL := `SELECT id FROM messages WHERE recipient_id=? AND urgent=0 ORDER BY id LIMIT 1`
+	err = tx.QueryRowContext(db.context(), selectSQL, msg.RecipientID).Scan(&evictedID)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return 0, model.ErrQueueFull
+	default:
+		return 0, errors.Wrap(err, "unable to select message to evict")
+	}
+	if _, err = tx.ExecContext(db.context(), "DELETE FROM messages WHERE id=?", evictedID); err != nil {
+		return 0, errors.Wrap(err, "unable to evict message")
+	}
+	if _, err = tx.ExecContext(db.context(), "DELETE FROM outbox WHERE message_id=?", evictedID); err != nil {
+		return 0, errors.Wrap(err, "unable to delete outbox entry of evicted message")
+	}
+
+	return evictedID, nil
+}
+
+func (db sqliteDB) ClaimOutboxEntries(now, leaseUntil int64, limit int) ([]model.OutboxRecord, error) {
+	tx, err := db.beginTx()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to start a transaction")
+	}
+	defer tx.Rollback()
+
+	const selectSQL = `
+	SELECT id, recipient_id, message_id, payload, urgent, attempts, next_attempt
+	FROM outbox WHERE next_attempt<=? ORDER BY id LIMIT ?`
+	entries := make([]model.OutboxRecord, 0)
+	if err = tx.Select(&entries, selectSQL, now, limit); err != nil {
+		return nil, errors.Wrap(err, "unable to select outbox entries")
+	}
+	for i := range entries {
+		_, err = tx.Exec(`UPDATE outbox SET attempts=attempts+1, next_attempt=? WHERE id=?`, leaseUntil, entries[i].ID)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to claim outbox entry")
+		}
+		entries[i].Attempts++
+		entries[i].NextAttempt = leaseUntil
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, errors.Wrap(err, "failed to commit transaction")
+	}
+	return entries, nil
+}
+
+func (db sqliteDB) DeleteOutboxEntry(id int64) error {
+	_, err := db.dbx.ExecContext(db.context(), "DELETE FROM outbox WHERE id=?", id)
+	if err != nil {
+		return errors.Wrap(err, "unable to delete outbox entry")
+	}
+	return nil
+}
+
+func (db sqliteDB) OutboxSize() (int64, error) {
+	var n int64
+	err := db.dbx.QueryRowContext(db.context(), "SELECT COUNT(*) FROM outbox").Scan(&n)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to count outbox entries")
+	}
+	return n, nil
+}
+
+func (db sqliteDB) OutboxEntries(afterID int64, limit int) ([]model.OutboxRecord, error) {
+	const selectSQL = `
+	SELECT id, recipient_id, message_id, payload, urgent, attempts, next_attempt
+	FROM outbox WHERE id>? ORDER BY id LIMIT ?`
+	entries := make([]model.OutboxRecord, 0)
+	if err := db.dbx.SelectContext(db.context(), &entries, selectSQL, afterID, limit); err != nil {
+		return nil, errors.Wrap(err, "unable to select outbox entries")
+	}
+	return entries, nil
+}
+
+func (db sqliteDB) UpdateOutboxPayload(id int64, payload []byte) error {
+	_, err := db.dbx.ExecContext(db.context(), "UPDATE outbox SET payload=? WHERE id=?", payload, id)
+	if err != nil {
+		return errors.Wrap(err, "unable to update outbox entry")
+	}
+	return nil
+}
+
 func (db sqliteDB) InsertSessionChallenge(userID int64, creationDate int64, challenge []byte) error {
 	insertSQL := `
 	INSERT INTO session_challenges (user_id, creation_date, challenge) VALUES (?, ?, ?)`
-	_, err := db.dbx.Exec(insertSQL, userID, creationDate, challenge)
+	_, err := db.dbx.ExecContext(db.context(), insertSQL, userID, creationDate, challenge)
 	if err != nil {
 		return errors.Wrap(err, "Unable to insert session challenge")
 	}
@@ -298,11 +866,11 @@ func (db sqliteDB) InsertSessionChallenge(userID int64, creationDate int64, chal
 	return nil
 }
 
-func (db sqliteDB) InsertTicket(ticket string, userID int64) error {
+func (db sqliteDB) InsertTicket(ticket string, userID int64, scopes string) error {
 	_, err := squirrel.Insert(tableTickets).
-		Columns("ticket", "user_id").
-		Values(ticket, userID).
-		RunWith(db.dbx.DB).Exec()
+		Columns("ticket", "user_id", "scopes").
+		Values(ticket, userID, scopes).
+		RunWith(db.dbx.DB).ExecContext(db.context())
 	return err
 }
 
@@ -318,7 +886,10 @@ func (db sqliteDB) InsertUser(user model.UserRecord, verificationToken *string)
 						wrapped_secret_key,
 						wrapped_secret_key_nonce,
 						wrapped_symmetric_key,
-						wrapped_symmetric_key_nonce)
+						wrapped_symmetric_key_nonce,
+						username_index,
+						locale,
+						created_at)
 						VALUES (:username,
 								:password_salt,
 								:password_hash_algorithm,
@@ -328,8 +899,11 @@ func (db sqliteDB) InsertUser(user model.UserRecord, verificationToken *string)
 								:wrapped_secret_key,
 								:wrapped_secret_key_nonce,
 								:wrapped_symmetric_key,
-								:wrapped_symmetric_key_nonce)`
-	tx, err := db.dbx.Beginx()
+								:wrapped_symmetric_key_nonce,
+								:username_index,
+								:locale,
+								:created_at)`
+	tx, err := db.beginTx()
 	if err != nil {
 		return 0, fmt.Errorf("unable to start transaction: %w", err)
 	}
@@ -366,7 +940,7 @@ func (db sqliteDB) InsertUser(user model.UserRecord, verificationToken *string)
 }
 
 func (db sqliteDB) LimitedUserInfo(username string) (id int64, pubKey []byte, err error) {
-	err = db.dbx.QueryRow("SELECT id, public_key FROM users WHERE username=?", username).Scan(&id, &pubKey)
+	err = db.dbx.QueryRowContext(db.context(), "SELECT id, public_key FROM users WHERE username=?", username).Scan(&id, &pubKey)
 	switch err {
 	case nil:
 		return id, pubKey, nil
@@ -377,8 +951,21 @@ func (db sqliteDB) LimitedUserInfo(username string) (id int64, pubKey []byte, er
 	}
 }
 
+// LimitedUserInfoIndex looks up a user by the blind index of their username
+func (db sqliteDB) LimitedUserInfoIndex(index []byte) (id int64, username string, pubKey []byte, err error) {
+	err = db.dbx.QueryRowContext(db.context(), "SELECT id, username, public_key FROM users WHERE username_index=?", index).Scan(&id, &username, &pubKey)
+	switch err {
+	case nil:
+		return id, username, pubKey, nil
+	case sql.ErrNoRows:
+		return 0, "", nil, nil
+	default:
+		return 0, "", nil, err
+	}
+}
+
 func (db sqliteDB) LimitedUserInfoID(userID int64) (username string, pubKey []byte, err error) {
-	err = db.dbx.QueryRow("SELECT username, public_key FROM users WHERE id=?", userID).Scan(&username, &pubKey)
+	err = db.dbx.QueryRowContext(db.context(), "SELECT username, public_key FROM users WHERE id=?", userID).Scan(&username, &pubKey)
 	switch err {
 	case nil:
 		return username, pubKey, nil
@@ -390,30 +977,47 @@ func (db sqliteDB) LimitedUserInfoID(userID int64) (username string, pubKey []by
 }
 
 func (db sqliteDB) MessageRecords(recipientID int64) ([]model.MessageRecord, error) {
+	msgs := make([]model.MessageRecord, 0)
+	err := db.EachMessageRecord(recipientID, func(msg model.MessageRecord) error {
+		msgs = append(msgs, msg)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return msgs, nil
+}
+
+func (db sqliteDB) EachMessageRecord(recipientID int64, fn func(model.MessageRecord) error) error {
 	selectSQL := `
-	SELECT id, recipient_id, sender_id, cipher_text, nonce, sent_date FROM messages WHERE recipient_id=?`
-	rows, err := db.dbx.Queryx(selectSQL, recipientID)
+	SELECT id, recipient_id, sender_id, cipher_text, nonce, sent_date, sealed, system, urgent FROM messages WHERE recipient_id=? ORDER BY id`
+	rows, err := db.dbx.QueryxContext(db.context(), selectSQL, recipientID)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to execute select on messages table")
+		return errors.Wrap(err, "unable to execute select on messages table")
 	}
 	defer rows.Close()
 
-	msgs := make([]model.MessageRecord, 0)
 	for rows.Next() {
 		msg := model.MessageRecord{}
 		err = rows.StructScan(&msg)
 		if err != nil {
-			return nil, errors.Wrap(err, "unable to scan a row")
+			return errors.Wrap(err, "unable to scan a row")
+		}
+		if err = fn(msg); err != nil {
+			return err
 		}
-		msgs = append(msgs, msg)
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Wrap(err, "unable to read the messages")
 	}
 
-	return msgs, nil
+	return nil
 }
 
 func (db sqliteDB) schemaVersion() int {
 	var v int
-	err := db.dbx.QueryRow("PRAGMA user_version;").Scan(&v)
+	err := db.dbx.QueryRowContext(db.context(), "PRAGMA user_version;").Scan(&v)
 	if err != nil {
 		log.Printf("There is no reason 'PRAMGA user_version' should fail: %v", err)
 		panic(err)
@@ -429,9 +1033,9 @@ func (db sqliteDB) setSchemaVersion(tx *sqlx.Tx, version int) error {
 
 func (db sqliteDB) MessageToRecipient(recipientID, msgID int64) (*model.MessageRecord, error) {
 	selectSQL := `
-	SELECT id, recipient_id, sender_id, cipher_text, nonce, sent_date FROM messages WHERE recipient_id=? AND id=?`
+	SELECT id, recipient_id, sender_id, cipher_text, nonce, sent_date, sealed, system, urgent FROM messages WHERE recipient_id=? AND id=?`
 	msg := model.MessageRecord{}
-	err := db.dbx.Get(&msg, selectSQL, recipientID, msgID)
+	err := db.dbx.GetContext(db.context(), &msg, selectSQL, recipientID, msgID)
 	switch err {
 	case nil:
 	case sql.ErrNoRows:
@@ -443,10 +1047,78 @@ func (db sqliteDB) MessageToRecipient(recipientID, msgID int64) (*model.MessageR
 	return &msg, nil
 }
 
+// MessagesToRecipient returns the messages of recipientID among msgIDs, in
+// order of id. Ids of missing messages, or messages belonging to another
+// user, are skipped.
+func (db sqliteDB) MessagesToRecipient(recipientID int64, msgIDs []int64) ([]model.MessageRecord, error) {
+	msgs := make([]model.MessageRecord, 0, len(msgIDs))
+	if len(msgIDs) == 0 {
+		return msgs, nil
+	}
+	query, args, err := squirrel.Select("id", "recipient_id", "sender_id", "cipher_text", "nonce", "sent_date", "sealed", "system", "urgent").
+		From("messages").
+		Where(squirrel.Eq{"recipient_id": recipientID, "id": msgIDs}).
+		OrderBy("id").
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+	if err = db.dbx.SelectContext(db.context(), &msgs, query, args...); err != nil {
+		return nil, errors.Wrap(err, "selecting messages failed")
+	}
+
+	return msgs, nil
+}
+
+func (db sqliteDB) RefreshToken(token string) (*model.RefreshTokenRecord, error) {
+	const query = `
+	SELECT id, user_id, expires_at, platform, app_version, device_model, created_at, last_used, user_agent, ip_prefix
+	FROM refresh_tokens WHERE token=?`
+	rtr := model.RefreshTokenRecord{Token: token}
+	err := db.dbx.QueryRowxContext(db.context(), query, token).StructScan(&rtr)
+	switch err {
+	case nil:
+		return &rtr, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+func (db sqliteDB) RotateRefreshToken(old, new string, expiresAt int64) (bool, error) {
+	tx, err := db.beginTx()
+	if err != nil {
+		return false, errors.Wrap(err, "unable to start a transaction")
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE refresh_tokens SET token=?, expires_at=? WHERE token=?`, new, expiresAt, old)
+	if err != nil {
+		return false, errors.Wrap(err, "unable to update the refresh token")
+	}
+	rotated, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "unable to count updated refresh tokens")
+	}
+	if rotated == 0 {
+		return false, nil
+	}
+	_, err = tx.Exec(`UPDATE sessions SET refresh_token=? WHERE refresh_token=?`, new, old)
+	if err != nil {
+		return false, errors.Wrap(err, "unable to update access tokens of the refresh token")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return false, errors.Wrap(err, "failed to commit transaction")
+	}
+	return true, nil
+}
+
 func (db sqliteDB) ReplaceAPNSToken(old, new string) (rowsAffected int64, err error) {
 	const query = `UPDATE user_apns_tokens SET token=? WHERE token=?`
 	var result sql.Result
-	result, err = db.dbx.Exec(query, new, old)
+	result, err = db.dbx.ExecContext(db.context(), query, new, old)
 	if err != nil {
 		return 0, errors.Wrap(err, "Failed to execute update query")
 	}
@@ -460,7 +1132,7 @@ func (db sqliteDB) ReplaceAPNSToken(old, new string) (rowsAffected int64, err er
 func (db sqliteDB) ReplaceFCMToken(old, new string) (rowsAffected int64, err error) {
 	const query = `UPDATE user_fcm_tokens SET token=? WHERE token=?`
 	var result sql.Result
-	result, err = db.dbx.Exec(query, new, old)
+	result, err = db.dbx.ExecContext(db.context(), query, new, old)
 	if err != nil {
 		return 0, errors.Wrap(err, "Failed to execute update query")
 	}
@@ -473,9 +1145,9 @@ func (db sqliteDB) ReplaceFCMToken(old, new string) (rowsAffected int64, err err
 
 func (db sqliteDB) SessionChallenge(userID int64) (*model.SessionChallengeRecord, error) {
 	const challengeSQL = `
-	SELECT id, creation_date, challenge FROM session_challenges WHERE user_id=?`
+	SELECT id, creation_date, challenge, used FROM session_challenges WHERE user_id=?`
 	var challenge model.SessionChallengeRecord
-	err := db.dbx.QueryRowx(challengeSQL, userID).StructScan(&challenge)
+	err := db.dbx.QueryRowxContext(db.context(), challengeSQL, userID).StructScan(&challenge)
 	switch err {
 	case nil:
 		challenge.UserID = userID
@@ -487,35 +1159,151 @@ func (db sqliteDB) SessionChallenge(userID int64) (*model.SessionChallengeRecord
 	}
 }
 
-func (db sqliteDB) Ticket(ticket string) (userID, timestamp int64, err error) {
-	err = squirrel.Select("user_id", "timestamp").
-		From(tableTickets).
-		Where(squirrel.Eq{"ticket": ticket}).
-		RunWith(db.dbx.DB).
-		QueryRow().
-		Scan(&userID, &timestamp)
+func (db sqliteDB) SessionChallengeCount() (int64, error) {
+	var count int64
+	err := db.dbx.QueryRowContext(db.context(), "SELECT COUNT(*) FROM session_challenges").Scan(&count)
+	return count, err
+}
+
+// Sessions returns the user's sessions that are still active at now, the
+// ones used last first
+func (db sqliteDB) Sessions(userID, now int64) ([]model.RefreshTokenRecord, error) {
+	const query = `
+	SELECT id, token, user_id, expires_at, platform, app_version, device_model, created_at, last_used, user_agent, ip_prefix
+	FROM refresh_tokens WHERE user_id=? AND expires_at>=? ORDER BY last_used DESC, id DESC`
+	sessions := make([]model.RefreshTokenRecord, 0)
+	if err := db.dbx.SelectContext(db.context(), &sessions, query, userID, now); err != nil {
+		return nil, errors.Wrap(err, "failed to select sessions")
+	}
+	return sessions, nil
+}
+
+func (db sqliteDB) Ticket(ticket string) (*model.TicketRecord, error) {
+	const query = `
+	SELECT t.user_id, t.timestamp, t.scopes, COALESCE(u.status, '') AS status,
+		COALESCE(u.suspended_until, 0) AS suspended_until, COALESCE(u.status_reason, '') AS status_reason
+	FROM tickets t LEFT JOIN users u ON u.id=t.user_id
+	WHERE t.ticket=?`
+	tr := model.TicketRecord{}
+	err := db.dbx.GetContext(db.context(), &tr, query, ticket)
 	switch err {
 	case nil:
-		return userID, timestamp, nil
+		return &tr, nil
 	case sql.ErrNoRows:
-		return 0, 0, nil
+		return nil, nil
 	default:
-		return 0, 0, err
+		return nil, err
+	}
+}
+
+func (db sqliteDB) TouchSession(refreshToken string, lastUsed int64) error {
+	const query = `UPDATE refresh_tokens SET last_used=? WHERE token=?`
+	_, err := db.dbx.ExecContext(db.context(), query, lastUsed, refreshToken)
+	return err
+}
+
+func (db sqliteDB) UseSessionChallenge(id int64) (bool, error) {
+	result, err := db.dbx.ExecContext(db.context(), "UPDATE session_challenges SET used=1 WHERE id=? AND used=0", id)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected == 1, err
+}
+
+func (db sqliteDB) UpdateUserIDOfAPNSToken(newUserID int64, token string, client model.ClientRecord) error {
+	const query = `UPDATE user_apns_tokens SET user_id=?, platform=?, app_version=?, device_model=? WHERE token=?`
+	_, err := db.dbx.ExecContext(db.context(), query, newUserID, client.Platform, client.AppVersion, client.DeviceModel, token)
+	return err
+}
+
+func (db sqliteDB) UpdateUserIDOfFCMToken(newUserID int64, token string, client model.ClientRecord) error {
+	const query = `UPDATE user_fcm_tokens SET user_id=?, platform=?, app_version=?, device_model=? WHERE token=?`
+	_, err := db.dbx.ExecContext(db.context(), query, newUserID, client.Platform, client.AppVersion, client.DeviceModel, token)
+	return err
+}
+
+// UsernamesWithoutIndex returns the usernames, keyed by user id, of users
+// whose username_index hasn't been set
+func (db sqliteDB) UsernamesWithoutIndex() (map[int64]string, error) {
+	rows, err := db.dbx.QueryContext(db.context(), "SELECT id, username FROM users WHERE username_index IS NULL")
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to select users without a username index")
+	}
+	defer rows.Close()
+
+	usernames := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var username string
+		if err = rows.Scan(&id, &username); err != nil {
+			return nil, errors.Wrap(err, "unable to scan a row")
+		}
+		usernames[id] = username
+	}
+
+	return usernames, rows.Err()
+}
+
+// UsersWithIndexPrefix returns up to limit users whose username_index
+// starts with prefix
+func (db sqliteDB) UsersWithIndexPrefix(prefix []byte, limit int) ([]model.UserIndexRecord, error) {
+	// blobs compare with memcmp, so a range query over the prefix can use the
+	// index on username_index
+	query := "SELECT id, public_key, username_index FROM users WHERE username_index >= ?"
+	args := []interface{}{prefix}
+	if upper := prefixUpperBound(prefix); upper != nil {
+		query += " AND username_index < ?"
+		args = append(args, upper)
+	}
+	query += " ORDER BY username_index LIMIT ?"
+	args = append(args, limit)
+
+	users := make([]model.UserIndexRecord, 0)
+	if err := db.dbx.SelectContext(db.context(), &users, query, args...); err != nil {
+		return nil, errors.Wrap(err, "unable to select users by index prefix")
 	}
+
+	return users, nil
 }
 
-func (db sqliteDB) UpdateUserIDOfAPNSToken(newUserID int64, token string) error {
-	const query = `UPDATE user_apns_tokens SET user_id=? WHERE token=?`
-	_, err := db.dbx.Exec(query, newUserID, token)
+// prefixUpperBound returns the smallest value greater than every value that
+// starts with prefix, or nil if there isn't one (i.e. prefix is all 0xff).
+func prefixUpperBound(prefix []byte) []byte {
+	upper := append([]byte{}, prefix...)
+	for i := len(upper) - 1; i >= 0; i-- {
+		if upper[i] < 0xff {
+			upper[i]++
+			return upper[:i+1]
+		}
+	}
+	return nil
+}
+
+func (db sqliteDB) SetUsernameIndex(userID int64, index []byte) error {
+	_, err := db.dbx.ExecContext(db.context(), "UPDATE users SET username_index=? WHERE id=?", index, userID)
 	return err
 }
 
-func (db sqliteDB) UpdateUserIDOfFCMToken(newUserID int64, token string) error {
-	const query = `UPDATE user_fcm_tokens SET user_id=? WHERE token=?`
-	_, err := db.dbx.Exec(query, newUserID, token)
+// SetUserLocale sets the locale that emails to the user are written in
+func (db sqliteDB) SetUserLocale(userID int64, locale string) error {
+	_, err := db.dbx.ExecContext(db.context(), "UPDATE users SET locale=? WHERE id=?", locale, userID)
 	return err
 }
 
+func (db sqliteDB) SetUserStatus(userID int64, status model.UserStatusRecord) (bool, error) {
+	const query = `UPDATE users SET status=?, suspended_until=?, status_reason=? WHERE id=?`
+	result, err := db.dbx.ExecContext(db.context(), query, status.Status, status.SuspendedUntil, status.StatusReason, userID)
+	if err != nil {
+		return false, errors.Wrap(err, "unable to set user status")
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
 func (db sqliteDB) User(username string) (*model.UserRecord, error) {
 	query := `
 	SELECT 	id,
@@ -529,10 +1317,16 @@ func (db sqliteDB) User(username string) (*model.UserRecord, error) {
 			password_hash_algorithm,
 			password_hash_operations_limit,
 			password_hash_memory_limit,
-			email
+			email,
+			locale,
+			undeliverable_email,
+			created_at,
+			status,
+			suspended_until,
+			status_reason
 	FROM users WHERE username=?`
 	user := model.UserRecord{}
-	err := db.dbx.Get(&user, query, username)
+	err := db.dbx.GetContext(db.context(), &user, query, username)
 	switch err {
 	case nil:
 		return &user, nil
@@ -543,19 +1337,108 @@ func (db sqliteDB) User(username string) (*model.UserRecord, error) {
 	}
 }
 
+func (db sqliteDB) UserDataSummary(userID, now int64) (*model.UserDataSummary, error) {
+	const query = `
+	SELECT	(SELECT COUNT(*) FROM messages WHERE recipient_id=?) AS pending_messages,
+			(SELECT IFNULL(SUM(LENGTH(cipher_text)), 0) FROM messages WHERE recipient_id=?) AS pending_message_bytes,
+			(SELECT COUNT(*) FROM user_apns_tokens WHERE user_id=?) AS apns_tokens,
+			(SELECT COUNT(*) FROM user_fcm_tokens WHERE user_id=?) AS fcm_tokens,
+			(SELECT COUNT(*) FROM sessions WHERE user_id=? AND expires_at>=?) AS active_sessions`
+	summary := model.UserDataSummary{}
+	err := db.dbx.GetContext(db.context(), &summary, query, userID, userID, userID, userID, userID, now)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to summarize user data")
+	}
+
+	return &summary, nil
+}
+
 func (db sqliteDB) Username(userID int64) string {
 	var username sql.NullString
-	err := db.dbx.QueryRow("SELECT username FROM users WHERE id=?", userID).Scan(&username)
+	err := db.dbx.QueryRowContext(db.context(), "SELECT username FROM users WHERE id=?", userID).Scan(&username)
 	if err != nil {
 		return ""
 	}
 	return username.String
 }
 
+func (db sqliteDB) RecentUsers(beforeID int64, limit int) ([]model.UserRecord, error) {
+	query := `SELECT id, username, email, locale, created_at, status, suspended_until, status_reason FROM users`
+	args := []interface{}{}
+	if beforeID > 0 {
+		query += " WHERE id<?"
+		args = append(args, beforeID)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	users := make([]model.UserRecord, 0)
+	if err := db.dbx.SelectContext(db.context(), &users, query, args...); err != nil {
+		return nil, errors.Wrap(err, "unable to select recent users")
+	}
+	return users, nil
+}
+
+// ReserveUsernames keeps usernames from being registered, unless the user
+// signs up with email. An empty email reserves them for nobody. Existing
+// reservations of the usernames are replaced.
+func (db sqliteDB) ReserveUsernames(usernames []string, email, note string) error {
+	tx, err := db.beginTx()
+	if err != nil {
+		return errors.Wrap(err, "unable to start a transaction")
+	}
+	defer tx.Rollback()
+
+	for _, username := range usernames {
+		_, err = tx.Exec(`INSERT OR REPLACE INTO reserved_usernames (username, email, note) VALUES (?, ?, ?)`, username, email, note)
+		if err != nil {
+			return errors.Wrapf(err, "unable to reserve '%s'", username)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errors.Wrap(err, "failed to commit transaction")
+	}
+	return nil
+}
+
+func (db sqliteDB) ReservedUsername(username string) (*model.ReservedUsernameRecord, error) {
+	const query = `SELECT username, email, note, created_at FROM reserved_usernames WHERE username=?`
+	rec := model.ReservedUsernameRecord{}
+	err := db.dbx.GetContext(db.context(), &rec, query, username)
+	switch err {
+	case nil:
+		return &rec, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, errors.Wrap(err, "failed to select reserved username")
+	}
+}
+
+func (db sqliteDB) ReservedUsernames() ([]model.ReservedUsernameRecord, error) {
+	const query = `SELECT username, email, note, created_at FROM reserved_usernames ORDER BY username`
+	recs := make([]model.ReservedUsernameRecord, 0)
+	err := db.dbx.SelectContext(db.context(), &recs, query)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to select reserved usernames")
+	}
+	return recs, nil
+}
+
+func (db sqliteDB) DeleteReservedUsername(username string) (bool, error) {
+	result, err := db.dbx.ExecContext(db.context(), "DELETE FROM reserved_usernames WHERE username=?", username)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to delete reserved username")
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
 func (db sqliteDB) UsernameAvailable(username string) (bool, error) {
 	checkUsernameSQL := "SELECT id FROM users WHERE username=?"
 	var foundID int
-	err := db.dbx.QueryRow(checkUsernameSQL, username).Scan(&foundID)
+	err := db.dbx.QueryRowContext(db.context(), checkUsernameSQL, username).Scan(&foundID)
 	switch err {
 	case nil:
 		return false, nil
@@ -569,7 +1452,7 @@ func (db sqliteDB) UsernameAvailable(username string) (bool, error) {
 func (db sqliteDB) UserPublicKey(userID int64) ([]byte, error) {
 	selectSQL := `SELECT public_key FROM users WHERE id=?`
 	var pubKey []byte
-	err := db.dbx.QueryRow(selectSQL, userID).Scan(&pubKey)
+	err := db.dbx.QueryRowContext(db.context(), selectSQL, userID).Scan(&pubKey)
 	switch err {
 	case nil:
 		return pubKey, nil
@@ -580,14 +1463,71 @@ func (db sqliteDB) UserPublicKey(userID int64) ([]byte, error) {
 	}
 }
 
+// SuppressEmail stops email from being sent to, and removes it from the
+// users that verified it, along with any pending verifications of it. The
+// users keep it as their undeliverable email until they verify another. It
+// returns the number of users the address was removed from.
+func (db sqliteDB) SuppressEmail(email, reason string) (int64, error) {
+	tx, err := db.beginTx()
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to start a transaction")
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT OR REPLACE INTO suppressed_emails (email, reason) VALUES (?, ?)`, email, reason)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to insert suppressed email")
+	}
+	result, err := tx.Exec(`UPDATE users SET undeliverable_email=email, email=NULL WHERE email=?`, email)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to update users table")
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to count updated users")
+	}
+	_, err = tx.Exec(`DELETE FROM email_verification_tokens WHERE email=?`, email)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to delete verification tokens")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, errors.Wrap(err, "failed to commit transaction")
+	}
+	return affected, nil
+}
+
+// EmailSuppressed returns true if email was suppressed by SuppressEmail
+func (db sqliteDB) EmailSuppressed(email string) (bool, error) {
+	var found string
+	err := db.dbx.QueryRowContext(db.context(), "SELECT email FROM suppressed_emails WHERE email=?", email).Scan(&found)
+	switch err {
+	case nil:
+		return true, nil
+	case sql.ErrNoRows:
+		return false, nil
+	default:
+		return false, errors.Wrap(err, "error checking if email is suppressed")
+	}
+}
+
+// InsertAuditLogEntry records an action taken by actor
+func (db sqliteDB) InsertAuditLogEntry(actor, action, details string) error {
+	_, err := db.dbx.ExecContext(db.context(), "INSERT INTO audit_log (actor, action, details) VALUES (?, ?, ?)", actor, action, details)
+	if err != nil {
+		return errors.Wrap(err, "failed to insert audit log entry")
+	}
+	return nil
+}
+
 func (db sqliteDB) VerifyEmail(email string, userID int64) error {
-	tx, err := db.dbx.Begin()
+	tx, err := db.beginTx()
 	if err != nil {
 		return errors.Wrap(err, "unable to start a transaction")
 	}
 	defer tx.Rollback()
 
-	_, err = tx.Exec(`UPDATE users SET email=? WHERE id=?`, email, userID)
+	_, err = tx.Exec(`UPDATE users SET email=?, undeliverable_email=NULL WHERE id=?`, email, userID)
 	if err != nil {
 		return errors.Wrap(err, "unable to update users table")
 	}
@@ -1,10 +1,13 @@
 package sqlite
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"testing"
 	"time"
 
+	"github.com/mattn/go-sqlite3"
 	"github.com/stretchr/testify/require"
 	"zood.dev/oscar/model"
 )
@@ -12,11 +15,28 @@ import (
 func newDB(t *testing.T) sqliteDB {
 	t.Helper()
 
-	db, err := New(InMemoryDSN)
+	db, err := New(InMemoryDSN, Options{})
 	require.NoError(t, err)
 	return db.(sqliteDB)
 }
 
+func TestWithContext(t *testing.T) {
+	db := newDB(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	bound := db.WithContext(ctx)
+	_, err := bound.UsernameAvailable("arash")
+	require.NoError(t, err)
+
+	cancel()
+	_, err = bound.UsernameAvailable("arash")
+	require.True(t, errors.Is(err, context.Canceled), "Got: %v", err)
+
+	// the original provider isn't affected
+	_, err = db.UsernameAvailable("arash")
+	require.NoError(t, err)
+}
+
 func TestAccessTokens(t *testing.T) {
 	db := newDB(t)
 
@@ -31,8 +51,11 @@ func TestAccessTokens(t *testing.T) {
 			ExpiresAt: time.Now().Add(time.Duration(i) * time.Hour).Unix(),
 			UserID:    int64(i % 4),
 		}
+		if i%2 == 0 {
+			atr.ClientRecord = model.ClientRecord{Platform: "android", AppVersion: "1.4.2", DeviceModel: "Pixel 4a"}
+		}
 		goldenData = append(goldenData, atr)
-		err = db.InsertAccessToken(atr.Token, atr.UserID, atr.ExpiresAt)
+		err = db.InsertAccessToken(atr.Token, atr.UserID, atr.ExpiresAt, atr.ClientRecord)
 		require.NoError(t, err)
 	}
 
@@ -42,6 +65,217 @@ func TestAccessTokens(t *testing.T) {
 		require.NotNil(t, atr)
 		require.Equal(t, expected, *atr)
 	}
+
+	// the token that expires first is skipped
+	now := time.Now().Add(time.Minute).Unix()
+	tokens, err := db.AccessTokens("", now, 2)
+	require.NoError(t, err)
+	require.Equal(t, []string{"token-data-1", "token-data-2"}, tokens)
+	tokens, err = db.AccessTokens(tokens[1], now, 2)
+	require.NoError(t, err)
+	require.Equal(t, []string{"token-data-3", "token-data-4"}, tokens)
+	tokens, err = db.AccessTokens(tokens[1], now, 2)
+	require.NoError(t, err)
+	require.Empty(t, tokens)
+
+	require.NoError(t, db.InsertScopedAccessToken("scoped", 1, now, "messages-read drop-box-read-only"))
+	atr, err := db.AccessToken("scoped")
+	require.NoError(t, err)
+	require.Equal(t, "messages-read drop-box-read-only", atr.Scopes)
+}
+
+func TestDeleteAccessTokens(t *testing.T) {
+	db := newDB(t)
+
+	expiresAt := time.Now().Add(time.Hour).Unix()
+	require.NoError(t, db.InsertAccessToken("first", 1, expiresAt, model.ClientRecord{}))
+	require.NoError(t, db.InsertAccessToken("second", 1, expiresAt, model.ClientRecord{}))
+	require.NoError(t, db.InsertAccessToken("third", 1, expiresAt, model.ClientRecord{}))
+	require.NoError(t, db.InsertAccessToken("others", 2, expiresAt, model.ClientRecord{}))
+
+	require.NoError(t, db.DeleteAccessToken("first"))
+	atr, err := db.AccessToken("first")
+	require.NoError(t, err)
+	require.Nil(t, atr)
+
+	deleted, err := db.DeleteAccessTokensOfUser(1)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), deleted)
+	atr, err = db.AccessToken("others")
+	require.NoError(t, err)
+	require.NotNil(t, atr)
+}
+
+func TestRefreshTokens(t *testing.T) {
+	db := newDB(t)
+
+	ios := model.ClientRecord{Platform: "ios", AppVersion: "2.1", DeviceModel: "iPhone12,1"}
+	expiresAt := time.Now().Add(time.Hour).Unix()
+	require.NoError(t, db.InsertRefreshToken(model.RefreshTokenRecord{Token: "refresh", UserID: 1, ExpiresAt: expiresAt, ClientRecord: ios, LastUsed: 100}))
+	require.NoError(t, db.InsertRefreshToken(model.RefreshTokenRecord{Token: "other-refresh", UserID: 1, ExpiresAt: expiresAt, ClientRecord: ios}))
+	require.NoError(t, db.InsertRefreshedAccessToken("first", "refresh", expiresAt))
+	require.NoError(t, db.InsertRefreshedAccessToken("second", "refresh", expiresAt))
+	require.NoError(t, db.InsertRefreshedAccessToken("other", "other-refresh", expiresAt))
+	require.Error(t, db.InsertRefreshedAccessToken("orphan", "unknown", expiresAt))
+
+	rtr, err := db.RefreshToken("refresh")
+	require.NoError(t, err)
+	require.Equal(t, &model.RefreshTokenRecord{ID: 1, Token: "refresh", UserID: 1, ExpiresAt: expiresAt, ClientRecord: ios, LastUsed: 100}, rtr)
+	// access tokens take the user and client of their refresh token
+	atr, err := db.AccessToken("first")
+	require.NoError(t, err)
+	require.Equal(t, &model.AccessTokenRecord{Token: "first", UserID: 1, ExpiresAt: expiresAt, ClientRecord: ios, RefreshToken: "refresh", SessionLastUsed: 100}, atr)
+	require.NoError(t, db.TouchSession("refresh", 200))
+	atr, err = db.AccessToken("second")
+	require.NoError(t, err)
+	require.Equal(t, int64(200), atr.SessionLastUsed)
+
+	// deleting an access token revokes its refresh token, and the other
+	// access tokens issued from it
+	require.NoError(t, db.DeleteAccessToken("first"))
+	rtr, err = db.RefreshToken("refresh")
+	require.NoError(t, err)
+	require.Nil(t, rtr)
+	atr, err = db.AccessToken("second")
+	require.NoError(t, err)
+	require.Nil(t, atr)
+	atr, err = db.AccessToken("other")
+	require.NoError(t, err)
+	require.NotNil(t, atr)
+
+	// rotating keeps the access tokens issued from the old refresh token
+	rotated, err := db.RotateRefreshToken("other-refresh", "rotated", expiresAt+60)
+	require.NoError(t, err)
+	require.True(t, rotated)
+	rotated, err = db.RotateRefreshToken("other-refresh", "again", expiresAt+60)
+	require.NoError(t, err)
+	require.False(t, rotated)
+	rtr, err = db.RefreshToken("rotated")
+	require.NoError(t, err)
+	require.Equal(t, expiresAt+60, rtr.ExpiresAt)
+	require.NoError(t, db.DeleteAccessToken("other"))
+	rtr, err = db.RefreshToken("rotated")
+	require.NoError(t, err)
+	require.Nil(t, rtr)
+
+	require.NoError(t, db.InsertRefreshToken(model.RefreshTokenRecord{Token: "last-refresh", UserID: 1, ExpiresAt: expiresAt, ClientRecord: ios}))
+	require.NoError(t, db.InsertRefreshedAccessToken("last", "last-refresh", expiresAt))
+	deleted, err := db.DeleteAccessTokensOfUser(1)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), deleted)
+	rtr, err = db.RefreshToken("last-refresh")
+	require.NoError(t, err)
+	require.Nil(t, rtr)
+}
+
+func TestDeleteExpiredRefreshTokens(t *testing.T) {
+	db := newDB(t)
+
+	now := time.Now().Unix()
+	require.NoError(t, db.InsertRefreshToken(model.RefreshTokenRecord{Token: "expired", UserID: 1, ExpiresAt: now - 1}))
+	require.NoError(t, db.InsertRefreshToken(model.RefreshTokenRecord{Token: "current", UserID: 1, ExpiresAt: now + 60}))
+
+	deleted, err := db.DeleteExpiredRefreshTokens(now)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), deleted)
+
+	rtr, err := db.RefreshToken("expired")
+	require.NoError(t, err)
+	require.Nil(t, rtr)
+	rtr, err = db.RefreshToken("current")
+	require.NoError(t, err)
+	require.NotNil(t, rtr)
+}
+
+func TestDeleteExpiredAccessTokens(t *testing.T) {
+	db := newDB(t)
+
+	now := time.Now().Unix()
+	require.NoError(t, db.InsertAccessToken("expired", 1, now-1, model.ClientRecord{}))
+	require.NoError(t, db.InsertAccessToken("current", 1, now+60, model.ClientRecord{}))
+
+	deleted, err := db.DeleteExpiredAccessTokens(now)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), deleted)
+
+	atr, err := db.AccessToken("expired")
+	require.NoError(t, err)
+	require.Nil(t, atr)
+	atr, err = db.AccessToken("current")
+	require.NoError(t, err)
+	require.NotNil(t, atr)
+}
+
+func TestSessions(t *testing.T) {
+	db := newDB(t)
+
+	ios := model.ClientRecord{Platform: "ios", AppVersion: "2.1", DeviceModel: "iPhone12,1"}
+	newer := model.RefreshTokenRecord{Token: "newer", UserID: 1, ExpiresAt: 1500, ClientRecord: ios,
+		CreatedAt: 100, LastUsed: 900, UserAgent: "Oscar/2.1", IPPrefix: "203.0.113.0/24"}
+	for _, rtr := range []model.RefreshTokenRecord{
+		{Token: "expired", UserID: 1, ExpiresAt: 999, ClientRecord: ios, LastUsed: 950},
+		{Token: "older", UserID: 1, ExpiresAt: 2000, LastUsed: 500},
+		newer,
+		{Token: "other-user", UserID: 2, ExpiresAt: 2000, ClientRecord: ios},
+	} {
+		require.NoError(t, db.InsertRefreshToken(rtr))
+	}
+	require.NoError(t, db.InsertRefreshedAccessToken("newer-access", "newer", 1500))
+
+	sessions, err := db.Sessions(1, 1000)
+	require.NoError(t, err)
+	newer.ID = 3
+	require.Equal(t, []model.RefreshTokenRecord{
+		newer,
+		{ID: 2, Token: "older", UserID: 1, ExpiresAt: 2000, LastUsed: 500},
+	}, sessions)
+
+	sessions, err = db.Sessions(3, 1000)
+	require.NoError(t, err)
+	require.Empty(t, sessions)
+
+	// only the user's own sessions can be deleted, along with their access
+	// tokens
+	deleted, err := db.DeleteSession(2, newer.ID)
+	require.NoError(t, err)
+	require.False(t, deleted)
+	deleted, err = db.DeleteSession(1, newer.ID)
+	require.NoError(t, err)
+	require.True(t, deleted)
+	atr, err := db.AccessToken("newer-access")
+	require.NoError(t, err)
+	require.Nil(t, atr)
+	sessions, err = db.Sessions(1, 1000)
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+}
+
+func TestClientCounts(t *testing.T) {
+	db := newDB(t)
+
+	android := model.ClientRecord{Platform: "android", AppVersion: "1.4.2", DeviceModel: "Pixel 4a"}
+	ios := model.ClientRecord{Platform: "ios", AppVersion: "2.1", DeviceModel: "iPhone12,1"}
+	require.NoError(t, db.InsertAccessToken("expired", 1, 999, android))
+	require.NoError(t, db.InsertAccessToken("android-1", 1, 2000, android))
+	require.NoError(t, db.InsertAccessToken("android-2", 2, 2000, model.ClientRecord{Platform: "android", AppVersion: "1.4.2", DeviceModel: "Pixel 5"}))
+	require.NoError(t, db.InsertAccessToken("ios", 3, 2000, ios))
+	require.NoError(t, db.InsertFCMToken(1, "fcm-token", android))
+	require.NoError(t, db.InsertAPNSToken(3, "apns-token", ios))
+	require.NoError(t, db.InsertAPNSToken(4, "old-apns-token", model.ClientRecord{}))
+
+	counts, err := db.ClientCounts(1000)
+	require.NoError(t, err)
+	require.Equal(t, []model.ClientCountRecord{
+		{Platform: "", AppVersion: "", Sessions: 0, PushTokens: 1},
+		{Platform: "android", AppVersion: "1.4.2", Sessions: 2, PushTokens: 1},
+		{Platform: "ios", AppVersion: "2.1", Sessions: 1, PushTokens: 1},
+	}, counts)
+
+	// re-registering a token moves it to the new build
+	require.NoError(t, db.UpdateUserIDOfAPNSToken(3, "apns-token", model.ClientRecord{Platform: "ios", AppVersion: "2.2"}))
+	atr, err := db.APNSToken("apns-token")
+	require.NoError(t, err)
+	require.Equal(t, "2.2", atr.AppVersion)
 }
 
 func TestEmailVerification(t *testing.T) {
@@ -104,6 +338,46 @@ func TestEmailVerification(t *testing.T) {
 	require.Equal(t, user, *actual)
 }
 
+func TestInsertEmailVerificationToken(t *testing.T) {
+	db := newDB(t)
+
+	email := "pam@dundermifflin.com"
+	user := model.UserRecord{
+		PasswordSalt:                []byte("salt"),
+		PasswordHashAlgorithm:       "argon2id13",
+		PasswordHashOperationsLimit: 1,
+		PasswordHashMemoryLimit:     1,
+		PublicKey:                   []byte("public-key"),
+		WrappedSecretKey:            []byte("wrapped-secret-key"),
+		WrappedSecretKeyNonce:       []byte("wrapped-secret-key-nonce"),
+		WrappedSymmetricKey:         []byte("wrapped-symmetric-key"),
+		WrappedSymmetricKeyNonce:    []byte("wrapped-symmetric-key-nonce"),
+		Username:                    "pam",
+	}
+	var err error
+	user.ID, err = db.InsertUser(user, nil)
+	require.NoError(t, err)
+	require.NoError(t, db.VerifyEmail(email, user.ID))
+
+	require.NoError(t, db.InsertEmailVerificationToken(user.ID, "pam@example.com", "second-token"))
+	require.NoError(t, db.InsertEmailVerificationToken(user.ID, "pam@example.org", "third-token"))
+
+	// only the latest request can be verified
+	tr, err := db.EmailVerificationTokenRecord("second-token")
+	require.NoError(t, err)
+	require.Nil(t, tr)
+	tr, err = db.EmailVerificationTokenRecord("third-token")
+	require.NoError(t, err)
+	require.NotNil(t, tr)
+	require.Equal(t, "pam@example.org", tr.Email)
+	require.Equal(t, user.ID, tr.UserID)
+
+	// the verified address is kept until then
+	actual, err := db.User(user.Username)
+	require.NoError(t, err)
+	require.Equal(t, email, *actual.Email)
+}
+
 func TestDisavowEmail(t *testing.T) {
 	db := newDB(t)
 
@@ -227,6 +501,141 @@ func TestMessagesPart2(t *testing.T) {
 	require.Nil(t, actual)
 }
 
+func TestMessagesToRecipient(t *testing.T) {
+	db := newDB(t)
+
+	msgs, err := db.MessagesToRecipient(2, nil)
+	require.NoError(t, err)
+	require.Empty(t, msgs)
+
+	var ids []int64
+	for _, recipientID := range []int64{2, 2, 3} {
+		id, err := db.InsertMessage(recipientID, 4, []byte("cipher-text"), []byte("nonce"), 19495478)
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+
+	msgs, err = db.MessagesToRecipient(2, []int64{ids[2], ids[1], ids[0], 5000})
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	require.Equal(t, ids[0], msgs[0].ID)
+	require.Equal(t, ids[1], msgs[1].ID)
+	require.Equal(t, []byte("cipher-text"), msgs[1].CipherText)
+}
+
+func TestEachMessageRecord(t *testing.T) {
+	db := newDB(t)
+
+	var ids []int64
+	for _, recipientID := range []int64{2, 3, 2, 2} {
+		id, err := db.InsertMessage(recipientID, 4, []byte("cipher-text"), []byte("nonce"), 19495478)
+		require.NoError(t, err)
+		if recipientID == 2 {
+			ids = append(ids, id)
+		}
+	}
+
+	var seen []int64
+	err := db.EachMessageRecord(2, func(msg model.MessageRecord) error {
+		seen = append(seen, msg.ID)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, ids, seen)
+
+	// the error of fn stops the iteration
+	stop := errors.New("stop")
+	seen = nil
+	err = db.EachMessageRecord(2, func(msg model.MessageRecord) error {
+		seen = append(seen, msg.ID)
+		return stop
+	})
+	require.Equal(t, stop, err)
+	require.Equal(t, ids[:1], seen)
+}
+
+func TestDeleteMessagesToRecipient(t *testing.T) {
+	db := newDB(t)
+
+	var ids []int64
+	for _, recipientID := range []int64{2, 2, 3} {
+		id, err := db.InsertMessage(recipientID, 4, []byte("cipher-text"), []byte("nonce"), 19495478)
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+
+	deleted, err := db.DeleteMessagesToRecipient(2, ids)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), deleted)
+
+	msgs, err := db.MessageRecords(2)
+	require.NoError(t, err)
+	require.Empty(t, msgs)
+	msgs, err = db.MessageRecords(3)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+}
+
+func TestUserDataSummary(t *testing.T) {
+	db := newDB(t)
+
+	summary, err := db.UserDataSummary(7, 1000)
+	require.NoError(t, err)
+	require.Equal(t, model.UserDataSummary{}, *summary)
+
+	_, err = db.InsertMessage(7, 8, []byte("12345"), []byte("nonce"), 1)
+	require.NoError(t, err)
+	_, err = db.InsertMessage(7, 8, []byte("123"), []byte("nonce"), 1)
+	require.NoError(t, err)
+	_, err = db.InsertMessage(8, 7, []byte("123"), []byte("nonce"), 1)
+	require.NoError(t, err)
+	require.NoError(t, db.InsertAPNSToken(7, "apns-summary-token", model.ClientRecord{}))
+	require.NoError(t, db.InsertFCMToken(7, "fcm-summary-token", model.ClientRecord{}))
+	require.NoError(t, db.InsertAccessToken("summary-active", 7, 1000, model.ClientRecord{}))
+	require.NoError(t, db.InsertAccessToken("summary-expired", 7, 999, model.ClientRecord{}))
+
+	summary, err = db.UserDataSummary(7, 1000)
+	require.NoError(t, err)
+	require.Equal(t, model.UserDataSummary{
+		PendingMessages:     2,
+		PendingMessageBytes: 8,
+		APNSTokens:          1,
+		FCMTokens:           1,
+		ActiveSessions:      1,
+	}, *summary)
+}
+
+func TestReservedUsernames(t *testing.T) {
+	db := newDB(t)
+
+	rec, err := db.ReservedUsername("acmecorp")
+	require.NoError(t, err)
+	require.Nil(t, rec)
+
+	require.NoError(t, db.ReserveUsernames([]string{"acmecorp", "acmehelp"}, "", "brand"))
+	// reserving again replaces the reservation
+	require.NoError(t, db.ReserveUsernames([]string{"acmehelp"}, "help@acme.example", ""))
+
+	rec, err = db.ReservedUsername("acmehelp")
+	require.NoError(t, err)
+	require.NotNil(t, rec)
+	require.Equal(t, "help@acme.example", rec.Email)
+	require.NotZero(t, rec.CreatedAt)
+
+	recs, err := db.ReservedUsernames()
+	require.NoError(t, err)
+	require.Len(t, recs, 2)
+	require.Equal(t, "acmecorp", recs[0].Username)
+	require.Equal(t, "brand", recs[0].Note)
+
+	deleted, err := db.DeleteReservedUsername("acmecorp")
+	require.NoError(t, err)
+	require.True(t, deleted)
+	deleted, err = db.DeleteReservedUsername("acmecorp")
+	require.NoError(t, err)
+	require.False(t, deleted)
+}
+
 func TestInsertUser2(t *testing.T) {
 	u := model.UserRecord{
 		PasswordHashAlgorithm:       "argon2id13",
@@ -239,6 +648,8 @@ func TestInsertUser2(t *testing.T) {
 		WrappedSymmetricKey:         []byte("wrapped-symmetric-ket"),
 		WrappedSymmetricKeyNonce:    []byte("wrapped-symmetric-key-nonce"),
 		Username:                    "alice",
+		Locale:                      "en-gb",
+		CreatedAt:                   1600000000,
 	}
 	db := newDB(t)
 	var err error
@@ -256,12 +667,65 @@ func TestInsertUser2(t *testing.T) {
 	require.NotNil(t, actual)
 	require.Equal(t, u, *actual)
 
+	require.NoError(t, db.SetUserLocale(u.ID, "fr"))
+	actual, err = db.User(u.Username)
+	require.NoError(t, err)
+	require.Equal(t, "fr", actual.Locale)
+
 	// make sure searching for a non-existent user gives us an appropriate error
 	actual, err = db.User("eve")
 	require.NoError(t, err)
 	require.Nil(t, actual)
 }
 
+func TestUserStatus(t *testing.T) {
+	db := newDB(t)
+	var ids []int64
+	for _, username := range []string{"alice", "bobby", "carol"} {
+		id, err := db.InsertUser(model.UserRecord{
+			Username:                 username,
+			PublicKey:                []byte("public-key"),
+			WrappedSecretKey:         []byte("wrapped-secret-key"),
+			WrappedSecretKeyNonce:    []byte("wrapped-secret-key-nonce"),
+			WrappedSymmetricKey:      []byte("wrapped-symmetric-key"),
+			WrappedSymmetricKeyNonce: []byte("wrapped-symmetric-key-nonce"),
+			PasswordSalt:             []byte("password-salt"),
+			PasswordHashAlgorithm:    "argon2id13",
+			CreatedAt:                int64(len(ids)),
+		}, nil)
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+
+	status := model.UserStatusRecord{Status: model.UserSuspended, SuspendedUntil: 1600000000, StatusReason: "spam"}
+	ok, err := db.SetUserStatus(ids[1], status)
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = db.SetUserStatus(1000, status)
+	require.NoError(t, err)
+	require.False(t, ok)
+	user, err := db.User("bobby")
+	require.NoError(t, err)
+	require.Equal(t, status, user.UserStatusRecord)
+
+	// the status comes along with the user's access tokens
+	require.NoError(t, db.InsertAccessToken("token", ids[1], 1600000000, model.ClientRecord{}))
+	atr, err := db.AccessToken("token")
+	require.NoError(t, err)
+	require.Equal(t, status, atr.UserStatusRecord)
+
+	users, err := db.RecentUsers(0, 2)
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+	require.Equal(t, "carol", users[0].Username)
+	require.Equal(t, int64(2), users[0].CreatedAt)
+	require.Equal(t, status, users[1].UserStatusRecord)
+	users, err = db.RecentUsers(users[1].ID, 2)
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	require.Equal(t, "alice", users[0].Username)
+}
+
 func TestLimitedUserInfo(t *testing.T) {
 	db := newDB(t)
 	id, pubKey, err := db.LimitedUserInfo("invalid")
@@ -434,6 +898,27 @@ func TestSessionChallenge(t *testing.T) {
 	require.Nil(t, actual)
 }
 
+func TestUseSessionChallenge(t *testing.T) {
+	db := newDB(t)
+
+	require.NoError(t, db.InsertSessionChallenge(32, time.Now().Unix(), []byte("challenge")))
+	challenge, err := db.SessionChallenge(32)
+	require.NoError(t, err)
+	require.False(t, challenge.Used)
+
+	used, err := db.UseSessionChallenge(challenge.ID)
+	require.NoError(t, err)
+	require.True(t, used)
+	// it can only be used once
+	used, err = db.UseSessionChallenge(challenge.ID)
+	require.NoError(t, err)
+	require.False(t, used)
+
+	challenge, err = db.SessionChallenge(32)
+	require.NoError(t, err)
+	require.True(t, challenge.Used)
+}
+
 func TestDeleteSessionChallengeID(t *testing.T) {
 	db := newDB(t)
 
@@ -464,12 +949,37 @@ func TestDeleteSessionChallengeID(t *testing.T) {
 	require.Nil(t, actual)
 }
 
+func TestDeleteSessionChallenges(t *testing.T) {
+	db := newDB(t)
+
+	now := time.Now().Unix()
+	require.NoError(t, db.InsertSessionChallenge(1, now-300, []byte("stale")))
+	require.NoError(t, db.InsertSessionChallenge(2, now, []byte("fresh")))
+	count, err := db.SessionChallengeCount()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), count)
+
+	deleted, err := db.DeleteSessionChallenges(now - 120)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), deleted)
+
+	actual, err := db.SessionChallenge(1)
+	require.NoError(t, err)
+	require.Nil(t, actual)
+	actual, err = db.SessionChallenge(2)
+	require.NoError(t, err)
+	require.NotNil(t, actual)
+	count, err = db.SessionChallengeCount()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), count)
+}
+
 func TestInsertAndGetFCMToken(t *testing.T) {
 	db := newDB(t)
 
 	userID := int64(14)
 	fcmToken := "an-fcm-token-from-google"
-	err := db.InsertFCMToken(userID, fcmToken)
+	err := db.InsertFCMToken(userID, fcmToken, model.ClientRecord{})
 	require.NoError(t, err)
 
 	// try to retrieve it
@@ -501,12 +1011,12 @@ func TestUpdateUserIDofFCMToken(t *testing.T) {
 	db := newDB(t)
 	oldUserID := int64(12)
 	token := "the-fcm-token"
-	err := db.InsertFCMToken(oldUserID, token)
+	err := db.InsertFCMToken(oldUserID, token, model.ClientRecord{})
 	require.NoError(t, err)
 
 	// the 'old user' has logged out of the phone, and a 'new user' has logged in, thus taking over the device's FCM token
 	newUserID := int64(23)
-	err = db.UpdateUserIDOfFCMToken(newUserID, token)
+	err = db.UpdateUserIDOfFCMToken(newUserID, token, model.ClientRecord{})
 	require.NoError(t, err)
 
 	// make sure we get the correct record
@@ -522,7 +1032,7 @@ func TestReplaceFCMToken(t *testing.T) {
 	db := newDB(t)
 	userID := int64(31)
 	oldToken := "old-token"
-	err := db.InsertFCMToken(userID, oldToken)
+	err := db.InsertFCMToken(userID, oldToken, model.ClientRecord{})
 	require.NoError(t, err)
 
 	// update FCM token of a user
@@ -544,7 +1054,7 @@ func TestDeleteFCMTokenOfUser(t *testing.T) {
 	db := newDB(t)
 	userID := int64(78)
 	token := "fcm-token"
-	err := db.InsertFCMToken(userID, token)
+	err := db.InsertFCMToken(userID, token, model.ClientRecord{})
 	require.NoError(t, err)
 
 	// delete with a bad user id
@@ -580,7 +1090,7 @@ func TestDeleteFCMToken(t *testing.T) {
 	userID := int64(11)
 	token := "fcm-token"
 
-	err := db.InsertFCMToken(userID, token)
+	err := db.InsertFCMToken(userID, token, model.ClientRecord{})
 	require.NoError(t, err)
 
 	// delete by specifying a bad token
@@ -607,7 +1117,7 @@ func TestFCMTokensRaw(t *testing.T) {
 	numTokens := 8
 	userID := int64(4)
 	for i := 0; i < numTokens; i++ {
-		err := db.InsertFCMToken(userID, fmt.Sprintf("token-deadbeef-%d", i))
+		err := db.InsertFCMToken(userID, fmt.Sprintf("token-deadbeef-%d", i), model.ClientRecord{})
 		require.NoError(t, err)
 	}
 
@@ -620,7 +1130,7 @@ func TestInsertAndGetAPNSToken(t *testing.T) {
 	db := newDB(t)
 	userID := int64(8)
 	token := "apns-token"
-	err := db.InsertAPNSToken(userID, token)
+	err := db.InsertAPNSToken(userID, token, model.ClientRecord{})
 	require.NoError(t, err)
 
 	// retrieve it
@@ -661,11 +1171,11 @@ func TestUpdateUserIDOfAPNSToken(t *testing.T) {
 
 	oldUserID := int64(6)
 	token := "apns-token"
-	err := db.InsertAPNSToken(oldUserID, token)
+	err := db.InsertAPNSToken(oldUserID, token, model.ClientRecord{})
 	require.NoError(t, err)
 
 	newUserID := int64(9)
-	err = db.UpdateUserIDOfAPNSToken(newUserID, token)
+	err = db.UpdateUserIDOfAPNSToken(newUserID, token, model.ClientRecord{})
 	require.NoError(t, err)
 
 	actual, err := db.APNSToken(token)
@@ -680,7 +1190,7 @@ func TestReplaceAPNSToken(t *testing.T) {
 
 	oldToken := "old-apns-token"
 	userID := int64(12)
-	err := db.InsertAPNSToken(userID, oldToken)
+	err := db.InsertAPNSToken(userID, oldToken, model.ClientRecord{})
 	require.NoError(t, err)
 
 	// the APNS token has been updated on the device
@@ -702,7 +1212,7 @@ func TestDeleteAPNSTokensOfUser(t *testing.T) {
 
 	userID := int64(4)
 	token := "apns-token"
-	err := db.InsertAPNSToken(userID, token)
+	err := db.InsertAPNSToken(userID, token, model.ClientRecord{})
 	require.NoError(t, err)
 
 	// delete with a bad user id
@@ -738,7 +1248,7 @@ func TestDeleteAPNSToken(t *testing.T) {
 
 	userID := int64(2)
 	token := "apns-token"
-	err := db.InsertAPNSToken(userID, token)
+	err := db.InsertAPNSToken(userID, token, model.ClientRecord{})
 	require.NoError(t, err)
 
 	// delete with a bad token
@@ -771,7 +1281,7 @@ func TestAPNSTokensRaw(t *testing.T) {
 	numTokens := 8
 	var userID int64 = 100
 	for i := 0; i < numTokens; i++ {
-		err := db.InsertAPNSToken(userID, fmt.Sprintf("token-livebeef-%d", i))
+		err := db.InsertAPNSToken(userID, fmt.Sprintf("token-livebeef-%d", i), model.ClientRecord{})
 		require.NoError(t, err)
 	}
 
@@ -784,41 +1294,277 @@ func TestTickets(t *testing.T) {
 	db := newDB(t)
 
 	// make sure we don't get a ticket from an empty db
-	userID, timestamp, err := db.Ticket("deadbeef")
+	tr, err := db.Ticket("deadbeef")
 	require.NoError(t, err)
-	require.Zero(t, userID)
-	require.Zero(t, timestamp)
+	require.Nil(t, tr)
 
 	ticket := "boppity-bop"
 	var expectedID int64 = 42
-	err = db.InsertTicket(ticket, expectedID)
+	err = db.InsertTicket(ticket, expectedID, "messages-read")
 	require.NoError(t, err)
 
-	userID, timestamp, err = db.Ticket(ticket)
+	tr, err = db.Ticket(ticket)
 	require.NoError(t, err)
-	require.Equal(t, expectedID, userID)
+	require.NotNil(t, tr)
+	require.Equal(t, expectedID, tr.UserID)
+	require.Equal(t, "messages-read", tr.Scopes)
 	// the timestamp shouldn't be older than 1 second ago
 	now := time.Now().Unix()
-	require.Greater(t, timestamp, now-1)
+	require.Greater(t, tr.Timestamp, now-1)
 	// the timestamp shouldn't be in the future either
-	require.LessOrEqual(t, timestamp, now)
+	require.LessOrEqual(t, tr.Timestamp, now)
 
 	// test ticket deletion
 	err = db.DeleteTickets(now - 5)
 	require.NoError(t, err)
 
 	// the ticket should still be in the database
-	userID, _, err = db.Ticket(ticket)
+	tr, err = db.Ticket(ticket)
 	require.NoError(t, err)
-	require.Equal(t, expectedID, userID)
+	require.Equal(t, expectedID, tr.UserID)
 
 	// perform a delete that SHOULD delete our ticket
 	err = db.DeleteTickets(now)
 	require.NoError(t, err)
 
 	// make sure the ticket no longer exists
-	userID, timestamp, err = db.Ticket(ticket)
+	tr, err = db.Ticket(ticket)
+	require.NoError(t, err)
+	require.Nil(t, tr)
+}
+
+func TestOptions(t *testing.T) {
+	opts := Options{}.withDefaults("file:/data/sqlite.db")
+	require.Equal(t, DefaultBusyTimeout, opts.BusyTimeout)
+	require.Equal(t, DefaultMaxOpenConns, opts.MaxOpenConns)
+	require.Equal(t, "file:/data/sqlite.db?_busy_timeout=5000&_txlock=immediate", opts.dsn("file:/data/sqlite.db"))
+
+	opts = Options{BusyTimeout: 250 * time.Millisecond, MaxOpenConns: 8}.withDefaults("file:/data/sqlite.db?mode=rwc")
+	require.Equal(t, 8, opts.MaxOpenConns)
+	require.Equal(t, "file:/data/sqlite.db?mode=rwc&_busy_timeout=250&_txlock=immediate", opts.dsn("file:/data/sqlite.db?mode=rwc"))
+
+	// each connection would get its own in-memory database
+	opts = Options{MaxOpenConns: 8}.withDefaults(InMemoryDSN)
+	require.Equal(t, 1, opts.MaxOpenConns)
+}
+
+func TestIsBusy(t *testing.T) {
+	require.True(t, isBusy(sqlite3.Error{Code: sqlite3.ErrBusy}))
+	require.True(t, isBusy(fmt.Errorf("unable to start transaction: %w", sqlite3.Error{Code: sqlite3.ErrLocked})))
+	require.False(t, isBusy(sqlite3.Error{Code: sqlite3.ErrConstraint}))
+	require.False(t, isBusy(errors.New("not sqlite")))
+	require.False(t, isBusy(nil))
+}
+
+func TestNewEncryptedRejectsBadKeys(t *testing.T) {
+	_, err := NewEncrypted(InMemoryDSN, []byte("short"), Options{})
+	require.Error(t, err)
+}
+
+func TestSealedMessages(t *testing.T) {
+	db := newDB(t)
+
+	expected := model.MessageRecord{
+		RecipientID: 2,
+		CipherText:  []byte("sealed-envelope"),
+		Nonce:       []byte("nonce"),
+		Sealed:      true,
+	}
+	var err error
+	expected.ID, err = db.InsertSealedMessage(expected.RecipientID, expected.CipherText, expected.Nonce)
+	require.NoError(t, err)
+
+	actual, err := db.MessageToRecipient(expected.RecipientID, expected.ID)
+	require.NoError(t, err)
+	require.Equal(t, expected, *actual)
+}
+
+func TestOutbox(t *testing.T) {
+	db := newDB(t)
+
+	msg := model.MessageRecord{
+		RecipientID: 2,
+		SenderID:    3,
+		CipherText:  []byte("cipher-text"),
+		Nonce:       []byte("nonce"),
+		SentDate:    19495478,
+	}
+	msgID, entryID, _, err := db.InsertMessageWithOutbox(msg, model.OutboxRecord{
+		RecipientID: msg.RecipientID,
+		Payload:     []byte("payload"),
+		Urgent:      true,
+		NextAttempt: 100,
+	}, 0)
+	require.NoError(t, err)
+	stored, err := db.MessageToRecipient(msg.RecipientID, msgID)
+	require.NoError(t, err)
+	msg.ID = msgID
+	require.Equal(t, msg, *stored)
+
+	// not due yet
+	entries, err := db.ClaimOutboxEntries(99, 200, 10)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	entries, err = db.ClaimOutboxEntries(100, 200, 10)
+	require.NoError(t, err)
+	require.Equal(t, []model.OutboxRecord{{
+		ID:          entryID,
+		RecipientID: msg.RecipientID,
+		MessageID:   msgID,
+		Payload:     []byte("payload"),
+		Urgent:      true,
+		Attempts:    1,
+		NextAttempt: 200,
+	}}, entries)
+
+	// a claimed entry is held off until its lease runs out
+	entries, err = db.ClaimOutboxEntries(150, 300, 10)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	entries, err = db.ClaimOutboxEntries(200, 300, 10)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, 2, entries[0].Attempts)
+
+	// listing includes the entries that aren't due
+	require.NoError(t, db.UpdateOutboxPayload(entryID, []byte("resealed")))
+	entries, err = db.OutboxEntries(0, 10)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, []byte("resealed"), entries[0].Payload)
+	entries, err = db.OutboxEntries(entryID, 10)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	n, err := db.OutboxSize()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), n)
+	require.NoError(t, db.DeleteOutboxEntry(entryID))
+	n, err = db.OutboxSize()
+	require.NoError(t, err)
+	require.Equal(t, int64(0), n)
+}
+
+func TestOutboxRollsBackWithMessage(t *testing.T) {
+	db := newDB(t)
+	_, err := db.dbx.Exec("DROP TABLE outbox")
+	require.NoError(t, err)
+
+	// the message isn't kept when its outbox entry can't be written
+	msg := model.MessageRecord{RecipientID: 2, SenderID: 3, CipherText: []byte("ct"), Nonce: []byte("nonce")}
+	_, _, _, err = db.InsertMessageWithOutbox(msg, model.OutboxRecord{RecipientID: 2, Payload: []byte("payload")}, 0)
+	require.Error(t, err)
+	msgs, err := db.MessageRecords(2)
+	require.NoError(t, err)
+	require.Empty(t, msgs)
+}
+
+func TestSystemMessages(t *testing.T) {
+	db := newDB(t)
+
+	msg := model.MessageRecord{RecipientID: 2, CipherText: []byte("ct"), Nonce: []byte("nonce"), SentDate: 100, System: true}
+	msgID, _, _, err := db.InsertMessageWithOutbox(msg, model.OutboxRecord{RecipientID: 2, Payload: []byte("payload")}, 0)
+	require.NoError(t, err)
+	stored, err := db.MessageToRecipient(2, msgID)
+	require.NoError(t, err)
+	msg.ID = msgID
+	require.Equal(t, msg, *stored)
+
+	// sealed messages keep the flag inside the envelope
+	sealed := model.MessageRecord{RecipientID: 2, CipherText: []byte("envelope"), Nonce: []byte("nonce"), Sealed: true, System: true}
+	msgID, _, _, err = db.InsertMessageWithOutbox(sealed, model.OutboxRecord{RecipientID: 2, Payload: []byte("payload")}, 0)
+	require.NoError(t, err)
+	stored, err = db.MessageToRecipient(2, msgID)
+	require.NoError(t, err)
+	require.True(t, stored.Sealed)
+	require.False(t, stored.System)
+}
+
+func TestQueueLimit(t *testing.T) {
+	db := newDB(t)
+
+	insert := func(recipientID int64, urgent bool) (int64, int64, error) {
+		msg := model.MessageRecord{RecipientID: recipientID, SenderID: 3, CipherText: []byte("ct"), Nonce: []byte("nonce"), Urgent: urgent}
+		msgID, _, evictedID, err := db.InsertMessageWithOutbox(msg, model.OutboxRecord{RecipientID: recipientID, Payload: []byte("payload"), Urgent: urgent}, 3)
+		return msgID, evictedID, err
+	}
+
+	urgentID, _, err := insert(2, true)
+	require.NoError(t, err)
+	oldestID, _, err := insert(2, false)
+	require.NoError(t, err)
+	newestID, evictedID, err := insert(2, false)
+	require.NoError(t, err)
+	require.Zero(t, evictedID)
+
+	// the queue is full, so regular messages are rejected
+	_, _, err = insert(2, false)
+	require.Equal(t, model.ErrQueueFull, err)
+	// other recipients aren't affected
+	_, _, err = insert(4, false)
+	require.NoError(t, err)
+
+	// urgent messages evict the oldest message that isn't urgent
+	msgID, evictedID, err := insert(2, true)
+	require.NoError(t, err)
+	require.Equal(t, oldestID, evictedID)
+	msgs, err := db.MessageRecords(2)
+	require.NoError(t, err)
+	ids := make([]int64, 0, len(msgs))
+	for _, m := range msgs {
+		ids = append(ids, m.ID)
+	}
+	require.ElementsMatch(t, []int64{urgentID, newestID, msgID}, ids)
+	n, err := db.OutboxSize()
+	require.NoError(t, err)
+	require.Equal(t, int64(4), n)
+
+	_, evictedID, err = insert(2, true)
+	require.NoError(t, err)
+	require.Equal(t, newestID, evictedID)
+
+	// once only urgent messages are queued, nothing can be evicted
+	_, _, err = insert(2, true)
+	require.Equal(t, model.ErrQueueFull, err)
+}
+
+func TestPrefixUpperBound(t *testing.T) {
+	require.Equal(t, []byte{1, 3}, prefixUpperBound([]byte{1, 2}))
+	require.Equal(t, []byte{2}, prefixUpperBound([]byte{1, 0xff}))
+	require.Nil(t, prefixUpperBound([]byte{0xff, 0xff}))
+}
+
+func TestEmailEvents(t *testing.T) {
+	db := newDB(t)
+
+	events, err := db.EmailEvents(10)
+	require.NoError(t, err)
+	require.Empty(t, events)
+
+	bounce := model.EmailEventRecord{
+		ProviderID: "event-1",
+		Event:      "failed",
+		Severity:   "permanent",
+		Recipient:  "alice@example.com",
+		MessageID:  "message-1",
+		Reason:     "No such mailbox",
+		Timestamp:  1000,
+	}
+	require.NoError(t, db.InsertEmailEvent(bounce))
+	// webhooks that are retried are only recorded once
+	require.NoError(t, db.InsertEmailEvent(bounce))
+	delivery := model.EmailEventRecord{ProviderID: "event-2", Event: "delivered", Recipient: "bob@example.com", MessageID: "message-2", Timestamp: 2000}
+	require.NoError(t, db.InsertEmailEvent(delivery))
+
+	events, err = db.EmailEvents(10)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	require.Equal(t, "event-2", events[0].ProviderID)
+	bounce.ID = events[1].ID
+	require.Equal(t, bounce, events[1])
+
+	events, err = db.EmailEvents(1)
 	require.NoError(t, err)
-	require.Zero(t, userID)
-	require.Zero(t, timestamp)
+	require.Len(t, events, 1)
 }
@@ -0,0 +1,618 @@
+package storemetrics
+
+import (
+	"context"
+	"time"
+
+	"zood.dev/oscar/model"
+)
+
+// storeSQL names the relational storage in the metrics
+const storeSQL = "sql"
+
+// dbProvider records the operations of a model.Provider. Copies made by
+// WithContext share the Recorder.
+type dbProvider struct {
+	p model.Provider
+	r *Recorder
+}
+
+// WrapDB returns a model.Provider recording every operation of p in r
+func WrapDB(p model.Provider, r *Recorder) model.Provider {
+	return dbProvider{p: p, r: r}
+}
+
+// WithContext fulfills model.Provider
+func (db dbProvider) WithContext(ctx context.Context) model.Provider {
+	return dbProvider{p: db.p.WithContext(ctx), r: db.r}
+}
+
+func (db dbProvider) APNSToken(token string) (*model.APNSTokenRecord, error) {
+	start := time.Now()
+	r, err := db.p.APNSToken(token)
+	db.r.observe(storeSQL, "APNSToken", start, err)
+	return r, err
+}
+
+func (db dbProvider) APNSTokenUser(userID int64, token string) (*model.APNSTokenRecord, error) {
+	start := time.Now()
+	r, err := db.p.APNSTokenUser(userID, token)
+	db.r.observe(storeSQL, "APNSTokenUser", start, err)
+	return r, err
+}
+
+func (db dbProvider) APNSTokensRaw(userID int64) ([]string, error) {
+	start := time.Now()
+	r, err := db.p.APNSTokensRaw(userID)
+	db.r.observe(storeSQL, "APNSTokensRaw", start, err)
+	return r, err
+}
+
+func (db dbProvider) AccessToken(token string) (*model.AccessTokenRecord, error) {
+	start := time.Now()
+	r, err := db.p.AccessToken(token)
+	db.r.observe(storeSQL, "AccessToken", start, err)
+	return r, err
+}
+
+func (db dbProvider) AccessTokens(afterToken string, now int64, limit int) ([]string, error) {
+	start := time.Now()
+	r, err := db.p.AccessTokens(afterToken, now, limit)
+	db.r.observe(storeSQL, "AccessTokens", start, err)
+	return r, err
+}
+
+func (db dbProvider) ClaimOutboxEntries(now, leaseUntil int64, limit int) ([]model.OutboxRecord, error) {
+	start := time.Now()
+	r, err := db.p.ClaimOutboxEntries(now, leaseUntil, limit)
+	db.r.observe(storeSQL, "ClaimOutboxEntries", start, err)
+	return r, err
+}
+
+func (db dbProvider) ClientCounts(now int64) ([]model.ClientCountRecord, error) {
+	start := time.Now()
+	r, err := db.p.ClientCounts(now)
+	db.r.observe(storeSQL, "ClientCounts", start, err)
+	return r, err
+}
+
+func (db dbProvider) DeleteAccessToken(token string) error {
+	start := time.Now()
+	err := db.p.DeleteAccessToken(token)
+	db.r.observe(storeSQL, "DeleteAccessToken", start, err)
+	return err
+}
+
+func (db dbProvider) DeleteAccessTokensOfUser(userID int64) (rowsAffected int64, err error) {
+	start := time.Now()
+	r, err := db.p.DeleteAccessTokensOfUser(userID)
+	db.r.observe(storeSQL, "DeleteAccessTokensOfUser", start, err)
+	return r, err
+}
+
+func (db dbProvider) DeleteAPNSToken(token string) error {
+	start := time.Now()
+	err := db.p.DeleteAPNSToken(token)
+	db.r.observe(storeSQL, "DeleteAPNSToken", start, err)
+	return err
+}
+
+func (db dbProvider) DeleteAPNSTokenOfUser(userID int64, token string) error {
+	start := time.Now()
+	err := db.p.DeleteAPNSTokenOfUser(userID, token)
+	db.r.observe(storeSQL, "DeleteAPNSTokenOfUser", start, err)
+	return err
+}
+
+func (db dbProvider) DeleteExpiredAccessTokens(now int64) (rowsAffected int64, err error) {
+	start := time.Now()
+	r, err := db.p.DeleteExpiredAccessTokens(now)
+	db.r.observe(storeSQL, "DeleteExpiredAccessTokens", start, err)
+	return r, err
+}
+
+func (db dbProvider) DeleteExpiredRefreshTokens(now int64) (rowsAffected int64, err error) {
+	start := time.Now()
+	r, err := db.p.DeleteExpiredRefreshTokens(now)
+	db.r.observe(storeSQL, "DeleteExpiredRefreshTokens", start, err)
+	return r, err
+}
+
+func (db dbProvider) DeleteFCMToken(token string) error {
+	start := time.Now()
+	err := db.p.DeleteFCMToken(token)
+	db.r.observe(storeSQL, "DeleteFCMToken", start, err)
+	return err
+}
+
+func (db dbProvider) DeleteFCMTokenOfUser(userID int64, token string) error {
+	start := time.Now()
+	err := db.p.DeleteFCMTokenOfUser(userID, token)
+	db.r.observe(storeSQL, "DeleteFCMTokenOfUser", start, err)
+	return err
+}
+
+func (db dbProvider) DeleteMessageToRecipient(recipientID, msgID int64) error {
+	start := time.Now()
+	err := db.p.DeleteMessageToRecipient(recipientID, msgID)
+	db.r.observe(storeSQL, "DeleteMessageToRecipient", start, err)
+	return err
+}
+
+func (db dbProvider) DeleteMessagesToRecipient(recipientID int64, msgIDs []int64) (rowsAffected int64, err error) {
+	start := time.Now()
+	r, err := db.p.DeleteMessagesToRecipient(recipientID, msgIDs)
+	db.r.observe(storeSQL, "DeleteMessagesToRecipient", start, err)
+	return r, err
+}
+
+func (db dbProvider) DeleteOutboxEntry(id int64) error {
+	start := time.Now()
+	err := db.p.DeleteOutboxEntry(id)
+	db.r.observe(storeSQL, "DeleteOutboxEntry", start, err)
+	return err
+}
+
+func (db dbProvider) DeleteReservedUsername(username string) (deleted bool, err error) {
+	start := time.Now()
+	r, err := db.p.DeleteReservedUsername(username)
+	db.r.observe(storeSQL, "DeleteReservedUsername", start, err)
+	return r, err
+}
+
+func (db dbProvider) DeleteSession(userID, id int64) (bool, error) {
+	start := time.Now()
+	r, err := db.p.DeleteSession(userID, id)
+	db.r.observe(storeSQL, "DeleteSession", start, err)
+	return r, err
+}
+
+func (db dbProvider) DeleteSessionChallengeID(id int64) error {
+	start := time.Now()
+	err := db.p.DeleteSessionChallengeID(id)
+	db.r.observe(storeSQL, "DeleteSessionChallengeID", start, err)
+	return err
+}
+
+func (db dbProvider) DeleteSessionChallengeUser(userID int64) error {
+	start := time.Now()
+	err := db.p.DeleteSessionChallengeUser(userID)
+	db.r.observe(storeSQL, "DeleteSessionChallengeUser", start, err)
+	return err
+}
+
+func (db dbProvider) DeleteSessionChallenges(olderThan int64) (rowsAffected int64, err error) {
+	start := time.Now()
+	r, err := db.p.DeleteSessionChallenges(olderThan)
+	db.r.observe(storeSQL, "DeleteSessionChallenges", start, err)
+	return r, err
+}
+
+func (db dbProvider) DeleteTickets(olderThan int64) error {
+	start := time.Now()
+	err := db.p.DeleteTickets(olderThan)
+	db.r.observe(storeSQL, "DeleteTickets", start, err)
+	return err
+}
+
+func (db dbProvider) DisavowEmail(token string) error {
+	start := time.Now()
+	err := db.p.DisavowEmail(token)
+	db.r.observe(storeSQL, "DisavowEmail", start, err)
+	return err
+}
+
+// EachMessageRecord observes the whole iteration, including the time fn
+// takes
+func (db dbProvider) EachMessageRecord(recipientID int64, fn func(model.MessageRecord) error) error {
+	start := time.Now()
+	err := db.p.EachMessageRecord(recipientID, fn)
+	db.r.observe(storeSQL, "EachMessageRecord", start, err)
+	return err
+}
+
+func (db dbProvider) EmailEvents(limit int) ([]model.EmailEventRecord, error) {
+	start := time.Now()
+	r, err := db.p.EmailEvents(limit)
+	db.r.observe(storeSQL, "EmailEvents", start, err)
+	return r, err
+}
+
+func (db dbProvider) EmailSuppressed(email string) (bool, error) {
+	start := time.Now()
+	r, err := db.p.EmailSuppressed(email)
+	db.r.observe(storeSQL, "EmailSuppressed", start, err)
+	return r, err
+}
+
+func (db dbProvider) EmailVerificationTokenRecord(token string) (*model.EmailVerificationTokenRecord, error) {
+	start := time.Now()
+	r, err := db.p.EmailVerificationTokenRecord(token)
+	db.r.observe(storeSQL, "EmailVerificationTokenRecord", start, err)
+	return r, err
+}
+
+func (db dbProvider) FCMToken(token string) (*model.FCMTokenRecord, error) {
+	start := time.Now()
+	r, err := db.p.FCMToken(token)
+	db.r.observe(storeSQL, "FCMToken", start, err)
+	return r, err
+}
+
+func (db dbProvider) FCMTokenUser(userID int64, token string) (*model.FCMTokenRecord, error) {
+	start := time.Now()
+	r, err := db.p.FCMTokenUser(userID, token)
+	db.r.observe(storeSQL, "FCMTokenUser", start, err)
+	return r, err
+}
+
+func (db dbProvider) FCMTokensRaw(userID int64) ([]string, error) {
+	start := time.Now()
+	r, err := db.p.FCMTokensRaw(userID)
+	db.r.observe(storeSQL, "FCMTokensRaw", start, err)
+	return r, err
+}
+
+func (db dbProvider) InsertRefreshToken(rtr model.RefreshTokenRecord) error {
+	start := time.Now()
+	err := db.p.InsertRefreshToken(rtr)
+	db.r.observe(storeSQL, "InsertRefreshToken", start, err)
+	return err
+}
+
+func (db dbProvider) InsertRefreshedAccessToken(token, refreshToken string, expiresAt int64) error {
+	start := time.Now()
+	err := db.p.InsertRefreshedAccessToken(token, refreshToken, expiresAt)
+	db.r.observe(storeSQL, "InsertRefreshedAccessToken", start, err)
+	return err
+}
+
+func (db dbProvider) InsertAPNSToken(userID int64, token string, client model.ClientRecord) error {
+	start := time.Now()
+	err := db.p.InsertAPNSToken(userID, token, client)
+	db.r.observe(storeSQL, "InsertAPNSToken", start, err)
+	return err
+}
+
+func (db dbProvider) InsertAccessToken(token string, userID int64, expiresAt int64, client model.ClientRecord) error {
+	start := time.Now()
+	err := db.p.InsertAccessToken(token, userID, expiresAt, client)
+	db.r.observe(storeSQL, "InsertAccessToken", start, err)
+	return err
+}
+
+func (db dbProvider) InsertAuditLogEntry(actor, action, details string) error {
+	start := time.Now()
+	err := db.p.InsertAuditLogEntry(actor, action, details)
+	db.r.observe(storeSQL, "InsertAuditLogEntry", start, err)
+	return err
+}
+
+func (db dbProvider) InsertEmailEvent(evt model.EmailEventRecord) error {
+	start := time.Now()
+	err := db.p.InsertEmailEvent(evt)
+	db.r.observe(storeSQL, "InsertEmailEvent", start, err)
+	return err
+}
+
+func (db dbProvider) InsertEmailVerificationToken(userID int64, email, token string) error {
+	start := time.Now()
+	err := db.p.InsertEmailVerificationToken(userID, email, token)
+	db.r.observe(storeSQL, "InsertEmailVerificationToken", start, err)
+	return err
+}
+
+func (db dbProvider) InsertFCMToken(userID int64, token string, client model.ClientRecord) error {
+	start := time.Now()
+	err := db.p.InsertFCMToken(userID, token, client)
+	db.r.observe(storeSQL, "InsertFCMToken", start, err)
+	return err
+}
+
+func (db dbProvider) InsertMessage(recipientID, senderID int64, cipherText, nonce []byte, sentDate int64) (int64, error) {
+	start := time.Now()
+	r, err := db.p.InsertMessage(recipientID, senderID, cipherText, nonce, sentDate)
+	db.r.observe(storeSQL, "InsertMessage", start, err)
+	return r, err
+}
+
+func (db dbProvider) InsertMessageWithOutbox(msg model.MessageRecord, entry model.OutboxRecord, maxQueued int64) (msgID, entryID, evictedID int64, err error) {
+	start := time.Now()
+	r0, r1, r2, err := db.p.InsertMessageWithOutbox(msg, entry, maxQueued)
+	db.r.observe(storeSQL, "InsertMessageWithOutbox", start, err)
+	return r0, r1, r2, err
+}
+
+func (db dbProvider) InsertScopedAccessToken(token string, userID, expiresAt int64, scopes string) error {
+	start := time.Now()
+	err := db.p.InsertScopedAccessToken(token, userID, expiresAt, scopes)
+	db.r.observe(storeSQL, "InsertScopedAccessToken", start, err)
+	return err
+}
+
+func (db dbProvider) InsertSealedMessage(recipientID int64, sealedEnvelope, nonce []byte) (int64, error) {
+	start := time.Now()
+	r, err := db.p.InsertSealedMessage(recipientID, sealedEnvelope, nonce)
+	db.r.observe(storeSQL, "InsertSealedMessage", start, err)
+	return r, err
+}
+
+func (db dbProvider) InsertSessionChallenge(userID int64, creationDate int64, challenge []byte) error {
+	start := time.Now()
+	err := db.p.InsertSessionChallenge(userID, creationDate, challenge)
+	db.r.observe(storeSQL, "InsertSessionChallenge", start, err)
+	return err
+}
+
+func (db dbProvider) InsertTicket(ticket string, userID int64, scopes string) error {
+	start := time.Now()
+	err := db.p.InsertTicket(ticket, userID, scopes)
+	db.r.observe(storeSQL, "InsertTicket", start, err)
+	return err
+}
+
+func (db dbProvider) InsertUser(user model.UserRecord, verificationToken *string) (int64, error) {
+	start := time.Now()
+	r, err := db.p.InsertUser(user, verificationToken)
+	db.r.observe(storeSQL, "InsertUser", start, err)
+	return r, err
+}
+
+func (db dbProvider) LimitedUserInfo(username string) (id int64, pubKey []byte, err error) {
+	start := time.Now()
+	r0, r1, err := db.p.LimitedUserInfo(username)
+	db.r.observe(storeSQL, "LimitedUserInfo", start, err)
+	return r0, r1, err
+}
+
+func (db dbProvider) LimitedUserInfoID(userID int64) (username string, pubKey []byte, err error) {
+	start := time.Now()
+	r0, r1, err := db.p.LimitedUserInfoID(userID)
+	db.r.observe(storeSQL, "LimitedUserInfoID", start, err)
+	return r0, r1, err
+}
+
+func (db dbProvider) LimitedUserInfoIndex(index []byte) (id int64, username string, pubKey []byte, err error) {
+	start := time.Now()
+	r0, r1, r2, err := db.p.LimitedUserInfoIndex(index)
+	db.r.observe(storeSQL, "LimitedUserInfoIndex", start, err)
+	return r0, r1, r2, err
+}
+
+func (db dbProvider) MessageRecords(recipientID int64) ([]model.MessageRecord, error) {
+	start := time.Now()
+	r, err := db.p.MessageRecords(recipientID)
+	db.r.observe(storeSQL, "MessageRecords", start, err)
+	return r, err
+}
+
+func (db dbProvider) MessageToRecipient(recipientID, msgID int64) (*model.MessageRecord, error) {
+	start := time.Now()
+	r, err := db.p.MessageToRecipient(recipientID, msgID)
+	db.r.observe(storeSQL, "MessageToRecipient", start, err)
+	return r, err
+}
+
+func (db dbProvider) MessagesToRecipient(recipientID int64, msgIDs []int64) ([]model.MessageRecord, error) {
+	start := time.Now()
+	r, err := db.p.MessagesToRecipient(recipientID, msgIDs)
+	db.r.observe(storeSQL, "MessagesToRecipient", start, err)
+	return r, err
+}
+
+func (db dbProvider) OutboxEntries(afterID int64, limit int) ([]model.OutboxRecord, error) {
+	start := time.Now()
+	r, err := db.p.OutboxEntries(afterID, limit)
+	db.r.observe(storeSQL, "OutboxEntries", start, err)
+	return r, err
+}
+
+func (db dbProvider) OutboxSize() (int64, error) {
+	start := time.Now()
+	r, err := db.p.OutboxSize()
+	db.r.observe(storeSQL, "OutboxSize", start, err)
+	return r, err
+}
+
+func (db dbProvider) RefreshToken(token string) (*model.RefreshTokenRecord, error) {
+	start := time.Now()
+	r, err := db.p.RefreshToken(token)
+	db.r.observe(storeSQL, "RefreshToken", start, err)
+	return r, err
+}
+
+func (db dbProvider) RotateRefreshToken(old, new string, expiresAt int64) (bool, error) {
+	start := time.Now()
+	r, err := db.p.RotateRefreshToken(old, new, expiresAt)
+	db.r.observe(storeSQL, "RotateRefreshToken", start, err)
+	return r, err
+}
+
+func (db dbProvider) RecentUsers(beforeID int64, limit int) ([]model.UserRecord, error) {
+	start := time.Now()
+	r, err := db.p.RecentUsers(beforeID, limit)
+	db.r.observe(storeSQL, "RecentUsers", start, err)
+	return r, err
+}
+
+func (db dbProvider) ReplaceAPNSToken(old, new string) (rowsAffected int64, err error) {
+	start := time.Now()
+	r, err := db.p.ReplaceAPNSToken(old, new)
+	db.r.observe(storeSQL, "ReplaceAPNSToken", start, err)
+	return r, err
+}
+
+func (db dbProvider) ReplaceFCMToken(old, new string) (rowsAffected int64, err error) {
+	start := time.Now()
+	r, err := db.p.ReplaceFCMToken(old, new)
+	db.r.observe(storeSQL, "ReplaceFCMToken", start, err)
+	return r, err
+}
+
+func (db dbProvider) ReserveUsernames(usernames []string, email, note string) error {
+	start := time.Now()
+	err := db.p.ReserveUsernames(usernames, email, note)
+	db.r.observe(storeSQL, "ReserveUsernames", start, err)
+	return err
+}
+
+func (db dbProvider) ReservedUsername(username string) (*model.ReservedUsernameRecord, error) {
+	start := time.Now()
+	r, err := db.p.ReservedUsername(username)
+	db.r.observe(storeSQL, "ReservedUsername", start, err)
+	return r, err
+}
+
+func (db dbProvider) ReservedUsernames() ([]model.ReservedUsernameRecord, error) {
+	start := time.Now()
+	r, err := db.p.ReservedUsernames()
+	db.r.observe(storeSQL, "ReservedUsernames", start, err)
+	return r, err
+}
+
+func (db dbProvider) SessionChallenge(userID int64) (*model.SessionChallengeRecord, error) {
+	start := time.Now()
+	r, err := db.p.SessionChallenge(userID)
+	db.r.observe(storeSQL, "SessionChallenge", start, err)
+	return r, err
+}
+
+func (db dbProvider) SessionChallengeCount() (int64, error) {
+	start := time.Now()
+	r, err := db.p.SessionChallengeCount()
+	db.r.observe(storeSQL, "SessionChallengeCount", start, err)
+	return r, err
+}
+
+func (db dbProvider) Sessions(userID, now int64) ([]model.RefreshTokenRecord, error) {
+	start := time.Now()
+	r, err := db.p.Sessions(userID, now)
+	db.r.observe(storeSQL, "Sessions", start, err)
+	return r, err
+}
+
+func (db dbProvider) SetUserLocale(userID int64, locale string) error {
+	start := time.Now()
+	err := db.p.SetUserLocale(userID, locale)
+	db.r.observe(storeSQL, "SetUserLocale", start, err)
+	return err
+}
+
+func (db dbProvider) SetUserStatus(userID int64, status model.UserStatusRecord) (bool, error) {
+	start := time.Now()
+	r, err := db.p.SetUserStatus(userID, status)
+	db.r.observe(storeSQL, "SetUserStatus", start, err)
+	return r, err
+}
+
+func (db dbProvider) SetUsernameIndex(userID int64, index []byte) error {
+	start := time.Now()
+	err := db.p.SetUsernameIndex(userID, index)
+	db.r.observe(storeSQL, "SetUsernameIndex", start, err)
+	return err
+}
+
+func (db dbProvider) SuppressEmail(email, reason string) (affectedUsers int64, err error) {
+	start := time.Now()
+	r, err := db.p.SuppressEmail(email, reason)
+	db.r.observe(storeSQL, "SuppressEmail", start, err)
+	return r, err
+}
+
+func (db dbProvider) Ticket(ticket string) (*model.TicketRecord, error) {
+	start := time.Now()
+	r, err := db.p.Ticket(ticket)
+	db.r.observe(storeSQL, "Ticket", start, err)
+	return r, err
+}
+
+func (db dbProvider) TouchSession(refreshToken string, lastUsed int64) error {
+	start := time.Now()
+	err := db.p.TouchSession(refreshToken, lastUsed)
+	db.r.observe(storeSQL, "TouchSession", start, err)
+	return err
+}
+
+func (db dbProvider) UpdateUserIDOfAPNSToken(newUserID int64, token string, client model.ClientRecord) error {
+	start := time.Now()
+	err := db.p.UpdateUserIDOfAPNSToken(newUserID, token, client)
+	db.r.observe(storeSQL, "UpdateUserIDOfAPNSToken", start, err)
+	return err
+}
+
+func (db dbProvider) UpdateUserIDOfFCMToken(newUserID int64, token string, client model.ClientRecord) error {
+	start := time.Now()
+	err := db.p.UpdateUserIDOfFCMToken(newUserID, token, client)
+	db.r.observe(storeSQL, "UpdateUserIDOfFCMToken", start, err)
+	return err
+}
+
+func (db dbProvider) UpdateOutboxPayload(id int64, payload []byte) error {
+	start := time.Now()
+	err := db.p.UpdateOutboxPayload(id, payload)
+	db.r.observe(storeSQL, "UpdateOutboxPayload", start, err)
+	return err
+}
+
+func (db dbProvider) UseSessionChallenge(id int64) (bool, error) {
+	start := time.Now()
+	r, err := db.p.UseSessionChallenge(id)
+	db.r.observe(storeSQL, "UseSessionChallenge", start, err)
+	return r, err
+}
+
+func (db dbProvider) User(username string) (*model.UserRecord, error) {
+	start := time.Now()
+	r, err := db.p.User(username)
+	db.r.observe(storeSQL, "User", start, err)
+	return r, err
+}
+
+func (db dbProvider) UserDataSummary(userID, now int64) (*model.UserDataSummary, error) {
+	start := time.Now()
+	r, err := db.p.UserDataSummary(userID, now)
+	db.r.observe(storeSQL, "UserDataSummary", start, err)
+	return r, err
+}
+
+func (db dbProvider) UserPublicKey(userID int64) ([]byte, error) {
+	start := time.Now()
+	r, err := db.p.UserPublicKey(userID)
+	db.r.observe(storeSQL, "UserPublicKey", start, err)
+	return r, err
+}
+
+func (db dbProvider) Username(userID int64) string {
+	start := time.Now()
+	r := db.p.Username(userID)
+	db.r.observe(storeSQL, "Username", start, nil)
+	return r
+}
+
+func (db dbProvider) UsernameAvailable(username string) (bool, error) {
+	start := time.Now()
+	r, err := db.p.UsernameAvailable(username)
+	db.r.observe(storeSQL, "UsernameAvailable", start, err)
+	return r, err
+}
+
+func (db dbProvider) UsernamesWithoutIndex() (map[int64]string, error) {
+	start := time.Now()
+	r, err := db.p.UsernamesWithoutIndex()
+	db.r.observe(storeSQL, "UsernamesWithoutIndex", start, err)
+	return r, err
+}
+
+func (db dbProvider) UsersWithIndexPrefix(prefix []byte, limit int) ([]model.UserIndexRecord, error) {
+	start := time.Now()
+	r, err := db.p.UsersWithIndexPrefix(prefix, limit)
+	db.r.observe(storeSQL, "UsersWithIndexPrefix", start, err)
+	return r, err
+}
+
+func (db dbProvider) VerifyEmail(email string, userID int64) error {
+	start := time.Now()
+	err := db.p.VerifyEmail(email, userID)
+	db.r.observe(storeSQL, "VerifyEmail", start, err)
+	return err
+}
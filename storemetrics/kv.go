@@ -0,0 +1,256 @@
+package storemetrics
+
+import (
+	"time"
+
+	"zood.dev/oscar/kvstor"
+)
+
+// storeKV names the kv storage in the metrics
+const storeKV = "kv"
+
+// kvProvider records the operations of a kvstor.Provider
+type kvProvider struct {
+	p kvstor.Provider
+	r *Recorder
+}
+
+// WrapKV returns a kvstor.Provider recording every operation of p in r
+func WrapKV(p kvstor.Provider, r *Recorder) kvstor.Provider {
+	return kvProvider{p: p, r: r}
+}
+
+func (kv kvProvider) DropPackage(pkg []byte, boxID []byte, expires int64) error {
+	start := time.Now()
+	err := kv.p.DropPackage(pkg, boxID, expires)
+	kv.r.observe(storeKV, "DropPackage", start, err)
+	return err
+}
+
+func (kv kvProvider) InsertIds(userID int64, pubID []byte) error {
+	start := time.Now()
+	err := kv.p.InsertIds(userID, pubID)
+	kv.r.observe(storeKV, "InsertIds", start, err)
+	return err
+}
+
+func (kv kvProvider) PickUpPackage(boxID []byte) ([]byte, error) {
+	start := time.Now()
+	r, err := kv.p.PickUpPackage(boxID)
+	kv.r.observe(storeKV, "PickUpPackage", start, err)
+	return r, err
+}
+
+func (kv kvProvider) PurgeExpiredPackages(now int64) (int, error) {
+	start := time.Now()
+	r, err := kv.p.PurgeExpiredPackages(now)
+	kv.r.observe(storeKV, "PurgeExpiredPackages", start, err)
+	return r, err
+}
+
+func (kv kvProvider) PublicIDFromUserID(userID int64) ([]byte, error) {
+	start := time.Now()
+	r, err := kv.p.PublicIDFromUserID(userID)
+	kv.r.observe(storeKV, "PublicIDFromUserID", start, err)
+	return r, err
+}
+
+func (kv kvProvider) UserIDFromPublicID(pubID []byte) (int64, error) {
+	start := time.Now()
+	r, err := kv.p.UserIDFromPublicID(pubID)
+	kv.r.observe(storeKV, "UserIDFromPublicID", start, err)
+	return r, err
+}
+
+// AddBoxAlias fulfills kvstor.BoxAliases
+func (kv kvProvider) AddBoxAlias(boxID, alias []byte, ownerID int64, graceUntil int64) error {
+	start := time.Now()
+	err := kv.p.AddBoxAlias(boxID, alias, ownerID, graceUntil)
+	kv.r.observe(storeKV, "AddBoxAlias", start, err)
+	return err
+}
+
+// BoxOfAlias fulfills kvstor.BoxAliases
+func (kv kvProvider) BoxOfAlias(alias []byte) ([]byte, error) {
+	start := time.Now()
+	r, err := kv.p.BoxOfAlias(alias)
+	kv.r.observe(storeKV, "BoxOfAlias", start, err)
+	return r, err
+}
+
+// PurgeExpiredBoxAliases fulfills kvstor.BoxAliases
+func (kv kvProvider) PurgeExpiredBoxAliases(now int64) (int, error) {
+	start := time.Now()
+	r, err := kv.p.PurgeExpiredBoxAliases(now)
+	kv.r.observe(storeKV, "PurgeExpiredBoxAliases", start, err)
+	return r, err
+}
+
+// ContentHash fulfills kvstor.ContentIndex
+func (kv kvProvider) ContentHash(name string) ([]byte, error) {
+	start := time.Now()
+	r, err := kv.p.ContentHash(name)
+	kv.r.observe(storeKV, "ContentHash", start, err)
+	return r, err
+}
+
+// ContentReferences fulfills kvstor.ContentIndex
+func (kv kvProvider) ContentReferences(hash []byte) (int64, error) {
+	start := time.Now()
+	r, err := kv.p.ContentReferences(hash)
+	kv.r.observe(storeKV, "ContentReferences", start, err)
+	return r, err
+}
+
+// LinkContent fulfills kvstor.ContentIndex
+func (kv kvProvider) LinkContent(name string, hash []byte) ([]byte, int64, error) {
+	start := time.Now()
+	old, oldRefs, err := kv.p.LinkContent(name, hash)
+	kv.r.observe(storeKV, "LinkContent", start, err)
+	return old, oldRefs, err
+}
+
+// UnlinkContent fulfills kvstor.ContentIndex
+func (kv kvProvider) UnlinkContent(name string) ([]byte, int64, error) {
+	start := time.Now()
+	old, oldRefs, err := kv.p.UnlinkContent(name)
+	kv.r.observe(storeKV, "UnlinkContent", start, err)
+	return old, oldRefs, err
+}
+
+// ContentNames fulfills kvstor.ContentIndex. The recorded latency includes
+// the time spent in fn.
+func (kv kvProvider) ContentNames(prefix string, fn func(name string) error) error {
+	start := time.Now()
+	err := kv.p.ContentNames(prefix, fn)
+	kv.r.observe(storeKV, "ContentNames", start, err)
+	return err
+}
+
+// StartDebugCapture fulfills kvstor.DebugCaptures
+func (kv kvProvider) StartDebugCapture(userID int64, until int64) error {
+	start := time.Now()
+	err := kv.p.StartDebugCapture(userID, until)
+	kv.r.observe(storeKV, "StartDebugCapture", start, err)
+	return err
+}
+
+// DebugCaptureUntil fulfills kvstor.DebugCaptures
+func (kv kvProvider) DebugCaptureUntil(userID int64) (int64, error) {
+	start := time.Now()
+	r, err := kv.p.DebugCaptureUntil(userID)
+	kv.r.observe(storeKV, "DebugCaptureUntil", start, err)
+	return r, err
+}
+
+// AppendDebugCapture fulfills kvstor.DebugCaptures
+func (kv kvProvider) AppendDebugCapture(userID int64, record []byte, max int) error {
+	start := time.Now()
+	err := kv.p.AppendDebugCapture(userID, record, max)
+	kv.r.observe(storeKV, "AppendDebugCapture", start, err)
+	return err
+}
+
+// DebugCapture fulfills kvstor.DebugCaptures
+func (kv kvProvider) DebugCapture(userID int64) ([][]byte, error) {
+	start := time.Now()
+	r, err := kv.p.DebugCapture(userID)
+	kv.r.observe(storeKV, "DebugCapture", start, err)
+	return r, err
+}
+
+// DeleteDebugCapture fulfills kvstor.DebugCaptures
+func (kv kvProvider) DeleteDebugCapture(userID int64) error {
+	start := time.Now()
+	err := kv.p.DeleteDebugCapture(userID)
+	kv.r.observe(storeKV, "DeleteDebugCapture", start, err)
+	return err
+}
+
+// QueueEmail fulfills kvstor.EmailQueue
+func (kv kvProvider) QueueEmail(id string, email []byte, due int64) error {
+	start := time.Now()
+	err := kv.p.QueueEmail(id, email, due)
+	kv.r.observe(storeKV, "QueueEmail", start, err)
+	return err
+}
+
+// DueEmails fulfills kvstor.EmailQueue
+func (kv kvProvider) DueEmails(now int64, max int) (map[string][]byte, error) {
+	start := time.Now()
+	r, err := kv.p.DueEmails(now, max)
+	kv.r.observe(storeKV, "DueEmails", start, err)
+	return r, err
+}
+
+// DequeueEmail fulfills kvstor.EmailQueue
+func (kv kvProvider) DequeueEmail(id string, deadLetter []byte) error {
+	start := time.Now()
+	err := kv.p.DequeueEmail(id, deadLetter)
+	kv.r.observe(storeKV, "DequeueEmail", start, err)
+	return err
+}
+
+// ReplaceQueuedEmail fulfills kvstor.EmailQueue
+func (kv kvProvider) ReplaceQueuedEmail(id string, email []byte) (bool, error) {
+	start := time.Now()
+	r, err := kv.p.ReplaceQueuedEmail(id, email)
+	kv.r.observe(storeKV, "ReplaceQueuedEmail", start, err)
+	return r, err
+}
+
+// DeadLetters fulfills kvstor.EmailQueue
+func (kv kvProvider) DeadLetters() (map[string][]byte, error) {
+	start := time.Now()
+	r, err := kv.p.DeadLetters()
+	kv.r.observe(storeKV, "DeadLetters", start, err)
+	return r, err
+}
+
+// DeleteDeadLetter fulfills kvstor.EmailQueue
+func (kv kvProvider) DeleteDeadLetter(id string) error {
+	start := time.Now()
+	err := kv.p.DeleteDeadLetter(id)
+	kv.r.observe(storeKV, "DeleteDeadLetter", start, err)
+	return err
+}
+
+// ReplaceDeadLetter fulfills kvstor.EmailQueue
+func (kv kvProvider) ReplaceDeadLetter(id string, deadLetter []byte) (bool, error) {
+	start := time.Now()
+	r, err := kv.p.ReplaceDeadLetter(id, deadLetter)
+	kv.r.observe(storeKV, "ReplaceDeadLetter", start, err)
+	return r, err
+}
+
+// SpendToken fulfills kvstor.SpentTokens
+func (kv kvProvider) SpendToken(id []byte, expires int64) (bool, error) {
+	start := time.Now()
+	r, err := kv.p.SpendToken(id, expires)
+	kv.r.observe(storeKV, "SpendToken", start, err)
+	return r, err
+}
+
+// PurgeSpentTokens fulfills kvstor.SpentTokens
+func (kv kvProvider) PurgeSpentTokens(now int64) (int, error) {
+	start := time.Now()
+	r, err := kv.p.PurgeSpentTokens(now)
+	kv.r.observe(storeKV, "PurgeSpentTokens", start, err)
+	return r, err
+}
+
+// Incident fulfills kvstor.IncidentNotice
+func (kv kvProvider) Incident() ([]byte, error) {
+	start := time.Now()
+	r, err := kv.p.Incident()
+	kv.r.observe(storeKV, "Incident", start, err)
+	return r, err
+}
+
+// SetIncident fulfills kvstor.IncidentNotice
+func (kv kvProvider) SetIncident(notice []byte) error {
+	start := time.Now()
+	err := kv.p.SetIncident(notice)
+	kv.r.observe(storeKV, "SetIncident", start, err)
+	return err
+}
@@ -0,0 +1,123 @@
+// Package storemetrics wraps the relational and kv storage providers, so the
+// latency of every operation is recorded in a histogram, and slow operations
+// are reported.
+package storemetrics
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Buckets are the upper bounds of the latency histograms
+var Buckets = []time.Duration{
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// Recorder collects the latencies of the operations of wrapped providers.
+// It's safe for concurrent use.
+type Recorder struct {
+	// SlowThreshold is the latency over which OnSlow is called. Zero never
+	// calls it.
+	SlowThreshold time.Duration
+	// OnSlow is called with every operation slower than SlowThreshold
+	OnSlow func(store, op string, elapsed time.Duration, err error)
+
+	mu  sync.Mutex
+	ops map[opKey]*opStats
+}
+
+type opKey struct {
+	store, op string
+}
+
+type opStats struct {
+	// counts holds a count per bucket, and one for the operations slower
+	// than the last bucket. They aren't cumulative.
+	counts []uint64
+	sum    time.Duration
+	errors uint64
+}
+
+// NewRecorder returns a Recorder calling onSlow with the operations slower
+// than slowThreshold
+func NewRecorder(slowThreshold time.Duration, onSlow func(store, op string, elapsed time.Duration, err error)) *Recorder {
+	return &Recorder{SlowThreshold: slowThreshold, OnSlow: onSlow, ops: make(map[opKey]*opStats)}
+}
+
+// Observe records that op of store took elapsed, and failed with err if it's
+// not nil
+func (r *Recorder) Observe(store, op string, elapsed time.Duration, err error) {
+	bucket := sort.Search(len(Buckets), func(i int) bool { return elapsed <= Buckets[i] })
+
+	r.mu.Lock()
+	key := opKey{store, op}
+	s := r.ops[key]
+	if s == nil {
+		s = &opStats{counts: make([]uint64, len(Buckets)+1)}
+		r.ops[key] = s
+	}
+	s.counts[bucket]++
+	s.sum += elapsed
+	if err != nil {
+		s.errors++
+	}
+	r.mu.Unlock()
+
+	if r.SlowThreshold > 0 && elapsed > r.SlowThreshold && r.OnSlow != nil {
+		r.OnSlow(store, op, elapsed, err)
+	}
+}
+
+// observe records an operation that started at start
+func (r *Recorder) observe(store, op string, start time.Time, err error) {
+	r.Observe(store, op, time.Since(start), err)
+}
+
+// OpStats are the totals of one operation of a store
+type OpStats struct {
+	Store string
+	Op    string
+	// Cumulative holds, for each of Buckets, the count of operations that
+	// took at most that long
+	Cumulative []uint64
+	Count      uint64
+	Sum        time.Duration
+	Errors     uint64
+}
+
+// Snapshot returns the totals of every operation recorded so far, ordered
+// by store and operation
+func (r *Recorder) Snapshot() []OpStats {
+	r.mu.Lock()
+	stats := make([]OpStats, 0, len(r.ops))
+	for key, s := range r.ops {
+		os := OpStats{Store: key.store, Op: key.op, Cumulative: make([]uint64, len(Buckets)), Sum: s.sum, Errors: s.errors}
+		for i, c := range s.counts {
+			os.Count += c
+			if i < len(Buckets) {
+				os.Cumulative[i] = os.Count
+			}
+		}
+		stats = append(stats, os)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Store != stats[j].Store {
+			return stats[i].Store < stats[j].Store
+		}
+		return stats[i].Op < stats[j].Op
+	})
+	return stats
+}
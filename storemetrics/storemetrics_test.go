@@ -0,0 +1,78 @@
+package storemetrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/memkv"
+)
+
+func TestRecorderHistogram(t *testing.T) {
+	r := NewRecorder(0, nil)
+	r.Observe("kv", "PickUpPackage", 200*time.Microsecond, nil)
+	r.Observe("kv", "PickUpPackage", 3*time.Millisecond, nil)
+	r.Observe("kv", "PickUpPackage", time.Minute, errors.New("disk full"))
+	r.Observe("sql", "User", time.Millisecond, nil)
+
+	stats := r.Snapshot()
+	require.Len(t, stats, 2)
+	kv := stats[0]
+	require.Equal(t, "kv", kv.Store)
+	require.Equal(t, "PickUpPackage", kv.Op)
+	require.Equal(t, uint64(3), kv.Count)
+	require.Equal(t, uint64(1), kv.Errors)
+	require.Equal(t, time.Minute+3200*time.Microsecond, kv.Sum)
+	// 500µs, 1ms, 5ms ... 5s
+	require.Equal(t, []uint64{1, 1, 2, 2, 2, 2, 2, 2, 2, 2, 2}, kv.Cumulative)
+
+	// a latency equal to a bound falls in that bucket
+	require.Equal(t, "User", stats[1].Op)
+	require.Equal(t, uint64(0), stats[1].Cumulative[0])
+	require.Equal(t, uint64(1), stats[1].Cumulative[1])
+}
+
+func TestRecorderSlow(t *testing.T) {
+	type slowOp struct {
+		op  string
+		err error
+	}
+	var slow []slowOp
+	r := NewRecorder(100*time.Millisecond, func(store, op string, elapsed time.Duration, err error) {
+		slow = append(slow, slowOp{op, err})
+	})
+	r.Observe("kv", "InsertIds", 100*time.Millisecond, nil)
+	r.Observe("kv", "DropPackage", 150*time.Millisecond, nil)
+	failure := errors.New("timeout")
+	r.Observe("kv", "PickUpPackage", time.Second, failure)
+	require.Equal(t, []slowOp{{"DropPackage", nil}, {"PickUpPackage", failure}}, slow)
+
+	// zero turns the reports off
+	slow = nil
+	r.SlowThreshold = 0
+	r.Observe("kv", "DropPackage", time.Hour, nil)
+	require.Nil(t, slow)
+}
+
+func TestWrapKV(t *testing.T) {
+	r := NewRecorder(0, nil)
+	kvs := WrapKV(memkv.New(), r)
+
+	require.NoError(t, kvs.InsertIds(7, []byte("public")))
+	userID, err := kvs.UserIDFromPublicID([]byte("public"))
+	require.NoError(t, err)
+	require.Equal(t, int64(7), userID)
+	_, _, err = kvs.LinkContent("a", []byte("hash"))
+	require.NoError(t, err)
+	_, _, err = kvs.LinkContent("b", []byte("hash"))
+	require.NoError(t, err)
+
+	stats := r.Snapshot()
+	ops := make(map[string]uint64)
+	for _, s := range stats {
+		require.Equal(t, storeKV, s.Store)
+		ops[s.Op] = s.Count
+	}
+	require.Equal(t, map[string]uint64{"InsertIds": 1, "UserIDFromPublicID": 1, "LinkContent": 2}, ops)
+}
@@ -0,0 +1,133 @@
+// Package usercache provides a model.Provider that keeps recently looked up
+// usernames and public keys in memory, in front of another model.Provider.
+package usercache
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"zood.dev/oscar/model"
+)
+
+// Provider caches the per-user lookups that happen on every message send
+// and user info request. Entries expire after the TTL, and must be
+// invalidated via InvalidateUser whenever a user's username or public key
+// changes, or the user is deleted.
+type Provider struct {
+	model.Provider
+	c *cache
+}
+
+// cache is shared by a Provider and all the copies made by WithContext
+type cache struct {
+	hits   uint64
+	misses uint64
+
+	mu         sync.Mutex
+	entries    map[int64]entry
+	maxEntries int
+	ttl        time.Duration
+	now        func() time.Time
+}
+
+type entry struct {
+	username  string
+	publicKey []byte
+	expires   time.Time
+}
+
+// New returns a Provider caching up to maxEntries users for ttl
+func New(db model.Provider, ttl time.Duration, maxEntries int) *Provider {
+	return &Provider{
+		Provider: db,
+		c: &cache{
+			entries:    make(map[int64]entry),
+			maxEntries: maxEntries,
+			ttl:        ttl,
+			now:        time.Now,
+		},
+	}
+}
+
+// WithContext fulfills model.Provider. The returned provider shares the cache.
+func (p *Provider) WithContext(ctx context.Context) model.Provider {
+	return &Provider{Provider: p.Provider.WithContext(ctx), c: p.c}
+}
+
+// Stats returns the number of lookups served from, and missed by, the cache
+func (p *Provider) Stats() (hits, misses uint64) {
+	return atomic.LoadUint64(&p.c.hits), atomic.LoadUint64(&p.c.misses)
+}
+
+// InvalidateUser drops anything cached about userID
+func (p *Provider) InvalidateUser(userID int64) {
+	p.c.mu.Lock()
+	delete(p.c.entries, userID)
+	p.c.mu.Unlock()
+}
+
+// lookup returns the cached entry for userID, loading it from the
+// underlying provider on a miss. Users that don't exist aren't cached, and
+// result in an empty entry.
+func (p *Provider) lookup(userID int64) (entry, error) {
+	c := p.c
+	now := c.now()
+	c.mu.Lock()
+	e, ok := c.entries[userID]
+	c.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		atomic.AddUint64(&c.hits, 1)
+		return e, nil
+	}
+	atomic.AddUint64(&c.misses, 1)
+
+	username, pubKey, err := p.Provider.LimitedUserInfoID(userID)
+	if err != nil || pubKey == nil {
+		return entry{}, err
+	}
+	e = entry{username: username, publicKey: pubKey, expires: now.Add(c.ttl)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.maxEntries {
+		c.evict(now)
+	}
+	c.entries[userID] = e
+	return e, nil
+}
+
+// evict drops expired entries, or if there aren't any, an arbitrary one.
+// Must be called with mu held.
+func (c *cache) evict(now time.Time) {
+	for id, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, id)
+		}
+	}
+	for id := range c.entries {
+		if len(c.entries) < c.maxEntries {
+			return
+		}
+		delete(c.entries, id)
+	}
+}
+
+// LimitedUserInfoID fulfills model.Provider
+func (p *Provider) LimitedUserInfoID(userID int64) (username string, pubKey []byte, err error) {
+	e, err := p.lookup(userID)
+	return e.username, e.publicKey, err
+}
+
+// Username fulfills model.Provider
+func (p *Provider) Username(userID int64) string {
+	e, _ := p.lookup(userID)
+	return e.username
+}
+
+// UserPublicKey fulfills model.Provider
+func (p *Provider) UserPublicKey(userID int64) ([]byte, error) {
+	e, err := p.lookup(userID)
+	return e.publicKey, err
+}
@@ -0,0 +1,71 @@
+package usercache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"zood.dev/oscar/model"
+	"zood.dev/oscar/sqlite"
+)
+
+func insertUser(t *testing.T, db model.Provider, username string) int64 {
+	t.Helper()
+
+	id, err := db.InsertUser(model.UserRecord{
+		Username:                    username,
+		PublicKey:                   []byte("public-key"),
+		WrappedSecretKey:            []byte("wrapped-secret-key"),
+		WrappedSecretKeyNonce:       []byte("wrapped-secret-key-nonce"),
+		WrappedSymmetricKey:         []byte("wrapped-symmetric-key"),
+		WrappedSymmetricKeyNonce:    []byte("wrapped-symmetric-key-nonce"),
+		PasswordSalt:                []byte("salt"),
+		PasswordHashAlgorithm:       "argon2id13",
+		PasswordHashOperationsLimit: 1,
+		PasswordHashMemoryLimit:     1,
+	}, nil)
+	require.NoError(t, err)
+	return id
+}
+
+func TestCache(t *testing.T) {
+	db := sqlite.NewMockDB(t)
+	userID := insertUser(t, db, "cacheduser")
+
+	now := time.Now()
+	p := New(db, time.Minute, 10)
+	p.c.now = func() time.Time { return now }
+
+	require.Equal(t, "cacheduser", p.Username(userID))
+	pubKey, err := p.UserPublicKey(userID)
+	require.NoError(t, err)
+	require.Equal(t, []byte("public-key"), pubKey)
+	hits, misses := p.Stats()
+	require.Equal(t, uint64(1), hits)
+	require.Equal(t, uint64(1), misses)
+
+	// expired entries are reloaded
+	now = now.Add(time.Minute)
+	p.Username(userID)
+	_, misses = p.Stats()
+	require.Equal(t, uint64(2), misses)
+
+	// as are invalidated ones
+	p.InvalidateUser(userID)
+	p.Username(userID)
+	_, misses = p.Stats()
+	require.Equal(t, uint64(3), misses)
+
+	// missing users aren't cached
+	require.Empty(t, p.Username(userID+100))
+	require.Len(t, p.c.entries, 1)
+}
+
+func TestCacheEviction(t *testing.T) {
+	db := sqlite.NewMockDB(t)
+	p := New(db, time.Minute, 2)
+	for _, name := range []string{"firstuser", "seconduser", "thirduser"} {
+		p.Username(insertUser(t, db, name))
+	}
+	require.Len(t, p.c.entries, 2)
+}